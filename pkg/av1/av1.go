@@ -0,0 +1,596 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package av1
+
+import (
+	"github.com/q191201771/naza/pkg/nazabits"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// AV1 bitstream:
+//   av1-spec.pdf
+//   数据由OBU(Open Bitstream Unit)组成，一个TU(Temporal Unit)对应一帧。
+//   rtmp/flv、mp4中使用Low Overhead Bitstream Format，也即每个OBU都带有obu_size字段。
+//
+// av1C:
+//   AV1-ISOBMFF.pdf, 2.3. AV1 Codec Configuration Box
+//   enhanced-rtmp av01的SequenceStart中的数据。
+
+// OBU Header
+//
+// +---------------+
+// |0|1|2|3|4|5|6|7|
+// +-+-+-+-+-+-+-+-+
+// |F| type  |X|S|R|
+// +---------------+
+//
+// X为1时，后面还有1字节的extension header:
+//
+// +---------------+
+// |0|1|2|3|4|5|6|7|
+// +-+-+-+-+-+-+-+-+
+// | TID | SID | R |
+// +---------------+
+
+const (
+	ObuTypeSequenceHeader       uint8 = 1
+	ObuTypeTemporalDelimiter    uint8 = 2
+	ObuTypeFrameHeader          uint8 = 3
+	ObuTypeTileGroup            uint8 = 4
+	ObuTypeMetadata             uint8 = 5
+	ObuTypeFrame                uint8 = 6
+	ObuTypeRedundantFrameHeader uint8 = 7
+	ObuTypeTileList             uint8 = 8
+	ObuTypePadding              uint8 = 15
+)
+
+const (
+	FrameTypeKey       uint8 = 0
+	FrameTypeInter     uint8 = 1
+	FrameTypeIntraOnly uint8 = 2
+	FrameTypeSwitch    uint8 = 3
+)
+
+type ObuHeader struct {
+	Type         uint8
+	HasExtension bool
+	HasSizeField bool
+	TemporalId   uint8
+	SpatialId    uint8
+}
+
+// Context 从sequence header OBU中解析出的信息
+type Context struct {
+	SeqProfile                uint8
+	StillPicture              uint8
+	ReducedStillPictureHeader uint8
+	SeqLevelIdx0              uint8
+	SeqTier0                  uint8
+	HighBitdepth              uint8
+	TwelveBit                 uint8
+	MonoChrome                uint8
+	ChromaSubsamplingX        uint8
+	ChromaSubsamplingY        uint8
+	ChromaSamplePosition      uint8
+	Width                     uint32
+	Height                    uint32
+}
+
+// ParseObuHeader
+//
+// @return headerSize: OBU header的大小，1或2
+func ParseObuHeader(b []byte) (h ObuHeader, headerSize int, err error) {
+	if len(b) < 1 {
+		return h, 0, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	if b[0]&0x80 != 0 {
+		// obu_forbidden_bit
+		return h, 0, nazaerrors.Wrap(base.ErrAv1)
+	}
+
+	h.Type = (b[0] >> 3) & 0x0F
+	h.HasExtension = b[0]&0x04 != 0
+	h.HasSizeField = b[0]&0x02 != 0
+	headerSize = 1
+	if h.HasExtension {
+		if len(b) < 2 {
+			return h, 0, nazaerrors.Wrap(base.ErrShortBuffer)
+		}
+		h.TemporalId = b[1] >> 5
+		h.SpatialId = (b[1] >> 3) & 0x03
+		headerSize = 2
+	}
+	return
+}
+
+// ParseObuType 注意，调用方保证`v`为OBU的第一个字节
+func ParseObuType(v uint8) uint8 {
+	return (v >> 3) & 0x0F
+}
+
+// ParseObu 解析一个OBU
+//
+// @param obu: 如果不带obu_size字段，则认为整个`obu`就是一个OBU
+//
+// @return payload: 不包含header和obu_size字段，复用传入参数`obu`的内存块
+// @return obuSize: 该OBU的总大小，包含header和obu_size字段
+func ParseObu(obu []byte) (h ObuHeader, payload []byte, obuSize int, err error) {
+	var headerSize int
+	if h, headerSize, err = ParseObuHeader(obu); err != nil {
+		return
+	}
+
+	if !h.HasSizeField {
+		return h, obu[headerSize:], len(obu), nil
+	}
+
+	size, n, err := ReadLeb128(obu[headerSize:])
+	if err != nil {
+		return
+	}
+	obuSize = headerSize + n + int(size)
+	if obuSize > len(obu) {
+		return h, nil, 0, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	return h, obu[headerSize+n : obuSize], obuSize, nil
+}
+
+// SplitObu 将Low Overhead Bitstream Format格式的TU拆分成多个OBU
+//
+// @return 复用传入参数`tu`的内存块，每个OBU包含header和obu_size字段
+func SplitObu(tu []byte) (obus [][]byte, err error) {
+	err = IterateObu(tu, func(obu []byte) {
+		obus = append(obus, obu)
+	})
+	return
+}
+
+func IterateObu(tu []byte, handler func(obu []byte)) error {
+	for i := 0; i != len(tu); {
+		_, _, obuSize, err := ParseObu(tu[i:])
+		if err != nil {
+			return err
+		}
+		handler(tu[i : i+obuSize])
+		i += obuSize
+	}
+	return nil
+}
+
+// PackObu 将OBU打包成带或不带obu_size字段的格式
+//
+// @return 内存块为内部独立新申请
+func PackObu(h ObuHeader, payload []byte, withSizeField bool) []byte {
+	out := make([]byte, 0, 2+Leb128Size(uint64(len(payload)))+len(payload))
+	b0 := h.Type << 3
+	if h.HasExtension {
+		b0 |= 0x04
+	}
+	if withSizeField {
+		b0 |= 0x02
+	}
+	out = append(out, b0)
+	if h.HasExtension {
+		out = append(out, h.TemporalId<<5|(h.SpatialId&0x03)<<3)
+	}
+	if withSizeField {
+		out = AppendLeb128(out, uint64(len(payload)))
+	}
+	return append(out, payload...)
+}
+
+// IsKeyTemporalUnit TU中包含sequence header，并且第一个帧是显示的关键帧
+//
+// @param tu: Low Overhead Bitstream Format格式
+func IsKeyTemporalUnit(tu []byte) bool {
+	var ctx *Context
+	isKey := false
+	frameChecked := false
+	_ = IterateObu(tu, func(obu []byte) {
+		if frameChecked {
+			return
+		}
+		h, payload, _, err := ParseObu(obu)
+		if err != nil {
+			return
+		}
+		switch h.Type {
+		case ObuTypeSequenceHeader:
+			var c Context
+			if ParseSequenceHeader(payload, &c) == nil {
+				ctx = &c
+			}
+		case ObuTypeFrame, ObuTypeFrameHeader:
+			frameChecked = true
+			if ctx == nil {
+				return
+			}
+			if ctx.ReducedStillPictureHeader == 1 {
+				isKey = true
+				return
+			}
+			if len(payload) < 1 {
+				return
+			}
+			// show_existing_frame f(1), frame_type f(2)
+			showExistingFrame := payload[0] >> 7
+			frameType := (payload[0] >> 5) & 0x03
+			isKey = showExistingFrame == 0 && frameType == FrameTypeKey
+		}
+	})
+	return isKey
+}
+
+// HasSequenceHeaderObu TU中是否包含sequence header OBU
+//
+// @param tu: Low Overhead Bitstream Format格式
+func HasSequenceHeaderObu(tu []byte) bool {
+	has := false
+	_ = IterateObu(tu, func(obu []byte) {
+		if len(obu) > 0 && ParseObuType(obu[0]) == ObuTypeSequenceHeader {
+			has = true
+		}
+	})
+	return has
+}
+
+// ParseSequenceHeader
+//
+// av1-spec.pdf, 5.5. Sequence header OBU syntax
+//
+// @param payload: sequence header OBU的payload部分，不包含header和obu_size字段
+func ParseSequenceHeader(payload []byte, ctx *Context) error {
+	br := nazabits.NewBitReader(payload)
+
+	ctx.SeqProfile, _ = br.ReadBits8(3)
+	ctx.StillPicture, _ = br.ReadBit()
+	ctx.ReducedStillPictureHeader, _ = br.ReadBit()
+
+	if ctx.ReducedStillPictureHeader == 1 {
+		ctx.SeqLevelIdx0, _ = br.ReadBits8(5)
+	} else {
+		var decoderModelInfoPresentFlag uint8
+		var bufferDelayLengthMinus1 uint8
+
+		timingInfoPresentFlag, _ := br.ReadBit()
+		if timingInfoPresentFlag == 1 {
+			// timing_info()
+			_ = br.SkipBits(32) // num_units_in_display_tick
+			_ = br.SkipBits(32) // time_scale
+			equalPictureInterval, _ := br.ReadBit()
+			if equalPictureInterval == 1 {
+				if _, err := readUvlc(&br); err != nil {
+					return nazaerrors.Wrap(base.ErrAv1)
+				}
+			}
+
+			decoderModelInfoPresentFlag, _ = br.ReadBit()
+			if decoderModelInfoPresentFlag == 1 {
+				// decoder_model_info()
+				bufferDelayLengthMinus1, _ = br.ReadBits8(5)
+				_ = br.SkipBits(32) // num_units_in_decoding_tick
+				_ = br.SkipBits(5)  // buffer_removal_time_length_minus_1
+				_ = br.SkipBits(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+
+		initialDisplayDelayPresentFlag, _ := br.ReadBit()
+		operatingPointsCntMinus1, _ := br.ReadBits8(5)
+		for i := 0; i <= int(operatingPointsCntMinus1); i++ {
+			_ = br.SkipBits(12) // operating_point_idc[i]
+			seqLevelIdx, _ := br.ReadBits8(5)
+			var seqTier uint8
+			if seqLevelIdx > 7 {
+				seqTier, _ = br.ReadBit()
+			}
+			if i == 0 {
+				ctx.SeqLevelIdx0 = seqLevelIdx
+				ctx.SeqTier0 = seqTier
+			}
+
+			if decoderModelInfoPresentFlag == 1 {
+				decoderModelPresentForThisOp, _ := br.ReadBit()
+				if decoderModelPresentForThisOp == 1 {
+					// operating_parameters_info(i)
+					n := uint(bufferDelayLengthMinus1) + 1
+					_ = br.SkipBits(n) // decoder_buffer_delay[op]
+					_ = br.SkipBits(n) // encoder_buffer_delay[op]
+					_ = br.SkipBits(1) // low_delay_mode_flag[op]
+				}
+			}
+			if initialDisplayDelayPresentFlag == 1 {
+				initialDisplayDelayPresentForThisOp, _ := br.ReadBit()
+				if initialDisplayDelayPresentForThisOp == 1 {
+					_ = br.SkipBits(4) // initial_display_delay_minus_1[i]
+				}
+			}
+		}
+	}
+
+	frameWidthBitsMinus1, _ := br.ReadBits8(4)
+	frameHeightBitsMinus1, _ := br.ReadBits8(4)
+	maxFrameWidthMinus1, _ := br.ReadBits32(uint(frameWidthBitsMinus1) + 1)
+	maxFrameHeightMinus1, _ := br.ReadBits32(uint(frameHeightBitsMinus1) + 1)
+	ctx.Width = maxFrameWidthMinus1 + 1
+	ctx.Height = maxFrameHeightMinus1 + 1
+
+	if ctx.ReducedStillPictureHeader == 0 {
+		frameIdNumbersPresentFlag, _ := br.ReadBit()
+		if frameIdNumbersPresentFlag == 1 {
+			_ = br.SkipBits(4) // delta_frame_id_length_minus_2
+			_ = br.SkipBits(3) // additional_frame_id_length_minus_1
+		}
+	}
+
+	_ = br.SkipBits(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+
+	if ctx.ReducedStillPictureHeader == 0 {
+		_ = br.SkipBits(4) // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+		enableOrderHint, _ := br.ReadBit()
+		if enableOrderHint == 1 {
+			_ = br.SkipBits(2) // enable_jnt_comp, enable_ref_frame_mvs
+		}
+		seqChooseScreenContentTools, _ := br.ReadBit()
+		seqForceScreenContentTools := uint8(2) // SELECT_SCREEN_CONTENT_TOOLS
+		if seqChooseScreenContentTools == 0 {
+			seqForceScreenContentTools, _ = br.ReadBit()
+		}
+		if seqForceScreenContentTools > 0 {
+			seqChooseIntegerMv, _ := br.ReadBit()
+			if seqChooseIntegerMv == 0 {
+				_ = br.SkipBits(1) // seq_force_integer_mv
+			}
+		}
+		if enableOrderHint == 1 {
+			_ = br.SkipBits(3) // order_hint_bits_minus_1
+		}
+	}
+
+	_ = br.SkipBits(3) // enable_superres, enable_cdef, enable_restoration
+
+	// color_config()
+	ctx.HighBitdepth, _ = br.ReadBit()
+	bitDepth := 8
+	if ctx.SeqProfile == 2 && ctx.HighBitdepth == 1 {
+		ctx.TwelveBit, _ = br.ReadBit()
+		if ctx.TwelveBit == 1 {
+			bitDepth = 12
+		} else {
+			bitDepth = 10
+		}
+	} else if ctx.HighBitdepth == 1 {
+		bitDepth = 10
+	}
+	if ctx.SeqProfile != 1 {
+		ctx.MonoChrome, _ = br.ReadBit()
+	}
+	colorPrimaries, transferCharacteristics, matrixCoefficients := uint8(2), uint8(2), uint8(2)
+	colorDescriptionPresentFlag, _ := br.ReadBit()
+	if colorDescriptionPresentFlag == 1 {
+		colorPrimaries, _ = br.ReadBits8(8)
+		transferCharacteristics, _ = br.ReadBits8(8)
+		matrixCoefficients, _ = br.ReadBits8(8)
+	}
+	if ctx.MonoChrome == 1 {
+		ctx.ChromaSubsamplingX, ctx.ChromaSubsamplingY = 1, 1
+	} else if colorPrimaries == 1 && transferCharacteristics == 13 && matrixCoefficients == 0 {
+		// sRGB
+		ctx.ChromaSubsamplingX, ctx.ChromaSubsamplingY = 0, 0
+	} else {
+		_ = br.SkipBits(1) // color_range
+		switch ctx.SeqProfile {
+		case 0:
+			ctx.ChromaSubsamplingX, ctx.ChromaSubsamplingY = 1, 1
+		case 1:
+			ctx.ChromaSubsamplingX, ctx.ChromaSubsamplingY = 0, 0
+		default:
+			if bitDepth == 12 {
+				ctx.ChromaSubsamplingX, _ = br.ReadBit()
+				if ctx.ChromaSubsamplingX == 1 {
+					ctx.ChromaSubsamplingY, _ = br.ReadBit()
+				}
+			} else {
+				ctx.ChromaSubsamplingX, ctx.ChromaSubsamplingY = 1, 0
+			}
+		}
+		if ctx.ChromaSubsamplingX == 1 && ctx.ChromaSubsamplingY == 1 {
+			ctx.ChromaSamplePosition, _ = br.ReadBits8(2)
+		}
+	}
+
+	if br.Err() != nil {
+		return nazaerrors.Wrap(base.ErrAv1)
+	}
+	return nil
+}
+
+// BuildAv1c 生成AV1CodecConfigurationRecord
+//
+// AV1-ISOBMFF.pdf, 2.3.3. Syntax
+//
+//	aligned (8) class AV1CodecConfigurationRecord {
+//	  unsigned int (1) marker = 1;
+//	  unsigned int (7) version = 1;
+//	  unsigned int (3) seq_profile;
+//	  unsigned int (5) seq_level_idx_0;
+//	  unsigned int (1) seq_tier_0;
+//	  unsigned int (1) high_bitdepth;
+//	  unsigned int (1) twelve_bit;
+//	  unsigned int (1) monochrome;
+//	  unsigned int (1) chroma_subsampling_x;
+//	  unsigned int (1) chroma_subsampling_y;
+//	  unsigned int (2) chroma_sample_position;
+//	  unsigned int (3) reserved = 0;
+//	  unsigned int (1) initial_presentation_delay_present;
+//	  unsigned int (4) initial_presentation_delay_minus_one / reserved;
+//	  unsigned int (8) configOBUs[];
+//	}
+//
+// @param seqHeaderObu: 完整的sequence header OBU，带不带obu_size字段都可以
+//
+// @return 内存块为内部独立新申请
+func BuildAv1c(seqHeaderObu []byte) ([]byte, error) {
+	h, payload, _, err := ParseObu(seqHeaderObu)
+	if err != nil {
+		return nil, err
+	}
+	if h.Type != ObuTypeSequenceHeader {
+		return nil, nazaerrors.Wrap(base.ErrAv1)
+	}
+	var ctx Context
+	if err = ParseSequenceHeader(payload, &ctx); err != nil {
+		return nil, err
+	}
+
+	// configOBUs中的OBU必须带obu_size字段
+	obu := PackObu(h, payload, true)
+
+	out := make([]byte, 4+len(obu))
+	out[0] = 0x81
+	out[1] = ctx.SeqProfile<<5 | ctx.SeqLevelIdx0&0x1F
+	out[2] = ctx.SeqTier0<<7 | ctx.HighBitdepth<<6 | ctx.TwelveBit<<5 | ctx.MonoChrome<<4 |
+		ctx.ChromaSubsamplingX<<3 | ctx.ChromaSubsamplingY<<2 | ctx.ChromaSamplePosition&0x03
+	out[3] = 0
+	copy(out[4:], obu)
+	return out, nil
+}
+
+// ParseSequenceHeaderObuFromAv1c 从av1C中获取sequence header OBU
+//
+// @return 复用传入参数`av1c`的内存块，带obu_size字段
+func ParseSequenceHeaderObuFromAv1c(av1c []byte) ([]byte, error) {
+	if len(av1c) < 4 {
+		return nil, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	if av1c[0] != 0x81 {
+		return nil, nazaerrors.Wrap(base.ErrAv1)
+	}
+
+	var ret []byte
+	err := IterateObu(av1c[4:], func(obu []byte) {
+		if ret == nil && ParseObuType(obu[0]) == ObuTypeSequenceHeader {
+			ret = obu
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ret == nil {
+		return nil, nazaerrors.Wrap(base.ErrAv1)
+	}
+	return ret, nil
+}
+
+// BuildSeqHeaderFromSequenceHeaderObu 生成enhanced-rtmp av01的SequenceStart
+//
+// @return 内存块为内部独立新申请
+func BuildSeqHeaderFromSequenceHeaderObu(seqHeaderObu []byte) ([]byte, error) {
+	av1c, err := BuildAv1c(seqHeaderObu)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 5+len(av1c))
+	out[0] = 0x80 | base.RtmpExFrameTypeKeyFrame<<4 | base.RtmpExPacketTypeSequenceStart
+	copy(out[1:], base.RtmpExFourCcAv1)
+	copy(out[5:], av1c)
+	return out, nil
+}
+
+// ParseSequenceHeaderObuFromSeqHeader
+//
+// @param payload: enhanced-rtmp av01的SequenceStart，rtmp message的payload部分或者flv tag的payload部分
+//
+// @return 复用传入参数`payload`的内存块
+func ParseSequenceHeaderObuFromSeqHeader(payload []byte) ([]byte, error) {
+	if len(payload) < 5 {
+		return nil, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	return ParseSequenceHeaderObuFromAv1c(payload[5:])
+}
+
+// ParseContextFromSeqHeader 从enhanced-rtmp av01的SequenceStart中解析出宽高等信息
+func ParseContextFromSeqHeader(payload []byte, ctx *Context) error {
+	obu, err := ParseSequenceHeaderObuFromSeqHeader(payload)
+	if err != nil {
+		return err
+	}
+	_, seqPayload, _, err := ParseObu(obu)
+	if err != nil {
+		return err
+	}
+	return ParseSequenceHeader(seqPayload, ctx)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// ReadLeb128
+//
+// av1-spec.pdf, 4.10.5. leb128
+//
+// @return n: leb128占用的字节数
+func ReadLeb128(b []byte) (v uint64, n int, err error) {
+	for i := 0; i < 8; i++ {
+		if i >= len(b) {
+			return 0, 0, nazaerrors.Wrap(base.ErrShortBuffer)
+		}
+		v |= uint64(b[i]&0x7F) << (i * 7)
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, nazaerrors.Wrap(base.ErrAv1)
+}
+
+func AppendLeb128(out []byte, v uint64) []byte {
+	for {
+		b := uint8(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
+
+func Leb128Size(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// readUvlc av1-spec.pdf, 4.10.3. uvlc()
+func readUvlc(br *nazabits.BitReader) (uint32, error) {
+	leadingZeros := uint(0)
+	for {
+		b, err := br.ReadBit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		leadingZeros++
+	}
+	if leadingZeros >= 32 {
+		return 0xFFFFFFFF, nil
+	}
+	if leadingZeros == 0 {
+		return 0, nil
+	}
+	v, err := br.ReadBits32(leadingZeros)
+	if err != nil {
+		return 0, err
+	}
+	return v + (1 << leadingZeros) - 1, nil
+}
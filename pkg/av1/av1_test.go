@@ -0,0 +1,159 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package av1_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazabits"
+
+	"github.com/ysjhlnu/lal/pkg/av1"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// goldenSeqHeaderPayload 1920x1080，main profile，level 4.0(seq_level_idx 8)，8bit 4:2:0
+var goldenSeqHeaderPayload = buildSeqHeaderPayload()
+
+func buildSeqHeaderPayload() []byte {
+	b := make([]byte, 16)
+	bw := nazabits.NewBitWriter(b)
+	w := func(n uint, v uint16) {
+		bw.WriteBits16(n, v)
+	}
+	w(3, 0)     // seq_profile
+	w(1, 0)     // still_picture
+	w(1, 0)     // reduced_still_picture_header
+	w(1, 0)     // timing_info_present_flag
+	w(1, 0)     // initial_display_delay_present_flag
+	w(5, 0)     // operating_points_cnt_minus_1
+	w(12, 0)    // operating_point_idc[0]
+	w(5, 8)     // seq_level_idx[0]
+	w(1, 0)     // seq_tier[0]
+	w(4, 10)    // frame_width_bits_minus_1
+	w(4, 10)    // frame_height_bits_minus_1
+	w(11, 1919) // max_frame_width_minus_1
+	w(11, 1079) // max_frame_height_minus_1
+	w(1, 0)     // frame_id_numbers_present_flag
+	w(3, 7)     // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	w(4, 15)    // enable_interintra_compound, enable_masked_compound, enable_warped_motion, enable_dual_filter
+	w(1, 1)     // enable_order_hint
+	w(2, 3)     // enable_jnt_comp, enable_ref_frame_mvs
+	w(1, 1)     // seq_choose_screen_content_tools
+	w(1, 1)     // seq_choose_integer_mv
+	w(3, 6)     // order_hint_bits_minus_1
+	w(3, 7)     // enable_superres, enable_cdef, enable_restoration
+	w(1, 0)     // high_bitdepth
+	w(1, 0)     // mono_chrome
+	w(1, 0)     // color_description_present_flag
+	w(1, 0)     // color_range
+	w(2, 0)     // chroma_sample_position
+	w(1, 0)     // separate_uv_delta_q
+	w(1, 0)     // film_grain_params_present
+	w(1, 1)     // trailing_one_bit
+	return b[:13]
+}
+
+func TestParseSequenceHeader(t *testing.T) {
+	var ctx av1.Context
+	err := av1.ParseSequenceHeader(goldenSeqHeaderPayload, &ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(1920), ctx.Width)
+	assert.Equal(t, uint32(1080), ctx.Height)
+	assert.Equal(t, uint8(0), ctx.SeqProfile)
+	assert.Equal(t, uint8(8), ctx.SeqLevelIdx0)
+	assert.Equal(t, uint8(1), ctx.ChromaSubsamplingX)
+	assert.Equal(t, uint8(1), ctx.ChromaSubsamplingY)
+
+	err = av1.ParseSequenceHeader(goldenSeqHeaderPayload[:4], &ctx)
+	assert.IsNotNil(t, err)
+}
+
+func TestLeb128(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 300, 16383, 16384, 1 << 30} {
+		b := av1.AppendLeb128(nil, v)
+		assert.Equal(t, av1.Leb128Size(v), len(b))
+		r, n, err := av1.ReadLeb128(b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, v, r)
+		assert.Equal(t, len(b), n)
+	}
+	_, _, err := av1.ReadLeb128([]byte{0x80})
+	assert.IsNotNil(t, err)
+}
+
+func TestObu(t *testing.T) {
+	seqHeaderObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeSequenceHeader}, goldenSeqHeaderPayload, true)
+	// frame header: show_existing_frame=0, frame_type=KEY_FRAME
+	keyFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, []byte{0x10, 0x01, 0x02}, true)
+	interFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, []byte{0x30, 0x01, 0x02}, true)
+	tdObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeTemporalDelimiter}, nil, true)
+
+	var tu []byte
+	tu = append(tu, tdObu...)
+	tu = append(tu, seqHeaderObu...)
+	tu = append(tu, keyFrameObu...)
+	obus, err := av1.SplitObu(tu)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(obus))
+	assert.Equal(t, seqHeaderObu, obus[1])
+	h, payload, _, err := av1.ParseObu(obus[2])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, av1.ObuTypeFrame, h.Type)
+	assert.Equal(t, []byte{0x10, 0x01, 0x02}, payload)
+
+	assert.Equal(t, true, av1.IsKeyTemporalUnit(tu))
+	assert.Equal(t, false, av1.IsKeyTemporalUnit(interFrameObu))
+	assert.Equal(t, false, av1.IsKeyTemporalUnit(append(append([]byte{}, seqHeaderObu...), interFrameObu...)))
+	assert.Equal(t, true, av1.HasSequenceHeaderObu(tu))
+	assert.Equal(t, false, av1.HasSequenceHeaderObu(keyFrameObu))
+
+	// 带extension，不带obu_size
+	obu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame, HasExtension: true, TemporalId: 2, SpatialId: 1}, []byte{1, 2, 3}, false)
+	h, payload, size, err := av1.ParseObu(obu)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint8(2), h.TemporalId)
+	assert.Equal(t, uint8(1), h.SpatialId)
+	assert.Equal(t, false, h.HasSizeField)
+	assert.Equal(t, []byte{1, 2, 3}, payload)
+	assert.Equal(t, 5, size)
+
+	_, err = av1.SplitObu([]byte{0x0a, 0x05, 0x00})
+	assert.IsNotNil(t, err)
+}
+
+func TestSeqHeader(t *testing.T) {
+	seqHeaderObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeSequenceHeader}, goldenSeqHeaderPayload, false)
+	sh, err := av1.BuildSeqHeaderFromSequenceHeaderObu(seqHeaderObu)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0x90, 'a', 'v', '0', '1', 0x81, 0x08, 0x0c, 0x00}, sh[:9])
+
+	msg := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: sh,
+	}
+	assert.Equal(t, true, msg.IsAv1KeySeqHeader())
+	assert.Equal(t, true, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, false, msg.IsHevcKeySeqHeader())
+	assert.Equal(t, base.RtmpCodecIdAv1, msg.VideoCodecId())
+
+	obu, err := av1.ParseSequenceHeaderObuFromSeqHeader(sh)
+	assert.Equal(t, nil, err)
+	_, payload, _, err := av1.ParseObu(obu)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, goldenSeqHeaderPayload, payload)
+
+	var ctx av1.Context
+	err = av1.ParseContextFromSeqHeader(sh, &ctx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(1920), ctx.Width)
+
+	_, err = av1.BuildSeqHeaderFromSequenceHeaderObu(av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, goldenSeqHeaderPayload, true))
+	assert.IsNotNil(t, err)
+}
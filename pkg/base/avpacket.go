@@ -21,11 +21,14 @@ type AvPacketPt int
 
 const (
 	AvPacketPtUnknown AvPacketPt = -1
-	AvPacketPtG711U   AvPacketPt = 0  // g711u
-	AvPacketPtG711A   AvPacketPt = 8  // g711a
-	AvPacketPtAvc     AvPacketPt = 96 // h264
-	AvPacketPtHevc    AvPacketPt = 98 // h265
-	AvPacketPtAac     AvPacketPt = 97 // aac
+	AvPacketPtG711U   AvPacketPt = 0   // g711u
+	AvPacketPtG711A   AvPacketPt = 8   // g711a
+	AvPacketPtAvc     AvPacketPt = 96  // h264
+	AvPacketPtHevc    AvPacketPt = 98  // h265
+	AvPacketPtAac     AvPacketPt = 97  // aac
+	AvPacketPtVp9     AvPacketPt = 99  // vp9
+	AvPacketPtAv1     AvPacketPt = 100 // av1
+	AvPacketPtOpus    AvPacketPt = 111 // opus
 )
 
 func (a AvPacketPt) ReadableString() string {
@@ -36,8 +39,18 @@ func (a AvPacketPt) ReadableString() string {
 		return "h264"
 	case AvPacketPtHevc:
 		return "h265"
+	case AvPacketPtAv1:
+		return "av1"
+	case AvPacketPtVp9:
+		return "vp9"
 	case AvPacketPtAac:
 		return "aac"
+	case AvPacketPtG711U:
+		return "g711u"
+	case AvPacketPtG711A:
+		return "g711a"
+	case AvPacketPtOpus:
+		return "opus"
 	}
 	return ""
 }
@@ -56,11 +69,12 @@ type AvPacket struct {
 }
 
 func (packet *AvPacket) IsAudio() bool {
-	return packet.PayloadType == AvPacketPtAac
+	return packet.PayloadType == AvPacketPtAac || packet.PayloadType == AvPacketPtG711U || packet.PayloadType == AvPacketPtG711A
 }
 
 func (packet *AvPacket) IsVideo() bool {
-	return packet.PayloadType == AvPacketPtAvc || packet.PayloadType == AvPacketPtHevc
+	return packet.PayloadType == AvPacketPtAvc || packet.PayloadType == AvPacketPtHevc ||
+		packet.PayloadType == AvPacketPtAv1 || packet.PayloadType == AvPacketPtVp9
 }
 
 func (packet *AvPacket) DebugString() string {
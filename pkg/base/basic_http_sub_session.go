@@ -9,6 +9,7 @@
 package base
 
 import (
+	"errors"
 	"net"
 	"strings"
 
@@ -21,6 +22,7 @@ type BasicHttpSubSession struct {
 	suffix      string
 	conn        connection.Connection
 	sessionStat BasicSessionStat
+	sendQueue   *SendQueue
 }
 
 type BasicHttpSubSessionOption struct {
@@ -30,14 +32,44 @@ type BasicHttpSubSessionOption struct {
 	UrlCtx        UrlContext
 	IsWebSocket   bool
 	WebSocketKey  string
+
+	SendQueueConfig SendQueueConfig // 见 SendQueue
 }
 
+// NewBasicHttpSubSession
+//
+// 开启 SendQueueConfig 或者 ConnModOption 设置了WriteChanSize时，由发送队列的协程写连接，
+// 没有开启 SendQueueConfig 时，队列大小为WriteChanSize，并且不丢弃数据
 func NewBasicHttpSubSession(option BasicHttpSubSessionOption) *BasicHttpSubSession {
+	var connOption connection.Option
+	if option.ConnModOption != nil {
+		option.ConnModOption(&connOption)
+	}
+	queueConfig := option.SendQueueConfig
+	if !queueConfig.Enable {
+		queueConfig.QueueSize = connOption.WriteChanSize
+	}
+
+	modOptions := []connection.ModOption{option.ConnModOption}
+	if queueConfig.Enable || queueConfig.QueueSize > 0 {
+		modOptions = append(modOptions, func(opt *connection.Option) {
+			opt.WriteChanSize = 0
+		})
+	}
 	s := &BasicHttpSubSession{
 		BasicHttpSubSessionOption: option,
-		conn:                      connection.New(option.Conn, option.ConnModOption),
+		conn:                      connection.New(option.Conn, modOptions...),
 		sessionStat:               NewBasicSessionStat(option.SessionType, option.Conn.RemoteAddr().String()),
 	}
+	if queueConfig.Enable || queueConfig.QueueSize > 0 {
+		s.sendQueue = NewSendQueue(s.UniqueKey(), queueConfig, func(b []byte) error {
+			_, err := s.conn.Write(b)
+			return err
+		}).WithWritev(func(bs net.Buffers) error {
+			_, err := s.conn.Writev(bs)
+			return err
+		})
+	}
 	return s
 }
 
@@ -52,6 +84,9 @@ func (session *BasicHttpSubSession) RunLoop() error {
 }
 
 func (session *BasicHttpSubSession) Dispose() error {
+	if session.sendQueue != nil {
+		session.sendQueue.Dispose()
+	}
 	return session.conn.Close()
 }
 
@@ -66,6 +101,11 @@ func (session *BasicHttpSubSession) WriteHttpResponseHeader(b []byte) {
 }
 
 func (session *BasicHttpSubSession) Write(b []byte) {
+	session.WriteFrame(b, SendItemTypeOther)
+}
+
+// WriteFrame 发送音视频数据，`typ`用于发送队列积压时的丢弃策略，没有开启发送队列时和 Write 相同
+func (session *BasicHttpSubSession) WriteFrame(b []byte, typ SendItemType) {
 	if session.IsWebSocket {
 		wsHeader := WsHeader{
 			Fin:           true,
@@ -76,11 +116,52 @@ func (session *BasicHttpSubSession) Write(b []byte) {
 			PayloadLength: uint64(len(b)),
 			Masked:        false,
 		}
-		session.write(MakeWsFrameHeader(wsHeader))
+		header := MakeWsFrameHeader(wsHeader)
+		if session.sendQueue != nil {
+			// 头和数据作为一个整体，避免只丢弃其中一部分
+			frame := make([]byte, len(header)+len(b))
+			copy(frame, header)
+			copy(frame[len(header):], b)
+			session.push(frame, typ)
+			return
+		}
+		session.write(header)
+	}
+	if session.sendQueue != nil {
+		session.push(b, typ)
+		return
 	}
 	session.write(b)
 }
 
+// WriteRefBuffer 和 WriteFrame 相同
+//
+// 使用发送队列时，内部持有`rb`的一个引用，发送或丢弃后释放，内存块可以放回内存池，否则同步发送。
+// 调用方仍然负责释放自己的引用。
+func (session *BasicHttpSubSession) WriteRefBuffer(rb *RefBuffer, typ SendItemType) {
+	if session.sendQueue == nil {
+		session.WriteFrame(rb.Bytes(), typ)
+		return
+	}
+	if session.IsWebSocket {
+		wsHeader := WsHeader{
+			Fin:           true,
+			Rsv1:          false,
+			Rsv2:          false,
+			Rsv3:          false,
+			Opcode:        Wso_Binary,
+			PayloadLength: uint64(rb.Len()),
+			Masked:        false,
+		}
+		// 头和数据作为一个整体，避免只丢弃其中一部分
+		header := WrapRefBuffer(MakeWsFrameHeader(wsHeader))
+		session.checkPushErr(session.sendQueue.PushRefs([]*RefBuffer{header, rb}, typ))
+		header.Release()
+		return
+	}
+	session.checkPushErr(session.sendQueue.PushRef(rb, typ))
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // IObject interface
 // ---------------------------------------------------------------------------------------------------------------------
@@ -121,7 +202,11 @@ func (session *BasicHttpSubSession) RawQuery() string {
 // ----- ISessionStat --------------------------------------------------------------------------------------------------
 
 func (session *BasicHttpSubSession) GetStat() StatSession {
-	return session.sessionStat.GetStat()
+	stat := session.sessionStat.GetStat()
+	if session.sendQueue != nil {
+		stat.DroppedFrameCount = session.sendQueue.DroppedFrameCount()
+	}
+	return stat
 }
 
 func (session *BasicHttpSubSession) UpdateStat(intervalSec uint32) {
@@ -135,6 +220,21 @@ func (session *BasicHttpSubSession) IsAlive() (readAlive, writeAlive bool) {
 // ---------------------------------------------------------------------------------------------------------------------
 
 func (session *BasicHttpSubSession) write(b []byte) {
+	if session.sendQueue != nil {
+		session.push(b, SendItemTypeOther)
+		return
+	}
 	// TODO(chef) handle write error
 	_, _ = session.conn.Write(b)
 }
+
+func (session *BasicHttpSubSession) push(b []byte, typ SendItemType) {
+	session.checkPushErr(session.sendQueue.Push(b, typ))
+}
+
+func (session *BasicHttpSubSession) checkPushErr(err error) {
+	if errors.Is(err, ErrSendQueueSlowConsumer) {
+		Log.Warnf("[%s] close slow consumer. err=%+v", session.UniqueKey(), err)
+		_ = session.Dispose()
+	}
+}
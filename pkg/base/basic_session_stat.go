@@ -82,6 +82,10 @@ func NewBasicSessionStat(sessionType SessionType, remoteAddr string) BasicSessio
 		s.stat.SessionId = GenUkPsPubSession()
 		s.stat.BaseType = SessionBaseTypePubStr
 		s.stat.Protocol = SessionProtocolPsStr
+	case SessionTypePsPush:
+		s.stat.SessionId = GenUkPsPushSession()
+		s.stat.BaseType = SessionBaseTypePushStr
+		s.stat.Protocol = SessionProtocolPsStr
 	}
 	return s
 }
@@ -104,6 +108,11 @@ func (s *BasicSessionStat) AddWriteBytes(n int) {
 	s.currConnStat.WroteBytesSum.Add(uint64(n))
 }
 
+// ReadBytesSum 注意，只统计通过 AddReadBytes 添加的数据，可以并发调用
+func (s *BasicSessionStat) ReadBytesSum() uint64 {
+	return s.currConnStat.ReadBytesSum.Load()
+}
+
 func (s *BasicSessionStat) UpdateStat(intervalSec uint32) {
 	s.updateStat(s.currConnStat.ReadBytesSum.Load(), s.currConnStat.WroteBytesSum.Load(), s.stat.BaseType, intervalSec)
 }
@@ -24,6 +24,10 @@ var (
 
 var ErrSamplingFrequencyIndex = errors.New("lal.aac: invalid sampling frequency index")
 
+// ----- pkg/av1 -------------------------------------------------------------------------------------------------------
+
+var ErrAv1 = errors.New("lal.av1: fxxk")
+
 // ----- pkg/aac -------------------------------------------------------------------------------------------------------
 
 var ErrAvc = errors.New("lal.avc: fxxk")
@@ -37,6 +41,10 @@ var (
 	ErrSessionNotStarted = errors.New("lal.base: session has not been started yet")
 
 	ErrInvalidUrl = errors.New("lal.base: invalid url")
+
+	ErrSendQueueSlowConsumer = errors.New("lal.base: send queue consumer too slow")
+	ErrSendQueueDisposed     = errors.New("lal.base: send queue disposed")
+	ErrSendQueueFull         = errors.New("lal.base: send queue full")
 )
 
 // ----- pkg/hevc ------------------------------------------------------------------------------------------------------
@@ -51,12 +59,23 @@ var ErrHlsSessionNotFound = errors.New("lal.hls: hls session not found")
 // ----- pkg/rtmp ------------------------------------------------------------------------------------------------------
 
 var (
-	ErrAmfInvalidType = errors.New("lal.rtmp: invalid amf0 type")
-	ErrAmfTooShort    = errors.New("lal.rtmp: too short to unmarshal amf0 data")
-	ErrAmfNotExist    = errors.New("lal.rtmp: not exist")
+	ErrAmfInvalidType      = errors.New("lal.rtmp: invalid amf0 type")
+	ErrAmfTooShort         = errors.New("lal.rtmp: too short to unmarshal amf0 data")
+	ErrAmfNotExist         = errors.New("lal.rtmp: not exist")
+	ErrAmfInvalidReference = errors.New("lal.rtmp: invalid amf3 reference")
+	ErrAmfUnsupported      = errors.New("lal.rtmp: unsupported amf type")
+	ErrAmfTooDeep          = errors.New("lal.rtmp: amf data nested too deep")
 
 	ErrRtmpShortBuffer   = errors.New("lal.rtmp: buffer too short")
 	ErrRtmpUnexpectedMsg = errors.New("lal.rtmp: unexpected msg")
+	ErrRtmptBufferFull   = errors.New("lal.rtmp: rtmpt buffer full")
+	ErrRtmptInvalidSeq   = errors.New("lal.rtmp: rtmpt invalid request seq")
+
+	ErrRtmpConnectRejected = errors.New("lal.rtmp: connect rejected")
+	ErrRtmpAuthFailed      = errors.New("lal.rtmp: auth failed")
+
+	ErrRtmpTooManyRedirects  = errors.New("lal.rtmp: too many redirects")
+	ErrRtmpTooManyReconnects = errors.New("lal.rtmp: too many reconnect requests")
 )
 
 func NewErrAmfInvalidType(b byte) error {
@@ -77,12 +96,17 @@ var (
 	ErrRtsp                     = errors.New("lal.rtsp: fxxk")
 	ErrRtspClosedByObserver     = errors.New("lal.rtsp: close by observer")
 	ErrRtspUnsupportedTransport = errors.New("lal.rtsp: unsupported Transport")
+	ErrRtspAuthFailed           = errors.New("lal.rtsp: auth failed")
 )
 
 // ----- pkg/sdp -------------------------------------------------------------------------------------------------------
 
 var ErrSdp = errors.New("lal.sdp: fxxk")
 
+// ----- pkg/vp9 -------------------------------------------------------------------------------------------------------
+
+var ErrVp9 = errors.New("lal.vp9: fxxk")
+
 // ----- pkg/logic -----------------------------------------------------------------------------------------------------
 
 var (
@@ -91,6 +115,11 @@ var (
 
 	ErrSimpleAuthParamNotFound = errors.New("lal.logic: simple auth failed since url param lal_secret not found")
 	ErrSimpleAuthFailed        = errors.New("lal.logic: simple auth failed since url param lal_secret invalid")
+
+	ErrVodInvalidFile    = errors.New("lal.logic: invalid vod file")
+	ErrVodSeekOutOfRange = errors.New("lal.logic: vod seek out of range")
+
+	ErrRecordInvalidFile = errors.New("lal.logic: invalid record file")
 )
 
 // ----- pkg/gb28181 ---------------------------------------------------------------------------------------------------
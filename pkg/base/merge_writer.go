@@ -17,21 +17,45 @@ import (
 // MergeWriter 合并多个内存块，达到阈值后一次性将内存块数组返回给上层
 //
 // 注意，输入时的单个内存块，回调时不会出现拆分切割的情况
+//
+// 使用 NewMergeWriterRef 创建时，每次回调的内存块作为一个整体进入发送队列，见 SendQueue.PushRefs ，所以回调时同时给出这批数据的类型:
+//   - SendItemTypeOther 的数据（信令、seq header等）不能被丢弃，单独作为一批回调
+//   - 视频关键帧作为新一批的开始，这一批的类型为 SendItemTypeVideoKey ，用于发送队列从丢弃状态中恢复
+//   - 其他批次中有视频非关键帧时为 SendItemTypeVideoNonKey ，否则为 SendItemTypeAudio
 type MergeWriter struct {
-	onWritev OnWritev
+	onWritev OnWritevRef
 	size     int
 
 	currSize int
-	bs       net.Buffers // TODO(chef): perf 复用外层切片
+	rbs      []*RefBuffer
+	typ      SendItemType
 }
 
 type OnWritev func(bs net.Buffers)
 
+// OnWritevRef
+//
+// 注意，回调结束后，`rbs`切片会被复用，其中的内存块的引用也会被释放。需要继续持有内存块的一方，自己调用 RefBuffer.Ref
+//
+// @param typ: 这批数据在发送队列中的类型
+type OnWritevRef func(rbs []*RefBuffer, typ SendItemType)
+
 // NewMergeWriter
 //
 // @param onWritev 回调缓存的1~n个内存块
 // @param size     回调阈值
 func NewMergeWriter(onWritev OnWritev, size int) *MergeWriter {
+	return NewMergeWriterRef(func(rbs []*RefBuffer, typ SendItemType) {
+		bs := make(net.Buffers, len(rbs))
+		for i, rb := range rbs {
+			bs[i] = rb.Bytes()
+		}
+		onWritev(bs)
+	}, size)
+}
+
+// NewMergeWriterRef 和 NewMergeWriter 相同，区别是回调 RefBuffer ，配合 WriteRef 使用
+func NewMergeWriterRef(onWritev OnWritevRef, size int) *MergeWriter {
 	return &MergeWriter{
 		onWritev: onWritev,
 		size:     size,
@@ -43,9 +67,28 @@ func NewMergeWriter(onWritev OnWritev, size int) *MergeWriter {
 // 注意，函数调用结束后，`b`内存块会被内部持有
 func (w *MergeWriter) Write(b []byte) {
 	Log.Debugf("[%p] MergeWriter::Write. len=%d", w, len(b))
-	w.bs = append(w.bs, b)
-	w.currSize += len(b)
-	if w.currSize >= w.size {
+	// 不区分类型，只按大小合并
+	rb := WrapRefBuffer(b)
+	w.WriteRef(rb, SendItemTypeAudio)
+	rb.Release()
+}
+
+// WriteRef
+//
+// 注意，内部持有`rb`的一个引用直到回调结束，调用方仍然负责释放自己的引用
+//
+// @param typ: `rb`在发送队列中的类型，见 SendItemTypeOfRtmpMsg
+func (w *MergeWriter) WriteRef(rb *RefBuffer, typ SendItemType) {
+	if len(w.rbs) > 0 && (typ == SendItemTypeOther || typ == SendItemTypeVideoKey) {
+		w.flush()
+	}
+
+	if len(w.rbs) == 0 || typ == SendItemTypeVideoNonKey && w.typ == SendItemTypeAudio {
+		w.typ = typ
+	}
+	w.rbs = append(w.rbs, rb.Ref())
+	w.currSize += rb.Len()
+	if w.currSize >= w.size || typ == SendItemTypeOther {
 		w.flush()
 	}
 }
@@ -53,22 +96,20 @@ func (w *MergeWriter) Write(b []byte) {
 // Flush 强制将内部缓冲的数据全部回调排空
 func (w *MergeWriter) Flush() {
 	Log.Debugf("[%p] MergeWriter::Flush.", w)
-	if w.currSize > 0 {
+	if len(w.rbs) > 0 {
 		w.flush()
 	}
 }
 
 // flush 将内部缓冲的数据全部回调排空
+//
+// 注意，WriteRef 和 flush 在每个消息的广播路径上，不打印日志，避免日志参数申请内存
 func (w *MergeWriter) flush() {
-	// only for debug log
-	var n int
-	var ns []int
-	for _, v := range w.bs {
-		n += len(v)
-		ns = append(ns, len(v))
+	w.onWritev(w.rbs, w.typ)
+	for i, rb := range w.rbs {
+		rb.Release()
+		w.rbs[i] = nil
 	}
-	Log.Debugf("[%p] MergeWriter::flush. len=%d(%v)", w, n, ns)
-	w.onWritev(w.bs)
 	w.currSize = 0
-	w.bs = nil
+	w.rbs = w.rbs[:0]
 }
@@ -0,0 +1,124 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RefBuffer 带引用计数的内存块，引用计数减为0时放回内存池
+//
+// 用于广播场景，一份数据（比如rtmp chunk、flv tag）被GOP缓存、merge writer、多个sub session的发送队列共享，
+// 避免为每个持有者拷贝内存，同时减少内存申请。
+//
+// 约定:
+//   - 创建者持有一个引用
+//   - 需要在函数调用结束后继续持有内存块的一方，自己调用 Ref ，不再使用时调用 Release
+//   - 传给不感知引用计数的异步发送方（比如开启了WriteChanSize的connection）之前，需要调用 Detach
+//
+// 漏调用 Release 只是让内存块交给GC回收，多调用 Release 则会导致内存块被提前复用，所以宁漏勿多。
+type RefBuffer struct {
+	b        []byte
+	n        int
+	refs     int32
+	class    int // 内存池的下标，-1表示不来自内存池
+	detached int32
+}
+
+const (
+	refBufferMinClassShift = 9  // 512B
+	refBufferMaxClassShift = 22 // 4MB
+)
+
+var refBufferPools [refBufferMaxClassShift - refBufferMinClassShift + 1]sync.Pool
+
+// NewRefBuffer 从内存池中获取长度为`size`的内存块，引用计数为1
+//
+// 注意，内存块的内容是未初始化的
+func NewRefBuffer(size int) *RefBuffer {
+	class := refBufferClass(size)
+	if class < 0 {
+		return &RefBuffer{b: make([]byte, size), n: size, refs: 1, class: -1}
+	}
+	if v := refBufferPools[class].Get(); v != nil {
+		rb := v.(*RefBuffer)
+		rb.n = size
+		rb.refs = 1
+		rb.detached = 0
+		return rb
+	}
+	return &RefBuffer{b: make([]byte, 1<<(class+refBufferMinClassShift)), n: size, refs: 1, class: class}
+}
+
+// WrapRefBuffer 包装已有的内存块，引用计数为1，不会放回内存池
+func WrapRefBuffer(b []byte) *RefBuffer {
+	return &RefBuffer{b: b, n: len(b), refs: 1, class: -1}
+}
+
+// Bytes 注意，只在持有引用期间有效
+func (rb *RefBuffer) Bytes() []byte {
+	return rb.b[:rb.n]
+}
+
+func (rb *RefBuffer) Len() int {
+	return rb.n
+}
+
+// Truncate 将长度修改为`n`，`n`不能超过创建时的长度
+func (rb *RefBuffer) Truncate(n int) {
+	if n < 0 || n > rb.n {
+		Log.Panicf("RefBuffer::Truncate out of range. n=%d, len=%d", n, rb.n)
+	}
+	rb.n = n
+}
+
+// Ref 增加一个引用
+func (rb *RefBuffer) Ref() *RefBuffer {
+	atomic.AddInt32(&rb.refs, 1)
+	return rb
+}
+
+// Release 释放一个引用，引用计数减为0时放回内存池
+func (rb *RefBuffer) Release() {
+	refs := atomic.AddInt32(&rb.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		Log.Panicf("RefBuffer::Release too many times. refs=%d", refs)
+	}
+	if rb.class < 0 || atomic.LoadInt32(&rb.detached) == 1 {
+		return
+	}
+	refBufferPools[rb.class].Put(rb)
+}
+
+// Detach 之后内存块不再放回内存池，而是交给GC回收
+//
+// 用于将内存块交给不感知引用计数、也不通知何时使用完毕的一方
+func (rb *RefBuffer) Detach() {
+	atomic.StoreInt32(&rb.detached, 1)
+}
+
+func (rb *RefBuffer) RefCount() int32 {
+	return atomic.LoadInt32(&rb.refs)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// refBufferClass 能容纳`size`的最小内存池下标，超过最大规格时返回-1
+func refBufferClass(size int) int {
+	for i := 0; i < len(refBufferPools); i++ {
+		if size <= 1<<(i+refBufferMinClassShift) {
+			return i
+		}
+	}
+	return -1
+}
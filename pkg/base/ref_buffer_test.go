@@ -0,0 +1,133 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+func TestRefBuffer(t *testing.T) {
+	assert.Equal(t, 0, refBufferClass(1))
+	assert.Equal(t, 0, refBufferClass(512))
+	assert.Equal(t, 1, refBufferClass(513))
+	assert.Equal(t, len(refBufferPools)-1, refBufferClass(4*1024*1024))
+	assert.Equal(t, -1, refBufferClass(4*1024*1024+1))
+
+	rb := NewRefBuffer(1000)
+	assert.Equal(t, 1000, rb.Len())
+	assert.Equal(t, 1000, len(rb.Bytes()))
+	assert.Equal(t, 1024, cap(rb.Bytes()))
+	rb.Truncate(10)
+	assert.Equal(t, 10, len(rb.Bytes()))
+
+	rb.Ref()
+	assert.Equal(t, int32(2), rb.RefCount())
+	rb.Release()
+	assert.Equal(t, int32(1), rb.RefCount())
+	rb.Release()
+	assert.Equal(t, int32(0), rb.RefCount())
+
+	// 放回内存池后重新获取，状态被重置
+	rb = NewRefBuffer(600)
+	assert.Equal(t, 600, rb.Len())
+	assert.Equal(t, int32(1), rb.RefCount())
+	rb.Detach()
+	rb.Release()
+
+	rb = NewRefBuffer(5 * 1024 * 1024)
+	assert.Equal(t, 5*1024*1024, rb.Len())
+	rb.Release()
+
+	b := []byte{1, 2, 3}
+	rb = WrapRefBuffer(b)
+	assert.Equal(t, b, rb.Bytes())
+	rb.Release()
+}
+
+func TestSendQueue_Ref(t *testing.T) {
+	st := newSendQueueTester(t, SendQueueConfig{
+		Enable:            true,
+		QueueSize:         2,
+		DropNonKeyPercent: 100,
+	})
+	defer st.q.Dispose()
+
+	pushRef := func(q *SendQueue, s string, typ SendItemType) *RefBuffer {
+		rb := WrapRefBuffer([]byte(s))
+		assert.Equal(t, nil, q.PushRef(rb, typ))
+		rb.Release()
+		return rb
+	}
+	waitRefCount := func(rb *RefBuffer, n int32) {
+		for i := 0; i < 1000 && rb.RefCount() != n; i++ {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, n, rb.RefCount())
+	}
+
+	a1 := pushRef(st.q, "a1", SendItemTypeAudio)
+	a2 := pushRef(st.q, "a2", SendItemTypeAudio)
+	ash := pushRef(st.q, "ash", SendItemTypeOther)
+	assert.Equal(t, int32(1), a1.RefCount())
+	// 队列满，跳过GOP时丢弃的数据释放引用
+	pushRef(st.q, "a3", SendItemTypeAudio)
+	assert.Equal(t, int32(0), a1.RefCount())
+	assert.Equal(t, int32(0), a2.RefCount())
+	assert.Equal(t, int32(1), ash.RefCount())
+
+	// 发送后释放引用
+	st.release(2)
+	assert.Equal(t, []string{"begin", "ash"}, st.wrote)
+	waitRefCount(ash, 0)
+
+	// 发送失败时，正在发送的以及队列中的数据释放引用
+	gate := make(chan struct{})
+	q := NewSendQueue("test", SendQueueConfig{Enable: true}, func(b []byte) error {
+		<-gate
+		return ErrSendQueueDisposed
+	})
+	defer q.Dispose()
+	b1 := pushRef(q, "b1", SendItemTypeAudio)
+	for i := 0; i < 1000 && q.Len() != 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	b2 := pushRef(q, "b2", SendItemTypeAudio)
+	assert.Equal(t, int32(1), b1.RefCount())
+	assert.Equal(t, int32(1), b2.RefCount())
+	close(gate)
+	waitRefCount(b1, 0)
+	waitRefCount(b2, 0)
+}
+
+func TestMergeWriter_Ref(t *testing.T) {
+	var cbBuf [][]byte
+	w := NewMergeWriterRef(func(rbs []*RefBuffer, typ SendItemType) {
+		for _, rb := range rbs {
+			cbBuf = append(cbBuf, rb.Bytes())
+		}
+	}, 4)
+	var written []*RefBuffer
+	for _, s := range []string{"ab", "cd", "e"} {
+		rb := WrapRefBuffer([]byte(s))
+		w.WriteRef(rb, SendItemTypeAudio)
+		rb.Release()
+		written = append(written, rb)
+	}
+	assert.Equal(t, [][]byte{[]byte("ab"), []byte("cd")}, cbBuf)
+	w.Flush()
+	assert.Equal(t, 3, len(cbBuf))
+
+	// 回调结束后，内部持有的引用全部释放
+	for _, rb := range written {
+		assert.Equal(t, int32(0), rb.RefCount())
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/q191201771/naza/pkg/nazaerrors"
+)
+
+// SendQueue 输出类型session的有界发送队列
+//
+// 上层（比如group广播）只往队列中放数据，由独立的协程写入连接，慢的拉流端不会阻塞广播。
+//
+// 队列积压时，按以下顺序逐级丢弃数据:
+//   - 队列长度超过 SendQueueConfig.DropNonKeyPercent 时，丢弃视频非关键帧，直到下一个关键帧
+//   - 队列满时，丢弃队列中所有未发送的音视频帧，并丢弃后续音视频帧，直到下一个关键帧（也即跳到下一个GOP）
+//   - 队列没有排空（低于 DropNonKeyPercent ）的情况下，连续跳过GOP的次数超过 SendQueueConfig.MaxSkipGopCount 时，
+//     返回 ErrSendQueueSlowConsumer ，上层应该关闭session
+//
+// SendItemTypeOther 类型的数据（信令、metadata、seq header等）不会被丢弃。
+//
+// SendQueueConfig.Enable 为false时，不使用上面的丢弃策略，只是代替connection的异步发送，
+// 使得 RefBuffer 在真正发送完成后才释放引用。队列满时丢弃本次数据并返回 ErrSendQueueFull ，和connection的channel满时的行为相同。
+type SendQueue struct {
+	uniqueKey string
+	config    SendQueueConfig
+	write     func(b []byte) error
+	writev    func(bs net.Buffers) error
+
+	notifyChan chan struct{}
+	exitChan   chan struct{}
+	exitOnce   sync.Once
+
+	mutex        sync.Mutex
+	items        []sendQueueItem
+	err          error
+	dropMode     sendQueueDropMode
+	skipGopCount int
+	hasVideo     bool
+
+	droppedFrameCount uint64 // 原子操作
+}
+
+type SendQueueConfig struct {
+	Enable            bool `json:"enable"`               // 是否开启丢弃策略
+	QueueSize         int  `json:"queue_size"`           // 队列中最多缓存的帧数
+	DropNonKeyPercent int  `json:"drop_non_key_percent"` // 队列长度超过 QueueSize 的这个百分比时，开始丢弃非关键帧
+	MaxSkipGopCount   int  `json:"max_skip_gop_count"`   // 为0时不断开连接
+}
+
+var DefaultSendQueueConfig = SendQueueConfig{
+	Enable:            false,
+	QueueSize:         512,
+	DropNonKeyPercent: 50,
+	MaxSkipGopCount:   3,
+}
+
+type SendItemType uint8
+
+const (
+	SendItemTypeOther SendItemType = iota
+	SendItemTypeAudio
+	SendItemTypeVideoKey
+	SendItemTypeVideoNonKey
+)
+
+type sendQueueDropMode uint8
+
+const (
+	sendQueueDropModeNone    sendQueueDropMode = iota
+	sendQueueDropModeNonKey                    // 丢弃视频非关键帧，音频正常发送
+	sendQueueDropModeSkipGop                   // 丢弃所有音视频帧
+)
+
+// sendQueueItem b、rb、rbs三者只有一个有效
+//
+// rb、rbs中的内存块，进入队列时持有一个引用，发送或丢弃后释放
+type sendQueueItem struct {
+	b   []byte
+	rb  *RefBuffer
+	rbs []*RefBuffer
+	typ SendItemType
+}
+
+func (item *sendQueueItem) ref() {
+	if item.rb != nil {
+		item.rb.Ref()
+	}
+	for _, rb := range item.rbs {
+		rb.Ref()
+	}
+}
+
+func (item *sendQueueItem) release() {
+	if item.rb != nil {
+		item.rb.Release()
+	}
+	for _, rb := range item.rbs {
+		rb.Release()
+	}
+}
+
+// SendItemTypeOfRtmpMsg 获取rtmp消息在发送队列中的类型
+func SendItemTypeOfRtmpMsg(msg RtmpMsg) SendItemType {
+	if msg.IsMultitrackSeqHeader() {
+		return SendItemTypeOther
+	}
+	switch msg.Header.MsgTypeId {
+	case RtmpTypeIdAudio:
+		if msg.IsAacSeqHeader() || msg.IsExAudioSeqHeader() {
+			return SendItemTypeOther
+		}
+		return SendItemTypeAudio
+	case RtmpTypeIdVideo:
+		if msg.IsVideoKeySeqHeader() {
+			return SendItemTypeOther
+		}
+		if msg.IsVideoKeyNalu() {
+			return SendItemTypeVideoKey
+		}
+		return SendItemTypeVideoNonKey
+	}
+	return SendItemTypeOther
+}
+
+// NewSendQueue
+//
+// @param write: 在内部的发送协程中被调用，返回错误时发送协程退出
+func NewSendQueue(uniqueKey string, config SendQueueConfig, write func(b []byte) error) *SendQueue {
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultSendQueueConfig.QueueSize
+	}
+	if config.DropNonKeyPercent <= 0 || config.DropNonKeyPercent > 100 {
+		config.DropNonKeyPercent = DefaultSendQueueConfig.DropNonKeyPercent
+	}
+	q := &SendQueue{
+		uniqueKey:  uniqueKey,
+		config:     config,
+		write:      write,
+		notifyChan: make(chan struct{}, 1),
+		exitChan:   make(chan struct{}),
+	}
+	go q.runWriteLoop()
+	return q
+}
+
+// Push
+//
+// 注意，函数调用结束后，`b`内存块会被内部持有
+//
+// @return 不为nil时，上层应该关闭session
+func (q *SendQueue) Push(b []byte, typ SendItemType) error {
+	return q.push(sendQueueItem{b: b, typ: typ})
+}
+
+// PushRef 和 Push 相同，区别是进入队列时内部持有`rb`的一个引用，发送或丢弃后释放，调用方仍然负责释放自己的引用
+func (q *SendQueue) PushRef(rb *RefBuffer, typ SendItemType) error {
+	return q.push(sendQueueItem{rb: rb, typ: typ})
+}
+
+// PushRefs 将多个内存块作为一个整体放入队列，一起发送或丢弃。引用的持有方式和 PushRef 相同
+//
+// 设置了 WithWritev 时，使用一次writev发送
+func (q *SendQueue) PushRefs(rbs []*RefBuffer, typ SendItemType) error {
+	if len(rbs) == 0 {
+		return nil
+	}
+	return q.push(sendQueueItem{rbs: append([]*RefBuffer(nil), rbs...), typ: typ})
+}
+
+// WithWritev 设置发送多个内存块的函数，见 PushRefs
+//
+// 注意，需要在 Push 系列函数之前调用
+func (q *SendQueue) WithWritev(writev func(bs net.Buffers) error) *SendQueue {
+	q.writev = writev
+	return q
+}
+
+// Dispose 退出发送协程，未发送的数据直接丢弃
+func (q *SendQueue) Dispose() {
+	q.exitOnce.Do(func() {
+		close(q.exitChan)
+	})
+}
+
+// DroppedFrameCount 丢弃的帧数，包括发送队列中被丢弃的帧
+func (q *SendQueue) DroppedFrameCount() uint64 {
+	return atomic.LoadUint64(&q.droppedFrameCount)
+}
+
+func (q *SendQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (q *SendQueue) push(item sendQueueItem) error {
+	typ := item.typ
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.err != nil {
+		return q.err
+	}
+
+	if !q.config.Enable {
+		if len(q.items) >= q.config.QueueSize {
+			atomic.AddUint64(&q.droppedFrameCount, 1)
+			return nazaerrors.Wrap(ErrSendQueueFull)
+		}
+		q.append(item)
+		return nil
+	}
+
+	if typ == SendItemTypeVideoKey || typ == SendItemTypeVideoNonKey {
+		q.hasVideo = true
+	}
+
+	if typ != SendItemTypeOther {
+		if len(q.items) >= q.config.QueueSize && q.dropMode != sendQueueDropModeSkipGop {
+			q.skipGop()
+			if q.config.MaxSkipGopCount > 0 && q.skipGopCount > q.config.MaxSkipGopCount {
+				Log.Warnf("[%s] send queue skip gop too many times, consumer too slow. count=%d", q.uniqueKey, q.skipGopCount)
+				q.err = nazaerrors.Wrap(ErrSendQueueSlowConsumer)
+				return q.err
+			}
+		}
+
+		if q.shouldDrop(typ) {
+			atomic.AddUint64(&q.droppedFrameCount, 1)
+			return nil
+		}
+	}
+
+	q.append(item)
+	return nil
+}
+
+func (q *SendQueue) append(item sendQueueItem) {
+	item.ref()
+	q.items = append(q.items, item)
+	select {
+	case q.notifyChan <- struct{}{}:
+	default:
+	}
+}
+
+func (q *SendQueue) dropThreshold() int {
+	return q.config.QueueSize * q.config.DropNonKeyPercent / 100
+}
+
+// shouldDrop 根据当前的丢弃模式，判断是否丢弃，并更新丢弃模式
+func (q *SendQueue) shouldDrop(typ SendItemType) bool {
+	n := len(q.items)
+
+	switch q.dropMode {
+	case sendQueueDropModeSkipGop:
+		// 队列满时不恢复，避免立刻再次跳过GOP
+		if n >= q.config.QueueSize {
+			return true
+		}
+		if typ == SendItemTypeVideoKey || (!q.hasVideo && n < q.dropThreshold()) {
+			// 单音频流没有关键帧，排空到阈值以下时恢复
+			q.dropMode = sendQueueDropModeNone
+			return false
+		}
+		return true
+	case sendQueueDropModeNonKey:
+		if typ == SendItemTypeVideoKey {
+			q.dropMode = sendQueueDropModeNone
+			return false
+		}
+		return typ == SendItemTypeVideoNonKey
+	}
+
+	if typ == SendItemTypeVideoNonKey && n >= q.dropThreshold() {
+		Log.Debugf("[%s] send queue drop non key frame. len=%d", q.uniqueKey, n)
+		// 丢弃一个非关键帧之后，直到下一个关键帧之前的帧都无法解码
+		q.dropMode = sendQueueDropModeNonKey
+		return true
+	}
+	return false
+}
+
+// skipGop 丢弃队列中所有音视频帧
+func (q *SendQueue) skipGop() {
+	var dropped int
+	items := q.items[:0]
+	for _, item := range q.items {
+		if item.typ == SendItemTypeOther {
+			items = append(items, item)
+		} else {
+			item.release()
+			dropped++
+		}
+	}
+	for i := len(items); i < len(q.items); i++ {
+		q.items[i] = sendQueueItem{}
+	}
+	q.items = items
+
+	q.skipGopCount++
+	q.dropMode = sendQueueDropModeSkipGop
+	atomic.AddUint64(&q.droppedFrameCount, uint64(dropped))
+	Log.Warnf("[%s] send queue full, skip to next gop. dropped=%d, count=%d", q.uniqueKey, dropped, q.skipGopCount)
+}
+
+func (q *SendQueue) runWriteLoop() {
+	var bs net.Buffers
+	for {
+		select {
+		case <-q.exitChan:
+			q.mutex.Lock()
+			if q.err == nil {
+				q.err = nazaerrors.Wrap(ErrSendQueueDisposed)
+			}
+			q.clearItems()
+			q.mutex.Unlock()
+			return
+		case <-q.notifyChan:
+		}
+
+		for {
+			q.mutex.Lock()
+			if len(q.items) == 0 {
+				q.mutex.Unlock()
+				break
+			}
+			item := q.items[0]
+			q.items[0] = sendQueueItem{}
+			q.items = q.items[1:]
+			if len(q.items) < q.dropThreshold() {
+				q.skipGopCount = 0
+			}
+			q.mutex.Unlock()
+
+			err := q.writeItem(&item, &bs)
+			item.release()
+			if err != nil {
+				q.mutex.Lock()
+				q.err = err
+				q.clearItems()
+				q.mutex.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// writeItem
+//
+// @param bs: 复用的切片，避免每次writev申请内存
+func (q *SendQueue) writeItem(item *sendQueueItem, bs *net.Buffers) error {
+	if item.rb != nil {
+		return q.write(item.rb.Bytes())
+	}
+	if item.rbs == nil {
+		return q.write(item.b)
+	}
+	if q.writev == nil {
+		for _, rb := range item.rbs {
+			if err := q.write(rb.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	*bs = (*bs)[:0]
+	for _, rb := range item.rbs {
+		*bs = append(*bs, rb.Bytes())
+	}
+	return q.writev(*bs)
+}
+
+func (q *SendQueue) clearItems() {
+	for i := range q.items {
+		q.items[i].release()
+	}
+	q.items = nil
+}
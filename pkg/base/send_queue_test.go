@@ -0,0 +1,238 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+// sendQueueTester 写操作被gate阻塞，每往gate中放一个元素，放行一次写操作
+type sendQueueTester struct {
+	t     *testing.T
+	q     *SendQueue
+	gate  chan struct{}
+	mutex sync.Mutex
+	wrote []string
+}
+
+func newSendQueueTester(t *testing.T, config SendQueueConfig) *sendQueueTester {
+	st := &sendQueueTester{
+		t:    t,
+		gate: make(chan struct{}),
+	}
+	st.q = NewSendQueue("test", config, func(b []byte) error {
+		<-st.gate
+		st.mutex.Lock()
+		st.wrote = append(st.wrote, string(b))
+		st.mutex.Unlock()
+		return nil
+	})
+	// 先放一个元素，等待发送协程取走后阻塞在写操作上，后续Push的元素都会留在队列中
+	st.push("begin", SendItemTypeOther)
+	st.waitLen(0)
+	return st
+}
+
+func (st *sendQueueTester) push(s string, typ SendItemType) {
+	assert.Equal(st.t, nil, st.q.Push([]byte(s), typ))
+}
+
+func (st *sendQueueTester) waitLen(n int) {
+	for i := 0; i < 1000 && st.q.Len() != n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(st.t, n, st.q.Len())
+}
+
+// release 放行n次写操作，并等待写完
+func (st *sendQueueTester) release(n int) {
+	for i := 0; i < n; i++ {
+		st.gate <- struct{}{}
+	}
+	for i := 0; i < 1000; i++ {
+		st.mutex.Lock()
+		l := len(st.wrote)
+		st.mutex.Unlock()
+		if l >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	st := newSendQueueTester(t, SendQueueConfig{
+		Enable:            true,
+		QueueSize:         10,
+		DropNonKeyPercent: 50,
+		MaxSkipGopCount:   1,
+	})
+	defer st.q.Dispose()
+
+	// 达到阈值后丢弃非关键帧，直到下一个关键帧，音频不丢
+	st.push("k1", SendItemTypeVideoKey)
+	for i := 0; i < 4; i++ {
+		st.push("p1", SendItemTypeVideoNonKey)
+	}
+	st.push("p1-dropped", SendItemTypeVideoNonKey)
+	st.push("a1", SendItemTypeAudio)
+	st.push("p1-dropped", SendItemTypeVideoNonKey)
+	assert.Equal(t, uint64(2), st.q.DroppedFrameCount())
+	assert.Equal(t, 6, st.q.Len())
+	st.push("k2", SendItemTypeVideoKey)
+	st.push("ash", SendItemTypeOther)
+	assert.Equal(t, 8, st.q.Len())
+
+	// 队列满时，丢弃队列中的音视频帧，跳到下一个GOP，信令不丢
+	st.push("a2", SendItemTypeAudio)
+	st.push("a2", SendItemTypeAudio)
+	assert.Equal(t, 10, st.q.Len())
+	st.push("a2-dropped", SendItemTypeAudio)
+	assert.Equal(t, 1, st.q.Len())
+	assert.Equal(t, uint64(2+9+1), st.q.DroppedFrameCount())
+	st.push("p2-dropped", SendItemTypeVideoNonKey)
+	st.push("a2-dropped", SendItemTypeAudio)
+	st.push("k3", SendItemTypeVideoKey)
+	st.push("a3", SendItemTypeAudio)
+	assert.Equal(t, 3, st.q.Len())
+	assert.Equal(t, uint64(14), st.q.DroppedFrameCount())
+
+	// 排空后，跳过GOP的计数清零
+	st.release(4)
+	st.waitLen(0)
+	assert.Equal(t, []string{"begin", "ash", "k3", "a3"}, st.wrote)
+	st.push("sync", SendItemTypeOther)
+	st.waitLen(0)
+
+	// 没有排空的情况下，连续跳过GOP超过次数，断开
+	for i := 0; i < 10; i++ {
+		st.push("a4", SendItemTypeAudio)
+	}
+	st.push("a4-dropped", SendItemTypeAudio)
+	st.push("k4", SendItemTypeVideoKey)
+	for i := 0; i < 9; i++ {
+		st.push("a5", SendItemTypeAudio)
+	}
+	err := st.q.Push([]byte("a5"), SendItemTypeAudio)
+	assert.Equal(t, true, errors.Is(err, ErrSendQueueSlowConsumer))
+	err = st.q.Push([]byte("ash"), SendItemTypeOther)
+	assert.Equal(t, true, errors.Is(err, ErrSendQueueSlowConsumer))
+}
+
+func TestSendQueue_AudioOnly(t *testing.T) {
+	st := newSendQueueTester(t, SendQueueConfig{
+		Enable:            true,
+		QueueSize:         4,
+		DropNonKeyPercent: 50,
+	})
+	defer st.q.Dispose()
+
+	for i := 0; i < 4; i++ {
+		st.push("a1", SendItemTypeAudio)
+	}
+	// 纯音频流没有关键帧，跳过后队列低于阈值，立即恢复发送
+	st.push("a2", SendItemTypeAudio)
+	assert.Equal(t, 1, st.q.Len())
+	assert.Equal(t, uint64(4), st.q.DroppedFrameCount())
+
+	st.release(2)
+	assert.Equal(t, []string{"begin", "a2"}, st.wrote)
+}
+
+func TestSendQueue_Disable(t *testing.T) {
+	st := newSendQueueTester(t, SendQueueConfig{
+		Enable:    false,
+		QueueSize: 2,
+	})
+	defer st.q.Dispose()
+
+	// 不丢弃非关键帧，队列满时只丢弃本次数据
+	rb := NewRefBuffer(2)
+	copy(rb.Bytes(), "p1")
+	assert.Equal(t, nil, st.q.PushRef(rb, SendItemTypeVideoNonKey))
+	assert.Equal(t, int32(2), rb.RefCount())
+	st.push("p2", SendItemTypeVideoNonKey)
+	err := st.q.Push([]byte("p3"), SendItemTypeVideoKey)
+	assert.Equal(t, true, errors.Is(err, ErrSendQueueFull))
+	assert.Equal(t, uint64(1), st.q.DroppedFrameCount())
+
+	// 发送完成后释放引用
+	st.release(3)
+	st.waitLen(0)
+	assert.Equal(t, []string{"begin", "p1", "p2"}, st.wrote)
+	for i := 0; i < 1000 && rb.RefCount() != 1; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, int32(1), rb.RefCount())
+	rb.Release()
+}
+
+func TestSendQueue_Dispose(t *testing.T) {
+	q := NewSendQueue("test", SendQueueConfig{Enable: true}, func(b []byte) error {
+		return nil
+	})
+	assert.Equal(t, nil, q.Push([]byte("a"), SendItemTypeAudio))
+	q.Dispose()
+	q.Dispose()
+
+	var err error
+	for i := 0; i < 1000 && err == nil; i++ {
+		err = q.Push([]byte("a"), SendItemTypeAudio)
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, true, errors.Is(err, ErrSendQueueDisposed))
+}
+
+func TestSendItemTypeOfRtmpMsg(t *testing.T) {
+	newMsg := func(typeId uint8, payload ...byte) RtmpMsg {
+		return RtmpMsg{Header: RtmpHeader{MsgTypeId: typeId}, Payload: payload}
+	}
+	assert.Equal(t, SendItemTypeOther, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdMetadata, 0x02)))
+	assert.Equal(t, SendItemTypeOther, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdVideo, 0x17, 0x00, 0, 0, 0)))
+	assert.Equal(t, SendItemTypeVideoKey, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdVideo, 0x17, 0x01, 0, 0, 0)))
+	assert.Equal(t, SendItemTypeVideoNonKey, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdVideo, 0x27, 0x01, 0, 0, 0)))
+	assert.Equal(t, SendItemTypeOther, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdAudio, 0xAF, 0x00)))
+	assert.Equal(t, SendItemTypeAudio, SendItemTypeOfRtmpMsg(newMsg(RtmpTypeIdAudio, 0xAF, 0x01)))
+}
+
+func TestMergeWriter_SendItemType(t *testing.T) {
+	var batches []string
+	w := NewMergeWriterRef(func(rbs []*RefBuffer, typ SendItemType) {
+		s := fmt.Sprintf("%d:", typ)
+		for _, rb := range rbs {
+			s += string(rb.Bytes())
+		}
+		batches = append(batches, s)
+	}, 1024)
+	write := func(s string, typ SendItemType) {
+		rb := WrapRefBuffer([]byte(s))
+		w.WriteRef(rb, typ)
+		rb.Release()
+	}
+
+	// 信令单独一批，关键帧开始新的一批，有非关键帧的批次按非关键帧处理
+	write("a", SendItemTypeAudio)
+	write("M", SendItemTypeOther)
+	write("a", SendItemTypeAudio)
+	write("K", SendItemTypeVideoKey)
+	write("p", SendItemTypeVideoNonKey)
+	write("a", SendItemTypeAudio)
+	write("K", SendItemTypeVideoKey)
+	w.Flush()
+	write("a", SendItemTypeAudio)
+	write("p", SendItemTypeVideoNonKey)
+	w.Flush()
+	assert.Equal(t, []string{"1:a", "0:M", "1:a", "2:Kpa", "2:K", "3:ap"}, batches)
+}
@@ -18,10 +18,16 @@ const (
 	AudioCodecAac   = "AAC"
 	AudioCodecG711U = "PCMU"
 	AudioCodecG711A = "PCMA"
+	AudioCodecOpus  = "OPUS"
+	AudioCodecFlac  = "FLAC"
+	AudioCodecAc3   = "AC3"
+	AudioCodecEac3  = "EAC3"
 
 	// VideoCodecAvc StatGroup.VideoCodec
 	VideoCodecAvc  = "H264"
 	VideoCodecHevc = "H265"
+	VideoCodecAv1  = "AV1"
+	VideoCodecVp9  = "VP9"
 )
 
 type LalInfo struct {
@@ -44,6 +50,15 @@ type StatGroup struct {
 	StatPub     StatPub   `json:"pub"`
 	StatSubs    []StatSub `json:"subs"` // TODO(chef): [opt] 增加数量字段，因为这里不一定全部放入
 	StatPull    StatPull  `json:"pull"`
+
+	// Tracks enhanced-rtmp multitrack流中的所有track，trackId为0的默认track对应上面的AudioCodec和VideoCodec
+	Tracks []StatTrack `json:"tracks"`
+}
+
+type StatTrack struct {
+	Type    string `json:"type"` // "audio" 或 "video"
+	TrackId int    `json:"track_id"`
+	Codec   string `json:"codec"` // 见 AudioCodecXxx 和 VideoCodecXxx ，不认识的编码为FourCC
 }
 
 type StatSession struct {
@@ -60,6 +75,19 @@ type StatSession struct {
 	ReadBitrateKbits  int    `json:"read_bitrate_kbits"`
 	WriteBitrateKbits int    `json:"write_bitrate_kbits"`
 
+	// 收包质量统计，目前只有gb28181 PubSession和rtsp udp模式的输入类型session使用
+	LostPacketCount      uint64 `json:"lost_packet_count,omitempty"`
+	ReorderedPacketCount uint64 `json:"reordered_packet_count,omitempty"`
+	DroppedFrameCount    uint64 `json:"dropped_frame_count,omitempty"`
+
+	// 丢包重传统计，目前只有rtsp udp模式使用
+	// 输入类型session中NackPacketCount为本端请求重传的包数量，输出类型session中为响应对端请求成功重传的包数量
+	NackPacketCount          uint64 `json:"nack_packet_count,omitempty"`
+	RetransmittedPacketCount uint64 `json:"retransmitted_packet_count,omitempty"`
+
+	// 音视频同步统计，目前只有rtsp的输入类型session使用，由RTCP SR测得，见 rtsp.AvPacketQueue AvOffset
+	AvSyncOffsetMs int64 `json:"av_sync_offset_ms,omitempty"`
+
 	typ SessionType
 }
 
@@ -73,6 +101,9 @@ type StatSub struct {
 
 type StatPull struct {
 	StatSession
+
+	// Url 实际拉流的地址，不包含用户名和密码。如果发生了重定向（目前只有rtsp支持），则为重定向后的地址
+	Url string `json:"url,omitempty"`
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -90,7 +121,11 @@ func Session2StatSub(session ISession) StatSub {
 }
 
 func Session2StatPull(session ISession) StatPull {
-	return StatPull{
-		session.GetStat(),
+	stat := StatPull{
+		StatSession: session.GetStat(),
+	}
+	if ctx, err := ParseUrl(session.Url(), -1); err == nil {
+		stat.Url = ctx.RawUrlWithoutUserInfo
 	}
+	return stat
 }
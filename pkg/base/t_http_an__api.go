@@ -19,8 +19,9 @@ const (
 	AutoStopPullAfterNoOutMsNever       = -1
 	AutoStopPullAfterNoOutMsImmediately = 0
 
-	RtspModeTcp = 0
-	RtspModeUdp = 1
+	RtspModeTcp  = 0
+	RtspModeUdp  = 1
+	RtspModeAuto = 2 // 先尝试udp，没有收到数据时自动切换为tcp
 )
 
 type ApiCtrlStartRelayPullReq struct {
@@ -43,7 +44,35 @@ type ApiCtrlStartRtpPubReq struct {
 	Port            int    `json:"port"`
 	TimeoutMs       int    `json:"timeout_ms"`
 	IsTcpFlag       int    `json:"is_tcp_flag"`
+	JitterBufferMs  int    `json:"jitter_buffer_ms"`
+	RtcpMode        int    `json:"rtcp_mode"` // 只在udp模式下生效，0 不开启rtcp，1 rtcp使用rtp端口+1，2 rtp和rtcp复用同一个端口
 	DebugDumpPacket string `json:"debug_dump_packet"`
+
+	// 回放、下载使用。Sdp为sip INVITE中的sdp，当s=Playback或s=Download时，根据t=确定回放时长
+	// 如果stream_name为空，则使用 `<device_id>_<channel>_<start>_<end>` 作为流名称
+	Sdp      string `json:"sdp"`
+	DeviceId string `json:"device_id"`
+}
+
+const (
+	RtcpModeDisable     = 0
+	RtcpModePortPlusOne = 1
+	RtcpModeMux         = 2
+)
+
+type ApiCtrlRtpPubMansRtspReq struct {
+	StreamName string `json:"stream_name"`
+	Body       string `json:"body"` // sip INFO中的MANSRTSP消息
+}
+
+type ApiCtrlStartRtpTalkReq struct {
+	StreamName    string `json:"stream_name"`
+	Ssrc          uint32 `json:"ssrc"`
+	PackType      int    `json:"pack_type"`       // 0 ps, 1 raw rtp
+	Transport     int    `json:"transport"`       // 0 udp, 1 tcp active, 2 tcp passive
+	LocalPort     int    `json:"local_port"`      // 为0时自动选择
+	RemoteAddr    string `json:"remote_addr"`     // 设备地址，tcp passive时不需要
+	PsPayloadType int    `json:"ps_payload_type"` // 为0时使用默认值96
 }
 
 // ----- response ------------------------------------------------------------------------------------------------------
@@ -64,6 +93,7 @@ const (
 
 	ErrorCodeStartRelayPullFail = 2001
 	ErrorCodeListenUdpPortFail  = 2002
+	ErrorCodeStartRtpTalkFail   = 2003
 )
 
 type ApiRespBasic struct {
@@ -120,3 +150,16 @@ type ApiCtrlStartRtpPubResp struct {
 		Port       int    `json:"port"`
 	} `json:"data"`
 }
+
+type ApiCtrlRtpPubMansRtspResp struct {
+	ApiRespBasic
+}
+
+type ApiCtrlStartRtpTalkResp struct {
+	ApiRespBasic
+	Data struct {
+		StreamName string `json:"stream_name"`
+		SessionId  string `json:"session_id"`
+		Port       int    `json:"port"`
+	} `json:"data"`
+}
@@ -49,8 +49,16 @@ type PubStartInfo struct {
 
 type PubStopInfo struct {
 	SessionEventCommonInfo
+
+	Reason string `json:"reason"` // 目前只有gb28181回放、下载结束时有值，见 PubStopReasonPlaybackFinished 等
 }
 
+const (
+	PubStopReasonPlaybackFinished = "playback_finished" // 播放到结尾
+	PubStopReasonTimeout          = "timeout"           // 超时没有收到数据
+	PubStopReasonClosed           = "closed"            // 其他原因关闭，比如连接断开、调用api关闭
+)
+
 type SubStartInfo struct {
 	SessionEventCommonInfo
 }
@@ -75,6 +83,10 @@ type RtmpConnectInfo struct {
 	App        string `json:"app"`
 	FlashVer   string `json:"flashVer"`
 	TcUrl      string `json:"tcUrl"`
+	SwfUrl     string `json:"swfUrl"`
+	PageUrl    string `json:"pageUrl"`
+
+	Args map[string]interface{} `json:"args"` // connect信令command object中的所有字段，包括自定义字段
 }
 
 type HlsMakeTsInfo struct {
@@ -100,7 +112,7 @@ func Session2PubStartInfo(session ISession) PubStartInfo {
 
 func Session2PubStopInfo(session ISession) PubStopInfo {
 	return PubStopInfo{
-		session2EventCommonInfo(session),
+		SessionEventCommonInfo: session2EventCommonInfo(session),
 	}
 }
 
@@ -32,6 +32,7 @@ const (
 	// RtmpTypeIdWinAckSize 见 RtmpTypeIdAck
 	RtmpTypeIdWinAckSize         uint8 = 5
 	RtmpTypeIdBandwidth          uint8 = 6
+	RtmpTypeIdDataMessageAmf3    uint8 = 15
 	RtmpTypeIdCommandMessageAmf3 uint8 = 17
 	RtmpTypeIdCommandMessageAmf0 uint8 = 20
 	RtmpTypeIdAggregateMessage   uint8 = 22
@@ -41,6 +42,7 @@ const (
 	// user control message type
 	//
 	RtmpUserControlStreamBegin  uint8 = 0
+	RtmpUserControlStreamEof    uint8 = 1
 	RtmpUserControlRecorded     uint8 = 4
 	RtmpUserControlPingRequest  uint8 = 6
 	RtmpUserControlPingResponse uint8 = 7
@@ -60,6 +62,13 @@ const (
 	RtmpCodecIdAvc  uint8 = 7
 	RtmpCodecIdHevc uint8 = 12
 
+	// RtmpCodecIdAv1 RtmpCodecIdVp9
+	//
+	// 注意，AV1和VP9只能通过enhanced-rtmp的FourCC携带，这两个值不会出现在rtmp/flv数据中，
+	// 只是lal内部使用，作为 RtmpMsg.VideoCodecId 的返回值
+	RtmpCodecIdAv1 uint8 = 13
+	RtmpCodecIdVp9 uint8 = 14
+
 	// RtmpAvcPacketTypeSeqHeader RtmpAvcPacketTypeNalu RtmpHevcPacketTypeSeqHeader RtmpHevcPacketTypeNalu
 	// 注意，按照标准文档上描述，PacketType还有可能为2：
 	// 2: AVC end of sequence (lower level NALU sequence ender is not required or supported)
@@ -76,6 +85,29 @@ const (
 	RtmpExPacketTypeCodedFrames   uint8 = 1 // CompositionTime不为0时有这个类型
 	RtmpExPacketTypeSequenceEnd   uint8 = 2
 	RtmpExPacketTypeCodedFramesX  uint8 = 3
+	RtmpExPacketTypeMetadata      uint8 = 4
+	RtmpExPacketTypeMultitrack    uint8 = 6
+	RtmpExPacketTypeModEx         uint8 = 7
+
+	// RtmpExAudioPacketTypeSequenceStart RtmpExAudioPacketTypeXxx...
+	//
+	// enhanced-rtmp v2 音频的packetType，SoundFormat为 RtmpSoundFormatExHeader 时有效
+	RtmpExAudioPacketTypeSequenceStart      uint8 = 0
+	RtmpExAudioPacketTypeCodedFrames        uint8 = 1
+	RtmpExAudioPacketTypeSequenceEnd        uint8 = 2
+	RtmpExAudioPacketTypeMultichannelConfig uint8 = 4
+	RtmpExAudioPacketTypeMultitrack         uint8 = 5
+	RtmpExAudioPacketTypeModEx              uint8 = 7
+
+	// RtmpExMultitrackTypeOneTrack RtmpExMultitrackTypeXxx...
+	//
+	// enhanced-rtmp v2 multitrack的类型
+	// OneTrack:             只有一个track，所有track共用一个FourCC，track数据前面没有长度字段
+	// ManyTracks:           多个track，所有track共用一个FourCC
+	// ManyTracksManyCodecs: 多个track，每个track有自己的FourCC
+	RtmpExMultitrackTypeOneTrack             uint8 = 0
+	RtmpExMultitrackTypeManyTracks           uint8 = 1
+	RtmpExMultitrackTypeManyTracksManyCodecs uint8 = 2
 
 	// RtmpExFrameTypeKeyFrame RtmpExFrameTypeXXX...
 	//
@@ -84,7 +116,23 @@ const (
 	// 1 = key frame (a seekable frame)
 	// 2 = inter frame (a non-seekable frame)
 	// ...
-	RtmpExFrameTypeKeyFrame uint8 = 1
+	RtmpExFrameTypeKeyFrame   uint8 = 1
+	RtmpExFrameTypeInterFrame uint8 = 2
+
+	// RtmpExFourCcAvc RtmpExFourCcXxx...
+	//
+	// enhanced-rtmp扩展头中，紧跟在第一个字节后面的4字节FourCC
+	RtmpExFourCcAvc  = "avc1"
+	RtmpExFourCcHevc = "hvc1"
+	RtmpExFourCcAv1  = "av01"
+	RtmpExFourCcVp9  = "vp09"
+
+	RtmpExFourCcAac  = "mp4a"
+	RtmpExFourCcMp3  = ".mp3"
+	RtmpExFourCcOpus = "Opus"
+	RtmpExFourCcFlac = "fLaC"
+	RtmpExFourCcAc3  = "ac-3"
+	RtmpExFourCcEac3 = "ec-3"
 
 	RtmpAvcKeyFrame    = RtmpFrameTypeKey<<4 | RtmpCodecIdAvc
 	RtmpHevcKeyFrame   = RtmpFrameTypeKey<<4 | RtmpCodecIdHevc
@@ -102,9 +150,19 @@ const (
 	//     AACPacketType UI8
 	//     Data          UI8[n]
 	// 注意，视频的CodecId是后4位，音频是前4位
-	RtmpSoundFormatG711A uint8 = 7
-	RtmpSoundFormatG711U uint8 = 8
-	RtmpSoundFormatAac   uint8 = 10
+	RtmpSoundFormatG711A    uint8 = 7
+	RtmpSoundFormatG711U    uint8 = 8
+	RtmpSoundFormatExHeader uint8 = 9 // enhanced-rtmp v2，后面跟着FourCC
+	RtmpSoundFormatAac      uint8 = 10
+
+	// RtmpSoundFormatOpus RtmpSoundFormatFlac RtmpSoundFormatAc3 RtmpSoundFormatEac3
+	//
+	// 注意，这几种编码只能通过enhanced-rtmp的FourCC携带，这几个值不会出现在rtmp/flv数据中（SoundFormat只有4位），
+	// 只是lal内部使用，作为 RtmpMsg.AudioCodecId 的返回值
+	RtmpSoundFormatOpus uint8 = 16
+	RtmpSoundFormatFlac uint8 = 17
+	RtmpSoundFormatAc3  uint8 = 18
+	RtmpSoundFormatEac3 uint8 = 19
 
 	RtmpAacPacketTypeSeqHeader = 0
 	RtmpAacPacketTypeRaw       = 1
@@ -132,17 +190,21 @@ func (msg RtmpMsg) IsHevcKeySeqHeader() bool {
 		return false
 	}
 
-	isExtHeader := msg.Payload[0] & 0x80
-	if isExtHeader != 0 {
-		packetType := msg.Payload[0] & 0x0f
-		if msg.Payload[1] == 'h' && msg.Payload[2] == 'v' && msg.Payload[3] == 'c' && msg.Payload[4] == '1' && packetType == RtmpExPacketTypeSequenceStart {
-			return true
-		}
-	} else {
-		return msg.Payload[0] == RtmpHevcKeyFrame && msg.Payload[1] == RtmpHevcPacketTypeSeqHeader
+	if msg.IsEnhanced() {
+		return msg.isExFourCc(RtmpExFourCcHevc) && msg.exPacketType() == RtmpExPacketTypeSequenceStart
 	}
 
-	return false
+	return msg.Payload[0] == RtmpHevcKeyFrame && msg.Payload[1] == RtmpHevcPacketTypeSeqHeader
+}
+
+// IsAv1KeySeqHeader enhanced-rtmp av01的SequenceStart，数据为AV1CodecConfigurationRecord(av1C)
+func (msg RtmpMsg) IsAv1KeySeqHeader() bool {
+	return msg.Header.MsgTypeId == RtmpTypeIdVideo && msg.isExFourCc(RtmpExFourCcAv1) && msg.exPacketType() == RtmpExPacketTypeSequenceStart
+}
+
+// IsVp9KeySeqHeader enhanced-rtmp vp09的SequenceStart，数据为VPCodecConfigurationRecord(vpcC)
+func (msg RtmpMsg) IsVp9KeySeqHeader() bool {
+	return msg.Header.MsgTypeId == RtmpTypeIdVideo && msg.isExFourCc(RtmpExFourCcVp9) && msg.exPacketType() == RtmpExPacketTypeSequenceStart
 }
 
 func (msg RtmpMsg) IsEnhanced() bool {
@@ -154,8 +216,9 @@ func (msg RtmpMsg) IsEnhanced() bool {
 	return false
 }
 
+// IsVideoKeySeqHeader AVC、HEVC、AV1或VP9的seq header
 func (msg RtmpMsg) IsVideoKeySeqHeader() bool {
-	return msg.IsAvcKeySeqHeader() || msg.IsHevcKeySeqHeader()
+	return msg.IsAvcKeySeqHeader() || msg.IsHevcKeySeqHeader() || msg.IsAv1KeySeqHeader() || msg.IsVp9KeySeqHeader()
 }
 
 func (msg RtmpMsg) IsAvcKeyNalu() bool {
@@ -167,16 +230,32 @@ func (msg RtmpMsg) IsHevcKeyNalu() bool {
 		return false
 	}
 
-	isExtHeader := msg.Payload[0] & 0x80
-	if isExtHeader != 0 {
-		frameType := msg.Payload[0] >> 4 & 0x07
-		packetType := msg.Payload[0] & 0x0F
-		return frameType == RtmpExFrameTypeKeyFrame && packetType != RtmpExPacketTypeSequenceStart
+	if msg.IsEnhanced() {
+		return msg.isExFourCc(RtmpExFourCcHevc) && msg.isExKeyCodedFrames()
 	}
 
 	return msg.Payload[0] == RtmpHevcKeyFrame && msg.Payload[1] == RtmpHevcPacketTypeNalu
 }
 
+// IsAv1KeyFrame enhanced-rtmp av01的关键帧，帧数据从payload[5:]开始（av01的CodedFrames不携带CompositionTime）
+func (msg RtmpMsg) IsAv1KeyFrame() bool {
+	return msg.Header.MsgTypeId == RtmpTypeIdVideo && msg.isExFourCc(RtmpExFourCcAv1) && msg.isExKeyCodedFrames()
+}
+
+// IsVp9KeyFrame enhanced-rtmp vp09的关键帧，帧数据从payload[5:]开始
+func (msg RtmpMsg) IsVp9KeyFrame() bool {
+	return msg.Header.MsgTypeId == RtmpTypeIdVideo && msg.isExFourCc(RtmpExFourCcVp9) && msg.isExKeyCodedFrames()
+}
+
+// IsExCodedFrames enhanced-rtmp的CodedFrames或CodedFramesX，和编码格式无关
+func (msg RtmpMsg) IsExCodedFrames() bool {
+	if !msg.IsEnhanced() {
+		return false
+	}
+	packetType := msg.exPacketType()
+	return packetType == RtmpExPacketTypeCodedFrames || packetType == RtmpExPacketTypeCodedFramesX
+}
+
 func (msg RtmpMsg) IsEnchanedHevcNalu() bool {
 	isExtHeader := msg.Payload[0] & 0x80
 	if isExtHeader != 0 {
@@ -205,29 +284,66 @@ func (msg RtmpMsg) GetEnchanedHevcNaluIndex() int {
 	return 0
 }
 
+// IsVideoKeyNalu AVC或HEVC的关键帧，AV1或VP9的关键帧，以及enhanced-rtmp multitrack的关键帧
 func (msg RtmpMsg) IsVideoKeyNalu() bool {
-	return msg.IsAvcKeyNalu() || msg.IsHevcKeyNalu()
+	return msg.IsAvcKeyNalu() || msg.IsHevcKeyNalu() || msg.IsAv1KeyFrame() || msg.IsVp9KeyFrame() || msg.isMultitrackKeyFrame()
 }
 
 func (msg RtmpMsg) IsAacSeqHeader() bool {
 	return msg.Header.MsgTypeId == RtmpTypeIdAudio && msg.AudioCodecId() == RtmpSoundFormatAac && msg.Payload[1] == RtmpAacPacketTypeSeqHeader
 }
 
+// VideoCodecId
+//
+// enhanced-rtmp根据FourCC返回对应的 RtmpCodecIdXxx ，不认识的FourCC返回0
 func (msg RtmpMsg) VideoCodecId() uint8 {
-	isExtHeader := msg.Payload[0] & 0x80
-	if isExtHeader == 0 {
+	if !msg.IsEnhanced() {
 		return msg.Payload[0] & 0xF
 	}
 
-	if msg.Payload[1] == 'h' && msg.Payload[2] == 'v' && msg.Payload[3] == 'c' && msg.Payload[4] == '1' {
+	switch {
+	case msg.isExFourCc(RtmpExFourCcAvc):
+		return RtmpCodecIdAvc
+	case msg.isExFourCc(RtmpExFourCcHevc):
 		return RtmpCodecIdHevc
+	case msg.isExFourCc(RtmpExFourCcAv1):
+		return RtmpCodecIdAv1
+	case msg.isExFourCc(RtmpExFourCcVp9):
+		return RtmpCodecIdVp9
 	}
 
-	return RtmpCodecIdAvc
+	return 0
 }
 
+// AudioCodecId
+//
+// enhanced-rtmp根据FourCC返回对应的 RtmpSoundFormatXxx ，不认识的FourCC以及ManyTracksManyCodecs类型的multitrack返回 RtmpSoundFormatExHeader
 func (msg RtmpMsg) AudioCodecId() uint8 {
-	return msg.Payload[0] >> 4
+	soundFormat := msg.Payload[0] >> 4
+	if soundFormat != RtmpSoundFormatExHeader {
+		return soundFormat
+	}
+
+	var fourCc string
+	if msg.IsMultitrack() {
+		if len(msg.Payload) >= 6 && msg.Payload[1]>>4 != RtmpExMultitrackTypeManyTracksManyCodecs {
+			fourCc = string(msg.Payload[2:6])
+		}
+	} else if len(msg.Payload) >= 5 {
+		fourCc = string(msg.Payload[1:5])
+	}
+
+	switch fourCc {
+	case RtmpExFourCcOpus:
+		return RtmpSoundFormatOpus
+	case RtmpExFourCcFlac:
+		return RtmpSoundFormatFlac
+	case RtmpExFourCcAc3:
+		return RtmpSoundFormatAc3
+	case RtmpExFourCcEac3:
+		return RtmpSoundFormatEac3
+	}
+	return RtmpSoundFormatExHeader
 }
 
 func (msg RtmpMsg) Clone() (ret RtmpMsg) {
@@ -245,7 +361,7 @@ func (msg RtmpMsg) Dts() uint32 {
 //
 // 注意，只有视频才能调用该函数获取pts，音频的dts和pts都直接使用 RtmpMsg.Header.TimestampAbs
 func (msg RtmpMsg) Pts() uint32 {
-	return msg.Header.TimestampAbs + bele.BeUint24(msg.Payload[2:])
+	return msg.Header.TimestampAbs + msg.Cts()
 }
 
 func (msg RtmpMsg) Cts() uint32 {
@@ -258,8 +374,13 @@ func (msg RtmpMsg) Cts() uint32 {
 		packetType := msg.Payload[0] & 0x0F
 		switch packetType {
 		case RtmpExPacketTypeCodedFrames:
-			return bele.BeUint24(msg.Payload[5:])
-		case RtmpExPacketTypeCodedFramesX:
+			// 只有avc1和hvc1的CodedFrames携带CompositionTime
+			if msg.isExFourCc(RtmpExFourCcAvc) || msg.isExFourCc(RtmpExFourCcHevc) {
+				return bele.BeUint24(msg.Payload[5:])
+			}
+			return 0
+		case RtmpExPacketTypeCodedFramesX, RtmpExPacketTypeMultitrack:
+			// multitrack中每个track的CompositionTime可能不同，见 RtmpTrack
 			return 0
 		default:
 			Log.Warnf("RtmpMsg.Cts: packetType invalid, packetType=%d", packetType)
@@ -286,3 +407,20 @@ func (msg RtmpMsg) DebugString() string {
 	return fmt.Sprintf("type=%d,len=%d,dts=%d, payload=%s",
 		msg.Header.MsgTypeId, msg.Header.MsgLen, msg.Header.TimestampAbs, hex.Dump(nazabytes.Prefix(msg.Payload, 64)))
 }
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (msg RtmpMsg) isExFourCc(fourCc string) bool {
+	return msg.IsEnhanced() && len(msg.Payload) >= 5 && string(msg.Payload[1:5]) == fourCc
+}
+
+func (msg RtmpMsg) exPacketType() uint8 {
+	return msg.Payload[0] & 0x0F
+}
+
+// isExKeyCodedFrames enhanced-rtmp中携带帧数据的关键帧
+func (msg RtmpMsg) isExKeyCodedFrames() bool {
+	frameType := msg.Payload[0] >> 4 & 0x07
+	packetType := msg.exPacketType()
+	return frameType == RtmpExFrameTypeKeyFrame && (packetType == RtmpExPacketTypeCodedFrames || packetType == RtmpExPacketTypeCodedFramesX)
+}
@@ -0,0 +1,283 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base
+
+import (
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+)
+
+// enhanced-rtmp v2 multitrack
+//
+// 视频:
+//   [0x80 | FrameType << 4 | RtmpExPacketTypeMultitrack]
+// 音频:
+//   [RtmpSoundFormatExHeader << 4 | RtmpExAudioPacketTypeMultitrack]
+//
+// 后面的结构音视频相同:
+//   [AvMultitrackType << 4 | PacketType]
+//   [FourCC]                                     // 不是ManyTracksManyCodecs时存在
+//   loop {
+//     [FourCC]                                   // ManyTracksManyCodecs时存在
+//     [TrackId UI8]
+//     [SizeOfTrack UI24]                         // 不是OneTrack时存在
+//     [Data]                                     // 和非multitrack时FourCC后面的数据相同
+//   }
+//
+// trackId为0的track是默认track。
+
+// DefaultRtmpTrackId 默认track
+const DefaultRtmpTrackId uint8 = 0
+
+// RtmpTrack enhanced-rtmp multitrack消息中的一个track
+type RtmpTrack struct {
+	TrackId    uint8
+	FourCc     string
+	FrameType  uint8  // 只有视频有效，见 RtmpExFrameTypeKeyFrame
+	PacketType uint8  // 视频见 RtmpExPacketTypeXxx ，音频见 RtmpExAudioPacketTypeXxx
+	Data       []byte // 和非multitrack时FourCC后面的数据相同，比如avc1和hvc1的CodedFrames包含CompositionTime
+}
+
+// IsMultitrack 是否是enhanced-rtmp v2的multitrack消息
+func (msg RtmpMsg) IsMultitrack() bool {
+	if len(msg.Payload) < 2 {
+		return false
+	}
+	switch msg.Header.MsgTypeId {
+	case RtmpTypeIdVideo:
+		return msg.IsEnhanced() && msg.exPacketType() == RtmpExPacketTypeMultitrack
+	case RtmpTypeIdAudio:
+		return msg.Payload[0]>>4 == RtmpSoundFormatExHeader && msg.Payload[0]&0x0F == RtmpExAudioPacketTypeMultitrack
+	}
+	return false
+}
+
+// IsExAudioSeqHeader enhanced-rtmp v2非multitrack的音频SequenceStart，比如Opus、FLAC
+func (msg RtmpMsg) IsExAudioSeqHeader() bool {
+	return msg.Header.MsgTypeId == RtmpTypeIdAudio && len(msg.Payload) >= 5 &&
+		msg.Payload[0]>>4 == RtmpSoundFormatExHeader && msg.Payload[0]&0x0F == RtmpExAudioPacketTypeSequenceStart
+}
+
+// IsMultitrackSeqHeader multitrack消息中携带的是SequenceStart或MultichannelConfig
+func (msg RtmpMsg) IsMultitrackSeqHeader() bool {
+	if !msg.IsMultitrack() {
+		return false
+	}
+	packetType := msg.Payload[1] & 0x0F
+	if msg.Header.MsgTypeId == RtmpTypeIdAudio {
+		return packetType == RtmpExAudioPacketTypeSequenceStart || packetType == RtmpExAudioPacketTypeMultichannelConfig
+	}
+	return packetType == RtmpExPacketTypeSequenceStart
+}
+
+// ParseTracks 解析multitrack消息中的所有track
+//
+// @return 返回的 RtmpTrack.Data 复用`msg.Payload`的内存块
+func (msg RtmpMsg) ParseTracks() (tracks []RtmpTrack, err error) {
+	if !msg.IsMultitrack() {
+		return nil, nazaerrors.Wrap(ErrRtmpUnexpectedMsg)
+	}
+
+	var frameType uint8
+	if msg.Header.MsgTypeId == RtmpTypeIdVideo {
+		frameType = msg.Payload[0] >> 4 & 0x07
+	}
+	multitrackType := msg.Payload[1] >> 4
+	packetType := msg.Payload[1] & 0x0F
+	if packetType == RtmpExPacketTypeModEx || multitrackType > RtmpExMultitrackTypeManyTracksManyCodecs {
+		return nil, nazaerrors.Wrap(ErrRtmpUnexpectedMsg)
+	}
+
+	b := msg.Payload[2:]
+	var fourCc string
+	if multitrackType != RtmpExMultitrackTypeManyTracksManyCodecs {
+		if len(b) < 4 {
+			return nil, nazaerrors.Wrap(ErrRtmpShortBuffer)
+		}
+		fourCc = string(b[:4])
+		b = b[4:]
+	}
+
+	for len(b) > 0 {
+		t := RtmpTrack{
+			FourCc:     fourCc,
+			FrameType:  frameType,
+			PacketType: packetType,
+		}
+		if multitrackType == RtmpExMultitrackTypeManyTracksManyCodecs {
+			if len(b) < 4 {
+				return nil, nazaerrors.Wrap(ErrRtmpShortBuffer)
+			}
+			t.FourCc = string(b[:4])
+			b = b[4:]
+		}
+		if len(b) < 1 {
+			return nil, nazaerrors.Wrap(ErrRtmpShortBuffer)
+		}
+		t.TrackId = b[0]
+		b = b[1:]
+
+		if multitrackType == RtmpExMultitrackTypeOneTrack {
+			t.Data = b
+			b = nil
+		} else {
+			if len(b) < 3 {
+				return nil, nazaerrors.Wrap(ErrRtmpShortBuffer)
+			}
+			size := int(bele.BeUint24(b))
+			if len(b) < 3+size {
+				return nil, nazaerrors.Wrap(ErrRtmpShortBuffer)
+			}
+			t.Data = b[3 : 3+size]
+			b = b[3+size:]
+		}
+		tracks = append(tracks, t)
+
+		if multitrackType == RtmpExMultitrackTypeOneTrack {
+			break
+		}
+	}
+	return tracks, nil
+}
+
+// DefaultTrackMsg 从multitrack消息中取出默认track，转换成非multitrack的消息，供不支持multitrack的输出使用
+//
+// avc1、hvc1、mp4a转换成legacy的rtmp格式，其他FourCC转换成非multitrack的enhanced-rtmp格式。
+//
+// @return ok: 为false时表示消息中没有默认track
+//
+// @return msg: 内存块为内部独立新申请
+func (msg RtmpMsg) DefaultTrackMsg() (ret RtmpMsg, ok bool) {
+	tracks, err := msg.ParseTracks()
+	if err != nil {
+		return ret, false
+	}
+	for _, t := range tracks {
+		if t.TrackId == DefaultRtmpTrackId {
+			return t.ToRtmpMsg(msg.Header), true
+		}
+	}
+	return ret, false
+}
+
+// ToRtmpMsg 将track转换成非multitrack的消息，转换规则见 RtmpMsg.DefaultTrackMsg
+//
+// @param header: 使用其中除MsgLen外的字段
+//
+// @return 内存块为内部独立新申请
+func (t RtmpTrack) ToRtmpMsg(header RtmpHeader) RtmpMsg {
+	var payload []byte
+	if header.MsgTypeId == RtmpTypeIdVideo {
+		payload = t.packVideo()
+	} else {
+		payload = t.packAudio()
+	}
+	header.MsgLen = uint32(len(payload))
+	return RtmpMsg{
+		Header:  header,
+		Payload: payload,
+	}
+}
+
+// Codec 用于 StatTrack.Codec
+func (t RtmpTrack) Codec() string {
+	switch t.FourCc {
+	case RtmpExFourCcAvc:
+		return VideoCodecAvc
+	case RtmpExFourCcHevc:
+		return VideoCodecHevc
+	case RtmpExFourCcAv1:
+		return VideoCodecAv1
+	case RtmpExFourCcVp9:
+		return VideoCodecVp9
+	case RtmpExFourCcAac:
+		return AudioCodecAac
+	case RtmpExFourCcOpus:
+		return AudioCodecOpus
+	case RtmpExFourCcFlac:
+		return AudioCodecFlac
+	case RtmpExFourCcAc3:
+		return AudioCodecAc3
+	case RtmpExFourCcEac3:
+		return AudioCodecEac3
+	}
+	return t.FourCc
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// isMultitrackKeyFrame multitrack消息中所有track共用FrameType
+func (msg RtmpMsg) isMultitrackKeyFrame() bool {
+	if msg.Header.MsgTypeId != RtmpTypeIdVideo || !msg.IsMultitrack() {
+		return false
+	}
+	frameType := msg.Payload[0] >> 4 & 0x07
+	packetType := msg.Payload[1] & 0x0F
+	return frameType == RtmpExFrameTypeKeyFrame && (packetType == RtmpExPacketTypeCodedFrames || packetType == RtmpExPacketTypeCodedFramesX)
+}
+
+func (t RtmpTrack) packVideo() []byte {
+	var codecId uint8
+	switch t.FourCc {
+	case RtmpExFourCcAvc:
+		codecId = RtmpCodecIdAvc
+	case RtmpExFourCcHevc:
+		codecId = RtmpCodecIdHevc
+	}
+
+	if codecId != 0 {
+		switch t.PacketType {
+		case RtmpExPacketTypeSequenceStart, RtmpExPacketTypeSequenceEnd, RtmpExPacketTypeCodedFramesX:
+			// legacy格式中这几种类型都带有CompositionTime，填0
+			packetType := RtmpAvcPacketTypeSeqHeader
+			if t.PacketType == RtmpExPacketTypeSequenceEnd {
+				packetType = 2
+			} else if t.PacketType == RtmpExPacketTypeCodedFramesX {
+				packetType = RtmpAvcPacketTypeNalu
+			}
+			out := make([]byte, 5+len(t.Data))
+			out[0] = t.FrameType<<4 | codecId
+			out[1] = packetType
+			copy(out[5:], t.Data)
+			return out
+		case RtmpExPacketTypeCodedFrames:
+			out := make([]byte, 2+len(t.Data))
+			out[0] = t.FrameType<<4 | codecId
+			out[1] = RtmpAvcPacketTypeNalu
+			copy(out[2:], t.Data)
+			return out
+		}
+	}
+
+	out := make([]byte, 5+len(t.Data))
+	out[0] = 0x80 | t.FrameType<<4 | t.PacketType
+	copy(out[1:], t.FourCc)
+	copy(out[5:], t.Data)
+	return out
+}
+
+func (t RtmpTrack) packAudio() []byte {
+	if t.FourCc == RtmpExFourCcAac &&
+		(t.PacketType == RtmpExAudioPacketTypeSequenceStart || t.PacketType == RtmpExAudioPacketTypeCodedFrames) {
+		out := make([]byte, 2+len(t.Data))
+		out[0] = RtmpSoundFormatAac<<4 | 0x0F
+		out[1] = RtmpAacPacketTypeSeqHeader
+		if t.PacketType == RtmpExAudioPacketTypeCodedFrames {
+			out[1] = RtmpAacPacketTypeRaw
+		}
+		copy(out[2:], t.Data)
+		return out
+	}
+
+	out := make([]byte, 5+len(t.Data))
+	out[0] = RtmpSoundFormatExHeader<<4 | t.PacketType
+	copy(out[1:], t.FourCc)
+	copy(out[5:], t.Data)
+	return out
+}
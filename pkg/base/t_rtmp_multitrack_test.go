@@ -0,0 +1,104 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+func TestRtmpMsgMultitrack(t *testing.T) {
+	header := base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo, TimestampAbs: 1000}
+
+	// 视频，ManyTracks，avc1 CodedFrames 关键帧，track 0和track 1
+	payload := []byte{0x80 | base.RtmpExFrameTypeKeyFrame<<4 | base.RtmpExPacketTypeMultitrack,
+		base.RtmpExMultitrackTypeManyTracks<<4 | base.RtmpExPacketTypeCodedFrames}
+	payload = append(payload, base.RtmpExFourCcAvc...)
+	payload = append(payload, 0, 0x00, 0x00, 0x07, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01)
+	payload = append(payload, 1, 0x00, 0x00, 0x04, 0x00, 0x00, 0x28, 0x09)
+	msg := base.RtmpMsg{Header: header, Payload: payload}
+
+	assert.Equal(t, true, msg.IsMultitrack())
+	assert.Equal(t, false, msg.IsMultitrackSeqHeader())
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+	assert.Equal(t, false, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, uint32(0), msg.Cts())
+	tracks, err := msg.ParseTracks()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(tracks))
+	assert.Equal(t, uint8(1), tracks[1].TrackId)
+	assert.Equal(t, base.RtmpExFourCcAvc, tracks[1].FourCc)
+	assert.Equal(t, []byte{0x00, 0x00, 0x28, 0x09}, tracks[1].Data)
+
+	// 默认track转换成legacy格式
+	dmsg, ok := msg.DefaultTrackMsg()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, false, dmsg.IsMultitrack())
+	assert.Equal(t, true, dmsg.IsAvcKeyNalu())
+	assert.Equal(t, uint32(len(dmsg.Payload)), dmsg.Header.MsgLen)
+	assert.Equal(t, uint32(1040), dmsg.Pts())
+	assert.Equal(t, []byte{0x17, 0x01, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01}, dmsg.Payload)
+
+	// 音频，ManyTracksManyCodecs，mp4a的track 0和Opus的track 2
+	header.MsgTypeId = base.RtmpTypeIdAudio
+	payload = []byte{base.RtmpSoundFormatExHeader<<4 | base.RtmpExAudioPacketTypeMultitrack,
+		base.RtmpExMultitrackTypeManyTracksManyCodecs<<4 | base.RtmpExAudioPacketTypeSequenceStart}
+	payload = append(payload, base.RtmpExFourCcAac...)
+	payload = append(payload, 0, 0x00, 0x00, 0x02, 0x12, 0x10)
+	payload = append(payload, base.RtmpExFourCcOpus...)
+	payload = append(payload, 2, 0x00, 0x00, 0x01, 0xff)
+	msg = base.RtmpMsg{Header: header, Payload: payload}
+
+	assert.Equal(t, true, msg.IsMultitrack())
+	assert.Equal(t, true, msg.IsMultitrackSeqHeader())
+	assert.Equal(t, false, msg.IsAacSeqHeader())
+	assert.Equal(t, base.RtmpSoundFormatExHeader, msg.AudioCodecId())
+	tracks, err = msg.ParseTracks()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(tracks))
+	assert.Equal(t, base.RtmpExFourCcOpus, tracks[1].FourCc)
+	assert.Equal(t, uint8(2), tracks[1].TrackId)
+
+	dmsg, ok = msg.DefaultTrackMsg()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, dmsg.IsAacSeqHeader())
+	assert.Equal(t, []byte{0xaf, 0x00, 0x12, 0x10}, dmsg.Payload)
+
+	opusMsg := tracks[1].ToRtmpMsg(header)
+	assert.Equal(t, true, opusMsg.IsExAudioSeqHeader())
+	assert.Equal(t, base.RtmpSoundFormatOpus, opusMsg.AudioCodecId())
+
+	// OneTrack，不包含默认track
+	payload = []byte{base.RtmpSoundFormatExHeader<<4 | base.RtmpExAudioPacketTypeMultitrack,
+		base.RtmpExMultitrackTypeOneTrack<<4 | base.RtmpExAudioPacketTypeCodedFrames}
+	payload = append(payload, base.RtmpExFourCcOpus...)
+	payload = append(payload, 1, 0x01, 0x02, 0x03)
+	msg = base.RtmpMsg{Header: header, Payload: payload}
+	assert.Equal(t, base.RtmpSoundFormatOpus, msg.AudioCodecId())
+	tracks, err = msg.ParseTracks()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(tracks))
+	assert.Equal(t, []byte{0x01, 0x02, 0x03}, tracks[0].Data)
+	_, ok = msg.DefaultTrackMsg()
+	assert.Equal(t, false, ok)
+
+	// 长度字段错误
+	msg.Payload = []byte{base.RtmpSoundFormatExHeader<<4 | base.RtmpExAudioPacketTypeMultitrack,
+		base.RtmpExMultitrackTypeManyTracks<<4 | base.RtmpExAudioPacketTypeCodedFrames, 'O', 'p', 'u', 's', 0, 0x00, 0x00, 0x09, 0x01}
+	_, err = msg.ParseTracks()
+	assert.IsNotNil(t, err)
+
+	// 非multitrack
+	msg = base.RtmpMsg{Header: header, Payload: []byte{0xaf, 0x01, 0x21}}
+	assert.Equal(t, false, msg.IsMultitrack())
+	assert.Equal(t, base.RtmpSoundFormatAac, msg.AudioCodecId())
+}
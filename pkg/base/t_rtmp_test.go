@@ -0,0 +1,74 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package base_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+func TestRtmpMsgEnhanced(t *testing.T) {
+	newMsg := func(b0 uint8, fourCc string, body ...byte) base.RtmpMsg {
+		payload := append([]byte{b0}, fourCc...)
+		payload = append(payload, body...)
+		return base.RtmpMsg{
+			Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+			Payload: payload,
+		}
+	}
+
+	// hvc1 CodedFrames 关键帧，携带CompositionTime
+	msg := newMsg(0x91, base.RtmpExFourCcHevc, 0x00, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01, 0x26)
+	assert.Equal(t, true, msg.IsHevcKeyNalu())
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+	assert.Equal(t, false, msg.IsAv1KeyFrame())
+	assert.Equal(t, base.RtmpCodecIdHevc, msg.VideoCodecId())
+	assert.Equal(t, uint32(40), msg.Cts())
+
+	// av01 CodedFrames 关键帧，不携带CompositionTime
+	msg = newMsg(0x91, base.RtmpExFourCcAv1, 0x12, 0x00, 0x0a, 0x0b)
+	assert.Equal(t, false, msg.IsHevcKeyNalu())
+	assert.Equal(t, true, msg.IsAv1KeyFrame())
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+	assert.Equal(t, base.RtmpCodecIdAv1, msg.VideoCodecId())
+	assert.Equal(t, true, msg.IsExCodedFrames())
+	assert.Equal(t, uint32(0), msg.Cts())
+	msg.Header.TimestampAbs = 1000
+	assert.Equal(t, uint32(1000), msg.Pts())
+
+	// vp09 CodedFramesX 非关键帧
+	msg = newMsg(0xa3, base.RtmpExFourCcVp9, 0x86, 0x00, 0x40, 0x92)
+	assert.Equal(t, false, msg.IsVp9KeyFrame())
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+	assert.Equal(t, base.RtmpCodecIdVp9, msg.VideoCodecId())
+	assert.Equal(t, true, msg.IsExCodedFrames())
+
+	// vp09 SequenceEnd
+	msg = newMsg(0x92, base.RtmpExFourCcVp9)
+	assert.Equal(t, false, msg.IsVp9KeyFrame())
+	assert.Equal(t, false, msg.IsExCodedFrames())
+	assert.Equal(t, false, msg.IsVideoKeySeqHeader())
+
+	// 不认识的FourCC
+	msg = newMsg(0x91, "xxxx", 0x00)
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+	assert.Equal(t, uint8(0), msg.VideoCodecId())
+
+	// 非enhanced
+	msg = base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo, TimestampAbs: 1000},
+		Payload: []byte{base.RtmpAvcKeyFrame, base.RtmpAvcPacketTypeNalu, 0x00, 0x00, 0x28},
+	}
+	assert.Equal(t, true, msg.IsVideoKeyNalu())
+	assert.Equal(t, base.RtmpCodecIdAvc, msg.VideoCodecId())
+	assert.Equal(t, uint32(1040), msg.Pts())
+}
@@ -13,7 +13,7 @@ package base
 // server.pub:  rtmp(ServerSession), rtsp(PubSession), customize(CustomizePubSessionContext), ps(gb28181.PubSession)
 // server.sub:  rtmp(ServerSession), rtsp(SubSession), flv(SubSession), ts(SubSession), 还有一个比较特殊的hls
 //
-// client.push: rtmp(PushSession), rtsp(PushSession)
+// client.push: rtmp(PushSession), rtsp(PushSession), ps(gb28181.TalkSession)
 // client.pull: rtmp(PullSession), rtsp(PullSession), flv(PullSession)
 //
 // other:       rtmp.ClientSession, (rtmp.ServerSession)
@@ -39,6 +39,7 @@ const (
 	SessionTypeFlvPull           SessionType = SessionProtocolFlv<<8 | SessionBaseTypePull
 	SessionTypeTsSub             SessionType = SessionProtocolTs<<8 | SessionBaseTypeSub
 	SessionTypePsPub             SessionType = SessionProtocolPs<<8 | SessionBaseTypePub
+	SessionTypePsPush            SessionType = SessionProtocolPs<<8 | SessionBaseTypePush
 	SessionTypeHlsSub            SessionType = SessionProtocolHls<<8 | SessionBaseTypeSub
 
 	SessionProtocolCustomize = 1
@@ -259,6 +259,18 @@ func ParseRtmpUrl2(rawUrl string) (ctx UrlContext, err error) {
 		return ctx, errors.New("no hostname in URL")
 	}
 
+	// 取出`user:password@`，connect鉴权时使用
+	if at := strings.IndexByte(base, '@'); at != -1 && (strings.IndexByte(base, '/') == -1 || at < strings.IndexByte(base, '/')) {
+		userinfo := base[:at]
+		base = base[at+1:]
+		if i := strings.IndexByte(userinfo, ':'); i != -1 {
+			ctx.Password, _ = url.PathUnescape(userinfo[i+1:])
+			userinfo = userinfo[:i]
+		}
+		ctx.Username, _ = url.PathUnescape(userinfo)
+		ctx.RawUrlWithoutUserInfo = rawUrl[:len(rawUrl)-len(base)-at-1] + base
+	}
+
 	/* 检查一下主机名 */
 
 	end := 0
@@ -140,10 +140,16 @@ func MakeWsFrameHeader(wsHeader WsHeader) (buf []byte) {
 	}
 	return buf
 }
+
+// MakeWsAcceptKey 根据客户端的`Sec-WebSocket-Key`计算`Sec-WebSocket-Accept`
+func MakeWsAcceptKey(secWebSocketKey string) string {
+	sha1Sum := sha1.Sum([]byte(secWebSocketKey + WsMagicStr))
+	return base64.StdEncoding.EncodeToString(sha1Sum[:])
+}
+
 func UpdateWebSocketHeader(secWebSocketKey string) []byte {
 	firstLine := "HTTP/1.1 101 Switching Protocol\r\n"
-	sha1Sum := sha1.Sum([]byte(secWebSocketKey + WsMagicStr))
-	secWebSocketAccept := base64.StdEncoding.EncodeToString(sha1Sum[:])
+	secWebSocketAccept := MakeWsAcceptKey(secWebSocketKey)
 	webSocketResponseHeaderStr := firstLine +
 		"Server: " + LalHttpflvSubSessionServer + "\r\n" +
 		"Sec-WebSocket-Accept:" + secWebSocketAccept + "\r\n" +
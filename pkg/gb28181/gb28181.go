@@ -10,6 +10,8 @@ package gb28181
 
 import (
 	"errors"
+	"time"
+
 	"github.com/q191201771/naza/pkg/nazalog"
 	"github.com/q191201771/naza/pkg/nazanet"
 )
@@ -34,6 +36,16 @@ var (
 	defaultPubSessionPortMax = uint16(60000)
 )
 
+var (
+	playbackEndToleranceMs       = int64(1000)     // 回放进度距离结束时间小于该值时，认为到达结束时间
+	playbackFinishedIdleDuration = 2 * time.Second // 到达结束时间后，超过该时长没有收到数据，认为回放结束
+	playbackDefaultFrameDuration = int64(40)       // 重新设置锚点时，还没有帧间隔的情况下，使用的默认帧间隔，单位毫秒
+)
+
+const psClockRate = 90000
+
+var rtcpRrInterval = 5 * time.Second // udp模式开启rtcp时，定时发送rr的间隔
+
 var defaultUdpConnPoll *nazanet.AvailUdpConnPool
 
 func init() {
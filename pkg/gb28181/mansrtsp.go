@@ -0,0 +1,121 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/q191201771/naza/pkg/nazaerrors"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// MANSRTSP 回放控制，由sip INFO携带，GB/T 28181-2016 附录B
+//
+// PLAY MANSRTSP/1.0
+// CSeq: 2
+// Scale: 2.0
+// Range: npt=100-
+//
+// PAUSE MANSRTSP/1.0
+// CSeq: 3
+// PauseTime: now
+
+const (
+	MansRtspMethodPlay     = "PLAY"
+	MansRtspMethodPause    = "PAUSE"
+	MansRtspMethodTeardown = "TEARDOWN"
+
+	mansRtspVersion = "MANSRTSP/1.0"
+)
+
+type MansRtspMsg struct {
+	Method string
+	CSeq   int
+
+	HasScale bool
+	Scale    float64 // 倍速，比如0.5、1、2、4
+
+	HasRange   bool
+	RangeStart float64 // 相对回放开始时间的偏移，单位秒。`npt=now-`时不设置HasRange
+}
+
+func ParseMansRtsp(b []byte) (msg MansRtspMsg, err error) {
+	s := strings.ReplaceAll(string(b), "\r\n", "\n")
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+
+	items := strings.Fields(lines[0])
+	if len(items) != 2 || items[1] != mansRtspVersion {
+		return msg, nazaerrors.Wrap(base.ErrGb28181, lines[0])
+	}
+	msg.Method = items[0]
+	switch msg.Method {
+	case MansRtspMethodPlay, MansRtspMethodPause, MansRtspMethodTeardown:
+	default:
+		return msg, nazaerrors.Wrap(base.ErrGb28181, lines[0])
+	}
+
+	for _, line := range lines[1:] {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		k := strings.TrimSpace(kv[0])
+		v := strings.TrimSpace(kv[1])
+
+		switch strings.ToLower(k) {
+		case "cseq":
+			if msg.CSeq, err = strconv.Atoi(v); err != nil {
+				return msg, err
+			}
+		case "scale":
+			if msg.Scale, err = strconv.ParseFloat(v, 64); err != nil {
+				return msg, err
+			}
+			if msg.Scale <= 0 {
+				return msg, nazaerrors.Wrap(base.ErrGb28181, line)
+			}
+			msg.HasScale = true
+		case "range":
+			// npt=100- 或者 npt=now-
+			v = strings.TrimPrefix(v, "npt=")
+			v = strings.SplitN(v, "-", 2)[0]
+			if v == "now" || v == "" {
+				continue
+			}
+			if msg.RangeStart, err = strconv.ParseFloat(v, 64); err != nil {
+				return msg, err
+			}
+			msg.HasRange = true
+		}
+	}
+	return msg, nil
+}
+
+// Pack 生成MANSRTSP消息，供sip服务通过INFO发送给设备
+func (msg MansRtspMsg) Pack() []byte {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s %s\r\n", msg.Method, mansRtspVersion))
+	sb.WriteString(fmt.Sprintf("CSeq: %d\r\n", msg.CSeq))
+	switch msg.Method {
+	case MansRtspMethodPlay:
+		if msg.HasScale {
+			sb.WriteString(fmt.Sprintf("Scale: %s\r\n", strconv.FormatFloat(msg.Scale, 'f', -1, 64)))
+		}
+		if msg.HasRange {
+			sb.WriteString(fmt.Sprintf("Range: npt=%s-\r\n", strconv.FormatFloat(msg.RangeStart, 'f', -1, 64)))
+		} else {
+			sb.WriteString("Range: npt=now-\r\n")
+		}
+	case MansRtspMethodPause:
+		sb.WriteString("PauseTime: now\r\n")
+	}
+	return []byte(sb.String())
+}
@@ -0,0 +1,252 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/ysjhlnu/lal/pkg/avc"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/h2645"
+	"github.com/ysjhlnu/lal/pkg/mpegts"
+)
+
+// PsPacker 将音视频数据打包成ps(Program Stream)流
+//
+// 目前主要用于gb28181语音广播、对讲，向设备发送音频
+type PsPacker struct {
+	audioStreamType uint8
+	videoStreamType uint8
+
+	packCount int
+}
+
+func NewPsPacker() *PsPacker {
+	return &PsPacker{}
+}
+
+// Pack
+//
+// @param pkt: 字段说明：
+// PayloadType AvPacketPt 音频支持AAC和G711A/G711U，视频支持H264和H265。
+// Timestamp   int64      dts，单位毫秒。
+// Pts         int64      pts，单位毫秒。
+// Payload     []byte     AAC需携带adts头，H264和H265是AnnexB格式。
+//
+// @return 一个完整的ps包，内存块为独立新申请，函数调用结束后，内部不持有该内存块。
+// 当有流类型发生变化，或者是视频关键帧时，会在ps包中携带system header和psm。
+func (p *PsPacker) Pack(pkt base.AvPacket) ([]byte, error) {
+	streamType, streamId, err := psStreamTypeOf(pkt.PayloadType)
+	if err != nil {
+		return nil, err
+	}
+
+	withPsm := p.packCount == 0
+	if streamId == StreamIdAudio {
+		if p.audioStreamType != streamType {
+			p.audioStreamType = streamType
+			withPsm = true
+		}
+	} else {
+		if p.videoStreamType != streamType {
+			p.videoStreamType = streamType
+			withPsm = true
+		}
+		if isKeyFrame(pkt) {
+			withPsm = true
+		}
+	}
+	p.packCount++
+
+	out := make([]byte, 0, PsHeaderlen+SysHeaderlen+SysMapHeaderLen+len(pkt.Payload)+PesHeaderLen)
+	out = appendPackHeader(out, uint64(pkt.Timestamp*90))
+	if withPsm {
+		out = p.appendSystemHeader(out)
+		out = p.appendPsm(out)
+	}
+	out = appendPes(out, streamId, uint64(pkt.Pts*90), uint64(pkt.Timestamp*90), pkt.Payload)
+	return out, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func psStreamTypeOf(pt base.AvPacketPt) (streamType uint8, streamId uint8, err error) {
+	switch pt {
+	case base.AvPacketPtAac:
+		return StreamTypeAAC, StreamIdAudio, nil
+	case base.AvPacketPtG711A:
+		return StreamTypeG711A, StreamIdAudio, nil
+	case base.AvPacketPtG711U:
+		return StreamTypeG711U, StreamIdAudio, nil
+	case base.AvPacketPtAvc:
+		return StreamTypeH264, StreamIdVideo, nil
+	case base.AvPacketPtHevc:
+		return StreamTypeH265, StreamIdVideo, nil
+	}
+	return 0, 0, base.ErrGb28181
+}
+
+func isKeyFrame(pkt base.AvPacket) bool {
+	// 注意，对于AnnexB格式的视频帧，遍历所有nal，只要包含关键帧nal，就认为是关键帧
+	var ret bool
+	isAvc := pkt.PayloadType == base.AvPacketPtAvc
+	_ = avc.IterateNaluAnnexb(pkt.Payload, func(nal []byte) {
+		if len(nal) == 0 {
+			return
+		}
+		typ := h2645.ParseNaluType(isAvc, nal[0])
+		if isAvc {
+			if typ == h2645.H264NaluTypeIdrSlice || typ == h2645.H264NaluTypeSps {
+				ret = true
+			}
+		} else {
+			if h2645.H265IsIrapNalu(typ) || typ == h2645.H265NaluTypeVps {
+				ret = true
+			}
+		}
+	})
+	return ret
+}
+
+// appendPackHeader
+//
+// 2.5.3.3 Pack layer of Program Stream
+// Table 2-33 - Program Stream pack header
+func appendPackHeader(out []byte, scr uint64) []byte {
+	muxRate := uint32(6106) // 单位50字节/秒
+
+	h := make([]byte, PsHeaderlen)
+	bele.BePutUint32(h, psPackStartCodePackHeader)
+	// '01' scr[32..30] marker scr[29..28]
+	h[4] = 0x44 | uint8((scr>>27)&0x38) | uint8((scr>>28)&0x03)
+	h[5] = uint8(scr >> 20)
+	// scr[19..15] marker scr[14..13]
+	h[6] = uint8((scr>>12)&0xf8) | 0x04 | uint8((scr>>13)&0x03)
+	h[7] = uint8(scr >> 5)
+	// scr[4..0] marker scr_ext[8..7]
+	h[8] = uint8((scr<<3)&0xf8) | 0x04
+	// scr_ext[6..0] marker
+	h[9] = 0x01
+	// program_mux_rate(22) marker marker
+	h[10] = uint8(muxRate >> 14)
+	h[11] = uint8(muxRate >> 6)
+	h[12] = uint8(muxRate<<2) | 0x03
+	// reserved(5) pack_stuffing_length(3)
+	h[13] = 0xf8
+	return append(out, h...)
+}
+
+// appendSystemHeader
+//
+// 2.5.3.5 System header
+// Table 2-34 - Program Stream system header
+func (p *PsPacker) appendSystemHeader(out []byte) []byte {
+	rateBound := uint32(50000)
+
+	h := make([]byte, 12, SysHeaderlen)
+	bele.BePutUint32(h, psPackStartCodeSystemHeader)
+	// marker rate_bound(22) marker
+	h[6] = 0x80 | uint8(rateBound>>15)
+	h[7] = uint8(rateBound >> 7)
+	h[8] = uint8(rateBound<<1) | 0x01
+	// audio_bound(6) fixed_flag CSPS_flag
+	h[9] = 0x01 << 2
+	// system_audio_lock_flag system_video_lock_flag marker video_bound(5)
+	h[10] = 0xe0 | 0x01
+	// packet_rate_restriction_flag reserved(7)
+	h[11] = 0x7f
+
+	// stream_id '11' P-STD_buffer_bound_scale P-STD_buffer_size_bound(13)
+	h = append(h, StreamIdAudio, 0xc0, 0x20)
+	h = append(h, StreamIdVideo, 0xe0, 0x80)
+	bele.BePutUint16(h[4:], uint16(len(h)-6))
+	return append(out, h...)
+}
+
+// appendPsm
+//
+// 2.5.4 Program Stream map
+// Table 2-35 - Program Stream map
+func (p *PsPacker) appendPsm(out []byte) []byte {
+	var esm []byte
+	if p.audioStreamType != 0 {
+		esm = append(esm, p.audioStreamType, StreamIdAudio, 0, 0)
+	}
+	if p.videoStreamType != 0 {
+		esm = append(esm, p.videoStreamType, StreamIdVideo, 0, 0)
+	}
+
+	h := make([]byte, 12, 12+len(esm)+4)
+	bele.BePutUint32(h, psPackStartCodeProgramStreamMap)
+	// program_stream_map_length
+	bele.BePutUint16(h[4:], uint16(6+len(esm)+4))
+	// current_next_indicator reserved(2) program_stream_map_version(5)
+	h[6] = 0xe0
+	// reserved(7) marker
+	h[7] = 0xff
+	// program_stream_info_length
+	bele.BePutUint16(h[8:], 0)
+	// elementary_stream_map_length
+	bele.BePutUint16(h[10:], uint16(len(esm)))
+	h = append(h, esm...)
+
+	crc := mpegts.CalcCrc32(0xffffffff, h)
+	h = append(h, 0, 0, 0, 0)
+	bele.BePutUint32(h[len(h)-4:], crc)
+	return append(out, h...)
+}
+
+// appendPes
+//
+// 注意，由于PES_packet_length只有两字节，数据较大时，会拆分成多个pes包，只有第一个pes包携带时间戳
+func appendPes(out []byte, streamId uint8, pts uint64, dts uint64, payload []byte) []byte {
+	first := true
+	for len(payload) > 0 {
+		var h []byte
+		if first {
+			if pts != dts {
+				h = make([]byte, 9+10)
+				h[7] = 0xc0
+				h[8] = 10
+				packPts(h[9:], 0x03, pts)
+				packPts(h[14:], 0x01, dts)
+			} else {
+				h = make([]byte, 9+5)
+				h[7] = 0x80
+				h[8] = 5
+				packPts(h[9:], 0x02, pts)
+			}
+		} else {
+			h = make([]byte, 9)
+		}
+		bele.BePutUint32(h, uint32(0x00000100)|uint32(streamId))
+		// '10' PES_scrambling_control(2) PES_priority data_alignment_indicator copyright original_or_copy
+		h[6] = 0x80
+
+		n := MaxPesLen - (len(h) - 6)
+		if n > len(payload) {
+			n = len(payload)
+		}
+		bele.BePutUint16(h[4:], uint16(len(h)-6+n))
+
+		out = append(out, h...)
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+		first = false
+	}
+	return out
+}
+
+// packPts 注意，除PTS外，DTS也使用这个函数打包
+func packPts(out []byte, fb uint8, pts uint64) {
+	out[0] = (fb << 4) | uint8((pts>>29)&0x0e) | 0x01
+	out[1] = uint8(pts >> 22)
+	out[2] = uint8((pts>>14)&0xfe) | 0x01
+	out[3] = uint8(pts >> 7)
+	out[4] = uint8((pts<<1)&0xfe) | 0x01
+}
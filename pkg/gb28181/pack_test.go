@@ -0,0 +1,51 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+func TestPsPacker(t *testing.T) {
+	// adts头 + 4字节数据
+	frame1 := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, 0x01, 0x02, 0x03, 0x04}
+	frame2 := []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, 0x05, 0x06, 0x07, 0x08}
+
+	var out []base.AvPacket
+	unpacker := NewPsUnpacker().WithOnAvPacket(func(packet *base.AvPacket) {
+		out = append(out, base.AvPacket{
+			PayloadType: packet.PayloadType,
+			Timestamp:   packet.Timestamp,
+			Pts:         packet.Pts,
+			Payload:     append([]byte(nil), packet.Payload...),
+		})
+	})
+
+	packer := NewPsPacker()
+	ps1, err := packer.Pack(base.AvPacket{PayloadType: base.AvPacketPtAac, Timestamp: 40, Pts: 40, Payload: frame1})
+	assert.Equal(t, nil, err)
+	ps2, err := packer.Pack(base.AvPacket{PayloadType: base.AvPacketPtAac, Timestamp: 80, Pts: 80, Payload: frame2})
+	assert.Equal(t, nil, err)
+	// 只有第一个包携带psm
+	assert.Equal(t, true, len(ps1) > len(ps2))
+
+	assert.Equal(t, nil, unpacker.FeedRtpBody(ps1, 3600))
+	assert.Equal(t, nil, unpacker.FeedRtpBody(ps2, 7200))
+
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, base.AvPacketPtAac, out[0].PayloadType)
+	assert.Equal(t, int64(40), out[0].Timestamp)
+	assert.Equal(t, frame1, out[0].Payload)
+
+	_, err = packer.Pack(base.AvPacket{PayloadType: base.AvPacketPtUnknown})
+	assert.IsNotNil(t, err)
+}
@@ -0,0 +1,104 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/q191201771/naza/pkg/nazaerrors"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// 注意，gb28181的信令（sip）不在lal中处理，sip服务将INVITE中的sdp、INFO中的MANSRTSP透传给lal即可
+
+const (
+	SessionNamePlay     = "Play"
+	SessionNamePlayback = "Playback"
+	SessionNameDownload = "Download"
+)
+
+// InviteSdpInfo gb28181 INVITE中sdp的关键字段
+type InviteSdpInfo struct {
+	SessionName   string // s=，Play、Playback或Download
+	ChannelId     string // u=，回放和下载时携带，格式为 `<channel>:<type>`，这里只保留channel
+	StartTime     int64  // t=，回放和下载的开始时间，unix时间戳，单位秒
+	EndTime       int64  // t=，回放和下载的结束时间，unix时间戳，单位秒
+	Ssrc          uint32 // y=
+	DownloadSpeed int    // a=downloadspeed:，只有下载时携带
+}
+
+// IsPlayback 是否为回放或下载，也即有确定的时间范围，流会结束
+func (info InviteSdpInfo) IsPlayback() bool {
+	return info.SessionName == SessionNamePlayback || info.SessionName == SessionNameDownload
+}
+
+// DurationMs 回放或下载的时长，单位毫秒
+func (info InviteSdpInfo) DurationMs() int64 {
+	if info.EndTime <= info.StartTime {
+		return 0
+	}
+	return (info.EndTime - info.StartTime) * 1000
+}
+
+// ParseInviteSdp 解析gb28181 INVITE中的sdp
+func ParseInviteSdp(b []byte) (info InviteSdpInfo, err error) {
+	s := strings.ReplaceAll(string(b), "\r\n", "\n")
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		v := line[2:]
+
+		switch line[0] {
+		case 's':
+			info.SessionName = v
+		case 'u':
+			info.ChannelId = strings.SplitN(v, ":", 2)[0]
+		case 't':
+			items := strings.Fields(v)
+			if len(items) != 2 {
+				return info, nazaerrors.Wrap(base.ErrGb28181, line)
+			}
+			if info.StartTime, err = strconv.ParseInt(items[0], 10, 64); err != nil {
+				return info, err
+			}
+			if info.EndTime, err = strconv.ParseInt(items[1], 10, 64); err != nil {
+				return info, err
+			}
+		case 'y':
+			ssrc, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				return info, err
+			}
+			info.Ssrc = uint32(ssrc)
+		case 'a':
+			if strings.HasPrefix(v, "downloadspeed:") {
+				if info.DownloadSpeed, err = strconv.Atoi(strings.TrimPrefix(v, "downloadspeed:")); err != nil {
+					return info, err
+				}
+			}
+		}
+	}
+
+	if info.SessionName == "" {
+		return info, nazaerrors.Wrap(base.ErrGb28181, "session name not found")
+	}
+	if info.IsPlayback() && info.DurationMs() == 0 {
+		return info, nazaerrors.Wrap(base.ErrGb28181, fmt.Sprintf("invalid time range. start=%d, end=%d", info.StartTime, info.EndTime))
+	}
+	return info, nil
+}
+
+// PlaybackStreamName 回放和下载使用独立的group，流名称格式为 `<device>_<channel>_<start>_<end>`
+func PlaybackStreamName(deviceId string, channelId string, startTime int64, endTime int64) string {
+	return fmt.Sprintf("%s_%s_%d_%d", deviceId, channelId, startTime, endTime)
+}
@@ -0,0 +1,99 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+var goldenPlaybackSdp = "v=0\r\n" +
+	"o=34020000002000000001 0 0 IN IP4 192.168.1.2\r\n" +
+	"s=Playback\r\n" +
+	"u=34020000001320000001:0\r\n" +
+	"c=IN IP4 192.168.1.2\r\n" +
+	"t=1288625085 1288625871\r\n" +
+	"m=video 6000 RTP/AVP 96 98 97\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:96 PS/90000\r\n" +
+	"y=1100000001\r\n"
+
+func TestParseInviteSdp(t *testing.T) {
+	info, err := ParseInviteSdp([]byte(goldenPlaybackSdp))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, SessionNamePlayback, info.SessionName)
+	assert.Equal(t, "34020000001320000001", info.ChannelId)
+	assert.Equal(t, int64(1288625085), info.StartTime)
+	assert.Equal(t, int64(1288625871), info.EndTime)
+	assert.Equal(t, uint32(1100000001), info.Ssrc)
+	assert.Equal(t, true, info.IsPlayback())
+	assert.Equal(t, int64(786000), info.DurationMs())
+	assert.Equal(t, "34020000001110000001_34020000001320000001_1288625085_1288625871",
+		PlaybackStreamName("34020000001110000001", info.ChannelId, info.StartTime, info.EndTime))
+
+	info, err = ParseInviteSdp([]byte("v=0\r\ns=Download\r\nt=0 0\r\n"))
+	assert.IsNotNil(t, err)
+
+	info, err = ParseInviteSdp([]byte("v=0\r\ns=Play\r\nt=0 0\r\na=downloadspeed:4\r\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, info.IsPlayback())
+	assert.Equal(t, 4, info.DownloadSpeed)
+}
+
+func TestParseMansRtsp(t *testing.T) {
+	msg, err := ParseMansRtsp([]byte("PLAY MANSRTSP/1.0\r\nCSeq: 2\r\nScale: 2.0\r\nRange: npt=100-\r\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MansRtspMethodPlay, msg.Method)
+	assert.Equal(t, 2, msg.CSeq)
+	assert.Equal(t, true, msg.HasScale)
+	assert.Equal(t, 2.0, msg.Scale)
+	assert.Equal(t, true, msg.HasRange)
+	assert.Equal(t, 100.0, msg.RangeStart)
+	assert.Equal(t, "PLAY MANSRTSP/1.0\r\nCSeq: 2\r\nScale: 2\r\nRange: npt=100-\r\n", string(msg.Pack()))
+
+	msg, err = ParseMansRtsp([]byte("PAUSE MANSRTSP/1.0\r\nCSeq: 3\r\nPauseTime: now\r\n"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, MansRtspMethodPause, msg.Method)
+	assert.Equal(t, false, msg.HasScale)
+	assert.Equal(t, false, msg.HasRange)
+
+	_, err = ParseMansRtsp([]byte("OPTIONS MANSRTSP/1.0\r\nCSeq: 4\r\n"))
+	assert.IsNotNil(t, err)
+}
+
+func TestPubSessionPlayback(t *testing.T) {
+	var out []int64
+	session := NewPubSession().WithPlayback(10000).WithOnAvPacket(func(packet *base.AvPacket) {
+		out = append(out, packet.Timestamp)
+	})
+	feed := func(ts int64) {
+		session.onAvPacketFromUnpacker(&base.AvPacket{Timestamp: ts, Pts: ts})
+	}
+
+	feed(1000)
+	feed(2000)
+	_ = session.HandleMansRtsp(MansRtspMsg{Method: MansRtspMethodPlay, HasScale: true, Scale: 2})
+	feed(3000)
+	feed(5000)
+	// 倍速后重新设置锚点，输出的时间戳在上一帧的基础上加一个帧间隔，保持递增
+	assert.Equal(t, []int64{1000, 2000, 3000, 4000}, out)
+	assert.Equal(t, false, session.isPlaybackEndReached)
+
+	_ = session.HandleMansRtsp(MansRtspMsg{Method: MansRtspMethodPause})
+	assert.Equal(t, true, session.IsPaused())
+	_ = session.HandleMansRtsp(MansRtspMsg{Method: MansRtspMethodPlay})
+	assert.Equal(t, false, session.IsPaused())
+
+	feed(10500)
+	assert.Equal(t, true, session.isPlaybackEndReached)
+	// 还在收数据，不认为结束
+	assert.Equal(t, false, session.IsPlaybackFinished())
+}
@@ -15,15 +15,20 @@ import (
 	"github.com/q191201771/naza/pkg/nazalog"
 	"github.com/q191201771/naza/pkg/nazanet"
 	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 )
 
 type OnReadPacket func(b []byte)
 
 type PubSession struct {
-	unpacker *PsUnpacker
+	unpacker      *PsUnpacker
+	unpackerMutex sync.Mutex // 收包协程以及jitter buffer定时检查的协程都会操作unpacker
+	onAvPacket    base.OnAvPacketFunc
 
 	streamName string
 
@@ -32,24 +37,61 @@ type PubSession struct {
 	isTcpFlag bool
 
 	disposeOnce sync.Once
+	exitChan    chan struct{}
 	udpConn     *nazanet.UdpConnection
 	listener    net.Listener
 	tcpConn     net.Conn
 	sessionStat base.BasicSessionStat
+
+	// 回放、下载使用
+	playbackMutex        sync.Mutex
+	playbackDurationMs   int64 // 为0时表示实时流
+	isPaused             bool
+	scale                float64
+	hasAnchor            bool
+	inAnchorTs           int64 // 倍速、拖动时，重新设置时间戳锚点
+	outAnchorTs          int64
+	prevOutTs            int64
+	prevOutDuration      int64 // 输出时间戳的帧间隔，重新设置锚点时使用
+	mediaBaseTs          int64 // 回放进度的基准
+	seekOffsetMs         int64
+	isSeeking            bool
+	isPlaybackEndReached bool
+	prevPacketTime       time.Time
+
+	// rtcp，只在udp模式下使用
+	isRtcpEnabled bool
+	isRtcpMuxFlag bool // rtp和rtcp复用同一个端口
+	rtcpConn      *nazanet.UdpConnection
+	rtcpMutex     sync.Mutex
+	senderSsrc    uint32
+	mediaSsrc     uint32
+	rrProducer    *rtprtcp.RrProducer
+	nackProducer  *rtprtcp.NackProducer
+	rtpRAddr      *net.UDPAddr
+	rtcpRAddr     *net.UDPAddr
+	prevRrTime    time.Time
+	hasSr         bool
+	lastSr        rtprtcp.Sr
 }
 
 func NewPubSession() *PubSession {
-	return &PubSession{
+	session := &PubSession{
 		unpacker:    NewPsUnpacker(),
+		onAvPacket:  defaultOnAvPacket,
+		scale:       1,
+		exitChan:    make(chan struct{}),
 		sessionStat: base.NewBasicSessionStat(base.SessionTypePsPub, ""),
 	}
+	session.unpacker.WithOnAvPacket(session.onAvPacketFromUnpacker)
+	return session
 }
 
 // WithOnAvPacket 设置音视频的回调。
 //
 //	@param onAvPacket: 见 PsUnpacker.WithOnAvPacket 的注释
 func (session *PubSession) WithOnAvPacket(onAvPacket base.OnAvPacketFunc) *PubSession {
-	session.unpacker.WithOnAvPacket(onAvPacket)
+	session.onAvPacket = onAvPacket
 	return session
 }
 
@@ -58,6 +100,41 @@ func (session *PubSession) WithStreamName(streamName string) *PubSession {
 	return session
 }
 
+// WithUnpackerOption 设置ps解析相关的参数，比如jitter buffer
+func (session *PubSession) WithUnpackerOption(modOption ModPsUnpackerOption) *PubSession {
+	session.unpacker.WithOption(modOption)
+	return session
+}
+
+// WithPlayback 设置回放、下载的时长，单位毫秒
+//
+// 设置后：
+// - 按倍速对时间戳进行调整，使得输出的流保持正常速度
+// - 根据时间戳判断回放进度，见 IsPlaybackFinished
+func (session *PubSession) WithPlayback(durationMs int64) *PubSession {
+	session.playbackDurationMs = durationMs
+	return session
+}
+
+// IsPlayback 是否为回放、下载，见 WithPlayback
+func (session *PubSession) IsPlayback() bool {
+	return session.playbackDurationMs > 0
+}
+
+// WithRtcp 开启rtcp，只在udp模式下生效
+//
+// 开启后，定时向对端发送rr，检测到丢包时发送nack，并记录对端的sr用于时间戳映射，见 RtpTs2UnixMs
+//
+// @param isMuxFlag: true表示rtp和rtcp复用同一个端口，false表示rtcp使用rtp端口+1
+func (session *PubSession) WithRtcp(isMuxFlag bool) *PubSession {
+	session.isRtcpEnabled = true
+	session.isRtcpMuxFlag = isMuxFlag
+	session.senderSsrc = rand.Uint32()
+	session.rrProducer = rtprtcp.NewRrProducer(psClockRate)
+	session.nackProducer = rtprtcp.NewNackProducer()
+	return session
+}
+
 // WithHookReadPacket
 //
 // 将接收的数据返回给上层。
@@ -82,12 +159,77 @@ func (session *PubSession) Listen(port int, isTcpFlag bool) (int, error) {
 
 // RunLoop 阻塞函数
 func (session *PubSession) RunLoop() error {
+	if session.unpacker.option.JitterBufferMs > 0 {
+		go session.runLoopJitterBuffer()
+	}
+
 	if session.isTcpFlag {
 		return session.runLoopTcp()
 	}
 	return session.runLoopUdp()
 }
 
+// HandleMansRtsp 处理回放控制
+//
+// 注意，MANSRTSP由sip服务发送给设备，这里只是同步状态，使得lal能正确处理时间戳、超时等
+func (session *PubSession) HandleMansRtsp(msg MansRtspMsg) error {
+	Log.Infof("[%s] handle mansrtsp. msg=%+v", session.UniqueKey(), msg)
+
+	if msg.Method == MansRtspMethodTeardown {
+		return session.Dispose()
+	}
+
+	session.playbackMutex.Lock()
+	defer session.playbackMutex.Unlock()
+
+	switch msg.Method {
+	case MansRtspMethodPause:
+		session.isPaused = true
+	case MansRtspMethodPlay:
+		session.isPaused = false
+		if msg.HasScale && msg.Scale != session.scale {
+			session.scale = msg.Scale
+			session.hasAnchor = false
+		}
+		if msg.HasRange {
+			session.seekOffsetMs = int64(msg.RangeStart * 1000)
+			session.isSeeking = true
+			session.hasAnchor = false
+			session.isPlaybackEndReached = false
+		}
+	}
+	return nil
+}
+
+// IsPaused 回放暂停时，设备不发送数据，业务方不应该做超时处理
+func (session *PubSession) IsPaused() bool {
+	session.playbackMutex.Lock()
+	defer session.playbackMutex.Unlock()
+	return session.isPaused
+}
+
+// IsPlaybackFinished 回放、下载是否结束
+//
+// 回放进度到达结束时间，并且设备不再发送数据，则认为结束
+func (session *PubSession) IsPlaybackFinished() bool {
+	session.playbackMutex.Lock()
+	defer session.playbackMutex.Unlock()
+	return session.isPlaybackEndReached && time.Since(session.prevPacketTime) >= playbackFinishedIdleDuration
+}
+
+// RtpTs2UnixMs 通过对端最近一次sr，将rtp时间戳映射为unix时间戳，单位毫秒
+//
+// @return 还没有收到sr时，返回false
+func (session *PubSession) RtpTs2UnixMs(rtpts uint32) (int64, bool) {
+	session.rtcpMutex.Lock()
+	defer session.rtcpMutex.Unlock()
+	if !session.hasSr {
+		return 0, false
+	}
+	srMs := int64(rtprtcp.MswLsw2UnixNano(uint64(session.lastSr.Msw), uint64(session.lastSr.Lsw)) / 1e6)
+	return srMs + int64(int32(rtpts-session.lastSr.Timestamp))*1000/psClockRate, true
+}
+
 // ----- IServerSessionLifecycle ---------------------------------------------------------------------------------------
 
 func (session *PubSession) Dispose() error {
@@ -132,7 +274,12 @@ func (session *PubSession) UpdateStat(intervalSec uint32) {
 }
 
 func (session *PubSession) GetStat() base.StatSession {
-	return session.sessionStat.GetStat()
+	stat := session.sessionStat.GetStat()
+	unpackerStat := session.unpacker.GetStat()
+	stat.LostPacketCount = unpackerStat.LostPacketCount
+	stat.ReorderedPacketCount = unpackerStat.ReorderedPacketCount
+	stat.DroppedFrameCount = unpackerStat.DroppedFrameCount
+	return stat
 }
 
 func (session *PubSession) IsAlive() (readAlive, writeAlive bool) {
@@ -146,8 +293,16 @@ func (session *PubSession) listenUdp(port int) (int, error) {
 	var uconn *net.UDPConn
 	var addr string
 
+	var rtcpUconn *net.UDPConn
+	var rtcpAddr string
+	isRtcpPortFlag := session.isRtcpEnabled && !session.isRtcpMuxFlag
+
 	if port == 0 {
-		uconn, _, err = defaultUdpConnPoll.Acquire()
+		if isRtcpPortFlag {
+			uconn, _, rtcpUconn, _, err = defaultUdpConnPoll.Acquire2()
+		} else {
+			uconn, _, err = defaultUdpConnPoll.Acquire()
+		}
 		if err != nil {
 			return -1, err
 		}
@@ -155,12 +310,23 @@ func (session *PubSession) listenUdp(port int) (int, error) {
 		port = uconn.LocalAddr().(*net.UDPAddr).Port
 	} else {
 		addr = fmt.Sprintf(":%d", port)
+		rtcpAddr = fmt.Sprintf(":%d", port+1)
 	}
 
 	session.udpConn, err = nazanet.NewUdpConnection(func(option *nazanet.UdpConnectionOption) {
 		option.LAddr = addr
 		option.Conn = uconn
 	})
+	if err != nil {
+		return port, err
+	}
+
+	if isRtcpPortFlag {
+		session.rtcpConn, err = nazanet.NewUdpConnection(func(option *nazanet.UdpConnectionOption) {
+			option.LAddr = rtcpAddr
+			option.Conn = rtcpUconn
+		})
+	}
 	return port, err
 }
 
@@ -184,17 +350,130 @@ func (session *PubSession) listenTcp(port int) (int, error) {
 }
 
 func (session *PubSession) runLoopUdp() error {
+	if session.rtcpConn != nil {
+		go func() {
+			_ = session.rtcpConn.RunLoop(func(b []byte, raddr *net.UDPAddr, err error) bool {
+				if len(b) == 0 && err != nil {
+					return false
+				}
+
+				session.sessionStat.AddReadBytes(len(b))
+				session.handleRtcpPacket(b, raddr)
+				return true
+			})
+		}()
+	}
+
 	err := session.udpConn.RunLoop(func(b []byte, raddr *net.UDPAddr, err error) bool {
 		if len(b) == 0 && err != nil {
 			return false
 		}
 
+		if session.isRtcpEnabled {
+			if session.isRtcpMuxFlag && rtprtcp.IsRtcpPacket(b) {
+				session.sessionStat.AddReadBytes(len(b))
+				session.handleRtcpPacket(b, raddr)
+				return true
+			}
+			session.onRtpPacketForRtcp(b, raddr)
+		}
+
 		session.feedPacket(b)
 		return true
 	})
 	return err
 }
 
+// onRtpPacketForRtcp 更新rr和nack的统计，并在需要时发送rr和nack
+func (session *PubSession) onRtpPacketForRtcp(b []byte, raddr *net.UDPAddr) {
+	h, err := rtprtcp.ParseRtpHeader(b)
+	if err != nil {
+		return
+	}
+
+	session.rtcpMutex.Lock()
+	if session.rtpRAddr == nil || session.mediaSsrc != h.Ssrc {
+		if session.mediaSsrc != h.Ssrc {
+			// ssrc变化后，之前的sr不再适用
+			session.hasSr = false
+		}
+		session.rtpRAddr = raddr
+		session.mediaSsrc = h.Ssrc
+		session.rrProducer.SetSsrc(session.senderSsrc, h.Ssrc)
+	}
+	session.rrProducer.FeedRtpPacket(h.Seq)
+	session.nackProducer.FeedRtpPacket(h.Seq)
+
+	now := time.Now()
+	var out [][]byte
+	if seqs := session.nackProducer.Produce(now); len(seqs) != 0 {
+		out = append(out, rtprtcp.PackNack(session.senderSsrc, session.mediaSsrc, seqs))
+	}
+	if now.Sub(session.prevRrTime) >= rtcpRrInterval {
+		session.prevRrTime = now
+		if rrBuf := session.rrProducer.ProduceRr(now); rrBuf != nil {
+			out = append(out, rrBuf)
+		}
+	}
+	session.rtcpMutex.Unlock()
+
+	for _, buf := range out {
+		session.writeRtcp(buf)
+	}
+}
+
+func (session *PubSession) handleRtcpPacket(b []byte, raddr *net.UDPAddr) {
+	if len(b) < rtprtcp.RtcpHeaderLength {
+		return
+	}
+
+	session.rtcpMutex.Lock()
+	session.rtcpRAddr = raddr
+	if b[1] != rtprtcp.RtcpPacketTypeSr || len(b) < 28 {
+		session.rtcpMutex.Unlock()
+		return
+	}
+
+	sr := rtprtcp.ParseSr(b)
+	session.lastSr = sr
+	session.hasSr = true
+	rrBuf := session.rrProducer.Produce(sr.GetMiddleNtp())
+	if rrBuf != nil {
+		session.prevRrTime = time.Now()
+	}
+	session.rtcpMutex.Unlock()
+
+	if rrBuf != nil {
+		session.writeRtcp(rrBuf)
+	}
+}
+
+// writeRtcp 优先发送给对端的rtcp地址，还没有收到对端的rtcp包时，根据rtp地址推算
+func (session *PubSession) writeRtcp(b []byte) {
+	session.rtcpMutex.Lock()
+	raddr := session.rtcpRAddr
+	if raddr == nil && session.rtpRAddr != nil {
+		raddr = &net.UDPAddr{IP: session.rtpRAddr.IP, Port: session.rtpRAddr.Port, Zone: session.rtpRAddr.Zone}
+		if !session.isRtcpMuxFlag {
+			raddr.Port++
+		}
+	}
+	session.rtcpMutex.Unlock()
+	if raddr == nil {
+		return
+	}
+
+	conn := session.udpConn
+	if session.rtcpConn != nil {
+		conn = session.rtcpConn
+	}
+	if err := conn.Write2Addr(b, raddr); err != nil {
+		Log.Warnf("[%s] write rtcp failed. err=%+v", session.UniqueKey(), err)
+		return
+	}
+	session.sessionStat.AddWriteBytes(len(b))
+}
+
 func (session *PubSession) runLoopTcp() error {
 	for {
 		conn, err := session.listener.Accept()
@@ -232,30 +511,104 @@ func (session *PubSession) runLoopTcp() error {
 	}
 }
 
+// runLoopJitterBuffer 定时检查jitter buffer，使得流中断时，缓存中的包也能在超时后输出
+func (session *PubSession) runLoopJitterBuffer() {
+	interval := time.Duration(session.unpacker.option.JitterBufferMs) * time.Millisecond / 2
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-session.exitChan:
+			return
+		case <-t.C:
+			session.unpackerMutex.Lock()
+			session.unpacker.FlushTimeout()
+			session.unpackerMutex.Unlock()
+		}
+	}
+}
+
+// onAvPacketFromUnpacker
+//
+// 回放时，对时间戳做倍速调整，并且计算回放进度
+func (session *PubSession) onAvPacketFromUnpacker(pkt *base.AvPacket) {
+	if session.playbackDurationMs == 0 {
+		session.onAvPacket(pkt)
+		return
+	}
+
+	session.playbackMutex.Lock()
+	isFirst := session.prevPacketTime.IsZero()
+	session.prevPacketTime = time.Now()
+	if !session.hasAnchor {
+		// 首次，或者倍速、拖动后，重新设置锚点
+		if isFirst {
+			session.outAnchorTs = pkt.Timestamp
+		} else {
+			// 锚点设置在上一帧之后，保证输出的时间戳是递增的
+			frameDuration := session.prevOutDuration
+			if frameDuration <= 0 {
+				frameDuration = playbackDefaultFrameDuration
+			}
+			session.outAnchorTs = session.prevOutTs + frameDuration
+		}
+		session.inAnchorTs = pkt.Timestamp
+		if isFirst || session.isSeeking {
+			session.mediaBaseTs = pkt.Timestamp - session.seekOffsetMs
+			session.isSeeking = false
+		}
+		session.hasAnchor = true
+	}
+
+	if pkt.Timestamp-session.mediaBaseTs >= session.playbackDurationMs-playbackEndToleranceMs {
+		session.isPlaybackEndReached = true
+	}
+
+	delta := pkt.Pts - pkt.Timestamp
+	pkt.Timestamp = session.outAnchorTs + int64(float64(pkt.Timestamp-session.inAnchorTs)/session.scale)
+	pkt.Pts = pkt.Timestamp + int64(float64(delta)/session.scale)
+	if !isFirst && pkt.Timestamp > session.prevOutTs {
+		session.prevOutDuration = pkt.Timestamp - session.prevOutTs
+	}
+	session.prevOutTs = pkt.Timestamp
+	session.playbackMutex.Unlock()
+
+	session.onAvPacket(pkt)
+}
+
 func (session *PubSession) feedPacket(b []byte) {
 	if session.hookOnReadPacket != nil {
 		session.hookOnReadPacket(b)
 	}
 
 	session.sessionStat.AddReadBytes(len(b))
+	session.unpackerMutex.Lock()
 	session.unpacker.FeedRtpPacket(b)
+	session.unpackerMutex.Unlock()
 }
 
 func (session *PubSession) dispose(err error) error {
 	var retErr error
 	session.disposeOnce.Do(func() {
 		Log.Infof("[%s] lifecycle dispose gb28181 PubSession. err=%+v", session.UniqueKey(), err)
+		close(session.exitChan)
 		if session.isTcpFlag {
 			if session.tcpConn == nil {
 				retErr = base.ErrSessionNotStarted
 				return
 			}
+			if session.listener != nil {
+				_ = session.listener.Close()
+			}
 			retErr = session.tcpConn.Close()
 		} else {
 			if session.udpConn == nil {
 				retErr = base.ErrSessionNotStarted
 				return
 			}
+			if session.rtcpConn != nil {
+				_ = session.rtcpConn.Dispose()
+			}
 			retErr = session.udpConn.Dispose()
 		}
 
@@ -263,3 +616,7 @@ func (session *PubSession) dispose(err error) error {
 	})
 	return retErr
 }
+
+func defaultOnAvPacket(packet *base.AvPacket) {
+	// noop
+}
@@ -0,0 +1,408 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/connection"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+	"github.com/q191201771/naza/pkg/nazanet"
+	"github.com/ysjhlnu/lal/pkg/aac"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+)
+
+// TalkSession gb28181语音广播、对讲
+//
+// 将音频数据(AAC或G711)打包成ps或者raw rtp，使用设备INVITE中的ssrc，通过udp或者tcp发送给设备。
+//
+// 注意，tcp active和tcp passive是站在lal的视角：
+// - TalkTransportTcpActive  lal主动连接设备
+// - TalkTransportTcpPassive lal监听端口，等待设备连接
+type TalkSession struct {
+	option TalkSessionOption
+
+	psPacker    *PsPacker
+	audioPacker *rtprtcp.RtpPacker
+	audioPt     base.AvPacketPt
+
+	disposeOnce sync.Once
+	udpConn     *nazanet.UdpConnection
+	listener    net.Listener
+	mutex       sync.Mutex
+	tcpConn     connection.Connection
+	sessionStat base.BasicSessionStat
+}
+
+type TalkPackType int
+
+const (
+	TalkPackTypePs     TalkPackType = 0
+	TalkPackTypeRawRtp TalkPackType = 1
+)
+
+type TalkTransport int
+
+const (
+	TalkTransportUdp        TalkTransport = 0
+	TalkTransportTcpActive  TalkTransport = 1
+	TalkTransportTcpPassive TalkTransport = 2
+)
+
+type TalkSessionOption struct {
+	StreamName string
+	Ssrc       uint32
+
+	PackType  TalkPackType
+	Transport TalkTransport
+
+	// LocalPort 本地端口，为0时内部自动选择可用端口，tcp active时不使用
+	LocalPort int
+	// RemoteAddr 设备地址，比如 "192.168.1.100:15060"，tcp passive时不使用
+	RemoteAddr string
+
+	// PsPayloadType 打包成ps时rtp包头中的payload type
+	PsPayloadType int
+
+	DialTimeoutMs  int
+	WriteChanSize  int
+	WriteTimeoutMs int
+}
+
+var defaultTalkSessionOption = TalkSessionOption{
+	PackType:       TalkPackTypePs,
+	Transport:      TalkTransportUdp,
+	PsPayloadType:  96,
+	DialTimeoutMs:  5000,
+	WriteChanSize:  1024,
+	WriteTimeoutMs: 10000,
+}
+
+type ModTalkSessionOption func(option *TalkSessionOption)
+
+func NewTalkSession(modOptions ...ModTalkSessionOption) *TalkSession {
+	option := defaultTalkSessionOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+
+	return &TalkSession{
+		option:      option,
+		psPacker:    NewPsPacker(),
+		audioPt:     base.AvPacketPtUnknown,
+		sessionStat: base.NewBasicSessionStat(base.SessionTypePsPush, option.RemoteAddr),
+	}
+}
+
+// Start 非阻塞函数
+//
+// 根据传输方式，绑定本地端口、监听端口或者连接设备
+//
+// @return 本地端口，tcp active时为连接使用的本地端口
+func (session *TalkSession) Start() (int, error) {
+	switch session.option.Transport {
+	case TalkTransportUdp:
+		return session.startUdp()
+	case TalkTransportTcpActive:
+		return session.startTcpActive()
+	case TalkTransportTcpPassive:
+		return session.startTcpPassive()
+	}
+	return -1, nazaerrors.Wrap(base.ErrGb28181)
+}
+
+// RunLoop 阻塞函数，直到session结束
+//
+// 注意，对讲场景下设备发送过来的数据只做统计，不做处理
+func (session *TalkSession) RunLoop() error {
+	switch session.option.Transport {
+	case TalkTransportUdp:
+		return session.udpConn.RunLoop(func(b []byte, raddr *net.UDPAddr, err error) bool {
+			if len(b) == 0 && err != nil {
+				return false
+			}
+			session.sessionStat.AddReadBytes(len(b))
+			return true
+		})
+	case TalkTransportTcpPassive:
+		conn, err := session.listener.Accept()
+		_ = session.listener.Close()
+		if err != nil {
+			return err
+		}
+		Log.Infof("[%s] accept tcp conn. raddr=%s", session.UniqueKey(), conn.RemoteAddr().String())
+		session.sessionStat.SetRemoteAddr(conn.RemoteAddr().String())
+		session.setTcpConn(conn)
+	}
+
+	return session.runLoopTcp()
+}
+
+// FeedAvPacket
+//
+// @param pkt: 音频数据，见 PsPacker.Pack 的注释
+func (session *TalkSession) FeedAvPacket(pkt base.AvPacket) error {
+	if !pkt.IsAudio() {
+		return nil
+	}
+	if session.option.Transport != TalkTransportUdp && session.getTcpConn() == nil {
+		// tcp passive模式下，设备还没有连接上来，此时不打包，
+		// 因为 PsPacker 只在第一个ps包中携带psm，打包后丢弃会导致设备连接后收不到psm
+		return nil
+	}
+
+	var rtpPkts []rtprtcp.RtpPacket
+	if session.option.PackType == TalkPackTypePs {
+		ps, err := session.psPacker.Pack(pkt)
+		if err != nil {
+			return err
+		}
+		if session.audioPacker == nil {
+			session.audioPacker = rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadRaw(), 90000, session.option.Ssrc)
+		}
+		rtpPkts = session.audioPacker.Pack(base.AvPacket{
+			PayloadType: base.AvPacketPt(session.option.PsPayloadType),
+			Timestamp:   pkt.Timestamp,
+			Payload:     ps,
+		})
+	} else {
+		if err := session.initRawRtpPackerIfNeeded(pkt); err != nil {
+			return err
+		}
+		payload := pkt.Payload
+		if pkt.PayloadType == base.AvPacketPtAac {
+			payload = payload[aac.AdtsHeaderLength:]
+		}
+		rtpPkts = session.audioPacker.Pack(base.AvPacket{
+			PayloadType: pkt.PayloadType,
+			Timestamp:   pkt.Timestamp,
+			Payload:     payload,
+		})
+	}
+
+	for i := range rtpPkts {
+		if err := session.write(rtpPkts[i].Raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ----- IClientSessionLifecycle ---------------------------------------------------------------------------------------
+
+func (session *TalkSession) Dispose() error {
+	return session.dispose(nil)
+}
+
+// ----- ISessionUrlContext --------------------------------------------------------------------------------------------
+
+func (session *TalkSession) Url() string {
+	Log.Warnf("[%s] TalkSession.Url() is not implemented", session.UniqueKey())
+	return "invalid"
+}
+
+func (session *TalkSession) AppName() string {
+	Log.Warnf("[%s] TalkSession.AppName() is not implemented", session.UniqueKey())
+	return "invalid"
+}
+
+func (session *TalkSession) StreamName() string {
+	return session.option.StreamName
+}
+
+func (session *TalkSession) RawQuery() string {
+	Log.Warnf("[%s] TalkSession.RawQuery() is not implemented", session.UniqueKey())
+	return "invalid"
+}
+
+// ----- IObject -------------------------------------------------------------------------------------------------------
+
+func (session *TalkSession) UniqueKey() string {
+	return session.sessionStat.UniqueKey()
+}
+
+// ----- ISessionStat --------------------------------------------------------------------------------------------------
+
+func (session *TalkSession) UpdateStat(intervalSec uint32) {
+	session.sessionStat.UpdateStat(intervalSec)
+}
+
+func (session *TalkSession) GetStat() base.StatSession {
+	return session.sessionStat.GetStat()
+}
+
+func (session *TalkSession) IsAlive() (readAlive, writeAlive bool) {
+	return session.sessionStat.IsAlive()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (session *TalkSession) startUdp() (int, error) {
+	var err error
+	var uconn *net.UDPConn
+	var addr string
+
+	port := session.option.LocalPort
+	if port == 0 {
+		uconn, _, err = defaultUdpConnPoll.Acquire()
+		if err != nil {
+			return -1, err
+		}
+		port = uconn.LocalAddr().(*net.UDPAddr).Port
+	} else {
+		addr = fmt.Sprintf(":%d", port)
+	}
+
+	session.udpConn, err = nazanet.NewUdpConnection(func(option *nazanet.UdpConnectionOption) {
+		option.LAddr = addr
+		option.Conn = uconn
+		option.RAddr = session.option.RemoteAddr
+	})
+	return port, err
+}
+
+func (session *TalkSession) startTcpActive() (int, error) {
+	conn, err := net.DialTimeout("tcp", session.option.RemoteAddr, time.Duration(session.option.DialTimeoutMs)*time.Millisecond)
+	if err != nil {
+		return -1, err
+	}
+	session.setTcpConn(conn)
+	return conn.LocalAddr().(*net.TCPAddr).Port, nil
+}
+
+func (session *TalkSession) startTcpPassive() (port int, err error) {
+	port = session.option.LocalPort
+	if port == 0 {
+		for i := defaultPubSessionPortMin; i < defaultPubSessionPortMax; i++ {
+			if session.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", i)); err == nil {
+				return int(i), nil
+			}
+		}
+		return -1, err
+	}
+
+	session.listener, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return port, err
+}
+
+func (session *TalkSession) runLoopTcp() error {
+	conn := session.getTcpConn()
+	if conn == nil {
+		return base.ErrSessionNotStarted
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		session.sessionStat.AddReadBytes(n)
+	}
+}
+
+func (session *TalkSession) initRawRtpPackerIfNeeded(pkt base.AvPacket) error {
+	if session.audioPacker != nil {
+		if session.audioPt != pkt.PayloadType {
+			Log.Warnf("[%s] audio payload type changed. prev=%s, curr=%s",
+				session.UniqueKey(), session.audioPt.ReadableString(), pkt.PayloadType.ReadableString())
+			return base.ErrGb28181
+		}
+		return nil
+	}
+
+	switch pkt.PayloadType {
+	case base.AvPacketPtG711A, base.AvPacketPtG711U:
+		session.audioPacker = rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadPcm(), 8000, session.option.Ssrc)
+	case base.AvPacketPtAac:
+		if len(pkt.Payload) < aac.AdtsHeaderLength {
+			return base.ErrShortBuffer
+		}
+		asc, err := aac.MakeAscWithAdtsHeader(pkt.Payload[:aac.AdtsHeaderLength])
+		if err != nil {
+			return err
+		}
+		ascCtx, err := aac.NewAscContext(asc)
+		if err != nil {
+			return err
+		}
+		clockRate, err := ascCtx.GetSamplingFrequency()
+		if err != nil {
+			return err
+		}
+		session.audioPacker = rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadAac(), clockRate, session.option.Ssrc)
+	default:
+		return base.ErrGb28181
+	}
+	session.audioPt = pkt.PayloadType
+	return nil
+}
+
+// write
+//
+// tcp使用rfc4571的格式，每个rtp包前携带2字节的长度
+func (session *TalkSession) write(b []byte) error {
+	if session.option.Transport == TalkTransportUdp {
+		if err := session.udpConn.Write(b); err != nil {
+			return err
+		}
+		session.sessionStat.AddWriteBytes(len(b))
+		return nil
+	}
+
+	conn := session.getTcpConn()
+	if conn == nil {
+		// tcp passive模式下，设备还没有连接上来
+		return nil
+	}
+	lb := make([]byte, 2)
+	bele.BePutUint16(lb, uint16(len(b)))
+	if _, err := conn.Writev(net.Buffers{lb, b}); err != nil {
+		return err
+	}
+	session.sessionStat.AddWriteBytes(2 + len(b))
+	return nil
+}
+
+func (session *TalkSession) setTcpConn(conn net.Conn) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.tcpConn = connection.New(conn, func(option *connection.Option) {
+		option.WriteChanSize = session.option.WriteChanSize
+		option.WriteTimeoutMs = session.option.WriteTimeoutMs
+	})
+}
+
+func (session *TalkSession) getTcpConn() connection.Connection {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.tcpConn
+}
+
+func (session *TalkSession) dispose(err error) error {
+	var retErr error
+	session.disposeOnce.Do(func() {
+		Log.Infof("[%s] lifecycle dispose gb28181 TalkSession. err=%+v", session.UniqueKey(), err)
+		if session.udpConn != nil {
+			retErr = session.udpConn.Dispose()
+		}
+		if session.listener != nil {
+			_ = session.listener.Close()
+		}
+		if conn := session.getTcpConn(); conn != nil {
+			retErr = conn.Close()
+		}
+	})
+	return retErr
+}
@@ -0,0 +1,76 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package gb28181
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+)
+
+func TestTalkSession_TcpPassive(t *testing.T) {
+	frame := func(i byte) []byte {
+		return []byte{0xff, 0xf1, 0x50, 0x80, 0x01, 0x7f, 0xfc, i, i, i, i}
+	}
+	feed := func(session *TalkSession, i byte) {
+		err := session.FeedAvPacket(base.AvPacket{PayloadType: base.AvPacketPtAac, Timestamp: int64(i) * 40, Pts: int64(i) * 40, Payload: frame(i)})
+		assert.Equal(t, nil, err)
+	}
+
+	session := NewTalkSession(func(option *TalkSessionOption) {
+		option.Ssrc = 1
+		option.Transport = TalkTransportTcpPassive
+	})
+	port, err := session.Start()
+	assert.Equal(t, nil, err)
+	defer session.Dispose()
+	go session.RunLoop()
+
+	// 设备连接之前的数据直接丢弃
+	feed(session, 1)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	for i := 0; i < 1000 && session.getTcpConn() == nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	feed(session, 2)
+	feed(session, 3)
+
+	var out []base.AvPacket
+	unpacker := NewPsUnpacker().WithOnAvPacket(func(packet *base.AvPacket) {
+		out = append(out, base.AvPacket{Timestamp: packet.Timestamp, Payload: append([]byte(nil), packet.Payload...)})
+	})
+	for i := 0; i < 2; i++ {
+		lb := make([]byte, 2)
+		_, err = io.ReadFull(conn, lb)
+		assert.Equal(t, nil, err)
+		b := make([]byte, bele.BeUint16(lb))
+		_, err = io.ReadFull(conn, b)
+		assert.Equal(t, nil, err)
+		pkt, err := rtprtcp.ParseRtpPacket(b)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint32(1), pkt.Header.Ssrc)
+		assert.Equal(t, nil, unpacker.FeedRtpBody(pkt.Body(), pkt.Header.Timestamp))
+	}
+
+	// 设备连接后收到的第一个ps包携带psm，可以正常解析
+	assert.Equal(t, 1, len(out))
+	assert.Equal(t, int64(80), out[0].Timestamp)
+	assert.Equal(t, frame(2), out[0].Payload)
+}
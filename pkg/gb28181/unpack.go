@@ -11,11 +11,14 @@ package gb28181
 import (
 	"bytes"
 	"encoding/hex"
+	"time"
+
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/h2645"
 	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 
 	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/nazaatomic"
 	"github.com/q191201771/naza/pkg/nazabits"
 	"github.com/q191201771/naza/pkg/nazabytes"
 	"github.com/q191201771/naza/pkg/nazalog"
@@ -23,6 +26,8 @@ import (
 
 // PsUnpacker 解析ps(Program Stream)流
 type PsUnpacker struct {
+	option PsUnpackerOption
+
 	list     rtprtcp.RtpPacketList
 	buf      *nazabytes.Buffer
 	audioBuf []byte
@@ -43,22 +48,60 @@ type PsUnpacker struct {
 
 	onAvPacket base.OnAvPacketFunc
 
-	waitSpsFlag bool
+	waitSpsFlag      bool
+	waitKeyFrameFlag bool // 丢包后，视频等待下一个关键帧
+	preDroppedPts    int64
+
+	hasMaxSeq    bool
+	maxSeq       uint16               // 已收到的最大seq
+	arrivalTimes map[uint16]time.Time // 缓存中的rtp包的到达时间，key为seq
+	arrivals     []psArrival          // 按到达顺序排列，头部是最早到达的包，已经取出的包延迟删除
+	now          func() time.Time
 
 	feedPacketCount     int
 	feedBodyCount       int
 	onAvPacketWrapCount int
 	onAvPacketCount     int
+
+	lostPacketCount      nazaatomic.Uint64
+	reorderedPacketCount nazaatomic.Uint64
+	droppedFrameCount    nazaatomic.Uint64
+}
+
+type PsUnpackerOption struct {
+	// JitterBufferMs 等待乱序、丢失rtp包的最大时长，单位毫秒
+	//
+	// 根据收包时间计算，也即缓存中最早到达的包等待超过该值时，不再等待丢失的包。
+	// 注意，流中断时没有新的包触发检查，需要定时调用 FlushTimeout 。
+	// 为0时只根据缓存的包数量判断，见 maxUnpackRtpListSize
+	JitterBufferMs int
+}
+
+var defaultPsUnpackerOption = PsUnpackerOption{
+	JitterBufferMs: 500,
+}
+
+type ModPsUnpackerOption func(option *PsUnpackerOption)
+
+// PsUnpackerStat 收包质量的统计
+type PsUnpackerStat struct {
+	LostPacketCount      uint64 // 等待超时，放弃等待的rtp包数量
+	ReorderedPacketCount uint64 // 乱序到达的rtp包数量
+	DroppedFrameCount    uint64 // 由于丢包，不完整或者无法解码而丢弃的帧数量
 }
 
 func NewPsUnpacker() *PsUnpacker {
 	p := &PsUnpacker{
+		option:        defaultPsUnpackerOption,
 		buf:           nazabytes.NewBuffer(psBufInitSize),
 		preVideoPts:   -1,
 		preAudioPts:   -1,
 		preVideoRtpts: -1,
 		preAudioRtpts: -1,
 		waitSpsFlag:   true,
+		preDroppedPts: -1,
+		arrivalTimes:  make(map[uint16]time.Time),
+		now:           time.Now,
 	}
 	p.list.InitMaxSize(maxUnpackRtpListSize)
 
@@ -79,6 +122,20 @@ func (p *PsUnpacker) WithOnAvPacket(onAvPacket base.OnAvPacketFunc) *PsUnpacker
 	return p
 }
 
+func (p *PsUnpacker) WithOption(modOption ModPsUnpackerOption) *PsUnpacker {
+	modOption(&p.option)
+	return p
+}
+
+// GetStat 可在任意协程调用
+func (p *PsUnpacker) GetStat() PsUnpackerStat {
+	return PsUnpackerStat{
+		LostPacketCount:      p.lostPacketCount.Load(),
+		ReorderedPacketCount: p.reorderedPacketCount.Load(),
+		DroppedFrameCount:    p.droppedFrameCount.Load(),
+	}
+}
+
 // FeedRtpPacket
 //
 // 注意，内部会处理丢包、乱序等问题
@@ -103,11 +160,6 @@ func (p *PsUnpacker) FeedRtpPacket(b []byte) error {
 	//nazalog.Debugf(">>>>>>>>>> PsUnpacker FeedRtpPacket. h=%+v, len=%d, body=%s",
 	//	ipkt.Header, len(ipkt.Raw), hex.Dump(nazabytes.Prefix(ipkt.Raw[12:], 8)))
 
-	var isStartPositionFn = func(pkt rtprtcp.RtpPacket) bool {
-		body := pkt.Body()
-		return len(body) > 4 && bytes.Compare(body[0:3], []byte{0, 0, 1}) == 0
-	}
-
 	// 处理丢包、乱序、重复
 
 	// 过期了直接丢掉
@@ -115,38 +167,83 @@ func (p *PsUnpacker) FeedRtpPacket(b []byte) error {
 		//nazalog.Debugf("PsUnpacker NOTICE stale, drop. %d", ipkt.Header.Seq)
 		return ErrGb28181
 	}
+	// 比已收到的最大seq小，说明是乱序到达的
+	if p.hasMaxSeq && rtprtcp.CompareSeq(ipkt.Header.Seq, p.maxSeq) < 0 {
+		p.reorderedPacketCount.Increment()
+	} else {
+		p.hasMaxSeq = true
+		p.maxSeq = ipkt.Header.Seq
+	}
+
 	// 插入队列
 	//nazalog.Debugf("PsUnpacker FeedRtpPacket insert. %d", ipkt.Header.Seq)
 	p.list.Insert(ipkt)
+	if _, ok := p.arrivalTimes[ipkt.Header.Seq]; !ok {
+		t := p.now()
+		p.arrivalTimes[ipkt.Header.Seq] = t
+		if p.option.JitterBufferMs > 0 {
+			p.arrivals = append(p.arrivals, psArrival{seq: ipkt.Header.Seq, t: t})
+		}
+	}
+	p.popList()
+	return nil
+}
+
+// FlushTimeout 检查jitter buffer是否超时，超时则放弃等待丢失的包，继续解析缓存中后续的包
+//
+// 流中断时不会再调用 FeedRtpPacket ，缓存中的包需要业务方定时调用该函数来输出
+func (p *PsUnpacker) FlushTimeout() {
+	if p.list.Size == 0 {
+		return
+	}
+	p.popList()
+}
+
+// popList 取出缓存中可以解析的包喂入解析器，需要时放弃等待丢失的包
+func (p *PsUnpacker) popList() {
+	var isStartPositionFn = func(pkt rtprtcp.RtpPacket) bool {
+		body := pkt.Body()
+		return len(body) > 4 && bytes.Compare(body[0:3], []byte{0, 0, 1}) == 0
+	}
+
 	for {
 		// 循环判断头部是否是顺序的
 
 		if p.list.IsFirstSequential() {
 			// 如果头一个是顺序的，取出来，喂入解析器
 
-			opkt := p.list.PopFirst()
+			opkt := p.popFirst()
 			p.list.SetDoneSeq(opkt.Header.Seq)
 			//nazalog.Debugf("PsUnpacker FeedRtpBody. %d", opkt.Header.Seq)
 			errFeedRtpBody := p.FeedRtpBody(opkt.Body(), opkt.Header.Timestamp)
 			if errFeedRtpBody != nil {
 				p.list.Reset()
+				p.arrivalTimes = make(map[uint16]time.Time)
+				p.arrivals = nil
 			}
 		} else {
-			// 不是顺序的，如果还没达到容器阈值，就先缓存在容器中，直接退出了
+			// 不是顺序的，如果还没达到容器阈值，并且等待时长没有超过jitter buffer，就先缓存在容器中，直接退出了
 			// 注意，如果队列为空，也会走到这，然后通过!full退出
 
-			if !p.list.Full() {
+			if !p.list.Full() && !p.isJitterBufferTimeout() {
 				//nazalog.Debugf("PsUnpacker exit check !full.")
 				break
 			}
 
+			// 放弃等待丢失的包
+			first := p.list.PeekFirst()
+			if doneSeq, ok := p.list.DoneSeq(); ok {
+				p.lostPacketCount.Add(uint64(rtprtcp.SubSeq(first.Header.Seq, doneSeq) - 1))
+			}
+			p.dropIncompleteFrame()
+
 			// 如果达到容器阈值了，就丢弃一部分
 			// 丢弃哪些呢？
 			// 先丢第一个，因为满了至少要丢一个了。
 			//
 			// 再丢弃连续的，直到下一个可解析帧位置
 			// 因为不连续的话，没法判断和正在丢弃的是否同一帧的，可以给个机会看后续是否能收到
-			prev := p.list.PopFirst()
+			prev := p.popFirst()
 			//nazalog.Debugf("PsUnpacker NOTICE drop. %d", prev.Header.Seq)
 
 			for p.list.Size > 0 {
@@ -164,7 +261,7 @@ func (p *PsUnpacker) FeedRtpPacket(b []byte) error {
 					break
 				}
 
-				prev = p.list.PopFirst()
+				prev = p.popFirst()
 				//nazalog.Debugf("PsUnpacker NOTICE drop. %d", prev.Header.Seq)
 			}
 
@@ -174,8 +271,58 @@ func (p *PsUnpacker) FeedRtpPacket(b []byte) error {
 			p.videoBuf = nil
 		}
 	}
+}
 
-	return nil
+func (p *PsUnpacker) popFirst() rtprtcp.RtpPacket {
+	pkt := p.list.PopFirst()
+	delete(p.arrivalTimes, pkt.Header.Seq)
+	return pkt
+}
+
+// isJitterBufferTimeout 缓存中最早到达的包等待的时长是否超过了jitter buffer
+func (p *PsUnpacker) isJitterBufferTimeout() bool {
+	if p.option.JitterBufferMs <= 0 {
+		return false
+	}
+	if p.list.Size == 0 {
+		// 缓存的包都已经取出
+		p.arrivals = p.arrivals[:0]
+		return false
+	}
+	// 注意，包的到达顺序和seq顺序不一定相同，所以按到达顺序记录，跳过已经取出的包
+	for len(p.arrivals) > 0 {
+		first := p.arrivals[0]
+		if t, ok := p.arrivalTimes[first.seq]; ok && t.Equal(first.t) {
+			return p.now().Sub(first.t) >= time.Duration(p.option.JitterBufferMs)*time.Millisecond
+		}
+		p.arrivals = p.arrivals[1:]
+	}
+	return false
+}
+
+type psArrival struct {
+	seq uint16
+	t   time.Time
+}
+
+// dropIncompleteFrame 丢包后，缓存中不完整的视频帧丢弃，并且后续视频等待下一个关键帧
+func (p *PsUnpacker) dropIncompleteFrame() {
+	// 注意，视频帧是在收到下一帧的pes后才回调的，
+	// 如果未解析完的数据是新一帧的pes，说明videoBuf中的帧是完整的，先回调给上层
+	rb := p.buf.Bytes()
+	if len(p.videoBuf) != 0 && len(rb) >= 14 && bele.BeUint32(rb) == psPackStartCodeVideoStream && (rb[7]>>6)&0x2 != 0 {
+		if _, pts := readPts(rb[9:]); pts != p.preVideoPts {
+			p.iterateNaluByStartCode(psPackStartCodeVideoStream, p.preVideoPts, p.preVideoPts)
+			p.videoBuf = nil
+		}
+	}
+
+	if len(p.videoBuf) != 0 || len(rb) != 0 {
+		p.droppedFrameCount.Increment()
+	}
+	if p.videoStreamType != 0 {
+		p.waitKeyFrameFlag = true
+	}
 }
 
 // FeedRtpBody 注意，传入的数据应该是连续的，属于完整帧的
@@ -570,6 +717,20 @@ func (p *PsUnpacker) onAvPacketWrap(packet *base.AvPacket) {
 			}
 		}
 	}
+	if packet.IsVideo() && p.waitKeyFrameFlag {
+		if isKeyNalu(packet.PayloadType, packet.Payload) {
+			p.waitKeyFrameFlag = false
+			p.preDroppedPts = -1
+		} else {
+			// 同一帧的多个nal只计数一次
+			if packet.Pts != p.preDroppedPts {
+				p.droppedFrameCount.Increment()
+				p.preDroppedPts = packet.Pts
+			}
+			return
+		}
+	}
+
 	if p.onAvPacket != nil {
 		p.onAvPacketCount++
 		//nazalog.Debugf("PsUnpacker > onAvPacket. packet=%s", packet.DebugString())
@@ -577,6 +738,23 @@ func (p *PsUnpacker) onAvPacketWrap(packet *base.AvPacket) {
 	}
 }
 
+// isKeyNalu 是否为关键帧开始的nal，也即vps、sps、pps或者关键帧nal
+//
+// @param nalu: 携带start code的nal
+func isKeyNalu(pt base.AvPacketPt, nalu []byte) bool {
+	startPos, leading := h2645.IterateNaluStartCode(nalu, 0)
+	if startPos < 0 || len(nalu) <= startPos+leading {
+		return false
+	}
+	isAvc := pt == base.AvPacketPtAvc
+	typ := h2645.ParseNaluType(isAvc, nalu[startPos+leading])
+	if isAvc {
+		return typ == h2645.H264NaluTypeSps || typ == h2645.H264NaluTypePps || typ == h2645.H264NaluTypeIdrSlice
+	}
+	return typ == h2645.H265NaluTypeVps || typ == h2645.H265NaluTypeSps || typ == h2645.H265NaluTypePps ||
+		h2645.H265IsIrapNalu(typ)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // TODO(chef): [refactor] 以下代码拷贝来自package mpegts，重复了
@@ -12,9 +12,12 @@ import (
 	"encoding/hex"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/q191201771/naza/pkg/assert"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/hevc"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 	"github.com/q191201771/naza/pkg/nazamd5"
 
 	"github.com/ysjhlnu/lal/pkg/avc"
@@ -190,3 +193,120 @@ func TestRtpLossPacket(t *testing.T) {
 		unpacker.FeedRtpPacket(rtp)
 	}
 }
+
+// makeJitterBufferFrames 构造视频帧，每帧间隔40毫秒，打包成ps后，拆分成多个rtp包
+func makeJitterBufferFrames(t *testing.T, keys []bool) [][]rtprtcp.RtpPacket {
+	makeFrame := func(isKey bool) []byte {
+		var out []byte
+		if isKey {
+			out = append(out, 0, 0, 0, 1, 0x67, 0x11, 0x11)
+			out = append(out, 0, 0, 0, 1, 0x68, 0x11, 0x11)
+			out = append(out, 0, 0, 0, 1, 0x65)
+		} else {
+			out = append(out, 0, 0, 0, 1, 0x41)
+		}
+		for i := 0; i < 500; i++ {
+			out = append(out, 0x11)
+		}
+		return out
+	}
+	psPacker := NewPsPacker()
+	rtpPacker := rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadRaw(), 90000, 1, func(option *rtprtcp.RtpPackerOption) {
+		option.MaxPayloadSize = 200
+	})
+	var frames [][]rtprtcp.RtpPacket
+	for i, isKey := range keys {
+		pkt := base.AvPacket{
+			PayloadType: base.AvPacketPtAvc,
+			Timestamp:   int64(i * 40),
+			Pts:         int64(i * 40),
+			Payload:     makeFrame(isKey),
+		}
+		ps, err := psPacker.Pack(pkt)
+		assert.Equal(t, nil, err)
+		pkt.PayloadType = 96
+		pkt.Payload = ps
+		frames = append(frames, rtpPacker.Pack(pkt))
+	}
+	return frames
+}
+
+func TestPsUnpackerJitterBuffer(t *testing.T) {
+	frames := makeJitterBufferFrames(t, []bool{true, false, false, false, true, false, false})
+
+	var pts []int64
+	unpacker := NewPsUnpacker().WithOption(func(option *PsUnpackerOption) {
+		option.JitterBufferMs = 40
+	}).WithOnAvPacket(func(packet *base.AvPacket) {
+		pts = append(pts, packet.Pts)
+	})
+	// 按帧间隔模拟收包时间
+	begin := time.Now()
+	var now time.Time
+	unpacker.now = func() time.Time {
+		return now
+	}
+
+	for i, frame := range frames {
+		now = begin.Add(time.Duration(i*40) * time.Millisecond)
+		for j, rtp := range frame {
+			if i == 1 && j == 0 {
+				// 乱序
+				continue
+			}
+			if i == 1 && j == 1 {
+				_ = unpacker.FeedRtpPacket(rtp.Raw)
+				_ = unpacker.FeedRtpPacket(frame[0].Raw)
+				continue
+			}
+			if i == 2 && j == 1 {
+				// 丢包
+				continue
+			}
+			_ = unpacker.FeedRtpPacket(rtp.Raw)
+		}
+	}
+
+	// 第2帧丢包，第3帧无法解码，都被丢弃，直到第4帧关键帧恢复
+	assert.Equal(t, []int64{0, 0, 0, 40, 160, 160, 160, 200}, pts)
+	stat := unpacker.GetStat()
+	assert.Equal(t, uint64(1), stat.LostPacketCount)
+	assert.Equal(t, uint64(1), stat.ReorderedPacketCount)
+	assert.Equal(t, uint64(2), stat.DroppedFrameCount)
+}
+
+func TestPsUnpackerJitterBuffer_Stall(t *testing.T) {
+	frames := makeJitterBufferFrames(t, []bool{true, true, true})
+
+	unpacker := NewPsUnpacker().WithOption(func(option *PsUnpackerOption) {
+		option.JitterBufferMs = 40
+	})
+	now := time.Now()
+	unpacker.now = func() time.Time {
+		return now
+	}
+
+	for i, frame := range frames {
+		for j, rtp := range frame {
+			if i == 1 && j == 1 {
+				// 丢包
+				continue
+			}
+			_ = unpacker.FeedRtpPacket(rtp.Raw)
+		}
+	}
+	// 之后不再收到新的包
+	assert.Equal(t, true, unpacker.list.Size > 0)
+
+	// 没有超时，继续等待
+	now = now.Add(39 * time.Millisecond)
+	unpacker.FlushTimeout()
+	assert.Equal(t, true, unpacker.list.Size > 0)
+	assert.Equal(t, uint64(0), unpacker.GetStat().LostPacketCount)
+
+	// 超时，放弃等待丢失的包，缓存中的包被取出
+	now = now.Add(time.Millisecond)
+	unpacker.FlushTimeout()
+	assert.Equal(t, 0, unpacker.list.Size)
+	assert.Equal(t, uint64(1), unpacker.GetStat().LostPacketCount)
+}
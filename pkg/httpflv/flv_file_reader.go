@@ -9,6 +9,7 @@
 package httpflv
 
 import (
+	"io"
 	"os"
 )
 
@@ -39,6 +40,23 @@ func (ffr *FlvFileReader) ReadTag() (Tag, error) {
 	return ReadTag(ffr.fp)
 }
 
+// Tell 返回当前的读取位置，下一个 ReadTag 读取的tag从该位置开始，可用于 SeekTo
+func (ffr *FlvFileReader) Tell() (int64, error) {
+	if !ffr.hasReadFlvHeader {
+		if _, err := ffr.ReadFlvHeader(); err != nil {
+			return 0, err
+		}
+	}
+	return ffr.fp.Seek(0, io.SeekCurrent)
+}
+
+// SeekTo @param offset 必须为 Tell 的返回值
+func (ffr *FlvFileReader) SeekTo(offset int64) error {
+	ffr.hasReadFlvHeader = true
+	_, err := ffr.fp.Seek(offset, io.SeekStart)
+	return err
+}
+
 func (ffr *FlvFileReader) Dispose() {
 	if ffr.fp != nil {
 		_ = ffr.fp.Close()
@@ -9,6 +9,7 @@
 package httpflv
 
 import (
+	"io"
 	"os"
 
 	"github.com/ysjhlnu/lal/pkg/base"
@@ -25,6 +26,23 @@ func (ffw *FlvFileWriter) Open(filename string) (err error) {
 	return
 }
 
+// OpenToAppend 打开已有的文件继续写，`offset`之后的数据（比如不完整的tag）会被截断
+//
+// @param offset: 通常为最后一个完整tag的结束位置，见 FlvFileReader.Tell
+func (ffw *FlvFileWriter) OpenToAppend(filename string, offset int64) (err error) {
+	if ffw.fp, err = os.OpenFile(filename, os.O_WRONLY, 0666); err != nil {
+		return
+	}
+	if err = ffw.fp.Truncate(offset); err == nil {
+		_, err = ffw.fp.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		_ = ffw.fp.Close()
+		ffw.fp = nil
+	}
+	return
+}
+
 func (ffw *FlvFileWriter) WriteRaw(b []byte) (err error) {
 	if ffw.fp == nil {
 		return base.ErrFileNotExist
@@ -10,6 +10,7 @@ package httpflv
 
 import (
 	"net"
+	"net/url"
 
 	"github.com/ysjhlnu/lal/pkg/base"
 
@@ -37,6 +38,8 @@ func NewSubSession(conn net.Conn, urlCtx base.UrlContext, isWebSocket bool, webs
 			UrlCtx:       urlCtx,
 			IsWebSocket:  isWebSocket,
 			WebSocketKey: websocketKey,
+
+			SendQueueConfig: SubSessionSendQueueConfig,
 		}),
 		IsFresh:                 true,
 		ShouldWaitVideoKeyFrame: true,
@@ -78,6 +81,27 @@ func (session *SubSession) Write(b []byte) {
 	session.core.Write(b)
 }
 
+// WriteFrame 见 base.BasicHttpSubSession.WriteFrame
+func (session *SubSession) WriteFrame(b []byte, typ base.SendItemType) {
+	session.core.WriteFrame(b, typ)
+}
+
+// WriteRefBuffer 见 base.BasicHttpSubSession.WriteRefBuffer
+func (session *SubSession) WriteRefBuffer(rb *base.RefBuffer, typ base.SendItemType) {
+	session.core.WriteRefBuffer(rb, typ)
+}
+
+// SupportMultitrack 拉流url中携带了`multitrack=1`参数时，认为播放端支持enhanced-rtmp multitrack
+//
+// http-flv没有类似rtmp connect的能力协商过程，所以由url参数指定
+func (session *SubSession) SupportMultitrack() bool {
+	q, err := url.ParseQuery(session.RawQuery())
+	if err != nil {
+		return false
+	}
+	return q.Get("multitrack") == "1"
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // IObject interface
 // ---------------------------------------------------------------------------------------------------------------------
@@ -12,6 +12,8 @@ import (
 	"io"
 
 	"github.com/q191201771/naza/pkg/bele"
+
+	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 type TagHeader struct {
@@ -51,9 +53,9 @@ func (tag *Tag) IsHevcKeySeqHeader() bool {
 	return tag.Header.Type == TagTypeVideo && tag.Raw[TagHeaderSize] == HevcKeyFrame && tag.Raw[TagHeaderSize+1] == HevcPacketTypeSeqHeader
 }
 
-// IsVideoKeySeqHeader AVC或HEVC的seq header
+// IsVideoKeySeqHeader AVC或HEVC的seq header，以及enhanced-rtmp的seq header
 func (tag *Tag) IsVideoKeySeqHeader() bool {
-	return tag.IsAvcKeySeqHeader() || tag.IsHevcKeySeqHeader()
+	return tag.IsAvcKeySeqHeader() || tag.IsHevcKeySeqHeader() || tag.rtmpMsg().IsVideoKeySeqHeader()
 }
 
 func (tag *Tag) IsAvcKeyNalu() bool {
@@ -64,15 +66,23 @@ func (tag *Tag) IsHevcKeyNalu() bool {
 	return tag.Header.Type == TagTypeVideo && tag.Raw[TagHeaderSize] == HevcKeyFrame && tag.Raw[TagHeaderSize+1] == HevcPacketTypeNalu
 }
 
-// IsVideoKeyNalu AVC或HEVC的关键帧
+// IsVideoKeyNalu AVC或HEVC的关键帧，以及enhanced-rtmp的关键帧
 func (tag *Tag) IsVideoKeyNalu() bool {
-	return tag.IsAvcKeyNalu() || tag.IsHevcKeyNalu()
+	return tag.IsAvcKeyNalu() || tag.IsHevcKeyNalu() || tag.rtmpMsg().IsVideoKeyNalu()
 }
 
 func (tag *Tag) IsAacSeqHeader() bool {
 	return tag.Header.Type == TagTypeAudio && tag.Raw[TagHeaderSize]>>4 == SoundFormatAac && tag.Raw[TagHeaderSize+1] == AacPacketTypeSeqHeader
 }
 
+// rtmpMsg 复用 base.RtmpMsg 中enhanced-rtmp的判断逻辑，不拷贝内存
+func (tag *Tag) rtmpMsg() base.RtmpMsg {
+	return base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: tag.Header.Type},
+		Payload: tag.Payload(),
+	}
+}
+
 func (tag *Tag) clone() (out Tag) {
 	out.Header = tag.Header
 	out.Raw = append(out.Raw, tag.Raw...)
@@ -89,6 +99,19 @@ func (tag *Tag) ModTagTimestamp(timestamp uint32) {
 // PackHttpflvTag 打包一个序列化后的 tag 二进制buffer，包含 tag header，body，prev tag size
 func PackHttpflvTag(t uint8, timestamp uint32, in []byte) []byte {
 	out := make([]byte, TagHeaderSize+len(in)+PrevTagSizeFieldSize)
+	PackHttpflvTagTo(out, t, timestamp, in)
+	return out
+}
+
+// PackHttpflvTagRef 和 PackHttpflvTag 相同，区别是返回的内存块来自内存池，见 base.RefBuffer
+func PackHttpflvTagRef(t uint8, timestamp uint32, in []byte) *base.RefBuffer {
+	rb := base.NewRefBuffer(TagHeaderSize + len(in) + PrevTagSizeFieldSize)
+	PackHttpflvTagTo(rb.Bytes(), t, timestamp, in)
+	return rb
+}
+
+// PackHttpflvTagTo 将flv tag写入`out`，`out`的大小必须为 TagHeaderSize+len(in)+PrevTagSizeFieldSize
+func PackHttpflvTagTo(out []byte, t uint8, timestamp uint32, in []byte) {
 	out[0] = t
 	bele.BePutUint24(out[1:], uint32(len(in)))
 	bele.BePutUint24(out[4:], timestamp&0xFFFFFF)
@@ -98,7 +121,6 @@ func PackHttpflvTag(t uint8, timestamp uint32, in []byte) []byte {
 	out[10] = 0
 	copy(out[11:], in)
 	bele.BePutUint32(out[TagHeaderSize+len(in):], uint32(TagHeaderSize+len(in)))
-	return out
 }
 
 // ReadTag 从`rd`中读取数据并解析至`tag`
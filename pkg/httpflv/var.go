@@ -8,12 +8,16 @@
 
 package httpflv
 
-import "github.com/q191201771/naza/pkg/nazalog"
+import (
+	"github.com/q191201771/naza/pkg/nazalog"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
 
 var (
-	SubSessionWriteChanSize  = 1024 // SubSession发送数据时channel的大小
-	SubSessionWriteTimeoutMs = 10000
-	FlvHeader                = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+	SubSessionWriteChanSize   = 1024 // SubSession发送数据时channel的大小
+	SubSessionWriteTimeoutMs  = 10000
+	SubSessionSendQueueConfig = base.DefaultSendQueueConfig // 见 base.SendQueue
+	FlvHeader                 = []byte{0x46, 0x4c, 0x56, 0x01, 0x05, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
 
 	Log = nazalog.GetGlobalLogger()
 )
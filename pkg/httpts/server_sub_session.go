@@ -11,8 +11,8 @@ package httpts
 import (
 	"net"
 
-	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/q191201771/naza/pkg/connection"
+	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 var tsHttpResponseHeader []byte
@@ -35,6 +35,8 @@ func NewSubSession(conn net.Conn, urlCtx base.UrlContext, isWebSocket bool, webs
 			UrlCtx:       urlCtx,
 			IsWebSocket:  isWebSocket,
 			WebSocketKey: websocketKey,
+
+			SendQueueConfig: SubSessionSendQueueConfig,
 		}),
 		IsFresh:            true,
 		ShouldWaitBoundary: true,
@@ -67,6 +69,11 @@ func (session *SubSession) Write(b []byte) {
 	session.core.Write(b)
 }
 
+// WriteFrame 见 base.BasicHttpSubSession.WriteFrame
+func (session *SubSession) WriteFrame(b []byte, typ base.SendItemType) {
+	session.core.WriteFrame(b, typ)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // IObject interface
 // ---------------------------------------------------------------------------------------------------------------------
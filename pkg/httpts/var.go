@@ -8,11 +8,15 @@
 
 package httpts
 
-import "github.com/q191201771/naza/pkg/nazalog"
+import (
+	"github.com/q191201771/naza/pkg/nazalog"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
 
 var (
-	SubSessionWriteChanSize  = 1024
-	SubSessionWriteTimeoutMs = 10000
+	SubSessionWriteChanSize   = 1024
+	SubSessionWriteTimeoutMs  = 10000
+	SubSessionSendQueueConfig = base.DefaultSendQueueConfig // 见 base.SendQueue
 
 	Log = nazalog.GetGlobalLogger()
 )
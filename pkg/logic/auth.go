@@ -10,6 +10,8 @@ package logic
 
 import (
 	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
 )
 
 // TODO(chef): [refactor] 将simple_auth.go的内容合并过来，没必要弄两个文件 202209
@@ -19,3 +21,27 @@ type IAuthentication interface {
 	OnSubStart(info base.SubStartInfo) error
 	OnHls(streamName, urlParam string) error
 }
+
+// IRtspAuthentication 可选接口
+//
+// Option.Authentication 实现该接口后，RTSP推拉流Basic/Digest鉴权的账号由该接口按流提供，
+// 否则使用webhook（见 HttpNotifyConfig.OnRtspAuth ），以及配置文件中的账号（见 rtsp.ServerAuthConfig ）
+type IRtspAuthentication interface {
+	OnRtspAuth(req rtsp.ServerAuthRequest) (rtsp.ServerAuthCredential, error)
+}
+
+// IRtmpConnectAuthentication 可选接口
+//
+// Option.Authentication 实现该接口后，RTMP的connect信令由该接口检查，可以根据app、tcUrl、flashVer、swfUrl、pageUrl以及自定义字段（见 base.RtmpConnectInfo ）判断，
+// 返回非nil时拒绝该连接，回复 NetConnection.Connect.Rejected ，description为err.Error()
+type IRtmpConnectAuthentication interface {
+	OnRtmpConnect(info base.RtmpConnectInfo) error
+}
+
+// IRtmpAuthentication 可选接口
+//
+// Option.Authentication 实现该接口后，RTMP connect信令challenge/response鉴权（adobe、llnw）的账号由该接口按app提供，
+// 否则使用webhook（见 HttpNotifyConfig.OnRtmpAuth ），以及配置文件中的账号（见 RtmpConfig.AuthConfig ）
+type IRtmpAuthentication interface {
+	OnRtmpAuth(req rtmp.ServerAuthRequest) (rtmp.ServerAuthCredential, error)
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/q191201771/naza/pkg/nazalog"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/hls"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
 	"github.com/ysjhlnu/lal/pkg/rtsp"
 )
 
@@ -26,6 +27,13 @@ const (
 	defaultHttpflvUrlPattern = "/live/"
 	defaultHttptsUrlPattern  = "/live/"
 	defaultHlsUrlPattern     = "/hls/"
+
+	defaultRtmpOverHttpUrlPattern      = "/"
+	defaultRtspOverHttpUrlPattern      = "/"
+	defaultRtspOverWebSocketUrlPattern = "/"
+	defaultRtspVodAppName              = "vod"
+	defaultRtspAuthMaxFailCount        = 5
+	defaultRtspAuthBlockSec            = 60
 )
 
 type Config struct {
@@ -41,6 +49,8 @@ type Config struct {
 	RelayPushConfig       RelayPushConfig       `json:"relay_push"`
 	StaticRelayPullConfig StaticRelayPullConfig `json:"static_relay_pull"`
 
+	SubSessionSendQueueConfig base.SendQueueConfig `json:"sub_session_send_queue"`
+
 	HttpApiConfig    HttpApiConfig    `json:"http_api"`
 	ServerId         string           `json:"server_id"`
 	HttpNotifyConfig HttpNotifyConfig `json:"http_notify"`
@@ -60,6 +70,23 @@ type RtmpConfig struct {
 	GopNum               int    `json:"gop_num"` // TODO(chef): refactor 更名为gop_cache_num
 	SingleGopMaxFrameNum int    `json:"single_gop_max_frame_num"`
 	MergeWriteSize       int    `json:"merge_write_size"`
+
+	// OverHttpConfig RTMPT(RTMP over HTTP)，复用http服务的监听，url pattern为RTMPT请求路径的前缀
+	OverHttpConfig CommonHttpServerConfig `json:"over_http"`
+
+	VodConfig RtmpVodConfig `json:"vod"`
+
+	// AuthConfig connect信令challenge/response鉴权（adobe、llnw）的默认账号，见 rtmpAuthenticator
+	AuthConfig rtmp.ServerAuthConfig `json:"auth"`
+}
+
+// RtmpVodConfig RTMP点播录制的flv文件
+//
+// play的流名称对应 Dir 下的flv文件（流名称可以不带.flv后缀），文件存在并且play的start参数不是只播放直播流时，播放文件，否则播放直播流。
+// Dir 为空时使用 RecordConfig.FlvOutPath 。
+type RtmpVodConfig struct {
+	Enable bool   `json:"enable"`
+	Dir    string `json:"dir"`
 }
 
 type InSessionConfig struct {
@@ -102,7 +129,23 @@ type RtspConfig struct {
 	RtspsCertFile       string `json:"rtsps_cert_file"`
 	RtspsKeyFile        string `json:"rtsps_key_file"`
 	OutWaitKeyFrameFlag bool   `json:"out_wait_key_frame_flag"`
+	SessionTimeoutSec   int    `json:"session_timeout_sec"` // 为0时使用默认值
 	rtsp.ServerAuthConfig
+
+	// OverHttpConfig RTSP over HTTP，复用http服务的监听
+	OverHttpConfig CommonHttpServerConfig `json:"over_http"`
+	// OverWebSocketConfig RTSP over WebSocket，复用http服务的监听
+	OverWebSocketConfig CommonHttpServerConfig `json:"over_websocket"`
+
+	MulticastConfig rtsp.MulticastConfig `json:"multicast"`
+
+	VodConfig RtspVodConfig `json:"vod"`
+}
+
+// RtspVodConfig RTSP点播录制的flv文件，拉流地址为`rtsp://host:port/<app_name>/<flv文件名>`，文件在 RecordConfig.FlvOutPath 下查找
+type RtspVodConfig struct {
+	Enable  bool   `json:"enable"`
+	AppName string `json:"app_name"`
 }
 
 type RecordConfig struct {
@@ -140,6 +183,12 @@ type HttpNotifyConfig struct {
 	OnRelayPullStop   string `json:"on_relay_pull_stop"`
 	OnRtmpConnect     string `json:"on_rtmp_connect"`
 	OnHlsMakeTs       string `json:"on_hls_make_ts"`
+
+	// OnRtspAuth RTSP推拉流鉴权时同步请求获取账号，见 rtspAuthenticator ，为空时不使用
+	OnRtspAuth string `json:"on_rtsp_auth"`
+
+	// OnRtmpAuth RTMP connect鉴权时同步请求获取账号，见 rtmpAuthenticator ，为空时不使用
+	OnRtmpAuth string `json:"on_rtmp_auth"`
 }
 
 type SimpleAuthConfig struct {
@@ -285,6 +334,9 @@ func LoadConfAndInitLog(rawContent []byte) *Config {
 	mergeCommonHttpAddrConfig(&config.HttpflvConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
 	mergeCommonHttpAddrConfig(&config.HttptsConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
 	mergeCommonHttpAddrConfig(&config.HlsConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
+	mergeCommonHttpAddrConfig(&config.RtmpConfig.OverHttpConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
+	mergeCommonHttpAddrConfig(&config.RtspConfig.OverHttpConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
+	mergeCommonHttpAddrConfig(&config.RtspConfig.OverWebSocketConfig.CommonHttpAddrConfig, &config.DefaultHttpConfig.CommonHttpAddrConfig)
 
 	// 为缺失的字段中的一些特定字段，设置特定默认值
 	if config.HlsConfig.Enable && !j.Exist("hls.cleanup_mode") {
@@ -315,6 +367,43 @@ func LoadConfAndInitLog(rawContent []byte) *Config {
 		config.HttpflvConfig.UrlPattern = defaultHlsUrlPattern
 	}
 
+	if (config.RtmpConfig.OverHttpConfig.Enable || config.RtmpConfig.OverHttpConfig.EnableHttps) && !j.Exist("rtmp.over_http.url_pattern") {
+		Log.Warnf("config rtmp.over_http.url_pattern not exist. set to default which is %s", defaultRtmpOverHttpUrlPattern)
+		config.RtmpConfig.OverHttpConfig.UrlPattern = defaultRtmpOverHttpUrlPattern
+	}
+	if (config.RtspConfig.OverHttpConfig.Enable || config.RtspConfig.OverHttpConfig.EnableHttps) && !j.Exist("rtsp.over_http.url_pattern") {
+		Log.Warnf("config rtsp.over_http.url_pattern not exist. set to default which is %s", defaultRtspOverHttpUrlPattern)
+		config.RtspConfig.OverHttpConfig.UrlPattern = defaultRtspOverHttpUrlPattern
+	}
+	if (config.RtspConfig.OverWebSocketConfig.Enable || config.RtspConfig.OverWebSocketConfig.EnableHttps) && !j.Exist("rtsp.over_websocket.url_pattern") {
+		Log.Warnf("config rtsp.over_websocket.url_pattern not exist. set to default which is %s", defaultRtspOverWebSocketUrlPattern)
+		config.RtspConfig.OverWebSocketConfig.UrlPattern = defaultRtspOverWebSocketUrlPattern
+	}
+	if config.RtspConfig.VodConfig.Enable && !j.Exist("rtsp.vod.app_name") {
+		Log.Warnf("config rtsp.vod.app_name not exist. set to default which is %s", defaultRtspVodAppName)
+		config.RtspConfig.VodConfig.AppName = defaultRtspVodAppName
+	}
+	if !j.Exist("rtsp.auth_max_fail_count") {
+		Log.Warnf("config rtsp.auth_max_fail_count not exist. set to default which is %d", defaultRtspAuthMaxFailCount)
+		config.RtspConfig.AuthMaxFailCount = defaultRtspAuthMaxFailCount
+	}
+	if !j.Exist("rtsp.auth_block_sec") {
+		Log.Warnf("config rtsp.auth_block_sec not exist. set to default which is %d", defaultRtspAuthBlockSec)
+		config.RtspConfig.AuthBlockSec = defaultRtspAuthBlockSec
+	}
+	if config.SubSessionSendQueueConfig.Enable && !j.Exist("sub_session_send_queue.queue_size") {
+		Log.Warnf("config sub_session_send_queue.queue_size not exist. set to default which is %d", base.DefaultSendQueueConfig.QueueSize)
+		config.SubSessionSendQueueConfig.QueueSize = base.DefaultSendQueueConfig.QueueSize
+	}
+	if config.SubSessionSendQueueConfig.Enable && !j.Exist("sub_session_send_queue.drop_non_key_percent") {
+		Log.Warnf("config sub_session_send_queue.drop_non_key_percent not exist. set to default which is %d", base.DefaultSendQueueConfig.DropNonKeyPercent)
+		config.SubSessionSendQueueConfig.DropNonKeyPercent = base.DefaultSendQueueConfig.DropNonKeyPercent
+	}
+	if config.SubSessionSendQueueConfig.Enable && !j.Exist("sub_session_send_queue.max_skip_gop_count") {
+		Log.Warnf("config sub_session_send_queue.max_skip_gop_count not exist. set to default which is %d", base.DefaultSendQueueConfig.MaxSkipGopCount)
+		config.SubSessionSendQueueConfig.MaxSkipGopCount = base.DefaultSendQueueConfig.MaxSkipGopCount
+	}
+
 	// 对一些常见的格式错误做修复
 	// 确保url pattern以`/`开始，并以`/`结束
 	if urlPattern, changed := ensureStartAndEndWithSlash(config.HttpflvConfig.UrlPattern); changed {
@@ -329,6 +418,18 @@ func LoadConfAndInitLog(rawContent []byte) *Config {
 		Log.Warnf("fix config. hls.url_pattern %s -> %s", config.HlsConfig.UrlPattern, urlPattern)
 		config.HttpflvConfig.UrlPattern = urlPattern
 	}
+	if urlPattern, changed := ensureStartAndEndWithSlash(config.RtmpConfig.OverHttpConfig.UrlPattern); changed {
+		Log.Warnf("fix config. rtmp.over_http.url_pattern %s -> %s", config.RtmpConfig.OverHttpConfig.UrlPattern, urlPattern)
+		config.RtmpConfig.OverHttpConfig.UrlPattern = urlPattern
+	}
+	if urlPattern, changed := ensureStartAndEndWithSlash(config.RtspConfig.OverHttpConfig.UrlPattern); changed {
+		Log.Warnf("fix config. rtsp.over_http.url_pattern %s -> %s", config.RtspConfig.OverHttpConfig.UrlPattern, urlPattern)
+		config.RtspConfig.OverHttpConfig.UrlPattern = urlPattern
+	}
+	if urlPattern, changed := ensureStartAndEndWithSlash(config.RtspConfig.OverWebSocketConfig.UrlPattern); changed {
+		Log.Warnf("fix config. rtsp.over_websocket.url_pattern %s -> %s", config.RtspConfig.OverWebSocketConfig.UrlPattern, urlPattern)
+		config.RtspConfig.OverWebSocketConfig.UrlPattern = urlPattern
+	}
 
 	// 打印配置文件中的元素内容，以及解析后的最终值
 	// 把配置文件原始内容中的换行去掉，使得打印日志时紧凑一些
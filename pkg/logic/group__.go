@@ -74,6 +74,7 @@ type IGroupObserver interface {
 	OnHlsMakeTs(info base.HlsMakeTsInfo)
 	OnRelayPullStart(info base.PullStartInfo) // TODO(chef): refactor me
 	OnRelayPullStop(info base.PullStopInfo)
+	OnPsPubStop(info base.PubStopInfo) // 只在gb28181回放、下载结束时回调
 }
 
 type Group struct {
@@ -98,6 +99,8 @@ type Group struct {
 	rtsp2RtmpRemuxer    *remux.AvPacket2RtmpRemuxer // TODO(chef): [refactor] 重命名为avPacket2RtmpRemuxer，因为除了rtsp，customize pub和gb28181 pub都是 202208
 	rtmp2RtspRemuxer    *remux.Rtmp2RtspRemuxer
 	rtmp2MpegtsRemuxer  *remux.Rtmp2MpegtsRemuxer
+	// gb28181 talk使用
+	rtmp2AvPacketRemuxer *remux.Rtmp2AvPacketRemuxer
 	// pull
 	pullProxy *pullProxy
 	// rtmp pub使用 TODO(chef): [doc] 更新这个注释，是共同使用 202210
@@ -105,12 +108,17 @@ type Group struct {
 	// ps pub使用
 	psPubTimeoutSec            uint32 // 超时时间
 	psPubPrevInactiveCheckTick int64  // 上次检查时间
+	psPubStopReason            string // 回放、下载结束的原因，见 base.PubStopReasonPlaybackFinished 等
 	// rtmp sub使用
 	rtmpGopCache *remux.GopCache
 	// httpflv sub使用
 	httpflvGopCache *remux.GopCache
 	// httpts sub使用
 	httptsGopCache *remux.GopCacheMpegts
+	// enhanced-rtmp multitrack使用，见 group__multitrack.go
+	hasMultitrack             bool
+	rtmpGopCacheMultitrack    *remux.GopCache
+	httpflvGopCacheMultitrack *remux.GopCache
 	// rtsp使用
 	sdpCtx *sdp.LogicContext
 	// mpegts使用
@@ -122,14 +130,19 @@ type Group struct {
 	rtspSubSessionSet     map[*rtsp.SubSession]struct{} // 注意，使用这个容器时，一定要注意是否需要使用 waitRtspSubSessionSet
 	waitRtspSubSessionSet map[*rtsp.SubSession]struct{} // 注意，见 rtspSubSessionSet
 	hlsSubSessionSet      map[*hls.SubSession]struct{}
+	// gb28181 talk
+	psTalkSessionSet map[*gb28181.TalkSession]struct{}
 	// push
 	pushEnable    bool
 	url2PushProxy map[string]*pushProxy
 	// hls
 	hlsMuxer *hls.Muxer
 	// record
-	recordFlv    *httpflv.FlvFileWriter
-	recordMpegts *mpegts.FileWriter
+	recordFlv        *httpflv.FlvFileWriter
+	recordFlvAppend  bool  // 追加到已有的录制文件，需要修改时间戳，见 startRecordFlvIfNeeded
+	recordFlvBaseTs  int64 // 追加时，第一个消息在文件中的时间戳
+	recordFlvFirstTs int64 // 追加时，第一个消息的原始时间戳，-1表示还没收到
+	recordMpegts     *mpegts.FileWriter
 	// rtmp sub使用
 	rtmpMergeWriter *base.MergeWriter // TODO(chef): 后面可以在业务层加一个定时Flush
 	//
@@ -162,6 +175,7 @@ func NewGroup(appName string, streamName string, config *Config, option GroupOpt
 		rtspSubSessionSet:          make(map[*rtsp.SubSession]struct{}),
 		waitRtspSubSessionSet:      make(map[*rtsp.SubSession]struct{}),
 		hlsSubSessionSet:           make(map[*hls.SubSession]struct{}),
+		psTalkSessionSet:           make(map[*gb28181.TalkSession]struct{}),
 		rtmpGopCache:               remux.NewGopCache("rtmp", uk, config.RtmpConfig.GopNum, config.RtmpConfig.SingleGopMaxFrameNum),
 		httpflvGopCache:            remux.NewGopCache("httpflv", uk, config.HttpflvConfig.GopNum, config.HttpflvConfig.SingleGopMaxFrameNum),
 		httptsGopCache:             remux.NewGopCacheMpegts(uk, config.HttptsConfig.GopNum, config.HttptsConfig.SingleGopMaxFrameNum),
@@ -176,8 +190,9 @@ func NewGroup(appName string, streamName string, config *Config, option GroupOpt
 	g.initRelayPushByConfig()
 	g.initRelayPullByConfig()
 
-	if config.RtmpConfig.MergeWriteSize > 0 {
-		g.rtmpMergeWriter = base.NewMergeWriter(g.writev2RtmpSubSessions, config.RtmpConfig.MergeWriteSize)
+	// 开启发送队列时，由发送队列按帧处理，不再合并发送
+	if config.RtmpConfig.MergeWriteSize > 0 && !config.SubSessionSendQueueConfig.Enable {
+		g.rtmpMergeWriter = base.NewMergeWriterRef(g.writev2RtmpSubSessions, config.RtmpConfig.MergeWriteSize)
 	}
 
 	Log.Infof("[%s] lifecycle new group. group=%p, appName=%s, streamName=%s", uk, g, appName, streamName)
@@ -257,6 +272,11 @@ func (group *Group) Dispose() {
 	}
 	group.httptsSubSessionSet = nil
 
+	for session := range group.psTalkSessionSet {
+		session.Dispose()
+	}
+	group.psTalkSessionSet = nil
+
 	group.delIn()
 }
 
@@ -329,6 +349,13 @@ func (group *Group) GetStat(maxsub int) base.StatGroup {
 		}
 		group.stat.StatSubs = append(group.stat.StatSubs, base.Session2StatSub(s))
 	}
+	for s := range group.psTalkSessionSet {
+		statSubCount++
+		if statSubCount > maxsub {
+			break
+		}
+		group.stat.StatSubs = append(group.stat.StatSubs, base.Session2StatSub(s))
+	}
 
 	return group.stat
 }
@@ -390,6 +417,13 @@ func (group *Group) KickSession(sessionId string) bool {
 				return true
 			}
 		}
+	} else if strings.HasPrefix(sessionId, base.UkPrePsPushSession) {
+		for s := range group.psTalkSessionSet {
+			if s.UniqueKey() == sessionId {
+				s.Dispose()
+				return true
+			}
+		}
 	} else {
 		Log.Errorf("[%s] kick session while session id format invalid. %s", group.UniqueKey, sessionId)
 	}
@@ -429,14 +463,20 @@ func (group *Group) OutSessionNum() int {
 		}
 	}
 	return len(group.rtmpSubSessionSet) + len(group.rtspSubSessionSet) + len(group.waitRtspSubSessionSet) +
-		len(group.httpflvSubSessionSet) + len(group.httptsSubSessionSet) + pushNum
+		len(group.httpflvSubSessionSet) + len(group.httptsSubSessionSet) + len(group.psTalkSessionSet) + pushNum
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
 // disposeInactiveSessions 关闭不活跃的session
 func (group *Group) disposeInactiveSessions(tickCount uint32) {
-	if group.psPubSession != nil {
+	if group.psPubSession != nil && group.psPubSession.IsPlaybackFinished() && group.psPubStopReason == "" {
+		Log.Infof("[%s] playback finished. session=%s", group.UniqueKey, group.psPubSession.UniqueKey())
+		group.psPubStopReason = base.PubStopReasonPlaybackFinished
+		group.psPubSession.Dispose()
+	}
+
+	if group.psPubSession != nil && !group.psPubSession.IsPaused() {
 		if group.psPubTimeoutSec == 0 {
 			// noop
 			// 没有超时逻辑
@@ -446,6 +486,9 @@ func (group *Group) disposeInactiveSessions(tickCount uint32) {
 
 				if readAlive, _ := group.psPubSession.IsAlive(); !readAlive {
 					Log.Warnf("[%s] session timeout. session=%s", group.UniqueKey, group.psPubSession.UniqueKey())
+					if group.psPubStopReason == "" {
+						group.psPubStopReason = base.PubStopReasonTimeout
+					}
 					group.psPubSession.Dispose()
 				}
 
@@ -505,6 +548,12 @@ func (group *Group) disposeInactiveSessions(tickCount uint32) {
 			session.Dispose()
 		}
 	}
+	for session := range group.psTalkSessionSet {
+		if _, writeAlive := session.IsAlive(); !writeAlive {
+			Log.Warnf("[%s] session timeout. session=%s", group.UniqueKey, session.UniqueKey())
+			session.Dispose()
+		}
+	}
 	for _, item := range group.url2PushProxy {
 		session := item.pushSession
 		if item.isPushing && session != nil {
@@ -516,6 +565,28 @@ func (group *Group) disposeInactiveSessions(tickCount uint32) {
 	}
 }
 
+// disposeAllOutSessions 关闭所有sub、talk session，这些session会各自走从group中删除的流程
+func (group *Group) disposeAllOutSessions() {
+	for session := range group.rtmpSubSessionSet {
+		session.Dispose()
+	}
+	for session := range group.rtspSubSessionSet {
+		session.Dispose()
+	}
+	for session := range group.waitRtspSubSessionSet {
+		session.Dispose()
+	}
+	for session := range group.httpflvSubSessionSet {
+		session.Dispose()
+	}
+	for session := range group.httptsSubSessionSet {
+		session.Dispose()
+	}
+	for session := range group.psTalkSessionSet {
+		session.Dispose()
+	}
+}
+
 // updateAllSessionStat 更新所有session的状态
 func (group *Group) updateAllSessionStat() {
 	if group.rtmpPubSession != nil {
@@ -545,6 +616,9 @@ func (group *Group) updateAllSessionStat() {
 	for session := range group.waitRtspSubSessionSet {
 		session.UpdateStat(calcSessionStatIntervalSec)
 	}
+	for session := range group.psTalkSessionSet {
+		session.UpdateStat(calcSessionStatIntervalSec)
+	}
 	for _, item := range group.url2PushProxy {
 		session := item.pushSession
 		if item.isPushing && session != nil {
@@ -564,7 +638,8 @@ func (group *Group) hasSubSession() bool {
 		len(group.httptsSubSessionSet) != 0 ||
 		len(group.rtspSubSessionSet) != 0 ||
 		len(group.waitRtspSubSessionSet) != 0 ||
-		len(group.hlsSubSessionSet) != 0
+		len(group.hlsSubSessionSet) != 0 ||
+		len(group.psTalkSessionSet) != 0
 }
 
 func (group *Group) hasPushSession() bool {
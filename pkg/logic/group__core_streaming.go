@@ -9,19 +9,19 @@
 package logic
 
 import (
-	"net"
-
 	"github.com/ysjhlnu/lal/pkg/rtmp"
 	"github.com/q191201771/naza/pkg/nazalog"
 
 	"github.com/ysjhlnu/lal/pkg/mpegts"
 
+	"github.com/ysjhlnu/lal/pkg/av1"
 	"github.com/ysjhlnu/lal/pkg/avc"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/hevc"
 	"github.com/ysjhlnu/lal/pkg/remux"
 	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 	"github.com/ysjhlnu/lal/pkg/sdp"
+	"github.com/ysjhlnu/lal/pkg/vp9"
 )
 
 // group__streaming.go
@@ -87,6 +87,43 @@ func (group *Group) OnAvPacket(pkt base.AvPacket) {
 	}
 }
 
+// OnTrackRtpPacket OnTrackAvPacket OnOnvifMetadata
+//
+// 输入rtsp中主音频、主视频之外的其他track，比如第二路音频、ONVIF元数据.
+// 来自 rtsp.PubSession 的回调，见 rtsp.IBaseInSessionTrackObserver.
+func (group *Group) OnTrackRtpPacket(track sdp.TrackContext, pkt rtprtcp.RtpPacket) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	// rtsp sub session可以通过SETUP这些track获取数据
+	for s := range group.rtspSubSessionSet {
+		if group.config.RtspConfig.OutWaitKeyFrameFlag && s.ShouldWaitVideoKeyFrame {
+			continue
+		}
+		s.WriteTrackRtpPacket(track.Index, pkt)
+	}
+}
+
+// OnTrackAvPacket ...
+func (group *Group) OnTrackAvPacket(track sdp.TrackContext, pkt base.AvPacket) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if hook, ok := group.customizeHookSessionContext.(ICustomizeHookSessionTrackContext); ok {
+		hook.OnTrackAvPacket(track, pkt)
+	}
+}
+
+// OnOnvifMetadata ...
+func (group *Group) OnOnvifMetadata(track sdp.TrackContext, b []byte) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if hook, ok := group.customizeHookSessionContext.(ICustomizeHookSessionTrackContext); ok {
+		hook.OnOnvifMetadata(track, b)
+	}
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // OnAvPacketFromPsPubSession
@@ -160,6 +197,16 @@ func (group *Group) onRtpPacketFromRemux(pkt rtprtcp.RtpPacket) {
 	group.feedRtpPacket(pkt)
 }
 
+// onTrackRtpPacketFromRemux enhanced-rtmp multitrack中的非默认track
+func (group *Group) onTrackRtpPacketFromRemux(trackIndex int, pkt rtprtcp.RtpPacket) {
+	for s := range group.rtspSubSessionSet {
+		if group.config.RtspConfig.OutWaitKeyFrameFlag && s.ShouldWaitVideoKeyFrame {
+			continue
+		}
+		s.WriteTrackRtpPacket(trackIndex, pkt)
+	}
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // OnFragmentOpen
@@ -188,6 +235,20 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 		nazalog.Debugf("[%s] metadata. err=%+v, len=%d, value=%s", group.UniqueKey, err, len(m), m.DebugString())
 	}
 
+	// # enhanced-rtmp multitrack
+	// 支持multitrack的sub session以及rtsp使用原始消息，其他输出只使用默认track
+	originMsg := msg
+	group.broadcastMultitrack(msg)
+	if msg.IsMultitrack() {
+		var ok bool
+		if msg, ok = msg.DefaultTrackMsg(); !ok {
+			if group.rtmp2RtspRemuxer != nil {
+				group.rtmp2RtspRemuxer.FeedRtmpMsg(originMsg)
+			}
+			return
+		}
+	}
+
 	var (
 		lazyRtmpChunkDivider remux.LazyRtmpChunkDivider
 		lazyRtmpMsg2FlvTag   remux.LazyRtmpMsg2FlvTag
@@ -196,6 +257,9 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 	// 设置好用于发送的 rtmp 头部信息
 	lazyRtmpChunkDivider.Init(msg)
 	lazyRtmpMsg2FlvTag.Init(msg)
+	// 需要继续持有内存块的一方（gop缓存、merge writer、发送队列等）自己持有引用，这里只释放本次广播的引用
+	defer lazyRtmpChunkDivider.Release()
+	defer lazyRtmpMsg2FlvTag.Release()
 
 	// # 数据有效性检查
 	if len(msg.Payload) == 0 {
@@ -235,7 +299,16 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 
 	// # rtsp
 	if group.rtmp2RtspRemuxer != nil {
-		group.rtmp2RtspRemuxer.FeedRtmpMsg(msg)
+		group.rtmp2RtspRemuxer.FeedRtmpMsg(originMsg)
+	}
+
+	// # gb28181 talk
+	// 注意，音频头总是需要喂入，否则对讲开始后无法生成adts头
+	if group.rtmp2AvPacketRemuxer != nil && msg.Header.MsgTypeId == base.RtmpTypeIdAudio &&
+		(len(group.psTalkSessionSet) != 0 || msg.IsAacSeqHeader()) {
+		if err := group.rtmp2AvPacketRemuxer.FeedRtmpMsg(msg, nil); err != nil {
+			Log.Warnf("[%s] feed rtmp msg to talk remuxer failed. err=%+v", group.UniqueKey, err)
+		}
 	}
 
 	if group.customizeHookSessionContext != nil {
@@ -245,19 +318,22 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 	// # 广播。遍历所有 rtmp sub session，转发数据
 	// ## 如果是新的 sub session，发送已缓存的信息
 	for session := range group.rtmpSubSessionSet {
+		if group.isMultitrackRtmpSubSession(session) {
+			continue
+		}
 		if session.IsFresh {
 			// TODO chef: 头信息和full gop也可以在SubSession刚加入时发送
 			if group.rtmpGopCache.MetadataEnsureWithoutSetDataFrame != nil {
 				Log.Debugf("[%s] [%s] write metadata", group.UniqueKey, session.UniqueKey())
-				_ = session.Write(group.rtmpGopCache.MetadataEnsureWithoutSetDataFrame)
+				_ = session.WriteRefBuffer(group.rtmpGopCache.MetadataEnsureWithoutSetDataFrameRef(), base.SendItemTypeOther)
 			}
 			if group.rtmpGopCache.VideoSeqHeader != nil {
 				Log.Debugf("[%s] [%s] write vsh", group.UniqueKey, session.UniqueKey())
-				_ = session.Write(group.rtmpGopCache.VideoSeqHeader)
+				_ = session.WriteRefBuffer(group.rtmpGopCache.VideoSeqHeaderRef(), base.SendItemTypeOther)
 			}
 			if group.rtmpGopCache.AacSeqHeader != nil {
 				Log.Debugf("[%s] [%s] write ash", group.UniqueKey, session.UniqueKey())
-				_ = session.Write(group.rtmpGopCache.AacSeqHeader)
+				_ = session.WriteRefBuffer(group.rtmpGopCache.AacSeqHeaderRef(), base.SendItemTypeOther)
 			}
 			gopCount := group.rtmpGopCache.GetGopCount()
 			if gopCount > 0 {
@@ -267,8 +343,9 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 				Log.Debugf("[%s] [%s] write gop cache. gop num=%d", group.UniqueKey, session.UniqueKey(), gopCount)
 			}
 			for i := 0; i < gopCount; i++ {
-				for _, item := range group.rtmpGopCache.GetGopDataAt(i) {
-					_ = session.Write(item)
+				types := group.rtmpGopCache.GetGopSendItemTypesAt(i)
+				for j, item := range group.rtmpGopCache.GetGopDataRefAt(i) {
+					_ = session.WriteRefBuffer(item, types[j])
 				}
 			}
 
@@ -295,11 +372,12 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 	} // for loop iterate rtmpSubSessionSet
 
 	// ## 转发本次数据
+	sendItemType := base.SendItemTypeOfRtmpMsg(msg)
 	if len(group.rtmpSubSessionSet) > 0 {
 		if group.rtmpMergeWriter == nil {
-			group.write2RtmpSubSessions(lazyRtmpChunkDivider.GetEnsureWithoutSdf())
+			group.write2RtmpSubSessions(lazyRtmpChunkDivider.GetEnsureWithoutSdfRef(), sendItemType)
 		} else {
-			group.rtmpMergeWriter.Write(lazyRtmpChunkDivider.GetEnsureWithoutSdf())
+			group.rtmpMergeWriter.WriteRef(lazyRtmpChunkDivider.GetEnsureWithoutSdfRef(), sendItemType)
 		}
 	}
 
@@ -310,40 +388,44 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 				continue
 			}
 
-			if v.pushSession.IsFresh {
+			// 服务端要求重连后重新publish成功，和新的session一样处理
+			if v.pushSession.IsFresh || v.pushSession.Republished() {
 				if group.rtmpGopCache.MetadataEnsureWithSetDataFrame != nil {
-					_ = v.pushSession.Write(group.rtmpGopCache.MetadataEnsureWithSetDataFrame)
+					_ = v.pushSession.WriteRefBuffer(group.rtmpGopCache.MetadataEnsureWithSetDataFrameRef())
 				}
 				if group.rtmpGopCache.VideoSeqHeader != nil {
-					_ = v.pushSession.Write(group.rtmpGopCache.VideoSeqHeader)
+					_ = v.pushSession.WriteRefBuffer(group.rtmpGopCache.VideoSeqHeaderRef())
 				}
 				if group.rtmpGopCache.AacSeqHeader != nil {
-					_ = v.pushSession.Write(group.rtmpGopCache.AacSeqHeader)
+					_ = v.pushSession.WriteRefBuffer(group.rtmpGopCache.AacSeqHeaderRef())
 				}
 				for i := 0; i < group.rtmpGopCache.GetGopCount(); i++ {
-					for _, item := range group.rtmpGopCache.GetGopDataAt(i) {
-						_ = v.pushSession.Write(item)
+					for _, item := range group.rtmpGopCache.GetGopDataRefAt(i) {
+						_ = v.pushSession.WriteRefBuffer(item)
 					}
 				}
 
 				v.pushSession.IsFresh = false
 			}
 
-			_ = v.pushSession.Write(lazyRtmpChunkDivider.GetEnsureWithSdf())
+			_ = v.pushSession.WriteRefBuffer(lazyRtmpChunkDivider.GetEnsureWithSdfRef())
 		}
 	}
 
 	// # 广播。遍历所有 httpflv sub session，转发数据
 	for session := range group.httpflvSubSessionSet {
+		if group.isMultitrackHttpflvSubSession(session) {
+			continue
+		}
 		if session.IsFresh {
 			if group.httpflvGopCache.MetadataEnsureWithoutSetDataFrame != nil {
-				session.Write(group.httpflvGopCache.MetadataEnsureWithoutSetDataFrame)
+				session.WriteRefBuffer(group.httpflvGopCache.MetadataEnsureWithoutSetDataFrameRef(), base.SendItemTypeOther)
 			}
 			if group.httpflvGopCache.VideoSeqHeader != nil {
-				session.Write(group.httpflvGopCache.VideoSeqHeader)
+				session.WriteRefBuffer(group.httpflvGopCache.VideoSeqHeaderRef(), base.SendItemTypeOther)
 			}
 			if group.httpflvGopCache.AacSeqHeader != nil {
-				session.Write(group.httpflvGopCache.AacSeqHeader)
+				session.WriteRefBuffer(group.httpflvGopCache.AacSeqHeaderRef(), base.SendItemTypeOther)
 			}
 			gopCount := group.httpflvGopCache.GetGopCount()
 			if gopCount > 0 {
@@ -351,8 +433,9 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 				session.ShouldWaitVideoKeyFrame = false
 			}
 			for i := 0; i < gopCount; i++ {
-				for _, item := range group.httpflvGopCache.GetGopDataAt(i) {
-					session.Write(item)
+				types := group.httpflvGopCache.GetGopSendItemTypesAt(i)
+				for j, item := range group.httpflvGopCache.GetGopDataRefAt(i) {
+					session.WriteRefBuffer(item, types[j])
 				}
 			}
 
@@ -362,37 +445,35 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 		// 是否在等待关键帧
 		if session.ShouldWaitVideoKeyFrame {
 			if msg.IsVideoKeyNalu() {
-				session.Write(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf())
+				session.WriteRefBuffer(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), sendItemType)
 				session.ShouldWaitVideoKeyFrame = false
 			}
 		} else {
-			session.Write(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf())
+			session.WriteRefBuffer(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), sendItemType)
 		}
 	}
 
 	// # 录制flv文件
 	if group.recordFlv != nil {
-		if err := group.recordFlv.WriteRaw(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf()); err != nil {
-			Log.Errorf("[%s] record flv write error. err=%+v", group.UniqueKey, err)
-		}
+		group.writeRecordFlv(msg, lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf())
 	}
 
 	// # 缓存关键信息，以及gop
 	if group.config.RtmpConfig.Enable || group.config.RtmpConfig.RtmpsEnable {
-		if !group.rtmpGopCache.Feed(msg, lazyRtmpChunkDivider.GetEnsureWithoutSdf()) {
+		if !group.rtmpGopCache.FeedRef(msg, lazyRtmpChunkDivider.GetEnsureWithoutSdfRef()) {
 			Log.Warnf("[%s] over frame number limit for a single gop in rtmp cache.", group.UniqueKey)
 		}
 		if msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
-			group.rtmpGopCache.SetMetadata(lazyRtmpChunkDivider.GetEnsureWithSdf(), lazyRtmpChunkDivider.GetEnsureWithoutSdf())
+			group.rtmpGopCache.SetMetadataRef(lazyRtmpChunkDivider.GetEnsureWithSdfRef(), lazyRtmpChunkDivider.GetEnsureWithoutSdfRef())
 		}
 	}
 	if group.config.HttpflvConfig.Enable {
-		if !group.httpflvGopCache.Feed(msg, lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf()) {
+		if !group.httpflvGopCache.FeedRef(msg, lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef()) {
 			Log.Warnf("[%s] over frame number limit for a single gop in http flv cache.", group.UniqueKey)
 		}
 		if msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
 			// 注意，因为withSdf实际上用不上，而且我们也没实现，所以全部用without了
-			group.httpflvGopCache.SetMetadata(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf(), lazyRtmpMsg2FlvTag.GetEnsureWithoutSdf())
+			group.httpflvGopCache.SetMetadataRef(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef())
 		}
 	}
 
@@ -408,6 +489,14 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 				group.stat.AudioCodec = base.AudioCodecG711U
 			case base.RtmpSoundFormatG711A:
 				group.stat.AudioCodec = base.AudioCodecG711A
+			case base.RtmpSoundFormatOpus:
+				group.stat.AudioCodec = base.AudioCodecOpus
+			case base.RtmpSoundFormatFlac:
+				group.stat.AudioCodec = base.AudioCodecFlac
+			case base.RtmpSoundFormatAc3:
+				group.stat.AudioCodec = base.AudioCodecAc3
+			case base.RtmpSoundFormatEac3:
+				group.stat.AudioCodec = base.AudioCodecEac3
 			}
 		}
 	}
@@ -418,6 +507,12 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 		if msg.IsHevcKeySeqHeader() {
 			group.stat.VideoCodec = base.VideoCodecHevc
 		}
+		if msg.IsAv1KeySeqHeader() {
+			group.stat.VideoCodec = base.VideoCodecAv1
+		}
+		if msg.IsVp9KeySeqHeader() {
+			group.stat.VideoCodec = base.VideoCodecVp9
+		}
 	}
 	if group.stat.VideoHeight == 0 || group.stat.VideoWidth == 0 {
 		if msg.IsAvcKeySeqHeader() {
@@ -449,6 +544,21 @@ func (group *Group) broadcastByRtmpMsg(msg base.RtmpMsg) {
 				}
 			}
 		}
+		if msg.IsAv1KeySeqHeader() {
+			var ctx av1.Context
+			if err := av1.ParseContextFromSeqHeader(msg.Payload, &ctx); err == nil {
+				group.stat.VideoHeight = int(ctx.Height)
+				group.stat.VideoWidth = int(ctx.Width)
+			}
+		}
+		// vpcC中没有宽高，从关键帧中获取
+		if msg.IsVp9KeyFrame() {
+			var h vp9.FrameHeader
+			if err := vp9.ParseFrameHeader(msg.Payload[5:], &h); err == nil {
+				group.stat.VideoHeight = int(h.Height)
+				group.stat.VideoWidth = int(h.Width)
+			}
+		}
 	}
 }
 
@@ -485,6 +595,10 @@ func (group *Group) feedRtpPacket(pkt rtprtcp.RtpPacket) {
 				boundary = rtprtcp.IsAvcBoundary(pkt)
 			case base.AvPacketPtHevc:
 				boundary = rtprtcp.IsHevcBoundary(pkt)
+			case base.AvPacketPtAv1:
+				boundary = rtprtcp.IsAv1Boundary(pkt)
+			case base.AvPacketPtVp9:
+				boundary = rtprtcp.IsVp9Boundary(pkt)
 			default:
 				// 注意，不是avc和hevc时，直接发送
 				boundary = true
@@ -508,6 +622,7 @@ func (group *Group) feedTsPackets(tsPackets []byte, frame *mpegts.Frame, boundar
 	}
 
 	// # 遍历 httpts sub session
+	sendItemType := sendItemTypeOfTsFrame(frame)
 	for session := range group.httptsSubSessionSet {
 		if session.IsFresh {
 			// ## 如果是新加入者
@@ -534,14 +649,14 @@ func (group *Group) feedTsPackets(tsPackets []byte, frame *mpegts.Frame, boundar
 		// ## 转发本次数据
 		if session.ShouldWaitBoundary {
 			if boundary {
-				session.Write(tsPackets)
+				session.WriteFrame(tsPackets, sendItemType)
 
 				session.ShouldWaitBoundary = false
 			} else {
 				// 需要继续等
 			}
 		} else {
-			session.Write(tsPackets)
+			session.WriteFrame(tsPackets, sendItemType)
 		}
 	} // for loop iterate httptsSubSessionSet
 
@@ -556,21 +671,35 @@ func (group *Group) feedTsPackets(tsPackets []byte, frame *mpegts.Frame, boundar
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (group *Group) write2RtmpSubSessions(b []byte) {
+func (group *Group) write2RtmpSubSessions(rb *base.RefBuffer, typ base.SendItemType) {
 	for session := range group.rtmpSubSessionSet {
-		if session.IsFresh || session.ShouldWaitVideoKeyFrame {
+		if session.IsFresh || session.ShouldWaitVideoKeyFrame || group.isMultitrackRtmpSubSession(session) {
 			continue
 		}
-		_ = session.Write(b)
+		_ = session.WriteRefBuffer(rb, typ)
+	}
+}
+
+// sendItemTypeOfTsFrame 获取ts帧在发送队列中的类型
+func sendItemTypeOfTsFrame(frame *mpegts.Frame) base.SendItemType {
+	if frame == nil {
+		return base.SendItemTypeOther
+	}
+	if frame.Pid == mpegts.PidAudio {
+		return base.SendItemTypeAudio
+	}
+	if frame.Key {
+		return base.SendItemTypeVideoKey
 	}
+	return base.SendItemTypeVideoNonKey
 }
 
-func (group *Group) writev2RtmpSubSessions(bs net.Buffers) {
+func (group *Group) writev2RtmpSubSessions(rbs []*base.RefBuffer, typ base.SendItemType) {
 	for session := range group.rtmpSubSessionSet {
-		if session.IsFresh || session.ShouldWaitVideoKeyFrame {
+		if session.IsFresh || session.ShouldWaitVideoKeyFrame || group.isMultitrackRtmpSubSession(session) {
 			continue
 		}
-		_ = session.Writev(bs)
+		_ = session.WriteRefBuffers(rbs, typ)
 	}
 }
 
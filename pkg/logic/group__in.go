@@ -38,7 +38,7 @@ func (group *Group) AddCustomizePubSession(streamName string) (ICustomizePubSess
 		group.rtmp2RtspRemuxer = remux.NewRtmp2RtspRemuxer(
 			group.onSdpFromRemux,
 			group.onRtpPacketFromRemux,
-		)
+		).WithOnTrackRtpPacket(group.onTrackRtpPacketFromRemux)
 	}
 
 	group.customizePubSession.WithOnRtmpMsg(group.OnReadRtmpAvMsg)
@@ -65,7 +65,7 @@ func (group *Group) AddRtmpPubSession(session *rtmp.ServerSession) error {
 		group.rtmp2RtspRemuxer = remux.NewRtmp2RtspRemuxer(
 			group.onSdpFromRemux,
 			group.onRtpPacketFromRemux,
-		)
+		).WithOnTrackRtpPacket(group.onTrackRtpPacketFromRemux)
 	}
 
 	session.SetPubSessionObserver(group)
@@ -110,6 +110,23 @@ func (group *Group) StartRtpPub(req base.ApiCtrlStartRtpPubReq) (ret base.ApiCtr
 	}
 
 	pubSession := gb28181.NewPubSession().WithStreamName(req.StreamName).WithOnAvPacket(group.OnAvPacketFromPsPubSession)
+	pubSession.WithUnpackerOption(func(option *gb28181.PsUnpackerOption) {
+		option.JitterBufferMs = req.JitterBufferMs
+	})
+	switch req.RtcpMode {
+	case base.RtcpModePortPlusOne:
+		pubSession.WithRtcp(false)
+	case base.RtcpModeMux:
+		pubSession.WithRtcp(true)
+	}
+	if req.Sdp != "" {
+		sdpInfo, err := gb28181.ParseInviteSdp([]byte(req.Sdp))
+		if err != nil {
+			Log.Warnf("[%s] parse invite sdp failed. err=%+v", group.UniqueKey, err)
+		} else if sdpInfo.IsPlayback() {
+			pubSession.WithPlayback(sdpInfo.DurationMs())
+		}
+	}
 	pubSession.WithHookReadPacket(func(b []byte) {
 		if group.psPubDumpFile != nil {
 			group.psPubDumpFile.WriteWithType(b, base.DumpTypePsRtpData)
@@ -120,6 +137,7 @@ func (group *Group) StartRtpPub(req base.ApiCtrlStartRtpPubReq) (ret base.ApiCtr
 
 	group.psPubSession = pubSession
 	group.psPubTimeoutSec = uint32(req.TimeoutMs / 1000)
+	group.psPubStopReason = ""
 	group.addIn()
 
 	group.rtsp2RtmpRemuxer = remux.NewAvPacket2RtmpRemuxer()
@@ -133,7 +151,7 @@ func (group *Group) StartRtpPub(req base.ApiCtrlStartRtpPubReq) (ret base.ApiCtr
 		group.rtmp2RtspRemuxer = remux.NewRtmp2RtspRemuxer(
 			group.onSdpFromRemux,
 			group.onRtpPacketFromRemux,
-		)
+		).WithOnTrackRtpPacket(group.onTrackRtpPacketFromRemux)
 	}
 
 	port, err := pubSession.Listen(req.Port, req.IsTcpFlag != 0)
@@ -177,7 +195,7 @@ func (group *Group) AddRtmpPullSession(session *rtmp.PullSession) error {
 		group.rtmp2RtspRemuxer = remux.NewRtmp2RtspRemuxer(
 			group.onSdpFromRemux,
 			group.onRtpPacketFromRemux,
-		)
+		).WithOnTrackRtpPacket(group.onTrackRtpPacketFromRemux)
 	}
 
 	var info base.PullStartInfo
@@ -231,7 +249,46 @@ func (group *Group) AddRtspPullSession(session *rtsp.PullSession) error {
 func (group *Group) DelPsPubSession(session *gb28181.PubSession) {
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
+
+	isCurr := session == group.psPubSession
 	group.delPsPubSession(session)
+
+	// 注意，ps pub只在回放、下载时回调on_pub_stop，实时流保持原有行为，不回调
+	if !isCurr || !session.IsPlayback() {
+		return
+	}
+
+	// 提前结束（比如连接断开、超时）也认为回放、下载已经结束
+	reason := group.psPubStopReason
+	if reason == "" {
+		reason = base.PubStopReasonClosed
+	}
+	Log.Infof("[%s] playback stop. session=%s, reason=%s", group.UniqueKey, session.UniqueKey(), reason)
+
+	info := base.Session2PubStopInfo(session)
+	info.HasInSession = group.hasInSession()
+	info.HasOutSession = group.hasOutSession()
+	info.Reason = reason
+	group.observer.OnPsPubStop(info)
+
+	// 回放、下载结束后，流不会再有数据，关闭所有拉流，使得group被释放
+	group.disposeAllOutSessions()
+}
+
+// HandleMansRtsp gb28181回放控制
+//
+// @return 如果group中没有ps pub session，返回false
+func (group *Group) HandleMansRtsp(msg gb28181.MansRtspMsg) bool {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	if group.psPubSession == nil {
+		return false
+	}
+	if err := group.psPubSession.HandleMansRtsp(msg); err != nil {
+		Log.Warnf("[%s] handle mansrtsp failed. err=%+v", group.UniqueKey, err)
+	}
+	return true
 }
 
 func (group *Group) DelCustomizePubSession(sessionCtx ICustomizePubSessionContext) {
@@ -357,6 +414,8 @@ func (group *Group) addIn() {
 		nazalog.Debugf("[%s] [%s] NewRtmp2MpegtsRemuxer in group.", group.UniqueKey, group.rtmp2MpegtsRemuxer.UniqueKey())
 	}
 
+	group.rtmp2AvPacketRemuxer = remux.NewRtmp2AvPacketRemuxer().WithOnAvPacket(group.onAvPacketFromRtmp2AvPacketRemuxer)
+
 	if group.config.InSessionConfig.AddDummyAudioEnable {
 		group.dummyAudioFilter = remux.NewDummyAudioFilter(group.UniqueKey, group.config.InSessionConfig.AddDummyAudioWaitAudioMs, group.broadcastByRtmpMsg)
 	}
@@ -395,6 +454,7 @@ func (group *Group) delIn() {
 	group.psPubSession = nil
 	group.rtsp2RtmpRemuxer = nil
 	group.rtmp2RtspRemuxer = nil
+	group.rtmp2AvPacketRemuxer = nil
 	group.dummyAudioFilter = nil
 
 	if group.psPubDumpFile != nil {
@@ -404,6 +464,7 @@ func (group *Group) delIn() {
 	group.rtmpGopCache.Clear()
 	group.httpflvGopCache.Clear()
 	group.httptsGopCache.Clear()
+	group.stopMultitrack()
 	group.sdpCtx = nil
 	group.patpmt = nil
 }
@@ -0,0 +1,202 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/remux"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+// enhanced-rtmp multitrack
+//
+// 收到第一个multitrack消息之前，所有输出使用相同的数据。
+// 收到第一个multitrack消息之后:
+//   - 支持multitrack的rtmp sub session和httpflv sub session，从这里接收原始消息（包含所有track）
+//   - rtsp由 remux.Rtmp2RtspRemuxer 将非默认track转换为sdp中单独的track
+//   - 其他输出（hls、mpegts、relay push、录制、不支持multitrack的sub session等）只接收默认track，见 base.RtmpMsg.DefaultTrackMsg
+
+// broadcastMultitrack 转发给支持multitrack的sub session，以及缓存
+//
+// @param msg: 原始消息，可能是也可能不是multitrack消息
+func (group *Group) broadcastMultitrack(msg base.RtmpMsg) {
+	if !group.hasMultitrack {
+		if !msg.IsMultitrack() {
+			return
+		}
+		group.startMultitrack()
+	}
+
+	if msg.IsMultitrack() {
+		group.updateMultitrackStat(msg)
+	}
+
+	var (
+		lazyRtmpChunkDivider remux.LazyRtmpChunkDivider
+		lazyRtmpMsg2FlvTag   remux.LazyRtmpMsg2FlvTag
+	)
+	lazyRtmpChunkDivider.Init(msg)
+	lazyRtmpMsg2FlvTag.Init(msg)
+	defer lazyRtmpChunkDivider.Release()
+	defer lazyRtmpMsg2FlvTag.Release()
+	sendItemType := base.SendItemTypeOfRtmpMsg(msg)
+
+	for session := range group.rtmpSubSessionSet {
+		if !session.SupportMultitrack() {
+			continue
+		}
+		if session.IsFresh {
+			if writeMultitrackGopCache(group.rtmpGopCacheMultitrack, func(rb *base.RefBuffer, typ base.SendItemType) {
+				_ = session.WriteRefBuffer(rb, typ)
+			}) {
+				session.ShouldWaitVideoKeyFrame = false
+			}
+			session.IsFresh = false
+		}
+		if session.ShouldWaitVideoKeyFrame {
+			if !msg.IsVideoKeyNalu() {
+				continue
+			}
+			session.ShouldWaitVideoKeyFrame = false
+		}
+		_ = session.WriteRefBuffer(lazyRtmpChunkDivider.GetEnsureWithoutSdfRef(), sendItemType)
+	}
+
+	for session := range group.httpflvSubSessionSet {
+		if !session.SupportMultitrack() {
+			continue
+		}
+		if session.IsFresh {
+			if writeMultitrackGopCache(group.httpflvGopCacheMultitrack, func(rb *base.RefBuffer, typ base.SendItemType) {
+				session.WriteRefBuffer(rb, typ)
+			}) {
+				session.ShouldWaitVideoKeyFrame = false
+			}
+			session.IsFresh = false
+		}
+		if session.ShouldWaitVideoKeyFrame {
+			if !msg.IsVideoKeyNalu() {
+				continue
+			}
+			session.ShouldWaitVideoKeyFrame = false
+		}
+		session.WriteRefBuffer(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), sendItemType)
+	}
+
+	if group.config.RtmpConfig.Enable || group.config.RtmpConfig.RtmpsEnable {
+		if !group.rtmpGopCacheMultitrack.FeedRef(msg, lazyRtmpChunkDivider.GetEnsureWithoutSdfRef()) {
+			Log.Warnf("[%s] over frame number limit for a single gop in rtmp multitrack cache.", group.UniqueKey)
+		}
+		if msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
+			group.rtmpGopCacheMultitrack.SetMetadataRef(lazyRtmpChunkDivider.GetEnsureWithSdfRef(), lazyRtmpChunkDivider.GetEnsureWithoutSdfRef())
+		}
+	}
+	if group.config.HttpflvConfig.Enable {
+		if !group.httpflvGopCacheMultitrack.FeedRef(msg, lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef()) {
+			Log.Warnf("[%s] over frame number limit for a single gop in http flv multitrack cache.", group.UniqueKey)
+		}
+		if msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
+			group.httpflvGopCacheMultitrack.SetMetadataRef(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef())
+		}
+	}
+}
+
+func (group *Group) startMultitrack() {
+	Log.Infof("[%s] multitrack started.", group.UniqueKey)
+	group.hasMultitrack = true
+
+	// 切换之前所有输出的数据是相同的，用已有的缓存初始化
+	group.rtmpGopCacheMultitrack = group.rtmpGopCache.Clone()
+	group.httpflvGopCacheMultitrack = group.httpflvGopCache.Clone()
+
+	// 支持multitrack的rtmp sub session之后不再从merge writer接收数据，先把缓存的数据发出去
+	if group.rtmpMergeWriter != nil {
+		group.rtmpMergeWriter.Flush()
+	}
+}
+
+func (group *Group) stopMultitrack() {
+	if group.hasMultitrack {
+		group.rtmpGopCacheMultitrack.Clear()
+		group.httpflvGopCacheMultitrack.Clear()
+	}
+	group.hasMultitrack = false
+	group.rtmpGopCacheMultitrack = nil
+	group.httpflvGopCacheMultitrack = nil
+	group.stat.Tracks = nil
+}
+
+func (group *Group) updateMultitrackStat(msg base.RtmpMsg) {
+	tracks, err := msg.ParseTracks()
+	if err != nil {
+		return
+	}
+
+	typ := "video"
+	if msg.Header.MsgTypeId == base.RtmpTypeIdAudio {
+		typ = "audio"
+	}
+	for _, t := range tracks {
+		st := base.StatTrack{
+			Type:    typ,
+			TrackId: int(t.TrackId),
+			Codec:   t.Codec(),
+		}
+
+		exist := false
+		for i := range group.stat.Tracks {
+			if group.stat.Tracks[i].Type == st.Type && group.stat.Tracks[i].TrackId == st.TrackId {
+				group.stat.Tracks[i] = st
+				exist = true
+				break
+			}
+		}
+		if !exist {
+			group.stat.Tracks = append(group.stat.Tracks, st)
+		}
+	}
+}
+
+// isMultitrackRtmpSubSession isMultitrackHttpflvSubSession
+//
+// 为true时，sub session的数据由 broadcastMultitrack 发送
+func (group *Group) isMultitrackRtmpSubSession(session *rtmp.ServerSession) bool {
+	return group.hasMultitrack && session.SupportMultitrack()
+}
+
+func (group *Group) isMultitrackHttpflvSubSession(session *httpflv.SubSession) bool {
+	return group.hasMultitrack && session.SupportMultitrack()
+}
+
+// writeMultitrackGopCache 发送缓存的metadata、seq header以及gop
+//
+// @return 是否发送了gop
+func writeMultitrackGopCache(gc *remux.GopCache, write func(rb *base.RefBuffer, typ base.SendItemType)) bool {
+	if gc.MetadataEnsureWithoutSetDataFrame != nil {
+		write(gc.MetadataEnsureWithoutSetDataFrameRef(), base.SendItemTypeOther)
+	}
+	if gc.VideoSeqHeader != nil {
+		write(gc.VideoSeqHeaderRef(), base.SendItemTypeOther)
+	}
+	if gc.AacSeqHeader != nil {
+		write(gc.AacSeqHeaderRef(), base.SendItemTypeOther)
+	}
+	for _, b := range gc.GetMultitrackSeqHeaderRefs() {
+		write(b, base.SendItemTypeOther)
+	}
+	gopCount := gc.GetGopCount()
+	for i := 0; i < gopCount; i++ {
+		types := gc.GetGopSendItemTypesAt(i)
+		for j, item := range gc.GetGopDataRefAt(i) {
+			write(item, types[j])
+		}
+	}
+	return gopCount > 0
+}
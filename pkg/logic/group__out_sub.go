@@ -75,6 +75,8 @@ func (group *Group) AddHlsSubSession(session *hls.SubSession) {
 func (group *Group) HandleNewRtspSubSessionDescribe(session *rtsp.SubSession) (ok bool, sdp []byte) {
 	Log.Debugf("[%s] [%s] rtsp sub describe.", group.UniqueKey, session.UniqueKey())
 
+	session.WithOnKeyFrameRequest(group.onRtspKeyFrameRequest)
+
 	group.mutex.Lock()
 	defer group.mutex.Unlock()
 	if group.sdpCtx == nil {
@@ -133,6 +135,17 @@ func (group *Group) DelHlsSubSession(session *hls.SubSession) {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// onRtspKeyFrameRequest rtsp拉流端请求关键帧，输入流为rtsp时转发给输入端，其他类型的输入流不支持
+func (group *Group) onRtspKeyFrameRequest() {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	if group.rtspPubSession != nil {
+		group.rtspPubSession.RequestKeyFrame()
+	} else if group.pullProxy.rtspSession != nil {
+		group.pullProxy.rtspSession.RequestKeyFrame()
+	}
+}
+
 func (group *Group) delRtmpSubSession(session *rtmp.ServerSession) {
 	Log.Debugf("[%s] [%s] del rtmp SubSession from group.", group.UniqueKey, session.UniqueKey())
 	delete(group.rtmpSubSessionSet, session)
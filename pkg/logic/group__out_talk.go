@@ -0,0 +1,92 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/gb28181"
+)
+
+// StartRtpTalk gb28181语音广播、对讲，将group中的音频打包后发送给设备
+//
+// 注意，session.Start在tcp active模式下会阻塞建连，所以不持有group.mutex
+func (group *Group) StartRtpTalk(req base.ApiCtrlStartRtpTalkReq) (ret base.ApiCtrlStartRtpTalkResp) {
+	session := gb28181.NewTalkSession(func(option *gb28181.TalkSessionOption) {
+		option.StreamName = req.StreamName
+		option.Ssrc = req.Ssrc
+		option.PackType = gb28181.TalkPackType(req.PackType)
+		option.Transport = gb28181.TalkTransport(req.Transport)
+		option.LocalPort = req.LocalPort
+		option.RemoteAddr = req.RemoteAddr
+		if req.PsPayloadType != 0 {
+			option.PsPayloadType = req.PsPayloadType
+		}
+	})
+
+	port, err := session.Start()
+	if err != nil {
+		Log.Errorf("[%s] [%s] start talk session failed. err=%+v", group.UniqueKey, session.UniqueKey(), err)
+		ret.ErrorCode = base.ErrorCodeStartRtpTalkFail
+		ret.Desp = err.Error()
+		return
+	}
+
+	group.mutex.Lock()
+	// Start期间group可能已经被销毁
+	if group.psTalkSessionSet == nil {
+		group.mutex.Unlock()
+		Log.Warnf("[%s] [%s] group disposed while starting talk session.", group.UniqueKey, session.UniqueKey())
+		_ = session.Dispose()
+		ret.ErrorCode = base.ErrorCodeGroupNotFound
+		ret.Desp = base.DespGroupNotFound
+		return
+	}
+	Log.Debugf("[%s] [%s] add talk session into group.", group.UniqueKey, session.UniqueKey())
+	group.psTalkSessionSet[session] = struct{}{}
+	group.mutex.Unlock()
+
+	go func() {
+		runErr := session.RunLoop()
+		Log.Debugf("[%s] [%s] talk session run loop exit, err=%v", group.UniqueKey, session.UniqueKey(), runErr)
+		group.DelPsTalkSession(session)
+	}()
+
+	ret.ErrorCode = base.ErrorCodeSucc
+	ret.Desp = base.DespSucc
+	ret.Data.SessionId = session.UniqueKey()
+	ret.Data.StreamName = session.StreamName()
+	ret.Data.Port = port
+	return
+}
+
+func (group *Group) DelPsTalkSession(session *gb28181.TalkSession) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+	group.delPsTalkSession(session)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (group *Group) delPsTalkSession(session *gb28181.TalkSession) {
+	Log.Debugf("[%s] [%s] del talk session from group.", group.UniqueKey, session.UniqueKey())
+	_ = session.Dispose()
+	delete(group.psTalkSessionSet, session)
+}
+
+// onAvPacketFromRtmp2AvPacketRemuxer
+//
+// 注意，该回调在持有group.mutex的情况下被调用
+func (group *Group) onAvPacketFromRtmp2AvPacketRemuxer(pkt base.AvPacket, arg interface{}) {
+	for session := range group.psTalkSessionSet {
+		if err := session.FeedAvPacket(pkt); err != nil {
+			Log.Errorf("[%s] [%s] feed talk session failed. err=%+v", group.UniqueKey, session.UniqueKey(), err)
+			_ = session.Dispose()
+		}
+	}
+}
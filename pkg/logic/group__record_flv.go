@@ -9,21 +9,57 @@
 package logic
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 
+	"github.com/q191201771/naza/pkg/bele"
+
+	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+var (
+	recordFlvTailScanSize = int64(4 * 1024 * 1024) // 追加录制时，录制中断的文件在尾部查找完整tag的范围
+	recordFlvTailTagNum   = 16                     // 追加录制时，从最后几个tag中获取最大的时间戳
 )
 
 // startRecordFlvIfNeeded 必要时开启flv录制
+//
+// 配置中开启了flv录制，或者rtmp推流的publish类型为record、append时，开启录制。
+// 其中append会追加到该流最近的一个录制文件后面，时间戳接着文件中最后的时间戳。
+//
+// 注意，publish类型只影响flv录制，ts录制仍然只由 RecordConfig.EnableMpegts 控制，见 startRecordMpegtsIfNeeded
 func (group *Group) startRecordFlvIfNeeded(nowUnix int64) {
-	if !group.config.RecordConfig.EnableFlv {
+	pubType := rtmp.PubTypeLive
+	if group.rtmpPubSession != nil {
+		pubType = group.rtmpPubSession.PubType()
+	}
+	if !group.config.RecordConfig.EnableFlv && pubType == rtmp.PubTypeLive {
 		return
 	}
 
+	outPath := group.config.RecordConfig.FlvOutPath
+	if !group.config.RecordConfig.EnableFlv {
+		// 配置中没有开启录制时，启动时不会创建目录
+		if err := os.MkdirAll(outPath, 0777); err != nil {
+			Log.Errorf("[%s] record flv mkdir error. path=%s, err=%+v", group.UniqueKey, outPath, err)
+			return
+		}
+	}
+
+	if pubType == rtmp.PubTypeAppend {
+		if group.appendRecordFlv(outPath) {
+			return
+		}
+	}
+
 	// 构造文件名
 	filename := fmt.Sprintf("%s-%d.flv", group.streamName, nowUnix)
-	filenameWithPath := filepath.Join(group.config.RecordConfig.FlvOutPath, filename)
+	filenameWithPath := filepath.Join(outPath, filename)
 
 	// 初始化录制
 	group.recordFlv = &httpflv.FlvFileWriter{}
@@ -40,13 +76,207 @@ func (group *Group) startRecordFlvIfNeeded(nowUnix int64) {
 	}
 }
 
-func (group *Group) stopRecordFlvIfNeeded() {
-	if !group.config.RecordConfig.EnableFlv {
-		return
+// appendRecordFlv 打开该流最近的一个录制文件继续写
+//
+// @return 没有可以追加的文件时返回false
+func (group *Group) appendRecordFlv(outPath string) bool {
+	filenameWithPath := findLatestRecordFlv(outPath, group.streamName)
+	if filenameWithPath == "" {
+		Log.Infof("[%s] no record flv file to append, create new one.", group.UniqueKey)
+		return false
+	}
+	end, lastTs, err := scanRecordFlvTail(filenameWithPath)
+	if err != nil {
+		Log.Warnf("[%s] record flv scan file failed, create new one. filename=%s, err=%+v",
+			group.UniqueKey, filenameWithPath, err)
+		return false
 	}
 
+	w := &httpflv.FlvFileWriter{}
+	if err = w.OpenToAppend(filenameWithPath, end); err != nil {
+		Log.Errorf("[%s] record flv open file to append failed. filename=%s, err=%+v",
+			group.UniqueKey, filenameWithPath, err)
+		return false
+	}
+
+	Log.Infof("[%s] record flv append to file. filename=%s, last timestamp=%d",
+		group.UniqueKey, filenameWithPath, lastTs)
+	group.recordFlv = w
+	group.recordFlvAppend = true
+	// 留出1毫秒，保证时间戳递增
+	group.recordFlvBaseTs = lastTs + 1
+	group.recordFlvFirstTs = -1
+	return true
+}
+
+func (group *Group) stopRecordFlvIfNeeded() {
 	if group.recordFlv != nil {
 		_ = group.recordFlv.Dispose()
 		group.recordFlv = nil
 	}
+	group.recordFlvAppend = false
+}
+
+// writeRecordFlv
+//
+// @param tag: 由`msg`转换得到的flv tag，内部不会修改
+func (group *Group) writeRecordFlv(msg base.RtmpMsg, tag []byte) {
+	if group.recordFlv == nil {
+		return
+	}
+
+	if group.recordFlvAppend {
+		if group.recordFlvFirstTs == -1 {
+			group.recordFlvFirstTs = int64(msg.Header.TimestampAbs)
+		}
+		ts := group.recordFlvBaseTs + int64(msg.Header.TimestampAbs) - group.recordFlvFirstTs
+		if ts < group.recordFlvBaseTs {
+			ts = group.recordFlvBaseTs
+		}
+		t := httpflv.Tag{Raw: append([]byte(nil), tag...)}
+		t.ModTagTimestamp(uint32(ts))
+		tag = t.Raw
+	}
+
+	if err := group.recordFlv.WriteRaw(tag); err != nil {
+		Log.Errorf("[%s] record flv write error. err=%+v", group.UniqueKey, err)
+	}
+}
+
+// findLatestRecordFlv 查找`streamName`录制开始时间最晚的文件，文件名格式见 startRecordFlvIfNeeded
+//
+// @return 没有找到时返回空字符串
+func findLatestRecordFlv(outPath string, streamName string) string {
+	entries, err := os.ReadDir(outPath)
+	if err != nil {
+		return ""
+	}
+	var (
+		latest     string
+		latestUnix int64 = -1
+	)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		unix := parseRecordStartUnix(entry.Name())
+		if unix <= latestUnix || entry.Name() != fmt.Sprintf("%s-%d.flv", streamName, unix) {
+			continue
+		}
+		latest = filepath.Join(outPath, entry.Name())
+		latestUnix = unix
+	}
+	return latest
+}
+
+// scanRecordFlvTail 从文件尾部向前查找最后一个完整的tag
+//
+// 注意，在group的锁内调用，录制文件可能很大，所以不读取整个文件
+//
+// @return end:    最后一个完整tag的结束位置，之后的数据可能是录制中断时没有写完整的tag
+// @return lastTs: 最后几个tag中最大的时间戳
+func scanRecordFlvTail(filename string) (end int64, lastTs int64, err error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return
+	}
+
+	header := make([]byte, len(httpflv.FlvHeader))
+	if _, err = io.ReadFull(fp, header); err != nil {
+		return
+	}
+	if !bytes.HasPrefix(header, httpflv.FlvHeader[:3]) {
+		return 0, 0, fmt.Errorf("%w. invalid flv header. filename=%s", base.ErrRecordInvalidFile, filename)
+	}
+	headerEnd := int64(len(header))
+
+	if end, err = findRecordFlvLastTagEnd(fp, headerEnd, fi.Size()); err != nil {
+		return 0, 0, fmt.Errorf("%w. filename=%s, err=%+v", base.ErrRecordInvalidFile, filename, err)
+	}
+
+	// 音视频交织时，最后一个tag的时间戳可能小于前面的tag
+	pos := end
+	for i := 0; i < recordFlvTailTagNum; i++ {
+		h, start, ok := readRecordFlvTagBefore(fp, pos, headerEnd)
+		if !ok {
+			break
+		}
+		if ts := int64(h.Timestamp); ts > lastTs {
+			lastTs = ts
+		}
+		pos = start
+	}
+	return end, lastTs, nil
+}
+
+// findRecordFlvLastTagEnd
+//
+// 正常结束的文件，最后4字节的PreviousTagSize指向最后一个tag。
+// 录制中断时，文件尾部可能有没有写完整的tag，此时在文件尾部 recordFlvTailScanSize 范围内逐字节向前查找。
+func findRecordFlvLastTagEnd(fp *os.File, headerEnd int64, size int64) (int64, error) {
+	if _, _, ok := readRecordFlvTagBefore(fp, size, headerEnd); ok || size == headerEnd {
+		return size, nil
+	}
+
+	winStart := size - recordFlvTailScanSize
+	if winStart < headerEnd {
+		winStart = headerEnd
+	}
+	buf := make([]byte, size-winStart)
+	if _, err := fp.ReadAt(buf, winStart); err != nil {
+		return 0, err
+	}
+	prevTagSizeFieldSize := int64(httpflv.PrevTagSizeFieldSize)
+	for pos := size - 1; pos-prevTagSizeFieldSize >= winStart; pos-- {
+		// 先用内存中的PreviousTagSize过滤，减少读文件
+		tagSize := int64(bele.BeUint32(buf[pos-prevTagSizeFieldSize-winStart:]))
+		if tagSize < int64(httpflv.TagHeaderSize) || pos-prevTagSizeFieldSize-tagSize < headerEnd {
+			continue
+		}
+		if _, _, ok := readRecordFlvTagBefore(fp, pos, headerEnd); ok {
+			return pos, nil
+		}
+	}
+	if winStart == headerEnd {
+		// 没有完整的tag
+		return headerEnd, nil
+	}
+	return 0, fmt.Errorf("last tag not found in tail. size=%d", size)
+}
+
+// readRecordFlvTagBefore 读取结束位置（包含PreviousTagSize）为`pos`的tag的header，并校验是否为合法的tag
+//
+// @return start: tag的开始位置
+func readRecordFlvTagBefore(fp *os.File, pos int64, headerEnd int64) (h httpflv.TagHeader, start int64, ok bool) {
+	b := make([]byte, httpflv.TagHeaderSize)
+	if pos-int64(httpflv.PrevTagSizeFieldSize) < headerEnd {
+		return
+	}
+	if _, err := fp.ReadAt(b[:httpflv.PrevTagSizeFieldSize], pos-int64(httpflv.PrevTagSizeFieldSize)); err != nil {
+		return
+	}
+	tagSize := int64(bele.BeUint32(b))
+	start = pos - int64(httpflv.PrevTagSizeFieldSize) - tagSize
+	if tagSize < int64(httpflv.TagHeaderSize) || start < headerEnd {
+		return
+	}
+	if _, err := fp.ReadAt(b, start); err != nil {
+		return
+	}
+	h.Type = b[0]
+	h.DataSize = bele.BeUint24(b[1:])
+	h.Timestamp = (uint32(b[7]) << 24) + bele.BeUint24(b[4:])
+	h.StreamId = bele.BeUint24(b[8:])
+	if h.Type != httpflv.TagTypeAudio && h.Type != httpflv.TagTypeVideo && h.Type != httpflv.TagTypeMetadata {
+		return
+	}
+	if int64(h.DataSize)+int64(httpflv.TagHeaderSize) != tagSize || h.StreamId != 0 {
+		return
+	}
+	return h, start, true
 }
@@ -0,0 +1,75 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/remux"
+)
+
+func TestGroup_appendRecordFlv(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "test110-1666000000.flv")
+	writeVodTestFile(t, filename)
+	writeVodTestFile(t, filepath.Join(dir, "test110-1665000000.flv"))
+	writeVodTestFile(t, filepath.Join(dir, "test111-1667000000.flv"))
+	assert.Equal(t, filename, findLatestRecordFlv(dir, "test110"))
+	assert.Equal(t, "", findLatestRecordFlv(dir, "test"))
+
+	// 正常结束的文件，从最后的PreviousTagSize找到最后一个tag
+	fi, err := os.Stat(filename)
+	assert.Equal(t, nil, err)
+	end, lastTs, err := scanRecordFlvTail(filename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fi.Size(), end)
+	assert.Equal(t, int64(2000), lastTs)
+
+	// 模拟录制中断，最后一个tag不完整
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Equal(t, nil, err)
+	_, _ = fp.Write([]byte{httpflv.TagTypeVideo, 0, 0, 100})
+	_ = fp.Close()
+	end, lastTs, err = scanRecordFlvTail(filename)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, fi.Size(), end)
+	assert.Equal(t, int64(2000), lastTs)
+
+	group := &Group{UniqueKey: "GROUP1", streamName: "test110"}
+	assert.Equal(t, true, group.appendRecordFlv(dir))
+	for _, ts := range []uint32{5000, 5040} {
+		msg := base.RtmpMsg{
+			Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdAudio, TimestampAbs: ts},
+			Payload: []byte{0xAF, 0x01, 0x21, 0x10},
+		}
+		var lazy remux.LazyRtmpMsg2FlvTag
+		lazy.Init(msg)
+		group.writeRecordFlv(msg, lazy.GetEnsureWithoutSdf())
+	}
+	group.stopRecordFlvIfNeeded()
+
+	var reader httpflv.FlvFileReader
+	assert.Equal(t, nil, reader.Open(filename))
+	defer reader.Dispose()
+	var tss []uint32
+	for {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			break
+		}
+		tss = append(tss, tag.Header.Timestamp)
+	}
+	assert.Equal(t, []uint32{2000, 2001, 2041}, tss[len(tss)-3:])
+}
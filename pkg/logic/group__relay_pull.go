@@ -233,7 +233,10 @@ func (group *Group) pullIfNeeded() (string, error) {
 	} else {
 		rtspSession = rtsp.NewPullSession(group, func(option *rtsp.PullSessionOption) {
 			option.PullTimeoutMs = group.pullProxy.pullTimeoutMs
-			option.OverTcp = group.pullProxy.rtspMode == 0
+			option.OverTcp = group.pullProxy.rtspMode == base.RtspModeTcp
+			if group.pullProxy.rtspMode == base.RtspModeAuto {
+				option.UdpFallbackTimeoutMs = RtspPullUdpFallbackTimeoutMs
+			}
 		}).WithOnDescribeResponse(func() {
 			err := group.AddRtspPullSession(rtspSession)
 			if err != nil {
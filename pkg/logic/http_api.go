@@ -62,6 +62,8 @@ func (h *HttpApiServer) RunLoop() error {
 	mux.HandleFunc("/api/ctrl/stop_relay_pull", h.ctrlStopRelayPullHandler)
 	mux.HandleFunc("/api/ctrl/kick_session", h.ctrlKickSessionHandler)
 	mux.HandleFunc("/api/ctrl/start_rtp_pub", h.ctrlStartRtpPubHandler)
+	mux.HandleFunc("/api/ctrl/rtp_pub_mansrtsp", h.ctrlRtpPubMansRtspHandler)
+	mux.HandleFunc("/api/ctrl/start_rtp_talk", h.ctrlStartRtpTalkHandler)
 	// 所有没有注册路由的走下面这个处理函数
 	mux.HandleFunc("/", h.notFoundHandler)
 
@@ -190,7 +192,11 @@ func (h *HttpApiServer) ctrlStartRtpPubHandler(w http.ResponseWriter, req *http.
 	var v base.ApiCtrlStartRtpPubResp
 	var info base.ApiCtrlStartRtpPubReq
 
-	j, err := unmarshalRequestJsonBody(req, &info, "stream_name")
+	j, err := unmarshalRequestJsonBody(req, &info)
+	if err == nil && info.StreamName == "" && info.Sdp == "" {
+		// 回放、下载时，stream_name可以由sdp生成
+		err = nazahttp.ErrParamMissing
+	}
 	if err != nil {
 		Log.Warnf("http api start rtp pub error. err=%+v", err)
 		v.ErrorCode = base.ErrorCodeParamMissing
@@ -202,6 +208,9 @@ func (h *HttpApiServer) ctrlStartRtpPubHandler(w http.ResponseWriter, req *http.
 	if !j.Exist("timeout_ms") {
 		info.TimeoutMs = DefaultApiCtrlStartRtpPubReqTimeoutMs
 	}
+	if !j.Exist("jitter_buffer_ms") {
+		info.JitterBufferMs = DefaultApiCtrlStartRtpPubReqJitterBufferMs
+	}
 	// 不存在时默认0值的，不需要手动写了
 	//if !j.Exist("port") {
 	//	info.Port = 0
@@ -216,6 +225,44 @@ func (h *HttpApiServer) ctrlStartRtpPubHandler(w http.ResponseWriter, req *http.
 	feedback(resp, w)
 }
 
+func (h *HttpApiServer) ctrlRtpPubMansRtspHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.ApiCtrlRtpPubMansRtspResp
+	var info base.ApiCtrlRtpPubMansRtspReq
+
+	_, err := unmarshalRequestJsonBody(req, &info, "stream_name", "body")
+	if err != nil {
+		Log.Warnf("http api rtp pub mansrtsp error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+
+	Log.Infof("http api rtp pub mansrtsp. req info=%+v", info)
+
+	resp := h.sm.CtrlRtpPubMansRtsp(info)
+	feedback(resp, w)
+}
+
+func (h *HttpApiServer) ctrlStartRtpTalkHandler(w http.ResponseWriter, req *http.Request) {
+	var v base.ApiCtrlStartRtpTalkResp
+	var info base.ApiCtrlStartRtpTalkReq
+
+	_, err := unmarshalRequestJsonBody(req, &info, "stream_name", "ssrc")
+	if err != nil {
+		Log.Warnf("http api start rtp talk error. err=%+v", err)
+		v.ErrorCode = base.ErrorCodeParamMissing
+		v.Desp = base.DespParamMissing
+		feedback(v, w)
+		return
+	}
+
+	Log.Infof("http api start rtp talk. req info=%+v", info)
+
+	resp := h.sm.CtrlStartRtpTalk(info)
+	feedback(resp, w)
+}
+
 func (h *HttpApiServer) webUIHandler(w http.ResponseWriter, req *http.Request) {
 	t, err := template.New("webUI").Parse(webUITpl)
 	if err != nil {
@@ -15,6 +15,7 @@ import (
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/httpflv"
 	"github.com/ysjhlnu/lal/pkg/httpts"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
 )
 
 type IHttpServerHandlerObserver interface {
@@ -33,6 +34,9 @@ type IHttpServerHandlerObserver interface {
 
 type HttpServerHandler struct {
 	observer IHttpServerHandlerObserver
+
+	rtspHttpTunnelHandler base.Handler
+	rtspWebSocketHandler  base.Handler
 }
 
 func NewHttpServerHandler(observer IHttpServerHandlerObserver) *HttpServerHandler {
@@ -41,13 +45,40 @@ func NewHttpServerHandler(observer IHttpServerHandlerObserver) *HttpServerHandle
 	}
 }
 
+// WithRtspHttpTunnelHandler 设置RTSP over HTTP的处理函数
+//
+// 由于RTSP over HTTP的请求路径和rtsp地址的路径一致，可能和httpflv等的url pattern冲突，所以统一由 ServeSubSession 分发
+func (h *HttpServerHandler) WithRtspHttpTunnelHandler(handler base.Handler) *HttpServerHandler {
+	h.rtspHttpTunnelHandler = handler
+	return h
+}
+
+// WithRtspWebSocketHandler 设置RTSP over WebSocket的处理函数
+//
+// 后缀不是.flv和.ts的WebSocket请求，都交给该函数处理
+func (h *HttpServerHandler) WithRtspWebSocketHandler(handler base.Handler) *HttpServerHandler {
+	h.rtspWebSocketHandler = handler
+	return h
+}
+
 func (h *HttpServerHandler) ServeSubSession(writer http.ResponseWriter, req *http.Request) {
+	if h.rtspHttpTunnelHandler != nil && rtsp.IsHttpTunnelRequest(req) {
+		h.rtspHttpTunnelHandler(writer, req)
+		return
+	}
+
 	urlCtx, err := base.ParseUrl(base.ParseHttpRequest(req), 80)
 	if err != nil {
 		Log.Errorf("parse url. err=%+v", err)
 		return
 	}
 
+	if h.rtspWebSocketHandler != nil && rtsp.IsWebSocketRequest(req) &&
+		!strings.HasSuffix(urlCtx.LastItemOfPath, ".flv") && !strings.HasSuffix(urlCtx.LastItemOfPath, ".ts") {
+		h.rtspWebSocketHandler(writer, req)
+		return
+	}
+
 	conn, bio, err := writer.(http.Hijacker).Hijack()
 	if err != nil {
 		Log.Errorf("hijack failed. err=%+v", err)
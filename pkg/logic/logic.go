@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 
 	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/sdp"
 )
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -88,6 +89,19 @@ type ICustomizeHookSessionContext interface {
 	OnStop()
 }
 
+// ICustomizeHookSessionTrackContext 可选接口
+//
+// 业务方实现的 ICustomizeHookSessionContext 对象如果同时实现了该接口，则可以收到rtsp输入流中主音频、主视频之外的其他track，
+// 比如第二路音频、ONVIF元数据。
+// 注意，这些track不会转换成rtmp，所以不会出现在 ICustomizeHookSessionContext.OnMsg 中。
+type ICustomizeHookSessionTrackContext interface {
+	// OnTrackAvPacket 注意，业务方不应该修改或持有 pkt.Payload 内存块
+	OnTrackAvPacket(track sdp.TrackContext, pkt base.AvPacket)
+
+	// OnOnvifMetadata ONVIF元数据，一个完整的xml文档。注意，业务方不应该修改或持有该内存块
+	OnOnvifMetadata(track sdp.TrackContext, b []byte)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 // INotifyHandler 事件通知接口
@@ -0,0 +1,78 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazahttp"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+// rtmpAuthenticator 实现 rtmp.IServerAuthenticator
+//
+// 账号来源的优先级为 IRtmpAuthentication > webhook > 配置文件
+type rtmpAuthenticator struct {
+	authentication IAuthentication
+	webhookUrl     string
+	serverId       string
+	config         rtmp.ServerAuthConfig
+	client         *http.Client
+}
+
+// RtmpAuthWebhookInfo webhook请求的body，回复的body为json格式的 rtmp.ServerAuthCredential ，http状态码不为200时拒绝该请求
+type RtmpAuthWebhookInfo struct {
+	rtmp.ServerAuthRequest
+
+	ServerId string `json:"server_id"`
+}
+
+func newRtmpAuthenticator(authentication IAuthentication, config *Config) *rtmpAuthenticator {
+	a := &rtmpAuthenticator{
+		authentication: authentication,
+		serverId:       config.ServerId,
+		config:         config.RtmpConfig.AuthConfig,
+		client: &http.Client{
+			Timeout: time.Duration(notifyTimeoutSec) * time.Second,
+		},
+	}
+	if config.HttpNotifyConfig.Enable {
+		a.webhookUrl = config.HttpNotifyConfig.OnRtmpAuth
+	}
+	return a
+}
+
+func (a *rtmpAuthenticator) GetCredential(req rtmp.ServerAuthRequest) (rtmp.ServerAuthCredential, error) {
+	if h, ok := a.authentication.(IRtmpAuthentication); ok {
+		return h.OnRtmpAuth(req)
+	}
+	if a.webhookUrl != "" {
+		return a.postWebhook(req)
+	}
+	return a.config.GetCredential(req)
+}
+
+func (a *rtmpAuthenticator) postWebhook(req rtmp.ServerAuthRequest) (cred rtmp.ServerAuthCredential, err error) {
+	resp, err := nazahttp.PostJson(a.webhookUrl, RtmpAuthWebhookInfo{ServerAuthRequest: req, ServerId: a.serverId}, a.client)
+	if err != nil {
+		return cred, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return cred, fmt.Errorf("%w. rtmp auth webhook rejected. status=%d", base.ErrRtmpAuthFailed, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cred)
+	return
+}
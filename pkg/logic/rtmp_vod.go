@@ -0,0 +1,279 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/remux"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+// rtmpVodSession RTMP点播一个录制的flv文件
+//
+// Open时扫描整个文件，建立seek索引，并缓存metadata和音视频seq header。
+// Start后在独立的协程中按tag的时间戳匀速读取文件，发送给 rtmp.ServerSession 。
+// 时间戳为相对于文件开头的位置，seek后客户端根据时间戳显示播放进度。
+type rtmpVodSession struct {
+	uniqueKey  string
+	filename   string
+	subSession *rtmp.ServerSession
+
+	reader httpflv.FlvFileReader
+	vodIndex
+	headers [][]byte // metadata，音视频seq header，开始播放时先发送
+
+	cmdChan  chan rtmpVodCmd
+	stopChan chan struct{}
+
+	mutex   sync.Mutex
+	started bool
+	stopped bool
+}
+
+type rtmpVodCmd struct {
+	isPause   bool
+	isResume  bool
+	seekPoint *vodSeekPoint
+}
+
+func newRtmpVodSession(filename string, subSession *rtmp.ServerSession) *rtmpVodSession {
+	return &rtmpVodSession{
+		uniqueKey:  subSession.UniqueKey(),
+		filename:   filename,
+		subSession: subSession,
+		cmdChan:    make(chan rtmpVodCmd),
+		stopChan:   make(chan struct{}),
+	}
+}
+
+func (s *rtmpVodSession) Open() error {
+	if err := s.reader.Open(s.filename); err != nil {
+		return err
+	}
+
+	var metadata, vsh, ash []byte
+	s.vodIndex = scanVodFile(&s.reader, func(tag httpflv.Tag) {
+		msg := remux.FlvTag2RtmpMsg(tag)
+		if len(msg.Payload) < 2 {
+			return
+		}
+		msg.Header.TimestampAbs = 0
+		var divider remux.LazyRtmpChunkDivider
+		divider.Init(msg)
+		if tag.IsMetadata() && metadata == nil {
+			metadata = divider.GetEnsureWithoutSdf()
+		} else if msg.IsVideoKeySeqHeader() && vsh == nil {
+			vsh = divider.GetEnsureWithoutSdf()
+		} else if (msg.IsAacSeqHeader() || msg.IsExAudioSeqHeader()) && ash == nil {
+			ash = divider.GetEnsureWithoutSdf()
+		}
+	})
+	for _, b := range [][]byte{metadata, vsh, ash} {
+		if b != nil {
+			s.headers = append(s.headers, b)
+		}
+	}
+
+	if len(s.seekPoints) == 0 {
+		s.reader.Dispose()
+		return fmt.Errorf("%w. filename=%s", base.ErrVodInvalidFile, s.filename)
+	}
+
+	Log.Infof("[%s] open rtmp vod file. filename=%s, duration=%d, seek points=%d",
+		s.uniqueKey, s.filename, s.durationMs, len(s.seekPoints))
+	return nil
+}
+
+// Start 根据play信令中的参数开始播放
+func (s *rtmpVodSession) Start(args rtmp.PlayArgs) {
+	var startMs int64
+	if args.Start > 0 {
+		startMs = int64(args.Start)
+	}
+	point := s.findSeekPoint(startMs)
+	stopMs := int64(-1)
+	if args.Duration > 0 {
+		stopMs = startMs + int64(args.Duration)
+	} else if args.Duration == 0 {
+		// 只播放一帧，也即起始位置之前的关键帧
+		stopMs = point.ms
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	}
+	s.started = true
+	go s.runLoop(point, stopMs)
+}
+
+// ----- rtmp.IVodObserver ---------------------------------------------------------------------------------------------
+
+func (s *rtmpVodSession) OnVodSeek(ms int64) (int64, error) {
+	if ms < 0 {
+		ms = 0
+	}
+	if ms > s.durationMs {
+		return 0, fmt.Errorf("%w. ms=%d, duration=%d", base.ErrVodSeekOutOfRange, ms, s.durationMs)
+	}
+	point := s.findSeekPoint(ms)
+	s.sendCmd(rtmpVodCmd{seekPoint: point})
+	return point.ms, nil
+}
+
+func (s *rtmpVodSession) OnVodPause(pause bool) {
+	s.sendCmd(rtmpVodCmd{isPause: pause, isResume: !pause})
+}
+
+func (s *rtmpVodSession) OnVodStop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.stopped {
+		return
+	}
+	s.stopped = true
+	close(s.stopChan)
+	if !s.started {
+		// 没有开始播放，文件由这里关闭，否则由 runLoop 关闭
+		s.reader.Dispose()
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// runLoop
+//
+// @param stopMs: 播放到该位置结束，-1表示播放到文件结尾
+func (s *rtmpVodSession) runLoop(point *vodSeekPoint, stopMs int64) {
+	defer s.reader.Dispose()
+
+	for _, b := range s.headers {
+		_ = s.subSession.Write(b)
+	}
+
+	var (
+		paused   bool
+		eof      bool
+		baseTs   = s.firstTs + point.ms // 从该时间戳开始按时间发送
+		baseTime = time.Now()
+		lastTs   = baseTs
+		pending  *httpflv.Tag // 已读取，但还没到发送时间
+	)
+	if err := s.reader.SeekTo(point.offset); err != nil {
+		// 不退出，继续处理seek等信令，避免 sendCmd 阻塞
+		Log.Errorf("[%s] vod seek failed. err=%+v", s.uniqueKey, err)
+		eof = true
+		_ = s.subSession.WritePlayComplete()
+	}
+
+	for {
+		var timer *time.Timer
+		var timerChan <-chan time.Time
+		if !paused && !eof {
+			if pending == nil {
+				tag, err := s.reader.ReadTag()
+				if err != nil {
+					Log.Infof("[%s] vod reach end of file. err=%+v", s.uniqueKey, err)
+					eof = true
+					_ = s.subSession.WritePlayComplete()
+					continue
+				}
+				pending = &tag
+			}
+
+			ts := int64(pending.Header.Timestamp)
+			if stopMs >= 0 && ts-s.firstTs > stopMs {
+				Log.Infof("[%s] vod reach end of duration. stop=%d", s.uniqueKey, stopMs)
+				eof = true
+				pending = nil
+				_ = s.subSession.WritePlayComplete()
+				continue
+			}
+			delay := time.Duration(ts-baseTs)*time.Millisecond - time.Since(baseTime)
+			if delay <= 0 {
+				s.feed(*pending)
+				lastTs = ts
+				pending = nil
+				continue
+			}
+			timer = time.NewTimer(delay)
+			timerChan = timer.C
+		}
+
+		select {
+		case <-s.stopChan:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case cmd := <-s.cmdChan:
+			if cmd.isPause {
+				paused = true
+				break
+			}
+			if cmd.seekPoint != nil {
+				if err := s.reader.SeekTo(cmd.seekPoint.offset); err != nil {
+					Log.Errorf("[%s] vod seek failed. err=%+v", s.uniqueKey, err)
+				}
+				pending = nil
+				eof = false
+				lastTs = s.firstTs + cmd.seekPoint.ms
+			}
+			if cmd.isResume {
+				paused = false
+			}
+			if pending != nil {
+				baseTs = int64(pending.Header.Timestamp)
+			} else {
+				baseTs = lastTs
+			}
+			baseTime = time.Now()
+		case <-timerChan:
+			s.feed(*pending)
+			lastTs = int64(pending.Header.Timestamp)
+			pending = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *rtmpVodSession) sendCmd(cmd rtmpVodCmd) {
+	select {
+	case s.cmdChan <- cmd:
+	case <-s.stopChan:
+	}
+}
+
+func (s *rtmpVodSession) feed(tag httpflv.Tag) {
+	// metadata已经在开始时发送
+	if tag.IsMetadata() {
+		return
+	}
+	msg := remux.FlvTag2RtmpMsg(tag)
+	if len(msg.Payload) < 2 {
+		return
+	}
+	ms := int64(tag.Header.Timestamp) - s.firstTs
+	if ms < 0 {
+		ms = 0
+	}
+	msg.Header.TimestampAbs = uint32(ms)
+
+	var divider remux.LazyRtmpChunkDivider
+	divider.Init(msg)
+	_ = s.subSession.WriteFrame(divider.GetEnsureWithoutSdf(), base.SendItemTypeOfRtmpMsg(msg))
+}
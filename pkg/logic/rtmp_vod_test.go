@@ -0,0 +1,119 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+// vodTestConn 记录每次写入的rtmp消息，只解析fmt0的第一个chunk
+type vodTestConn struct {
+	net.Conn
+	mutex sync.Mutex
+	msgs  []vodTestMsg
+}
+
+type vodTestMsg struct {
+	typeid uint8
+	ts     uint32
+	raw    []byte
+}
+
+func (c *vodTestConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(b) >= 12 {
+		c.msgs = append(c.msgs, vodTestMsg{typeid: b[7], ts: bele.BeUint24(b[1:]), raw: append([]byte(nil), b...)})
+	}
+	return len(b), nil
+}
+
+func (c *vodTestConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1935}
+}
+
+func (c *vodTestConn) waitPlayStop() []vodTestMsg {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		for _, msg := range c.msgs {
+			if msg.typeid == base.RtmpTypeIdCommandMessageAmf0 && bytes.Contains(msg.raw, []byte("NetStream.Play.Stop")) {
+				msgs := c.msgs
+				c.mutex.Unlock()
+				return msgs
+			}
+		}
+		c.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestRtmpVodSession(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test110.flv")
+	writeVodTestFile(t, filename)
+
+	var conn vodTestConn
+	subSession := rtmp.NewServerSession(nil, &conn)
+
+	vod := newRtmpVodSession(filename, subSession)
+	assert.Equal(t, nil, vod.Open())
+	assert.Equal(t, 2, len(vod.headers))
+	assert.Equal(t, int64(2000), vod.durationMs)
+
+	// 超出文件范围
+	_, err := vod.OnVodSeek(3000)
+	assert.IsNotNil(t, err)
+
+	// 从第1.2秒开始，向前对齐到关键帧，播放500毫秒
+	vod.Start(rtmp.PlayArgs{Start: 1200, Duration: 500})
+	msgs := conn.waitPlayStop()
+	assert.IsNotNil(t, msgs)
+
+	var avMsgs []vodTestMsg
+	for _, msg := range msgs {
+		if msg.typeid == base.RtmpTypeIdAudio || msg.typeid == base.RtmpTypeIdVideo {
+			avMsgs = append(avMsgs, msg)
+		}
+	}
+	// 前两个是seq header
+	assert.Equal(t, true, len(avMsgs) > 2)
+	assert.Equal(t, uint32(0), avMsgs[0].ts)
+	assert.Equal(t, uint32(0), avMsgs[1].ts)
+	assert.Equal(t, uint32(1000), avMsgs[2].ts)
+	assert.Equal(t, uint32(1680), avMsgs[len(avMsgs)-1].ts)
+
+	vod.OnVodStop()
+
+	// duration为0时只播放一帧
+	var conn2 vodTestConn
+	vod2 := newRtmpVodSession(filename, rtmp.NewServerSession(nil, &conn2))
+	assert.Equal(t, nil, vod2.Open())
+	vod2.Start(rtmp.PlayArgs{Start: 1200, Duration: 0})
+	avMsgs = nil
+	for _, msg := range conn2.waitPlayStop() {
+		if msg.typeid == base.RtmpTypeIdAudio || msg.typeid == base.RtmpTypeIdVideo {
+			avMsgs = append(avMsgs, msg)
+		}
+	}
+	assert.Equal(t, true, len(avMsgs) > 2)
+	assert.Equal(t, uint32(1000), avMsgs[len(avMsgs)-1].ts)
+	vod2.OnVodStop()
+}
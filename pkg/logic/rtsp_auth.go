@@ -0,0 +1,78 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazahttp"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+)
+
+// rtspAuthenticator 实现 rtsp.IServerAuthenticator
+//
+// 账号来源的优先级为 IRtspAuthentication > webhook > 配置文件
+type rtspAuthenticator struct {
+	authentication IAuthentication
+	webhookUrl     string
+	serverId       string
+	config         rtsp.ServerAuthConfig
+	client         *http.Client
+}
+
+// RtspAuthWebhookInfo webhook请求的body，回复的body为json格式的 rtsp.ServerAuthCredential ，http状态码不为200时拒绝该请求
+type RtspAuthWebhookInfo struct {
+	rtsp.ServerAuthRequest
+
+	ServerId string `json:"server_id"`
+}
+
+func newRtspAuthenticator(authentication IAuthentication, config *Config) *rtspAuthenticator {
+	a := &rtspAuthenticator{
+		authentication: authentication,
+		serverId:       config.ServerId,
+		config:         config.RtspConfig.ServerAuthConfig,
+		client: &http.Client{
+			Timeout: time.Duration(notifyTimeoutSec) * time.Second,
+		},
+	}
+	if config.HttpNotifyConfig.Enable {
+		a.webhookUrl = config.HttpNotifyConfig.OnRtspAuth
+	}
+	return a
+}
+
+func (a *rtspAuthenticator) GetCredential(req rtsp.ServerAuthRequest) (rtsp.ServerAuthCredential, error) {
+	if h, ok := a.authentication.(IRtspAuthentication); ok {
+		return h.OnRtspAuth(req)
+	}
+	if a.webhookUrl != "" {
+		return a.postWebhook(req)
+	}
+	return a.config.GetCredential(req)
+}
+
+func (a *rtspAuthenticator) postWebhook(req rtsp.ServerAuthRequest) (cred rtsp.ServerAuthCredential, err error) {
+	resp, err := nazahttp.PostJson(a.webhookUrl, RtspAuthWebhookInfo{ServerAuthRequest: req, ServerId: a.serverId}, a.client)
+	if err != nil {
+		return cred, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return cred, fmt.Errorf("%w. rtsp auth webhook rejected. status=%d", base.ErrRtspAuthFailed, resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&cred)
+	return
+}
@@ -0,0 +1,68 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+)
+
+type rtspAuthTestAuthentication struct {
+	SimpleAuthCtx
+}
+
+func (a *rtspAuthTestAuthentication) OnRtspAuth(req rtsp.ServerAuthRequest) (rtsp.ServerAuthCredential, error) {
+	return rtsp.ServerAuthCredential{Enable: true, Username: req.StreamName}, nil
+}
+
+func TestRtspAuthenticator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var info RtspAuthWebhookInfo
+		_ = json.NewDecoder(r.Body).Decode(&info)
+		if info.AppName != "live" || info.ServerId != "1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rtsp.ServerAuthCredential{Enable: true, Method: 1, Username: info.StreamName, Password: "p"})
+	}))
+	defer server.Close()
+
+	config := &Config{ServerId: "1"}
+	config.RtspConfig.AuthEnable = true
+	config.RtspConfig.UserName = "u"
+	config.HttpNotifyConfig.OnRtspAuth = server.URL
+
+	// http notify没有开启时，使用配置文件中的账号
+	a := newRtspAuthenticator(NewSimpleAuthCtx(SimpleAuthConfig{}), config)
+	cred, err := a.GetCredential(rtsp.ServerAuthRequest{AppName: "live", StreamName: "test110"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "u", cred.Username)
+
+	config.HttpNotifyConfig.Enable = true
+	a = newRtspAuthenticator(NewSimpleAuthCtx(SimpleAuthConfig{}), config)
+	cred, err = a.GetCredential(rtsp.ServerAuthRequest{AppName: "live", StreamName: "test110"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, rtsp.ServerAuthCredential{Enable: true, Method: 1, Username: "test110", Password: "p"}, cred)
+	_, err = a.GetCredential(rtsp.ServerAuthRequest{AppName: "other", StreamName: "test110"})
+	assert.Equal(t, true, errors.Is(err, base.ErrRtspAuthFailed))
+
+	// 业务方实现了 IRtspAuthentication
+	a = newRtspAuthenticator(&rtspAuthTestAuthentication{}, config)
+	cred, err = a.GetCredential(rtsp.ServerAuthRequest{AppName: "live", StreamName: "test111"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "test111", cred.Username)
+}
@@ -0,0 +1,278 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/remux"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+// rtspVodSession RTSP点播一个录制的flv文件
+//
+// Open时扫描整个文件，生成sdp，并建立seek索引（有视频时为视频关键帧，否则为间隔1秒的音频帧）。
+// 第一次PLAY后，在独立的协程中按tag的时间戳（除以倍速）匀速读取文件，经 remux.Rtmp2RtspRemuxer 转换为rtp包后发送给 rtsp.SubSession 。
+type rtspVodSession struct {
+	uniqueKey     string
+	filename      string
+	fileStartUnix int64 // 从录制文件名中解析出的录制开始时间，用于`clock=`格式的Range，-1表示未知
+	subSession    *rtsp.SubSession
+
+	reader  httpflv.FlvFileReader
+	remuxer *remux.Rtmp2RtspRemuxer
+
+	sdp []byte
+	vodIndex
+
+	cmdChan  chan rtspVodCmd
+	stopChan chan struct{}
+
+	mutex      sync.Mutex
+	started    bool
+	positionMs int64 // 最后发送的tag的位置
+}
+
+type rtspVodCmd struct {
+	isPause   bool
+	seekPoint *vodSeekPoint // nil表示从当前位置继续
+	scale     float64
+}
+
+func newRtspVodSession(filename string, subSession *rtsp.SubSession) *rtspVodSession {
+	return &rtspVodSession{
+		uniqueKey:     subSession.UniqueKey(),
+		filename:      filename,
+		fileStartUnix: parseRecordStartUnix(filename),
+		subSession:    subSession,
+		cmdChan:       make(chan rtspVodCmd),
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// Open 打开文件，返回sdp
+func (s *rtspVodSession) Open() ([]byte, error) {
+	if err := s.reader.Open(s.filename); err != nil {
+		return nil, err
+	}
+	s.remuxer = remux.NewRtmp2RtspRemuxer(s.onSdp, s.onRtpPacket)
+
+	s.vodIndex = scanVodFile(&s.reader, func(tag httpflv.Tag) {
+		if s.sdp == nil {
+			s.remuxer.FeedRtmpMsg(remux.FlvTag2RtmpMsg(tag))
+		}
+	})
+
+	if s.sdp == nil || len(s.seekPoints) == 0 {
+		s.reader.Dispose()
+		return nil, fmt.Errorf("%w. invalid vod file. filename=%s", base.ErrRtsp, s.filename)
+	}
+
+	Log.Infof("[%s] open vod file. filename=%s, duration=%d, seek points=%d",
+		s.uniqueKey, s.filename, s.durationMs, len(s.seekPoints))
+	return s.sdp, nil
+}
+
+// ----- rtsp.IVodObserver ---------------------------------------------------------------------------------------------
+
+func (s *rtspVodSession) OnVodPlay(playRange *rtsp.PlayRange, scale float64) (startMs, durationMs int64, err error) {
+	cmd := rtspVodCmd{scale: scale}
+	if playRange != nil && !playRange.IsNow {
+		ms := playRange.StartMs
+		if playRange.IsClock {
+			if s.fileStartUnix == -1 {
+				return 0, 0, fmt.Errorf("%w. record start time unknown. filename=%s", base.ErrRtsp, s.filename)
+			}
+			ms = playRange.StartClock.UnixNano()/1e6 - s.fileStartUnix*1000
+		}
+		if ms < 0 || ms > s.durationMs {
+			return 0, 0, fmt.Errorf("%w. range out of file. start=%d, duration=%d", base.ErrRtsp, ms, s.durationMs)
+		}
+		cmd.seekPoint = s.findSeekPoint(ms)
+	}
+
+	s.mutex.Lock()
+	if !s.started {
+		s.started = true
+		if cmd.seekPoint == nil {
+			cmd.seekPoint = &s.seekPoints[0]
+		}
+		go s.runLoop()
+	}
+	startMs = s.positionMs
+	s.mutex.Unlock()
+
+	if cmd.seekPoint != nil {
+		startMs = cmd.seekPoint.ms
+	}
+	s.sendCmd(cmd)
+	return startMs, s.durationMs, nil
+}
+
+func (s *rtspVodSession) OnVodPause() {
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	if started {
+		s.sendCmd(rtspVodCmd{isPause: true})
+	}
+}
+
+func (s *rtspVodSession) OnVodStop() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	close(s.stopChan)
+	if !s.started {
+		// 没有开始播放，文件由这里关闭，否则由 runLoop 关闭
+		s.reader.Dispose()
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (s *rtspVodSession) runLoop() {
+	defer s.reader.Dispose()
+
+	var (
+		paused   = true
+		eof      bool
+		scale    = 1.0
+		baseTs   int64 // 从该时间戳开始按时间发送
+		baseTime time.Time
+		lastTs   int64
+		pending  *httpflv.Tag // 已读取，但还没到发送时间
+	)
+
+	for {
+		var timer *time.Timer
+		var timerChan <-chan time.Time
+		if !paused && !eof {
+			if pending == nil {
+				tag, err := s.reader.ReadTag()
+				if err != nil {
+					Log.Infof("[%s] vod reach end of file. err=%+v", s.uniqueKey, err)
+					eof = true
+					continue
+				}
+				pending = &tag
+			}
+
+			ts := int64(pending.Header.Timestamp)
+			delay := time.Duration(float64(ts-baseTs)/scale*float64(time.Millisecond)) - time.Since(baseTime)
+			if delay <= 0 {
+				s.feed(*pending)
+				lastTs = ts
+				pending = nil
+				continue
+			}
+			timer = time.NewTimer(delay)
+			timerChan = timer.C
+		}
+
+		select {
+		case <-s.stopChan:
+			return
+		case cmd := <-s.cmdChan:
+			if cmd.isPause {
+				paused = true
+				break
+			}
+			if cmd.seekPoint != nil {
+				if err := s.reader.SeekTo(cmd.seekPoint.offset); err != nil {
+					Log.Errorf("[%s] vod seek failed. err=%+v", s.uniqueKey, err)
+				}
+				pending = nil
+				eof = false
+				lastTs = s.firstTs + cmd.seekPoint.ms
+			}
+			if pending != nil {
+				baseTs = int64(pending.Header.Timestamp)
+			} else {
+				baseTs = lastTs
+			}
+			baseTime = time.Now()
+			scale = cmd.scale
+			paused = false
+		case <-timerChan:
+			s.feed(*pending)
+			lastTs = int64(pending.Header.Timestamp)
+			pending = nil
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (s *rtspVodSession) sendCmd(cmd rtspVodCmd) {
+	select {
+	case s.cmdChan <- cmd:
+	case <-s.stopChan:
+	}
+}
+
+func (s *rtspVodSession) feed(tag httpflv.Tag) {
+	s.remuxer.FeedRtmpMsg(remux.FlvTag2RtmpMsg(tag))
+	if tag.IsMetadata() {
+		return
+	}
+
+	ms := int64(tag.Header.Timestamp) - s.firstTs
+	if ms < 0 {
+		ms = 0
+	}
+	s.mutex.Lock()
+	s.positionMs = ms
+	s.mutex.Unlock()
+}
+
+func (s *rtspVodSession) position() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.positionMs
+}
+
+func (s *rtspVodSession) onSdp(sdpCtx sdp.LogicContext) {
+	s.sdp = sdpCtx.RawSdp
+}
+
+func (s *rtspVodSession) onRtpPacket(pkt rtprtcp.RtpPacket) {
+	// Open阶段生成sdp时也会产生rtp包，丢弃
+	s.mutex.Lock()
+	started := s.started
+	s.mutex.Unlock()
+	if started {
+		s.subSession.WriteRtpPacket(pkt)
+	}
+}
+
+// parseRecordStartUnix 从录制文件名中解析录制开始时间，文件名格式见 Group.startRecordFlvIfNeeded
+//
+// @return 解析失败返回-1
+func parseRecordStartUnix(filename string) int64 {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	index := strings.LastIndexByte(name, '-')
+	if index == -1 {
+		return -1
+	}
+	v, err := strconv.ParseInt(name[index+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return v
+}
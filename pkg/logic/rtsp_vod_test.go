@@ -0,0 +1,112 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/avc"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+// writeVodTestFile 生成一个2秒的flv文件，音视频都是25帧每秒，视频每秒一个关键帧
+func writeVodTestFile(t *testing.T, filename string) {
+	sps, _ := base64.StdEncoding.DecodeString("Z2QAIKzZQMApsBEAAAMAAQAAAwAyDxgxlg==")
+	pps, _ := base64.StdEncoding.DecodeString("aOvssiw=")
+	seqHeader, err := avc.BuildSeqHeaderFromSpsPps(sps, pps)
+	assert.Equal(t, nil, err)
+
+	var w httpflv.FlvFileWriter
+	assert.Equal(t, nil, w.Open(filename))
+	defer w.Dispose()
+	assert.Equal(t, nil, w.WriteFlvHeader())
+	writeTag := func(typ uint8, ts uint32, payload []byte) {
+		raw := httpflv.PackHttpflvTag(typ, ts, payload)
+		assert.Equal(t, nil, w.WriteRaw(raw))
+	}
+
+	writeTag(httpflv.TagTypeVideo, 0, seqHeader)
+	writeTag(httpflv.TagTypeAudio, 0, []byte{0xAF, 0x00, 0x12, 0x10})
+	for ts := uint32(0); ts <= 2000; ts += 40 {
+		if ts%1000 == 0 {
+			writeTag(httpflv.TagTypeVideo, ts, []byte{0x17, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x65, 0x88})
+		} else {
+			writeTag(httpflv.TagTypeVideo, ts, []byte{0x27, 0x01, 0, 0, 0, 0, 0, 0, 2, 0x41, 0x9a})
+		}
+		writeTag(httpflv.TagTypeAudio, ts, []byte{0xAF, 0x01, 0x21, 0x10})
+	}
+}
+
+func TestRtspVodSession(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test110-1666000000.flv")
+	writeVodTestFile(t, filename)
+
+	urlCtx, err := base.ParseRtspUrl("rtsp://127.0.0.1/vod/test110-1666000000.flv")
+	assert.Equal(t, nil, err)
+	subSession := rtsp.NewSubSession(urlCtx, nil)
+
+	vod := newRtspVodSession(filename, subSession)
+	assert.Equal(t, int64(1666000000), vod.fileStartUnix)
+	rawSdp, err := vod.Open()
+	assert.Equal(t, nil, err)
+	sdpCtx, err := sdp.ParseSdp2LogicContext(rawSdp)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, sdpCtx.IsVideoUnpackable())
+	assert.Equal(t, true, sdpCtx.IsAudioUnpackable())
+	subSession.InitWithSdp(sdpCtx)
+
+	assert.Equal(t, int64(2000), vod.durationMs)
+	assert.Equal(t, 3, len(vod.seekPoints))
+	assert.Equal(t, int64(1000), vod.findSeekPoint(1999).ms)
+
+	// 超出文件范围
+	_, _, err = vod.OnVodPlay(&rtsp.PlayRange{StartMs: 3000}, 1)
+	assert.IsNotNil(t, err)
+	_, _, err = vod.OnVodPlay(&rtsp.PlayRange{IsClock: true, StartClock: time.Unix(1665999999, 0)}, 1)
+	assert.IsNotNil(t, err)
+
+	// 从第0秒开始，正常速度播放，然后暂停
+	startMs, durationMs, err := vod.OnVodPlay(nil, 1)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(0), startMs)
+	assert.Equal(t, int64(2000), durationMs)
+	time.Sleep(200 * time.Millisecond)
+	vod.OnVodPause()
+	pos := vod.position()
+	assert.Equal(t, true, pos > 0 && pos < 1000)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, pos, vod.position())
+
+	// clock格式seek到第1.2秒，向前对齐到关键帧，4倍速
+	startMs, _, err = vod.OnVodPlay(&rtsp.PlayRange{IsClock: true, StartClock: time.Unix(1666000001, 200*1e6)}, 4)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1000), startMs)
+	deadline := time.Now().Add(time.Second)
+	for vod.position() != 2000 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int64(2000), vod.position())
+
+	vod.OnVodStop()
+}
+
+func TestParseRecordStartUnix(t *testing.T) {
+	assert.Equal(t, int64(1666000000), parseRecordStartUnix("/tmp/test110-1666000000.flv"))
+	assert.Equal(t, int64(1666000000), parseRecordStartUnix("a-b-1666000000.flv"))
+	assert.Equal(t, int64(-1), parseRecordStartUnix("test110.flv"))
+	assert.Equal(t, int64(-1), parseRecordStartUnix("test-abc.flv"))
+}
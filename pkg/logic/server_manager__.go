@@ -105,6 +105,13 @@ Doc: %s
 		hls.SetUseMemoryAsDiskFlag(true)
 	}
 
+	if sm.config.SubSessionSendQueueConfig.Enable {
+		Log.Infof("sub session send queue enabled. config=%+v", sm.config.SubSessionSendQueueConfig)
+		rtmp.ServerSessionSendQueueConfig = sm.config.SubSessionSendQueueConfig
+		httpflv.SubSessionSendQueueConfig = sm.config.SubSessionSendQueueConfig
+		httpts.SubSessionSendQueueConfig = sm.config.SubSessionSendQueueConfig
+	}
+
 	if sm.config.RecordConfig.EnableFlv {
 		if err := os.MkdirAll(sm.config.RecordConfig.FlvOutPath, 0777); err != nil {
 			Log.Errorf("record flv mkdir error. path=%s, err=%+v", sm.config.RecordConfig.FlvOutPath, err)
@@ -121,7 +128,10 @@ Doc: %s
 
 	if sm.config.HttpflvConfig.Enable || sm.config.HttpflvConfig.EnableHttps ||
 		sm.config.HttptsConfig.Enable || sm.config.HttptsConfig.EnableHttps ||
-		sm.config.HlsConfig.Enable || sm.config.HlsConfig.EnableHttps {
+		sm.config.HlsConfig.Enable || sm.config.HlsConfig.EnableHttps ||
+		sm.config.RtmpConfig.OverHttpConfig.Enable || sm.config.RtmpConfig.OverHttpConfig.EnableHttps ||
+		sm.config.RtspConfig.OverHttpConfig.Enable || sm.config.RtspConfig.OverHttpConfig.EnableHttps ||
+		sm.config.RtspConfig.OverWebSocketConfig.Enable || sm.config.RtspConfig.OverWebSocketConfig.EnableHttps {
 		sm.httpServerManager = base.NewHttpServerManager()
 		sm.httpServerHandler = NewHttpServerHandler(sm)
 		sm.hlsServerHandler = hls.NewServerHandler(sm.config.HlsConfig.OutPath, sm.config.HlsConfig.UrlPattern, sm.config.HlsConfig.SubSessionHashKey, sm.config.HlsConfig.SubSessionTimeoutMs, sm)
@@ -139,6 +149,36 @@ Doc: %s
 	if sm.config.RtspConfig.RtspsEnable {
 		sm.rtspsServer = rtsp.NewServer(sm.config.RtspConfig.RtspsAddr, sm, sm.config.RtspConfig.ServerAuthConfig)
 	}
+	if sm.config.RtspConfig.SessionTimeoutSec > 0 {
+		if sm.rtspServer != nil {
+			sm.rtspServer.WithSessionTimeoutSec(sm.config.RtspConfig.SessionTimeoutSec)
+		}
+		if sm.rtspsServer != nil {
+			sm.rtspsServer.WithSessionTimeoutSec(sm.config.RtspConfig.SessionTimeoutSec)
+		}
+	}
+	if sm.config.RtspConfig.MulticastConfig.Enable {
+		// 注意，rtsp和rtsps共享组播地址，同一路流只发送一份数据
+		multicastManager, err := rtsp.NewMulticastManager(sm.config.RtspConfig.MulticastConfig)
+		if err != nil {
+			Log.Errorf("create rtsp multicast manager failed, multicast disabled. err=%+v", err)
+		} else {
+			if sm.rtspServer != nil {
+				sm.rtspServer.WithMulticastManager(multicastManager)
+			}
+			if sm.rtspsServer != nil {
+				sm.rtspsServer.WithMulticastManager(multicastManager)
+			}
+		}
+	}
+	if sm.httpServerHandler != nil && sm.rtspServer != nil {
+		if sm.config.RtspConfig.OverHttpConfig.Enable || sm.config.RtspConfig.OverHttpConfig.EnableHttps {
+			sm.httpServerHandler.WithRtspHttpTunnelHandler(sm.rtspServer.ServeHttpTunnel)
+		}
+		if sm.config.RtspConfig.OverWebSocketConfig.Enable || sm.config.RtspConfig.OverWebSocketConfig.EnableHttps {
+			sm.httpServerHandler.WithRtspWebSocketHandler(sm.rtspServer.ServeWebSocket)
+		}
+	}
 	if sm.config.HttpApiConfig.Enable {
 		sm.httpApiServer = NewHttpApiServer(sm.config.HttpApiConfig.Addr, sm)
 	}
@@ -150,6 +190,24 @@ Doc: %s
 	if sm.option.Authentication == nil {
 		sm.option.Authentication = NewSimpleAuthCtx(sm.config.SimpleAuthConfig)
 	}
+	if sm.rtspServer != nil || sm.rtspsServer != nil {
+		authenticator := newRtspAuthenticator(sm.option.Authentication, sm.config)
+		if sm.rtspServer != nil {
+			sm.rtspServer.WithAuthenticator(authenticator)
+		}
+		if sm.rtspsServer != nil {
+			sm.rtspsServer.WithAuthenticator(authenticator)
+		}
+	}
+	if sm.rtmpServer != nil || sm.rtmpsServer != nil {
+		authenticator := newRtmpAuthenticator(sm.option.Authentication, sm.config)
+		if sm.rtmpServer != nil {
+			sm.rtmpServer.WithAuthenticator(authenticator)
+		}
+		if sm.rtmpsServer != nil {
+			sm.rtmpsServer.WithAuthenticator(authenticator)
+		}
+	}
 
 	return sm
 }
@@ -213,6 +271,29 @@ func (sm *ServerManager) RunLoop() error {
 	if err := addMux(sm.config.HlsConfig.CommonHttpServerConfig, sm.serveHls, "hls"); err != nil {
 		return err
 	}
+	// RTMPT的请求路径是固定的，为每个路径单独注册
+	if sm.rtmpServer == nil && (sm.config.RtmpConfig.OverHttpConfig.Enable || sm.config.RtmpConfig.OverHttpConfig.EnableHttps) {
+		Log.Warnf("rtmp over http need rtmp enable.")
+	} else if sm.rtmpServer != nil {
+		for _, pattern := range rtmp.RtmptUrlPatterns {
+			config := sm.config.RtmpConfig.OverHttpConfig
+			config.UrlPattern += pattern
+			if err := addMux(config, sm.rtmpServer.ServeRtmpt, "rtmp over http"); err != nil {
+				return err
+			}
+		}
+	}
+	// 注意，使用和httpflv、httpts相同的处理函数，从而允许和它们使用相同的监听地址以及url pattern
+	if sm.rtspServer == nil && (sm.config.RtspConfig.OverHttpConfig.Enable || sm.config.RtspConfig.OverHttpConfig.EnableHttps) {
+		Log.Warnf("rtsp over http need rtsp enable.")
+	} else if err := addMux(sm.config.RtspConfig.OverHttpConfig, sm.httpServerHandler.ServeSubSession, "rtsp over http"); err != nil {
+		return err
+	}
+	if sm.rtspServer == nil && (sm.config.RtspConfig.OverWebSocketConfig.Enable || sm.config.RtspConfig.OverWebSocketConfig.EnableHttps) {
+		Log.Warnf("rtsp over websocket need rtsp enable.")
+	} else if err := addMux(sm.config.RtspConfig.OverWebSocketConfig, sm.httpServerHandler.ServeSubSession, "rtsp over websocket"); err != nil {
+		return err
+	}
 
 	if sm.httpServerManager != nil {
 		go func() {
@@ -404,17 +485,29 @@ func (sm *ServerManager) WithOnHookSession(onHookSession func(uniqueKey string,
 
 // ----- implement rtmp.IServerObserver interface -----------------------------------------------------------------------
 
-func (sm *ServerManager) OnRtmpConnect(session *rtmp.ServerSession, opa rtmp.ObjectPairArray) {
-	sm.mutex.Lock()
-	defer sm.mutex.Unlock()
-
+func (sm *ServerManager) OnRtmpConnect(session *rtmp.ServerSession, opa rtmp.ObjectPairArray) error {
 	var info base.RtmpConnectInfo
 	info.SessionId = session.UniqueKey()
 	info.RemoteAddr = session.GetStat().RemoteAddr
-	info.App, _ = opa.FindString("app")
+	// 使用session中的app，鉴权参数已经去掉
+	info.App = session.AppName()
 	info.FlashVer, _ = opa.FindString("flashVer")
 	info.TcUrl, _ = opa.FindString("tcUrl")
+	info.SwfUrl, _ = opa.FindString("swfUrl")
+	info.PageUrl, _ = opa.FindString("pageUrl")
+	info.Args = opa.ToMap()
+
+	// 注意，业务方的回调可能比较耗时（比如请求鉴权服务），不持有锁
+	if h, ok := sm.option.Authentication.(IRtmpConnectAuthentication); ok {
+		if err := h.OnRtmpConnect(info); err != nil {
+			return err
+		}
+	}
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
 	sm.nhOnRtmpConnect(info)
+	return nil
 }
 
 func (sm *ServerManager) OnNewRtmpPubSession(session *rtmp.ServerSession) error {
@@ -458,6 +551,10 @@ func (sm *ServerManager) OnDelRtmpPubSession(session *rtmp.ServerSession) {
 }
 
 func (sm *ServerManager) OnNewRtmpSubSession(session *rtmp.ServerSession) error {
+	if filename := sm.rtmpVodFilename(session); filename != "" {
+		return sm.onNewRtmpVodSubSession(session, filename)
+	}
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
@@ -481,6 +578,11 @@ func (sm *ServerManager) OnDelRtmpSubSession(session *rtmp.ServerSession) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
+	if session.IsVod() {
+		sm.nhOnSubStop(base.Session2SubStopInfo(session))
+		return
+	}
+
 	group := sm.getGroup(session.AppName(), session.StreamName())
 	if group == nil {
 		return
@@ -620,6 +722,10 @@ func (sm *ServerManager) OnDelRtspPubSession(session *rtsp.PubSession) {
 }
 
 func (sm *ServerManager) OnNewRtspSubSessionDescribe(session *rtsp.SubSession) (ok bool, sdp []byte) {
+	if sm.config.RtspConfig.VodConfig.Enable && session.AppName() == sm.config.RtspConfig.VodConfig.AppName {
+		return sm.onNewRtspVodDescribe(session)
+	}
+
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
@@ -654,6 +760,11 @@ func (sm *ServerManager) OnNewRtspSubSessionPlay(session *rtsp.SubSession) error
 func (sm *ServerManager) OnDelRtspSubSession(session *rtsp.SubSession) {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
+	if session.IsVod() {
+		sm.nhOnSubStop(base.Session2SubStopInfo(session))
+		return
+	}
+
 	group := sm.getGroup(session.AppName(), session.StreamName())
 	if group == nil {
 		return
@@ -667,6 +778,89 @@ func (sm *ServerManager) OnDelRtspSubSession(session *rtsp.SubSession) {
 	sm.nhOnSubStop(info)
 }
 
+func (sm *ServerManager) onNewRtspVodDescribe(session *rtsp.SubSession) (ok bool, sdp []byte) {
+	info := base.Session2SubStartInfo(session)
+
+	sm.mutex.Lock()
+	err := sm.option.Authentication.OnSubStart(info)
+	sm.mutex.Unlock()
+	if err != nil {
+		return false, nil
+	}
+
+	// 只允许访问录制目录下的flv文件
+	name := session.StreamName()
+	if filepath.Base(name) != name || filepath.Ext(name) != ".flv" {
+		Log.Warnf("[%s] invalid vod file name. name=%s", session.UniqueKey(), name)
+		return false, nil
+	}
+
+	// 注意，打开时需要扫描整个文件，不持有锁
+	vod := newRtspVodSession(filepath.Join(sm.config.RecordConfig.FlvOutPath, name), session)
+	if sdp, err = vod.Open(); err != nil {
+		Log.Warnf("[%s] open vod failed. err=%+v", session.UniqueKey(), err)
+		return false, nil
+	}
+	session.SetVodObserver(vod)
+
+	sm.mutex.Lock()
+	sm.nhOnSubStart(info)
+	sm.mutex.Unlock()
+	return true, sdp
+}
+
+// rtmpVodFilename 拉流对应的点播文件，不播放点播文件时返回空字符串
+func (sm *ServerManager) rtmpVodFilename(session *rtmp.ServerSession) string {
+	if !sm.config.RtmpConfig.VodConfig.Enable || !session.PlayArgs().AllowVod() {
+		return ""
+	}
+
+	// 只允许访问点播目录下的flv文件
+	name := session.StreamName()
+	if filepath.Ext(name) != ".flv" {
+		name += ".flv"
+	}
+	if filepath.Base(name) != name {
+		Log.Warnf("[%s] invalid vod file name. name=%s", session.UniqueKey(), name)
+		return ""
+	}
+
+	dir := sm.config.RtmpConfig.VodConfig.Dir
+	if dir == "" {
+		dir = sm.config.RecordConfig.FlvOutPath
+	}
+	filename := filepath.Join(dir, name)
+	if _, err := os.Stat(filename); err != nil {
+		return ""
+	}
+	return filename
+}
+
+func (sm *ServerManager) onNewRtmpVodSubSession(session *rtmp.ServerSession, filename string) error {
+	info := base.Session2SubStartInfo(session)
+
+	sm.mutex.Lock()
+	err := sm.option.Authentication.OnSubStart(info)
+	sm.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 注意，打开时需要扫描整个文件，不持有锁
+	vod := newRtmpVodSession(filename, session)
+	if err = vod.Open(); err != nil {
+		Log.Warnf("[%s] open vod failed. err=%+v", session.UniqueKey(), err)
+		return err
+	}
+	session.SetVodObserver(vod)
+	vod.Start(session.PlayArgs())
+
+	sm.mutex.Lock()
+	sm.nhOnSubStart(info)
+	sm.mutex.Unlock()
+	return nil
+}
+
 func (sm *ServerManager) OnNewHlsSubSession(session *hls.SubSession) error {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
@@ -761,6 +955,10 @@ func (sm *ServerManager) OnRelayPullStop(info base.PullStopInfo) {
 	sm.nhOnRelayPullStop(info)
 }
 
+func (sm *ServerManager) OnPsPubStop(info base.PubStopInfo) {
+	sm.nhOnPubStop(info)
+}
+
 func (sm *ServerManager) OnHlsMakeTs(info base.HlsMakeTsInfo) {
 	sm.nhOnHlsMakeTs(info)
 }
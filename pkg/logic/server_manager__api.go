@@ -11,6 +11,7 @@ package logic
 import (
 	"github.com/q191201771/naza/pkg/bininfo"
 	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/gb28181"
 	"math"
 )
 
@@ -139,9 +140,67 @@ func (sm *ServerManager) CtrlStartRtpPub(info base.ApiCtrlStartRtpPubReq) (ret b
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
+	if info.StreamName == "" {
+		sdpInfo, err := gb28181.ParseInviteSdp([]byte(info.Sdp))
+		if err != nil || !sdpInfo.IsPlayback() || info.DeviceId == "" {
+			Log.Warnf("generate stream name failed. sdp info=%+v, device id=%s, err=%+v", sdpInfo, info.DeviceId, err)
+			ret.ErrorCode = base.ErrorCodeParamMissing
+			ret.Desp = base.DespParamMissing
+			return
+		}
+		info.StreamName = gb28181.PlaybackStreamName(info.DeviceId, sdpInfo.ChannelId, sdpInfo.StartTime, sdpInfo.EndTime)
+	}
+
 	// 注意，如果group不存在，我们依然relay pull
 	g := sm.getOrCreateGroup("", info.StreamName)
 	ret = g.StartRtpPub(info)
 
 	return
 }
+
+// CtrlRtpPubMansRtsp gb28181回放控制，sip服务将INFO中的MANSRTSP透传给lal
+func (sm *ServerManager) CtrlRtpPubMansRtsp(info base.ApiCtrlRtpPubMansRtspReq) (ret base.ApiCtrlRtpPubMansRtspResp) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	msg, err := gb28181.ParseMansRtsp([]byte(info.Body))
+	if err != nil {
+		ret.ErrorCode = base.ErrorCodeParamMissing
+		ret.Desp = err.Error()
+		return
+	}
+
+	g := sm.getGroup("", info.StreamName)
+	if g == nil {
+		ret.ErrorCode = base.ErrorCodeGroupNotFound
+		ret.Desp = base.DespGroupNotFound
+		return
+	}
+
+	if !g.HandleMansRtsp(msg) {
+		ret.ErrorCode = base.ErrorCodeSessionNotFound
+		ret.Desp = base.DespSessionNotFound
+		return
+	}
+
+	ret.ErrorCode = base.ErrorCodeSucc
+	ret.Desp = base.DespSucc
+	return
+}
+
+// CtrlStartRtpTalk gb28181语音广播、对讲，将group中的音频发送给设备
+func (sm *ServerManager) CtrlStartRtpTalk(info base.ApiCtrlStartRtpTalkReq) (ret base.ApiCtrlStartRtpTalkResp) {
+	sm.mutex.Lock()
+	g := sm.getGroup("", info.StreamName)
+	sm.mutex.Unlock()
+
+	if g == nil {
+		ret.ErrorCode = base.ErrorCodeGroupNotFound
+		ret.Desp = base.DespGroupNotFound
+		return
+	}
+	// 注意，StartRtpTalk可能阻塞建连，不能持有sm.mutex
+	ret = g.StartRtpTalk(info)
+
+	return
+}
@@ -68,7 +68,11 @@ var (
 	StaticRelayPullTimeoutMs             = 10000
 
 	DefaultApiCtrlStartRtpPubReqTimeoutMs = 60000
+	DefaultApiCtrlStartRtpPubReqJitterBufferMs = 500
 	DefaultApiCtrlStartRelayPullReqPullTimeoutMs = 10000
+
+	// RtspPullUdpFallbackTimeoutMs rtsp_mode为 base.RtspModeAuto 时，udp拉流多长时间没有收到rtp包则切换为tcp
+	RtspPullUdpFallbackTimeoutMs = 3000
 )
 
 // 注意，这是配置文件中静态回源的配置值，不是HTTP-API的默认值
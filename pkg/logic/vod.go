@@ -0,0 +1,89 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package logic
+
+import (
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+)
+
+// vodIndex 点播录制的flv文件时，打开文件时扫描整个文件得到的索引，rtsp和rtmp点播共用
+type vodIndex struct {
+	seekPoints []vodSeekPoint // 有视频时为视频关键帧，否则为间隔1秒的音频帧
+	firstTs    int64
+	durationMs int64
+}
+
+type vodSeekPoint struct {
+	ms     int64 // 相对于文件开头
+	offset int64 // 在文件中的位置，见 httpflv.FlvFileReader Tell
+}
+
+// scanVodFile 从当前位置开始读取到文件结尾，建立索引
+//
+// @param onTag: 读取到的每个tag（包括metadata），回调结束后，内部不再使用tag
+func scanVodFile(reader *httpflv.FlvFileReader, onTag func(tag httpflv.Tag)) (idx vodIndex) {
+	var (
+		lastTs      int64
+		audioPoints []vodSeekPoint
+	)
+	idx.firstTs = -1
+	for {
+		offset, err := reader.Tell()
+		if err != nil {
+			break
+		}
+		// 注意，正在录制的文件，最后一个tag可能不完整
+		tag, err := reader.ReadTag()
+		if err != nil {
+			break
+		}
+
+		onTag(tag)
+		if tag.IsMetadata() {
+			continue
+		}
+
+		ts := int64(tag.Header.Timestamp)
+		if idx.firstTs == -1 {
+			idx.firstTs = ts
+		}
+		ms := ts - idx.firstTs
+		if ms < 0 {
+			ms = 0
+		}
+		if tag.IsVideoKeyNalu() {
+			idx.seekPoints = append(idx.seekPoints, vodSeekPoint{ms: ms, offset: offset})
+		} else if tag.Header.Type == httpflv.TagTypeAudio && !tag.IsAacSeqHeader() {
+			if len(audioPoints) == 0 || ms-audioPoints[len(audioPoints)-1].ms >= 1000 {
+				audioPoints = append(audioPoints, vodSeekPoint{ms: ms, offset: offset})
+			}
+		}
+		if ts > lastTs {
+			lastTs = ts
+		}
+	}
+
+	if len(idx.seekPoints) == 0 {
+		idx.seekPoints = audioPoints
+	}
+	idx.durationMs = lastTs - idx.firstTs
+	return
+}
+
+// findSeekPoint 返回位置在`ms`之前的最后一个seek点
+func (idx *vodIndex) findSeekPoint(ms int64) *vodSeekPoint {
+	point := &idx.seekPoints[0]
+	for i := range idx.seekPoints {
+		if idx.seekPoints[i].ms > ms {
+			break
+		}
+		point = &idx.seekPoints[i]
+	}
+	return point
+}
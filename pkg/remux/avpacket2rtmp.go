@@ -9,13 +9,17 @@
 package remux
 
 import (
+	"bytes"
+
 	"github.com/ysjhlnu/lal/pkg/aac"
+	"github.com/ysjhlnu/lal/pkg/av1"
 	"github.com/ysjhlnu/lal/pkg/avc"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/hevc"
 	"github.com/ysjhlnu/lal/pkg/rtmp"
 	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 	"github.com/ysjhlnu/lal/pkg/sdp"
+	"github.com/ysjhlnu/lal/pkg/vp9"
 	"github.com/q191201771/naza/pkg/bele"
 )
 
@@ -39,6 +43,11 @@ type AvPacket2RtmpRemuxer struct {
 	sps []byte
 	pps []byte
 
+	av1SeqHeaderObu []byte // 最近一次发送的AV1 sequence header OBU
+	vp9Record       []byte // 最近一次发送的VP9 vpcC
+
+	hasEmittedOpusHead bool
+
 	hasAdts2Asc bool
 }
 
@@ -73,6 +82,13 @@ func (r *AvPacket2RtmpRemuxer) OnRtpPacket(pkt rtprtcp.RtpPacket) {
 	// noop
 }
 func (r *AvPacket2RtmpRemuxer) OnSdp(sdpCtx sdp.LogicContext) {
+	// AV1和VP9的编码参数在rtp数据包中带内传输，这里只记录类型，用于metadata
+	if t := sdpCtx.GetVideoPayloadTypeBase(); t == base.AvPacketPtAv1 || t == base.AvPacketPtVp9 {
+		r.videoType = t
+	}
+	if sdpCtx.GetAudioPayloadTypeBase() == base.AvPacketPtOpus {
+		r.audioType = base.AvPacketPtOpus
+	}
 	r.InitWithAvConfig(sdpCtx.Asc, sdpCtx.Vps, sdpCtx.Sps, sdpCtx.Pps)
 }
 func (r *AvPacket2RtmpRemuxer) OnAvPacket(pkt base.AvPacket) {
@@ -106,14 +122,14 @@ func (r *AvPacket2RtmpRemuxer) InitWithAvConfig(asc, vps, sps, pps []byte) {
 		return
 	}
 
-	if r.audioType != base.AvPacketPtUnknown {
+	if r.audioType == base.AvPacketPtAac {
 		bAsh, err = aac.MakeAudioDataSeqHeaderWithAsc(asc)
 		if err != nil {
 			Log.Errorf("build aac seq header failed. err=%+v", err)
 			return
 		}
 	}
-	if r.videoType != base.AvPacketPtUnknown {
+	if r.videoType == base.AvPacketPtAvc || r.videoType == base.AvPacketPtHevc {
 		if r.videoType == base.AvPacketPtHevc {
 			bVsh, err = hevc.BuildSeqHeaderFromVpsSpsPps(vps, sps, pps)
 			if err != nil {
@@ -129,11 +145,11 @@ func (r *AvPacket2RtmpRemuxer) InitWithAvConfig(asc, vps, sps, pps []byte) {
 		}
 	}
 
-	if r.audioType != base.AvPacketPtUnknown {
+	if bAsh != nil {
 		r.emitRtmpAvMsg(true, bAsh, 0)
 	}
 
-	if r.videoType != base.AvPacketPtUnknown {
+	if bVsh != nil {
 		r.emitRtmpAvMsg(false, bVsh, 0)
 	}
 }
@@ -145,6 +161,8 @@ func (r *AvPacket2RtmpRemuxer) InitWithAvConfig(asc, vps, sps, pps []byte) {
 // @param pkt:
 //   - 如果是aac，格式是裸数据或带adts头，具体取决于前面的配置。
 //   - 如果是h264，格式是avcc或Annexb，具体取决于前面的配置。
+//   - 如果是av1，格式是Low Overhead Bitstream Format的TU。
+//   - 如果是vp9，格式是一个frame或superframe。
 //     内部不持有该内存块。
 func (r *AvPacket2RtmpRemuxer) FeedAvPacket(pkt base.AvPacket) {
 	switch pkt.PayloadType {
@@ -322,6 +340,15 @@ func (r *AvPacket2RtmpRemuxer) FeedAvPacket(pkt base.AvPacket) {
 		copy(payload[1:], pkt.Payload)
 		r.emitRtmpAvMsg(true, payload, pkt.Timestamp)
 
+	case base.AvPacketPtAv1:
+		r.feedAv1(pkt)
+
+	case base.AvPacketPtVp9:
+		r.feedVp9(pkt)
+
+	case base.AvPacketPtOpus:
+		r.feedOpus(pkt)
+
 	default:
 		Log.Warnf("unsupported packet. type=%d", pkt.PayloadType)
 	}
@@ -336,12 +363,19 @@ func (r *AvPacket2RtmpRemuxer) emitRtmpAvMsg(isAudio bool, payload []byte, times
 		videocodecid := -1
 		if r.audioType == base.AvPacketPtAac {
 			audiocodecid = int(base.RtmpSoundFormatAac)
+		} else if r.audioType == base.AvPacketPtOpus {
+			audiocodecid = int(bele.BeUint32([]byte(base.RtmpExFourCcOpus)))
 		}
 		switch r.videoType {
 		case base.AvPacketPtAvc:
 			videocodecid = int(base.RtmpCodecIdAvc)
 		case base.AvPacketPtHevc:
 			videocodecid = int(base.RtmpCodecIdHevc)
+		case base.AvPacketPtAv1:
+			// enhanced-rtmp中videocodecid为FourCC
+			videocodecid = int(bele.BeUint32([]byte(base.RtmpExFourCcAv1)))
+		case base.AvPacketPtVp9:
+			videocodecid = int(bele.BeUint32([]byte(base.RtmpExFourCcVp9)))
 		}
 		bMetadata, err := rtmp.BuildMetadata(-1, -1, audiocodecid, videocodecid)
 		if err != nil {
@@ -379,6 +413,112 @@ func (r *AvPacket2RtmpRemuxer) emitRtmpAvMsg(isAudio bool, payload []byte, times
 	r.onRtmpMsg(msg)
 }
 
+// feedAv1 TU中的sequence header OBU发生变化时发送enhanced-rtmp av01的SequenceStart
+func (r *AvPacket2RtmpRemuxer) feedAv1(pkt base.AvPacket) {
+	r.videoType = base.AvPacketPtAv1
+
+	var seqHeaderObu []byte
+	err := av1.IterateObu(pkt.Payload, func(obu []byte) {
+		if seqHeaderObu == nil && av1.ParseObuType(obu[0]) == av1.ObuTypeSequenceHeader {
+			seqHeaderObu = obu
+		}
+	})
+	if err != nil {
+		Log.Errorf("iterate obu failed. err=%+v", err)
+		return
+	}
+
+	if seqHeaderObu != nil && !bytes.Equal(seqHeaderObu, r.av1SeqHeaderObu) {
+		bVsh, err := av1.BuildSeqHeaderFromSequenceHeaderObu(seqHeaderObu)
+		if err != nil {
+			Log.Errorf("build av1 seq header failed. err=%+v", err)
+			return
+		}
+		r.emitRtmpAvMsg(false, bVsh, pkt.Timestamp)
+		r.av1SeqHeaderObu = append(r.av1SeqHeaderObu[:0], seqHeaderObu...)
+	}
+
+	// 还没有收到sequence header，解码端无法解码，丢弃
+	if r.av1SeqHeaderObu == nil {
+		return
+	}
+
+	frameType := base.RtmpExFrameTypeInterFrame
+	if av1.IsKeyTemporalUnit(pkt.Payload) {
+		frameType = base.RtmpExFrameTypeKeyFrame
+	}
+	r.emitRtmpAvMsg(false, packEnhancedCodedFrames(frameType, base.RtmpExFourCcAv1, pkt.Payload), pkt.Timestamp)
+}
+
+// feedVp9 关键帧的编码参数发生变化时发送enhanced-rtmp vp09的SequenceStart
+func (r *AvPacket2RtmpRemuxer) feedVp9(pkt base.AvPacket) {
+	r.videoType = base.AvPacketPtVp9
+
+	isKey := vp9.IsKeyFrame(pkt.Payload)
+	if isKey {
+		bVsh, err := vp9.BuildSeqHeaderFromKeyFrame(pkt.Payload)
+		if err != nil {
+			Log.Errorf("build vp9 seq header failed. err=%+v", err)
+			return
+		}
+		if !bytes.Equal(bVsh[5:], r.vp9Record) {
+			r.emitRtmpAvMsg(false, bVsh, pkt.Timestamp)
+			r.vp9Record = append(r.vp9Record[:0], bVsh[5:]...)
+		}
+	}
+
+	if r.vp9Record == nil {
+		return
+	}
+
+	frameType := base.RtmpExFrameTypeInterFrame
+	if isKey {
+		frameType = base.RtmpExFrameTypeKeyFrame
+	}
+	r.emitRtmpAvMsg(false, packEnhancedCodedFrames(frameType, base.RtmpExFourCcVp9, pkt.Payload), pkt.Timestamp)
+}
+
+// feedOpus 以enhanced-rtmp Opus格式输出，第一帧前发送OpusHead作为SequenceStart
+func (r *AvPacket2RtmpRemuxer) feedOpus(pkt base.AvPacket) {
+	r.audioType = base.AvPacketPtOpus
+
+	if !r.hasEmittedOpusHead {
+		r.emitRtmpAvMsg(true, packEnhancedAudio(base.RtmpExAudioPacketTypeSequenceStart, base.RtmpExFourCcOpus, makeOpusHead()), pkt.Timestamp)
+		r.hasEmittedOpusHead = true
+	}
+	r.emitRtmpAvMsg(true, packEnhancedAudio(base.RtmpExAudioPacketTypeCodedFrames, base.RtmpExFourCcOpus, pkt.Payload), pkt.Timestamp)
+}
+
+// makeOpusHead rfc7845 5.1，rtp中没有OpusHead，rfc7587规定sdp中固定为48000/2，这里使用2声道，mapping family 0
+func makeOpusHead() []byte {
+	b := make([]byte, 19)
+	copy(b, "OpusHead")
+	b[8] = 1 // version
+	b[9] = 2 // channel count
+	// pre-skip为0
+	bele.LePutUint32(b[12:], 48000)
+	// output gain和mapping family为0
+	return b
+}
+
+// packEnhancedAudio 生成enhanced-rtmp非multitrack的音频消息
+func packEnhancedAudio(packetType uint8, fourCc string, data []byte) []byte {
+	payload := make([]byte, 5+len(data))
+	payload[0] = base.RtmpSoundFormatExHeader<<4 | packetType
+	copy(payload[1:], fourCc)
+	copy(payload[5:], data)
+	return payload
+}
+
+// packEnhancedCodedFrames 生成不带CompositionTime的enhanced-rtmp CodedFrames
+func packEnhancedCodedFrames(frameType uint8, fourCc string, data []byte) []byte {
+	payload := make([]byte, 5+len(data))
+	payload[0] = 0x80 | frameType<<4 | base.RtmpExPacketTypeCodedFrames
+	copy(payload[1:], fourCc)
+	copy(payload[5:], data)
+	return payload
+}
+
 func (r *AvPacket2RtmpRemuxer) setVps(b []byte) {
 	r.vps = r.vps[0:0]
 	r.vps = append(r.vps, b...)
@@ -12,8 +12,14 @@ import (
 	"encoding/hex"
 	"testing"
 
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/av1"
+	"github.com/ysjhlnu/lal/pkg/avc"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/remux"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
 )
 
 // #85
@@ -89,3 +95,209 @@ func TestCase2(t *testing.T) {
 		remuxer.FeedAvPacket(p)
 	}
 }
+
+// AV1和VP9: AvPacket -> enhanced-rtmp -> rtsp
+func TestCaseAv1Vp9(t *testing.T) {
+	seqHeaderPayload, _ := hex.DecodeString("00000042abbfc377ffee010000")
+	seqHeaderObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeSequenceHeader}, seqHeaderPayload, true)
+	keyFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, []byte{0x10, 0x01, 0x02}, true)
+	interFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, []byte{0x30, 0x01, 0x02}, true)
+
+	vp9KeyFrame := []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x4f, 0xf0, 0x2c, 0xf0, 0x00, 0x00}
+	vp9InterFrame := []byte{0x86, 0x00, 0x40, 0x92}
+
+	cases := []struct {
+		pt      base.AvPacketPt
+		fourCc  string
+		packets [][]byte
+	}{
+		{
+			pt:     base.AvPacketPtAv1,
+			fourCc: base.RtmpExFourCcAv1,
+			packets: [][]byte{
+				interFrameObu, // 没有sequence header，丢弃
+				append(append([]byte{}, seqHeaderObu...), keyFrameObu...),
+				interFrameObu,
+			},
+		},
+		{
+			pt:     base.AvPacketPtVp9,
+			fourCc: base.RtmpExFourCcVp9,
+			packets: [][]byte{
+				vp9InterFrame, // 没有关键帧，丢弃
+				vp9KeyFrame,
+				vp9InterFrame,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		var msgs []base.RtmpMsg
+		remuxer := remux.NewAvPacket2RtmpRemuxer().WithOnRtmpMsg(func(msg base.RtmpMsg) {
+			msgs = append(msgs, msg.Clone())
+		})
+		for i, p := range c.packets {
+			remuxer.FeedAvPacket(base.AvPacket{
+				Timestamp:   int64(i * 40),
+				PayloadType: c.pt,
+				Payload:     p,
+			})
+		}
+
+		// metadata, seq header, 关键帧, 非关键帧
+		assert.Equal(t, 4, len(msgs))
+		assert.Equal(t, base.RtmpTypeIdMetadata, msgs[0].Header.MsgTypeId)
+		assert.Equal(t, true, msgs[1].IsVideoKeySeqHeader())
+		assert.Equal(t, true, msgs[2].IsVideoKeyNalu())
+		assert.Equal(t, false, msgs[3].IsVideoKeyNalu())
+		assert.Equal(t, c.fourCc, string(msgs[3].Payload[1:5]))
+		assert.Equal(t, c.packets[2], msgs[3].Payload[5:])
+		assert.Equal(t, uint32(80), msgs[3].Pts())
+
+		var sdpCtx sdp.LogicContext
+		var rtpPkts []rtprtcp.RtpPacket
+		rtspRemuxer := remux.NewRtmp2RtspRemuxer(func(ctx sdp.LogicContext) {
+			sdpCtx = ctx
+		}, func(pkt rtprtcp.RtpPacket) {
+			rtpPkts = append(rtpPkts, pkt)
+		})
+		for _, msg := range msgs {
+			rtspRemuxer.FeedRtmpMsg(msg)
+		}
+		for i := 0; i < 16; i++ {
+			rtspRemuxer.FeedRtmpMsg(msgs[3])
+		}
+		assert.Equal(t, c.pt, sdpCtx.GetVideoPayloadTypeBase())
+		assert.Equal(t, 18, len(rtpPkts))
+		if c.pt == base.AvPacketPtAv1 {
+			assert.Equal(t, true, rtprtcp.IsAv1Boundary(rtpPkts[0]))
+		} else {
+			assert.Equal(t, true, rtprtcp.IsVp9Boundary(rtpPkts[0]))
+		}
+	}
+}
+
+func TestCaseOpus(t *testing.T) {
+	var msgs []base.RtmpMsg
+	remuxer := remux.NewAvPacket2RtmpRemuxer().WithOnRtmpMsg(func(msg base.RtmpMsg) {
+		msgs = append(msgs, msg.Clone())
+	})
+	frame := []byte{0xfc, 0x01, 0x02, 0x03}
+	for i := 0; i < 2; i++ {
+		remuxer.FeedAvPacket(base.AvPacket{
+			Timestamp:   int64(i * 20),
+			PayloadType: base.AvPacketPtOpus,
+			Payload:     frame,
+		})
+	}
+
+	// metadata, OpusHead, 2帧
+	assert.Equal(t, 4, len(msgs))
+	assert.Equal(t, base.RtmpTypeIdMetadata, msgs[0].Header.MsgTypeId)
+	assert.Equal(t, true, msgs[1].IsExAudioSeqHeader())
+	assert.Equal(t, "OpusHead", string(msgs[1].Payload[5:13]))
+	assert.Equal(t, base.RtmpSoundFormatOpus, msgs[2].AudioCodecId())
+	assert.Equal(t, frame, msgs[3].Payload[5:])
+
+	var sdpCtx sdp.LogicContext
+	var rtpPkts []rtprtcp.RtpPacket
+	rtspRemuxer := remux.NewRtmp2RtspRemuxer(func(ctx sdp.LogicContext) {
+		sdpCtx = ctx
+	}, func(pkt rtprtcp.RtpPacket) {
+		rtpPkts = append(rtpPkts, pkt)
+	})
+	for _, msg := range msgs {
+		rtspRemuxer.FeedRtmpMsg(msg)
+	}
+	for i := 0; i < 16; i++ {
+		rtspRemuxer.FeedRtmpMsg(msgs[3])
+	}
+	assert.Equal(t, base.AvPacketPtOpus, sdpCtx.GetAudioPayloadTypeBase())
+	assert.Equal(t, 48000, sdpCtx.AudioClockRate)
+	assert.Equal(t, 18, len(rtpPkts))
+	assert.Equal(t, frame, rtpPkts[0].Body())
+}
+
+func TestCaseMultitrack2Rtsp(t *testing.T) {
+	sps, _ := hex.DecodeString("6764001facd9405005bb016a020202800001f480007530078c18cb")
+	pps, _ := hex.DecodeString("68ebecb22c")
+	vsh, err := avc.BuildSeqHeaderFromSpsPps(sps, pps)
+	assert.Equal(t, nil, err)
+	record := vsh[5:]
+	asc := []byte{0x12, 0x10}
+	opusHead := []byte{'O', 'p', 'u', 's', 'H', 'e', 'a', 'd', 1, 2, 0, 0, 0x80, 0xbb, 0, 0, 0, 0, 0}
+	nalu := []byte{0, 0, 0, 3, 0x65, 0x88, 0x84}
+
+	u24 := func(n int) []byte {
+		return []byte{byte(n >> 16), byte(n >> 8), byte(n)}
+	}
+	// ManyTracks，track 0和track 1都是avc1
+	packVideo := func(frameType, packetType uint8, data []byte) base.RtmpMsg {
+		b := []byte{0x80 | frameType<<4 | base.RtmpExPacketTypeMultitrack, base.RtmpExMultitrackTypeManyTracks<<4 | packetType}
+		b = append(b, base.RtmpExFourCcAvc...)
+		for trackId := 0; trackId < 2; trackId++ {
+			b = append(b, byte(trackId))
+			b = append(b, u24(len(data))...)
+			b = append(b, data...)
+		}
+		return base.RtmpMsg{Header: base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo, MsgLen: uint32(len(b))}, Payload: b}
+	}
+	// ManyTracksManyCodecs，track 0是mp4a，track 1是Opus
+	packAudio := func(packetType uint8, aac, opus []byte) base.RtmpMsg {
+		b := []byte{base.RtmpSoundFormatExHeader<<4 | base.RtmpExAudioPacketTypeMultitrack, base.RtmpExMultitrackTypeManyTracksManyCodecs<<4 | packetType}
+		b = append(b, base.RtmpExFourCcAac...)
+		b = append(b, 0)
+		b = append(b, u24(len(aac))...)
+		b = append(b, aac...)
+		b = append(b, base.RtmpExFourCcOpus...)
+		b = append(b, 1)
+		b = append(b, u24(len(opus))...)
+		b = append(b, opus...)
+		return base.RtmpMsg{Header: base.RtmpHeader{MsgTypeId: base.RtmpTypeIdAudio, MsgLen: uint32(len(b))}, Payload: b}
+	}
+
+	vshMsg := packVideo(base.RtmpExFrameTypeKeyFrame, base.RtmpExPacketTypeSequenceStart, record)
+	ashMsg := packAudio(base.RtmpExAudioPacketTypeSequenceStart, asc, opusHead)
+	keyMsg := packVideo(base.RtmpExFrameTypeKeyFrame, base.RtmpExPacketTypeCodedFrames, append([]byte{0, 0, 0}, nalu...))
+	audioMsg := packAudio(base.RtmpExAudioPacketTypeCodedFrames, []byte{0x21, 0x00}, []byte{0xfc, 0x01})
+
+	// 默认track
+	m, ok := vshMsg.DefaultTrackMsg()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, vsh, m.Payload)
+	m, ok = keyMsg.DefaultTrackMsg()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, m.IsAvcKeyNalu())
+	m, ok = ashMsg.DefaultTrackMsg()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, true, m.IsAacSeqHeader())
+
+	var sdpCtx sdp.LogicContext
+	var rtpPkts []rtprtcp.RtpPacket
+	trackIndex2Count := make(map[int]int)
+	rtspRemuxer := remux.NewRtmp2RtspRemuxer(func(ctx sdp.LogicContext) {
+		sdpCtx = ctx
+	}, func(pkt rtprtcp.RtpPacket) {
+		rtpPkts = append(rtpPkts, pkt)
+	}).WithOnTrackRtpPacket(func(trackIndex int, pkt rtprtcp.RtpPacket) {
+		trackIndex2Count[trackIndex]++
+	})
+	rtspRemuxer.FeedRtmpMsg(vshMsg)
+	rtspRemuxer.FeedRtmpMsg(ashMsg)
+	for i := 0; i < 10; i++ {
+		rtspRemuxer.FeedRtmpMsg(keyMsg)
+		rtspRemuxer.FeedRtmpMsg(audioMsg)
+	}
+
+	assert.Equal(t, base.AvPacketPtAvc, sdpCtx.GetVideoPayloadTypeBase())
+	assert.Equal(t, base.AvPacketPtAac, sdpCtx.GetAudioPayloadTypeBase())
+	extra := sdpCtx.ExtraTracks()
+	assert.Equal(t, 2, len(extra))
+	assert.Equal(t, base.AvPacketPtAvc, extra[0].PayloadTypeBase)
+	assert.Equal(t, base.AvPacketPtOpus, extra[1].PayloadTypeBase)
+	// 默认track的数据在分析阶段被缓存，非默认track的数据在分析阶段被丢弃
+	assert.Equal(t, 20, len(rtpPkts))
+	assert.Equal(t, 2, len(trackIndex2Count))
+	assert.Equal(t, 2, trackIndex2Count[extra[0].Index])
+	assert.Equal(t, 2, trackIndex2Count[extra[1].Index])
+}
@@ -9,13 +9,16 @@
 package remux
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 // GopCache
 //
 // 提供两个功能:
-//  1. 缓存Metadata, VideoSeqHeader, AacSeqHeader
+//  1. 缓存Metadata, VideoSeqHeader, AacSeqHeader, 以及enhanced-rtmp multitrack的seq header
 //  2. 缓存音视频GOP数据
 //
 // 以下，只讨论GopCache的第2点功能
@@ -50,14 +53,25 @@ import (
 //
 // GetGopCount: 0         |   1           |   1           |
 // -----
+//
+// 缓存的内存块为 base.RefBuffer ，GopCache对每个缓存的内存块持有一个引用，被替换、淘汰或者 Clear 时释放。
+// 以[]byte为参数的函数是对应Ref函数的包装，内存块由调用方分配时使用。
 type GopCache struct {
 	t         string
 	uniqueKey string
 
+	// 注意，和对应的Ref函数（比如 VideoSeqHeaderRef ）指向同一个内存块，只在GopCache下次修改之前有效
 	MetadataEnsureWithSetDataFrame    []byte
 	MetadataEnsureWithoutSetDataFrame []byte
 	VideoSeqHeader                    []byte
-	AacSeqHeader                      []byte
+	AacSeqHeader                      []byte // 注意，enhanced-rtmp的音频SequenceStart（比如Opus）也缓存在这里
+
+	metadataEnsureWithSetDataFrameRef    *base.RefBuffer
+	metadataEnsureWithoutSetDataFrameRef *base.RefBuffer
+	videoSeqHeaderRef                    *base.RefBuffer
+	aacSeqHeaderRef                      *base.RefBuffer
+
+	multitrackSeqHeaders []multitrackSeqHeader
 
 	gopRing              []Gop
 	gopRingFirst         int
@@ -86,17 +100,36 @@ func NewGopCache(t string, uniqueKey string, gopNum int, singleGopMaxFrameNum in
 type LazyGet func() []byte
 
 func (gc *GopCache) SetMetadata(w []byte, wo []byte) {
+	wrb, worb := wrapOrNil(w), wrapOrNil(wo)
+	gc.SetMetadataRef(wrb, worb)
+	releaseOrNil(wrb)
+	releaseOrNil(worb)
+}
+
+// SetMetadataRef
+//
+// 注意，内部持有`w`和`wo`的引用，调用方仍然负责释放自己的引用
+func (gc *GopCache) SetMetadataRef(w *base.RefBuffer, wo *base.RefBuffer) {
 	// TODO(chef): [refactor] 将metadata等缓存逻辑从GopCache中移除 202207
 
-	gc.MetadataEnsureWithSetDataFrame = w
-	gc.MetadataEnsureWithoutSetDataFrame = wo
+	replaceRefBytes(&gc.metadataEnsureWithSetDataFrameRef, &gc.MetadataEnsureWithSetDataFrame, w)
+	replaceRefBytes(&gc.metadataEnsureWithoutSetDataFrameRef, &gc.MetadataEnsureWithoutSetDataFrame, wo)
 	Log.Debugf("[%s] cache %s metadata. size:%d", gc.uniqueKey, gc.t, len(gc.MetadataEnsureWithSetDataFrame))
 }
 
 // Feed
 //
-// @param lg: 内部可能持有lg返回的内存块
+// @param b: 内部可能持有`b`内存块
 func (gc *GopCache) Feed(msg base.RtmpMsg, b []byte) bool {
+	rb := base.WrapRefBuffer(b)
+	defer rb.Release()
+	return gc.FeedRef(msg, rb)
+}
+
+// FeedRef
+//
+// @param b: 需要缓存时，内部持有`b`的一个引用，调用方仍然负责释放自己的引用
+func (gc *GopCache) FeedRef(msg base.RtmpMsg, b *base.RefBuffer) bool {
 	// TODO(chef): [refactor] 重构lg两个参数这种方式 202207
 
 	switch msg.Header.MsgTypeId {
@@ -104,15 +137,23 @@ func (gc *GopCache) Feed(msg base.RtmpMsg, b []byte) bool {
 		// noop
 		return true
 	case base.RtmpTypeIdAudio:
-		if msg.IsAacSeqHeader() {
-			gc.AacSeqHeader = b
-			Log.Debugf("[%s] cache %s aac seq header. size:%d", gc.uniqueKey, gc.t, len(gc.AacSeqHeader))
+		if msg.IsMultitrackSeqHeader() {
+			gc.feedMultitrackSeqHeader(msg, b)
+			return true
+		}
+		if msg.IsAacSeqHeader() || msg.IsExAudioSeqHeader() {
+			replaceRefBytes(&gc.aacSeqHeaderRef, &gc.AacSeqHeader, b)
+			Log.Debugf("[%s] cache %s aac seq header. size:%d", gc.uniqueKey, gc.t, b.Len())
 			return true
 		}
 	case base.RtmpTypeIdVideo:
+		if msg.IsMultitrackSeqHeader() {
+			gc.feedMultitrackSeqHeader(msg, b)
+			return true
+		}
 		if msg.IsVideoKeySeqHeader() {
-			gc.VideoSeqHeader = b
-			Log.Debugf("[%s] cache %s video seq header. size:%d", gc.uniqueKey, gc.t, len(gc.VideoSeqHeader))
+			replaceRefBytes(&gc.videoSeqHeaderRef, &gc.VideoSeqHeader, b)
+			Log.Debugf("[%s] cache %s video seq header. size:%d", gc.uniqueKey, gc.t, b.Len())
 			return true
 		}
 	}
@@ -127,23 +168,110 @@ func (gc *GopCache) Feed(msg base.RtmpMsg, b []byte) bool {
 	return true
 }
 
+func (gc *GopCache) MetadataEnsureWithSetDataFrameRef() *base.RefBuffer {
+	return gc.metadataEnsureWithSetDataFrameRef
+}
+
+func (gc *GopCache) MetadataEnsureWithoutSetDataFrameRef() *base.RefBuffer {
+	return gc.metadataEnsureWithoutSetDataFrameRef
+}
+
+func (gc *GopCache) VideoSeqHeaderRef() *base.RefBuffer {
+	return gc.videoSeqHeaderRef
+}
+
+func (gc *GopCache) AacSeqHeaderRef() *base.RefBuffer {
+	return gc.aacSeqHeaderRef
+}
+
 // GetGopCount 获取GOP数量，注意，最后一个可能是不完整的
 func (gc *GopCache) GetGopCount() int {
 	return (gc.gopRingLast + gc.gopSize - gc.gopRingFirst) % gc.gopSize
 }
 
 func (gc *GopCache) GetGopDataAt(pos int) [][]byte {
+	rbs := gc.GetGopDataRefAt(pos)
+	if rbs == nil {
+		return nil
+	}
+	ret := make([][]byte, len(rbs))
+	for i, rb := range rbs {
+		ret[i] = rb.Bytes()
+	}
+	return ret
+}
+
+// GetGopDataRefAt
+//
+// 注意，返回的内存块由GopCache持有，需要在GopCache下次修改后继续持有的一方，自己调用 base.RefBuffer.Ref
+func (gc *GopCache) GetGopDataRefAt(pos int) []*base.RefBuffer {
 	if pos >= gc.GetGopCount() || pos < 0 {
 		return nil
 	}
 	return gc.gopRing[(pos+gc.gopRingFirst)%gc.gopSize].data
 }
 
+// GetGopSendItemTypesAt 获取 GetGopDataRefAt 中每个内存块在发送队列中的类型
+func (gc *GopCache) GetGopSendItemTypesAt(pos int) []base.SendItemType {
+	if pos >= gc.GetGopCount() || pos < 0 {
+		return nil
+	}
+	return gc.gopRing[(pos+gc.gopRingFirst)%gc.gopSize].types
+}
+
+// GetMultitrackSeqHeaders 获取缓存的enhanced-rtmp multitrack seq header，按到达顺序排列
+func (gc *GopCache) GetMultitrackSeqHeaders() [][]byte {
+	var ret [][]byte
+	for _, item := range gc.multitrackSeqHeaders {
+		ret = append(ret, item.b.Bytes())
+	}
+	return ret
+}
+
+// GetMultitrackSeqHeaderRefs 和 GetMultitrackSeqHeaders 相同，内存块的持有方式和 GetGopDataRefAt 相同
+func (gc *GopCache) GetMultitrackSeqHeaderRefs() []*base.RefBuffer {
+	var ret []*base.RefBuffer
+	for _, item := range gc.multitrackSeqHeaders {
+		ret = append(ret, item.b)
+	}
+	return ret
+}
+
+// Clone 深拷贝缓存结构，缓存的内存块是共享的，新的GopCache对每个内存块持有自己的引用
+func (gc *GopCache) Clone() *GopCache {
+	ret := *gc
+	ret.metadataEnsureWithSetDataFrameRef = refOrNil(gc.metadataEnsureWithSetDataFrameRef)
+	ret.metadataEnsureWithoutSetDataFrameRef = refOrNil(gc.metadataEnsureWithoutSetDataFrameRef)
+	ret.videoSeqHeaderRef = refOrNil(gc.videoSeqHeaderRef)
+	ret.aacSeqHeaderRef = refOrNil(gc.aacSeqHeaderRef)
+	ret.multitrackSeqHeaders = append([]multitrackSeqHeader{}, gc.multitrackSeqHeaders...)
+	for _, item := range ret.multitrackSeqHeaders {
+		item.b.Ref()
+	}
+	ret.gopRing = make([]Gop, gc.gopSize)
+	for i := 0; i < gc.GetGopCount(); i++ {
+		pos := (i + gc.gopRingFirst) % gc.gopSize
+		for _, rb := range gc.gopRing[pos].data {
+			ret.gopRing[pos].data = append(ret.gopRing[pos].data, rb.Ref())
+		}
+		ret.gopRing[pos].types = append([]base.SendItemType(nil), gc.gopRing[pos].types...)
+	}
+	return &ret
+}
+
+// Clear 清空缓存，并释放持有的引用
 func (gc *GopCache) Clear() {
-	gc.MetadataEnsureWithSetDataFrame = nil
-	gc.MetadataEnsureWithoutSetDataFrame = nil
-	gc.VideoSeqHeader = nil
-	gc.AacSeqHeader = nil
+	replaceRefBytes(&gc.metadataEnsureWithSetDataFrameRef, &gc.MetadataEnsureWithSetDataFrame, nil)
+	replaceRefBytes(&gc.metadataEnsureWithoutSetDataFrameRef, &gc.MetadataEnsureWithoutSetDataFrame, nil)
+	replaceRefBytes(&gc.videoSeqHeaderRef, &gc.VideoSeqHeader, nil)
+	replaceRefBytes(&gc.aacSeqHeaderRef, &gc.AacSeqHeader, nil)
+	for _, item := range gc.multitrackSeqHeaders {
+		item.b.Release()
+	}
+	gc.multitrackSeqHeaders = nil
+	for i := range gc.gopRing {
+		gc.gopRing[i].Clear()
+	}
 	gc.gopRingLast = 0
 	gc.gopRingFirst = 0
 }
@@ -154,11 +282,11 @@ func (gc *GopCache) Clear() {
 //
 // 往最后一个GOP元素追加一个msg
 // 注意，如果GopCache为空，则不缓存msg
-func (gc *GopCache) feedLastGop(msg base.RtmpMsg, b []byte) bool {
+func (gc *GopCache) feedLastGop(msg base.RtmpMsg, b *base.RefBuffer) bool {
 	if !gc.isGopRingEmpty() {
 		gopPos := (gc.gopRingLast - 1 + gc.gopSize) % gc.gopSize
 		if gc.gopRing[gopPos].len() <= gc.singleGopMaxFrameNum || gc.singleGopMaxFrameNum == 0 {
-			gc.gopRing[gopPos].Feed(msg, b)
+			gc.gopRing[gopPos].FeedRef(msg, b)
 		} else {
 			return false
 		}
@@ -169,15 +297,42 @@ func (gc *GopCache) feedLastGop(msg base.RtmpMsg, b []byte) bool {
 // feedNewGop
 //
 // 生成一个最新的GOP元素，并往里追加一个msg
-func (gc *GopCache) feedNewGop(msg base.RtmpMsg, b []byte) {
+func (gc *GopCache) feedNewGop(msg base.RtmpMsg, b *base.RefBuffer) {
 	if gc.isGopRingFull() {
+		// 淘汰最老的GOP
+		gc.gopRing[gc.gopRingFirst].Clear()
 		gc.gopRingFirst = (gc.gopRingFirst + 1) % gc.gopSize
 	}
 	gc.gopRing[gc.gopRingLast].Clear()
-	gc.gopRing[gc.gopRingLast].Feed(msg, b)
+	gc.gopRing[gc.gopRingLast].FeedRef(msg, b)
 	gc.gopRingLast = (gc.gopRingLast + 1) % gc.gopSize
 }
 
+// feedMultitrackSeqHeader
+//
+// 音视频类型和track相同（包括FourCC）的seq header只保留最新的
+func (gc *GopCache) feedMultitrackSeqHeader(msg base.RtmpMsg, b *base.RefBuffer) {
+	tracks, err := msg.ParseTracks()
+	if err != nil {
+		Log.Warnf("[%s] parse %s multitrack seq header failed. err=%+v", gc.uniqueKey, gc.t, err)
+		return
+	}
+	ids := make([]string, len(tracks))
+	for i, t := range tracks {
+		ids[i] = fmt.Sprintf("%s/%d", t.FourCc, t.TrackId)
+	}
+	key := fmt.Sprintf("%d:%s", msg.Header.MsgTypeId, strings.Join(ids, ","))
+
+	Log.Debugf("[%s] cache %s multitrack seq header. key:%s, size:%d", gc.uniqueKey, gc.t, key, b.Len())
+	for i := range gc.multitrackSeqHeaders {
+		if gc.multitrackSeqHeaders[i].key == key {
+			replaceRef(&gc.multitrackSeqHeaders[i].b, b)
+			return
+		}
+	}
+	gc.multitrackSeqHeaders = append(gc.multitrackSeqHeaders, multitrackSeqHeader{key: key, b: b.Ref()})
+}
+
 func (gc *GopCache) isGopRingFull() bool {
 	return (gc.gopRingLast+1)%gc.gopSize == gc.gopRingFirst
 }
@@ -188,19 +343,81 @@ func (gc *GopCache) isGopRingEmpty() bool {
 
 // ---------------------------------------------------------------------------------------------------------------------
 
+// replaceRef 持有`rb`的引用（`rb`可以为nil），并释放`dst`原来持有的引用
+func replaceRef(dst **base.RefBuffer, rb *base.RefBuffer) {
+	if *dst != nil {
+		(*dst).Release()
+	}
+	*dst = refOrNil(rb)
+}
+
+// replaceRefBytes 和 replaceRef 相同，同时将`dstBytes`修改为`rb`的内存块
+func replaceRefBytes(dst **base.RefBuffer, dstBytes *[]byte, rb *base.RefBuffer) {
+	replaceRef(dst, rb)
+	if rb == nil {
+		*dstBytes = nil
+	} else {
+		*dstBytes = rb.Bytes()
+	}
+}
+
+func refOrNil(rb *base.RefBuffer) *base.RefBuffer {
+	if rb == nil {
+		return nil
+	}
+	return rb.Ref()
+}
+
+func releaseOrNil(rb *base.RefBuffer) {
+	if rb != nil {
+		rb.Release()
+	}
+}
+
+func wrapOrNil(b []byte) *base.RefBuffer {
+	if b == nil {
+		return nil
+	}
+	return base.WrapRefBuffer(b)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type multitrackSeqHeader struct {
+	key string
+	b   *base.RefBuffer
+}
+
 type Gop struct {
-	data [][]byte
+	data  []*base.RefBuffer
+	types []base.SendItemType // 和data一一对应，见 base.SendItemTypeOfRtmpMsg
 }
 
 // Feed
 //
 // @param b: 内部持有`b`内存块
 func (g *Gop) Feed(msg base.RtmpMsg, b []byte) {
-	g.data = append(g.data, b)
+	rb := base.WrapRefBuffer(b)
+	g.FeedRef(msg, rb)
+	rb.Release()
 }
 
+// FeedRef
+//
+// @param b: 内部持有`b`的一个引用
+func (g *Gop) FeedRef(msg base.RtmpMsg, b *base.RefBuffer) {
+	g.data = append(g.data, b.Ref())
+	g.types = append(g.types, base.SendItemTypeOfRtmpMsg(msg))
+}
+
+// Clear 清空，并释放持有的引用
 func (g *Gop) Clear() {
+	for i, rb := range g.data {
+		rb.Release()
+		g.data[i] = nil
+	}
 	g.data = g.data[:0]
+	g.types = g.types[:0]
 }
 func (g *Gop) len() int {
 	return len(g.data)
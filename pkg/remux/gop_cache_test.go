@@ -118,3 +118,44 @@ func TestGopCache_Feed(t *testing.T) {
 	assert.Equal(t, [][]byte{{1, 4}, {0, 4}}, nc.GetGopDataAt(2))
 	assert.Equal(t, nil, nc.GetGopDataAt(3))
 }
+
+func TestGopCache_Multitrack(t *testing.T) {
+	// 视频，OneTrack，trackId=1
+	vsh1 := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: []byte{0x80 | 0x10 | 6, 0x00, 'a', 'v', 'c', '1', 1, 0x01},
+	}
+	// 视频，OneTrack，trackId=2
+	vsh2 := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: []byte{0x80 | 0x10 | 6, 0x00, 'a', 'v', 'c', '1', 2, 0x02},
+	}
+	// 音频Opus，非multitrack
+	ash := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdAudio},
+		Payload: []byte{0x90, 'O', 'p', 'u', 's', 0x03},
+	}
+	// 视频关键帧，OneTrack，trackId=1
+	key := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: []byte{0x80 | 0x10 | 6, 0x01, 'a', 'v', 'c', '1', 1, 0, 0, 0, 0x04},
+	}
+
+	gc := NewGopCache("rtmp", "test", 2, 0)
+	gc.Feed(vsh1, []byte{1})
+	gc.Feed(vsh2, []byte{2})
+	gc.Feed(vsh1, []byte{3})
+	gc.Feed(ash, []byte{4})
+	gc.Feed(key, []byte{5})
+	assert.Equal(t, [][]byte{{3}, {2}}, gc.GetMultitrackSeqHeaders())
+	assert.Equal(t, []byte{4}, gc.AacSeqHeader)
+	assert.Equal(t, nil, gc.VideoSeqHeader)
+	assert.Equal(t, 1, gc.GetGopCount())
+
+	clone := gc.Clone()
+	gc.Clear()
+	assert.Equal(t, nil, gc.GetMultitrackSeqHeaders())
+	assert.Equal(t, 0, gc.GetGopCount())
+	assert.Equal(t, [][]byte{{3}, {2}}, clone.GetMultitrackSeqHeaders())
+	assert.Equal(t, [][]byte{{5}}, clone.GetGopDataAt(0))
+}
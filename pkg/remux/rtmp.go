@@ -37,10 +37,13 @@ func MakeDefaultRtmpHeader(in base.RtmpHeader) (out base.RtmpHeader) {
 // ---------------------------------------------------------------------------------------------------------------------
 
 // LazyRtmpChunkDivider 在必要时，有且仅有一次做切分成chunk的操作
+//
+// 切分后的内存块来自内存池，由 LazyRtmpChunkDivider 持有一个引用，使用完毕后调用 Release 。
+// 注意，Get系列函数返回的内存块只在 Release 之前有效，需要继续持有的一方应该使用 Get...Ref 并调用 base.RefBuffer.Ref 。
 type LazyRtmpChunkDivider struct {
 	msg              base.RtmpMsg
-	chunksWithSdf    []byte
-	chunksWithoutSdf []byte
+	chunksWithSdf    *base.RefBuffer
+	chunksWithoutSdf *base.RefBuffer
 }
 
 func (lcd *LazyRtmpChunkDivider) Init(msg base.RtmpMsg) {
@@ -48,37 +51,47 @@ func (lcd *LazyRtmpChunkDivider) Init(msg base.RtmpMsg) {
 }
 
 func (lcd *LazyRtmpChunkDivider) GetEnsureWithSdf() []byte {
+	return lcd.GetEnsureWithSdfRef().Bytes()
+}
+
+func (lcd *LazyRtmpChunkDivider) GetEnsureWithoutSdf() []byte {
+	return lcd.GetEnsureWithoutSdfRef().Bytes()
+}
+
+func (lcd *LazyRtmpChunkDivider) GetEnsureWithSdfRef() *base.RefBuffer {
 	if lcd.chunksWithSdf == nil {
-		var msg []byte
-		if lcd.msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
-			msg2 := lcd.msg.Clone()
-			msg2.Payload, _ = rtmp.MetadataEnsureWithSdf(msg2.Payload)
-			msg2.Header.MsgLen = uint32(len(msg2.Payload))
-			msg2.Header = MakeDefaultRtmpHeader(msg2.Header)
-			lcd.chunksWithSdf = rtmp.Message2Chunks(msg2.Payload, &msg2.Header)
-		} else {
-			msg = lcd.msg.Payload
-			h := MakeDefaultRtmpHeader(lcd.msg.Header)
-			lcd.chunksWithSdf = rtmp.Message2Chunks(msg, &h)
-		}
+		lcd.chunksWithSdf = lcd.divide(rtmp.MetadataEnsureWithSdf)
 	}
 	return lcd.chunksWithSdf
 }
 
-func (lcd *LazyRtmpChunkDivider) GetEnsureWithoutSdf() []byte {
+func (lcd *LazyRtmpChunkDivider) GetEnsureWithoutSdfRef() *base.RefBuffer {
 	if lcd.chunksWithoutSdf == nil {
-		var msg []byte
-		if lcd.msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
-			msg2 := lcd.msg.Clone()
-			msg2.Payload, _ = rtmp.MetadataEnsureWithoutSdf(msg2.Payload)
-			msg2.Header.MsgLen = uint32(len(msg2.Payload))
-			msg2.Header = MakeDefaultRtmpHeader(msg2.Header)
-			lcd.chunksWithoutSdf = rtmp.Message2Chunks(msg2.Payload, &msg2.Header)
-		} else {
-			msg = lcd.msg.Payload
-			h := MakeDefaultRtmpHeader(lcd.msg.Header)
-			lcd.chunksWithoutSdf = rtmp.Message2Chunks(msg, &h)
-		}
+		lcd.chunksWithoutSdf = lcd.divide(rtmp.MetadataEnsureWithoutSdf)
 	}
 	return lcd.chunksWithoutSdf
 }
+
+// Release 释放内部持有的引用
+func (lcd *LazyRtmpChunkDivider) Release() {
+	if lcd.chunksWithSdf != nil {
+		lcd.chunksWithSdf.Release()
+		lcd.chunksWithSdf = nil
+	}
+	if lcd.chunksWithoutSdf != nil {
+		lcd.chunksWithoutSdf.Release()
+		lcd.chunksWithoutSdf = nil
+	}
+}
+
+func (lcd *LazyRtmpChunkDivider) divide(ensureMetadata func([]byte) ([]byte, error)) *base.RefBuffer {
+	if lcd.msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
+		msg2 := lcd.msg.Clone()
+		msg2.Payload, _ = ensureMetadata(msg2.Payload)
+		msg2.Header.MsgLen = uint32(len(msg2.Payload))
+		msg2.Header = MakeDefaultRtmpHeader(msg2.Header)
+		return rtmp.Message2ChunksRef(msg2.Payload, &msg2.Header)
+	}
+	h := MakeDefaultRtmpHeader(lcd.msg.Header)
+	return rtmp.Message2ChunksRef(lcd.msg.Payload, &h)
+}
@@ -9,22 +9,24 @@
 package remux
 
 import (
+	"github.com/ysjhlnu/lal/pkg/aac"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/h2645"
 )
 
 // TODO(chef): 该文件处于开发阶段，请不要直接使用
-// TODO(chef): 支持音频 202206
 
 // Rtmp2AvPacketRemuxer
 //
 // 用途：
 // - 将rtmp流中的视频转换成ffmpeg可解码的格式
+// - 将rtmp流中的音频转换成AvPacket，AAC为携带adts头的格式，G711直接透传
 type Rtmp2AvPacketRemuxer struct {
 	option     Rtmp2AvPacketRemuxerOption
 	onAvPacket func(pkt base.AvPacket, arg interface{})
 
 	spspps []byte // annexb格式
+	ascCtx *aac.AscContext
 }
 
 type Rtmp2AvPacketRemuxerOption struct {
@@ -60,6 +62,8 @@ func (r *Rtmp2AvPacketRemuxer) FeedRtmpMsg(msg base.RtmpMsg, arg interface{}) er
 	switch msg.Header.MsgTypeId {
 	case base.RtmpTypeIdVideo:
 		return r.feedVideo(msg, arg)
+	case base.RtmpTypeIdAudio:
+		return r.feedAudio(msg, arg)
 	}
 	return nil
 }
@@ -71,7 +75,12 @@ func (r *Rtmp2AvPacketRemuxer) feedVideo(msg base.RtmpMsg, arg interface{}) erro
 		return nil
 	}
 
-	isH264 := msg.VideoCodecId() == base.RtmpCodecIdAvc
+	codecId := msg.VideoCodecId()
+	if codecId != base.RtmpCodecIdAvc && codecId != base.RtmpCodecIdHevc {
+		// AV1、VP9等不支持
+		return nil
+	}
+	isH264 := codecId == base.RtmpCodecIdAvc
 
 	var err error
 	if msg.IsVideoKeySeqHeader() {
@@ -148,6 +157,53 @@ func (r *Rtmp2AvPacketRemuxer) feedVideo(msg base.RtmpMsg, arg interface{}) erro
 	return err
 }
 
+func (r *Rtmp2AvPacketRemuxer) feedAudio(msg base.RtmpMsg, arg interface{}) error {
+	if len(msg.Payload) <= 1 {
+		return nil
+	}
+
+	pkt := base.AvPacket{
+		Timestamp: int64(msg.Header.TimestampAbs),
+		Pts:       int64(msg.Header.TimestampAbs),
+	}
+
+	switch msg.AudioCodecId() {
+	case base.RtmpSoundFormatAac:
+		if len(msg.Payload) <= 2 {
+			return nil
+		}
+
+		var err error
+		if msg.IsAacSeqHeader() {
+			r.ascCtx, err = aac.NewAscContext(msg.Payload[2:])
+			return err
+		}
+		if r.ascCtx == nil {
+			// 还没有收到音频头，无法生成adts头
+			return nil
+		}
+
+		raw := msg.Payload[2:]
+		out := make([]byte, aac.AdtsHeaderLength+len(raw))
+		_ = r.ascCtx.PackToAdtsHeader(out, len(raw))
+		copy(out[aac.AdtsHeaderLength:], raw)
+
+		pkt.PayloadType = base.AvPacketPtAac
+		pkt.Payload = out
+	case base.RtmpSoundFormatG711A:
+		pkt.PayloadType = base.AvPacketPtG711A
+		pkt.Payload = append([]byte(nil), msg.Payload[1:]...)
+	case base.RtmpSoundFormatG711U:
+		pkt.PayloadType = base.AvPacketPtG711U
+		pkt.Payload = append([]byte(nil), msg.Payload[1:]...)
+	default:
+		return nil
+	}
+
+	r.onAvPacket(pkt, arg)
+	return nil
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 func defaultOnAvPacket(pkt base.AvPacket, arg interface{}) {
@@ -28,10 +28,12 @@ func RtmpMsg2FlvTag(msg base.RtmpMsg) *httpflv.Tag {
 // -------------------------------------------------------------------------------------------------------------------
 
 // LazyRtmpMsg2FlvTag 在必要时，有且仅有一次做转换操作
+//
+// 内存块的持有方式和 LazyRtmpChunkDivider 相同
 type LazyRtmpMsg2FlvTag struct {
 	msg base.RtmpMsg
 	//tagWithSdf []byte
-	tagWithoutSdf []byte
+	tagWithoutSdf *base.RefBuffer
 }
 
 func (l *LazyRtmpMsg2FlvTag) Init(msg base.RtmpMsg) {
@@ -45,14 +47,25 @@ func (l *LazyRtmpMsg2FlvTag) GetEnsureWithSdf() []byte {
 }
 
 func (l *LazyRtmpMsg2FlvTag) GetEnsureWithoutSdf() []byte {
+	return l.GetEnsureWithoutSdfRef().Bytes()
+}
+
+func (l *LazyRtmpMsg2FlvTag) GetEnsureWithoutSdfRef() *base.RefBuffer {
 	if l.tagWithoutSdf == nil {
-		if l.msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
-			msg2 := l.msg.Clone()
-			msg2.Payload, _ = rtmp.MetadataEnsureWithoutSdf(msg2.Payload)
-			l.tagWithoutSdf = RtmpMsg2FlvTag(msg2).Raw
-		} else {
-			l.tagWithoutSdf = RtmpMsg2FlvTag(l.msg).Raw
+		msg := l.msg
+		if msg.Header.MsgTypeId == base.RtmpTypeIdMetadata {
+			msg = l.msg.Clone()
+			msg.Payload, _ = rtmp.MetadataEnsureWithoutSdf(msg.Payload)
 		}
+		l.tagWithoutSdf = httpflv.PackHttpflvTagRef(msg.Header.MsgTypeId, msg.Header.TimestampAbs, msg.Payload)
 	}
 	return l.tagWithoutSdf
 }
+
+// Release 释放内部持有的引用
+func (l *LazyRtmpMsg2FlvTag) Release() {
+	if l.tagWithoutSdf != nil {
+		l.tagWithoutSdf.Release()
+		l.tagWithoutSdf = nil
+	}
+}
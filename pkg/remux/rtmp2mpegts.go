@@ -100,6 +100,8 @@ type Rtmp2MpegtsRemuxer struct {
 	audioCacheFirstFramePts uint64
 
 	opened bool
+
+	unsupportedVideoCodecLogged bool // 不支持的视频编码格式只打印一次日志
 }
 
 func NewRtmp2MpegtsRemuxer(observer IRtmp2MpegtsRemuxerObserver) *Rtmp2MpegtsRemuxer {
@@ -195,6 +197,11 @@ func (s *Rtmp2MpegtsRemuxer) feedVideo(msg base.RtmpMsg) {
 
 	codecId := msg.VideoCodecId()
 	if codecId != base.RtmpCodecIdAvc && codecId != base.RtmpCodecIdHevc {
+		// 比如AV1、VP9，mpegts（以及hls）只支持AVC和HEVC
+		if !s.unsupportedVideoCodecLogged {
+			s.unsupportedVideoCodecLogged = true
+			Log.Warnf("[%s] unsupported video codec in mpegts, drop video. codecId=%d", s.uk, codecId)
+		}
 		return
 	}
 
@@ -17,6 +17,7 @@ import (
 	"github.com/ysjhlnu/lal/pkg/rtmp"
 
 	"github.com/ysjhlnu/lal/pkg/aac"
+	"github.com/ysjhlnu/lal/pkg/av1"
 	"github.com/ysjhlnu/lal/pkg/avc"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/hevc"
@@ -35,12 +36,14 @@ var (
 
 // Rtmp2RtspRemuxer 提供rtmp数据向sdp+rtp数据的转换
 type Rtmp2RtspRemuxer struct {
-	onSdp       OnSdp
-	onRtpPacket OnRtpPacket
+	onSdp            OnSdp
+	onRtpPacket      OnRtpPacket
+	onTrackRtpPacket OnTrackRtpPacket
 
 	analyzeDone        bool
 	msgCache           []base.RtmpMsg
 	vps, sps, pps, asc []byte
+	av1SeqHeaderObu    []byte
 	audioPt            base.AvPacketPt
 	videoPt            base.AvPacketPt
 	audioSampleRate    int
@@ -49,11 +52,17 @@ type Rtmp2RtspRemuxer struct {
 	videoSsrc   uint32
 	audioPacker *rtprtcp.RtpPacker
 	videoPacker *rtprtcp.RtpPacker
+
+	multitrack  bool                   // 是否收到过enhanced-rtmp multitrack消息
+	extraTracks []*rtmp2RtspExtraTrack // enhanced-rtmp multitrack中的非默认track
 }
 
 type OnSdp func(sdpCtx sdp.LogicContext)
 type OnRtpPacket func(pkt rtprtcp.RtpPacket)
 
+// OnTrackRtpPacket @param trackIndex: 在sdp中的序号，见 sdp.TrackContext.Index
+type OnTrackRtpPacket func(trackIndex int, pkt rtprtcp.RtpPacket)
+
 // NewRtmp2RtspRemuxer @param onSdp:       每次回调为独立的内存块，回调结束后，内部不再使用该内存块
 // @param onRtpPacket: 每次回调为独立的内存块，回调结束后，内部不再使用该内存块
 func NewRtmp2RtspRemuxer(onSdp OnSdp, onRtpPacket OnRtpPacket) *Rtmp2RtspRemuxer {
@@ -66,10 +75,29 @@ func NewRtmp2RtspRemuxer(onSdp OnSdp, onRtpPacket OnRtpPacket) *Rtmp2RtspRemuxer
 	}
 }
 
+// WithOnTrackRtpPacket enhanced-rtmp multitrack中的非默认track，在sdp中作为单独的track，rtp数据通过该回调返回
+//
+// 不设置时，只转换默认track
+func (r *Rtmp2RtspRemuxer) WithOnTrackRtpPacket(onTrackRtpPacket OnTrackRtpPacket) *Rtmp2RtspRemuxer {
+	r.onTrackRtpPacket = onTrackRtpPacket
+	return r
+}
+
 // FeedRtmpMsg @param msg: 函数调用结束后，内部不持有`msg`内存块
 func (r *Rtmp2RtspRemuxer) FeedRtmpMsg(msg base.RtmpMsg) {
 	var err error
 
+	// multitrack消息，非默认track单独处理，默认track转换成非multitrack消息后走正常流程
+	if msg.IsMultitrack() {
+		r.multitrack = true
+		r.feedMultitrack(msg)
+
+		var ok bool
+		if msg, ok = msg.DefaultTrackMsg(); !ok {
+			return
+		}
+	}
+
 	switch msg.Header.MsgTypeId {
 	case base.RtmpTypeIdMetadata:
 		if meta, err := rtmp.ParseMetadata(msg.Payload); err == nil {
@@ -95,6 +123,10 @@ func (r *Rtmp2RtspRemuxer) FeedRtmpMsg(msg base.RtmpMsg) {
 				if r.audioSampleRate < 0 {
 					r.audioSampleRate = pcmDefaultSampleRate
 				}
+			case base.RtmpSoundFormatOpus:
+				// rfc7587，时钟频率固定为48000
+				r.audioPt = base.AvPacketPtOpus
+				r.audioSampleRate = 48000
 			}
 		}
 	case base.RtmpTypeIdVideo:
@@ -126,12 +158,33 @@ func (r *Rtmp2RtspRemuxer) FeedRtmpMsg(msg base.RtmpMsg) {
 			return
 		}
 
+		if msg.IsAv1KeySeqHeader() || msg.IsVp9KeySeqHeader() {
+			// AV1和VP9的编码参数在rtp数据包中带内传输，sdp中只需要确定类型
+			if msg.IsAv1KeySeqHeader() {
+				r.videoPt = base.AvPacketPtAv1
+				r.av1SeqHeaderObu, err = av1.ParseSequenceHeaderObuFromSeqHeader(msg.Clone().Payload)
+				if err != nil {
+					Log.Warnf("parse av1 sequence header obu failed. err=%+v", err)
+				}
+			} else {
+				r.videoPt = base.AvPacketPtVp9
+			}
+			r.doAnalyze()
+			return
+		}
+
 		if msg.IsAacSeqHeader() {
 			r.asc = msg.Clone().Payload[2:]
 			r.doAnalyze()
 			return
 		}
 
+		if msg.IsExAudioSeqHeader() {
+			// Opus的OpusHead不需要通过sdp传递
+			r.doAnalyze()
+			return
+		}
+
 		r.msgCache = append(r.msgCache, msg.Clone())
 		r.doAnalyze()
 		return
@@ -141,7 +194,7 @@ func (r *Rtmp2RtspRemuxer) FeedRtmpMsg(msg base.RtmpMsg) {
 
 	// 音视频头已通过sdp回调，rtp数据中不再包含音视频头
 	// TODO(chef): [opt] RtspRemuxerAddSpsPps2KeyFrameFlag 开启时，考虑更新sps 202207
-	if msg.IsAvcKeySeqHeader() || msg.IsHevcKeySeqHeader() || msg.IsAacSeqHeader() {
+	if msg.IsVideoKeySeqHeader() || msg.IsAacSeqHeader() || msg.IsExAudioSeqHeader() {
 		return
 	}
 
@@ -191,8 +244,10 @@ func (r *Rtmp2RtspRemuxer) doAnalyze() {
 			Asc:               r.asc,
 			SamplingFrequency: r.audioSampleRate,
 		}
-		ctx, err := sdp.Pack(videoInfo, audioInfo)
+		extraVideos, extraAudios := r.extraTrackInfos()
+		ctx, err := sdp.PackWithExtraTracks(videoInfo, audioInfo, extraVideos, extraAudios)
 		Log.Assert(nil, err)
+		r.bindExtraTracks(ctx)
 		r.onSdp(ctx)
 
 		// 分析阶段缓存的数据
@@ -209,7 +264,8 @@ func (r *Rtmp2RtspRemuxer) doAnalyze() {
 func (r *Rtmp2RtspRemuxer) isAnalyzeEnough() bool {
 	// 音视频头都收集好了
 	// 注意，这里故意只判断sps和pps，从而同时支持h264和2h65的情况
-	if r.sps != nil && r.pps != nil && r.asc != nil {
+	// multitrack时其他track的头可能在后面的消息中，所以等到分析包数阈值
+	if !r.multitrack && (r.sps != nil && r.pps != nil || r.isAv1OrVp9()) && (r.asc != nil || r.audioPt == base.AvPacketPtOpus) {
 		return true
 	}
 
@@ -228,17 +284,36 @@ func (r *Rtmp2RtspRemuxer) remux(msg base.RtmpMsg) {
 	case base.RtmpTypeIdAudio:
 		packer = r.getAudioPacker()
 		if packer != nil {
+			payload := msg.Payload[2:]
+			if r.audioPt == base.AvPacketPtOpus {
+				// enhanced-rtmp，FourCC后面直接是帧数据
+				if len(msg.Payload) <= 5 || msg.Payload[0]&0x0F != base.RtmpExAudioPacketTypeCodedFrames {
+					return
+				}
+				payload = msg.Payload[5:]
+			}
 			rtppkts = packer.Pack(base.AvPacket{
 				Timestamp:   int64(msg.Header.TimestampAbs),
 				PayloadType: r.audioPt,
-				Payload:     msg.Payload[2:],
+				Payload:     payload,
 			})
 		}
 	case base.RtmpTypeIdVideo:
 		packer = r.getVideoPacker()
 		if packer != nil {
 			var payload []byte
-			if msg.VideoCodecId() == base.RtmpCodecIdHevc && msg.IsEnchanedHevcNalu() {
+			if r.isAv1OrVp9() {
+				// av01和vp09只转发CodedFrames，帧数据前面没有CompositionTime
+				if !msg.IsExCodedFrames() || len(msg.Payload) <= 5 {
+					return
+				}
+				payload = msg.Payload[5:]
+
+				// rtp中没有带外的编码参数，关键帧中没有sequence header OBU时补上
+				if msg.IsAv1KeyFrame() && r.av1SeqHeaderObu != nil && !av1.HasSequenceHeaderObu(payload) {
+					payload = append(append([]byte{}, r.av1SeqHeaderObu...), payload...)
+				}
+			} else if msg.VideoCodecId() == base.RtmpCodecIdHevc && msg.IsEnchanedHevcNalu() {
 				index := msg.GetEnchanedHevcNaluIndex()
 				payload = msg.Payload[index:]
 			} else {
@@ -273,9 +348,8 @@ func (r *Rtmp2RtspRemuxer) getAudioPacker() *rtprtcp.RtpPacker {
 		r.audioSsrc = rand.Uint32()
 
 		switch r.audioPt {
-		case base.AvPacketPtG711A:
-			fallthrough
-		case base.AvPacketPtG711U:
+		case base.AvPacketPtG711A, base.AvPacketPtG711U, base.AvPacketPtOpus:
+			// Opus和G711一样，一个rtp包一帧
 			pp := rtprtcp.NewRtpPackerPayloadPcm()
 			r.audioPacker = rtprtcp.NewRtpPacker(pp, r.audioSampleRate, r.audioSsrc)
 		case base.AvPacketPtAac:
@@ -301,19 +375,31 @@ func (r *Rtmp2RtspRemuxer) getAudioPacker() *rtprtcp.RtpPacker {
 }
 
 func (r *Rtmp2RtspRemuxer) getVideoPacker() *rtprtcp.RtpPacker {
-	if r.sps == nil {
+	if r.sps == nil && !r.isAv1OrVp9() {
 		return nil
 	}
 	if r.videoPacker == nil {
 		r.videoSsrc = rand.Uint32()
-		pp := rtprtcp.NewRtpPackerPayloadAvcHevc(r.videoPt, func(option *rtprtcp.RtpPackerPayloadAvcHevcOption) {
-			option.Typ = rtprtcp.RtpPackerPayloadAvcHevcTypeAvcc
-		})
+		var pp rtprtcp.IRtpPackerPayload
+		switch r.videoPt {
+		case base.AvPacketPtAv1:
+			pp = rtprtcp.NewRtpPackerPayloadAv1()
+		case base.AvPacketPtVp9:
+			pp = rtprtcp.NewRtpPackerPayloadVp9()
+		default:
+			pp = rtprtcp.NewRtpPackerPayloadAvcHevc(r.videoPt, func(option *rtprtcp.RtpPackerPayloadAvcHevcOption) {
+				option.Typ = rtprtcp.RtpPackerPayloadAvcHevcTypeAvcc
+			})
+		}
 		r.videoPacker = rtprtcp.NewRtpPacker(pp, 90000, r.videoSsrc)
 	}
 	return r.videoPacker
 }
 
+func (r *Rtmp2RtspRemuxer) isAv1OrVp9() bool {
+	return r.videoPt == base.AvPacketPtAv1 || r.videoPt == base.AvPacketPtVp9
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
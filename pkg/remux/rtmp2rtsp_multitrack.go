@@ -0,0 +1,254 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"math/rand"
+
+	"github.com/ysjhlnu/lal/pkg/aac"
+	"github.com/ysjhlnu/lal/pkg/av1"
+	"github.com/ysjhlnu/lal/pkg/avc"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/hevc"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+// enhanced-rtmp multitrack中的非默认track
+//
+// 分析阶段收集各track的SequenceStart，生成sdp时作为单独的track追加在主视频、主音频后面。
+// 分析阶段结束后才出现的track，以及rtsp不支持的编码（比如FLAC、AC-3），直接丢弃。
+type rtmp2RtspExtraTrack struct {
+	msgTypeId uint8
+	trackId   uint8
+	fourCc    string
+
+	videoInfo       sdp.VideoInfo
+	audioInfo       sdp.AudioInfo
+	av1SeqHeaderObu []byte
+
+	index  int // 在sdp中的序号，-1表示没有进入sdp
+	packer *rtprtcp.RtpPacker
+}
+
+func (r *Rtmp2RtspRemuxer) feedMultitrack(msg base.RtmpMsg) {
+	if r.onTrackRtpPacket == nil {
+		return
+	}
+
+	tracks, err := msg.ParseTracks()
+	if err != nil {
+		Log.Warnf("parse multitrack failed. err=%+v, header=%+v", err, msg.Header)
+		return
+	}
+
+	for _, t := range tracks {
+		if t.TrackId == base.DefaultRtmpTrackId {
+			continue
+		}
+
+		et := r.findExtraTrack(msg.Header.MsgTypeId, t.TrackId)
+		if !r.analyzeDone {
+			if et == nil {
+				r.addExtraTrack(msg.Header, t)
+			}
+			// 分析阶段非默认track的帧数据直接丢弃
+			continue
+		}
+
+		if et == nil || et.index < 0 {
+			continue
+		}
+		r.remuxExtraTrack(msg.Header, et, t)
+	}
+}
+
+func (r *Rtmp2RtspRemuxer) addExtraTrack(header base.RtmpHeader, t base.RtmpTrack) {
+	et := &rtmp2RtspExtraTrack{
+		msgTypeId: header.MsgTypeId,
+		trackId:   t.TrackId,
+		fourCc:    t.FourCc,
+		index:     -1,
+	}
+
+	var err error
+	if header.MsgTypeId == base.RtmpTypeIdVideo {
+		if t.PacketType != base.RtmpExPacketTypeSequenceStart {
+			return
+		}
+		// 转换成非multitrack消息，复用已有的seq header解析逻辑
+		payload := t.ToRtmpMsg(header).Payload
+		switch t.FourCc {
+		case base.RtmpExFourCcAvc:
+			et.videoInfo.VideoPt = base.AvPacketPtAvc
+			et.videoInfo.Sps, et.videoInfo.Pps, err = avc.ParseSpsPpsFromSeqHeader(payload)
+		case base.RtmpExFourCcHevc:
+			et.videoInfo.VideoPt = base.AvPacketPtHevc
+			et.videoInfo.Vps, et.videoInfo.Sps, et.videoInfo.Pps, err = hevc.ParseVpsSpsPpsFromSeqHeader(payload)
+		case base.RtmpExFourCcAv1:
+			et.videoInfo.VideoPt = base.AvPacketPtAv1
+			et.av1SeqHeaderObu, err = av1.ParseSequenceHeaderObuFromSeqHeader(payload)
+		case base.RtmpExFourCcVp9:
+			et.videoInfo.VideoPt = base.AvPacketPtVp9
+		default:
+			Log.Warnf("unsupported multitrack video codec for rtsp, ignore. trackId=%d, fourCc=%s", t.TrackId, t.FourCc)
+			return
+		}
+	} else {
+		switch t.FourCc {
+		case base.RtmpExFourCcAac:
+			if t.PacketType != base.RtmpExAudioPacketTypeSequenceStart {
+				return
+			}
+			var ascCtx *aac.AscContext
+			if ascCtx, err = aac.NewAscContext(t.Data); err == nil {
+				et.audioInfo.SamplingFrequency, err = ascCtx.GetSamplingFrequency()
+			}
+			et.audioInfo.AudioPt = base.AvPacketPtAac
+			et.audioInfo.Asc = append([]byte{}, t.Data...)
+		case base.RtmpExFourCcOpus:
+			et.audioInfo.AudioPt = base.AvPacketPtOpus
+			et.audioInfo.SamplingFrequency = 48000
+		default:
+			Log.Warnf("unsupported multitrack audio codec for rtsp, ignore. trackId=%d, fourCc=%s", t.TrackId, t.FourCc)
+			return
+		}
+	}
+	if err != nil {
+		Log.Warnf("parse multitrack seq header failed, ignore. trackId=%d, fourCc=%s, err=%+v", t.TrackId, t.FourCc, err)
+		return
+	}
+
+	r.extraTracks = append(r.extraTracks, et)
+}
+
+// extraTrackInfos 顺序和 sdp.PackWithExtraTracks 中追加track的顺序一致
+func (r *Rtmp2RtspRemuxer) extraTrackInfos() (videos []sdp.VideoInfo, audios []sdp.AudioInfo) {
+	for _, et := range r.extraVideoAudioTracks() {
+		if et.msgTypeId == base.RtmpTypeIdVideo {
+			videos = append(videos, et.videoInfo)
+		} else {
+			audios = append(audios, et.audioInfo)
+		}
+	}
+	return
+}
+
+// bindExtraTracks 根据生成的sdp，确定每个track在sdp中的序号
+func (r *Rtmp2RtspRemuxer) bindExtraTracks(ctx sdp.LogicContext) {
+	ets := r.extraVideoAudioTracks()
+	sdpTracks := ctx.ExtraTracks()
+	if len(ets) != len(sdpTracks) {
+		// 比如没有主视频时，第一个非默认视频track会被sdp当成主视频
+		Log.Warnf("multitrack mismatch sdp, ignore extra tracks. tracks=%d, sdp tracks=%d", len(ets), len(sdpTracks))
+		return
+	}
+	for i, et := range ets {
+		et.index = sdpTracks[i].Index
+	}
+}
+
+func (r *Rtmp2RtspRemuxer) extraVideoAudioTracks() (ret []*rtmp2RtspExtraTrack) {
+	for _, et := range r.extraTracks {
+		if et.msgTypeId == base.RtmpTypeIdVideo {
+			ret = append(ret, et)
+		}
+	}
+	for _, et := range r.extraTracks {
+		if et.msgTypeId == base.RtmpTypeIdAudio {
+			ret = append(ret, et)
+		}
+	}
+	return
+}
+
+func (r *Rtmp2RtspRemuxer) findExtraTrack(msgTypeId uint8, trackId uint8) *rtmp2RtspExtraTrack {
+	for _, et := range r.extraTracks {
+		if et.msgTypeId == msgTypeId && et.trackId == trackId {
+			return et
+		}
+	}
+	return nil
+}
+
+func (r *Rtmp2RtspRemuxer) remuxExtraTrack(header base.RtmpHeader, et *rtmp2RtspExtraTrack, t base.RtmpTrack) {
+	if t.FourCc != et.fourCc {
+		return
+	}
+
+	var pt base.AvPacketPt
+	var payload []byte
+	if et.msgTypeId == base.RtmpTypeIdVideo {
+		pt = et.videoInfo.VideoPt
+		switch t.PacketType {
+		case base.RtmpExPacketTypeCodedFrames:
+			payload = t.Data
+			if pt == base.AvPacketPtAvc || pt == base.AvPacketPtHevc {
+				// 跳过CompositionTime
+				if len(payload) <= 3 {
+					return
+				}
+				payload = payload[3:]
+			}
+		case base.RtmpExPacketTypeCodedFramesX:
+			payload = t.Data
+		default:
+			return
+		}
+
+		if pt == base.AvPacketPtAv1 && t.FrameType == base.RtmpExFrameTypeKeyFrame &&
+			et.av1SeqHeaderObu != nil && !av1.HasSequenceHeaderObu(payload) {
+			payload = append(append([]byte{}, et.av1SeqHeaderObu...), payload...)
+		}
+	} else {
+		pt = et.audioInfo.AudioPt
+		if t.PacketType != base.RtmpExAudioPacketTypeCodedFrames {
+			return
+		}
+		payload = t.Data
+	}
+	if len(payload) == 0 {
+		return
+	}
+
+	if et.packer == nil {
+		et.packer = r.newExtraTrackPacker(et)
+	}
+	rtppkts := et.packer.Pack(base.AvPacket{
+		Timestamp:   int64(header.TimestampAbs),
+		PayloadType: pt,
+		Payload:     payload,
+	})
+	for i := range rtppkts {
+		r.onTrackRtpPacket(et.index, rtppkts[i])
+	}
+}
+
+func (r *Rtmp2RtspRemuxer) newExtraTrackPacker(et *rtmp2RtspExtraTrack) *rtprtcp.RtpPacker {
+	ssrc := rand.Uint32()
+	if et.msgTypeId == base.RtmpTypeIdAudio {
+		if et.audioInfo.AudioPt == base.AvPacketPtAac {
+			return rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadAac(), et.audioInfo.SamplingFrequency, ssrc)
+		}
+		return rtprtcp.NewRtpPacker(rtprtcp.NewRtpPackerPayloadPcm(), et.audioInfo.SamplingFrequency, ssrc)
+	}
+
+	var pp rtprtcp.IRtpPackerPayload
+	switch et.videoInfo.VideoPt {
+	case base.AvPacketPtAv1:
+		pp = rtprtcp.NewRtpPackerPayloadAv1()
+	case base.AvPacketPtVp9:
+		pp = rtprtcp.NewRtpPackerPayloadVp9()
+	default:
+		pp = rtprtcp.NewRtpPackerPayloadAvcHevc(et.videoInfo.VideoPt, func(option *rtprtcp.RtpPackerPayloadAvcHevcOption) {
+			option.Typ = rtprtcp.RtpPackerPayloadAvcHevcTypeAvcc
+		})
+	}
+	return rtprtcp.NewRtpPacker(pp, 90000, ssrc)
+}
@@ -0,0 +1,179 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package remux
+
+import (
+	"net"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/httpflv"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+func TestLazyRtmpChunkDivider(t *testing.T) {
+	msg := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgLen: 3, MsgTypeId: base.RtmpTypeIdVideo, TimestampAbs: 10},
+		Payload: []byte{0x17, 0x01, 0x00},
+	}
+	h := MakeDefaultRtmpHeader(msg.Header)
+
+	var lcd LazyRtmpChunkDivider
+	lcd.Init(msg)
+	rb := lcd.GetEnsureWithoutSdfRef()
+	assert.Equal(t, rtmp.Message2Chunks(msg.Payload, &h), rb.Bytes())
+	// 只切分一次
+	assert.Equal(t, true, rb == lcd.GetEnsureWithoutSdfRef())
+
+	gc := NewGopCache("rtmp", "test", 1, 0)
+	gc.FeedRef(msg, rb)
+	lcd.Release()
+	assert.Equal(t, int32(1), rb.RefCount())
+	gc.Clear()
+	assert.Equal(t, int32(0), rb.RefCount())
+
+	var lft LazyRtmpMsg2FlvTag
+	lft.Init(msg)
+	assert.Equal(t, httpflv.PackHttpflvTag(msg.Header.MsgTypeId, msg.Header.TimestampAbs, msg.Payload), lft.GetEnsureWithoutSdf())
+	lft.Release()
+}
+
+func TestGopCache_Ref(t *testing.T) {
+	vsh := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: []byte{0x17, 0x00, 0, 0, 0},
+	}
+	key := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: []byte{0x17, 0x01, 0, 0, 0},
+	}
+	rbs := make([]*base.RefBuffer, 3)
+	for i := range rbs {
+		rbs[i] = base.WrapRefBuffer([]byte{byte(i + 1)})
+	}
+
+	gc := NewGopCache("rtmp", "test", 1, 0)
+	gc.FeedRef(vsh, rbs[0])
+	gc.FeedRef(vsh, rbs[1])
+	gc.FeedRef(key, rbs[2])
+	// 被替换的seq header释放引用，[]byte字段和Ref指向同一个内存块
+	assert.Equal(t, int32(1), rbs[0].RefCount())
+	assert.Equal(t, true, gc.VideoSeqHeaderRef() == rbs[1])
+	assert.Equal(t, []byte{2}, gc.VideoSeqHeader)
+	assert.Equal(t, []*base.RefBuffer{rbs[2]}, gc.GetGopDataRefAt(0))
+	assert.Equal(t, [][]byte{{3}}, gc.GetGopDataAt(0))
+	assert.Equal(t, []base.SendItemType{base.SendItemTypeVideoKey}, gc.GetGopSendItemTypesAt(0))
+
+	clone := gc.Clone()
+	assert.Equal(t, int32(3), rbs[2].RefCount())
+	gc.Clear()
+	assert.Equal(t, true, gc.VideoSeqHeaderRef() == nil)
+	assert.Equal(t, nil, gc.VideoSeqHeader)
+
+	// 释放后只剩创建者的引用
+	clone.Clear()
+	for _, rb := range rbs {
+		assert.Equal(t, int32(1), rb.RefCount())
+	}
+}
+
+// benchmarkBroadcast 模拟group中的广播流程：每个消息切割成rtmp chunk以及flv tag，放入GOP缓存以及merge writer
+//
+// @param release: 为false时，内存块不放回内存池，也即和没有引用计数时一样，每个消息都申请新的内存块
+// benchmarkBroadcast
+//
+// @param subNum: rtmp和httpflv各自的拉流端数量，拉流端使用默认配置的发送队列，见 base.SendQueue
+func benchmarkBroadcast(b *testing.B, release bool, subNum int) {
+	video := make([]byte, 8*1024)
+	audio := make([]byte, 300)
+	msgs := make([]base.RtmpMsg, 50)
+	for i := range msgs {
+		if i%2 == 0 {
+			video[0] = 0x27
+			if i == 0 {
+				video[0] = 0x17
+			}
+			video[1] = 1
+			msgs[i] = base.RtmpMsg{Header: base.RtmpHeader{MsgLen: uint32(len(video)), MsgTypeId: base.RtmpTypeIdVideo}, Payload: append([]byte(nil), video...)}
+		} else {
+			audio[0] = 0xAF
+			audio[1] = 1
+			msgs[i] = base.RtmpMsg{Header: base.RtmpHeader{MsgLen: uint32(len(audio)), MsgTypeId: base.RtmpTypeIdAudio}, Payload: audio}
+		}
+	}
+
+	rtmpGopCache := NewGopCache("rtmp", "bench", 2, 0)
+	httpflvGopCache := NewGopCache("httpflv", "bench", 2, 0)
+	newSubs := func() []*base.SendQueue {
+		subs := make([]*base.SendQueue, subNum)
+		for i := range subs {
+			config := base.DefaultSendQueueConfig
+			config.QueueSize = 1024
+			subs[i] = base.NewSendQueue("bench", config, func(b []byte) error {
+				return nil
+			}).WithWritev(func(bs net.Buffers) error {
+				return nil
+			})
+		}
+		return subs
+	}
+	rtmpSubs := newSubs()
+	httpflvSubs := newSubs()
+	defer func() {
+		for i := range rtmpSubs {
+			rtmpSubs[i].Dispose()
+			httpflvSubs[i].Dispose()
+		}
+	}()
+
+	var sent int
+	mw := base.NewMergeWriterRef(func(rbs []*base.RefBuffer, typ base.SendItemType) {
+		sent += len(rbs)
+		for _, sub := range rtmpSubs {
+			_ = sub.PushRefs(rbs, typ)
+		}
+	}, 64*1024)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg := msgs[i%len(msgs)]
+		msg.Header.TimestampAbs = uint32(i)
+
+		var (
+			lazyRtmpChunkDivider LazyRtmpChunkDivider
+			lazyRtmpMsg2FlvTag   LazyRtmpMsg2FlvTag
+		)
+		lazyRtmpChunkDivider.Init(msg)
+		lazyRtmpMsg2FlvTag.Init(msg)
+		mw.WriteRef(lazyRtmpChunkDivider.GetEnsureWithoutSdfRef(), base.SendItemTypeOfRtmpMsg(msg))
+		rtmpGopCache.FeedRef(msg, lazyRtmpChunkDivider.GetEnsureWithoutSdfRef())
+		httpflvGopCache.FeedRef(msg, lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef())
+		for _, sub := range httpflvSubs {
+			_ = sub.PushRef(lazyRtmpMsg2FlvTag.GetEnsureWithoutSdfRef(), base.SendItemTypeOfRtmpMsg(msg))
+		}
+		if release {
+			lazyRtmpChunkDivider.Release()
+			lazyRtmpMsg2FlvTag.Release()
+		}
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	benchmarkBroadcast(b, false, 0)
+}
+
+func BenchmarkBroadcastRef(b *testing.B) {
+	benchmarkBroadcast(b, true, 0)
+}
+
+func BenchmarkBroadcastRefSubs(b *testing.B) {
+	benchmarkBroadcast(b, true, 100)
+}
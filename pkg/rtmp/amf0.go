@@ -19,6 +19,7 @@ import (
 	"github.com/q191201771/naza/pkg/nazabytes"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/q191201771/naza/pkg/nazaerrors"
 	"github.com/ysjhlnu/lal/pkg/base"
@@ -39,6 +40,9 @@ const (
 	Amf0TypeMarkerLongString  = uint8(0x0c)
 	Amf0TypeMarkerUnsupported = uint8(0x0d)
 
+	// Amf0TypeMarkerAvmplusObject 切换到amf3编码，后面跟着一个amf3编码的值
+	Amf0TypeMarkerAvmplusObject = uint8(0x11)
+
 	// 还没用到的类型
 	//Amf0TypeMarkerMovieclip   = uint8(0x04)
 	//Amf0TypeMarkerReference   = uint8(0x07)
@@ -95,6 +99,19 @@ func (o ObjectPairArray) FindNumber(key string) (int, error) {
 	return -1, base.ErrAmfNotExist
 }
 
+// ToMap 转换为map，嵌套的 ObjectPairArray 也会被转换，可用于json序列化
+func (o ObjectPairArray) ToMap() map[string]interface{} {
+	m := make(map[string]interface{}, len(o))
+	for _, op := range o {
+		if v, ok := op.Value.(ObjectPairArray); ok {
+			m[op.Key] = v.ToMap()
+		} else {
+			m[op.Key] = op.Value
+		}
+	}
+	return m
+}
+
 func (o ObjectPairArray) DebugString() string {
 	var b strings.Builder
 	for _, v := range o {
@@ -183,6 +200,10 @@ func (amf0) WriteObject(writer io.Writer, opa ObjectPairArray) error {
 			if err := Amf0.WriteBoolean(writer, opa[i].Value.(bool)); err != nil {
 				return err
 			}
+		case ObjectPairArray:
+			if err := Amf0.WriteObject(writer, opa[i].Value.(ObjectPairArray)); err != nil {
+				return err
+			}
 		default:
 			Log.Panicf("unknown value type. i=%d, v=%+v", i, opa[i].Value)
 		}
@@ -191,6 +212,109 @@ func (amf0) WriteObject(writer io.Writer, opa ObjectPairArray) error {
 	return err
 }
 
+// WriteValue
+//
+// 写入任意类型的值，主要用于将amf3解码出的值重新编码为amf0
+//
+// ObjectPairArray中所有Key都为""时，编码为Amf0TypeMarkerStrictArray，否则编码为Amf0TypeMarkerObject；
+// Amf3EcmaArray编码为Amf0TypeMarkerEcmaArray；[]byte编码为字符串；time.Time编码为毫秒数
+func (amf0) WriteValue(writer io.Writer, v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		return Amf0.WriteNull(writer)
+	case bool:
+		return Amf0.WriteBoolean(writer, val)
+	case int:
+		return Amf0.WriteNumber(writer, float64(val))
+	case float64:
+		return Amf0.WriteNumber(writer, val)
+	case string:
+		return Amf0.WriteString(writer, val)
+	case []byte:
+		return Amf0.WriteString(writer, string(val))
+	case time.Time:
+		return Amf0.WriteNumber(writer, float64(val.UnixNano()/int64(time.Millisecond)))
+	case []interface{}:
+		opa := make(ObjectPairArray, len(val))
+		for i := range val {
+			opa[i].Value = val[i]
+		}
+		return Amf0.writeStrictArray(writer, opa)
+	case Amf3EcmaArray:
+		return Amf0.writeEcmaArray(writer, ObjectPairArray(val))
+	case ObjectPairArray:
+		if len(val) > 0 && isStrictArray(val) {
+			return Amf0.writeStrictArray(writer, val)
+		}
+		return Amf0.writeObjectValue(writer, val)
+	}
+	return nazaerrors.Wrap(base.ErrAmfUnsupported)
+}
+
+func (amf0) writeObjectValue(writer io.Writer, opa ObjectPairArray) error {
+	if _, err := writer.Write([]byte{Amf0TypeMarkerObject}); err != nil {
+		return err
+	}
+	if err := Amf0.writeProperties(writer, opa); err != nil {
+		return err
+	}
+	_, err := writer.Write(Amf0TypeMarkerObjectEndBytes)
+	return err
+}
+
+func (amf0) writeEcmaArray(writer io.Writer, opa ObjectPairArray) error {
+	if _, err := writer.Write([]byte{Amf0TypeMarkerEcmaArray}); err != nil {
+		return err
+	}
+	if err := bele.WriteBe(writer, uint32(len(opa))); err != nil {
+		return err
+	}
+	if err := Amf0.writeProperties(writer, opa); err != nil {
+		return err
+	}
+	_, err := writer.Write(Amf0TypeMarkerArrayEndBytes)
+	return err
+}
+
+func (amf0) writeStrictArray(writer io.Writer, opa ObjectPairArray) error {
+	if _, err := writer.Write([]byte{Amf0TypeMarkerStrictArray}); err != nil {
+		return err
+	}
+	if err := bele.WriteBe(writer, uint32(len(opa))); err != nil {
+		return err
+	}
+	for _, op := range opa {
+		if err := Amf0.WriteValue(writer, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (amf0) writeProperties(writer io.Writer, opa ObjectPairArray) error {
+	for _, op := range opa {
+		if err := bele.WriteBe(writer, uint16(len(op.Key))); err != nil {
+			return err
+		}
+		if _, err := writer.Write([]byte(op.Key)); err != nil {
+			return err
+		}
+		if err := Amf0.WriteValue(writer, op.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isStrictArray(opa ObjectPairArray) bool {
+	for _, op := range opa {
+		if op.Key != "" {
+			return false
+		}
+	}
+	return true
+}
+
 // ----------------------------------------------------------------------------
 // read类型的方法集合
 //
@@ -235,6 +359,14 @@ func (amf0) ReadString(b []byte) (val string, l int, err error) {
 	case Amf0TypeMarkerLongString:
 		val, l, err = Amf0.ReadLongStringWithoutType(b[1:])
 		l++
+	case Amf0TypeMarkerAvmplusObject:
+		var v interface{}
+		if v, l, err = Amf0.ReadAvmplusObject(b); err == nil {
+			var ok bool
+			if val, ok = v.(string); !ok {
+				err = base.NewErrAmfInvalidType(b[1])
+			}
+		}
 	default:
 		err = base.NewErrAmfInvalidType(b[0])
 	}
@@ -242,6 +374,17 @@ func (amf0) ReadString(b []byte) (val string, l int, err error) {
 }
 
 func (amf0) ReadNumber(b []byte) (float64, int, error) {
+	if len(b) > 0 && b[0] == Amf0TypeMarkerAvmplusObject {
+		v, l, err := Amf0.ReadAvmplusObject(b)
+		if err != nil {
+			return 0, 0, err
+		}
+		if n, ok := v.(float64); ok {
+			return n, l, nil
+		}
+		return 0, 0, base.NewErrAmfInvalidType(b[1])
+	}
+
 	if len(b) < 9 {
 		return 0, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
 	}
@@ -252,6 +395,17 @@ func (amf0) ReadNumber(b []byte) (float64, int, error) {
 }
 
 func (amf0) ReadBoolean(b []byte) (bool, int, error) {
+	if len(b) > 0 && b[0] == Amf0TypeMarkerAvmplusObject {
+		v, l, err := Amf0.ReadAvmplusObject(b)
+		if err != nil {
+			return false, 0, err
+		}
+		if bv, ok := v.(bool); ok {
+			return bv, l, nil
+		}
+		return false, 0, base.NewErrAmfInvalidType(b[1])
+	}
+
 	if len(b) < 2 {
 		return false, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
 	}
@@ -265,12 +419,41 @@ func (amf0) ReadNull(b []byte) (int, error) {
 	if len(b) < 1 {
 		return 0, nazaerrors.Wrap(base.ErrAmfTooShort)
 	}
+	if b[0] == Amf0TypeMarkerAvmplusObject {
+		v, l, err := Amf0.ReadAvmplusObject(b)
+		if err != nil {
+			return 0, err
+		}
+		if v != nil {
+			return 0, base.NewErrAmfInvalidType(b[1])
+		}
+		return l, nil
+	}
 	if b[0] != Amf0TypeMarkerNull {
 		return 0, base.NewErrAmfInvalidType(b[0])
 	}
 	return 1, nil
 }
 
+// ReadAvmplusObject
+//
+// 读取Amf0TypeMarkerAvmplusObject，以及后面amf3编码的值，值的类型见amf3.go文件头部的说明
+//
+// @return int: 读取时从 b 消耗的字节大小，包含Amf0TypeMarkerAvmplusObject
+func (amf0) ReadAvmplusObject(b []byte) (interface{}, int, error) {
+	if len(b) < 1 {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	if b[0] != Amf0TypeMarkerAvmplusObject {
+		return nil, 0, base.NewErrAmfInvalidType(b[0])
+	}
+	v, l, err := Amf3.ReadValue(b[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, l + 1, nil
+}
+
 func (amf0) ReadUndefinedOrUnsupported(b []byte) (int, error) {
 	if len(b) < 1 {
 		return 0, nazaerrors.Wrap(base.ErrAmfTooShort)
@@ -287,6 +470,9 @@ func (amf0) ReadObject(b []byte) (ObjectPairArray, int, error) {
 	if len(b) < 1 {
 		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
 	}
+	if b[0] == Amf0TypeMarkerAvmplusObject {
+		return readAvmplusObjectPairArray(b)
+	}
 	if b[0] != Amf0TypeMarkerObject {
 		return nil, 0, base.NewErrAmfInvalidType(b[0])
 	}
@@ -379,6 +565,8 @@ func (amf0) ReadObjectOrArray(b []byte) (ObjectPairArray, int, error) {
 		return Amf0.ReadObject(b)
 	case Amf0TypeMarkerEcmaArray:
 		return Amf0.ReadArray(b)
+	case Amf0TypeMarkerAvmplusObject:
+		return readAvmplusObjectPairArray(b)
 	}
 	return nil, 0, base.NewErrAmfInvalidType(b[0])
 }
@@ -443,6 +631,16 @@ func (amf0) read(b []byte, index int, k string, ops ObjectPairArray) (ObjectPair
 			return nil, 0, err
 		}
 		index += l
+	case Amf0TypeMarkerAvmplusObject:
+		v, l, err := Amf0.ReadAvmplusObject(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		// 和amf0的null保持一致，不放入结果中
+		if v != nil {
+			ops = append(ops, ObjectPair{k, v})
+		}
+		index += l
 	default:
 		Log.Errorf("unknown type. vt=%d, hex=%s, %s", vt, hex.Dump(nazabytes.Prefix(b, 4096)), hex.Dump(nazabytes.Prefix(b[index:], 4096)))
 		return ops, index, base.NewErrAmfInvalidType(vt)
@@ -450,3 +648,55 @@ func (amf0) read(b []byte, index int, k string, ops ObjectPairArray) (ObjectPair
 
 	return ops, index, nil
 }
+
+func readAvmplusObjectPairArray(b []byte) (ObjectPairArray, int, error) {
+	v, l, err := Amf0.ReadAvmplusObject(b)
+	if err != nil {
+		return nil, 0, err
+	}
+	opa, ok := v.(ObjectPairArray)
+	if !ok {
+		return nil, 0, base.NewErrAmfInvalidType(b[1])
+	}
+	return opa, l, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// DataMessageAmf3ToAmf0
+//
+// 将type 15(data message amf3)或type 17(command message amf3)消息的payload，转换为等价的amf0编码的payload，
+// 其中通过Amf0TypeMarkerAvmplusObject切换的amf3编码的值，也会转换为amf0编码
+//
+// @param b: 消息的payload，如果第一个字节为0，表示格式选择字节，会被跳过
+func DataMessageAmf3ToAmf0(b []byte) ([]byte, error) {
+	index := 0
+	if len(b) > 0 && b[0] == 0 {
+		index = 1
+	}
+
+	var out bytes.Buffer
+	for index < len(b) {
+		switch b[index] {
+		case Amf0TypeMarkerNull, Amf0TypeMarkerUndefined:
+			_ = Amf0.WriteNull(&out)
+			index++
+			continue
+		}
+
+		ops, newIndex, err := Amf0.read(b, index, "", nil)
+		if err != nil {
+			return nil, err
+		}
+		index = newIndex
+
+		var v interface{}
+		if len(ops) > 0 {
+			v = ops[0].Value
+		}
+		if err := Amf0.WriteValue(&out, v); err != nil {
+			return nil, err
+		}
+	}
+	return out.Bytes(), nil
+}
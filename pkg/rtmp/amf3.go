@@ -0,0 +1,581 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+// amf3.go
+// @pure
+// 提供amf3格式的编码与解码的操作，见 amf3_spec_121207.pdf
+//
+// rtmp中，amf3一般通过以下两种方式出现:
+//   - type 17(command)和type 15(data)消息，第一个字节为0，后面是amf0编码的值
+//   - amf0编码的值中，通过 Amf0TypeMarkerAvmplusObject 切换为amf3编码的值
+//
+// 解码后的类型:
+//   - undefined、null: nil
+//   - false、true: bool
+//   - integer、double: float64，和amf0保持一致，方便使用 ObjectPairArray.FindNumber
+//   - string、xml-doc、xml: string
+//   - date: time.Time
+//   - array: ObjectPairArray，关联部分的Key为关联名，密集部分的Key为""
+//   - object: ObjectPairArray，先是sealed成员，然后是dynamic成员
+//   - byte-array: []byte
+//
+// 编码支持的类型:
+//   - nil、bool、int、float64、string、time.Time、[]byte
+//   - ObjectPairArray: 编码为匿名的dynamic object
+//   - Amf3EcmaArray: 编码为带关联部分的array，Key为""的元素放入密集部分
+//   - []interface{}: 编码为只有密集部分的array
+
+import (
+	"io"
+	"time"
+
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+const (
+	Amf3TypeMarkerUndefined    = uint8(0x00)
+	Amf3TypeMarkerNull         = uint8(0x01)
+	Amf3TypeMarkerFalse        = uint8(0x02)
+	Amf3TypeMarkerTrue         = uint8(0x03)
+	Amf3TypeMarkerInteger      = uint8(0x04)
+	Amf3TypeMarkerDouble       = uint8(0x05)
+	Amf3TypeMarkerString       = uint8(0x06)
+	Amf3TypeMarkerXmlDoc       = uint8(0x07)
+	Amf3TypeMarkerDate         = uint8(0x08)
+	Amf3TypeMarkerArray        = uint8(0x09)
+	Amf3TypeMarkerObject       = uint8(0x0a)
+	Amf3TypeMarkerXml          = uint8(0x0b)
+	Amf3TypeMarkerByteArray    = uint8(0x0c)
+	Amf3TypeMarkerVectorInt    = uint8(0x0d)
+	Amf3TypeMarkerVectorUint   = uint8(0x0e)
+	Amf3TypeMarkerVectorDouble = uint8(0x0f)
+	Amf3TypeMarkerVectorObject = uint8(0x10)
+	Amf3TypeMarkerDictionary   = uint8(0x11)
+)
+
+const (
+	amf3IntegerMax = 0x0FFFFFFF
+	amf3IntegerMin = -0x10000000
+
+	// amf3MaxDepth 读取时数组、对象的最大嵌套层数，避免恶意数据导致栈溢出
+	amf3MaxDepth = 64
+)
+
+// Amf3EcmaArray 见文件头部的说明
+type Amf3EcmaArray ObjectPairArray
+
+type amf3Traits struct {
+	className string
+	dynamic   bool
+	members   []string
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type amf3 struct{}
+
+var Amf3 amf3
+
+// ReadValue
+//
+// 读取一个amf3编码的值（包含type marker），引用表只在本次调用内有效
+//
+// @return 第2个参数为读取时从`b`消耗的字节大小
+func (amf3) ReadValue(b []byte) (interface{}, int, error) {
+	var r amf3Reader
+	return r.readValue(b, 0)
+}
+
+// WriteValue
+//
+// 写入一个amf3编码的值（包含type marker），引用表只在本次调用内有效
+func (amf3) WriteValue(writer io.Writer, v interface{}) error {
+	w := amf3Writer{
+		writer:  writer,
+		strings: make(map[string]int),
+	}
+	return w.writeValue(v)
+}
+
+// ReadU29 读取amf3中的变长整数
+func (amf3) ReadU29(b []byte) (uint32, int, error) {
+	var ret uint32
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+		}
+		if i == 3 {
+			return ret<<8 | uint32(b[i]), 4, nil
+		}
+		ret = ret<<7 | uint32(b[i]&0x7F)
+		if b[i]&0x80 == 0 {
+			return ret, i + 1, nil
+		}
+	}
+	return ret, 4, nil
+}
+
+// WriteU29 写入amf3中的变长整数，`v`的有效范围为[0, 0x1FFFFFFF]
+func (amf3) WriteU29(writer io.Writer, v uint32) error {
+	var b []byte
+	v &= 0x1FFFFFFF
+	switch {
+	case v < 0x80:
+		b = []byte{byte(v)}
+	case v < 0x4000:
+		b = []byte{byte(v>>7) | 0x80, byte(v & 0x7F)}
+	case v < 0x200000:
+		b = []byte{byte(v>>14) | 0x80, byte(v>>7) | 0x80, byte(v & 0x7F)}
+	default:
+		b = []byte{byte(v>>22) | 0x80, byte(v>>15) | 0x80, byte(v>>8) | 0x80, byte(v)}
+	}
+	_, err := writer.Write(b)
+	return err
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type amf3Reader struct {
+	strings []string
+	objects []interface{}
+	traits  []amf3Traits
+	depth   int
+}
+
+func (r *amf3Reader) readValue(b []byte, index int) (interface{}, int, error) {
+	if len(b)-index < 1 {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	if r.depth >= amf3MaxDepth {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooDeep)
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+	marker := b[index]
+	index++
+
+	switch marker {
+	case Amf3TypeMarkerUndefined, Amf3TypeMarkerNull:
+		return nil, index, nil
+	case Amf3TypeMarkerFalse:
+		return false, index, nil
+	case Amf3TypeMarkerTrue:
+		return true, index, nil
+	case Amf3TypeMarkerInteger:
+		u, l, err := Amf3.ReadU29(b[index:])
+		if err != nil {
+			return nil, 0, err
+		}
+		// 29位有符号整数
+		v := int32(u<<3) >> 3
+		return float64(v), index + l, nil
+	case Amf3TypeMarkerDouble:
+		if len(b)-index < 8 {
+			return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+		}
+		return bele.BeFloat64(b[index:]), index + 8, nil
+	case Amf3TypeMarkerString:
+		return r.readString(b, index)
+	case Amf3TypeMarkerXmlDoc, Amf3TypeMarkerXml:
+		return r.readXml(b, index)
+	case Amf3TypeMarkerDate:
+		return r.readDate(b, index)
+	case Amf3TypeMarkerArray:
+		return r.readArray(b, index)
+	case Amf3TypeMarkerObject:
+		return r.readObject(b, index)
+	case Amf3TypeMarkerByteArray:
+		return r.readByteArray(b, index)
+	}
+	return nil, 0, base.NewErrAmfInvalidType(marker)
+}
+
+// readString 读取不带type marker的UTF-8-vr
+func (r *amf3Reader) readString(b []byte, index int) (string, int, error) {
+	u, l, err := Amf3.ReadU29(b[index:])
+	if err != nil {
+		return "", 0, err
+	}
+	index += l
+
+	if u&1 == 0 {
+		ref := int(u >> 1)
+		if ref >= len(r.strings) {
+			return "", 0, nazaerrors.Wrap(base.ErrAmfInvalidReference)
+		}
+		return r.strings[ref], index, nil
+	}
+
+	n := int(u >> 1)
+	if len(b)-index < n {
+		return "", 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	s := string(b[index : index+n])
+	// 空字符串不进入引用表
+	if n > 0 {
+		r.strings = append(r.strings, s)
+	}
+	return s, index + n, nil
+}
+
+// readObjectRef 读取U29O-ref，如果是引用，返回引用的值
+func (r *amf3Reader) readObjectRef(b []byte, index int) (u uint32, isRef bool, v interface{}, newIndex int, err error) {
+	u, l, err := Amf3.ReadU29(b[index:])
+	if err != nil {
+		return 0, false, nil, 0, err
+	}
+	index += l
+
+	if u&1 == 0 {
+		ref := int(u >> 1)
+		if ref >= len(r.objects) {
+			return 0, false, nil, 0, nazaerrors.Wrap(base.ErrAmfInvalidReference)
+		}
+		return u, true, r.objects[ref], index, nil
+	}
+	return u, false, nil, index, nil
+}
+
+func (r *amf3Reader) readXml(b []byte, index int) (interface{}, int, error) {
+	u, isRef, v, index, err := r.readObjectRef(b, index)
+	if err != nil || isRef {
+		return v, index, err
+	}
+	n := int(u >> 1)
+	if len(b)-index < n {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	s := string(b[index : index+n])
+	r.objects = append(r.objects, s)
+	return s, index + n, nil
+}
+
+func (r *amf3Reader) readDate(b []byte, index int) (interface{}, int, error) {
+	_, isRef, v, index, err := r.readObjectRef(b, index)
+	if err != nil || isRef {
+		return v, index, err
+	}
+	if len(b)-index < 8 {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	ms := bele.BeFloat64(b[index:])
+	t := time.Unix(0, int64(ms)*int64(time.Millisecond))
+	r.objects = append(r.objects, t)
+	return t, index + 8, nil
+}
+
+func (r *amf3Reader) readByteArray(b []byte, index int) (interface{}, int, error) {
+	u, isRef, v, index, err := r.readObjectRef(b, index)
+	if err != nil || isRef {
+		return v, index, err
+	}
+	n := int(u >> 1)
+	if len(b)-index < n {
+		return nil, 0, nazaerrors.Wrap(base.ErrAmfTooShort)
+	}
+	ba := append([]byte{}, b[index:index+n]...)
+	r.objects = append(r.objects, ba)
+	return ba, index + n, nil
+}
+
+func (r *amf3Reader) readArray(b []byte, index int) (interface{}, int, error) {
+	u, isRef, v, index, err := r.readObjectRef(b, index)
+	if err != nil || isRef {
+		return v, index, err
+	}
+
+	// 先占位，使得内部可以引用到（循环引用时得到的是nil）
+	pos := len(r.objects)
+	r.objects = append(r.objects, nil)
+
+	var ops ObjectPairArray
+	// 关联部分，以空字符串结束
+	for {
+		var k string
+		k, index, err = r.readString(b, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		if k == "" {
+			break
+		}
+		var item interface{}
+		item, index, err = r.readValue(b, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		ops = append(ops, ObjectPair{Key: k, Value: item})
+	}
+	// 密集部分
+	count := int(u >> 1)
+	for i := 0; i < count; i++ {
+		var item interface{}
+		item, index, err = r.readValue(b, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		ops = append(ops, ObjectPair{Key: "", Value: item})
+	}
+
+	r.objects[pos] = ops
+	return ops, index, nil
+}
+
+func (r *amf3Reader) readObject(b []byte, index int) (interface{}, int, error) {
+	u, isRef, v, index, err := r.readObjectRef(b, index)
+	if err != nil || isRef {
+		return v, index, err
+	}
+
+	var traits amf3Traits
+	if u&2 == 0 {
+		// traits引用
+		ref := int(u >> 2)
+		if ref >= len(r.traits) {
+			return nil, 0, nazaerrors.Wrap(base.ErrAmfInvalidReference)
+		}
+		traits = r.traits[ref]
+	} else {
+		if u&4 != 0 {
+			// externalizable的数据格式由具体类决定，无法通用解析
+			return nil, 0, nazaerrors.Wrap(base.ErrAmfUnsupported)
+		}
+		traits.dynamic = u&8 != 0
+		traits.className, index, err = r.readString(b, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		count := int(u >> 4)
+		for i := 0; i < count; i++ {
+			var name string
+			name, index, err = r.readString(b, index)
+			if err != nil {
+				return nil, 0, err
+			}
+			traits.members = append(traits.members, name)
+		}
+		r.traits = append(r.traits, traits)
+	}
+
+	pos := len(r.objects)
+	r.objects = append(r.objects, nil)
+
+	var ops ObjectPairArray
+	for _, name := range traits.members {
+		var item interface{}
+		item, index, err = r.readValue(b, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		ops = append(ops, ObjectPair{Key: name, Value: item})
+	}
+	if traits.dynamic {
+		for {
+			var k string
+			k, index, err = r.readString(b, index)
+			if err != nil {
+				return nil, 0, err
+			}
+			if k == "" {
+				break
+			}
+			var item interface{}
+			item, index, err = r.readValue(b, index)
+			if err != nil {
+				return nil, 0, err
+			}
+			ops = append(ops, ObjectPair{Key: k, Value: item})
+		}
+	}
+
+	r.objects[pos] = ops
+	return ops, index, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type amf3Writer struct {
+	writer  io.Writer
+	strings map[string]int
+
+	// 所有ObjectPairArray都编码为匿名的dynamic object，traits相同，第一次之后都使用引用
+	hasAnonymousTraits bool
+	traitsCount        int
+	anonymousTraitsRef int
+}
+
+func (w *amf3Writer) writeMarker(marker uint8) error {
+	_, err := w.writer.Write([]byte{marker})
+	return err
+}
+
+func (w *amf3Writer) writeValue(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		return w.writeMarker(Amf3TypeMarkerNull)
+	case bool:
+		if val {
+			return w.writeMarker(Amf3TypeMarkerTrue)
+		}
+		return w.writeMarker(Amf3TypeMarkerFalse)
+	case int:
+		if val >= amf3IntegerMin && val <= amf3IntegerMax {
+			if err := w.writeMarker(Amf3TypeMarkerInteger); err != nil {
+				return err
+			}
+			return Amf3.WriteU29(w.writer, uint32(val))
+		}
+		return w.writeDouble(float64(val))
+	case float64:
+		return w.writeDouble(val)
+	case string:
+		if err := w.writeMarker(Amf3TypeMarkerString); err != nil {
+			return err
+		}
+		return w.writeString(val)
+	case time.Time:
+		if err := w.writeMarker(Amf3TypeMarkerDate); err != nil {
+			return err
+		}
+		if err := Amf3.WriteU29(w.writer, 1); err != nil {
+			return err
+		}
+		return bele.WriteBe(w.writer, float64(val.UnixNano()/int64(time.Millisecond)))
+	case []byte:
+		if err := w.writeMarker(Amf3TypeMarkerByteArray); err != nil {
+			return err
+		}
+		if err := Amf3.WriteU29(w.writer, uint32(len(val))<<1|1); err != nil {
+			return err
+		}
+		_, err := w.writer.Write(val)
+		return err
+	case ObjectPairArray:
+		return w.writeObject(val)
+	case []ObjectPair:
+		return w.writeObject(val)
+	case Amf3EcmaArray:
+		return w.writeEcmaArray(val)
+	case []interface{}:
+		if err := w.writeMarker(Amf3TypeMarkerArray); err != nil {
+			return err
+		}
+		if err := Amf3.WriteU29(w.writer, uint32(len(val))<<1|1); err != nil {
+			return err
+		}
+		if err := w.writeString(""); err != nil {
+			return err
+		}
+		for _, item := range val {
+			if err := w.writeValue(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nazaerrors.Wrap(base.ErrAmfUnsupported)
+}
+
+func (w *amf3Writer) writeDouble(v float64) error {
+	if err := w.writeMarker(Amf3TypeMarkerDouble); err != nil {
+		return err
+	}
+	return bele.WriteBe(w.writer, v)
+}
+
+// writeString 写入不带type marker的UTF-8-vr，重复的字符串使用引用
+func (w *amf3Writer) writeString(s string) error {
+	if s == "" {
+		return Amf3.WriteU29(w.writer, 1)
+	}
+	if ref, ok := w.strings[s]; ok {
+		return Amf3.WriteU29(w.writer, uint32(ref)<<1)
+	}
+	w.strings[s] = len(w.strings)
+	if err := Amf3.WriteU29(w.writer, uint32(len(s))<<1|1); err != nil {
+		return err
+	}
+	_, err := w.writer.Write([]byte(s))
+	return err
+}
+
+func (w *amf3Writer) writeObject(opa ObjectPairArray) error {
+	if err := w.writeMarker(Amf3TypeMarkerObject); err != nil {
+		return err
+	}
+	if w.hasAnonymousTraits {
+		// U29O-traits-ref
+		if err := Amf3.WriteU29(w.writer, uint32(w.anonymousTraitsRef)<<2|1); err != nil {
+			return err
+		}
+	} else {
+		// U29O-traits，dynamic，没有sealed成员，类名为空
+		if err := Amf3.WriteU29(w.writer, 0x0b); err != nil {
+			return err
+		}
+		if err := w.writeString(""); err != nil {
+			return err
+		}
+		w.hasAnonymousTraits = true
+		w.anonymousTraitsRef = w.traitsCount
+		w.traitsCount++
+	}
+
+	for _, op := range opa {
+		if op.Key == "" {
+			// dynamic成员的空名字表示结束，无法表示，跳过
+			continue
+		}
+		if err := w.writeString(op.Key); err != nil {
+			return err
+		}
+		if err := w.writeValue(op.Value); err != nil {
+			return err
+		}
+	}
+	return w.writeString("")
+}
+
+func (w *amf3Writer) writeEcmaArray(arr Amf3EcmaArray) error {
+	if err := w.writeMarker(Amf3TypeMarkerArray); err != nil {
+		return err
+	}
+	var dense []interface{}
+	for _, op := range arr {
+		if op.Key == "" {
+			dense = append(dense, op.Value)
+		}
+	}
+	if err := Amf3.WriteU29(w.writer, uint32(len(dense))<<1|1); err != nil {
+		return err
+	}
+	for _, op := range arr {
+		if op.Key == "" {
+			continue
+		}
+		if err := w.writeString(op.Key); err != nil {
+			return err
+		}
+		if err := w.writeValue(op.Value); err != nil {
+			return err
+		}
+	}
+	if err := w.writeString(""); err != nil {
+		return err
+	}
+	for _, item := range dense {
+		if err := w.writeValue(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+	. "github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+func TestAmf3_U29(t *testing.T) {
+	cases := []struct {
+		v uint32
+		l int
+	}{
+		{0, 1},
+		{0x7F, 1},
+		{0x80, 2},
+		{0x3FFF, 2},
+		{0x4000, 3},
+		{0x1FFFFF, 3},
+		{0x200000, 4},
+		{0x1FFFFFFF, 4},
+	}
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		err := Amf3.WriteU29(out, c.v)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.l, out.Len())
+		v, l, err := Amf3.ReadU29(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, c.v, v)
+		assert.Equal(t, c.l, l)
+	}
+
+	_, _, err := Amf3.ReadU29([]byte{0x80, 0x80})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfTooShort))
+}
+
+func TestAmf3_WriteValue_ReadValue(t *testing.T) {
+	cases := []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{nil, nil},
+		{true, true},
+		{false, false},
+		{1, float64(1)},
+		{-1, float64(-1)},
+		{0x0FFFFFFF, float64(0x0FFFFFFF)},
+		{-0x10000000, float64(-0x10000000)},
+		{0x10000000, float64(0x10000000)}, // 超出integer范围，编码为double
+		{1.5, 1.5},
+		{"abc", "abc"},
+		{"", ""},
+		{[]byte{1, 2, 3}, []byte{1, 2, 3}},
+		{[]interface{}{"x", "x", 1.0}, ObjectPairArray{{"", "x"}, {"", "x"}, {"", 1.0}}},
+		{ObjectPairArray{{"a", 1.0}, {"b", "x"}}, ObjectPairArray{{"a", 1.0}, {"b", "x"}}},
+		{Amf3EcmaArray{{"a", 1.0}, {"", "d"}, {"b", true}}, ObjectPairArray{{"a", 1.0}, {"b", true}, {"", "d"}}},
+	}
+	for _, c := range cases {
+		out := &bytes.Buffer{}
+		err := Amf3.WriteValue(out, c.in)
+		assert.Equal(t, nil, err)
+		v, l, err := Amf3.ReadValue(out.Bytes())
+		assert.Equal(t, nil, err)
+		assert.Equal(t, out.Len(), l)
+		assert.Equal(t, c.out, v)
+	}
+
+	now := time.Unix(1700000000, 123*int64(time.Millisecond))
+	out := &bytes.Buffer{}
+	err := Amf3.WriteValue(out, now)
+	assert.Equal(t, nil, err)
+	v, _, err := Amf3.ReadValue(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, now.Equal(v.(time.Time)))
+
+	err = Amf3.WriteValue(out, struct{}{})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfUnsupported))
+}
+
+func TestAmf3_Reference(t *testing.T) {
+	// 重复的字符串和匿名traits，写入时使用引用
+	in := ObjectPairArray{
+		{"first", ObjectPairArray{{"keyname", "value"}}},
+		{"second", ObjectPairArray{{"keyname", "value"}}},
+	}
+	out := &bytes.Buffer{}
+	err := Amf3.WriteValue(out, in)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("keyname")))
+	assert.Equal(t, 1, bytes.Count(out.Bytes(), []byte("value")))
+	v, _, err := Amf3.ReadValue(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, in, v)
+
+	// dense array，包含3个元素:
+	// - sealed成员x，dynamic成员y，类名Foo，inline traits
+	// - traits引用，dynamic成员名为字符串引用
+	// - 对象引用，引用第1个元素
+	b, _ := hex.DecodeString("0907" + "01" +
+		"0a1b07466f6f0378" + "0405" + "0379" + "03" + "01" +
+		"0a01" + "0406" + "04" + "02" + "01" +
+		"0a02")
+	v, l, err := Amf3.ReadValue(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, len(b), l)
+	assert.Equal(t, ObjectPairArray{
+		{"", ObjectPairArray{{"x", float64(5)}, {"y", true}}},
+		{"", ObjectPairArray{{"x", float64(6)}, {"y", false}}},
+		{"", ObjectPairArray{{"x", float64(5)}, {"y", true}}},
+	}, v)
+}
+
+func TestAmf3Corner(t *testing.T) {
+	// 字符串引用不存在
+	_, _, err := Amf3.ReadValue([]byte{Amf3TypeMarkerString, 0x02})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfInvalidReference))
+
+	// traits引用不存在
+	_, _, err = Amf3.ReadValue([]byte{Amf3TypeMarkerObject, 0x01})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfInvalidReference))
+
+	// externalizable
+	_, _, err = Amf3.ReadValue([]byte{Amf3TypeMarkerObject, 0x07, 0x01})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfUnsupported))
+
+	_, _, err = Amf3.ReadValue([]byte{Amf3TypeMarkerDictionary})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfInvalidType))
+
+	_, _, err = Amf3.ReadValue([]byte{Amf3TypeMarkerString, 0x07, 'a'})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfTooShort))
+
+	_, _, err = Amf3.ReadValue(nil)
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfTooShort))
+
+	// 嵌套的数组，每层只有一个元素
+	nested := func(n int) []byte {
+		b := bytes.Repeat([]byte{Amf3TypeMarkerArray, 0x03, 0x01}, n)
+		return append(b, Amf3TypeMarkerNull)
+	}
+	_, l, err := Amf3.ReadValue(nested(10))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 31, l)
+	_, _, err = Amf3.ReadValue(nested(100000))
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfTooDeep))
+}
+
+func TestAmf0_AvmplusObject(t *testing.T) {
+	// connect信令的command object通过avmplus-object切换为amf3编码
+	out := &bytes.Buffer{}
+	_, _ = out.Write([]byte{Amf0TypeMarkerAvmplusObject})
+	err := Amf3.WriteValue(out, ObjectPairArray{{"app", "live"}, {"objectEncoding", 3}})
+	assert.Equal(t, nil, err)
+
+	opa, l, err := Amf0.ReadObject(out.Bytes())
+	assert.Equal(t, nil, err)
+	assert.Equal(t, out.Len(), l)
+	app, _ := opa.FindString("app")
+	assert.Equal(t, "live", app)
+	oe, _ := opa.FindNumber("objectEncoding")
+	assert.Equal(t, 3, oe)
+
+	str, _, err := Amf0.ReadString([]byte{Amf0TypeMarkerAvmplusObject, Amf3TypeMarkerString, 0x05, 'a', 'b'})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ab", str)
+	n, _, err := Amf0.ReadNumber([]byte{Amf0TypeMarkerAvmplusObject, Amf3TypeMarkerInteger, 0x7F})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, float64(127), n)
+	l, err = Amf0.ReadNull([]byte{Amf0TypeMarkerAvmplusObject, Amf3TypeMarkerNull})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, l)
+	_, _, err = Amf0.ReadString([]byte{Amf0TypeMarkerAvmplusObject, Amf3TypeMarkerTrue})
+	assert.Equal(t, true, errors.Is(err, base.ErrAmfInvalidType))
+}
+
+func TestDataMessageAmf3ToAmf0(t *testing.T) {
+	// type 15的@setDataFrame
+	out := &bytes.Buffer{}
+	_, _ = out.Write([]byte{0})
+	_ = Amf0.WriteString(out, "@setDataFrame")
+	_ = Amf0.WriteString(out, "onMetaData")
+	_, _ = out.Write([]byte{Amf0TypeMarkerAvmplusObject})
+	err := Amf3.WriteValue(out, Amf3EcmaArray{
+		{"width", 1280},
+		{"height", 720},
+		{"encoder", "iot"},
+		{"stereo", true},
+	})
+	assert.Equal(t, nil, err)
+
+	b, err := DataMessageAmf3ToAmf0(out.Bytes())
+	assert.Equal(t, nil, err)
+	opa, err := ParseMetadata(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(opa))
+	w, _ := opa.FindNumber("width")
+	assert.Equal(t, 1280, w)
+	h, _ := opa.FindNumber("height")
+	assert.Equal(t, 720, h)
+	e, _ := opa.FindString("encoder")
+	assert.Equal(t, "iot", e)
+	assert.Equal(t, true, opa.Find("stereo"))
+
+	// 纯amf0的数据转换后不变
+	b2, err := DataMessageAmf3ToAmf0(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, b, b2)
+}
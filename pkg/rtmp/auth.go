@@ -0,0 +1,121 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// connect阶段的challenge/response鉴权，兼容ffmpeg、OBS等客户端。以adobe为例，llnw（Limelight）类似：
+//
+//  1. 客户端connect，app中没有鉴权参数，
+//     服务端回复 `[ code=403 need auth; authmod=adobe ]`
+//  2. 客户端重新建立连接，app和tcUrl后面加上 `?authmod=adobe&user=<user>`，
+//     服务端回复 `[ AccessManager.Reject ] : [ authmod=adobe ] : ?reason=needauth&user=<user>&salt=<salt>&challenge=<challenge>&opaque=<opaque>`
+//  3. 客户端重新建立连接，app和tcUrl后面加上 `?authmod=adobe&user=<user>&challenge=<client challenge>&response=<response>&opaque=<opaque>`，
+//     服务端校验通过后回复 NetConnection.Connect.Success ，失败时回复 `?reason=authfailed`
+//
+// 服务端每一步的回复都是code为 NetConnection.Connect.Rejected 的_error信令，回复后关闭连接。
+//
+// llnw第2步服务端下发`nonce`，第3步客户端携带`nonce`、`cnonce`、`nc`、`response`，计算方式类似http digest，见 llnwAuthResponse 。
+
+const (
+	AuthModAdobe = "adobe"
+	AuthModLlnw  = "llnw"
+)
+
+const (
+	authReasonNeedAuth   = "needauth"
+	authReasonAuthFailed = "authfailed"
+	authReasonNoSuchUser = "nosuchuser"
+
+	// llnw中固定的参数，和ffmpeg保持一致，拉流也使用publish
+	llnwRealm  = "live"
+	llnwMethod = "publish"
+	llnwQop    = "auth"
+	llnwNc     = "00000001"
+)
+
+// authDescriptionNeedAuth 第1步服务端的回复
+func authDescriptionNeedAuth(mod string) string {
+	return fmt.Sprintf("[ code=403 need auth; authmod=%s ]", mod)
+}
+
+// authDescriptionReject 第2步以及鉴权失败时服务端的回复
+func authDescriptionReject(mod string, query string) string {
+	return fmt.Sprintf("[ AccessManager.Reject ] : [ authmod=%s ] : ?%s", mod, query)
+}
+
+// isAuthRejectDescription 是否是鉴权流程中服务端的回复
+func isAuthRejectDescription(description string) bool {
+	return strings.Contains(description, "authmod=")
+}
+
+// adobeAuthResponse base64(md5(base64(md5(user + salt + password)) + opaque + challenge))
+//
+// @param opaque:    服务端下发的opaque，为空时使用服务端下发的challenge
+// @param challenge: 客户端生成的challenge
+func adobeAuthResponse(user, password, salt, opaque, challenge string) string {
+	h := md5.Sum([]byte(user + salt + password))
+	salted := base64.StdEncoding.EncodeToString(h[:])
+	h = md5.Sum([]byte(salted + opaque + challenge))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// llnwAuthResponse md5(md5(user:realm:password):nonce:nc:cnonce:qop:md5(method:/app))
+//
+// @param app: 不包含鉴权参数，没有instance时加上`/_definst_`
+func llnwAuthResponse(user, password, app, nonce, cnonce string) string {
+	uri := app
+	if i := strings.IndexByte(uri, '/'); i != -1 {
+		uri = uri[:i]
+	} else {
+		uri += "/_definst_"
+	}
+	ha1 := md5Hex(fmt.Sprintf("%s:%s:%s", user, llnwRealm, password))
+	ha2 := md5Hex(fmt.Sprintf("%s:/%s", llnwMethod, uri))
+	return md5Hex(fmt.Sprintf("%s:%s:%s:%s:%s:%s", ha1, nonce, llnwNc, cnonce, llnwQop, ha2))
+}
+
+// parseAuthParams 解析`k1=v1&k2=v2`格式的鉴权参数
+//
+// 注意，值可能是base64编码，包含`+`、`/`、`=`，所以不使用 url.ParseQuery
+func parseAuthParams(s string) map[string]string {
+	m := make(map[string]string)
+	for _, item := range strings.Split(s, "&") {
+		if i := strings.IndexByte(item, '='); i > 0 {
+			m[item[:i]] = item[i+1:]
+		}
+	}
+	return m
+}
+
+// splitAuthQuery 将app或tcUrl拆分为`?`前后两部分
+func splitAuthQuery(s string) (string, string) {
+	if i := strings.IndexByte(s, '?'); i != -1 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+func genAuthRandom(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func md5Hex(s string) string {
+	h := md5.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,113 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+func TestAuthResponse(t *testing.T) {
+	// 按公式手动计算一遍
+	assert.Equal(t, "ym6RiP4wQql0KIMLktu1mg==", adobeAuthResponse("user", "pass", "salt", "opaque", "challenge"))
+
+	ha1 := md5Hex("user:live:pass")
+	ha2 := md5Hex("publish:/live/_definst_")
+	expected := md5Hex(ha1 + ":nonce:00000001:cnonce:auth:" + ha2)
+	assert.Equal(t, expected, llnwAuthResponse("user", "pass", "live", "nonce", "cnonce"))
+	assert.Equal(t, md5Hex(ha1+":nonce:00000001:cnonce:auth:"+md5Hex("publish:/live")),
+		llnwAuthResponse("user", "pass", "live/inst", "nonce", "cnonce"))
+}
+
+func TestParseAuthParams(t *testing.T) {
+	app, query := splitAuthQuery("live?authmod=adobe&user=a&response=ab+c/d==")
+	assert.Equal(t, "live", app)
+	m := parseAuthParams(query)
+	assert.Equal(t, "adobe", m["authmod"])
+	assert.Equal(t, "a", m["user"])
+	assert.Equal(t, "ab+c/d==", m["response"])
+
+	app, query = splitAuthQuery("live")
+	assert.Equal(t, "live", app)
+	assert.Equal(t, 0, len(parseAuthParams(query)))
+
+	assert.Equal(t, true, isAuthRejectDescription(authDescriptionNeedAuth(AuthModAdobe)))
+	assert.Equal(t, false, isAuthRejectDescription("stream not found"))
+}
+
+func TestAuthChallengeStore(t *testing.T) {
+	st := newAuthChallengeStore()
+	st.add("k", authChallengeItem{user: "u"})
+	item, ok := st.take("k")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, "u", item.user)
+	// 只能使用一次
+	_, ok = st.take("k")
+	assert.Equal(t, false, ok)
+
+	st.expireDur = -time.Second
+	st.add("k", authChallengeItem{user: "u"})
+	_, ok = st.take("k")
+	assert.Equal(t, false, ok)
+}
+
+type authTestServerObserver struct {
+	connectErr error
+}
+
+func (o *authTestServerObserver) OnRtmpConnect(session *ServerSession, opa ObjectPairArray) error {
+	return o.connectErr
+}
+func (o *authTestServerObserver) OnNewRtmpPubSession(session *ServerSession) error { return nil }
+func (o *authTestServerObserver) OnDelRtmpPubSession(session *ServerSession)       {}
+func (o *authTestServerObserver) OnNewRtmpSubSession(session *ServerSession) error { return nil }
+func (o *authTestServerObserver) OnDelRtmpSubSession(session *ServerSession)       {}
+
+func TestServerAuth(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	observer := &authTestServerObserver{}
+	config := ServerAuthConfig{AuthEnable: true, AuthMod: AuthModAdobe, UserName: "user", PassWord: "pass"}
+	server := NewServer(addr, observer).WithAuthenticator(&config)
+	assert.Equal(t, nil, server.Listen())
+	go server.RunLoop()
+	defer server.Dispose()
+
+	push := func(userinfo string) error {
+		s := NewPushSession(func(option *PushSessionOption) {
+			option.PushTimeoutMs = 3000
+		})
+		defer s.Dispose()
+		return s.Push(fmt.Sprintf("rtmp://%s@%s/live/test", userinfo, addr))
+	}
+
+	for _, mod := range []string{AuthModAdobe, AuthModLlnw} {
+		config.AuthMod = mod
+		assert.Equal(t, nil, push("user:pass"))
+
+		err = push("user:wrong")
+		assert.Equal(t, true, errors.Is(err, base.ErrRtmpAuthFailed), mod)
+		err = push("other:pass")
+		assert.Equal(t, true, errors.Is(err, base.ErrRtmpAuthFailed), mod)
+	}
+
+	config.AuthEnable = false
+	observer.connectErr = errors.New("forbidden")
+	err = push("user:pass")
+	assert.Equal(t, true, errors.Is(err, base.ErrRtmpConnectRejected))
+}
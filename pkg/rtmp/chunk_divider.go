@@ -32,6 +32,11 @@ func Message2Chunks(message []byte, header *base.RtmpHeader) []byte {
 	return defaultChunkDivider.Message2Chunks(message, header)
 }
 
+// Message2ChunksRef 和 Message2Chunks 相同，区别是返回的内存块来自内存池，见 base.RefBuffer
+func Message2ChunksRef(message []byte, header *base.RtmpHeader) *base.RefBuffer {
+	return defaultChunkDivider.Message2ChunksRef(message, header)
+}
+
 // Message2ChunksV
 //
 // @param message: 待打包的message支持放在多个字节切片中
@@ -46,6 +51,12 @@ func (d *ChunkDivider) Message2Chunks(message []byte, header *base.RtmpHeader) [
 	return message2Chunks(message, header, nil, d.localChunkSize)
 }
 
+func (d *ChunkDivider) Message2ChunksRef(message []byte, header *base.RtmpHeader) *base.RefBuffer {
+	rb := base.NewRefBuffer(message2ChunksMaxLen(len(message), d.localChunkSize))
+	rb.Truncate(message2ChunksTo(rb.Bytes(), message, header, nil, d.localChunkSize))
+	return rb
+}
+
 func (d *ChunkDivider) Message2ChunksV(message net.Buffers, header *base.RtmpHeader) []byte {
 	return message2ChunksV(message, header, nil, d.localChunkSize)
 }
@@ -135,26 +146,39 @@ func calcHeader(header *base.RtmpHeader, prevHeader *base.RtmpHeader, out []byte
 }
 
 func message2Chunks(message []byte, header *base.RtmpHeader, prevHeader *base.RtmpHeader, chunkSize int) []byte {
-	//if header.Csid < minCsid || header.Csid > maxCsid {
-	//	return nil, ErrRtmp
-	//}
+	out := make([]byte, message2ChunksMaxLen(len(message), chunkSize))
+	return out[:message2ChunksTo(out, message, header, prevHeader, chunkSize)]
+}
 
+// message2ChunksMaxLen 切割成chunk后最多需要的内存大小
+func message2ChunksMaxLen(messageLen int, chunkSize int) int {
 	// 注意，这里我们要尽量缩小预分配内存的大小
-	var maxNeededLen int
+	numOfChunk := messageLen / chunkSize
+	maxNeededLen := numOfChunk * (chunkSize + maxHeaderSize)
+	if messageLen%chunkSize != 0 {
+		maxNeededLen += messageLen%chunkSize + maxHeaderSize
+	}
+	return maxNeededLen
+}
 
-	numOfChunk := len(message) / chunkSize
-	maxNeededLen = numOfChunk * (chunkSize + maxHeaderSize)
+// message2ChunksTo
+//
+// @param out: 大小至少为 message2ChunksMaxLen
+//
+// @return 写入`out`的大小
+func message2ChunksTo(out []byte, message []byte, header *base.RtmpHeader, prevHeader *base.RtmpHeader, chunkSize int) int {
+	//if header.Csid < minCsid || header.Csid > maxCsid {
+	//	return nil, ErrRtmp
+	//}
 
 	// 计算chunk数量，最后一个chunk的大小
+	numOfChunk := len(message) / chunkSize
 	lastChunkSize := chunkSize
 	if len(message)%chunkSize != 0 {
 		numOfChunk++
 		lastChunkSize = len(message) % chunkSize
-		maxNeededLen += lastChunkSize + maxHeaderSize
 	}
 
-	out := make([]byte, maxNeededLen)
-
 	var index int
 
 	// NOTICE 和srs交互时，发现srs要求message中的非第一个chunk不能使用fmt0
@@ -173,7 +197,7 @@ func message2Chunks(message []byte, header *base.RtmpHeader, prevHeader *base.Rt
 		prevHeader = header
 	}
 
-	return out[:index]
+	return index
 }
 
 // copyBufferFromBuffers
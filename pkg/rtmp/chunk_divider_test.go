@@ -71,3 +71,51 @@ func TestMessage2Chunks(t *testing.T) {
 		assert.Equal(t, exp, m)
 	}
 }
+
+func TestMessage2ChunksRef(t *testing.T) {
+	buf := make([]byte, LocalChunkSize*3+1)
+	for i := range buf {
+		buf[i] = byte(i % 256)
+	}
+	for _, testLen := range []int{1, 4096, 4097, len(buf)} {
+		h := base.RtmpHeader{
+			Csid:         CsidVideo,
+			MsgLen:       uint32(testLen),
+			MsgTypeId:    base.RtmpTypeIdVideo,
+			MsgStreamId:  Msid1,
+			TimestampAbs: 123,
+		}
+		rb := Message2ChunksRef(buf[:testLen], &h)
+		assert.Equal(t, Message2Chunks(buf[:testLen], &h), rb.Bytes())
+		rb.Release()
+	}
+}
+
+// 模拟广播时，每个音视频消息切割成chunk一次
+func benchmarkMessage2Chunks(b *testing.B, ref bool) {
+	msg := make([]byte, 16*1024)
+	h := base.RtmpHeader{
+		Csid:         CsidVideo,
+		MsgLen:       uint32(len(msg)),
+		MsgTypeId:    base.RtmpTypeIdVideo,
+		MsgStreamId:  Msid1,
+		TimestampAbs: 123,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if ref {
+			Message2ChunksRef(msg, &h).Release()
+		} else {
+			_ = Message2Chunks(msg, &h)
+		}
+	}
+}
+
+func BenchmarkMessage2Chunks(b *testing.B) {
+	benchmarkMessage2Chunks(b, false)
+}
+
+func BenchmarkMessage2ChunksRef(b *testing.B) {
+	benchmarkMessage2Chunks(b, true)
+}
@@ -33,6 +33,7 @@ type PullSessionOption struct {
 	PeerWinAckSize             int
 
 	HandshakeComplexFlag bool
+	MaxRedirectNum       int // 见 ClientSessionOption.MaxRedirectNum
 	// TlsConfig
 	// rtmps时使用。
 	// 不关心可以不填。
@@ -48,6 +49,7 @@ var defaultPullSessionOption = PullSessionOption{
 	HandshakeComplexFlag:       false,
 	PeerWinAckSize:             0,
 	ReuseReadMessageBufferFlag: true,
+	MaxRedirectNum:             3,
 }
 
 type ModPullSessionOption func(option *PullSessionOption)
@@ -66,6 +68,7 @@ func NewPullSession(modOptions ...ModPullSessionOption) *PullSession {
 			option.HandshakeComplexFlag = opt.HandshakeComplexFlag
 			option.PeerWinAckSize = opt.PeerWinAckSize
 			option.ReuseReadMessageBufferFlag = opt.ReuseReadMessageBufferFlag
+			option.MaxRedirectNum = opt.MaxRedirectNum
 		}),
 	}
 }
@@ -30,6 +30,8 @@ type PushSessionOption struct {
 	WriteChanSize    int // io层发送音视频数据的异步队列大小，如果为0，则同步发送
 
 	HandshakeComplexFlag bool
+	MaxRedirectNum       int // 见 ClientSessionOption.MaxRedirectNum
+	MaxReconnectNum      int // 见 ClientSessionOption.MaxReconnectNum
 	// TlsConfig
 	// rtmps时使用。
 	// 不关心可以不填。
@@ -44,6 +46,8 @@ var defaultPushSessionOption = PushSessionOption{
 	WriteBufSize:         0,
 	WriteChanSize:        0,
 	HandshakeComplexFlag: false,
+	MaxRedirectNum:       3,
+	MaxReconnectNum:      3,
 }
 
 type ModPushSessionOption func(option *PushSessionOption)
@@ -61,6 +65,8 @@ func NewPushSession(modOptions ...ModPushSessionOption) *PushSession {
 			option.WriteBufSize = opt.WriteBufSize
 			option.WriteChanSize = opt.WriteChanSize
 			option.HandshakeComplexFlag = opt.HandshakeComplexFlag
+			option.MaxRedirectNum = opt.MaxRedirectNum
+			option.MaxReconnectNum = opt.MaxReconnectNum
 		}),
 	}
 }
@@ -79,12 +85,27 @@ func (s *PushSession) Write(msg []byte) error {
 	return s.core.Write(msg)
 }
 
+// WriteRefBuffer 和 Write 相同，调用方仍然负责释放自己的引用
+func (s *PushSession) WriteRefBuffer(rb *base.RefBuffer) error {
+	if s.core.option.WriteChanSize > 0 {
+		// connection的异步发送不通知何时发送完成，内存块不能再放回内存池
+		rb.Detach()
+	}
+	return s.core.Write(rb.Bytes())
+}
+
 // Flush 将缓存的数据立即刷新发送
 // 是否有缓存策略，请参见配置及内部实现
 func (s *PushSession) Flush() error {
 	return s.core.Flush()
 }
 
+// Republished 服务端要求重连（NetConnection.Connect.ReconnectRequest）时，内部会重新建立连接并publish，期间 Write 的数据被丢弃。
+// 重新publish成功后，第一次调用返回true，此时业务方应该像对待新的session一样，重新发送metadata、seq header等
+func (s *PushSession) Republished() bool {
+	return s.core.takeRepublished()
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // IClientSessionLifecycle interface
 // ---------------------------------------------------------------------------------------------------------------------
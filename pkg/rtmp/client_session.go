@@ -10,10 +10,9 @@ package rtmp
 
 import (
 	"context"
-	"crypto/md5"
 	"crypto/tls"
-	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -26,6 +25,13 @@ import (
 	"github.com/q191201771/naza/pkg/connection"
 )
 
+// 内部使用，表示需要关闭当前连接，重新建立连接
+var (
+	errClientAuthReconnect    = errors.New("lal.rtmp: reconnect with auth params")
+	errClientRedirect         = errors.New("lal.rtmp: reconnect to redirect url")
+	errClientReconnectRequest = errors.New("lal.rtmp: reconnect requested by server")
+)
+
 // ClientSession rtmp 客户端类型连接的底层实现
 // package rtmp 的使用者应该优先使用基于 ClientSession 实现的 PushSession 和 PullSession
 type ClientSession struct {
@@ -44,8 +50,17 @@ type ClientSession struct {
 	conn                  connection.Connection
 	doResultChan          chan struct{}
 	errChan               chan error
+	waitChan              chan error
 	hasNotifyDoResultSucc bool
 
+	// 服务端要求重连时会替换conn，以下字段由connMutex保护
+	connMutex    sync.Mutex
+	reconnecting bool // 正在重新建立连接并publish，期间发送的数据被丢弃
+	republished  bool // 重新publish成功，见 PushSession.Republished
+	disposed     bool
+
+	reconnectDeadline time.Time // 重新publish的超时时间，重连时 Do 已经返回，所以使用连接的deadline
+
 	sessionStat base.BasicSessionStat
 
 	debugLogReadUserCtrlMsgCount int
@@ -54,14 +69,17 @@ type ClientSession struct {
 	recvLastAck uint64
 	seqNum      uint32
 
-	disposeOnce sync.Once
-	authInfo    AuthInfo
+	disposeOnce  sync.Once
+	authInfo     AuthInfo
+	redirectNum  int
+	reconnectNum int
 }
 
+// AuthInfo connect信令challenge/response鉴权过程中的状态，见 auth.go
 type AuthInfo struct {
-	challenge string
-	salt      string
-	opaque    string
+	mod       string // 服务端要求的鉴权方式，见 AuthModAdobe AuthModLlnw
+	query     string // 重新建立连接时，app和tcUrl后面追加的鉴权参数
+	responded bool   // 已经携带response重新连接过
 }
 
 type ClientSessionOption struct {
@@ -83,6 +101,10 @@ type ClientSessionOption struct {
 	PeerWinAckSize int
 
 	HandshakeComplexFlag bool // 握手是否使用复杂模式
+
+	MaxRedirectNum  int // 最多跟随服务端重定向（connect被拒绝，并且携带了ex.redirect）的次数，如果为0，则不跟随
+	MaxReconnectNum int // 推流时最多响应服务端重连请求（NetConnection.Connect.ReconnectRequest）的次数，超过后推流失败，如果为0，则不重连
+
 	// TlsConfig
 	// rtmps时使用。
 	// 不关心可以不填。
@@ -101,6 +123,8 @@ var defaultClientSessOption = ClientSessionOption{
 	HandshakeComplexFlag:       false,
 	PeerWinAckSize:             0,
 	ReuseReadMessageBufferFlag: true,
+	MaxRedirectNum:             3,
+	MaxReconnectNum:            3,
 }
 
 type ModClientSessionOption func(option *ClientSessionOption)
@@ -137,6 +161,7 @@ func NewClientSession(sessionType base.SessionType, modOptions ...ModClientSessi
 		debugLogReadUserCtrlMsgMax: 5,
 		hc:                         hc,
 		errChan:                    make(chan error, 1),
+		waitChan:                   make(chan error, 1),
 	}
 	Log.Infof("[%s] lifecycle new rtmp ClientSession. session=%p", s.UniqueKey(), s)
 	return s
@@ -167,18 +192,26 @@ func (s *ClientSession) Do(rawUrl string) error {
 }
 
 func (s *ClientSession) Write(msg []byte) error {
-	if s.conn == nil {
+	conn, reconnecting := s.getConn()
+	if conn == nil {
 		return base.ErrSessionNotStarted
 	}
-	_, err := s.conn.Write(msg)
+	if reconnecting {
+		return nil
+	}
+	_, err := conn.Write(msg)
 	return err
 }
 
 func (s *ClientSession) Flush() error {
-	if s.conn == nil {
+	conn, reconnecting := s.getConn()
+	if conn == nil {
 		return base.ErrSessionNotStarted
 	}
-	return s.conn.Flush()
+	if reconnecting {
+		return nil
+	}
+	return conn.Flush()
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -191,8 +224,10 @@ func (s *ClientSession) Dispose() error {
 }
 
 // WaitChan 文档请参考： IClientSessionLifecycle interface
+//
+// 注意，服务端要求重连时，底层连接会被替换，但是不会通知WaitChan
 func (s *ClientSession) WaitChan() <-chan error {
-	return s.conn.Done()
+	return s.waitChan
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
@@ -220,47 +255,94 @@ func (s *ClientSession) UniqueKey() string {
 // ----- ISessionStat --------------------------------------------------------------------------------------------------
 
 func (s *ClientSession) GetStat() base.StatSession {
-	return s.sessionStat.GetStatWithConn(s.conn)
+	conn, _ := s.getConn()
+	return s.sessionStat.GetStatWithConn(conn)
 }
 
 func (s *ClientSession) UpdateStat(intervalSec uint32) {
-	s.sessionStat.UpdateStatWitchConn(s.conn, intervalSec)
+	conn, _ := s.getConn()
+	s.sessionStat.UpdateStatWitchConn(conn, intervalSec)
 }
 
 func (s *ClientSession) IsAlive() (readAlive, writeAlive bool) {
-	return s.sessionStat.IsAliveWitchConn(s.conn)
+	conn, _ := s.getConn()
+	return s.sessionStat.IsAliveWitchConn(conn)
 }
 
 // ---------------------------------------------------------------------------------------------------------------------
 
-func (s *ClientSession) connect() {
+func (s *ClientSession) connect(ctx context.Context) {
+	for {
+		err := s.runConnection()
+		if !s.shouldReconnect(ctx, err) {
+			if !s.hasNotifyDoResultSucc {
+				// 比如connect被拒绝，使得 Do 尽快返回
+				select {
+				case s.errChan <- err:
+				default:
+				}
+			}
+			_ = s.dispose(err)
+			return
+		}
+
+		// 关闭当前连接，重新建立连接
+		_ = s.conn.Close()
+		s.chunkComposer = NewChunkComposer()
+		s.chunkComposer.SetReuseBufferFlag(s.option.ReuseReadMessageBufferFlag)
+	}
+}
+
+// runConnection 建立连接，发送connect信令，阻塞直到连接断开
+func (s *ClientSession) runConnection() error {
 	if err := s.tcpConnect(); err != nil {
-		s.errChan <- err
-		return
+		return err
 	}
 
 	if err := s.handshake(); err != nil {
-		s.errChan <- err
-		return
+		return err
 	}
 
 	Log.Infof("[%s] > W SetChunkSize %d.", s.UniqueKey(), LocalChunkSize)
 	if err := s.packer.writeChunkSize(s.conn, LocalChunkSize); err != nil {
-		s.errChan <- err
-		return
+		return err
 	}
 
 	Log.Infof("[%s] > W connect('%s'). tcUrl=%s", s.UniqueKey(), s.appName(), s.tcUrl())
 	if err := s.packer.writeConnect(s.conn, s.appName(), s.tcUrl(), s.sessionStat.BaseType() == base.SessionBaseTypePushStr); err != nil {
-		s.errChan <- err
-		return
+		return err
 	}
 
-	s.runReadLoop()
+	return s.chunkComposer.RunLoop(s.conn, s.doMsg)
+}
+
+func (s *ClientSession) shouldReconnect(ctx context.Context, err error) bool {
+	switch err {
+	case errClientAuthReconnect, errClientRedirect:
+		// Do 超时或者返回后不再重连
+		return ctx.Err() == nil
+	case errClientReconnectRequest:
+		s.connMutex.Lock()
+		defer s.connMutex.Unlock()
+		if s.disposed {
+			return false
+		}
+		s.reconnecting = true
+		// 重连期间没有 Do 的超时控制，DoTimeoutMs为0时也使用默认的超时，避免一直丢弃数据
+		timeoutMs := s.option.DoTimeoutMs
+		if timeoutMs == 0 {
+			timeoutMs = defaultClientSessOption.DoTimeoutMs
+		}
+		s.reconnectDeadline = time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+		// 服务端的challenge只能使用一次，重新走一遍鉴权流程
+		s.authInfo = AuthInfo{}
+		return true
+	}
+	return false
 }
 
 func (s *ClientSession) doContext(ctx context.Context) error {
-	go s.connect()
+	go s.connect(ctx)
 
 	select {
 	case <-ctx.Done():
@@ -284,9 +366,14 @@ func (s *ClientSession) parseUrl(rawUrl string) (err error) {
 }
 
 func (s *ClientSession) tcUrl() string {
-	return fmt.Sprintf("%s://%s/%s", s.urlCtx.Scheme, s.urlCtx.StdHost, s.urlCtx.PathWithoutLastItem)
+	return fmt.Sprintf("%s://%s/%s", s.urlCtx.Scheme, s.urlCtx.StdHost, s.appName())
 }
+
+// appName connect信令中的app，鉴权过程中带有鉴权参数
 func (s *ClientSession) appName() string {
+	if s.authInfo.query != "" {
+		return fmt.Sprintf("%s?%s", s.urlCtx.PathWithoutLastItem, s.authInfo.query)
+	}
 	return s.urlCtx.PathWithoutLastItem
 }
 
@@ -314,13 +401,28 @@ func (s *ClientSession) tcpConnect() error {
 		}
 	}
 
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.disposed {
+		_ = conn.Close()
+		return base.ErrSessionNotStarted
+	}
 	s.conn = connection.New(conn, func(option *connection.Option) {
 		option.ReadBufSize = s.option.ReadBufSize
 		option.WriteChanFullBehavior = connection.WriteChanFullBehaviorBlock
 	})
+	if s.reconnecting && !s.reconnectDeadline.IsZero() {
+		_ = s.conn.SetDeadline(s.reconnectDeadline)
+	}
 	return nil
 }
 
+func (s *ClientSession) getConn() (conn connection.Connection, reconnecting bool) {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	return s.conn, s.reconnecting
+}
+
 func (s *ClientSession) handshake() error {
 	Log.Infof("[%s] > W Handshake C0+C1.", s.UniqueKey())
 	if err := s.hc.WriteC0C1(s.conn); err != nil {
@@ -344,12 +446,6 @@ func (s *ClientSession) handshake() error {
 	return nil
 }
 
-func (s *ClientSession) runReadLoop() {
-	if err := s.chunkComposer.RunLoop(s.conn, s.doMsg); err != nil {
-		_ = s.dispose(err)
-	}
-}
-
 func (s *ClientSession) doMsg(stream *Stream) error {
 	if err := s.writeAcknowledgementIfNeeded(stream); err != nil {
 		return err
@@ -364,8 +460,13 @@ func (s *ClientSession) doMsg(stream *Stream) error {
 		return s.doProtocolControlMessage(stream)
 	case base.RtmpTypeIdCommandMessageAmf0:
 		return s.doCommandMessage(stream)
+	case base.RtmpTypeIdCommandMessageAmf3:
+		stream.msg.skipAmf3FormatByte()
+		return s.doCommandMessage(stream)
 	case base.RtmpTypeIdMetadata:
 		return s.doDataMessageAmf0(stream)
+	case base.RtmpTypeIdDataMessageAmf3:
+		return s.doDataMessageAmf3(stream)
 	case base.RtmpTypeIdAck:
 		return s.doAck(stream)
 	case base.RtmpTypeIdUserControl:
@@ -418,6 +519,24 @@ func (s *ClientSession) doDataMessageAmf0(stream *Stream) error {
 	return nil
 }
 
+func (s *ClientSession) doDataMessageAmf3(stream *Stream) error {
+	msg, err := stream.toAmf0DataMsg()
+	if err != nil {
+		return err
+	}
+
+	val, _, err := Amf0.ReadString(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if val == "|RtmpSampleAccess" {
+		Log.Debugf("[%s] < R |RtmpSampleAccess, ignore.", s.UniqueKey())
+		return nil
+	}
+	s.onReadRtmpAvMsg(msg)
+	return nil
+}
+
 func (s *ClientSession) doCommandMessage(stream *Stream) error {
 	cmd, err := stream.msg.readStringWithType()
 	if err != nil {
@@ -453,74 +572,130 @@ func (s *ClientSession) doErrorMessage(stream *Stream, tid int) error {
 	if err != nil {
 		return err
 	}
-	if s.sessionStat.BaseType() == base.SessionBaseTypePushStr {
-		description, err := infos.FindString("description")
-		if err != nil {
-			return err
-		}
+	code, _ := infos.FindString("code")
+	description, _ := infos.FindString("description")
+	Log.Warnf("[%s] < R _error(). code=%s, description=%s", s.UniqueKey(), code, description)
 
-		return s.dealErrorMessage(description)
+	if tid != tidClientConnect {
+		return nil
 	}
-
-	return nil
-}
-
-func (s *ClientSession) parseAuthorityInfo(auth string) {
-	// 解析salt、challenge、opaque字段
-	res := strings.Split(auth, "&")
-	for _, info := range res {
-		if pos := strings.IndexAny(info, "="); pos > 0 {
-			switch info[:pos] {
-			case "salt":
-				s.authInfo.salt = info[pos+1:]
-			case "challenge":
-				s.authInfo.challenge = info[pos+1:]
-			case "opaque":
-				s.authInfo.opaque = info[pos+1:]
-			}
+	if ex, ok := infos.Find("ex").(ObjectPairArray); ok {
+		if redirect, err := ex.FindString("redirect"); err == nil && redirect != "" {
+			return s.dealRedirect(redirect)
 		}
 	}
+	if isAuthRejectDescription(description) {
+		return s.dealAuthReject(description)
+	}
+	return fmt.Errorf("%w. code=%s, description=%s", base.ErrRtmpConnectRejected, code, description)
 }
 
-func (s *ClientSession) dealErrorMessage(description string) (err error) {
-	if strings.Contains(description, "code=403 need auth") {
-		// app和tcUrl需要加上streamid、authmod、user
-		s.urlCtx.PathWithoutLastItem = fmt.Sprintf("%s/%s?authmod=adobe&user=%s", s.urlCtx.PathWithoutLastItem, s.urlCtx.LastItemOfPath, s.urlCtx.Username)
-
-		//关闭上一次连接并发起新的连接
-		s.conn.Close()
-		s.connect()
-	} else if strings.Contains(description, "?reason=needauth") {
-		descriptions := strings.Split(description, ":")
-		if len(descriptions) != 3 {
-			err = fmt.Errorf("inavlid message: %s", description)
-			return err
-		} else {
-			descriptions[2] = strings.Replace(descriptions[2], " ", "", -1)
-			replacestr := fmt.Sprintf("?reason=needauth&user=%s&", s.urlCtx.Username)
-			authinfo := strings.Replace(descriptions[2], replacestr, "", -1)
+// dealAuthReject 处理服务端connect鉴权的回复，见 auth.go
+//
+// @return 返回 errClientAuthReconnect 时，需要携带鉴权参数重新建立连接
+func (s *ClientSession) dealAuthReject(description string) error {
+	user := s.urlCtx.Username
+	if user == "" {
+		return fmt.Errorf("%w. server need auth but no username in url. description=%s", base.ErrRtmpAuthFailed, description)
+	}
 
-			s.parseAuthorityInfo(authinfo)
+	// 第1步，服务端要求鉴权
+	if strings.Contains(description, "code=403 need auth") {
+		switch {
+		case strings.Contains(description, "authmod="+AuthModAdobe):
+			s.authInfo.mod = AuthModAdobe
+		case strings.Contains(description, "authmod="+AuthModLlnw):
+			s.authInfo.mod = AuthModLlnw
+		default:
+			return fmt.Errorf("%w. unsupported authmod. description=%s", base.ErrRtmpAuthFailed, description)
+		}
+		if s.authInfo.query != "" {
+			return fmt.Errorf("%w. description=%s", base.ErrRtmpAuthFailed, description)
+		}
+		s.authInfo.query = fmt.Sprintf("authmod=%s&user=%s", s.authInfo.mod, user)
+		return errClientAuthReconnect
+	}
 
-			// base64(md5(username|salt|password))作为新的salt1
-			mds := md5.Sum([]byte(s.urlCtx.Username + s.authInfo.salt + s.urlCtx.Password))
-			salt1 := base64.StdEncoding.EncodeToString(mds[:])
+	i := strings.Index(description, "?reason=")
+	if i == -1 {
+		return fmt.Errorf("%w. description=%s", base.ErrRtmpAuthFailed, description)
+	}
+	params := parseAuthParams(description[i+1:])
+	if params["reason"] != authReasonNeedAuth || s.authInfo.mod == "" || s.authInfo.responded {
+		// 比如 authReasonAuthFailed authReasonNoSuchUser
+		return fmt.Errorf("%w. reason=%s", base.ErrRtmpAuthFailed, params["reason"])
+	}
 
-			// response = base64(md5(salt1|opaque|challenge))
-			mds1 := md5.Sum([]byte(salt1 + s.authInfo.opaque + s.authInfo.challenge))
-			response := base64.StdEncoding.EncodeToString(mds1[:])
+	// 第2步，根据服务端下发的challenge计算response
+	switch s.authInfo.mod {
+	case AuthModAdobe:
+		opaque := params["opaque"]
+		if opaque == "" {
+			opaque = params["challenge"]
+		}
+		challenge := genAuthRandom(4)
+		response := adobeAuthResponse(user, s.urlCtx.Password, params["salt"], opaque, challenge)
+		s.authInfo.query = fmt.Sprintf("authmod=%s&user=%s&challenge=%s&response=%s", AuthModAdobe, user, challenge, response)
+		if params["opaque"] != "" {
+			s.authInfo.query += "&opaque=" + params["opaque"]
+		}
+	case AuthModLlnw:
+		cnonce := genAuthRandom(4)
+		response := llnwAuthResponse(user, s.urlCtx.Password, s.urlCtx.PathWithoutLastItem, params["nonce"], cnonce)
+		s.authInfo.query = fmt.Sprintf("authmod=%s&user=%s&nonce=%s&cnonce=%s&nc=%s&response=%s",
+			AuthModLlnw, user, params["nonce"], cnonce, llnwNc, response)
+	}
+	s.authInfo.responded = true
+	return errClientAuthReconnect
+}
 
-			// app和tcUrl需要加上challenge、response、opaque字段
-			s.urlCtx.PathWithoutLastItem = fmt.Sprintf("%s&challenge=%s&response=%s&opaque=%s", s.urlCtx.PathWithoutLastItem, s.authInfo.challenge, response, s.authInfo.opaque)
+// dealRedirect 服务端拒绝connect，并要求连接到其他地址
+func (s *ClientSession) dealRedirect(tcUrl string) error {
+	if s.redirectNum >= s.option.MaxRedirectNum {
+		return fmt.Errorf("%w. redirect=%s, num=%d", base.ErrRtmpTooManyRedirects, tcUrl, s.redirectNum)
+	}
+	if err := s.switchUrl(tcUrl); err != nil {
+		return err
+	}
+	s.redirectNum++
+	Log.Infof("[%s] redirect. url=%s, num=%d", s.UniqueKey(), s.urlCtx.Url, s.redirectNum)
+	return errClientRedirect
+}
 
-			// 关闭前一个连接并发起新的连接
-			s.conn.Close()
-			s.connect()
+// dealReconnectRequest 服务端要求重连，比如服务端准备下线
+//
+// 推流时重新建立连接并publish，对业务方透明，见 PushSession.Republished 。拉流时忽略
+func (s *ClientSession) dealReconnectRequest(infos ObjectPairArray) error {
+	tcUrl, _ := infos.FindString("tcUrl")
+	if s.sessionStat.BaseType() != base.SessionBaseTypePushStr || !s.hasNotifyDoResultSucc {
+		Log.Warnf("[%s] < R onStatus('NetConnection.Connect.ReconnectRequest'). ignore. tcUrl=%s", s.UniqueKey(), tcUrl)
+		return nil
+	}
+	Log.Infof("[%s] < R onStatus('NetConnection.Connect.ReconnectRequest'). tcUrl=%s", s.UniqueKey(), tcUrl)
+	if s.reconnectNum >= s.option.MaxReconnectNum {
+		return fmt.Errorf("%w. tcUrl=%s, num=%d", base.ErrRtmpTooManyReconnects, tcUrl, s.reconnectNum)
+	}
+	s.reconnectNum++
+	if tcUrl != "" {
+		if err := s.switchUrl(tcUrl); err != nil {
+			return err
 		}
-	} else {
-		err = fmt.Errorf("invalid errmessage: %s", description)
+	}
+	return errClientReconnectRequest
+}
+
+// switchUrl 后续连接到`tcUrl`，流名称、url参数、用户名和密码保持不变
+func (s *ClientSession) switchUrl(tcUrl string) error {
+	urlCtx, err := base.ParseRtmpUrl2(fmt.Sprintf("%s/%s", strings.TrimSuffix(tcUrl, "/"), s.streamNameWithRawQuery()))
+	if err != nil {
 		return err
 	}
+	if urlCtx.Username == "" {
+		urlCtx.Username = s.urlCtx.Username
+		urlCtx.Password = s.urlCtx.Password
+	}
+	s.urlCtx = urlCtx
+	s.authInfo = AuthInfo{}
 	return nil
 }
 
@@ -536,6 +711,9 @@ func (s *ClientSession) doOnStatusMessage(stream *Stream, tid int) error {
 	if err != nil {
 		return err
 	}
+	if code == "NetConnection.Connect.ReconnectRequest" {
+		return s.dealReconnectRequest(infos)
+	}
 	switch s.sessionStat.BaseType() {
 	case base.SessionBaseTypePushStr:
 		switch code {
@@ -655,6 +833,20 @@ func (s *ClientSession) writeAcknowledgementIfNeeded(stream *Stream) error {
 	return s.packer.writeAcknowledgement(s.conn, seqNum)
 }
 func (s *ClientSession) notifyDoResultSucc() {
+	s.connMutex.Lock()
+	reconnecting := s.reconnecting
+	s.connMutex.Unlock()
+	if reconnecting {
+		_ = s.conn.SetDeadline(time.Time{})
+		s.modConnProps()
+		Log.Infof("[%s] republish succ.", s.UniqueKey())
+		s.connMutex.Lock()
+		s.reconnecting = false
+		s.republished = true
+		s.connMutex.Unlock()
+		return
+	}
+
 	// 碰上过对端服务器实现有问题，对于play信令回复了两次相同的结果，我们在这里忽略掉非第一次的回复
 	if s.hasNotifyDoResultSucc {
 		Log.Warnf("[%s] has notified do result succ already, ignore it", s.UniqueKey())
@@ -662,6 +854,13 @@ func (s *ClientSession) notifyDoResultSucc() {
 	}
 	s.hasNotifyDoResultSucc = true
 
+	s.modConnProps()
+
+	s.onDoResult()
+	s.doResultChan <- struct{}{}
+}
+
+func (s *ClientSession) modConnProps() {
 	s.conn.ModWriteChanSize(s.option.WriteChanSize)
 	//pull有可能还需要小包发送，不使用缓存
 	if s.sessionStat.BaseType() == base.SessionBaseTypePushStr {
@@ -670,20 +869,32 @@ func (s *ClientSession) notifyDoResultSucc() {
 
 	s.conn.ModReadTimeoutMs(s.option.ReadAvTimeoutMs)
 	s.conn.ModWriteTimeoutMs(s.option.WriteAvTimeoutMs)
+}
 
-	s.onDoResult()
-	s.doResultChan <- struct{}{}
+// takeRepublished 重新publish成功后，第一次调用返回true
+func (s *ClientSession) takeRepublished() bool {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	republished := s.republished
+	s.republished = false
+	return republished
 }
 
 func (s *ClientSession) dispose(err error) error {
 	var retErr error
 	s.disposeOnce.Do(func() {
 		Log.Infof("[%s] lifecycle dispose rtmp ClientSession. err=%+v", s.UniqueKey(), err)
-		if s.conn == nil {
+		s.connMutex.Lock()
+		s.disposed = true
+		conn := s.conn
+		s.connMutex.Unlock()
+		// 注意，不管是否建立过连接，都通知 WaitChan
+		s.waitChan <- err
+		if conn == nil {
 			retErr = base.ErrSessionNotStarted
 			return
 		}
-		retErr = s.conn.Close()
+		retErr = conn.Close()
 	})
 	return retErr
 }
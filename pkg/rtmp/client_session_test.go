@@ -0,0 +1,162 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+type redirectTestServerObserver struct {
+	authTestServerObserver
+	pubChan chan *ServerSession
+}
+
+func (o *redirectTestServerObserver) OnNewRtmpPubSession(session *ServerSession) error {
+	o.pubChan <- session
+	return nil
+}
+
+// runRedirectTestServer connect时总是回复重定向到`redirect`
+func runRedirectTestServer(ln net.Listener, redirect func() string) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var hs HandshakeServer
+			if hs.ReadC0C1(conn) != nil || hs.WriteS0S1S2(conn) != nil || hs.ReadC2(conn) != nil {
+				return
+			}
+			_ = NewChunkComposer().RunLoop(conn, func(stream *Stream) error {
+				if stream.header.MsgTypeId != base.RtmpTypeIdCommandMessageAmf0 {
+					return nil
+				}
+				packer := NewMessagePacker()
+				_ = packer.writeChunkSize(conn, LocalChunkSize)
+				packer.b.ModWritePos(12)
+				_ = Amf0.WriteString(packer.b, "_error")
+				_ = Amf0.WriteNumber(packer.b, float64(tidClientConnect))
+				_ = Amf0.WriteNull(packer.b)
+				_ = Amf0.WriteObject(packer.b, []ObjectPair{
+					{Key: "level", Value: "error"},
+					{Key: "code", Value: "NetConnection.Connect.Rejected"},
+					{Key: "description", Value: "redirect"},
+					{Key: "ex", Value: ObjectPairArray{
+						{Key: "code", Value: 302},
+						{Key: "redirect", Value: redirect()},
+					}},
+				})
+				_ = packer.ChunkAndWrite(conn, csidOverConnection, base.RtmpTypeIdCommandMessageAmf0, 0)
+				return io.EOF
+			})
+		}()
+	}
+}
+
+func writeReconnectRequest(session *ServerSession) error {
+	packer := NewMessagePacker()
+	packer.b.ModWritePos(12)
+	_ = Amf0.WriteString(packer.b, "onStatus")
+	_ = Amf0.WriteNumber(packer.b, 0)
+	_ = Amf0.WriteNull(packer.b)
+	_ = Amf0.WriteObject(packer.b, []ObjectPair{
+		{Key: "level", Value: "status"},
+		{Key: "code", Value: "NetConnection.Connect.ReconnectRequest"},
+		{Key: "description", Value: "server shutdown"},
+	})
+	return packer.ChunkAndWrite(session.conn, csidOverConnection, base.RtmpTypeIdCommandMessageAmf0, 0)
+}
+
+func TestClientSession_redirectAndReconnect(t *testing.T) {
+	observer := &redirectTestServerObserver{pubChan: make(chan *ServerSession, 4)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	server := NewServer(addr, observer)
+	assert.Equal(t, nil, server.Listen())
+	go server.RunLoop()
+	defer server.Dispose()
+
+	redirectLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Equal(t, nil, err)
+	defer redirectLn.Close()
+	redirectAddr := redirectLn.Addr().String()
+	redirectTo := addr
+	go runRedirectTestServer(redirectLn, func() string { return fmt.Sprintf("rtmp://%s/live", redirectTo) })
+
+	push := NewPushSession(func(option *PushSessionOption) {
+		option.PushTimeoutMs = 3000
+		option.MaxReconnectNum = 1
+	})
+	defer push.Dispose()
+	assert.Equal(t, nil, push.Push(fmt.Sprintf("rtmp://%s/live/test", redirectAddr)))
+	assert.Equal(t, fmt.Sprintf("rtmp://%s/live/test", addr), push.Url())
+
+	var pub *ServerSession
+	select {
+	case pub = <-observer.pubChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait pub session timeout")
+	}
+	assert.Equal(t, "test", pub.StreamName())
+	assert.Equal(t, false, push.Republished())
+
+	// 服务端要求重连，推流session保持不变，重新publish
+	assert.Equal(t, nil, writeReconnectRequest(pub))
+	select {
+	case pub = <-observer.pubChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait republish timeout")
+	}
+	assert.Equal(t, "test", pub.StreamName())
+	republished := false
+	for deadline := time.Now().Add(3 * time.Second); !republished && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		republished = push.Republished()
+	}
+	assert.Equal(t, true, republished)
+	// 只返回一次
+	assert.Equal(t, false, push.Republished())
+	select {
+	case err = <-push.WaitChan():
+		t.Fatal(err)
+	default:
+	}
+	assert.Equal(t, nil, push.Write([]byte{}))
+
+	// 重连次数超过限制，推流失败
+	assert.Equal(t, nil, writeReconnectRequest(pub))
+	select {
+	case err = <-push.WaitChan():
+		assert.Equal(t, true, errors.Is(err, base.ErrRtmpTooManyReconnects))
+	case <-time.After(3 * time.Second):
+		t.Fatal("wait push fail timeout")
+	}
+
+	// 重定向次数超过限制
+	redirectTo = redirectAddr
+	push2 := NewPushSession(func(option *PushSessionOption) {
+		option.PushTimeoutMs = 3000
+		option.MaxRedirectNum = 2
+	})
+	defer push2.Dispose()
+	err = push2.Push(fmt.Sprintf("rtmp://%s/live/test", redirectAddr))
+	assert.Equal(t, true, errors.Is(err, base.ErrRtmpTooManyRedirects))
+}
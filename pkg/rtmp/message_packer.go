@@ -128,8 +128,19 @@ func (packer *MessagePacker) writeConnect(writer io.Writer, appName, tcUrl strin
 
 // @param objectEncoding 设置0或者3，表示是Amf0或AMF3，上层可根据connect信令中的objectEncoding值设置该值
 func (packer *MessagePacker) writeConnectResult(writer io.Writer, tid int, objectEncoding int) error {
+	return packer.writeConnectResultWithTypeId(writer, tid, objectEncoding, base.RtmpTypeIdCommandMessageAmf0)
+}
+
+// writeConnectResultWithTypeId
+//
+// @param typeid 使用和connect信令相同的消息类型回复，base.RtmpTypeIdCommandMessageAmf0 或 base.RtmpTypeIdCommandMessageAmf3
+func (packer *MessagePacker) writeConnectResultWithTypeId(writer io.Writer, tid int, objectEncoding int, typeid uint8) error {
 	packer.b.ModWritePos(12)
 
+	if typeid == base.RtmpTypeIdCommandMessageAmf3 {
+		// 格式选择字节，后面的内容依然是amf0编码
+		_, _ = packer.b.Write([]byte{0})
+	}
 	_ = Amf0.WriteString(packer.b, "_result")
 	_ = Amf0.WriteNumber(packer.b, float64(tid))
 	objs := []ObjectPair{
@@ -146,7 +157,29 @@ func (packer *MessagePacker) writeConnectResult(writer io.Writer, tid int, objec
 	}
 	_ = Amf0.WriteObject(packer.b, objs)
 
-	return packer.ChunkAndWrite(writer, csidOverConnection, base.RtmpTypeIdCommandMessageAmf0, 0)
+	return packer.ChunkAndWrite(writer, csidOverConnection, typeid, 0)
+}
+
+// writeConnectRejected 拒绝connect信令，客户端（比如ffmpeg）根据description判断是否需要鉴权
+//
+// @param typeid 见 writeConnectResultWithTypeId
+func (packer *MessagePacker) writeConnectRejected(writer io.Writer, tid int, description string, typeid uint8) error {
+	packer.b.ModWritePos(12)
+
+	if typeid == base.RtmpTypeIdCommandMessageAmf3 {
+		_, _ = packer.b.Write([]byte{0})
+	}
+	_ = Amf0.WriteString(packer.b, "_error")
+	_ = Amf0.WriteNumber(packer.b, float64(tid))
+	_ = Amf0.WriteNull(packer.b)
+	objs := []ObjectPair{
+		{Key: "level", Value: "error"},
+		{Key: "code", Value: "NetConnection.Connect.Rejected"},
+		{Key: "description", Value: description},
+	}
+	_ = Amf0.WriteObject(packer.b, objs)
+
+	return packer.ChunkAndWrite(writer, csidOverConnection, typeid, 0)
 }
 
 func (packer *MessagePacker) writeCreateStream(writer io.Writer) error {
@@ -236,6 +269,23 @@ func (packer *MessagePacker) writeOnStatusPlay(writer io.Writer, streamid int) e
 	return packer.ChunkAndWrite(writer, csidOverStream, base.RtmpTypeIdCommandMessageAmf0, streamid)
 }
 
+// writeOnStatus play之后的各种状态通知，比如 NetStream.Seek.Notify 、 NetStream.Pause.Notify
+func (packer *MessagePacker) writeOnStatus(writer io.Writer, streamid int, level, code, description string) error {
+	packer.b.ModWritePos(12)
+
+	_ = Amf0.WriteString(packer.b, "onStatus")
+	_ = Amf0.WriteNumber(packer.b, 0)
+	_ = Amf0.WriteNull(packer.b)
+	objs := []ObjectPair{
+		{Key: "level", Value: level},
+		{Key: "code", Value: code},
+		{Key: "description", Value: description},
+	}
+	_ = Amf0.WriteObject(packer.b, objs)
+
+	return packer.ChunkAndWrite(writer, csidOverStream, base.RtmpTypeIdCommandMessageAmf0, streamid)
+}
+
 func (packer *MessagePacker) writeStreamIsRecorded(writer io.Writer, streamid uint32) error {
 	packer.b.ModWritePos(12)
 
@@ -256,6 +306,16 @@ func (packer *MessagePacker) writeStreamBegin(writer io.Writer, streamid uint32)
 	return packer.ChunkAndWrite(writer, csidProtocolControl, base.RtmpTypeIdUserControl, 0)
 }
 
+func (packer *MessagePacker) writeStreamEof(writer io.Writer, streamid uint32) error {
+	packer.b.ModWritePos(12)
+
+	// 6
+	_ = bele.WriteBe(packer.b, uint16(base.RtmpUserControlStreamEof))
+	_ = bele.WriteBe(packer.b, uint32(streamid))
+
+	return packer.ChunkAndWrite(writer, csidProtocolControl, base.RtmpTypeIdUserControl, 0)
+}
+
 func (packer *MessagePacker) writePingRequest(writer io.Writer, timestamp uint32) error {
 	packer.b.ModWritePos(12)
 
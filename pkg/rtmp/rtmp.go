@@ -44,6 +44,25 @@ const (
 
 const ackSeqMax = 0xf0000000
 
+// PubTypeLive PubTypeXxx...
+//
+// publish信令中的发布类型，lalserver中录制为flv文件
+const (
+	PubTypeLive   = "live"   // 只做直播
+	PubTypeRecord = "record" // 直播，并且录制成新的文件
+	PubTypeAppend = "append" // 直播，并且追加到已有的录制文件后面，没有已有文件时同 PubTypeRecord
+)
+
+// CapsExReconnect CapsExXxx...
+//
+// enhanced-rtmp v2，connect信令中capsEx字段的各个bit
+const (
+	CapsExReconnect           = 0x01
+	CapsExMultitrack          = 0x02
+	CapsExModEx               = 0x04
+	CapsExTimestampNanoOffset = 0x08
+)
+
 // ---------------------------------------------------------------------------------------------------------------------
 // ### rtmp connect message
 //
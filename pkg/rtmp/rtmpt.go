@@ -0,0 +1,407 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/nazaerrors"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RTMPT，RTMP tunneled over HTTP
+//
+// 客户端通过短轮询的POST请求交换rtmp数据:
+//   - POST /fcs/ident2            回复404，客户端接着发送open
+//   - POST /open/1                创建会话，回复会话id
+//   - POST /send/<id>/<seq>       body为客户端发送的rtmp数据
+//   - POST /idle/<id>/<seq>       没有数据需要发送时，用于拉取服务端的数据
+//   - POST /close/<id>/<seq>      关闭会话
+//
+// send、idle、close的回复body，第一个字节为建议客户端下次轮询的间隔，后面是服务端发送给客户端的rtmp数据。
+// seq是请求的序号，必须递增，重复或者乱序的请求会导致rtmp数据错乱，所以直接关闭会话。
+//
+// 每个会话由一个虚拟的 net.Conn 承载，从而复用 ServerSession 的逻辑，推流和拉流都支持。
+
+const (
+	HeaderContentTypeRtmpt = "application/x-fcs"
+
+	rtmptCmdOpen  = "open"
+	rtmptCmdSend  = "send"
+	rtmptCmdIdle  = "idle"
+	rtmptCmdClose = "close"
+	rtmptCmdFcs   = "fcs"
+)
+
+var (
+	// RtmptUrlPatterns RTMPT请求的路径，http服务需要将这些路径（加上url pattern前缀）交给 Server.ServeRtmpt 处理
+	RtmptUrlPatterns = []string{"fcs/", "open/", "send/", "idle/", "close/"}
+
+	rtmptSessionTimeout = 30 * time.Second // 客户端超过这个时间没有轮询，关闭会话
+	rtmptMaxPendingSize = 16 * 1024 * 1024 // 等待客户端取走的数据、以及等待读取的客户端数据的最大值，超过时关闭会话
+)
+
+const (
+	rtmptMinPollingDelay = uint8(0x01)
+	rtmptMaxPollingDelay = uint8(0x21)
+)
+
+// ServeRtmpt 供http服务回调，函数签名和 base.Handler 一致
+func (server *Server) ServeRtmpt(writer http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	cmd, id, seq := parseRtmptPath(req.URL.Path)
+	switch cmd {
+	case rtmptCmdOpen:
+		server.handleRtmptOpen(writer, req)
+		return
+	case rtmptCmdSend, rtmptCmdIdle, rtmptCmdClose:
+		// noop
+	default:
+		// 包含/fcs/ident2
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	server.rtmptMutex.Lock()
+	conn := server.id2Rtmpt[id]
+	server.rtmptMutex.Unlock()
+	if conn == nil {
+		Log.Warnf("rtmpt session not found. cmd=%s, id=%s", cmd, id)
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(writer, req.Body, int64(rtmptMaxPendingSize)))
+	if err != nil {
+		Log.Warnf("[%s] read rtmpt body failed. err=%+v", conn.id, err)
+		_ = conn.Close()
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch cmd {
+	case rtmptCmdSend:
+		if err = conn.feed(seq, body); err != nil {
+			Log.Warnf("[%s] rtmpt send failed, close session. seq=%s, len=%d, err=%+v", conn.id, seq, len(body), err)
+			_ = conn.Close()
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeRtmptResponse(writer, conn.poll())
+	case rtmptCmdIdle:
+		if err = conn.active(seq); err != nil {
+			Log.Warnf("[%s] rtmpt idle failed, close session. seq=%s, err=%+v", conn.id, seq, err)
+			_ = conn.Close()
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeRtmptResponse(writer, conn.poll())
+	case rtmptCmdClose:
+		Log.Infof("[%s] rtmpt close by client.", conn.id)
+		_ = conn.Close()
+		writeRtmptResponse(writer, []byte{0})
+	}
+}
+
+func (server *Server) handleRtmptOpen(writer http.ResponseWriter, req *http.Request) {
+	_, _ = io.Copy(io.Discard, http.MaxBytesReader(writer, req.Body, int64(rtmptMaxPendingSize)))
+
+	conn := newRtmptConn(req)
+
+	server.rtmptMutex.Lock()
+	server.id2Rtmpt[conn.id] = conn
+	server.rtmptMutex.Unlock()
+	Log.Infof("[%s] new rtmpt session. raddr=%s", conn.id, req.RemoteAddr)
+
+	go conn.runTimeoutCheck()
+	go func() {
+		server.handleTcpConnect(conn)
+		_ = conn.Close()
+
+		server.rtmptMutex.Lock()
+		delete(server.id2Rtmpt, conn.id)
+		server.rtmptMutex.Unlock()
+	}()
+
+	writeRtmptResponse(writer, []byte(conn.id+"\n"))
+}
+
+// parseRtmptPath 取路径中的命令、会话id以及请求序号，允许命令前面有url pattern前缀
+func parseRtmptPath(path string) (cmd string, id string, seq string) {
+	items := strings.Split(strings.Trim(path, "/"), "/")
+	for i, item := range items {
+		switch item {
+		case rtmptCmdFcs, rtmptCmdOpen:
+			return item, "", ""
+		case rtmptCmdSend, rtmptCmdIdle, rtmptCmdClose:
+			if i+2 < len(items) {
+				return item, items[i+1], items[i+2]
+			}
+			if i+1 < len(items) {
+				return item, items[i+1], ""
+			}
+			return item, "", ""
+		}
+	}
+	return "", "", ""
+}
+
+func writeRtmptResponse(writer http.ResponseWriter, body []byte) {
+	h := writer.Header()
+	h.Set("Content-Type", HeaderContentTypeRtmpt)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "Keep-Alive")
+	_, _ = writer.Write(body)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// rtmptConn 将一个RTMPT会话的多个http请求合成一个 net.Conn
+//
+// 读取的是客户端通过send发送过来的数据，写入的数据缓存起来，等待客户端通过send或idle取走，所以写不会阻塞
+type rtmptConn struct {
+	id         string
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	readNotify chan struct{}
+	closeChan  chan struct{}
+	closeOnce  sync.Once
+
+	mutex          sync.Mutex
+	hasSeq         bool
+	lastSeq        uint64 // 上一个send、idle请求的序号
+	readBuf        []byte
+	writeBuf       []byte
+	readDeadline   time.Time
+	lastActiveTime time.Time
+	pollingDelay   uint8
+}
+
+func newRtmptConn(req *http.Request) *rtmptConn {
+	c := &rtmptConn{
+		id:             genRtmptSessionId(),
+		remoteAddr:     rtmptAddr(req.RemoteAddr),
+		readNotify:     make(chan struct{}, 1),
+		closeChan:      make(chan struct{}),
+		lastActiveTime: time.Now(),
+		pollingDelay:   rtmptMinPollingDelay,
+	}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		c.localAddr = addr
+	} else {
+		c.localAddr = rtmptAddr(req.Host)
+	}
+	return c
+}
+
+// feed 缓存客户端通过send发送的数据，等待 Read 读取
+func (c *rtmptConn) feed(seq string, b []byte) error {
+	c.mutex.Lock()
+	if err := c.checkSeq(seq); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+	if len(c.readBuf)+len(b) > rtmptMaxPendingSize {
+		c.mutex.Unlock()
+		return nazaerrors.Wrap(base.ErrRtmptBufferFull)
+	}
+	c.readBuf = append(c.readBuf, b...)
+	c.lastActiveTime = time.Now()
+	c.mutex.Unlock()
+
+	select {
+	case c.readNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *rtmptConn) active(seq string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.checkSeq(seq); err != nil {
+		return err
+	}
+	c.lastActiveTime = time.Now()
+	return nil
+}
+
+// checkSeq 请求序号必须递增，注意，调用方需要持有锁
+func (c *rtmptConn) checkSeq(seq string) error {
+	v, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return nazaerrors.Wrap(base.ErrRtmptInvalidSeq)
+	}
+	if c.hasSeq && v <= c.lastSeq {
+		return fmt.Errorf("%w. last=%d, curr=%d", base.ErrRtmptInvalidSeq, c.lastSeq, v)
+	}
+	c.hasSeq = true
+	c.lastSeq = v
+	return nil
+}
+
+// poll 取走所有等待发送的数据，前面加上轮询间隔
+func (c *rtmptConn) poll() []byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// 有数据时让客户端尽快轮询，没有数据时逐渐增加轮询间隔
+	if len(c.writeBuf) > 0 {
+		c.pollingDelay = rtmptMinPollingDelay
+	} else if c.pollingDelay < rtmptMaxPollingDelay {
+		c.pollingDelay++
+	}
+
+	ret := make([]byte, 1+len(c.writeBuf))
+	ret[0] = c.pollingDelay
+	copy(ret[1:], c.writeBuf)
+	c.writeBuf = c.writeBuf[:0]
+	return ret
+}
+
+func (c *rtmptConn) runTimeoutCheck() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case <-t.C:
+			c.mutex.Lock()
+			idle := time.Since(c.lastActiveTime)
+			c.mutex.Unlock()
+			if idle > rtmptSessionTimeout {
+				Log.Warnf("[%s] rtmpt session timeout. idle=%v", c.id, idle)
+				_ = c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *rtmptConn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if len(c.readBuf) > 0 {
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			c.mutex.Unlock()
+			return n, nil
+		}
+		deadline := c.readDeadline
+		c.mutex.Unlock()
+
+		var timer *time.Timer
+		var timeoutChan <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeoutChan = timer.C
+		}
+
+		var err error
+		select {
+		case <-c.readNotify:
+		case <-c.closeChan:
+			err = io.EOF
+		case <-timeoutChan:
+			err = os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *rtmptConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.writeBuf)+len(b) > rtmptMaxPendingSize {
+		return 0, nazaerrors.Wrap(base.ErrRtmptBufferFull)
+	}
+	c.writeBuf = append(c.writeBuf, b...)
+	return len(b), nil
+}
+
+func (c *rtmptConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+	})
+	return nil
+}
+
+func (c *rtmptConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *rtmptConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *rtmptConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *rtmptConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readDeadline = t
+	c.mutex.Unlock()
+	return nil
+}
+
+// SetWriteDeadline 写不会阻塞，不需要超时
+func (c *rtmptConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type rtmptAddr string
+
+func (a rtmptAddr) Network() string {
+	return "rtmpt"
+}
+
+func (a rtmptAddr) String() string {
+	return string(a)
+}
+
+func genRtmptSessionId() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,140 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/ysjhlnu/lal/pkg/rtmp"
+)
+
+type rtmptServerObserver struct{}
+
+func (o *rtmptServerObserver) OnRtmpConnect(session *rtmp.ServerSession, opa rtmp.ObjectPairArray) error {
+	return nil
+}
+func (o *rtmptServerObserver) OnNewRtmpPubSession(session *rtmp.ServerSession) error { return nil }
+func (o *rtmptServerObserver) OnDelRtmpPubSession(session *rtmp.ServerSession)       {}
+func (o *rtmptServerObserver) OnNewRtmpSubSession(session *rtmp.ServerSession) error { return nil }
+func (o *rtmptServerObserver) OnDelRtmpSubSession(session *rtmp.ServerSession)       {}
+
+func TestRtmpt(t *testing.T) {
+	s := rtmp.NewServer("", &rtmptServerObserver{})
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeRtmpt))
+	defer hs.Close()
+
+	post := func(path string, body []byte) (int, []byte) {
+		resp, err := http.Post(hs.URL+path, rtmp.HeaderContentTypeRtmpt, bytes.NewReader(body))
+		assert.Equal(t, nil, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.Equal(t, nil, err)
+		return resp.StatusCode, b
+	}
+
+	resp, err := http.Get(hs.URL + "/open/1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	code, _ := post("/fcs/ident2", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, _ = post("/idle/notexist/0", nil)
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body := post("/open/1", []byte{0})
+	assert.Equal(t, http.StatusOK, code)
+	id := strings.TrimSpace(string(body))
+	assert.Equal(t, 16, len(id))
+
+	// 握手，通过send发送c0c1，通过idle拉取s0s1s2
+	var hc rtmp.HandshakeClientSimple
+	c0c1 := &bytes.Buffer{}
+	err = hc.WriteC0C1(c0c1)
+	assert.Equal(t, nil, err)
+	code, body = post("/send/"+id+"/1", c0c1.Bytes())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, len(body) >= 1)
+
+	s0s1s2 := body[1:]
+	seq := 2
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s0s1s2) < 1+1536*2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		code, body = post("/idle/"+id+"/"+strconv.Itoa(seq), nil)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, true, body[0] >= 1 && body[0] <= 0x21)
+		s0s1s2 = append(s0s1s2, body[1:]...)
+		seq++
+	}
+	assert.Equal(t, 1+1536*2, len(s0s1s2))
+	err = hc.ReadS0S1(bytes.NewReader(s0s1s2))
+	assert.Equal(t, nil, err)
+
+	code, body = post("/close/"+id+"/9", nil)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []byte{0}, body)
+}
+
+func TestRtmpt_InvalidRequest(t *testing.T) {
+	s := rtmp.NewServer("", &rtmptServerObserver{})
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeRtmpt))
+	defer hs.Close()
+
+	post := func(path string, body []byte) int {
+		resp, err := http.Post(hs.URL+path, rtmp.HeaderContentTypeRtmpt, bytes.NewReader(body))
+		assert.Equal(t, nil, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	open := func() string {
+		resp, err := http.Post(hs.URL+"/open/1", rtmp.HeaderContentTypeRtmpt, bytes.NewReader([]byte{0}))
+		assert.Equal(t, nil, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		assert.Equal(t, nil, err)
+		return strings.TrimSpace(string(b))
+	}
+	// 会话关闭后，等待会话被删除
+	waitClosed := func(id string) {
+		code := http.StatusOK
+		for i := 0; i < 100 && code != http.StatusNotFound; i++ {
+			time.Sleep(10 * time.Millisecond)
+			code = post("/idle/"+id+"/100000", nil)
+		}
+		assert.Equal(t, http.StatusNotFound, code)
+	}
+
+	// 重复的序号
+	id := open()
+	assert.Equal(t, http.StatusOK, post("/idle/"+id+"/1", nil))
+	assert.Equal(t, http.StatusOK, post("/idle/"+id+"/2", nil))
+	assert.Equal(t, http.StatusBadRequest, post("/send/"+id+"/2", []byte{3}))
+	waitClosed(id)
+
+	// 缺少序号
+	id = open()
+	assert.Equal(t, http.StatusBadRequest, post("/send/"+id, []byte{3}))
+	waitClosed(id)
+
+	// body过大
+	id = open()
+	assert.Equal(t, http.StatusBadRequest, post("/send/"+id+"/1", make([]byte, 16*1024*1024+1)))
+	waitClosed(id)
+}
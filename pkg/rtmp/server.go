@@ -11,12 +11,14 @@ package rtmp
 import (
 	"crypto/tls"
 	"net"
+	"sync"
 
 	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 type IServerObserver interface {
-	OnRtmpConnect(session *ServerSession, opa ObjectPairArray)
+	// OnRtmpConnect 见 IServerSessionObserver.OnRtmpConnect
+	OnRtmpConnect(session *ServerSession, opa ObjectPairArray) error
 
 	// OnNewRtmpPubSession
 	//
@@ -40,15 +42,30 @@ type Server struct {
 	addr     string
 	observer IServerObserver
 	ln       net.Listener
+
+	authenticator  IServerAuthenticator
+	authChallenges *authChallengeStore
+
+	rtmptMutex sync.Mutex
+	id2Rtmpt   map[string]*rtmptConn // RTMPT，见 ServeRtmpt
 }
 
 func NewServer(addr string, observer IServerObserver) *Server {
 	return &Server{
 		addr:     addr,
 		observer: observer,
+		id2Rtmpt: make(map[string]*rtmptConn),
+
+		authChallenges: newAuthChallengeStore(),
 	}
 }
 
+// WithAuthenticator 开启connect信令的challenge/response鉴权，见 IServerAuthenticator
+func (server *Server) WithAuthenticator(authenticator IServerAuthenticator) *Server {
+	server.authenticator = authenticator
+	return server
+}
+
 func (server *Server) Listen() (err error) {
 	if server.ln, err = net.Listen("tcp", server.addr); err != nil {
 		return
@@ -94,6 +111,8 @@ func (server *Server) Dispose() {
 func (server *Server) handleTcpConnect(conn net.Conn) {
 	Log.Infof("accept a rtmp connection. remoteAddr=%s", conn.RemoteAddr().String())
 	session := NewServerSession(server, conn)
+	session.authenticator = server.authenticator
+	session.authChallenges = server.authChallenges
 	_ = session.RunLoop()
 
 	if session.DisposeByObserverFlag {
@@ -109,8 +128,8 @@ func (server *Server) handleTcpConnect(conn net.Conn) {
 
 // ----- IServerSessionObserver ------------------------------------------------------------------------------------
 
-func (server *Server) OnRtmpConnect(session *ServerSession, opa ObjectPairArray) {
-	server.observer.OnRtmpConnect(session, opa)
+func (server *Server) OnRtmpConnect(session *ServerSession, opa ObjectPairArray) error {
+	return server.observer.OnRtmpConnect(session, opa)
 }
 
 func (server *Server) OnNewRtmpPubSession(session *ServerSession) error {
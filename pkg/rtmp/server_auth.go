@@ -0,0 +1,195 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// IServerAuthenticator connect信令challenge/response鉴权（见 auth.go ）使用的账号
+//
+// 默认不鉴权，可通过 Server.WithAuthenticator 设置，比如使用 ServerAuthConfig ，或者按app从数据库获取账号
+type IServerAuthenticator interface {
+	// GetCredential
+	//
+	// 注意，鉴权流程中客户端的每次connect都会调用，包括第一次没有携带鉴权参数的请求
+	//
+	// @return err: 如果返回非nil，则拒绝该连接
+	//
+	GetCredential(req ServerAuthRequest) (ServerAuthCredential, error)
+}
+
+type ServerAuthRequest struct {
+	AppName    string `json:"app_name"` // 去掉了鉴权参数
+	TcUrl      string `json:"tc_url"`
+	RemoteAddr string `json:"remote_addr"`
+	Username   string `json:"username"` // 客户端鉴权参数中的用户名，第一次请求没有携带时为空
+}
+
+type ServerAuthCredential struct {
+	Enable   bool   `json:"enable"`   // false表示不需要鉴权
+	AuthMod  string `json:"auth_mod"` // 见 AuthModAdobe AuthModLlnw
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// ServerAuthConfig 所有app使用同一个账号
+type ServerAuthConfig struct {
+	AuthEnable bool   `json:"auth_enable"`
+	AuthMod    string `json:"auth_mod"` // adobe 或 llnw
+	UserName   string `json:"username"`
+	PassWord   string `json:"password"`
+}
+
+func (c ServerAuthConfig) GetCredential(req ServerAuthRequest) (ServerAuthCredential, error) {
+	return ServerAuthCredential{
+		Enable:   c.AuthEnable,
+		AuthMod:  c.AuthMod,
+		Username: c.UserName,
+		Password: c.PassWord,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// checkAuth connect信令的鉴权
+//
+// 鉴权通过后，去掉appName和tcUrl中的鉴权参数
+//
+// @return description: err不为nil时，回复给客户端的内容
+func (s *ServerSession) checkAuth() (description string, err error) {
+	app, query := splitAuthQuery(s.appName)
+	params := parseAuthParams(query)
+	user := params["user"]
+
+	cred, err := s.authenticator.GetCredential(ServerAuthRequest{
+		AppName:    app,
+		TcUrl:      s.tcUrl,
+		RemoteAddr: s.conn.RemoteAddr().String(),
+		Username:   user,
+	})
+	if err != nil {
+		return err.Error(), fmt.Errorf("%w. %s", base.ErrRtmpAuthFailed, err.Error())
+	}
+	if !cred.Enable {
+		return "", nil
+	}
+	mod := cred.AuthMod
+	if mod != AuthModAdobe && mod != AuthModLlnw {
+		return "unsupported authmod", fmt.Errorf("%w. unsupported authmod. mod=%s", base.ErrRtmpAuthFailed, mod)
+	}
+
+	// 第1步，要求客户端携带鉴权参数，并且鉴权方式和配置的一致，防止鉴权降级
+	if params["authmod"] != mod || user == "" {
+		return authDescriptionNeedAuth(mod), fmt.Errorf("%w. need auth. app=%s", base.ErrRtmpAuthFailed, s.appName)
+	}
+
+	// 第2步，下发challenge
+	if params["response"] == "" {
+		var q string
+		switch mod {
+		case AuthModAdobe:
+			item := authChallengeItem{user: user, salt: genAuthRandom(8), challenge: genAuthRandom(4)}
+			opaque := genAuthRandom(8)
+			s.authChallenges.add(opaque, item)
+			q = fmt.Sprintf("reason=%s&user=%s&salt=%s&challenge=%s&opaque=%s", authReasonNeedAuth, user, item.salt, item.challenge, opaque)
+		case AuthModLlnw:
+			nonce := genAuthRandom(8)
+			s.authChallenges.add(nonce, authChallengeItem{user: user})
+			q = fmt.Sprintf("reason=%s&user=%s&nonce=%s", authReasonNeedAuth, user, nonce)
+		}
+		return authDescriptionReject(mod, q), fmt.Errorf("%w. challenge sent. user=%s", base.ErrRtmpAuthFailed, user)
+	}
+
+	// 第3步，校验response，challenge只能使用一次，防止重放
+	var key, expected string
+	switch mod {
+	case AuthModAdobe:
+		key = params["opaque"]
+		if item, ok := s.authChallenges.take(key); ok && item.user == user {
+			expected = adobeAuthResponse(user, cred.Password, item.salt, key, params["challenge"])
+		}
+	case AuthModLlnw:
+		key = params["nonce"]
+		if item, ok := s.authChallenges.take(key); ok && item.user == user {
+			expected = llnwAuthResponse(user, cred.Password, app, key, params["cnonce"])
+		}
+	}
+	// 使用常量时间比较，防止通过响应时间猜测
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(cred.Username)) == 1
+	responseOk := subtle.ConstantTimeCompare([]byte(params["response"]), []byte(expected)) == 1
+	if !userOk || expected == "" || !responseOk {
+		return authDescriptionReject(mod, fmt.Sprintf("reason=%s", authReasonAuthFailed)),
+			fmt.Errorf("%w. response invalid. user=%s", base.ErrRtmpAuthFailed, user)
+	}
+
+	s.appName = app
+	s.tcUrl, _ = splitAuthQuery(s.tcUrl)
+	return "", nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// authChallengeStore 服务端下发的challenge，客户端重新建立连接后校验，所以存储在 Server 中
+type authChallengeStore struct {
+	mutex     sync.Mutex
+	key2Item  map[string]authChallengeItem
+	expireDur time.Duration
+}
+
+type authChallengeItem struct {
+	user      string
+	salt      string
+	challenge string
+	expire    time.Time
+}
+
+// 存储的数量超过该值时，清理过期的challenge
+var authChallengeStoreMaxItemNum = 4096
+
+func newAuthChallengeStore() *authChallengeStore {
+	return &authChallengeStore{
+		key2Item:  make(map[string]authChallengeItem),
+		expireDur: 60 * time.Second,
+	}
+}
+
+func (st *authChallengeStore) add(key string, item authChallengeItem) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	now := time.Now()
+	if len(st.key2Item) >= authChallengeStoreMaxItemNum {
+		for k, v := range st.key2Item {
+			if now.After(v.expire) {
+				delete(st.key2Item, k)
+			}
+		}
+	}
+	item.expire = now.Add(st.expireDur)
+	st.key2Item[key] = item
+}
+
+// take 取出后删除
+func (st *authChallengeStore) take(key string) (authChallengeItem, bool) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	item, ok := st.key2Item[key]
+	if !ok {
+		return item, false
+	}
+	delete(st.key2Item, key)
+	return item, time.Now().Before(item.expire)
+}
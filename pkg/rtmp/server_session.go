@@ -10,7 +10,9 @@ package rtmp
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
 	"sync"
@@ -26,7 +28,13 @@ import (
 // TODO chef: 没有进化成Pub Sub时的超时释放
 
 type IServerSessionObserver interface {
-	OnRtmpConnect(session *ServerSession, opa ObjectPairArray)
+	// OnRtmpConnect
+	//
+	// @param opa: connect信令中的command object，包含app、tcUrl、flashVer、swfUrl、pageUrl以及自定义字段
+	//
+	// @return 上层如果想拒绝这个连接，则回调中返回不为nil的error值，内部回复 NetConnection.Connect.Rejected ，description为err.Error()
+	//
+	OnRtmpConnect(session *ServerSession, opa ObjectPairArray) error
 
 	// OnNewRtmpPubSession
 	//
@@ -63,17 +71,33 @@ type ServerSession struct {
 	appName                string // const after set
 	streamName             string // const after set
 	rawQuery               string //const after set
+	capsEx                 int    // enhanced-rtmp v2，客户端在connect中声明的扩展能力
+	objectEncoding         int    // 0表示amf0，3表示amf3，和客户端在connect中协商得到
 
 	observer      IServerSessionObserver
 	hs            HandshakeServer
 	chunkComposer *ChunkComposer
 	packer        *MessagePacker
 
+	authenticator  IServerAuthenticator // nil表示不鉴权，见 Server.WithAuthenticator
+	authChallenges *authChallengeStore
+
 	conn        connection.Connection
 	sessionStat base.BasicSessionStat
 
+	// only for SubSession，没有开启 ServerSessionSendQueueConfig 时，是大小为wChanSize的不丢弃数据的队列
+	sendQueue *base.SendQueue
+
+	// only for SubSession
+	playArgs    PlayArgs
+	playFilter  playFilter
+	vodMutex    sync.Mutex   // 保护vodObserver和vodDisposed，SetVodObserver 和 dispose 可能在不同的协程中调用
+	vodObserver IVodObserver // 不为nil时，表示为点播，见 IVodObserver
+	vodDisposed bool
+
 	// only for PubSession
 	avObserver IPubSessionObserver
+	pubType    string // 见 PubTypeLive 等
 
 	// IsFresh ShouldWaitVideoKeyFrame
 	//
@@ -127,11 +151,105 @@ func (s *ServerSession) RunLoop() (err error) {
 }
 
 func (s *ServerSession) Write(msg []byte) error {
-	_, err := s.conn.Write(msg)
+	return s.WriteFrame(msg, base.SendItemTypeOther)
+}
+
+// WriteFrame 发送音视频数据，`typ`用于发送队列积压时的丢弃策略，没有开启 ServerSessionSendQueueConfig 时和 Write 相同
+func (s *ServerSession) WriteFrame(msg []byte, typ base.SendItemType) error {
+	if !s.playFilter.allow(msg) {
+		return nil
+	}
+	if s.sendQueue == nil {
+		_, err := s.conn.Write(msg)
+		return err
+	}
+	return s.push(msg, typ)
+}
+
+// WriteRefBuffer 和 WriteFrame 相同
+//
+// SubSession内部持有`rb`的一个引用，发送或丢弃后释放，内存块可以放回内存池。
+// 调用方仍然负责释放自己的引用。
+func (s *ServerSession) WriteRefBuffer(rb *base.RefBuffer, typ base.SendItemType) error {
+	if !s.playFilter.allow(rb.Bytes()) {
+		return nil
+	}
+	if s.sendQueue == nil {
+		// 还不是SubSession，connection是同步发送
+		_, err := s.conn.Write(rb.Bytes())
+		return err
+	}
+	return s.pushRef(rb, typ)
+}
+
+// WriteRefBuffers 和 Writev 相同，内存块的持有方式和 WriteRefBuffer 相同
+//
+// @param typ: 多个内存块作为一个整体在发送队列中的类型，见 base.MergeWriter
+func (s *ServerSession) WriteRefBuffers(rbs []*base.RefBuffer, typ base.SendItemType) error {
+	// 每个元素是一个完整的消息，有被过滤的消息时才拷贝
+	var filtered []*base.RefBuffer
+	for i, rb := range rbs {
+		if !s.playFilter.allow(rb.Bytes()) {
+			if filtered == nil {
+				filtered = append([]*base.RefBuffer{}, rbs[:i]...)
+			}
+			continue
+		}
+		if filtered != nil {
+			filtered = append(filtered, rb)
+		}
+	}
+	if filtered != nil {
+		rbs = filtered
+	}
+	if len(rbs) == 0 {
+		return nil
+	}
+
+	if s.sendQueue != nil {
+		return s.checkPushErr(s.sendQueue.PushRefs(rbs, typ))
+	}
+	msgs := make(net.Buffers, len(rbs))
+	for i, rb := range rbs {
+		msgs[i] = rb.Bytes()
+	}
+	_, err := s.conn.Writev(msgs)
 	return err
 }
 
+// Writev
+//
+// 每个元素是一个完整的rtmp消息，使用发送队列时，按消息的类型分别放入队列，见 base.SendItemTypeOfRtmpMsg 。
+// 广播音视频数据使用 WriteRefBuffers
 func (s *ServerSession) Writev(msgs net.Buffers) error {
+	// 每个元素是一个完整的消息，有被过滤的消息时才拷贝
+	var filtered net.Buffers
+	for i, msg := range msgs {
+		if !s.playFilter.allow(msg) {
+			if filtered == nil {
+				filtered = append(net.Buffers{}, msgs[:i]...)
+			}
+			continue
+		}
+		if filtered != nil {
+			filtered = append(filtered, msg)
+		}
+	}
+	if filtered != nil {
+		msgs = filtered
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	if s.sendQueue != nil {
+		for _, msg := range msgs {
+			if err := s.push(msg, sendItemTypeOfChunks(msg)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	_, err := s.conn.Writev(msgs)
 	return err
 }
@@ -140,6 +258,21 @@ func (s *ServerSession) Flush() error {
 	return s.conn.Flush()
 }
 
+// SupportMultitrack 客户端在connect的capsEx中声明了支持enhanced-rtmp multitrack
+func (s *ServerSession) SupportMultitrack() bool {
+	return s.capsEx&CapsExMultitrack != 0
+}
+
+// ObjectEncoding 和客户端协商的编码格式，0表示amf0，3表示amf3
+func (s *ServerSession) ObjectEncoding() int {
+	return s.objectEncoding
+}
+
+// PubType 推流端publish信令中的发布类型，见 PubTypeLive 等，only for PubSession
+func (s *ServerSession) PubType() string {
+	return s.pubType
+}
+
 // ----- IServerSessionLifecycle ---------------------------------------------------------------------------------------
 
 func (s *ServerSession) Dispose() error {
@@ -177,7 +310,11 @@ func (s *ServerSession) UpdateStat(intervalSec uint32) {
 }
 
 func (s *ServerSession) GetStat() base.StatSession {
-	return s.sessionStat.GetStatWithConn(s.conn)
+	stat := s.sessionStat.GetStatWithConn(s.conn)
+	if s.sendQueue != nil {
+		stat.DroppedFrameCount = s.sendQueue.DroppedFrameCount()
+	}
+	return stat
 }
 
 func (s *ServerSession) IsAlive() (readAlive, writeAlive bool) {
@@ -230,6 +367,8 @@ func (s *ServerSession) doMsg(stream *Stream) error {
 		err = s.doCommandAmf3Message(stream)
 	case base.RtmpTypeIdMetadata:
 		err = s.doDataMessageAmf0(stream)
+	case base.RtmpTypeIdDataMessageAmf3:
+		err = s.doDataMessageAmf3(stream)
 	case base.RtmpTypeIdAck:
 		err = s.doAck(stream)
 	case base.RtmpTypeIdUserControl:
@@ -354,6 +493,12 @@ func (s *ServerSession) doCommandMessage(stream *Stream) error {
 		return s.doPublish(tid, stream)
 	case "play":
 		return s.doPlay(tid, stream)
+	case "seek":
+		return s.doSeek(tid, stream)
+	case "pause":
+		return s.doPause(tid, stream)
+	case "receiveAudio", "receiveVideo":
+		return s.doReceiveAv(cmd, stream)
 	case "releaseStream":
 		fallthrough
 	case "FCPublish":
@@ -371,10 +516,34 @@ func (s *ServerSession) doCommandMessage(stream *Stream) error {
 }
 
 func (s *ServerSession) doCommandAmf3Message(stream *Stream) error {
-	//去除前面的0就是Amf0的数据
-	stream.msg.Skip(1)
+	// 去除前面的格式选择字节，后面是amf0编码的数据，其中的值可能通过avmplus-object切换为amf3编码，由Amf0的读取函数处理
+	stream.msg.skipAmf3FormatByte()
 	return s.doCommandMessage(stream)
 }
+
+func (s *ServerSession) doDataMessageAmf3(stream *Stream) error {
+	if s.sessionStat.BaseType() != base.SessionBaseTypePubStr {
+		return nazaerrors.Wrap(base.ErrRtmpUnexpectedMsg)
+	}
+
+	// 转换成amf0的data message，上层（比如metadata的解析、转发给rtmp拉流端）只需要处理amf0
+	msg, err := stream.toAmf0DataMsg()
+	if err != nil {
+		return err
+	}
+
+	val, _, err := Amf0.ReadString(msg.Payload)
+	if err != nil {
+		return err
+	}
+	if val == "|RtmpSampleAccess" {
+		Log.Debugf("[%s] < R |RtmpSampleAccess, ignore.", s.UniqueKey())
+		return nil
+	}
+	s.avObserver.OnReadRtmpAvMsg(msg)
+	return nil
+}
+
 func (s *ServerSession) writeAcknowledgementIfNeeded(stream *Stream) error {
 	if s.peerWinAckSize <= 0 {
 		return nil
@@ -410,9 +579,19 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 	if err != nil {
 		Log.Warnf("[%s] tcUrl not exist.", s.UniqueKey())
 	}
-	Log.Infof("[%s] < R connect('%s'). tcUrl=%s", s.UniqueKey(), s.appName, s.tcUrl)
+	if capsEx, err := val.FindNumber("capsEx"); err == nil {
+		s.capsEx = capsEx
+	}
+	Log.Infof("[%s] < R connect('%s'). tcUrl=%s, capsEx=%d", s.UniqueKey(), s.appName, s.tcUrl, s.capsEx)
 
-	s.observer.OnRtmpConnect(s, val)
+	if s.authenticator != nil {
+		if description, err := s.checkAuth(); err != nil {
+			return s.rejectConnect(tid, stream, description, err)
+		}
+	}
+	if err := s.observer.OnRtmpConnect(s, val); err != nil {
+		return s.rejectConnect(tid, stream, err.Error(), fmt.Errorf("%w. %s", base.ErrRtmpConnectRejected, err.Error()))
+	}
 
 	Log.Infof("[%s] > W Window Acknowledgement Size %d.", s.UniqueKey(), windowAcknowledgementSize)
 	if err := s.packer.writeWinAckSize(s.conn, windowAcknowledgementSize); err != nil {
@@ -429,17 +608,31 @@ func (s *ServerSession) doConnect(tid int, stream *Stream) error {
 		return err
 	}
 
-	Log.Infof("[%s] > W _result('NetConnection.Connect.Success').", s.UniqueKey())
-	oe, err := val.FindNumber("objectEncoding")
+	oe, _ := val.FindNumber("objectEncoding")
 	if oe != 0 && oe != 3 {
 		oe = 0
 	}
-	if err := s.packer.writeConnectResult(s.conn, tid, oe); err != nil {
+	s.objectEncoding = oe
+	Log.Infof("[%s] > W _result('NetConnection.Connect.Success'). objectEncoding=%d", s.UniqueKey(), oe)
+	if err := s.packer.writeConnectResultWithTypeId(s.conn, tid, oe, stream.header.MsgTypeId); err != nil {
 		return err
 	}
 	return nil
 }
 
+// rejectConnect 回复 NetConnection.Connect.Rejected ，返回`err`使得连接关闭
+func (s *ServerSession) rejectConnect(tid int, stream *Stream, description string, err error) error {
+	// 发送的消息按 LocalChunkSize 切分，所以先告知对端
+	if werr := s.packer.writeChunkSize(s.conn, LocalChunkSize); werr != nil {
+		return werr
+	}
+	Log.Warnf("[%s] > W _error('NetConnection.Connect.Rejected'). description=%s, err=%+v", s.UniqueKey(), description, err)
+	if werr := s.packer.writeConnectRejected(s.conn, tid, description, stream.header.MsgTypeId); werr != nil {
+		return werr
+	}
+	return err
+}
+
 func (s *ServerSession) doCreateStream(tid int, stream *Stream) error {
 	Log.Infof("[%s] < R createStream().", s.UniqueKey())
 	Log.Infof("[%s] > W _result().", s.UniqueKey())
@@ -471,18 +664,24 @@ func (s *ServerSession) doPublish(tid int, stream *Stream) (err error) {
 	if err != nil {
 		Log.Warnf("[%s] read pubType failed. err=%s", s.UniqueKey(), err)
 	}
-	Log.Debugf("[%s] pubType=%s", s.UniqueKey(), pubType)
-	Log.Infof("[%s] < R publish('%s')", s.UniqueKey(), s.streamNameWithRawQuery)
+	switch pubType {
+	case PubTypeRecord, PubTypeAppend:
+		s.pubType = pubType
+	default:
+		// 没有或者不认识的类型，按直播处理
+		s.pubType = PubTypeLive
+	}
+	Log.Infof("[%s] < R publish('%s', '%s')", s.UniqueKey(), s.streamNameWithRawQuery, pubType)
 
 	Log.Infof("[%s] > W onStatus('NetStream.Publish.Start').", s.UniqueKey())
 	if err = s.packer.writeOnStatusPublish(s.conn, Msid1); err != nil {
 		return err
 	}
 
-	// 回复完信令后修改 connection 的属性
+	// 回复完信令后修改 connection 的属性，需要先设置session类型
+	s.sessionStat.SetBaseType(base.SessionBaseTypePubStr)
 	s.modConnProps()
 
-	s.sessionStat.SetBaseType(base.SessionBaseTypePubStr)
 	err = s.observer.OnNewRtmpPubSession(s)
 	if err != nil {
 		s.DisposeByObserverFlag = true
@@ -506,8 +705,8 @@ func (s *ServerSession) doPlay(tid int, stream *Stream) (err error) {
 
 	s.url = fmt.Sprintf("%s/%s", s.tcUrl, s.streamNameWithRawQuery)
 
-	Log.Infof("[%s] < R play('%s').", s.UniqueKey(), s.streamNameWithRawQuery)
-	// TODO chef: start duration reset
+	s.readPlayArgs(stream)
+	Log.Infof("[%s] < R play('%s'). args=%+v", s.UniqueKey(), s.streamNameWithRawQuery, s.playArgs)
 
 	if err := s.packer.writeStreamIsRecorded(s.conn, Msid1); err != nil {
 		return err
@@ -516,15 +715,22 @@ func (s *ServerSession) doPlay(tid int, stream *Stream) (err error) {
 		return err
 	}
 
+	if s.playArgs.Reset {
+		Log.Infof("[%s] > W onStatus('NetStream.Play.Reset').", s.UniqueKey())
+		if err := s.packer.writeOnStatus(s.conn, Msid1, "status", "NetStream.Play.Reset", "Playing and resetting."); err != nil {
+			return err
+		}
+	}
+
 	Log.Infof("[%s] > W onStatus('NetStream.Play.Start').", s.UniqueKey())
 	if err := s.packer.writeOnStatusPlay(s.conn, Msid1); err != nil {
 		return err
 	}
 
-	// 回复完信令后修改 connection 的属性
+	// 回复完信令后修改 connection 的属性，需要先设置session类型
+	s.sessionStat.SetBaseType(base.SessionBaseTypeSubStr)
 	s.modConnProps()
 
-	s.sessionStat.SetBaseType(base.SessionBaseTypeSubStr)
 	err = s.observer.OnNewRtmpSubSession(s)
 	if err != nil {
 		s.DisposeByObserverFlag = true
@@ -532,14 +738,49 @@ func (s *ServerSession) doPlay(tid int, stream *Stream) (err error) {
 	return err
 }
 
-func (s *ServerSession) modConnProps() {
-	s.conn.ModWriteChanSize(wChanSize)
+func (s *ServerSession) push(b []byte, typ base.SendItemType) error {
+	return s.checkPushErr(s.sendQueue.Push(b, typ))
+}
+
+func (s *ServerSession) pushRef(rb *base.RefBuffer, typ base.SendItemType) error {
+	return s.checkPushErr(s.sendQueue.PushRef(rb, typ))
+}
+
+// ctrlWriter 发送信令。使用发送队列时，信令也放入队列，避免超过队列中还没发送的音视频数据
+func (s *ServerSession) ctrlWriter() io.Writer {
+	if s.sendQueue == nil {
+		return s.conn
+	}
+	return sendQueueCtrlWriter{s: s}
+}
 
+func (s *ServerSession) checkPushErr(err error) error {
+	if errors.Is(err, base.ErrSendQueueSlowConsumer) {
+		_ = s.dispose(err)
+	}
+	return err
+}
+
+func (s *ServerSession) modConnProps() {
 	switch s.sessionStat.BaseType() {
 	case base.SessionBaseTypePubStr:
+		s.conn.ModWriteChanSize(wChanSize)
 		s.conn.ModReadTimeoutMs(serverSessionReadAvTimeoutMs)
 	case base.SessionBaseTypeSubStr:
 		s.conn.ModWriteTimeoutMs(serverSessionWriteAvTimeoutMs)
+		// 由发送队列的协程同步写连接，不再需要connection的channel，
+		// 内存块在发送完成后才释放引用，见 base.RefBuffer
+		queueConfig := ServerSessionSendQueueConfig
+		if !queueConfig.Enable {
+			queueConfig.QueueSize = wChanSize
+		}
+		s.sendQueue = base.NewSendQueue(s.UniqueKey(), queueConfig, func(b []byte) error {
+			_, err := s.conn.Write(b)
+			return err
+		}).WithWritev(func(bs net.Buffers) error {
+			_, err := s.conn.Writev(bs)
+			return err
+		})
 	}
 }
 
@@ -551,7 +792,44 @@ func (s *ServerSession) dispose(err error) error {
 			retErr = base.ErrSessionNotStarted
 			return
 		}
+		if s.sendQueue != nil {
+			s.sendQueue.Dispose()
+		}
+		s.vodMutex.Lock()
+		s.vodDisposed = true
+		vodObserver := s.vodObserver
+		s.vodMutex.Unlock()
+		if vodObserver != nil {
+			vodObserver.OnVodStop()
+		}
 		retErr = s.conn.Close()
 	})
 	return retErr
 }
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+type sendQueueCtrlWriter struct {
+	s *ServerSession
+}
+
+func (w sendQueueCtrlWriter) Write(b []byte) (int, error) {
+	// 注意，MessagePacker 会复用内存块，需要拷贝
+	if err := w.s.push(append([]byte(nil), b...), base.SendItemTypeOther); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// sendItemTypeOfChunks 根据rtmp消息的第一个chunk获取消息在发送队列中的类型，解析失败时返回 base.SendItemTypeOther
+func sendItemTypeOfChunks(b []byte) base.SendItemType {
+	typeid, payload, ok := parseFirstChunk(b)
+	// 太短的消息不是有效的音视频帧
+	if !ok || (typeid != base.RtmpTypeIdAudio && typeid != base.RtmpTypeIdVideo) || len(payload) < 5 {
+		return base.SendItemTypeOther
+	}
+	return base.SendItemTypeOfRtmpMsg(base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: typeid},
+		Payload: payload,
+	})
+}
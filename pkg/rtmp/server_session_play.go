@@ -0,0 +1,316 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtmp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// 拉流端play之后的控制信令:
+//   - seek          点播时跳转到指定位置，直播时回复 NetStream.Seek.Failed
+//   - pause         暂停、恢复。点播时暂停读取文件，直播时暂停期间丢弃音视频数据，恢复后从视频关键帧开始发送
+//   - receiveAudio  是否接收音频，直播和点播都支持
+//   - receiveVideo  是否接收视频，直播和点播都支持，重新开始接收时从视频关键帧开始发送
+//
+// 点播（播放录制的文件）由上层在 IServerSessionObserver.OnNewRtmpSubSession 回调中调用 ServerSession.SetVodObserver 开启，
+// 之后seek和pause交给 IVodObserver 处理。
+
+const (
+	// PlayStartAny play信令中start参数的默认值，优先播放录制的流，不存在时播放直播流
+	PlayStartAny = -2
+
+	// PlayStartLive 只播放直播流，其他负数也认为只播放直播流
+	PlayStartLive = -1
+)
+
+// PlayArgs play信令中流名称后面的可选参数
+type PlayArgs struct {
+	Start    int  // 单位毫秒，见 PlayStartAny PlayStartLive ，大于等于0时表示从该位置开始播放录制的流
+	Duration int  // 单位毫秒，负数表示播放到结束，0表示只播放起始位置的一帧
+	Reset    bool // 是否清空之前的播放列表
+}
+
+// AllowVod 是否可以播放录制的流
+func (a PlayArgs) AllowVod() bool {
+	return a.Start == PlayStartAny || a.Start >= 0
+}
+
+type IVodObserver interface {
+	// OnVodSeek
+	//
+	// @param ms 请求跳转的位置，单位毫秒，相对于文件开头
+	//
+	// @return 实际跳转的位置，返回非nil的err时，回复 NetStream.Seek.Failed
+	//
+	OnVodSeek(ms int64) (int64, error)
+
+	// OnVodPause 暂停或者恢复
+	OnVodPause(pause bool)
+
+	// OnVodStop session关闭时回调
+	OnVodStop()
+}
+
+// SetVodObserver 如果session已经关闭，则立即回调 IVodObserver.OnVodStop
+func (s *ServerSession) SetVodObserver(observer IVodObserver) {
+	s.vodMutex.Lock()
+	disposed := s.vodDisposed
+	if !disposed {
+		s.vodObserver = observer
+	}
+	s.vodMutex.Unlock()
+	if disposed {
+		observer.OnVodStop()
+	}
+}
+
+func (s *ServerSession) IsVod() bool {
+	return s.getVodObserver() != nil
+}
+
+func (s *ServerSession) getVodObserver() IVodObserver {
+	s.vodMutex.Lock()
+	defer s.vodMutex.Unlock()
+	return s.vodObserver
+}
+
+func (s *ServerSession) PlayArgs() PlayArgs {
+	return s.playArgs
+}
+
+// WritePlayComplete 点播播放结束时调用，通知客户端
+func (s *ServerSession) WritePlayComplete() error {
+	// 注意，调用方和读取信令的协程不同，不能共用 s.packer
+	packer := NewMessagePacker()
+	w := s.ctrlWriter()
+	if err := packer.writeStreamEof(w, Msid1); err != nil {
+		return err
+	}
+	Log.Infof("[%s] > W onStatus('NetStream.Play.Stop').", s.UniqueKey())
+	return packer.writeOnStatus(w, Msid1, "status", "NetStream.Play.Stop", "Stopped playing.")
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (s *ServerSession) readPlayArgs(stream *Stream) {
+	s.playArgs = PlayArgs{
+		Start:    PlayStartAny,
+		Duration: -1,
+	}
+	// 可选参数，读取失败时使用默认值
+	if start, err := stream.msg.readNumberWithType(); err == nil {
+		s.playArgs.Start = start
+		if duration, err := stream.msg.readNumberWithType(); err == nil {
+			s.playArgs.Duration = duration
+			if reset, err := stream.msg.readBooleanWithType(); err == nil {
+				s.playArgs.Reset = reset
+			}
+		}
+	}
+}
+
+func (s *ServerSession) doSeek(tid int, stream *Stream) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	ms, err := stream.msg.readNumberWithType()
+	if err != nil {
+		return err
+	}
+	Log.Infof("[%s] < R seek(%d).", s.UniqueKey(), ms)
+
+	vodObserver := s.getVodObserver()
+	if vodObserver == nil {
+		Log.Infof("[%s] > W onStatus('NetStream.Seek.Failed').", s.UniqueKey())
+		return s.packer.writeOnStatus(s.ctrlWriter(), Msid1, "error", "NetStream.Seek.Failed", "Live stream can not seek.")
+	}
+
+	pos, err := vodObserver.OnVodSeek(int64(ms))
+	if err != nil {
+		Log.Warnf("[%s] vod seek failed. err=%+v", s.UniqueKey(), err)
+		Log.Infof("[%s] > W onStatus('NetStream.Seek.Failed').", s.UniqueKey())
+		return s.packer.writeOnStatus(s.ctrlWriter(), Msid1, "error", "NetStream.Seek.Failed", "Seek failed.")
+	}
+
+	Log.Infof("[%s] > W onStatus('NetStream.Seek.Notify').", s.UniqueKey())
+	w := s.ctrlWriter()
+	if err = s.packer.writeOnStatus(w, Msid1, "status", "NetStream.Seek.Notify", fmt.Sprintf("Seeking %d.", pos)); err != nil {
+		return err
+	}
+	if err = s.packer.writeStreamBegin(w, Msid1); err != nil {
+		return err
+	}
+	return s.packer.writeOnStatus(w, Msid1, "status", "NetStream.Play.Start", "Started playing.")
+}
+
+func (s *ServerSession) doPause(tid int, stream *Stream) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	pause, err := stream.msg.readBooleanWithType()
+	if err != nil {
+		return err
+	}
+	// 暂停或恢复时的播放位置，目前没有使用
+	ms, _ := stream.msg.readNumberWithType()
+	Log.Infof("[%s] < R pause(%t, %d).", s.UniqueKey(), pause, ms)
+
+	if vodObserver := s.getVodObserver(); vodObserver != nil {
+		vodObserver.OnVodPause(pause)
+	} else {
+		s.playFilter.setPause(pause)
+	}
+
+	w := s.ctrlWriter()
+	if pause {
+		Log.Infof("[%s] > W onStatus('NetStream.Pause.Notify').", s.UniqueKey())
+		return s.packer.writeOnStatus(w, Msid1, "status", "NetStream.Pause.Notify", "Paused.")
+	}
+	if err = s.packer.writeStreamBegin(w, Msid1); err != nil {
+		return err
+	}
+	Log.Infof("[%s] > W onStatus('NetStream.Unpause.Notify').", s.UniqueKey())
+	return s.packer.writeOnStatus(w, Msid1, "status", "NetStream.Unpause.Notify", "Unpaused.")
+}
+
+func (s *ServerSession) doReceiveAv(cmd string, stream *Stream) error {
+	if err := stream.msg.readNull(); err != nil {
+		return err
+	}
+	flag, err := stream.msg.readBooleanWithType()
+	if err != nil {
+		return err
+	}
+	Log.Infof("[%s] < R %s(%t).", s.UniqueKey(), cmd, flag)
+
+	if cmd == "receiveAudio" {
+		s.playFilter.setReceiveAudio(flag)
+	} else {
+		s.playFilter.setReceiveVideo(flag)
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// playFilter 根据拉流端的pause、receiveAudio、receiveVideo，过滤发送的音视频数据
+//
+// 写数据的协程（group或点播）和读信令的协程不同，所以需要加锁
+type playFilter struct {
+	mutex        sync.Mutex
+	paused       bool
+	noAudio      bool
+	noVideo      bool
+	waitVideoKey bool // 恢复发送视频时，等待关键帧
+	hasVideo     bool
+}
+
+func (f *playFilter) setPause(pause bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.paused && !pause {
+		f.waitVideoKey = f.hasVideo
+	}
+	f.paused = pause
+}
+
+func (f *playFilter) setReceiveAudio(flag bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.noAudio = !flag
+}
+
+func (f *playFilter) setReceiveVideo(flag bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.noVideo && flag {
+		f.waitVideoKey = true
+	}
+	f.noVideo = !flag
+}
+
+// allow
+//
+// @param b: 一个完整的rtmp消息切割成的chunk
+func (f *playFilter) allow(b []byte) bool {
+	typeid, payload, ok := parseFirstChunk(b)
+	if !ok {
+		return true
+	}
+
+	// seq header总是发送，否则恢复接收音视频后无法解码
+	if typeid == base.RtmpTypeIdAudio || typeid == base.RtmpTypeIdVideo {
+		msg := base.RtmpMsg{Header: base.RtmpHeader{MsgTypeId: typeid}, Payload: payload}
+		if base.SendItemTypeOfRtmpMsg(msg) == base.SendItemTypeOther {
+			return true
+		}
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch typeid {
+	case base.RtmpTypeIdAudio:
+		return !f.paused && !f.noAudio
+	case base.RtmpTypeIdVideo:
+		f.hasVideo = true
+		if f.paused || f.noVideo {
+			return false
+		}
+		if f.waitVideoKey {
+			// 兼容enhanced-rtmp，frame type都在第一个字节的4~6位
+			if len(payload) == 0 || (payload[0]>>4)&0x07 != base.RtmpFrameTypeKey {
+				return false
+			}
+			f.waitVideoKey = false
+		}
+	}
+	return true
+}
+
+// parseFirstChunk 解析第一个chunk（fmt为0或1时才有message type id）
+//
+// @return payload: 第一个chunk中的消息数据
+func parseFirstChunk(b []byte) (typeid uint8, payload []byte, ok bool) {
+	if len(b) == 0 {
+		return 0, nil, false
+	}
+	fmtType := b[0] >> 6
+	index := 1
+	switch b[0] & 0x3F {
+	case 0:
+		index = 2
+	case 1:
+		index = 3
+	}
+
+	var headerLen int
+	switch fmtType {
+	case 0:
+		headerLen = 11
+	case 1:
+		headerLen = 7
+	default:
+		return 0, nil, false
+	}
+	if len(b) < index+headerLen {
+		return 0, nil, false
+	}
+	typeid = b[index+6]
+	if bele.BeUint24(b[index:]) == maxTimestampInMessageHeader {
+		headerLen += 4
+	}
+	if len(b) < index+headerLen {
+		return 0, nil, false
+	}
+	return typeid, b[index+headerLen:], true
+}
@@ -9,19 +9,24 @@
 package rtmp
 
 import (
+	"bytes"
 	"encoding/hex"
-	"github.com/q191201771/naza/pkg/assert"
-	"github.com/q191201771/naza/pkg/nazabytes"
+	"errors"
 	"net"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazabytes"
+	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 type testServerSessionObserver struct {
 }
 
-func (o *testServerSessionObserver) OnRtmpConnect(session *ServerSession, opa ObjectPairArray) {
-
+func (o *testServerSessionObserver) OnRtmpConnect(session *ServerSession, opa ObjectPairArray) error {
+	return nil
 }
 
 func (o *testServerSessionObserver) OnNewRtmpPubSession(session *ServerSession) error {
@@ -91,4 +96,286 @@ func TestServerSession_doMsg(t *testing.T) {
 
 	err := s.doMsg(&stream)
 	assert.Equal(t, nil, err)
+	assert.Equal(t, PubTypeLive, s.PubType())
+
+	// publish类型为record
+	s = NewServerSession(&o, &c)
+	err = s.doMsg(newTestCommandStream("publish", "test110", "record"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, PubTypeRecord, s.PubType())
+}
+
+func TestServerSession_doMsgAmf3(t *testing.T) {
+	var o testServerSessionObserver
+	var c mConn
+	s := NewServerSession(&o, &c)
+
+	var stream Stream
+	stream.msg.buff = nazabytes.NewBuffer(1024)
+
+	// type 17的connect信令，command object为amf3编码
+	stream.header.MsgTypeId = 17
+	stream.msg.buff.Write([]byte{0})
+	_ = Amf0.WriteString(stream.msg.buff, "connect")
+	_ = Amf0.WriteNumber(stream.msg.buff, 1)
+	stream.msg.buff.Write([]byte{Amf0TypeMarkerAvmplusObject})
+	_ = Amf3.WriteValue(stream.msg.buff, ObjectPairArray{
+		{Key: "app", Value: "live"},
+		{Key: "tcUrl", Value: "rtmp://127.0.0.1/live"},
+		{Key: "objectEncoding", Value: 3},
+	})
+
+	err := s.doMsg(&stream)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "live", s.appName)
+	assert.Equal(t, 3, s.ObjectEncoding())
+}
+
+// bufConn 记录写入的数据，play之后是异步写
+type bufConn struct {
+	mConn
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (c *bufConn) Write(b []byte) (n int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.buf.Write(b)
+}
+
+func (c *bufConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *bufConn) waitContains(s string) bool {
+	for i := 0; i < 100; i++ {
+		c.mutex.Lock()
+		ok := bytes.Contains(c.buf.Bytes(), []byte(s))
+		c.mutex.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func (c *bufConn) reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.buf.Reset()
+}
+
+func newTestCommandStream(name string, args ...interface{}) *Stream {
+	var stream Stream
+	stream.msg.buff = nazabytes.NewBuffer(1024)
+	stream.header.MsgTypeId = 20
+	_ = Amf0.WriteString(stream.msg.buff, name)
+	_ = Amf0.WriteNumber(stream.msg.buff, 0)
+	_ = Amf0.WriteNull(stream.msg.buff)
+	for _, arg := range args {
+		_ = Amf0.WriteValue(stream.msg.buff, arg)
+	}
+	return &stream
+}
+
+func TestServerSession_playControl(t *testing.T) {
+	var o testServerSessionObserver
+	var c bufConn
+	s := NewServerSession(&o, &c)
+
+	doCommand := func(name string, args ...interface{}) {
+		c.reset()
+		err := s.doMsg(newTestCommandStream(name, args...))
+		assert.Equal(t, nil, err)
+	}
+	allow := func(typeid uint8, payload ...byte) bool {
+		h := base.RtmpHeader{Csid: 6, MsgLen: uint32(len(payload)), MsgTypeId: typeid, MsgStreamId: Msid1}
+		return s.playFilter.allow(Message2Chunks(payload, &h))
+	}
+
+	// play的可选参数
+	doCommand("play", "test110", 1000, 2000, true)
+	assert.Equal(t, PlayArgs{Start: 1000, Duration: 2000, Reset: true}, s.PlayArgs())
+	assert.Equal(t, true, c.waitContains("NetStream.Play.Reset"))
+	assert.Equal(t, true, s.PlayArgs().AllowVod())
+
+	// 直播不能seek
+	doCommand("seek", 1000)
+	assert.Equal(t, true, c.waitContains("NetStream.Seek.Failed"))
+
+	// 暂停期间丢弃音视频，恢复后从视频关键帧开始
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x17, 0x01))
+	doCommand("pause", true, 1000)
+	assert.Equal(t, true, c.waitContains("NetStream.Pause.Notify"))
+	assert.Equal(t, false, allow(base.RtmpTypeIdAudio, 0xAF, 0x01))
+	assert.Equal(t, false, allow(base.RtmpTypeIdVideo, 0x17, 0x01))
+	doCommand("pause", false, 1000)
+	assert.Equal(t, true, c.waitContains("NetStream.Unpause.Notify"))
+	assert.Equal(t, true, allow(base.RtmpTypeIdAudio, 0xAF, 0x01))
+	assert.Equal(t, false, allow(base.RtmpTypeIdVideo, 0x27, 0x01))
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x17, 0x01))
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x27, 0x01))
+
+	// 只接收视频，之后恢复接收音频。期间的音频seq header不丢弃，恢复后可以解码
+	doCommand("receiveAudio", false)
+	assert.Equal(t, false, allow(base.RtmpTypeIdAudio, 0xAF, 0x01))
+	assert.Equal(t, true, allow(base.RtmpTypeIdAudio, 0xAF, 0x00, 0x12, 0x10))
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x27, 0x01))
+	doCommand("receiveAudio", true)
+	assert.Equal(t, true, allow(base.RtmpTypeIdAudio, 0xAF, 0x01))
+
+	// 只接收音频，重新接收视频时从关键帧开始，enhanced-rtmp的关键帧
+	doCommand("receiveVideo", false)
+	assert.Equal(t, false, allow(base.RtmpTypeIdVideo, 0x17, 0x01))
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x17, 0x00, 0, 0, 0))
+	doCommand("receiveVideo", true)
+	assert.Equal(t, false, allow(base.RtmpTypeIdVideo, 0xA1, 'h', 'v', 'c', '1'))
+	assert.Equal(t, true, allow(base.RtmpTypeIdVideo, 0x91, 'h', 'v', 'c', '1'))
+}
+
+type testVodObserver struct {
+	seekMs int64
+	paused bool
+}
+
+func (o *testVodObserver) OnVodSeek(ms int64) (int64, error) {
+	o.seekMs = ms
+	return ms / 1000 * 1000, nil
+}
+
+func (o *testVodObserver) OnVodPause(pause bool) {
+	o.paused = pause
+}
+
+func (o *testVodObserver) OnVodStop() {
+}
+
+func TestServerSession_vod(t *testing.T) {
+	var o testServerSessionObserver
+	var c bufConn
+	s := NewServerSession(&o, &c)
+	var vo testVodObserver
+	s.SetVodObserver(&vo)
+	assert.Equal(t, true, s.IsVod())
+
+	err := s.doMsg(newTestCommandStream("seek", 1500))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(1500), vo.seekMs)
+	assert.Equal(t, true, c.waitContains("NetStream.Seek.Notify"))
+	assert.Equal(t, true, c.waitContains("Seeking 1000."))
+	assert.Equal(t, true, c.waitContains("NetStream.Play.Start"))
+
+	err = s.doMsg(newTestCommandStream("pause", true, 1000))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, vo.paused)
+}
+
+func TestParseFirstChunk(t *testing.T) {
+	payload := []byte{0x17, 0x01, 0x00}
+
+	// csid为2字节，扩展时间戳
+	h := base.RtmpHeader{Csid: 100, MsgLen: uint32(len(payload)), MsgTypeId: base.RtmpTypeIdVideo, MsgStreamId: Msid1, TimestampAbs: 0x1000000}
+	typeid, p, ok := parseFirstChunk(Message2Chunks(payload, &h))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, base.RtmpTypeIdVideo, typeid)
+	assert.Equal(t, payload, p)
+
+	h = base.RtmpHeader{Csid: 6, MsgLen: uint32(len(payload)), MsgTypeId: base.RtmpTypeIdAudio, MsgStreamId: Msid1}
+	typeid, p, ok = parseFirstChunk(Message2Chunks(payload, &h))
+	assert.Equal(t, true, ok)
+	assert.Equal(t, base.RtmpTypeIdAudio, typeid)
+	assert.Equal(t, payload, p)
+
+	_, _, ok = parseFirstChunk(nil)
+	assert.Equal(t, false, ok)
+	_, _, ok = parseFirstChunk([]byte{0xC6})
+	assert.Equal(t, false, ok)
+}
+
+func TestSendItemTypeOfChunks(t *testing.T) {
+	check := func(typ base.SendItemType, typeid uint8, payload ...byte) {
+		h := base.RtmpHeader{Csid: 6, MsgLen: uint32(len(payload)), MsgTypeId: typeid, MsgStreamId: Msid1}
+		assert.Equal(t, typ, sendItemTypeOfChunks(Message2Chunks(payload, &h)))
+	}
+	check(base.SendItemTypeVideoKey, base.RtmpTypeIdVideo, 0x17, 0x01, 0, 0, 0)
+	check(base.SendItemTypeVideoNonKey, base.RtmpTypeIdVideo, 0x27, 0x01, 0, 0, 0)
+	check(base.SendItemTypeOther, base.RtmpTypeIdVideo, 0x17, 0x00, 0, 0, 0)
+	check(base.SendItemTypeAudio, base.RtmpTypeIdAudio, 0xAF, 0x01, 0, 0, 0)
+	check(base.SendItemTypeOther, base.RtmpTypeIdAudio, 0xAF, 0x00, 0x12, 0x10, 0)
+	check(base.SendItemTypeOther, base.RtmpTypeIdMetadata, 0x02, 0, 0, 0, 0)
+	assert.Equal(t, base.SendItemTypeOther, sendItemTypeOfChunks(nil))
+}
+
+// 使用发送队列时，信令也放入队列，不会超过还没发送的音视频数据
+func TestServerSession_ctrlWriter(t *testing.T) {
+	var o testServerSessionObserver
+	var c bufConn
+	s := NewServerSession(&o, &c)
+	s.sendQueue = base.NewSendQueue(s.UniqueKey(), base.SendQueueConfig{QueueSize: 8}, func(b []byte) error {
+		_, err := c.Write(b)
+		return err
+	})
+	defer s.sendQueue.Dispose()
+
+	h := base.RtmpHeader{Csid: 6, MsgLen: 5, MsgTypeId: base.RtmpTypeIdVideo, MsgStreamId: Msid1}
+	frame := Message2Chunks([]byte{0x17, 0x01, 0, 0, 0}, &h)
+	assert.Equal(t, nil, s.Writev(net.Buffers{frame}))
+	assert.Equal(t, nil, s.WritePlayComplete())
+	assert.Equal(t, true, c.waitContains("NetStream.Play.Stop"))
+	c.mutex.Lock()
+	assert.Equal(t, true, bytes.HasPrefix(c.buf.Bytes(), frame))
+	c.mutex.Unlock()
+}
+
+type closeConn struct {
+	bufConn
+}
+
+func (c *closeConn) Close() error {
+	return nil
+}
+
+// 开启merge write时，慢的拉流端同样会丢帧，最终被关闭
+func TestServerSession_mergeWriteSlowConsumer(t *testing.T) {
+	var o testServerSessionObserver
+	var c closeConn
+	s := NewServerSession(&o, &c)
+	block := make(chan struct{})
+	defer close(block)
+	s.sendQueue = base.NewSendQueue(s.UniqueKey(), base.SendQueueConfig{
+		Enable:            true,
+		QueueSize:         8,
+		DropNonKeyPercent: 50,
+		MaxSkipGopCount:   1,
+	}, func(b []byte) error {
+		<-block
+		return nil
+	})
+
+	var err error
+	mw := base.NewMergeWriterRef(func(rbs []*base.RefBuffer, typ base.SendItemType) {
+		if e := s.WriteRefBuffers(rbs, typ); e != nil {
+			err = e
+		}
+	}, 64)
+	write := func(typeid uint8, payload ...byte) {
+		h := base.RtmpHeader{Csid: 6, MsgLen: uint32(len(payload)), MsgTypeId: typeid, MsgStreamId: Msid1}
+		msg := base.RtmpMsg{Header: h, Payload: payload}
+		rb := base.WrapRefBuffer(Message2Chunks(payload, &h))
+		mw.WriteRef(rb, base.SendItemTypeOfRtmpMsg(msg))
+		rb.Release()
+	}
+
+	for i := 0; i < 10 && err == nil; i++ {
+		write(base.RtmpTypeIdVideo, 0x17, 0x01, 0, 0, 0)
+		for j := 0; j < 10; j++ {
+			write(base.RtmpTypeIdVideo, 0x27, 0x01, 0, 0, 0)
+			write(base.RtmpTypeIdAudio, 0xAF, 0x01, 0)
+		}
+		mw.Flush()
+	}
+	assert.Equal(t, true, s.sendQueue.DroppedFrameCount() > 0)
+	assert.Equal(t, true, errors.Is(err, base.ErrSendQueueSlowConsumer))
 }
@@ -51,6 +51,23 @@ func (stream *Stream) toAvMsg() base.RtmpMsg {
 	}
 }
 
+// toAmf0DataMsg 将amf3的data message(type 15)转换为amf0的data message(type 18)
+//
+// 注意，不修改stream自身的header，因为后续的chunk可能会复用header中的type id
+func (stream *Stream) toAmf0DataMsg() (base.RtmpMsg, error) {
+	payload, err := DataMessageAmf3ToAmf0(stream.msg.buff.Bytes())
+	if err != nil {
+		return base.RtmpMsg{}, err
+	}
+	h := stream.header
+	h.MsgTypeId = base.RtmpTypeIdMetadata
+	h.MsgLen = uint32(len(payload))
+	return base.RtmpMsg{
+		Header:  h,
+		Payload: payload,
+	}, nil
+}
+
 // ----- StreamMsg -----------------------------------------------------------------------------------------------------
 
 type StreamMsg struct {
@@ -83,6 +100,13 @@ func (msg *StreamMsg) ResetAndFree() {
 	msg.buff.ResetAndFree()
 }
 
+// skipAmf3FormatByte amf3的command message(type 17)第一个字节为格式选择字节，固定为0
+func (msg *StreamMsg) skipAmf3FormatByte() {
+	if msg.buff.Len() > 0 && msg.buff.Bytes()[0] == 0 {
+		msg.Skip(1)
+	}
+}
+
 func (msg *StreamMsg) peekStringWithType() (string, error) {
 	str, _, err := Amf0.ReadString(msg.buff.Bytes())
 	return str, err
@@ -104,6 +128,14 @@ func (msg *StreamMsg) readNumberWithType() (int, error) {
 	return int(val), err
 }
 
+func (msg *StreamMsg) readBooleanWithType() (bool, error) {
+	val, l, err := Amf0.ReadBoolean(msg.buff.Bytes())
+	if err == nil {
+		msg.Skip(uint32(l))
+	}
+	return val, err
+}
+
 func (msg *StreamMsg) readObjectWithType() (ObjectPairArray, error) {
 	opa, l, err := Amf0.ReadObject(msg.buff.Bytes())
 	if err == nil {
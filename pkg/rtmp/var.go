@@ -8,7 +8,10 @@
 
 package rtmp
 
-import "github.com/q191201771/naza/pkg/nazalog"
+import (
+	"github.com/q191201771/naza/pkg/nazalog"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
 
 // TODO chef 一些更专业的配置项，暂时只在该源码文件中配置，不提供外部配置接口
 
@@ -43,6 +46,9 @@ var (
 	windowAcknowledgementSize = 5000000
 
 	peerBandwidth = 5000000
+
+	// ServerSessionSendQueueConfig server sub session的发送队列配置，见 base.SendQueue
+	ServerSessionSendQueueConfig = base.DefaultSendQueueConfig
 )
 
 // 接收rtmp数据时，msg的初始内存块大小
@@ -10,6 +10,8 @@ package rtprtcp
 
 import (
 	"github.com/q191201771/naza/pkg/bele"
+
+	"github.com/ysjhlnu/lal/pkg/base"
 )
 
 // -------------------------------------------
@@ -83,9 +85,15 @@ import (
 //        +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
 
 const (
-	RtcpPacketTypeSr  = 200 // 0xc8 Sender Report
-	RtcpPacketTypeRr  = 201 // 0xc9 Receiver Report
-	RtcpPacketTypeApp = 204
+	RtcpPacketTypeSr    = 200 // 0xc8 Sender Report
+	RtcpPacketTypeRr    = 201 // 0xc9 Receiver Report
+	RtcpPacketTypeApp   = 204
+	RtcpPacketTypeRtpfb = 205 // rfc4585 Transport layer FB message
+	RtcpPacketTypePsfb  = 206 // rfc4585 Payload-specific FB message
+
+	RtcpFormatNack = 1 // rfc4585 Generic NACK，PT为RTPFB
+	RtcpFormatPli  = 1 // rfc4585 Picture Loss Indication，PT为PSFB
+	RtcpFormatFir  = 4 // rfc5104 Full Intra Request，PT为PSFB
 
 	RtcpHeaderLength = 4
 
@@ -133,6 +141,47 @@ func ParseSr(b []byte) Sr {
 	return s
 }
 
+// ParseNack rfc4585 6.2.1，解析Generic NACK
+//
+// @param b rtcp包，包含包头
+//
+// @return seqs: 对端请求重传的包序号
+func ParseNack(b []byte) (senderSsrc uint32, mediaSsrc uint32, seqs []uint16, err error) {
+	if len(b) < 12 {
+		return 0, 0, nil, base.ErrRtpRtcpShortBuffer
+	}
+	senderSsrc = bele.BeUint32(b[4:])
+	mediaSsrc = bele.BeUint32(b[8:])
+	for i := 12; i+4 <= len(b); i += 4 {
+		pid := bele.BeUint16(b[i:])
+		blp := bele.BeUint16(b[i+2:])
+		seqs = append(seqs, pid)
+		for j := uint16(0); j < 16; j++ {
+			if blp&(1<<j) != 0 {
+				seqs = append(seqs, pid+j+1)
+			}
+		}
+	}
+	return
+}
+
+// SplitRtcpCompoundPacket 将复合包拆分为单个的rtcp包，比如常见的RR+SDES，见rfc3550 6.1
+//
+// 遇到长度不合法的包时，丢弃该包以及之后的数据
+func SplitRtcpCompoundPacket(b []byte) [][]byte {
+	var out [][]byte
+	for len(b) >= RtcpHeaderLength {
+		h := ParseRtcpHeader(b)
+		l := (int(h.Length) + 1) * 4
+		if l > len(b) {
+			break
+		}
+		out = append(out, b[:l])
+		b = b[l:]
+	}
+	return out
+}
+
 // PackTo @param out 传出参数，注意，调用方保证长度>=4
 func (r *RtcpHeader) PackTo(out []byte) {
 	out[0] = r.Version<<6 | r.Padding<<5 | r.CountOrFormat
@@ -140,6 +189,11 @@ func (r *RtcpHeader) PackTo(out []byte) {
 	bele.BePutUint16(out[2:], r.Length)
 }
 
+// IsRtcpPacket rtcp和rtp复用同一个端口（rtcp-mux）时，用于区分rtcp包，见rfc5761 4
+func IsRtcpPacket(b []byte) bool {
+	return len(b) >= RtcpHeaderLength && b[1] >= 192 && b[1] <= 223
+}
+
 func (s *Sr) GetMiddleNtp() uint32 {
 	return uint32(((uint64(s.Msw)<<32 | uint64(s.Lsw)) << 16) >> 32)
 }
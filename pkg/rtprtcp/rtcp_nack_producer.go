@@ -0,0 +1,119 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+import (
+	"sort"
+	"time"
+)
+
+// 通过收到的rtp包，检测丢失的包序号，产生需要发送nack的包序号列表
+
+type NackProducerOption struct {
+	MaxRetries      int // 每个丢失的包最多请求重传的次数，超过后放弃
+	RetryIntervalMs int // 同一个包两次请求重传的间隔，第一次请求也会等待该时长，用于容忍乱序
+	MaxMissing      int // 最多同时记录的丢失包数量，超过后清空，避免对端重启等原因导致seq跳变时发送大量nack
+}
+
+var defaultNackProducerOption = NackProducerOption{
+	MaxRetries:      3,
+	RetryIntervalMs: 40,
+	MaxMissing:      512,
+}
+
+type ModNackProducerOption func(option *NackProducerOption)
+
+type NackProducer struct {
+	option NackProducerOption
+
+	maxSeq    uint16
+	hasMaxSeq bool
+	missing   map[uint16]*nackItem
+	lostNum   uint64
+}
+
+type nackItem struct {
+	retries  int
+	nextTime time.Time
+}
+
+func NewNackProducer(modOptions ...ModNackProducerOption) *NackProducer {
+	option := defaultNackProducerOption
+	for _, fn := range modOptions {
+		fn(&option)
+	}
+	return &NackProducer{
+		option:  option,
+		missing: make(map[uint16]*nackItem),
+	}
+}
+
+// FeedRtpPacket 每次收到rtp包，都将seq序号传入这个函数
+func (n *NackProducer) FeedRtpPacket(seq uint16) {
+	if !n.hasMaxSeq {
+		n.maxSeq = seq
+		n.hasMaxSeq = true
+		return
+	}
+
+	diff := SubSeq(seq, n.maxSeq)
+	if diff <= 0 {
+		// 乱序或者重传的包到达
+		delete(n.missing, seq)
+		return
+	}
+
+	if diff-1+len(n.missing) > n.option.MaxMissing {
+		Log.Warnf("too many missing packets, reset nack. maxSeq=%d, seq=%d, missing=%d", n.maxSeq, seq, len(n.missing))
+		n.lostNum += uint64(len(n.missing))
+		n.missing = make(map[uint16]*nackItem)
+	} else {
+		nextTime := time.Now().Add(time.Duration(n.option.RetryIntervalMs) * time.Millisecond)
+		for s := n.maxSeq + 1; s != seq; s++ {
+			n.missing[s] = &nackItem{nextTime: nextTime}
+		}
+	}
+	n.maxSeq = seq
+}
+
+// Produce 定时调用，获取当前需要请求重传的包序号
+//
+// @return: 按从小到大排序的包序号，可直接传入 PackNack
+func (n *NackProducer) Produce(now time.Time) []uint16 {
+	var seqs []uint16
+	for seq, item := range n.missing {
+		if now.Before(item.nextTime) {
+			continue
+		}
+		if item.retries >= n.option.MaxRetries {
+			delete(n.missing, seq)
+			n.lostNum++
+			continue
+		}
+		item.retries++
+		item.nextTime = now.Add(time.Duration(n.option.RetryIntervalMs) * time.Millisecond)
+		seqs = append(seqs, seq)
+	}
+
+	// 注意，需要考虑seq回绕
+	sort.Slice(seqs, func(i, j int) bool {
+		return CompareSeq(seqs[i], seqs[j]) < 0
+	})
+	return seqs
+}
+
+// MissingNum 当前记录的丢失包数量
+func (n *NackProducer) MissingNum() int {
+	return len(n.missing)
+}
+
+// LostNum 累计放弃重传的包数量
+func (n *NackProducer) LostNum() uint64 {
+	return n.lostNum
+}
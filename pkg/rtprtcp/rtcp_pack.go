@@ -19,7 +19,7 @@ type Rr struct {
 	extendedSeq uint32
 	jitter      uint32
 	lsr         uint32
-	dlsr        uint32 // default 0
+	dlsr        uint32
 }
 
 func (r *Rr) Pack() []byte {
@@ -38,13 +38,72 @@ func (r *Rr) Pack() []byte {
 	bele.BePutUint32(b[4:], r.senderSsrc)
 	bele.BePutUint32(b[8:], r.mediaSsrc)
 	b[12] = r.fraction
-	// TODO chef: lost的表示是否正确
-	bele.BePutUint24(b[13:], r.lost>>8)
-	bele.BePutUint16(b[16:], r.cycles)
-	bele.BePutUint32(b[18:], r.extendedSeq)
+	bele.BePutUint24(b[13:], r.lost)
+	// 注意，extendedSeq中已经包含了cycles
+	bele.BePutUint32(b[16:], r.extendedSeq)
 	bele.BePutUint32(b[20:], r.jitter)
 	bele.BePutUint32(b[24:], r.lsr)
-	bele.BePutUint32(b[28:], 0)
+	bele.BePutUint32(b[28:], r.dlsr)
 
 	return b
 }
+
+// PackNack rfc4585 6.2.1 Generic NACK
+//
+// @param seqs: 需要重传的包序号，注意，调用方保证按从小到大排序
+func PackNack(senderSsrc uint32, mediaSsrc uint32, seqs []uint16) []byte {
+	var fci []byte
+	for i := 0; i < len(seqs); {
+		// PID，以及之后16个包的BLP位图
+		pid := seqs[i]
+		var blp uint16
+		j := i + 1
+		for ; j < len(seqs); j++ {
+			d := SubSeq(seqs[j], pid)
+			if d < 1 || d > 16 {
+				break
+			}
+			blp |= 1 << uint(d-1)
+		}
+		fci = append(fci, uint8(pid>>8), uint8(pid), uint8(blp>>8), uint8(blp))
+		i = j
+	}
+
+	b := make([]byte, 12+len(fci))
+	var h RtcpHeader
+	h.Version = RtcpVersion
+	h.CountOrFormat = RtcpFormatNack
+	h.PacketType = RtcpPacketTypeRtpfb
+	h.Length = uint16(len(b)/4 - 1)
+	h.PackTo(b)
+	bele.BePutUint32(b[4:], senderSsrc)
+	bele.BePutUint32(b[8:], mediaSsrc)
+	copy(b[12:], fci)
+	return b
+}
+
+// PackPli rfc4585 6.3.1 Picture Loss Indication，请求对端发送关键帧
+func PackPli(senderSsrc uint32, mediaSsrc uint32) []byte {
+	b := make([]byte, 12)
+	var h RtcpHeader
+	h.Version = RtcpVersion
+	h.CountOrFormat = RtcpFormatPli
+	h.PacketType = RtcpPacketTypePsfb
+	h.Length = uint16(len(b)/4 - 1)
+	h.PackTo(b)
+	bele.BePutUint32(b[4:], senderSsrc)
+	bele.BePutUint32(b[8:], mediaSsrc)
+	return b
+}
+
+// PackEmptyRr 不包含report block的RR，用于udp模式下的保活
+func PackEmptyRr(senderSsrc uint32) []byte {
+	b := make([]byte, 8)
+	var h RtcpHeader
+	h.Version = RtcpVersion
+	h.PacketType = RtcpPacketTypeRr
+	h.Length = uint16(len(b)/4 - 1)
+	h.PackTo(b)
+	bele.BePutUint32(b[4:], senderSsrc)
+	return b
+}
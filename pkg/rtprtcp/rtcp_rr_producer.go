@@ -29,15 +29,32 @@ type RrProducer struct {
 
 	expectedPrior uint32
 	receivedPrior uint32
+
+	hasSr   bool
+	lsr     uint32    // 最近一次收到的sr包的ntp时间的中间32位
+	lsrTime time.Time // 最近一次收到sr包的本地时间，用于计算dlsr
 }
 
 func NewRrProducer(clockRate int) *RrProducer {
-	return &RrProducer{
+	r := &RrProducer{
 		clockRate: clockRate,
-		baseSeq:   -1,
-		maxSeq:    -1,
-		transit:   -1,
 	}
+	r.reset()
+	return r
+}
+
+// SetSsrc
+//
+// 对端rtp流的ssrc变化时（比如对端重新推流），之前的统计都不再有效，重新开始统计
+//
+// @param senderSsrc: 本端的ssrc
+// @param mediaSsrc:  对端rtp流的ssrc
+func (r *RrProducer) SetSsrc(senderSsrc uint32, mediaSsrc uint32) {
+	if r.mediaSsrc != mediaSsrc {
+		r.reset()
+	}
+	r.senderSsrc = senderSsrc
+	r.mediaSsrc = mediaSsrc
 }
 
 // FeedRtpPacket 每次收到rtp包，都将seq序号传入这个函数
@@ -67,6 +84,24 @@ func (r *RrProducer) FeedRtpPacket(seq uint16) {
 // @param lsr: 从sr包中获取，见func SR.GetMiddleNtp
 // @return:    rr包的二进制数据
 func (r *RrProducer) Produce(lsr uint32) []byte {
+	now := time.Now()
+	r.FeedSr(lsr, now)
+	return r.ProduceRr(now)
+}
+
+// FeedSr 收到sr包时调用，记录lsr以及收到的时间，之后产生的rr包根据它计算dlsr
+//
+// @param lsr: 从sr包中获取，见func SR.GetMiddleNtp
+func (r *RrProducer) FeedSr(lsr uint32, now time.Time) {
+	r.hasSr = true
+	r.lsr = lsr
+	r.lsrTime = now
+}
+
+// ProduceRr 定时产生rr包，没有收到过sr包时，lsr和dlsr为0
+//
+// @return: rr包的二进制数据，还没有收到rtp包时返回nil
+func (r *RrProducer) ProduceRr(now time.Time) []byte {
 	if r.baseSeq == -1 {
 		return nil
 	}
@@ -99,11 +134,32 @@ func (r *RrProducer) Produce(lsr uint32) []byte {
 	rr.cycles = uint16(r.cycles)
 	rr.extendedSeq = r.extendedSeq
 	rr.jitter = r.getJitter()
-	rr.lsr = lsr
+	if r.hasSr {
+		rr.lsr = r.lsr
+		// rfc3550 6.4.1，单位为1/65536秒
+		if d := now.Sub(r.lsrTime); d > 0 {
+			rr.dlsr = uint32(d * 65536 / time.Second)
+		}
+	}
 
 	return rr.Pack()
 }
 
+func (r *RrProducer) reset() {
+	r.baseSeq = -1
+	r.maxSeq = -1
+	r.cycles = 0
+	r.received = 0
+	r.extendedSeq = 0
+	r.transit = -1
+	r.jitter = 0
+	r.expectedPrior = 0
+	r.receivedPrior = 0
+	r.hasSr = false
+	r.lsr = 0
+	r.lsrTime = time.Time{}
+}
+
 // @param timestamp 当前收到的rtp包头中的时间戳
 func (r *RrProducer) updateJitter(timestamp uint32) {
 	// rfc3550 6.4.1 SR: Sender Report RTCP Packet
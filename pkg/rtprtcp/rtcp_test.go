@@ -0,0 +1,189 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+func TestRrProducer(t *testing.T) {
+	p := rtprtcp.NewRrProducer(90000)
+	p.SetSsrc(1, 2)
+	assert.Equal(t, []byte(nil), p.Produce(0))
+
+	for _, seq := range []uint16{65530, 65531, 65533, 65535, 0, 1} {
+		p.FeedRtpPacket(seq)
+	}
+	b := p.Produce(0x11223344)
+	assert.Equal(t, 32, len(b))
+	h := rtprtcp.ParseRtcpHeader(b)
+	assert.Equal(t, uint8(rtprtcp.RtcpPacketTypeRr), h.PacketType)
+	assert.Equal(t, uint16(7), h.Length)
+	assert.Equal(t, uint32(1), bele.BeUint32(b[4:]))
+	assert.Equal(t, uint32(2), bele.BeUint32(b[8:]))
+	assert.Equal(t, uint8(2*256/8), b[12])                     // fraction lost
+	assert.Equal(t, uint32(2), bele.BeUint24(b[13:]))          // cumulative lost
+	assert.Equal(t, uint32(1<<16|1), bele.BeUint32(b[16:]))    // extended highest seq
+	assert.Equal(t, uint32(0x11223344), bele.BeUint32(b[24:])) // lsr
+}
+
+func TestRrProducer_Dlsr(t *testing.T) {
+	p := rtprtcp.NewRrProducer(90000)
+	p.SetSsrc(1, 2)
+	p.FeedRtpPacket(100)
+
+	// 没有收到sr时，lsr和dlsr为0
+	now := time.Now()
+	b := p.ProduceRr(now)
+	assert.Equal(t, uint32(0), bele.BeUint32(b[24:]))
+	assert.Equal(t, uint32(0), bele.BeUint32(b[28:]))
+
+	// 收到sr之后1.5秒
+	p.FeedSr(0x11223344, now)
+	b = p.ProduceRr(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, uint32(0x11223344), bele.BeUint32(b[24:]))
+	assert.Equal(t, uint32(65536*3/2), bele.BeUint32(b[28:]))
+
+	// ssrc变化后重新统计
+	p.SetSsrc(1, 3)
+	assert.Equal(t, []byte(nil), p.ProduceRr(now))
+	p.FeedRtpPacket(5000)
+	b = p.ProduceRr(now)
+	assert.Equal(t, uint32(3), bele.BeUint32(b[8:]))
+	assert.Equal(t, uint32(0), bele.BeUint24(b[13:]))
+	assert.Equal(t, uint32(5000), bele.BeUint32(b[16:]))
+	assert.Equal(t, uint32(0), bele.BeUint32(b[24:]))
+	assert.Equal(t, uint32(0), bele.BeUint32(b[28:]))
+}
+
+func TestPackNack(t *testing.T) {
+	b := rtprtcp.PackNack(1, 2, []uint16{100, 101, 116, 117, 65535, 3})
+	h := rtprtcp.ParseRtcpHeader(b)
+	assert.Equal(t, uint8(rtprtcp.RtcpPacketTypeRtpfb), h.PacketType)
+	assert.Equal(t, uint8(rtprtcp.RtcpFormatNack), h.CountOrFormat)
+	assert.Equal(t, 12+4*3, len(b))
+	assert.Equal(t, uint16(len(b)/4-1), h.Length)
+	assert.Equal(t, uint32(1), bele.BeUint32(b[4:]))
+	assert.Equal(t, uint32(2), bele.BeUint32(b[8:]))
+	// pid=100，blp中包含101和116
+	assert.Equal(t, uint16(100), bele.BeUint16(b[12:]))
+	assert.Equal(t, uint16(1<<0|1<<15), bele.BeUint16(b[14:]))
+	// 117超出了上一个pid的范围
+	assert.Equal(t, uint16(117), bele.BeUint16(b[16:]))
+	assert.Equal(t, uint16(0), bele.BeUint16(b[18:]))
+	// 65535之后回绕到3
+	assert.Equal(t, uint16(65535), bele.BeUint16(b[20:]))
+	assert.Equal(t, uint16(1<<3), bele.BeUint16(b[22:]))
+}
+
+func TestNackProducer(t *testing.T) {
+	p := rtprtcp.NewNackProducer(func(option *rtprtcp.NackProducerOption) {
+		option.MaxRetries = 2
+		option.RetryIntervalMs = 10
+	})
+	for _, seq := range []uint16{65533, 65534, 1, 2, 65535, 5} {
+		p.FeedRtpPacket(seq)
+	}
+	assert.Equal(t, 3, p.MissingNum())
+
+	now := time.Now()
+	// 等待一个间隔，容忍乱序
+	assert.Equal(t, 0, len(p.Produce(now)))
+	now = now.Add(20 * time.Millisecond)
+	assert.Equal(t, []uint16{0, 3, 4}, p.Produce(now))
+
+	p.FeedRtpPacket(3)
+	assert.Equal(t, 0, len(p.Produce(now)))
+	now = now.Add(20 * time.Millisecond)
+	assert.Equal(t, []uint16{0, 4}, p.Produce(now))
+	now = now.Add(20 * time.Millisecond)
+	assert.Equal(t, 0, len(p.Produce(now)))
+	assert.Equal(t, 0, p.MissingNum())
+	assert.Equal(t, uint64(2), p.LostNum())
+}
+
+func TestParseNack(t *testing.T) {
+	in := []uint16{100, 101, 116, 117, 65535, 3}
+	b := rtprtcp.PackNack(1, 2, in)
+	senderSsrc, mediaSsrc, seqs, err := rtprtcp.ParseNack(b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(1), senderSsrc)
+	assert.Equal(t, uint32(2), mediaSsrc)
+	assert.Equal(t, in, seqs)
+
+	_, _, _, err = rtprtcp.ParseNack(b[:8])
+	assert.IsNotNil(t, err)
+}
+
+func TestPackPli(t *testing.T) {
+	b := rtprtcp.PackPli(1, 2)
+	assert.Equal(t, 12, len(b))
+	h := rtprtcp.ParseRtcpHeader(b)
+	assert.Equal(t, uint8(rtprtcp.RtcpPacketTypePsfb), h.PacketType)
+	assert.Equal(t, uint8(rtprtcp.RtcpFormatPli), h.CountOrFormat)
+	assert.Equal(t, uint16(2), h.Length)
+	assert.Equal(t, uint32(2), bele.BeUint32(b[8:]))
+}
+
+func TestPackEmptyRr(t *testing.T) {
+	b := rtprtcp.PackEmptyRr(1)
+	assert.Equal(t, 8, len(b))
+	h := rtprtcp.ParseRtcpHeader(b)
+	assert.Equal(t, uint8(rtprtcp.RtcpPacketTypeRr), h.PacketType)
+	assert.Equal(t, uint8(0), h.CountOrFormat)
+	assert.Equal(t, uint16(1), h.Length)
+	assert.Equal(t, uint32(1), bele.BeUint32(b[4:]))
+}
+
+func TestSplitRtcpCompoundPacket(t *testing.T) {
+	nack := rtprtcp.PackNack(1, 2, []uint16{100})
+	pli := rtprtcp.PackPli(1, 2)
+	b := append(append([]byte{}, nack...), pli...)
+
+	pkts := rtprtcp.SplitRtcpCompoundPacket(b)
+	assert.Equal(t, 2, len(pkts))
+	assert.Equal(t, nack, pkts[0])
+	assert.Equal(t, pli, pkts[1])
+
+	// 最后一个包不完整
+	pkts = rtprtcp.SplitRtcpCompoundPacket(b[:len(b)-1])
+	assert.Equal(t, 1, len(pkts))
+}
+
+func TestRtpPacketCache(t *testing.T) {
+	c := rtprtcp.NewRtpPacketCache(4)
+	for _, seq := range []uint16{65534, 65535, 0, 1, 2} {
+		var pkt rtprtcp.RtpPacket
+		pkt.Header.Seq = seq
+		pkt.Header.Ssrc = 10
+		pkt.Raw = []byte{uint8(seq)}
+		c.Put(pkt)
+	}
+	assert.Equal(t, uint32(10), c.Ssrc())
+	// 65534被2覆盖
+	assert.Equal(t, []byte(nil), c.Get(65534))
+	assert.Equal(t, []byte{0xff}, c.Get(65535))
+	assert.Equal(t, []byte{2}, c.Get(2))
+	assert.Equal(t, []byte(nil), c.Get(3))
+
+	// ssrc变化后，之前的包全部失效
+	var pkt rtprtcp.RtpPacket
+	pkt.Header.Seq = 3
+	pkt.Header.Ssrc = 11
+	pkt.Raw = []byte{3}
+	c.Put(pkt)
+	assert.Equal(t, []byte(nil), c.Get(2))
+	assert.Equal(t, []byte{3}, c.Get(3))
+}
@@ -14,4 +14,8 @@ type IRtpPackerPayload interface {
 	Pack(in []byte, maxSize int) (out [][]byte)
 }
 
-var _ IRtpPackerPayload = &RtpPackerPayloadAvcHevc{}
+var (
+	_ IRtpPackerPayload = &RtpPackerPayloadAvcHevc{}
+	_ IRtpPackerPayload = &RtpPackerPayloadAv1{}
+	_ IRtpPackerPayload = &RtpPackerPayloadVp9{}
+)
@@ -0,0 +1,122 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+import (
+	"github.com/ysjhlnu/lal/pkg/av1"
+)
+
+// RTP Payload Format For AV1
+// https://aomediacodec.github.io/av1-rtp-spec/
+//
+// 4.4 AV1 Aggregation Header
+//
+// +-+-+-+-+-+-+-+-+
+// |Z|Y| W |N|-|-|-|
+// +-+-+-+-+-+-+-+-+
+//
+// Z: 第一个OBU element是上一个包最后一个OBU element的后续部分
+// Y: 最后一个OBU element在下一个包中还有后续部分
+// W: OBU element的个数，为0时每个OBU element前面都有leb128的长度；为1~3时，最后一个OBU element前面没有长度
+// N: 新的coded video sequence的第一个包
+//
+// OBU element为去掉了obu_size字段的OBU。
+
+const (
+	av1AggregationHeaderSize = 1
+
+	av1AggregationHeaderZ uint8 = 0x80
+	av1AggregationHeaderY uint8 = 0x40
+	av1AggregationHeaderN uint8 = 0x08
+)
+
+type RtpPackerPayloadAv1 struct {
+}
+
+func NewRtpPackerPayloadAv1() *RtpPackerPayloadAv1 {
+	return &RtpPackerPayloadAv1{}
+}
+
+// Pack
+//
+// @param in: Low Overhead Bitstream Format格式的TU，也即enhanced-rtmp av01的帧数据。
+//
+//	temporal delimiter、tile list、padding这几种OBU会被丢弃。
+//
+// @return out: 内存块为独立新申请；函数返回后，内部不再持有该内存块
+func (r *RtpPackerPayloadAv1) Pack(in []byte, maxSize int) (out [][]byte) {
+	// 至少能放下aggregation header和1字节长度以及1字节数据
+	if in == nil || maxSize <= av1AggregationHeaderSize+2 {
+		return
+	}
+
+	var elements [][]byte
+	isNewSequence := false
+	err := av1.IterateObu(in, func(obu []byte) {
+		h, payload, _, err := av1.ParseObu(obu)
+		if err != nil {
+			return
+		}
+		switch h.Type {
+		case av1.ObuTypeTemporalDelimiter, av1.ObuTypeTileList, av1.ObuTypePadding:
+			return
+		case av1.ObuTypeSequenceHeader:
+			isNewSequence = true
+		}
+		elements = append(elements, av1.PackObu(h, payload, false))
+	})
+	if err != nil {
+		Log.Warnf("iterate obu failed. err=%+v", err)
+		return
+	}
+
+	// 统一使用W=0，每个OBU element前面都带有长度
+	item := make([]byte, av1AggregationHeaderSize, maxSize)
+	isContinue := false
+	flush := func(hasNext bool) {
+		if isContinue {
+			item[0] |= av1AggregationHeaderZ
+		}
+		if hasNext {
+			item[0] |= av1AggregationHeaderY
+		}
+		if isNewSequence && len(out) == 0 {
+			item[0] |= av1AggregationHeaderN
+		}
+		out = append(out, item)
+		item = make([]byte, av1AggregationHeaderSize, maxSize)
+		isContinue = hasNext
+	}
+
+	for _, e := range elements {
+		for len(e) > 0 {
+			remain := maxSize - len(item)
+			if av1.Leb128Size(uint64(len(e)))+len(e) <= remain {
+				item = av1.AppendLeb128(item, uint64(len(e)))
+				item = append(item, e...)
+				break
+			}
+
+			// 当前包放不下了，切割OBU element
+			n := remain - av1.Leb128Size(uint64(remain))
+			if n <= 0 {
+				flush(false)
+				continue
+			}
+			item = av1.AppendLeb128(item, uint64(n))
+			item = append(item, e[:n]...)
+			e = e[n:]
+			flush(true)
+		}
+	}
+	if len(item) > av1AggregationHeaderSize {
+		flush(false)
+	}
+	return
+}
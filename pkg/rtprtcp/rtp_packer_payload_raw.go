@@ -0,0 +1,37 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+// RtpPackerPayloadRaw 不关心数据格式，按`maxSize`将数据切分成多个rtp包
+//
+// 比如gb28181中，将ps流打包成rtp
+type RtpPackerPayloadRaw struct {
+}
+
+func NewRtpPackerPayloadRaw() *RtpPackerPayloadRaw {
+	return &RtpPackerPayloadRaw{}
+}
+
+func (r *RtpPackerPayloadRaw) Pack(in []byte, maxSize int) (out [][]byte) {
+	if in == nil || maxSize <= 0 {
+		return
+	}
+
+	for len(in) > 0 {
+		n := maxSize
+		if n > len(in) {
+			n = len(in)
+		}
+		item := make([]byte, n)
+		copy(item, in[:n])
+		out = append(out, item)
+		in = in[n:]
+	}
+	return
+}
@@ -0,0 +1,105 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+import (
+	"math/rand"
+
+	"github.com/ysjhlnu/lal/pkg/vp9"
+)
+
+// RTP Payload Format for VP9
+// rfc9628 4.2. VP9 Payload Descriptor
+//
+//      0 1 2 3 4 5 6 7
+//     +-+-+-+-+-+-+-+-+
+//     |I|P|L|F|B|E|V|Z| (REQUIRED)
+//     +-+-+-+-+-+-+-+-+
+// I:  |M| PICTURE ID  | (REQUIRED)
+//     +-+-+-+-+-+-+-+-+
+// M:  | EXTENDED PID  | (RECOMMENDED)
+//     +-+-+-+-+-+-+-+-+
+// L:  | TID |U| SID |D| (Conditionally RECOMMENDED)
+//     +-+-+-+-+-+-+-+-+                             -\
+// P,F:| P_DIFF      |N| (Conditionally REQUIRED)    - up to 3 times
+//     +-+-+-+-+-+-+-+-+                             -/
+// V:  | SS            |
+//     | ..            |
+//     +-+-+-+-+-+-+-+-+
+//
+// I: 带有picture id
+// P: 帧间预测帧
+// L: 带有layer indices
+// F: flexible mode
+// B: 帧的第一个包
+// E: 帧的最后一个包
+// V: 带有scalability structure
+
+const (
+	vp9DescriptorI uint8 = 0x80
+	vp9DescriptorP uint8 = 0x40
+	vp9DescriptorL uint8 = 0x20
+	vp9DescriptorF uint8 = 0x10
+	vp9DescriptorB uint8 = 0x08
+	vp9DescriptorE uint8 = 0x04
+	vp9DescriptorV uint8 = 0x02
+
+	// 打包时使用 I=1，M=1，15位的picture id
+	vp9PackDescriptorSize = 3
+)
+
+type RtpPackerPayloadVp9 struct {
+	pictureId uint16
+}
+
+func NewRtpPackerPayloadVp9() *RtpPackerPayloadVp9 {
+	return &RtpPackerPayloadVp9{
+		pictureId: uint16(rand.Intn(0x8000)),
+	}
+}
+
+// Pack
+//
+// @param in: 一个frame或superframe，也即enhanced-rtmp vp09的帧数据
+//
+// @return out: 内存块为独立新申请；函数返回后，内部不再持有该内存块
+func (r *RtpPackerPayloadVp9) Pack(in []byte, maxSize int) (out [][]byte) {
+	if len(in) == 0 || maxSize <= vp9PackDescriptorSize {
+		return
+	}
+
+	b0 := vp9DescriptorI
+	if !vp9.IsKeyFrame(in) {
+		b0 |= vp9DescriptorP
+	}
+
+	for bpos := 0; bpos < len(in); {
+		n := len(in) - bpos
+		if n > maxSize-vp9PackDescriptorSize {
+			n = maxSize - vp9PackDescriptorSize
+		}
+
+		item := make([]byte, vp9PackDescriptorSize+n)
+		item[0] = b0
+		if bpos == 0 {
+			item[0] |= vp9DescriptorB
+		}
+		if bpos+n == len(in) {
+			item[0] |= vp9DescriptorE
+		}
+		item[1] = 0x80 | uint8(r.pictureId>>8)
+		item[2] = uint8(r.pictureId)
+		copy(item[vp9PackDescriptorSize:], in[bpos:bpos+n])
+		out = append(out, item)
+		bpos += n
+	}
+
+	r.pictureId = (r.pictureId + 1) & 0x7FFF
+	return
+}
@@ -266,3 +266,21 @@ func IsHevcBoundary(pkt RtpPacket) bool {
 
 	return false
 }
+
+// IsAv1Boundary 新的coded video sequence的第一个包，也即aggregation header中N为1
+func IsAv1Boundary(pkt RtpPacket) bool {
+	b := pkt.Body()
+	if len(b) < av1AggregationHeaderSize {
+		return false
+	}
+	return b[0]&av1AggregationHeaderN != 0 && b[0]&av1AggregationHeaderZ == 0
+}
+
+// IsVp9Boundary 关键帧的第一个包，也即payload descriptor中B为1，P为0
+func IsVp9Boundary(pkt RtpPacket) bool {
+	b := pkt.Body()
+	if len(b) < 1 {
+		return false
+	}
+	return b[0]&vp9DescriptorB != 0 && b[0]&vp9DescriptorP == 0
+}
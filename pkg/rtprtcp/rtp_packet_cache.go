@@ -0,0 +1,64 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+// RtpPacketCache 缓存最近发送的rtp包，收到对端的nack后，从中取出包重传
+//
+// 注意，非协程安全
+type RtpPacketCache struct {
+	ssrc  uint32
+	items []rtpPacketCacheItem
+}
+
+type rtpPacketCacheItem struct {
+	valid bool
+	seq   uint16
+	raw   []byte
+}
+
+// NewRtpPacketCache
+//
+// @param size: 最多缓存的包数量
+func NewRtpPacketCache(size int) *RtpPacketCache {
+	return &RtpPacketCache{
+		items: make([]rtpPacketCacheItem, size),
+	}
+}
+
+// Put 内部会拷贝 pkt.Raw
+func (c *RtpPacketCache) Put(pkt RtpPacket) {
+	if pkt.Header.Ssrc != c.ssrc {
+		// 流发生了变化，之前的包不再有意义
+		for i := range c.items {
+			c.items[i].valid = false
+		}
+		c.ssrc = pkt.Header.Ssrc
+	}
+
+	item := &c.items[int(pkt.Header.Seq)%len(c.items)]
+	item.valid = true
+	item.seq = pkt.Header.Seq
+	item.raw = append(item.raw[:0], pkt.Raw...)
+}
+
+// Get 获取序号为`seq`的包，不存在时返回nil
+//
+// 注意，返回的内存块在下次调用 Put 后可能被覆盖
+func (c *RtpPacketCache) Get(seq uint16) []byte {
+	item := &c.items[int(seq)%len(c.items)]
+	if !item.valid || item.seq != seq {
+		return nil
+	}
+	return item.raw
+}
+
+// Ssrc 最近一次 Put 的包的ssrc
+func (c *RtpPacketCache) Ssrc() uint32 {
+	return c.ssrc
+}
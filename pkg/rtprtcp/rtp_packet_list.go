@@ -121,10 +121,18 @@ func (l *RtpPacketList) SetDoneSeq(seq uint16) {
 	l.doneSeq = seq
 }
 
+// DoneSeq 已处理的包序号
+//
+// @return ok: 如果为false，说明还没有处理过包
+func (l *RtpPacketList) DoneSeq() (seq uint16, ok bool) {
+	return l.doneSeq, l.doneSeqFlag
+}
+
 func (l *RtpPacketList) Reset() {
 	l.doneSeqFlag = false
 	l.doneSeq = 0
 	l.Head.Next = nil
+	l.Size = 0
 }
 
 func (l *RtpPacketList) DebugString() string {
@@ -22,6 +22,8 @@ var (
 	_ IRtpUnpackerProtocol = &RtpUnpackerAac{}
 	_ IRtpUnpackerProtocol = &RtpUnpackerAvcHevc{}
 	_ IRtpUnpackerProtocol = &RtpUnpackerRaw{}
+	_ IRtpUnpackerProtocol = &RtpUnpackerAv1{}
+	_ IRtpUnpackerProtocol = &RtpUnpackerVp9{}
 )
 
 type IRtpUnpacker interface {
@@ -67,25 +69,61 @@ type IRtpUnpackerProtocol interface {
 //		  新申请的内存块，回调结束后，内部不再使用该内存块。
 //		  注意，这一层只做RTP包的合并，假如sps和pps是两个RTP single包，则合并结果为两个AvPacket，
 //		  假如sps和pps是一个stapA包，则合并结果为一个AvPacket。
+//		AV1:
+//		  Low Overhead Bitstream Format格式的TU，每个OBU都带有obu_size字段。
+//		  新申请的内存块，回调结束后，内部不再使用该内存块。
+//		VP9:
+//		  一个frame或superframe。
+//		  新申请的内存块，回调结束后，内部不再使用该内存块。
 type OnAvPacket func(pkt base.AvPacket)
 
-// DefaultRtpUnpackerFactory 目前支持AVC，HEVC和AAC MPEG4-GENERIC，业务方也可以自己实现IRtpUnpackerProtocol，甚至是IRtpUnpackContainer
+// DefaultRtpUnpackerFactory 目前支持AVC，HEVC，AV1，VP9，AAC MPEG4-GENERIC，G711和Opus，业务方也可以自己实现IRtpUnpackerProtocol，甚至是IRtpUnpackContainer
 func DefaultRtpUnpackerFactory(payloadType base.AvPacketPt, clockRate int, maxSize int, onAvPacket OnAvPacket) IRtpUnpacker {
 	nazalog.Debugf("DefaultRtpUnpackerFactory. type=%d, clockRate=%d, maxSize=%d", payloadType, clockRate, maxSize)
 	var protocol IRtpUnpackerProtocol
 	switch payloadType {
 	case base.AvPacketPtAac:
 		protocol = NewRtpUnpackerAac(payloadType, clockRate, onAvPacket)
-	case base.AvPacketPtG711U:
-		fallthrough
-	case base.AvPacketPtG711A:
+	case base.AvPacketPtG711U, base.AvPacketPtG711A, base.AvPacketPtOpus:
 		protocol = NewRtpUnpackerRaw(payloadType, clockRate, onAvPacket)
 	case base.AvPacketPtAvc:
 		fallthrough
 	case base.AvPacketPtHevc:
 		protocol = NewRtpUnpackerAvcHevc(payloadType, clockRate, onAvPacket)
+	case base.AvPacketPtAv1:
+		protocol = NewRtpUnpackerAv1(payloadType, clockRate, onAvPacket)
+	case base.AvPacketPtVp9:
+		protocol = NewRtpUnpackerVp9(payloadType, clockRate, onAvPacket)
 	default:
 		Log.Fatalf("payload type not support yet. payloadType=%d", payloadType)
 	}
 	return NewRtpUnpackContainer(maxSize, protocol)
 }
+
+// findFrameLastPacket 从队列头部开始，查找一帧的最后一个rtp包
+//
+// 以marker位作为帧结束的标志，如果marker位的包丢失了，则以时间戳变化作为帧结束的标志。
+// 目前供AV1和VP9使用。
+//
+// @return count: 这一帧包含的rtp包的数量
+// @return ok:    为false时表示这一帧的包还没有收齐
+func findFrameLastPacket(list *RtpPacketList) (last *RtpPacketListItem, count int, ok bool) {
+	first := list.Head.Next
+	if first == nil {
+		return nil, 0, false
+	}
+
+	p := first
+	count = 1
+	for p.Packet.Header.Mark == 0 {
+		if p.Next == nil || SubSeq(p.Next.Packet.Header.Seq, p.Packet.Header.Seq) != 1 {
+			return nil, 0, false
+		}
+		if p.Next.Packet.Header.Timestamp != first.Packet.Header.Timestamp {
+			break
+		}
+		p = p.Next
+		count++
+	}
+	return p, count, true
+}
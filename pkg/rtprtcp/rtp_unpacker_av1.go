@@ -0,0 +1,135 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+import (
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/av1"
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RtpUnpackerAv1
+//
+// 合帧后的数据为Low Overhead Bitstream Format格式的TU（每个OBU都带有obu_size字段，不包含temporal delimiter），
+// 可以直接作为enhanced-rtmp av01的帧数据。
+//
+// 协议见 RtpPackerPayloadAv1
+type RtpUnpackerAv1 struct {
+	payloadType base.AvPacketPt
+	clockRate   int
+	onAvPacket  OnAvPacket
+}
+
+func NewRtpUnpackerAv1(payloadType base.AvPacketPt, clockRate int, onAvPacket OnAvPacket) *RtpUnpackerAv1 {
+	return &RtpUnpackerAv1{
+		payloadType: payloadType,
+		clockRate:   clockRate,
+		onAvPacket:  onAvPacket,
+	}
+}
+
+func (unpacker *RtpUnpackerAv1) CalcPositionIfNeeded(pkt *RtpPacket) {
+	// noop
+}
+
+func (unpacker *RtpUnpackerAv1) TryUnpackOne(list *RtpPacketList) (unpackedFlag bool, unpackedSeq uint16) {
+	first := list.Head.Next
+	last, count, ok := findFrameLastPacket(list)
+	if !ok {
+		return false, 0
+	}
+
+	var out []byte
+	var obu []byte  // 当前正在合并的OBU element
+	hasObu := false // obu是否有效，为false时表示OBU的起始部分丢失了
+	for p := first; ; p = p.Next {
+		b := p.Packet.Body()
+		if len(b) < av1AggregationHeaderSize {
+			hasObu = false
+		} else {
+			isContinue := b[0]&av1AggregationHeaderZ != 0
+			hasNext := b[0]&av1AggregationHeaderY != 0
+			w := int(b[0]>>4) & 0x03
+
+			elements, err := splitAv1Elements(b[av1AggregationHeaderSize:], w)
+			if err != nil {
+				Log.Warnf("[%p] split av1 obu elements failed. err=%+v", unpacker, err)
+				hasObu = false
+			}
+			for i, e := range elements {
+				if i == 0 && isContinue {
+					obu = append(obu, e...)
+				} else {
+					obu = append(obu[:0], e...)
+					hasObu = true
+				}
+				if i == len(elements)-1 && hasNext {
+					break
+				}
+				if hasObu {
+					out = appendAv1Obu(out, obu)
+				}
+				hasObu = false
+			}
+		}
+
+		if p == last {
+			break
+		}
+	}
+
+	list.Head.Next = last.Next
+	list.Size -= count
+
+	if len(out) > 0 {
+		var pkt base.AvPacket
+		pkt.PayloadType = unpacker.payloadType
+		pkt.Timestamp = int64(last.Packet.Header.Timestamp / uint32(unpacker.clockRate/1000))
+		pkt.Payload = out
+		unpacker.onAvPacket(pkt)
+	}
+	return true, last.Packet.Header.Seq
+}
+
+// splitAv1Elements 拆分rtp包中的OBU element
+//
+// @return 复用传入参数`b`的内存块
+func splitAv1Elements(b []byte, w int) (elements [][]byte, err error) {
+	for i := 0; len(b) > 0; i++ {
+		// W不为0时，最后一个OBU element没有长度字段
+		if w != 0 && i == w-1 {
+			elements = append(elements, b)
+			break
+		}
+		size, n, err := av1.ReadLeb128(b)
+		if err != nil {
+			return elements, err
+		}
+		if n+int(size) > len(b) {
+			return elements, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+		}
+		elements = append(elements, b[n:n+int(size)])
+		b = b[n+int(size):]
+	}
+	return
+}
+
+// appendAv1Obu 将OBU element加上obu_size字段后追加到`out`中
+func appendAv1Obu(out []byte, element []byte) []byte {
+	h, payload, _, err := av1.ParseObu(element)
+	if err != nil {
+		return out
+	}
+	switch h.Type {
+	case av1.ObuTypeTemporalDelimiter, av1.ObuTypeTileList, av1.ObuTypePadding:
+		return out
+	}
+	return append(out, av1.PackObu(h, payload, true)...)
+}
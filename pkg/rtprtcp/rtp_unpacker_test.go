@@ -15,6 +15,7 @@ import (
 
 	"github.com/q191201771/naza/pkg/bele"
 
+	"github.com/ysjhlnu/lal/pkg/av1"
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/q191201771/naza/pkg/assert"
 )
@@ -199,6 +200,75 @@ func testHelperAddPrefixLength(in []byte) (out []byte) {
 	return
 }
 
+func TestAv1PackUnpack(t *testing.T) {
+	frameBody := make([]byte, 3000)
+	for i := range frameBody {
+		frameBody[i] = uint8(i)
+	}
+	seqHeaderObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeSequenceHeader}, []byte{0x00, 0x00, 0x00, 0x24}, true)
+	keyFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame}, append([]byte{0x10}, frameBody...), true)
+	interFrameObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeFrame, HasExtension: true, TemporalId: 1}, []byte{0x30, 0x01}, true)
+	tdObu := av1.PackObu(av1.ObuHeader{Type: av1.ObuTypeTemporalDelimiter}, nil, true)
+
+	var keyTu []byte
+	keyTu = append(keyTu, tdObu...)
+	keyTu = append(keyTu, seqHeaderObu...)
+	keyTu = append(keyTu, keyFrameObu...)
+
+	packer := NewRtpPacker(NewRtpPackerPayloadAv1(), 90000, 1, func(option *RtpPackerOption) {
+		option.MaxPayloadSize = 500
+	})
+	pkts := packer.Pack(base.AvPacket{Timestamp: 40, PayloadType: base.AvPacketPtAv1, Payload: keyTu})
+	assert.Equal(t, 7, len(pkts))
+	for i := range pkts {
+		assert.Equal(t, true, len(pkts[i].Body()) <= 500)
+		assert.Equal(t, i == 0, IsAv1Boundary(pkts[i]))
+	}
+	pkts = append(pkts, packer.Pack(base.AvPacket{Timestamp: 80, PayloadType: base.AvPacketPtAv1, Payload: interFrameObu})...)
+	assert.Equal(t, false, IsAv1Boundary(pkts[7]))
+
+	// 乱序
+	pkts[2], pkts[3] = pkts[3], pkts[2]
+	outPkts := testHelperUnpack(base.AvPacketPtAv1, 90000, 128, pkts)
+	assert.Equal(t, 2, len(outPkts))
+	assert.Equal(t, append(append([]byte{}, seqHeaderObu...), keyFrameObu...), outPkts[0].Payload)
+	assert.Equal(t, int64(40), outPkts[0].Timestamp)
+	assert.Equal(t, interFrameObu, outPkts[1].Payload)
+	assert.Equal(t, int64(80), outPkts[1].Timestamp)
+}
+
+func TestVp9PackUnpack(t *testing.T) {
+	keyFrame := []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x4f, 0xf0, 0x2c, 0xf0, 0x00, 0x00}
+	keyFrame = append(keyFrame, make([]byte, 2500)...)
+	interFrame := []byte{0x86, 0x00, 0x40, 0x92}
+
+	packer := NewRtpPacker(NewRtpPackerPayloadVp9(), 90000, 1, func(option *RtpPackerOption) {
+		option.MaxPayloadSize = 1000
+	})
+	pkts := packer.Pack(base.AvPacket{Timestamp: 40, PayloadType: base.AvPacketPtVp9, Payload: keyFrame})
+	assert.Equal(t, 3, len(pkts))
+	assert.Equal(t, true, IsVp9Boundary(pkts[0]))
+	assert.Equal(t, false, IsVp9Boundary(pkts[1]))
+	interPkts := packer.Pack(base.AvPacket{Timestamp: 80, PayloadType: base.AvPacketPtVp9, Payload: interFrame})
+	assert.Equal(t, 1, len(interPkts))
+	assert.Equal(t, false, IsVp9Boundary(interPkts[0]))
+
+	// 丢失第一个包的帧被丢弃
+	lost := packer.Pack(base.AvPacket{Timestamp: 120, PayloadType: base.AvPacketPtVp9, Payload: keyFrame})
+
+	pkts = append(pkts, interPkts...)
+	pkts = append(pkts, lost[1:]...)
+	outPkts := testHelperUnpack(base.AvPacketPtVp9, 90000, 128, pkts)
+	assert.Equal(t, 2, len(outPkts))
+	assert.Equal(t, keyFrame, outPkts[0].Payload)
+	assert.Equal(t, interFrame, outPkts[1].Payload)
+	assert.Equal(t, int64(80), outPkts[1].Timestamp)
+
+	n, err := parseVp9DescriptorSize([]byte{0xa8, 0x81, 0x02, 0x00, 0x01, 0xff})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 5, n)
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 
 func testHelperUnpack(payloadType base.AvPacketPt, clockRate int, maxSize int, rtpPackets []RtpPacket) []base.AvPacket {
@@ -0,0 +1,162 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtprtcp
+
+import (
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RtpUnpackerVp9
+//
+// 合帧后的数据为一个frame或superframe，可以直接作为enhanced-rtmp vp09的帧数据。
+// 注意，不支持spatial layer（SVC）。
+//
+// 协议见 RtpPackerPayloadVp9
+type RtpUnpackerVp9 struct {
+	payloadType base.AvPacketPt
+	clockRate   int
+	onAvPacket  OnAvPacket
+}
+
+func NewRtpUnpackerVp9(payloadType base.AvPacketPt, clockRate int, onAvPacket OnAvPacket) *RtpUnpackerVp9 {
+	return &RtpUnpackerVp9{
+		payloadType: payloadType,
+		clockRate:   clockRate,
+		onAvPacket:  onAvPacket,
+	}
+}
+
+func (unpacker *RtpUnpackerVp9) CalcPositionIfNeeded(pkt *RtpPacket) {
+	// noop
+}
+
+func (unpacker *RtpUnpackerVp9) TryUnpackOne(list *RtpPacketList) (unpackedFlag bool, unpackedSeq uint16) {
+	first := list.Head.Next
+	last, count, ok := findFrameLastPacket(list)
+	if !ok {
+		return false, 0
+	}
+
+	list.Head.Next = last.Next
+	list.Size -= count
+
+	// 使用两次遍历，第一次遍历找出总大小，第二次逐个拷贝
+	totalSize := 0
+	for p := first; ; p = p.Next {
+		b := p.Packet.Body()
+		n, err := parseVp9DescriptorSize(b)
+		if err != nil || (p == first && b[0]&vp9DescriptorB == 0) {
+			// 帧的第一个包丢失了，或者包格式错误，丢弃整帧
+			Log.Warnf("[%p] invalid vp9 rtp packet, drop frame. err=%+v, header=%+v", unpacker, err, p.Packet.Header)
+			return true, last.Packet.Header.Seq
+		}
+		totalSize += len(b) - n
+		if p == last {
+			break
+		}
+	}
+
+	var pkt base.AvPacket
+	pkt.PayloadType = unpacker.payloadType
+	pkt.Timestamp = int64(last.Packet.Header.Timestamp / uint32(unpacker.clockRate/1000))
+	pkt.Payload = make([]byte, 0, totalSize)
+	for p := first; ; p = p.Next {
+		b := p.Packet.Body()
+		n, _ := parseVp9DescriptorSize(b)
+		pkt.Payload = append(pkt.Payload, b[n:]...)
+		if p == last {
+			break
+		}
+	}
+
+	if len(pkt.Payload) > 0 {
+		unpacker.onAvPacket(pkt)
+	}
+	return true, last.Packet.Header.Seq
+}
+
+// parseVp9DescriptorSize 返回VP9 payload descriptor的大小
+func parseVp9DescriptorSize(b []byte) (int, error) {
+	if len(b) < 1 {
+		return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+	}
+
+	i := 1
+	b0 := b[0]
+	if b0&vp9DescriptorI != 0 {
+		if len(b) < i+1 {
+			return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+		}
+		// M为1时，picture id为15位
+		if b[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if b0&vp9DescriptorL != 0 {
+		i++
+		// non-flexible mode时还有TL0PICIDX
+		if b0&vp9DescriptorF == 0 {
+			i++
+		}
+	}
+	if b0&vp9DescriptorF != 0 && b0&vp9DescriptorP != 0 {
+		// P_DIFF，N为1时后面还有，最多3个
+		for j := 0; j < 3; j++ {
+			if len(b) < i+1 {
+				return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+			}
+			hasNext := b[i]&0x01 != 0
+			i++
+			if !hasNext {
+				break
+			}
+		}
+	}
+	if b0&vp9DescriptorV != 0 {
+		// scalability structure
+		//
+		// +-+-+-+-+-+-+-+-+
+		// | N_S |Y|G|-|-|-|
+		// +-+-+-+-+-+-+-+-+
+		if len(b) < i+1 {
+			return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+		}
+		ns := int(b[i]>>5) + 1
+		y := b[i]&0x10 != 0
+		g := b[i]&0x08 != 0
+		i++
+		if y {
+			// 每个spatial layer的WIDTH和HEIGHT，各2字节
+			i += 4 * ns
+		}
+		if g {
+			if len(b) < i+1 {
+				return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+			}
+			ng := int(b[i])
+			i++
+			for j := 0; j < ng; j++ {
+				if len(b) < i+1 {
+					return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+				}
+				// | TID |U| R |-|-|
+				r := int(b[i]>>2) & 0x03
+				i += 1 + r
+			}
+		}
+	}
+
+	if i > len(b) {
+		return 0, nazaerrors.Wrap(base.ErrRtpRtcpShortBuffer)
+	}
+	return i, nil
+}
@@ -16,11 +16,15 @@ import (
 // 处理音频和视频的时间戳：
 // 1. 让音频和视频的时间戳都从0开始（改变原时间戳）
 // 2. 让音频和视频的时间戳交替递增输出（不改变原时间戳）
+// 3. 如果通过 SetAvDelta 设置了音视频原始时间戳的对应关系（比如由RTCP SR计算得到），则音频和视频对齐到同一时间轴，而不是各自从0开始
 
 // 注意，本模块默认音频和视频都存在，如果只有音频或只有视频，则不要使用该模块
 
 const maxQueueSize = 128
 
+// avDeltaAdjustThresholdMs SetAvDelta 的值变化超过该阈值时，才重新调整音频时间戳的基准，避免音频时间戳频繁跳变
+const avDeltaAdjustThresholdMs = 40
+
 type OnAvPacket func(pkt base.AvPacket)
 
 type AvPacketQueue struct {
@@ -29,57 +33,113 @@ type AvPacketQueue struct {
 	videoBaseTs int64                        // video base timestamp
 	audioQueue  *circularqueue.CircularQueue // TODO chef: 特化成AvPacket类型
 	videoQueue  *circularqueue.CircularQueue
+
+	hasAvDelta   bool
+	avDeltaMs    int64 // 同一时刻，音频原始时间戳减去视频原始时间戳的差值
+	audioFirstTs int64 // 音频第一个原始时间戳，用于计算 AvOffset
+	videoFirstTs int64
+	audioLastTs  int64 // 最后一个音频时间戳（调整后），对齐后保证音频时间戳不回退
 }
 
 func NewAvPacketQueue(onAvPacket OnAvPacket) *AvPacketQueue {
 	return &AvPacketQueue{
-		onAvPacket:  onAvPacket,
-		audioBaseTs: -1,
-		videoBaseTs: -1,
-		audioQueue:  circularqueue.New(maxQueueSize),
-		videoQueue:  circularqueue.New(maxQueueSize),
+		onAvPacket:   onAvPacket,
+		audioBaseTs:  -1,
+		videoBaseTs:  -1,
+		audioFirstTs: -1,
+		videoFirstTs: -1,
+		audioQueue:   circularqueue.New(maxQueueSize),
+		videoQueue:   circularqueue.New(maxQueueSize),
+	}
+}
+
+// SetAvDelta 设置同一时刻音频原始时间戳减去视频原始时间戳的差值，单位毫秒
+//
+// 设置后，音频时间戳的基准由视频时间戳的基准推导得出，从而同一时刻的音频和视频输出相同的时间戳。
+// 可以多次调用，比如每次收到SR时，变化超过 avDeltaAdjustThresholdMs 时才重新调整。
+func (a *AvPacketQueue) SetAvDelta(deltaMs int64) {
+	if a.hasAvDelta && absInt64(deltaMs-a.avDeltaMs) < avDeltaAdjustThresholdMs {
+		return
+	}
+	if a.hasAvDelta {
+		Log.Infof("av delta changed. %d -> %d", a.avDeltaMs, deltaMs)
+	}
+	a.hasAvDelta = true
+	a.avDeltaMs = deltaMs
+	if a.videoBaseTs != -1 {
+		a.audioBaseTs = a.videoBaseTs + deltaMs
+	} else if a.audioBaseTs != -1 {
+		a.videoBaseTs = a.audioBaseTs - deltaMs
+	}
+}
+
+// AvOffset 音频和视频各自从0开始时，同一时刻音频时间戳比视频时间戳大的毫秒数，也即对齐时调整的大小
+//
+// @return ok 为false表示还没有计算出来，比如没有调用过 SetAvDelta
+func (a *AvPacketQueue) AvOffset() (offsetMs int64, ok bool) {
+	if !a.hasAvDelta || a.audioFirstTs == -1 || a.videoFirstTs == -1 {
+		return 0, false
 	}
+	return a.avDeltaMs - (a.audioFirstTs - a.videoFirstTs), true
 }
 
 // Feed 注意，调用方保证，音频相较于音频，视频相较于视频，时间戳是线性递增的。
 func (a *AvPacketQueue) Feed(pkt base.AvPacket) {
 	//Log.Debugf("AVQ feed. t=%d, ts=%d", pkt.PayloadType, pkt.Timestamp)
 	switch pkt.PayloadType {
-	case base.AvPacketPtAvc:
-		fallthrough
-	case base.AvPacketPtHevc:
+	case base.AvPacketPtAvc, base.AvPacketPtHevc, base.AvPacketPtAv1, base.AvPacketPtVp9:
 		// 时间戳回退了
-		if pkt.Timestamp < a.videoBaseTs {
+		if pkt.Timestamp < a.videoFirstTs {
 			Log.Warnf("video ts rotate. pktTS=%d, audioBaseTs=%d, videoBaseTs=%d, audioQueue=%d, videoQueue=%d",
 				pkt.Timestamp, a.audioBaseTs, a.videoBaseTs, a.audioQueue.Size(), a.videoQueue.Size())
-			a.videoBaseTs = -1
-			a.audioBaseTs = -1
-			a.PopAllByForce()
+			a.reset()
 		}
 		// 第一次
+		if a.videoFirstTs == -1 {
+			a.videoFirstTs = pkt.Timestamp
+		}
 		if a.videoBaseTs == -1 {
 			a.videoBaseTs = pkt.Timestamp
+			if a.hasAvDelta && a.audioBaseTs == -1 {
+				a.audioBaseTs = a.videoBaseTs + a.avDeltaMs
+			}
 		}
 		// 根据基准调节
 		pkt.Timestamp -= a.videoBaseTs
+		if pkt.Timestamp < 0 {
+			pkt.Timestamp = 0
+		}
 
 		_ = a.videoQueue.PushBack(pkt)
 	case base.AvPacketPtG711A:
 		fallthrough
 	case base.AvPacketPtG711U:
 		fallthrough
+	case base.AvPacketPtOpus:
+		fallthrough
 	case base.AvPacketPtAac:
-		if pkt.Timestamp < a.audioBaseTs {
+		if pkt.Timestamp < a.audioFirstTs {
 			Log.Warnf("audio ts rotate. pktTS=%d, audioBaseTs=%d, videoBaseTs=%d, audioQueue=%d, videoQueue=%d",
 				pkt.Timestamp, a.audioBaseTs, a.videoBaseTs, a.audioQueue.Size(), a.videoQueue.Size())
-			a.videoBaseTs = -1
-			a.audioBaseTs = -1
-			a.PopAllByForce()
+			a.reset()
+		}
+		if a.audioFirstTs == -1 {
+			a.audioFirstTs = pkt.Timestamp
 		}
 		if a.audioBaseTs == -1 {
 			a.audioBaseTs = pkt.Timestamp
+			if a.hasAvDelta && a.videoBaseTs == -1 {
+				a.videoBaseTs = a.audioBaseTs - a.avDeltaMs
+			}
 		}
 		pkt.Timestamp -= a.audioBaseTs
+		if a.hasAvDelta {
+			// 对齐后，早于视频的音频，以及调整基准导致的回退
+			if pkt.Timestamp < a.audioLastTs {
+				pkt.Timestamp = a.audioLastTs
+			}
+			a.audioLastTs = pkt.Timestamp
+		}
 		_ = a.audioQueue.PushBack(pkt)
 	}
 
@@ -126,6 +186,19 @@ func (a *AvPacketQueue) PopAllByForce() {
 	Log.Assert(false, !a.audioQueue.Empty() && !a.videoQueue.Empty())
 }
 
+// reset 时间戳翻转时调用
+//
+// 注意，翻转后之前的音视频对应关系已经失效，需要重新调用 SetAvDelta
+func (a *AvPacketQueue) reset() {
+	a.videoBaseTs = -1
+	a.audioBaseTs = -1
+	a.audioFirstTs = -1
+	a.videoFirstTs = -1
+	a.audioLastTs = 0
+	a.hasAvDelta = false
+	a.PopAllByForce()
+}
+
 func (a *AvPacketQueue) popAllAudio() {
 	for !a.audioQueue.Empty() {
 		pkt, _ := a.audioQueue.Front()
@@ -143,3 +216,10 @@ func (a *AvPacketQueue) popAllVideo() {
 		a.onAvPacket(ppkt)
 	}
 }
+
+func absInt64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
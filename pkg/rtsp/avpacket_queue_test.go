@@ -196,6 +196,22 @@ func TestAvPacketQueue(t *testing.T) {
 	}
 }
 
+func TestAvPacketQueueOpus(t *testing.T) {
+	// opus按20毫秒一帧
+	opus := func(t int64) base.AvPacket {
+		return base.AvPacket{PayloadType: base.AvPacketPtOpus, Timestamp: t}
+	}
+	var in []base.AvPacket
+	for i := int64(0); i < 6; i++ {
+		in = append(in, v(uint32(1000+i*40)), opus(500+i*40), opus(500+i*40+20))
+	}
+	out, _ := calc(in)
+	assert.Equal(t, []base.AvPacket{
+		v(0), opus(0), opus(20), v(40), opus(40), opus(60), v(80), opus(80), opus(100), v(120), opus(120), opus(140),
+		v(160), opus(160), opus(180), v(200),
+	}, out)
+}
+
 func a(t uint32) base.AvPacket {
 	return base.AvPacket{
 		PayloadType: base.AvPacketPtAac,
@@ -254,3 +270,42 @@ func peekQueuePackets(q *AvPacketQueue) []base.AvPacket {
 	}
 	return out
 }
+
+func TestAvPacketQueueAvDelta(t *testing.T) {
+	var out []base.AvPacket
+	q := NewAvPacketQueue(func(pkt base.AvPacket) {
+		out = append(out, pkt)
+	})
+	_, ok := q.AvOffset()
+	assert.Equal(t, false, ok)
+
+	// 视频比音频早200毫秒开始，同一时刻音频原始时间戳比视频小10100
+	q.SetAvDelta(-10100)
+	q.Feed(v(10000))
+	q.Feed(v(10040))
+	q.Feed(a(100))
+	q.Feed(v(10080))
+	q.Feed(v(10120))
+	q.Feed(v(10160))
+	q.Feed(v(10200))
+	q.Feed(v(10240))
+	q.Feed(a(123))
+	assert.Equal(t, []base.AvPacket{v(0), v(40), v(80), v(120), v(160), v(200), a(200), a(223)}, out)
+
+	offset, ok := q.AvOffset()
+	assert.Equal(t, true, ok)
+	assert.Equal(t, int64(-200), offset)
+
+	// 小的抖动不调整
+	q.SetAvDelta(-10090)
+	offset, _ = q.AvOffset()
+	assert.Equal(t, int64(-200), offset)
+
+	// 调整后音频时间戳不回退
+	out = nil
+	q.SetAvDelta(-10000)
+	q.Feed(a(146))
+	assert.Equal(t, []base.AvPacket{a(223)}, out)
+	offset, _ = q.AvOffset()
+	assert.Equal(t, int64(-100), offset)
+}
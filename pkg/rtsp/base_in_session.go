@@ -10,8 +10,10 @@ package rtsp
 
 import (
 	"encoding/hex"
+	"math/rand"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/q191201771/naza/pkg/nazaatomic"
 
@@ -45,6 +47,22 @@ type IBaseInSessionObserver interface {
 	OnAvPacket(pkt base.AvPacket)
 }
 
+// IBaseInSessionTrackObserver 可选接口
+//
+// observer实现该接口后，可以收到主音频、主视频之外的其他track的数据，见 sdp.LogicContext.ExtraTracks
+type IBaseInSessionTrackObserver interface {
+	// OnTrackRtpPacket 其他track的rtp包
+	OnTrackRtpPacket(track sdp.TrackContext, pkt rtprtcp.RtpPacket)
+
+	// OnTrackAvPacket 其他track合帧后的数据，只有 sdp.TrackContext.IsUnpackable 为true的track才会回调
+	OnTrackAvPacket(track sdp.TrackContext, pkt base.AvPacket)
+
+	// OnOnvifMetadata ONVIF元数据，一个完整的xml文档
+	//
+	// @param b: 回调结束后，内部不再使用该内存块
+	OnOnvifMetadata(track sdp.TrackContext, b []byte)
+}
+
 type BaseInSession struct {
 	cmdSession IInterleavedPacketWriter
 
@@ -70,9 +88,26 @@ type BaseInSession struct {
 	audioUnpacker rtprtcp.IRtpUnpacker
 	videoUnpacker rtprtcp.IRtpUnpacker
 
+	// 最近一个SR中，rtp时间戳（毫秒）减去ntp时间（毫秒），用于音视频同步，见 updateAvSync
+	audioSrRtpMinusNtp int64
+	videoSrRtpMinusNtp int64
+	hasAudioSr         bool
+	hasVideoSr         bool
+
 	audioSsrc nazaatomic.Uint32
 	videoSsrc nazaatomic.Uint32
 
+	// 丢包重传，只有udp模式使用，见 produceNack
+	senderSsrc        uint32 // 本端发送nack、pli时使用的ssrc
+	audioNackProducer *rtprtcp.NackProducer
+	videoNackProducer *rtprtcp.NackProducer
+	nackPacketCount   nazaatomic.Uint64
+	prevPliTime       time.Time
+
+	rtpReceived nazaatomic.Bool // 是否通过udp收到过rtp包，见 IsRtpReceived
+
+	extraTracks []*baseInTrack // 主音频、主视频之外的其他track
+
 	disposeOnce sync.Once
 	waitChan    chan error
 
@@ -82,10 +117,25 @@ type BaseInSession struct {
 	dumpReadSr       base.LogDump
 }
 
+type baseInTrack struct {
+	ctx sdp.TrackContext
+
+	rtpConn     *nazanet.UdpConnection
+	rtcpConn    *nazanet.UdpConnection
+	rtpChannel  int
+	rtcpChannel int
+
+	unpacker    rtprtcp.IRtpUnpacker
+	rrProducer  *rtprtcp.RrProducer
+	ssrc        nazaatomic.Uint32
+	metadataBuf []byte
+}
+
 func NewBaseInSession(sessionType base.SessionType, cmdSession IInterleavedPacketWriter) *BaseInSession {
 	s := &BaseInSession{
 		sessionStat:      base.NewBasicSessionStat(sessionType, ""),
 		cmdSession:       cmdSession,
+		senderSsrc:       rand.Uint32(),
 		waitChan:         make(chan error, 1),
 		dumpReadAudioRtp: base.NewLogDump(Log, 1),
 		dumpReadVideoRtp: base.NewLogDump(Log, 1),
@@ -119,6 +169,28 @@ func (session *BaseInSession) InitWithSdp(sdpCtx sdp.LogicContext) {
 
 	session.audioRrProducer = rtprtcp.NewRrProducer(session.sdpCtx.AudioClockRate)
 	session.videoRrProducer = rtprtcp.NewRrProducer(session.sdpCtx.VideoClockRate)
+	session.mu.Lock()
+	session.audioNackProducer = rtprtcp.NewNackProducer()
+	session.videoNackProducer = rtprtcp.NewNackProducer()
+	session.mu.Unlock()
+
+	for _, trackCtx := range session.sdpCtx.ExtraTracks() {
+		track := &baseInTrack{
+			ctx:         trackCtx,
+			rtpChannel:  -1,
+			rtcpChannel: -1,
+			rrProducer:  rtprtcp.NewRrProducer(trackCtx.ClockRate),
+		}
+		if trackCtx.IsUnpackable() {
+			track.unpacker = rtprtcp.DefaultRtpUnpackerFactory(trackCtx.PayloadTypeBase, trackCtx.ClockRate, unpackerItemMaxSize, func(pkt base.AvPacket) {
+				if observer, ok := session.observer.(IBaseInSessionTrackObserver); ok {
+					observer.OnTrackAvPacket(track.ctx, pkt)
+				}
+			})
+		}
+		Log.Infof("[%s] extra track. index=%d, media=%s, encoding=%s", session.UniqueKey(), trackCtx.Index, trackCtx.Media, trackCtx.EncodingName)
+		session.extraTracks = append(session.extraTracks, track)
+	}
 
 	if session.sdpCtx.IsAudioUnpackable() && session.sdpCtx.IsVideoUnpackable() {
 		session.mu.Lock()
@@ -148,6 +220,20 @@ func (session *BaseInSession) SetupWithConn(uri string, rtpConn, rtcpConn *nazan
 	} else if session.sdpCtx.IsVideoUri(uri) {
 		session.videoRtpConn = rtpConn
 		session.videoRtcpConn = rtcpConn
+	} else if track := session.getExtraTrackByUri(uri); track != nil {
+		track.rtpConn = rtpConn
+		track.rtcpConn = rtcpConn
+
+		go rtpConn.RunLoop(func(b []byte, rAddr *net.UDPAddr, err error) bool {
+			if err != nil {
+				Log.Warnf("[%s] read udp packet failed. err=%+v", session.UniqueKey(), err)
+				return true
+			}
+			_ = session.handleTrackRtpPacket(track, b)
+			return true
+		})
+		go rtcpConn.RunLoop(session.onReadRtcpPacket)
+		return nil
 	} else {
 		return nazaerrors.Wrap(base.ErrRtsp)
 	}
@@ -158,15 +244,28 @@ func (session *BaseInSession) SetupWithConn(uri string, rtpConn, rtcpConn *nazan
 	return nil
 }
 
+// SetupWithChannel
+//
+// 注意，如果该track之前通过 SetupWithConn 使用了udp（比如pull由udp切换为tcp），之前的udp连接会被关闭
 func (session *BaseInSession) SetupWithChannel(uri string, rtpChannel, rtcpChannel int) error {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
 	if session.sdpCtx.IsAudioUri(uri) {
+		disposeUdpConn(&session.audioRtpConn, &session.audioRtcpConn)
 		session.audioRtpChannel = rtpChannel
 		session.audioRtcpChannel = rtcpChannel
 		return nil
 	} else if session.sdpCtx.IsVideoUri(uri) {
+		disposeUdpConn(&session.videoRtpConn, &session.videoRtcpConn)
 		session.videoRtpChannel = rtpChannel
 		session.videoRtcpChannel = rtcpChannel
 		return nil
+	} else if track := session.getExtraTrackByUri(uri); track != nil {
+		disposeUdpConn(&track.rtpConn, &track.rtcpConn)
+		track.rtpChannel = rtpChannel
+		track.rtcpChannel = rtcpChannel
+		return nil
 	}
 	return nazaerrors.Wrap(base.ErrRtsp)
 }
@@ -206,6 +305,16 @@ func (session *BaseInSession) HandleInterleavedPacket(b []byte, channel int) {
 	case session.videoRtcpChannel:
 		_ = session.handleRtcpPacket(b, nil)
 	default:
+		for _, track := range session.extraTracks {
+			if channel == track.rtpChannel {
+				_ = session.handleTrackRtpPacket(track, b)
+				return
+			}
+			if channel == track.rtcpChannel {
+				_ = session.handleRtcpPacket(b, nil)
+				return
+			}
+		}
 		Log.Errorf("[%s] read interleaved packet but channel invalid. channel=%d", session.UniqueKey(), channel)
 	}
 }
@@ -224,12 +333,90 @@ func (session *BaseInSession) WriteRtpRtcpDummy() {
 	if session.audioRtcpConn != nil {
 		_ = session.audioRtcpConn.Write(dummyRtcpPacket)
 	}
+	for _, track := range session.extraTracks {
+		if track.rtpConn != nil {
+			_ = track.rtpConn.Write(dummyRtpPacket)
+		}
+		if track.rtcpConn != nil {
+			_ = track.rtcpConn.Write(dummyRtcpPacket)
+		}
+	}
+}
+
+// WriteRtcpKeepalive udp模式下，向对端发送不包含report block的RR，用于维持NAT映射
+//
+// 对端不发送SR时，我们也就不会回复RR，长时间没有数据发往对端，NAT映射可能会失效
+func (session *BaseInSession) WriteRtcpKeepalive() {
+	b := rtprtcp.PackEmptyRr(session.senderSsrc)
+
+	session.mu.Lock()
+	conns := []*nazanet.UdpConnection{session.audioRtcpConn, session.videoRtcpConn}
+	for _, track := range session.extraTracks {
+		conns = append(conns, track.rtcpConn)
+	}
+	session.mu.Unlock()
+
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		if err := conn.Write(b); err == nil {
+			session.sessionStat.AddWriteBytes(len(b))
+		}
+	}
+}
+
+// IsRtpReceived 是否通过udp收到过rtp包
+func (session *BaseInSession) IsRtpReceived() bool {
+	return session.rtpReceived.Load()
+}
+
+// RequestKeyFrame 向对端发送PLI，请求视频关键帧
+//
+// 距离上一次请求不足 keyFrameRequestInterval 时忽略，避免多个拉流端同时请求时频繁发送
+func (session *BaseInSession) RequestKeyFrame() {
+	ssrc := session.videoSsrc.Load()
+	if ssrc == 0 {
+		return
+	}
+
+	session.mu.Lock()
+	now := time.Now()
+	if now.Sub(session.prevPliTime) < keyFrameRequestInterval {
+		session.mu.Unlock()
+		return
+	}
+	session.prevPliTime = now
+	conn := session.videoRtcpConn
+	session.mu.Unlock()
+
+	Log.Debugf("[%s] write rtcp pli. ssrc=%d", session.UniqueKey(), ssrc)
+	b := rtprtcp.PackPli(session.senderSsrc, ssrc)
+	var err error
+	if conn != nil {
+		err = conn.Write(b)
+	} else {
+		err = session.cmdSession.WriteInterleavedPacket(b, session.videoRtcpChannel)
+	}
+	if err == nil {
+		session.sessionStat.AddWriteBytes(len(b))
+	}
 }
 
 // ----- ISessionStat --------------------------------------------------------------------------------------------------
 
 func (session *BaseInSession) GetStat() base.StatSession {
-	return session.sessionStat.GetStat()
+	stat := session.sessionStat.GetStat()
+	session.mu.Lock()
+	if session.avPacketQueue != nil {
+		stat.AvSyncOffsetMs, _ = session.avPacketQueue.AvOffset()
+	}
+	if session.audioNackProducer != nil {
+		stat.LostPacketCount = session.audioNackProducer.LostNum() + session.videoNackProducer.LostNum()
+	}
+	session.mu.Unlock()
+	stat.NackPacketCount = session.nackPacketCount.Load()
+	return stat
 }
 
 func (session *BaseInSession) UpdateStat(intervalSec uint32) {
@@ -273,10 +460,50 @@ func (session *BaseInSession) onReadRtpPacket(b []byte, rAddr *net.UDPAddr, err
 		return true
 	}
 
-	_ = session.handleRtpPacket(b)
+	session.rtpReceived.Store(true)
+	if session.handleRtpPacket(b) == nil {
+		session.produceNack(b)
+	}
 	return true
 }
 
+// produceNack udp模式下检测丢包，并请求对端重传
+//
+// 注意，interleaved模式下数据通过tcp传输，不会丢包，所以不需要调用
+func (session *BaseInSession) produceNack(b []byte) {
+	h, err := rtprtcp.ParseRtpHeader(b)
+	if err != nil {
+		return
+	}
+
+	isAudio := session.sdpCtx.IsAudioPayloadTypeOrigin(int(h.PacketType))
+	session.mu.Lock()
+	producer := session.videoNackProducer
+	if isAudio {
+		producer = session.audioNackProducer
+	}
+	if producer == nil {
+		session.mu.Unlock()
+		return
+	}
+	producer.FeedRtpPacket(h.Seq)
+	seqs := producer.Produce(time.Now())
+	conn := session.videoRtcpConn
+	if isAudio {
+		conn = session.audioRtcpConn
+	}
+	session.mu.Unlock()
+
+	if len(seqs) == 0 || conn == nil {
+		return
+	}
+	nackBuf := rtprtcp.PackNack(session.senderSsrc, h.Ssrc, seqs)
+	if err := conn.Write(nackBuf); err == nil {
+		session.sessionStat.AddWriteBytes(len(nackBuf))
+	}
+	session.nackPacketCount.Add(uint64(len(seqs)))
+}
+
 // callback by UDPConnection
 func (session *BaseInSession) onReadRtcpPacket(b []byte, rAddr *net.UDPAddr, err error) bool {
 	if err != nil {
@@ -310,6 +537,7 @@ func (session *BaseInSession) handleRtcpPacket(b []byte, rAddr *net.UDPAddr) err
 		case session.audioSsrc.Load():
 			session.mu.Lock()
 			rrBuf = session.audioRrProducer.Produce(sr.GetMiddleNtp())
+			session.updateAvSync(true, sr)
 			session.mu.Unlock()
 			if rrBuf != nil {
 				if rAddr != nil {
@@ -322,6 +550,7 @@ func (session *BaseInSession) handleRtcpPacket(b []byte, rAddr *net.UDPAddr) err
 		case session.videoSsrc.Load():
 			session.mu.Lock()
 			rrBuf = session.videoRrProducer.Produce(sr.GetMiddleNtp())
+			session.updateAvSync(false, sr)
 			session.mu.Unlock()
 			if rrBuf != nil {
 				if rAddr != nil {
@@ -332,6 +561,21 @@ func (session *BaseInSession) handleRtcpPacket(b []byte, rAddr *net.UDPAddr) err
 				session.sessionStat.AddWriteBytes(len(b))
 			}
 		default:
+			if track := session.getExtraTrackBySsrc(sr.SenderSsrc); track != nil {
+				session.mu.Lock()
+				rrBuf = track.rrProducer.Produce(sr.GetMiddleNtp())
+				session.mu.Unlock()
+				if rrBuf != nil {
+					if rAddr != nil {
+						_ = track.rtcpConn.Write2Addr(rrBuf, rAddr)
+					} else {
+						_ = session.cmdSession.WriteInterleavedPacket(rrBuf, track.rtcpChannel)
+					}
+					session.sessionStat.AddWriteBytes(len(b))
+				}
+				break
+			}
+
 			// noop
 			//
 			// ffmpeg推流时，会在发送第一个RTP包之前就发送一个SR，所以关闭这个警告日志
@@ -347,6 +591,34 @@ func (session *BaseInSession) handleRtcpPacket(b []byte, rAddr *net.UDPAddr) err
 	return nil
 }
 
+// updateAvSync 通过SR中ntp时间和rtp时间戳的对应关系，计算同一时刻音频和视频时间戳的差值，使得音频和视频对齐到同一时间轴
+//
+// 注意，调用方持有 mu
+func (session *BaseInSession) updateAvSync(isAudio bool, sr rtprtcp.Sr) {
+	clockRate := session.sdpCtx.VideoClockRate
+	if isAudio {
+		clockRate = session.sdpCtx.AudioClockRate
+	}
+	if clockRate < 1000 {
+		return
+	}
+
+	// 和unpacker中rtp时间戳转换为毫秒的方式保持一致
+	rtpMs := int64(sr.Timestamp / uint32(clockRate/1000))
+	ntpMs := int64(rtprtcp.MswLsw2UnixNano(uint64(sr.Msw), uint64(sr.Lsw)) / 1e6)
+	if isAudio {
+		session.audioSrRtpMinusNtp = rtpMs - ntpMs
+		session.hasAudioSr = true
+	} else {
+		session.videoSrRtpMinusNtp = rtpMs - ntpMs
+		session.hasVideoSr = true
+	}
+
+	if session.avPacketQueue != nil && session.hasAudioSr && session.hasVideoSr {
+		session.avPacketQueue.SetAvDelta(session.audioSrRtpMinusNtp - session.videoSrRtpMinusNtp)
+	}
+}
+
 func (session *BaseInSession) handleRtpPacket(b []byte) error {
 	session.sessionStat.AddReadBytes(len(b))
 
@@ -409,6 +681,78 @@ func (session *BaseInSession) handleRtpPacket(b []byte) error {
 	return nil
 }
 
+// handleTrackRtpPacket 处理主音频、主视频之外的其他track的rtp包
+func (session *BaseInSession) handleTrackRtpPacket(track *baseInTrack, b []byte) error {
+	session.sessionStat.AddReadBytes(len(b))
+
+	pkt, err := rtprtcp.ParseRtpPacket(b)
+	if err != nil {
+		Log.Errorf("[%s] handleTrackRtpPacket invalid rtp packet. index=%d, err=%+v", session.UniqueKey(), track.ctx.Index, err)
+		return err
+	}
+
+	track.ssrc.Store(pkt.Header.Ssrc)
+	session.mu.Lock()
+	track.rrProducer.FeedRtpPacket(pkt.Header.Seq)
+	session.mu.Unlock()
+
+	observer, _ := session.observer.(IBaseInSessionTrackObserver)
+	if observer != nil {
+		observer.OnTrackRtpPacket(track.ctx, pkt)
+	}
+
+	if track.unpacker != nil {
+		track.unpacker.Feed(pkt)
+	}
+
+	if track.ctx.IsOnvifMetadata() {
+		// 一个xml文档可能被分到多个rtp包中，最后一个包的mark位为1，见ONVIF Streaming Spec 5.2.1.1
+		track.metadataBuf = append(track.metadataBuf, pkt.Body()...)
+		if len(track.metadataBuf) > maxOnvifMetadataSize {
+			Log.Warnf("[%s] onvif metadata too large, drop it. size=%d", session.UniqueKey(), len(track.metadataBuf))
+			track.metadataBuf = track.metadataBuf[:0]
+			return nil
+		}
+		if pkt.Header.Mark == 1 {
+			if observer != nil {
+				observer.OnOnvifMetadata(track.ctx, track.metadataBuf)
+			}
+			track.metadataBuf = track.metadataBuf[:0]
+		}
+	}
+
+	return nil
+}
+
+func (session *BaseInSession) getExtraTrackByUri(uri string) *baseInTrack {
+	for _, track := range session.extraTracks {
+		if track.ctx.IsUri(uri) {
+			return track
+		}
+	}
+	return nil
+}
+
+func (session *BaseInSession) getExtraTrackBySsrc(ssrc uint32) *baseInTrack {
+	for _, track := range session.extraTracks {
+		if track.ssrc.Load() == ssrc {
+			return track
+		}
+	}
+	return nil
+}
+
+func disposeUdpConn(rtpConn, rtcpConn **nazanet.UdpConnection) {
+	if *rtpConn != nil {
+		_ = (*rtpConn).Dispose()
+		*rtpConn = nil
+	}
+	if *rtcpConn != nil {
+		_ = (*rtcpConn).Dispose()
+		*rtcpConn = nil
+	}
+}
+
 func (session *BaseInSession) dispose(err error) error {
 	var retErr error
 	session.disposeOnce.Do(func() {
@@ -427,6 +771,15 @@ func (session *BaseInSession) dispose(err error) error {
 			e4 = session.videoRtcpConn.Dispose()
 		}
 
+		for _, track := range session.extraTracks {
+			if track.rtpConn != nil {
+				_ = track.rtpConn.Dispose()
+			}
+			if track.rtcpConn != nil {
+				_ = track.rtcpConn.Dispose()
+			}
+		}
+
 		session.waitChan <- nil
 
 		retErr = nazaerrors.CombineErrors(e1, e2, e3, e4)
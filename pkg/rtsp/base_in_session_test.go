@@ -0,0 +1,130 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazanet"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+type baseInSessionTestObserver struct {
+	pkts []base.AvPacket
+}
+
+func (o *baseInSessionTestObserver) OnSdp(sdpCtx sdp.LogicContext) {}
+
+func (o *baseInSessionTestObserver) OnRtpPacket(pkt rtprtcp.RtpPacket) {}
+
+func (o *baseInSessionTestObserver) OnAvPacket(pkt base.AvPacket) {
+	o.pkts = append(o.pkts, pkt)
+}
+
+func TestBaseInSessionAvSync(t *testing.T) {
+	sdpCtx, err := sdp.ParseSdp2LogicContext([]byte(multicastTestSdp))
+	assert.Equal(t, nil, err)
+	observer := &baseInSessionTestObserver{}
+	session := NewBaseInSessionWithObserver(base.SessionTypeRtspPub, nil, observer)
+	session.InitWithSdp(sdpCtx)
+
+	// 同一ntp时刻，视频rtp时间戳对应5000毫秒，音频对应3000毫秒
+	ntpMsw := uint32(2208988800 + 1666000000)
+	session.updateAvSync(false, rtprtcp.Sr{Msw: ntpMsw, Timestamp: 90 * 5000})
+	assert.Equal(t, false, session.avPacketQueue.hasAvDelta)
+	session.updateAvSync(true, rtprtcp.Sr{Msw: ntpMsw + 1, Timestamp: 44 * 4000})
+	assert.Equal(t, true, session.avPacketQueue.hasAvDelta)
+	assert.Equal(t, int64(-2000), session.avPacketQueue.avDeltaMs)
+
+	session.onAvPacketUnpacked(base.AvPacket{PayloadType: base.AvPacketPtAvc, Timestamp: 5000})
+	session.onAvPacketUnpacked(base.AvPacket{PayloadType: base.AvPacketPtAac, Timestamp: 3100})
+	assert.Equal(t, int64(-100), session.GetStat().AvSyncOffsetMs)
+
+	// 音频比视频晚了100毫秒
+	assert.Equal(t, []base.AvPacket{
+		{PayloadType: base.AvPacketPtAvc, Timestamp: 0},
+	}, observer.pkts)
+	session.onAvPacketUnpacked(base.AvPacket{PayloadType: base.AvPacketPtAvc, Timestamp: 5200})
+	assert.Equal(t, int64(100), observer.pkts[1].Timestamp)
+}
+
+// newRtspTestUdpPeer 创建一个模拟对端的udp socket，以及本端指向该对端的连接
+//
+// @return lAddr: 本端连接的地址
+func newRtspTestUdpPeer(t *testing.T) (peer *net.UDPConn, conn *nazanet.UdpConnection, lAddr *net.UDPAddr) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.Equal(t, nil, err)
+	conn, err = nazanet.NewUdpConnection(func(option *nazanet.UdpConnectionOption) {
+		option.Conn = c
+		option.RAddr = peer.LocalAddr().String()
+	})
+	assert.Equal(t, nil, err)
+	return peer, conn, c.LocalAddr().(*net.UDPAddr)
+}
+
+func readRtspTestUdpPeer(t *testing.T, peer *net.UDPConn) []byte {
+	b := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := peer.ReadFromUDP(b)
+	assert.Equal(t, nil, err)
+	return b[:n]
+}
+
+func TestBaseInSessionNack(t *testing.T) {
+	sdpCtx, err := sdp.ParseSdp2LogicContext([]byte(multicastTestSdp))
+	assert.Equal(t, nil, err)
+	session := NewBaseInSessionWithObserver(base.SessionTypeRtspPub, nil, &baseInSessionTestObserver{})
+	session.InitWithSdp(sdpCtx)
+
+	peer, rtcpConn, _ := newRtspTestUdpPeer(t)
+	defer peer.Close()
+	session.videoRtcpConn = rtcpConn
+	defer session.Dispose()
+
+	feed := func(seq uint16) {
+		h := rtprtcp.MakeDefaultRtpHeader()
+		h.PacketType = 96
+		h.Seq = seq
+		h.Ssrc = 10
+		pkt := rtprtcp.MakeRtpPacket(h, []byte{0x41, 0x9a})
+		session.onReadRtpPacket(pkt.Raw, nil, nil)
+	}
+
+	// 3、4丢失，等待一个乱序容忍间隔后请求重传
+	for _, seq := range []uint16{1, 2, 5} {
+		feed(seq)
+	}
+	time.Sleep(50 * time.Millisecond)
+	feed(6)
+
+	_, mediaSsrc, seqs, err := rtprtcp.ParseNack(readRtspTestUdpPeer(t, peer))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint32(10), mediaSsrc)
+	assert.Equal(t, []uint16{3, 4}, seqs)
+	assert.Equal(t, uint64(2), session.GetStat().NackPacketCount)
+
+	// 短时间内的多次关键帧请求只发送一次
+	session.RequestKeyFrame()
+	session.RequestKeyFrame()
+	b := readRtspTestUdpPeer(t, peer)
+	h := rtprtcp.ParseRtcpHeader(b)
+	assert.Equal(t, uint8(rtprtcp.RtcpPacketTypePsfb), h.PacketType)
+	assert.Equal(t, uint8(rtprtcp.RtcpFormatPli), h.CountOrFormat)
+	_ = peer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = peer.ReadFromUDP(b)
+	assert.IsNotNil(t, err)
+}
@@ -39,6 +39,17 @@ type BaseOutSession struct {
 	videoRtpChannel  int
 	videoRtcpChannel int
 
+	extraTracks []*baseOutTrack // 主音频、主视频之外的其他track
+
+	// 丢包重传，只有udp模式使用，见 handleNack
+	rtpCacheMutex            sync.Mutex
+	audioRtpCache            *rtprtcp.RtpPacketCache
+	videoRtpCache            *rtprtcp.RtpPacketCache
+	nackPacketCount          nazaatomic.Uint64
+	retransmittedPacketCount nazaatomic.Uint64
+
+	onKeyFrameRequest func()
+
 	sessionStat base.BasicSessionStat
 
 	// only for debug log
@@ -52,6 +63,15 @@ type BaseOutSession struct {
 	waitChan    chan error
 }
 
+type baseOutTrack struct {
+	ctx sdp.TrackContext
+
+	rtpConn     *nazanet.UdpConnection
+	rtcpConn    *nazanet.UdpConnection
+	rtpChannel  int
+	rtcpChannel int
+}
+
 func NewBaseOutSession(sessionType base.SessionType, cmdSession IInterleavedPacketWriter) *BaseOutSession {
 	s := &BaseOutSession{
 		cmdSession:       cmdSession,
@@ -67,15 +87,33 @@ func NewBaseOutSession(sessionType base.SessionType, cmdSession IInterleavedPack
 
 func (session *BaseOutSession) InitWithSdp(sdpCtx sdp.LogicContext) {
 	session.sdpCtx = sdpCtx
+
+	for _, trackCtx := range sdpCtx.ExtraTracks() {
+		session.extraTracks = append(session.extraTracks, &baseOutTrack{
+			ctx:         trackCtx,
+			rtpChannel:  -1,
+			rtcpChannel: -1,
+		})
+	}
+}
+
+// WithOnKeyFrameRequest 对端通过rtcp PLI或FIR请求视频关键帧时回调，调用方保证在SETUP之前调用
+func (session *BaseOutSession) WithOnKeyFrameRequest(onKeyFrameRequest func()) {
+	session.onKeyFrameRequest = onKeyFrameRequest
 }
 
 func (session *BaseOutSession) SetupWithConn(uri string, rtpConn, rtcpConn *nazanet.UdpConnection) error {
 	if session.sdpCtx.IsAudioUri(uri) {
 		session.audioRtpConn = rtpConn
 		session.audioRtcpConn = rtcpConn
+		session.audioRtpCache = rtprtcp.NewRtpPacketCache(rtpPacketCacheSize)
 	} else if session.sdpCtx.IsVideoUri(uri) {
 		session.videoRtpConn = rtpConn
 		session.videoRtcpConn = rtcpConn
+		session.videoRtpCache = rtprtcp.NewRtpPacketCache(rtpPacketCacheSize)
+	} else if track := session.getExtraTrackByUri(uri); track != nil {
+		track.rtpConn = rtpConn
+		track.rtcpConn = rtcpConn
 	} else {
 		return nazaerrors.Wrap(base.ErrRtsp)
 	}
@@ -95,6 +133,10 @@ func (session *BaseOutSession) SetupWithChannel(uri string, rtpChannel, rtcpChan
 		session.videoRtpChannel = rtpChannel
 		session.videoRtcpChannel = rtcpChannel
 		return nil
+	} else if track := session.getExtraTrackByUri(uri); track != nil {
+		track.rtpChannel = rtpChannel
+		track.rtcpChannel = rtcpChannel
+		return nil
 	}
 
 	return nazaerrors.Wrap(base.ErrRtsp)
@@ -128,6 +170,7 @@ func (session *BaseOutSession) HandleInterleavedPacket(b []byte, channel int) {
 		fallthrough
 	case session.videoRtcpChannel:
 		Log.Debugf("[%s] read interleaved rtcp packet. b=%s", session.UniqueKey(), hex.Dump(nazabytes.Prefix(b, 32)))
+		session.handleRtcpPacket(b)
 	default:
 		Log.Errorf("[%s] read interleaved packet but channel invalid. channel=%d", session.UniqueKey(), channel)
 	}
@@ -146,6 +189,7 @@ func (session *BaseOutSession) WriteRtpPacket(packet rtprtcp.RtpPacket) error {
 
 		if session.audioRtpConn != nil {
 			err = session.audioRtpConn.Write(packet.Raw)
+			session.cacheRtpPacket(session.audioRtpCache, packet)
 		}
 		if session.audioRtpChannel != -1 {
 			err = session.cmdSession.WriteInterleavedPacket(packet.Raw, session.audioRtpChannel)
@@ -158,6 +202,7 @@ func (session *BaseOutSession) WriteRtpPacket(packet rtprtcp.RtpPacket) error {
 
 		if session.videoRtpConn != nil {
 			err = session.videoRtpConn.Write(packet.Raw)
+			session.cacheRtpPacket(session.videoRtpCache, packet)
 		}
 		if session.videoRtpChannel != -1 {
 			err = session.cmdSession.WriteInterleavedPacket(packet.Raw, session.videoRtpChannel)
@@ -173,10 +218,36 @@ func (session *BaseOutSession) WriteRtpPacket(packet rtprtcp.RtpPacket) error {
 	return err
 }
 
+// WriteTrackRtpPacket 发送主音频、主视频之外的其他track的rtp包，对端没有SETUP该track时直接丢弃
+//
+// @param trackIndex: 见 sdp.TrackContext.Index
+func (session *BaseOutSession) WriteTrackRtpPacket(trackIndex int, packet rtprtcp.RtpPacket) error {
+	var err error
+	for _, track := range session.extraTracks {
+		if track.ctx.Index != trackIndex {
+			continue
+		}
+		if track.rtpConn != nil {
+			err = track.rtpConn.Write(packet.Raw)
+		}
+		if track.rtpChannel != -1 {
+			err = session.cmdSession.WriteInterleavedPacket(packet.Raw, track.rtpChannel)
+		}
+		if err == nil {
+			session.sessionStat.AddWriteBytes(len(packet.Raw))
+		}
+		break
+	}
+	return err
+}
+
 // ----- ISessionStat --------------------------------------------------------------------------------------------------
 
 func (session *BaseOutSession) GetStat() base.StatSession {
-	return session.sessionStat.GetStat()
+	stat := session.sessionStat.GetStat()
+	stat.NackPacketCount = session.nackPacketCount.Load()
+	stat.RetransmittedPacketCount = session.retransmittedPacketCount.Load()
+	return stat
 }
 
 func (session *BaseOutSession) UpdateStat(intervalSec uint32) {
@@ -194,7 +265,7 @@ func (session *BaseOutSession) UniqueKey() string {
 }
 
 func (session *BaseOutSession) onReadRtpPacket(b []byte, rAddr *net.UDPAddr, err error) bool {
-	// TODO(chef): [fix] 在收到rtp和rtcp的地方，加入stat统计 202205
+	session.sessionStat.AddReadBytes(len(b))
 
 	if session.loggedReadRtpCount.Load() < int32(session.debugLogMaxCount) {
 		Log.Debugf("[%s] LOGPACKET. read rtp=%s", session.UniqueKey(), hex.Dump(nazabytes.Prefix(b, 32)))
@@ -204,15 +275,86 @@ func (session *BaseOutSession) onReadRtpPacket(b []byte, rAddr *net.UDPAddr, err
 }
 
 func (session *BaseOutSession) onReadRtcpPacket(b []byte, rAddr *net.UDPAddr, err error) bool {
-	// TODO chef: impl me
+	if err != nil {
+		Log.Warnf("[%s] read udp packet failed. err=%+v", session.UniqueKey(), err)
+		return true
+	}
+
+	session.sessionStat.AddReadBytes(len(b))
 
 	if session.loggedReadRtcpCount.Load() < int32(session.debugLogMaxCount) {
 		Log.Debugf("[%s] LOGPACKET. read rtcp=%s", session.UniqueKey(), hex.Dump(nazabytes.Prefix(b, 32)))
 		session.loggedReadRtcpCount.Increment()
 	}
+
+	session.handleRtcpPacket(b)
 	return true
 }
 
+// handleRtcpPacket 处理对端的反馈，目前只处理NACK、PLI、FIR，其他类型（比如RR）忽略
+func (session *BaseOutSession) handleRtcpPacket(b []byte) {
+	for _, pkt := range rtprtcp.SplitRtcpCompoundPacket(b) {
+		h := rtprtcp.ParseRtcpHeader(pkt)
+		switch {
+		case h.PacketType == rtprtcp.RtcpPacketTypeRtpfb && h.CountOrFormat == rtprtcp.RtcpFormatNack:
+			session.handleNack(pkt)
+		case h.PacketType == rtprtcp.RtcpPacketTypePsfb && (h.CountOrFormat == rtprtcp.RtcpFormatPli || h.CountOrFormat == rtprtcp.RtcpFormatFir):
+			if session.onKeyFrameRequest != nil {
+				session.onKeyFrameRequest()
+			}
+		}
+	}
+}
+
+// handleNack 从缓存中取出对端请求的包重传
+func (session *BaseOutSession) handleNack(b []byte) {
+	_, mediaSsrc, seqs, err := rtprtcp.ParseNack(b)
+	if err != nil {
+		Log.Warnf("[%s] invalid rtcp nack. err=%+v", session.UniqueKey(), err)
+		return
+	}
+
+	session.rtpCacheMutex.Lock()
+	defer session.rtpCacheMutex.Unlock()
+
+	var cache *rtprtcp.RtpPacketCache
+	var conn *nazanet.UdpConnection
+	if session.audioRtpCache != nil && session.audioRtpCache.Ssrc() == mediaSsrc {
+		cache, conn = session.audioRtpCache, session.audioRtpConn
+	} else if session.videoRtpCache != nil && session.videoRtpCache.Ssrc() == mediaSsrc {
+		cache, conn = session.videoRtpCache, session.videoRtpConn
+	} else {
+		return
+	}
+
+	for _, seq := range seqs {
+		raw := cache.Get(seq)
+		if raw == nil {
+			continue
+		}
+		if err := conn.Write(raw); err == nil {
+			session.sessionStat.AddWriteBytes(len(raw))
+			session.nackPacketCount.Increment()
+			session.retransmittedPacketCount.Increment()
+		}
+	}
+}
+
+func (session *BaseOutSession) cacheRtpPacket(cache *rtprtcp.RtpPacketCache, packet rtprtcp.RtpPacket) {
+	session.rtpCacheMutex.Lock()
+	cache.Put(packet)
+	session.rtpCacheMutex.Unlock()
+}
+
+func (session *BaseOutSession) getExtraTrackByUri(uri string) *baseOutTrack {
+	for _, track := range session.extraTracks {
+		if track.ctx.IsUri(uri) {
+			return track
+		}
+	}
+	return nil
+}
+
 func (session *BaseOutSession) dispose(err error) error {
 	var retErr error
 	session.disposeOnce.Do(func() {
@@ -230,6 +372,14 @@ func (session *BaseOutSession) dispose(err error) error {
 		if session.videoRtcpConn != nil {
 			e4 = session.videoRtcpConn.Dispose()
 		}
+		for _, track := range session.extraTracks {
+			if track.rtpConn != nil {
+				_ = track.rtpConn.Dispose()
+			}
+			if track.rtcpConn != nil {
+				_ = track.rtcpConn.Dispose()
+			}
+		}
 
 		session.waitChan <- nil
 
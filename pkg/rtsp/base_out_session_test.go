@@ -0,0 +1,68 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+func TestBaseOutSessionRetransmit(t *testing.T) {
+	sdpCtx, err := sdp.ParseSdp2LogicContext([]byte(multicastTestSdp))
+	assert.Equal(t, nil, err)
+	session := NewBaseOutSession(base.SessionTypeRtspSub, nil)
+	session.InitWithSdp(sdpCtx)
+
+	keyFrameRequestChan := make(chan struct{}, 1)
+	session.WithOnKeyFrameRequest(func() {
+		keyFrameRequestChan <- struct{}{}
+	})
+
+	rtpPeer, rtpConn, _ := newRtspTestUdpPeer(t)
+	defer rtpPeer.Close()
+	rtcpPeer, rtcpConn, rtcpAddr := newRtspTestUdpPeer(t)
+	defer rtcpPeer.Close()
+	assert.Equal(t, nil, session.SetupWithConn("rtsp://127.0.0.1/live/test/streamid=0", rtpConn, rtcpConn))
+	defer session.Dispose()
+
+	for seq := uint16(1); seq <= 3; seq++ {
+		h := rtprtcp.MakeDefaultRtpHeader()
+		h.PacketType = 96
+		h.Seq = seq
+		h.Ssrc = 10
+		assert.Equal(t, nil, session.WriteRtpPacket(rtprtcp.MakeRtpPacket(h, []byte{0x41, uint8(seq)})))
+		readRtspTestUdpPeer(t, rtpPeer)
+	}
+
+	// 拉流端请求重传2，以及不存在的100，同时请求关键帧
+	feedback := append(rtprtcp.PackNack(1, 10, []uint16{2, 100}), rtprtcp.PackPli(1, 10)...)
+	_, err = rtcpPeer.WriteToUDP(feedback, rtcpAddr)
+	assert.Equal(t, nil, err)
+
+	pkt, err := rtprtcp.ParseRtpPacket(readRtspTestUdpPeer(t, rtpPeer))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint16(2), pkt.Header.Seq)
+	assert.Equal(t, []byte{0x41, 2}, pkt.Body())
+
+	select {
+	case <-keyFrameRequestChan:
+	case <-time.After(time.Second):
+		t.Fatal("key frame request not received")
+	}
+	stat := session.GetStat()
+	// 100不在缓存中，没有重传，不计入
+	assert.Equal(t, uint64(1), stat.NackPacketCount)
+	assert.Equal(t, uint64(1), stat.RetransmittedPacketCount)
+}
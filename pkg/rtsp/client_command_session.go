@@ -11,8 +11,11 @@ package rtsp
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -30,8 +33,9 @@ import (
 type ClientCommandSessionType int
 
 const (
-	readBufSize                 = 256
-	writeGetParameterIntervalMs = 10000
+	readBufSize                = 256
+	keepaliveIntervalMs        = 10000 // 对端没有通过Session的timeout字段指定超时时间时，使用该保活间隔
+	udpFallbackCheckIntervalMs = 20
 )
 
 const (
@@ -42,13 +46,32 @@ const (
 type ClientCommandSessionOption struct {
 	DoTimeoutMs int
 	OverTcp     bool
+
+	// TlsConfig
+	// rtsps时使用。
+	// 业务方可以通过这个字段自定义 tls.Config ，比如开启证书校验。
+	// 如果为nil，那么内部会使用 base.DefaultTlsConfigClient 生成 tls.Config 。
+	// 如果没有设置ServerName，内部会使用url中的host作为SNI。
+	TlsConfig *tls.Config
+
+	// MaxRedirectCount 最多跟随多少次3xx重定向，为0时不跟随重定向
+	MaxRedirectCount int
+
+	// UdpFallbackTimeoutMs
+	// 只用于pull，并且 OverTcp 为false时有效。
+	// 如果大于0，那么udp模式PLAY之后，如果在该时间内没有收到rtp包（比如本端处于NAT之后），则重新建立连接，使用tcp interleaved模式拉流。
+	UdpFallbackTimeoutMs int
 }
 
 var defaultClientCommandSessionOption = ClientCommandSessionOption{
-	DoTimeoutMs: 10000,
-	OverTcp:     false,
+	DoTimeoutMs:      10000,
+	OverTcp:          false,
+	MaxRedirectCount: 3,
 }
 
+// errRedirect 对端回复了3xx重定向，重定向的地址见 ClientCommandSession.redirectUrl
+var errRedirect = errors.New("lal.rtsp: redirect")
+
 type IClientCommandSessionObserver interface {
 	OnConnectResult()
 
@@ -60,6 +83,12 @@ type IClientCommandSessionObserver interface {
 	OnSetupResult()
 
 	OnInterleavedPacket(packet []byte, channel int)
+
+	// IsRtpReceived only for PullSession，udp模式下是否收到过rtp包，见 ClientCommandSessionOption.UdpFallbackTimeoutMs
+	IsRtpReceived() bool
+
+	// OnKeepalive 和信令保活同时回调，udp模式下可以发送rtcp保活，维持NAT映射
+	OnKeepalive()
 }
 
 // ClientCommandSession Push和Pull共用，封装了客户端底层信令信令部分。
@@ -77,11 +106,14 @@ type ClientCommandSession struct {
 	cseq                        int
 	methodGetParameterSupported bool
 	auth                        Auth
+	redirectUrl                 string
+	redirectUrlWithoutUserInfo  string // 用于打印日志
 
 	sdpCtx sdp.LogicContext
 
-	sessionId string
-	channel   int
+	sessionId  string
+	timeoutSec int // 对端SETUP回复中Session的timeout字段，没有时为0
+	channel    int
 
 	disposeOnce sync.Once
 }
@@ -177,23 +209,13 @@ func (session *ClientCommandSession) doContext(ctx context.Context, rawUrl strin
 	errChan := make(chan error, 1)
 
 	go func() {
-		if err := session.connect(rawUrl); err != nil {
-			errChan <- err
-			return
-		}
-
-		if err := session.writeOptions(); err != nil {
+		if err := session.connectWithRedirect(rawUrl); err != nil {
 			errChan <- err
 			return
 		}
 
 		switch session.t {
 		case CcstPullSession:
-			if err := session.writeDescribe(); err != nil {
-				errChan <- err
-				return
-			}
-
 			if err := session.writeSetup(); err != nil {
 				errChan <- err
 				return
@@ -204,12 +226,12 @@ func (session *ClientCommandSession) doContext(ctx context.Context, rawUrl strin
 				errChan <- err
 				return
 			}
-		case CcstPushSession:
-			if err := session.writeAnnounce(); err != nil {
+
+			if err := session.fallbackTcpIfNeeded(); err != nil {
 				errChan <- err
 				return
 			}
-
+		case CcstPushSession:
 			if err := session.writeSetup(); err != nil {
 				errChan <- err
 				return
@@ -240,85 +262,143 @@ func (session *ClientCommandSession) doContext(ctx context.Context, rawUrl strin
 	return nil
 }
 
+// runReadLoop 握手完成之后，定时发送GET_PARAMETER（对端不支持时使用OPTIONS）保活，并读取对端数据
 func (session *ClientCommandSession) runReadLoop() {
 	var loopErr error
 	defer func() {
 		_ = session.dispose(loopErr)
 	}()
 
-	if !session.methodGetParameterSupported {
-		// TCP模式，需要收取数据进行处理
-		if session.option.OverTcp {
-			var r = bufio.NewReader(session.conn)
-			for {
-				isInterleaved, packet, channel, err := readInterleaved(r)
-				if err != nil {
-					loopErr = err
-					return
-				}
-				if isInterleaved {
-					session.observer.OnInterleavedPacket(packet, int(channel))
-				}
-			}
-		}
-
-		// not over tcp
-		// 接收TCP对端关闭FIN信号
-		dummy := make([]byte, 1)
-		_, err := session.conn.Read(dummy)
-		loopErr = err
-		return
-	}
-
-	// 对端支持get_parameter，需要定时向对端发送get_parameter进行保活
-
-	Log.Debugf("[%s] start get_parameter timer.", session.uniqueKey)
-	var r = bufio.NewReader(session.conn)
-	t := time.NewTicker(writeGetParameterIntervalMs * time.Millisecond)
-	defer t.Stop()
-
-	if session.option.OverTcp {
+	// 在独立的协程中读取对端数据，包括tcp模式下的rtp/rtcp包，以及保活信令的回复
+	readErrChan := make(chan error, 1)
+	go func() {
+		var r = bufio.NewReader(session.conn)
 		for {
-			select {
-			case <-t.C:
-				session.cseq++
-				if err := session.writeCmd(MethodGetParameter, session.urlCtx.RawUrlWithoutUserInfo, nil, ""); err != nil {
-					loopErr = err
-					return
-				}
-			default:
-				// noop
-			}
-
 			isInterleaved, packet, channel, err := readInterleaved(r)
 			if err != nil {
-				loopErr = err
+				readErrChan <- err
 				return
 			}
 			if isInterleaved {
 				session.observer.OnInterleavedPacket(packet, int(channel))
-			} else {
-				if _, err := nazahttp.ReadHttpResponseMessage(r); err != nil {
-					loopErr = err
-					return
-				}
+				continue
+			}
+			ctx, err := nazahttp.ReadHttpResponseMessage(r)
+			if err != nil {
+				readErrChan <- err
+				return
 			}
+			Log.Debugf("[%s] < read keepalive response. code=%s", session.uniqueKey, ctx.StatusCode)
 		}
-	}
+	}()
+
+	interval := session.keepaliveInterval()
+	Log.Debugf("[%s] start keepalive timer. interval=%v, get_parameter supported=%v",
+		session.uniqueKey, interval, session.methodGetParameterSupported)
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-	// not over tcp
 	for {
 		select {
+		case loopErr = <-readErrChan:
+			return
 		case <-t.C:
-			session.cseq++
-			if _, err := session.writeCmdReadResp(MethodGetParameter, session.urlCtx.RawUrlWithoutUserInfo, nil, ""); err != nil {
+			method := MethodOptions
+			if session.methodGetParameterSupported {
+				method = MethodGetParameter
+			}
+			if err := session.writeCmd(method, session.urlCtx.RawUrlWithoutUserInfo, nil, ""); err != nil {
 				loopErr = err
 				return
 			}
-		default:
-			// noop
+			session.observer.OnKeepalive()
+		}
+	}
+}
+
+// keepaliveInterval 对端通过Session的timeout字段指定了超时时间时，使用超时时间的一半
+func (session *ClientCommandSession) keepaliveInterval() time.Duration {
+	if session.timeoutSec > 0 {
+		return time.Duration(session.timeoutSec) * time.Second / 2
+	}
+	return keepaliveIntervalMs * time.Millisecond
+}
+
+// fallbackTcpIfNeeded udp模式PLAY之后，等待 ClientCommandSessionOption.UdpFallbackTimeoutMs ，如果没有收到rtp包，则切换为tcp interleaved模式
+//
+// 切换时关闭当前连接，在新的连接上重新OPTIONS、DESCRIBE、SETUP、PLAY，sdp沿用第一次DESCRIBE的结果
+func (session *ClientCommandSession) fallbackTcpIfNeeded() error {
+	if session.option.OverTcp || session.option.UdpFallbackTimeoutMs <= 0 {
+		return nil
+	}
+
+	deadline := time.Now().Add(time.Duration(session.option.UdpFallbackTimeoutMs) * time.Millisecond)
+	for time.Now().Before(deadline) {
+		if session.observer.IsRtpReceived() {
+			return nil
 		}
+		time.Sleep(udpFallbackCheckIntervalMs * time.Millisecond)
+	}
+	Log.Warnf("[%s] no rtp packet over udp, fallback to tcp. timeout=%d", session.uniqueKey, session.option.UdpFallbackTimeoutMs)
+
+	_ = session.writeCmd(MethodTeardown, session.urlCtx.RawUrlWithoutUserInfo, nil, "")
+	_ = session.conn.Close()
+
+	session.option.OverTcp = true
+	session.methodGetParameterSupported = false
+	session.sessionId = ""
+	session.timeoutSec = 0
+	session.channel = 0
 
+	if err := session.connect(session.rawUrl); err != nil {
+		return err
+	}
+	if err := session.writeOptions(); err != nil {
+		return err
+	}
+	headers := map[string]string{
+		HeaderAccept: HeaderAcceptApplicationSdp,
+	}
+	if _, err := session.writeCmdReadResp(MethodDescribe, session.urlCtx.RawUrlWithoutUserInfo, headers, ""); err != nil {
+		return err
+	}
+	if err := session.writeSetup(); err != nil {
+		return err
+	}
+	return session.writePlay()
+}
+
+// connectWithRedirect 建立连接，并完成SETUP之前的信令（pull为OPTIONS和DESCRIBE，push为OPTIONS和ANNOUNCE）
+//
+// 如果对端回复3xx重定向，则关闭当前连接，使用重定向后的地址重新开始，最多重定向 ClientCommandSessionOption.MaxRedirectCount 次
+func (session *ClientCommandSession) connectWithRedirect(rawUrl string) error {
+	for i := 0; ; i++ {
+		err := session.connect(rawUrl)
+		if err == nil {
+			err = session.writeOptions()
+		}
+		if err == nil {
+			switch session.t {
+			case CcstPullSession:
+				err = session.writeDescribe()
+			case CcstPushSession:
+				err = session.writeAnnounce()
+			}
+		}
+		if err != errRedirect {
+			return err
+		}
+
+		_ = session.conn.Close()
+		if i >= session.option.MaxRedirectCount {
+			return fmt.Errorf("%w. too many redirects. url=%s", base.ErrRtsp, session.redirectUrlWithoutUserInfo)
+		}
+		Log.Infof("[%s] redirect. from=%s, to=%s", session.uniqueKey, session.urlCtx.RawUrlWithoutUserInfo, session.redirectUrlWithoutUserInfo)
+
+		rawUrl = session.redirectUrl
+		session.methodGetParameterSupported = false
+		session.auth = Auth{}
+		session.sessionId = ""
 	}
 }
 
@@ -333,7 +413,20 @@ func (session *ClientCommandSession) connect(rawUrl string) (err error) {
 	Log.Debugf("[%s] > tcp connect.", session.uniqueKey)
 
 	// # 建立连接
-	conn, err := net.Dial("tcp", session.urlCtx.HostWithPort)
+	var conn net.Conn
+	if session.urlCtx.Scheme == "rtsps" {
+		tlsConfig := session.option.TlsConfig
+		if tlsConfig == nil {
+			tlsConfig = base.DefaultTlsConfigClient()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig = tlsConfig.Clone()
+			tlsConfig.ServerName = session.urlCtx.Host
+		}
+		conn, err = tls.Dial("tcp", session.urlCtx.HostWithPort, tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", session.urlCtx.HostWithPort)
+	}
 	if err != nil {
 		return err
 	}
@@ -434,6 +527,15 @@ func (session *ClientCommandSession) writeSetup() error {
 			return err
 		}
 	}
+	// 其他track，比如第二路音频、ONVIF元数据。注意，这些track失败时不影响主音频、主视频
+	for _, track := range session.sdpCtx.ExtraTracks() {
+		if track.AControl == "" {
+			continue
+		}
+		if err := setup(track.MakeSetupUri(session.urlCtx.RawUrlWithoutUserInfo)); err != nil {
+			Log.Warnf("[%s] setup extra track failed. index=%d, err=%+v", session.uniqueKey, track.Index, err)
+		}
+	}
 	return nil
 }
 
@@ -464,7 +566,7 @@ func (session *ClientCommandSession) writeOneSetup(setupUri string) error {
 		return err
 	}
 
-	session.sessionId = strings.Split(ctx.Headers.Get(HeaderSession), ";")[0]
+	session.sessionId, session.timeoutSec = parseSession(ctx.Headers.Get(HeaderSession))
 
 	rRtpPort, rRtcpPort, err := parseServerPort(ctx.Headers.Get(HeaderTransport))
 	var rtpRAddr, rtcpRAddr string
@@ -539,7 +641,7 @@ func (session *ClientCommandSession) writeOneSetupTcp(setupUri string) error {
 		return err
 	}
 
-	session.sessionId = strings.Split(ctx.Headers.Get(HeaderSession), ";")[0]
+	session.sessionId, session.timeoutSec = parseSession(ctx.Headers.Get(HeaderSession))
 
 	// TODO chef: 这里没有解析回传的channel id了，因为我假定了它和request中的是一致的
 	session.observer.OnSetupWithChannel(setupUri, rtpChannel, rtcpChannel)
@@ -605,6 +707,10 @@ func (session *ClientCommandSession) writeCmdReadResp(method, uri string, header
 		Log.Debugf("[%s] < read response. version=%s, code=%s, reason=%s, headers=%+v, body=%s",
 			session.uniqueKey, ctx.Version, ctx.StatusCode, ctx.Reason, ctx.Headers, string(ctx.Body))
 
+		if isRedirectStatusCode(ctx.StatusCode) {
+			return ctx, session.handleRedirect(ctx.Headers.Get(HeaderLocation))
+		}
+
 		if ctx.StatusCode != "401" {
 			return
 		}
@@ -616,6 +722,43 @@ func (session *ClientCommandSession) writeCmdReadResp(method, uri string, header
 	return
 }
 
+// handleRedirect 解析Location，结果存入 redirectUrl
+//
+// Location可能是相对地址。如果重定向前后host相同，则沿用原url中的用户名和密码。
+// 不允许从rtsps重定向到非加密的地址。
+func (session *ClientCommandSession) handleRedirect(location string) error {
+	if location == "" {
+		return fmt.Errorf("%w. redirect without location. url=%s", base.ErrRtsp, session.urlCtx.RawUrlWithoutUserInfo)
+	}
+	cur, err := url.Parse(session.urlCtx.Url)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	next := cur.ResolveReference(ref)
+	if cur.Scheme == "rtsps" && next.Scheme != "rtsps" {
+		return fmt.Errorf("%w. redirect from rtsps to %s is not allowed. url=%s", base.ErrRtsp, next.Scheme, session.urlCtx.RawUrlWithoutUserInfo)
+	}
+	if next.User == nil && next.Host == cur.Host {
+		next.User = cur.User
+	}
+	session.redirectUrl = next.String()
+	next.User = nil
+	session.redirectUrlWithoutUserInfo = next.String()
+	return errRedirect
+}
+
+func isRedirectStatusCode(code string) bool {
+	switch code {
+	case "301", "302", "303", "305", "307", "308":
+		return true
+	}
+	return false
+}
+
 func (session *ClientCommandSession) dispose(err error) error {
 	var retErr error
 	session.disposeOnce.Do(func() {
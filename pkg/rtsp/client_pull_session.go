@@ -9,6 +9,7 @@
 package rtsp
 
 import (
+	"crypto/tls"
 	"sync"
 
 	"github.com/q191201771/naza/pkg/nazaerrors"
@@ -27,11 +28,24 @@ type PullSessionOption struct {
 	PullTimeoutMs int
 
 	OverTcp bool // 是否使用interleaved模式，也即是否通过rtsp command tcp连接传输rtp/rtcp数据
+
+	// TlsConfig rtsps时使用，见 ClientCommandSessionOption.TlsConfig
+	TlsConfig *tls.Config
+
+	// MaxRedirectCount 最多跟随多少次3xx重定向，为0时不跟随重定向
+	MaxRedirectCount int
+
+	// UdpFallbackTimeoutMs
+	// OverTcp 为false时有效。
+	// 如果大于0，那么先尝试udp模式，PLAY之后如果在该时间内没有收到rtp包，则自动切换为tcp interleaved模式。
+	// 如果为0，则不切换。
+	UdpFallbackTimeoutMs int
 }
 
 var defaultPullSessionOption = PullSessionOption{
-	PullTimeoutMs: 10000,
-	OverTcp:       false,
+	PullTimeoutMs:    10000,
+	OverTcp:          false,
+	MaxRedirectCount: 3,
 }
 
 type PullSession struct {
@@ -62,6 +76,9 @@ func NewPullSession(observer IPullSessionObserver, modOptions ...ModPullSessionO
 	cmdSession := NewClientCommandSession(CcstPullSession, baseInSession.UniqueKey(), s, func(opt *ClientCommandSessionOption) {
 		opt.DoTimeoutMs = option.PullTimeoutMs
 		opt.OverTcp = option.OverTcp
+		opt.TlsConfig = option.TlsConfig
+		opt.MaxRedirectCount = option.MaxRedirectCount
+		opt.UdpFallbackTimeoutMs = option.UdpFallbackTimeoutMs
 	})
 	s.baseInSession = baseInSession
 	s.cmdSession = cmdSession
@@ -131,6 +148,11 @@ func (session *PullSession) GetSdp() sdp.LogicContext {
 	return session.baseInSession.GetSdp()
 }
 
+// RequestKeyFrame 文档请参考： BaseInSession.RequestKeyFrame
+func (session *PullSession) RequestKeyFrame() {
+	session.baseInSession.RequestKeyFrame()
+}
+
 // ---------------------------------------------------------------------------------------------------------------------
 // IClientSessionLifecycle interface
 // ---------------------------------------------------------------------------------------------------------------------
@@ -148,6 +170,8 @@ func (session *PullSession) WaitChan() <-chan error {
 // ---------------------------------------------------------------------------------------------------------------------
 
 // Url 文档请参考： interface ISessionUrlContext
+//
+// 注意，如果发生了重定向，返回的是重定向后的地址
 func (session *PullSession) Url() string {
 	return session.cmdSession.Url()
 }
@@ -224,6 +248,16 @@ func (session *PullSession) OnInterleavedPacket(packet []byte, channel int) {
 	session.baseInSession.HandleInterleavedPacket(packet, channel)
 }
 
+// IsRtpReceived IClientCommandSessionObserver, callback by ClientCommandSession
+func (session *PullSession) IsRtpReceived() bool {
+	return session.baseInSession.IsRtpReceived()
+}
+
+// OnKeepalive IClientCommandSessionObserver, callback by ClientCommandSession
+func (session *PullSession) OnKeepalive() {
+	session.baseInSession.WriteRtcpKeepalive()
+}
+
 // WriteInterleavedPacket IInterleavedPacketWriter, callback by BaseInSession
 func (session *PullSession) WriteInterleavedPacket(packet []byte, channel int) error {
 	return session.cmdSession.WriteInterleavedPacket(packet, channel)
@@ -9,6 +9,7 @@
 package rtsp
 
 import (
+	"crypto/tls"
 	"sync"
 
 	"github.com/ysjhlnu/lal/pkg/base"
@@ -21,11 +22,18 @@ import (
 type PushSessionOption struct {
 	PushTimeoutMs int
 	OverTcp       bool
+
+	// TlsConfig rtsps时使用，见 ClientCommandSessionOption.TlsConfig
+	TlsConfig *tls.Config
+
+	// MaxRedirectCount 最多跟随多少次3xx重定向，为0时不跟随重定向
+	MaxRedirectCount int
 }
 
 var defaultPushSessionOption = PushSessionOption{
-	PushTimeoutMs: 10000,
-	OverTcp:       false,
+	PushTimeoutMs:    10000,
+	OverTcp:          false,
+	MaxRedirectCount: 3,
 }
 
 type PushSession struct {
@@ -51,6 +59,8 @@ func NewPushSession(modOptions ...ModPushSessionOption) *PushSession {
 	cmdSession := NewClientCommandSession(CcstPushSession, baseOutSession.UniqueKey(), s, func(opt *ClientCommandSessionOption) {
 		opt.DoTimeoutMs = option.PushTimeoutMs
 		opt.OverTcp = option.OverTcp
+		opt.TlsConfig = option.TlsConfig
+		opt.MaxRedirectCount = option.MaxRedirectCount
 	})
 	s.cmdSession = cmdSession
 	s.baseOutSession = baseOutSession
@@ -206,6 +216,17 @@ func (session *PushSession) OnInterleavedPacket(packet []byte, channel int) {
 	session.baseOutSession.HandleInterleavedPacket(packet, channel)
 }
 
+// IsRtpReceived IClientCommandSessionObserver, callback by ClientCommandSession
+func (session *PushSession) IsRtpReceived() bool {
+	// noop
+	return false
+}
+
+// OnKeepalive IClientCommandSessionObserver, callback by ClientCommandSession
+func (session *PushSession) OnKeepalive() {
+	// noop
+}
+
 // WriteInterleavedPacket IInterleavedPacketWriter, callback by BaseOutSession
 func (session *PushSession) WriteInterleavedPacket(packet []byte, channel int) error {
 	return session.cmdSession.WriteInterleavedPacket(packet, channel)
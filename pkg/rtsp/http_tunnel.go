@@ -0,0 +1,244 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RTSP over HTTP，见 Apple <Tunnelling RTSP and RTP through HTTP>
+//
+// 客户端先发送GET请求，该连接用于接收rtsp信令的响应，以及interleaved模式的rtp、rtcp数据，
+// 然后再发送POST请求，rtsp信令经过base64编码后，通过POST的body持续发送。
+// GET和POST通过`x-sessioncookie`关联，POST可以关闭后重新建立。
+
+const (
+	HeaderSessionCookie            = "x-sessioncookie"
+	HeaderContentTypeRtspTunnelled = "application/x-rtsp-tunnelled"
+)
+
+var responseHttpTunnelGet = "HTTP/1.0 200 OK\r\n" +
+	"Server: " + base.LalRtspOptionsResponseServer + "\r\n" +
+	"Connection: close\r\n" +
+	"Cache-Control: no-store\r\n" +
+	"Pragma: no-cache\r\n" +
+	"Content-Type: " + HeaderContentTypeRtspTunnelled + "\r\n" +
+	"\r\n"
+
+// IsHttpTunnelRequest 是否为RTSP over HTTP的请求
+func IsHttpTunnelRequest(req *http.Request) bool {
+	return req.Header.Get(HeaderSessionCookie) != ""
+}
+
+// ServeHttpTunnel 供http服务回调，函数签名和 base.Handler 一致
+func (s *Server) ServeHttpTunnel(writer http.ResponseWriter, req *http.Request) {
+	cookie := req.Header.Get(HeaderSessionCookie)
+	if cookie == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		s.handleHttpTunnelGet(writer, cookie)
+	case http.MethodPost:
+		s.handleHttpTunnelPost(writer, cookie)
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func (s *Server) handleHttpTunnelGet(writer http.ResponseWriter, cookie string) {
+	s.tunnelMutex.Lock()
+	if _, ok := s.cookie2Tunnel[cookie]; ok {
+		s.tunnelMutex.Unlock()
+		Log.Warnf("http tunnel cookie already exist. cookie=%s", cookie)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// 先占位，避免并发的GET使用相同的cookie
+	s.cookie2Tunnel[cookie] = nil
+	s.tunnelMutex.Unlock()
+
+	defer func() {
+		s.tunnelMutex.Lock()
+		delete(s.cookie2Tunnel, cookie)
+		s.tunnelMutex.Unlock()
+	}()
+
+	conn, bio, err := writer.(http.Hijacker).Hijack()
+	if err != nil {
+		Log.Errorf("hijack failed. err=%+v", err)
+		return
+	}
+	if _, err = conn.Write([]byte(responseHttpTunnelGet)); err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	tunnel := newHttpTunnelConn(conn)
+	s.tunnelMutex.Lock()
+	s.cookie2Tunnel[cookie] = tunnel
+	s.tunnelMutex.Unlock()
+	Log.Infof("new http tunnel. cookie=%s, raddr=%s", cookie, conn.RemoteAddr().String())
+
+	// GET连接上不会再收到数据，读取只是为了检测连接是否断开
+	go func() {
+		_, _ = io.Copy(io.Discard, bio.Reader)
+		_ = tunnel.Close()
+	}()
+
+	s.handleTcpConnect(tunnel)
+	_ = tunnel.Close()
+}
+
+func (s *Server) handleHttpTunnelPost(writer http.ResponseWriter, cookie string) {
+	s.tunnelMutex.Lock()
+	tunnel := s.cookie2Tunnel[cookie]
+	s.tunnelMutex.Unlock()
+	if tunnel == nil {
+		Log.Warnf("http tunnel not found. cookie=%s", cookie)
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, bio, err := writer.(http.Hijacker).Hijack()
+	if err != nil {
+		Log.Errorf("hijack failed. err=%+v", err)
+		return
+	}
+	// 注意，POST不需要回复
+	err = tunnel.feedPost(bio.Reader)
+	Log.Debugf("http tunnel post done. cookie=%s, err=%v", cookie, err)
+	_ = conn.Close()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// httpTunnelConn 将GET和POST两个连接合成一个 net.Conn ，从而复用 ServerCommandSession 的逻辑
+type httpTunnelConn struct {
+	getConn net.Conn
+	pr      *io.PipeReader
+	pw      *io.PipeWriter
+
+	closeOnce sync.Once
+}
+
+func newHttpTunnelConn(getConn net.Conn) *httpTunnelConn {
+	pr, pw := io.Pipe()
+	return &httpTunnelConn{
+		getConn: getConn,
+		pr:      pr,
+		pw:      pw,
+	}
+}
+
+// feedPost 读取POST的body，base64解码后写入
+func (c *httpTunnelConn) feedPost(r *bufio.Reader) error {
+	var decoder httpTunnelDecoder
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			out, dErr := decoder.Feed(buf[:n])
+			if dErr != nil {
+				return dErr
+			}
+			if len(out) > 0 {
+				if _, wErr := c.pw.Write(out); wErr != nil {
+					return wErr
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *httpTunnelConn) Read(b []byte) (int, error) {
+	return c.pr.Read(b)
+}
+
+func (c *httpTunnelConn) Write(b []byte) (int, error) {
+	return c.getConn.Write(b)
+}
+
+func (c *httpTunnelConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		_ = c.pw.Close()
+		err = c.getConn.Close()
+	})
+	return err
+}
+
+func (c *httpTunnelConn) LocalAddr() net.Addr {
+	return c.getConn.LocalAddr()
+}
+
+func (c *httpTunnelConn) RemoteAddr() net.Addr {
+	return c.getConn.RemoteAddr()
+}
+
+// SetDeadline 注意，读超时不支持
+func (c *httpTunnelConn) SetDeadline(t time.Time) error {
+	return c.getConn.SetWriteDeadline(t)
+}
+
+func (c *httpTunnelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *httpTunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.getConn.SetWriteDeadline(t)
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// httpTunnelDecoder POST body的base64流式解码
+//
+// 每个rtsp信令单独编码，所以body是多段带padding的base64拼接而成，并且一段可能被拆分在多次读取中
+type httpTunnelDecoder struct {
+	pending []byte
+}
+
+func (d *httpTunnelDecoder) Feed(b []byte) ([]byte, error) {
+	for _, c := range b {
+		switch c {
+		case '\r', '\n', ' ', '\t':
+			continue
+		}
+		d.pending = append(d.pending, c)
+	}
+
+	// 以4个字符为单位解码，剩余的留到下次
+	n := len(d.pending) / 4 * 4
+	out := make([]byte, 0, n/4*3)
+	var quantum [3]byte
+	for i := 0; i < n; i += 4 {
+		m, err := base64.StdEncoding.Decode(quantum[:], d.pending[i:i+4])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, quantum[:m]...)
+	}
+	d.pending = append(d.pending[:0], d.pending[n:]...)
+	return out, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+
+	"github.com/q191201771/naza/pkg/assert"
+)
+
+type tunnelServerObserver struct{}
+
+func (o *tunnelServerObserver) OnNewRtspSessionConnect(session *rtsp.ServerCommandSession) {}
+func (o *tunnelServerObserver) OnDelRtspSession(session *rtsp.ServerCommandSession)        {}
+func (o *tunnelServerObserver) OnNewRtspPubSession(session *rtsp.PubSession) error         { return nil }
+func (o *tunnelServerObserver) OnDelRtspPubSession(session *rtsp.PubSession)               {}
+func (o *tunnelServerObserver) OnNewRtspSubSessionDescribe(session *rtsp.SubSession) (bool, []byte) {
+	return false, nil
+}
+func (o *tunnelServerObserver) OnNewRtspSubSessionPlay(session *rtsp.SubSession) error { return nil }
+func (o *tunnelServerObserver) OnDelRtspSubSession(session *rtsp.SubSession)           {}
+
+func TestHttpTunnel(t *testing.T) {
+	s := rtsp.NewServer("", &tunnelServerObserver{}, rtsp.ServerAuthConfig{})
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeHttpTunnel))
+	defer hs.Close()
+	addr := strings.TrimPrefix(hs.URL, "http://")
+
+	// POST先于GET时，找不到对应的GET
+	resp, err := http.Post(hs.URL+"/live/test", rtsp.HeaderContentTypeRtspTunnelled, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	getConn, err := net.Dial("tcp", addr)
+	assert.Equal(t, nil, err)
+	defer getConn.Close()
+	_, err = getConn.Write([]byte("GET /live/test HTTP/1.0\r\n" +
+		"x-sessioncookie: abc\r\n" +
+		"Accept: application/x-rtsp-tunnelled\r\n\r\n"))
+	assert.Equal(t, nil, err)
+	r := bufio.NewReader(getConn)
+	getResp, err := http.ReadResponse(r, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, getResp.StatusCode)
+	assert.Equal(t, rtsp.HeaderContentTypeRtspTunnelled, getResp.Header.Get("Content-Type"))
+
+	postConn, err := net.Dial("tcp", addr)
+	assert.Equal(t, nil, err)
+	defer postConn.Close()
+	_, err = postConn.Write([]byte("POST /live/test HTTP/1.0\r\n" +
+		"x-sessioncookie: abc\r\n" +
+		"Content-Type: application/x-rtsp-tunnelled\r\n" +
+		"Content-Length: 32767\r\n\r\n"))
+	assert.Equal(t, nil, err)
+
+	// 信令单独编码，并且拆分成多次发送
+	body := base64.StdEncoding.EncodeToString([]byte("OPTIONS rtsp://127.0.0.1/live/test RTSP/1.0\r\nCSeq: 1\r\n\r\n"))
+	_, err = postConn.Write([]byte(body[:5]))
+	assert.Equal(t, nil, err)
+	_, err = postConn.Write([]byte(body[5:]))
+	assert.Equal(t, nil, err)
+
+	expected := rtsp.PackResponseOptions("1")
+	b := make([]byte, len(expected))
+	_, err = io.ReadFull(r, b)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, expected, string(b))
+}
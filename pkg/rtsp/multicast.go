@@ -0,0 +1,304 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+// RTSP UDP组播输出
+//
+// 每路流（按流名称区分）从配置的地址范围中分配一个组播地址，sdp中的第i个媒体描述使用`port+2*i`和`port+2*i+1`作为rtp、rtcp端口。
+// 同一路流的所有组播拉流者共享一个发送者，数据只发送一份。
+//
+// 开启组播后，客户端在SETUP的Transport中选择multicast，组播地址和端口通过SETUP响应返回，不影响单播UDP、TCP的客户端。
+// 对于只根据sdp接收组播的客户端，DESCRIBE的url可以携带`multicast`参数（比如 rtsp://127.0.0.1/live/test?multicast=1），
+// 此时DESCRIBE响应的sdp中的`c=`和`m=`会修改为组播地址和端口。
+//
+// 主音频、主视频之外的其他track（比如ONVIF元数据），见 multicastOutput.writeTrackRtpPacket 。
+
+type MulticastConfig struct {
+	Enable    bool   `json:"enable"`
+	AddrBegin string `json:"addr_begin"` // 组播地址范围，包含首尾，比如239.0.0.1
+	AddrEnd   string `json:"addr_end"`
+	Port      int    `json:"port"` // sdp中第一个媒体描述使用的rtp端口，必须为偶数
+	Ttl       int    `json:"ttl"`
+}
+
+// MulticastManager 管理组播地址的分配，可以被多个 Server 共享
+type MulticastManager struct {
+	config    MulticastConfig
+	addrBegin uint32
+	addrEnd   uint32
+
+	mutex         sync.Mutex
+	stream2Output map[string]*multicastOutput
+	usedAddrs     map[uint32]struct{}
+}
+
+func NewMulticastManager(config MulticastConfig) (*MulticastManager, error) {
+	begin := net.ParseIP(config.AddrBegin).To4()
+	end := net.ParseIP(config.AddrEnd).To4()
+	if begin == nil || end == nil || !begin.IsMulticast() || !end.IsMulticast() {
+		return nil, fmt.Errorf("%w. invalid multicast addr range, begin=%s, end=%s", base.ErrRtsp, config.AddrBegin, config.AddrEnd)
+	}
+	if config.Port <= 0 || config.Port%2 != 0 || config.Port > 65534 {
+		return nil, fmt.Errorf("%w. invalid multicast port, port=%d", base.ErrRtsp, config.Port)
+	}
+	if config.Ttl <= 0 || config.Ttl > 255 {
+		return nil, fmt.Errorf("%w. invalid multicast ttl, ttl=%d", base.ErrRtsp, config.Ttl)
+	}
+
+	m := &MulticastManager{
+		config:        config,
+		addrBegin:     binary.BigEndian.Uint32(begin),
+		addrEnd:       binary.BigEndian.Uint32(end),
+		stream2Output: make(map[string]*multicastOutput),
+		usedAddrs:     make(map[uint32]struct{}),
+	}
+	if m.addrBegin > m.addrEnd {
+		return nil, fmt.Errorf("%w. invalid multicast addr range, begin=%s, end=%s", base.ErrRtsp, config.AddrBegin, config.AddrEnd)
+	}
+	return m, nil
+}
+
+// acquire 获取流对应的组播发送者，不存在时创建，每次调用都需要对应调用一次 release
+func (m *MulticastManager) acquire(streamName string, sdpCtx sdp.LogicContext) (*multicastOutput, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if output, ok := m.stream2Output[streamName]; ok {
+		output.refCount++
+		return output, nil
+	}
+
+	var addr uint32
+	for addr = m.addrBegin; ; addr++ {
+		if _, ok := m.usedAddrs[addr]; !ok {
+			break
+		}
+		if addr == m.addrEnd {
+			return nil, fmt.Errorf("%w. multicast addr exhausted", base.ErrRtsp)
+		}
+	}
+	if m.config.Port+2*len(sdpCtx.Tracks) > 65536 {
+		return nil, fmt.Errorf("%w. multicast port out of range, port=%d, tracks=%d", base.ErrRtsp, m.config.Port, len(sdpCtx.Tracks))
+	}
+
+	output, err := newMulticastOutput(streamName, uint32ToIp(addr), m.config.Port, m.config.Ttl, sdpCtx)
+	if err != nil {
+		return nil, err
+	}
+	output.refCount = 1
+	m.usedAddrs[addr] = struct{}{}
+	m.stream2Output[streamName] = output
+	Log.Infof("new multicast output. stream=%s, addr=%s, port=%d, ttl=%d", streamName, output.addr, output.port, output.ttl)
+	return output, nil
+}
+
+func (m *MulticastManager) release(output *multicastOutput) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	output.refCount--
+	if output.refCount > 0 {
+		return
+	}
+	Log.Infof("dispose multicast output. stream=%s, addr=%s", output.streamName, output.addr)
+	delete(m.stream2Output, output.streamName)
+	delete(m.usedAddrs, binary.BigEndian.Uint32(net.ParseIP(output.addr).To4()))
+	output.dispose()
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// multicastOutput 一路流的组播发送者
+//
+// 只有一个拉流者（owner）负责发送数据，owner关闭时由其他拉流者接替，从而复用 Group 中对 SubSession 的发送逻辑（比如等待关键帧）
+type multicastOutput struct {
+	streamName string
+	addr       string
+	port       int
+	ttl        int
+	sdpCtx     sdp.LogicContext
+
+	audioIndex int // 主音频在sdp中的序号，-1表示不存在
+	videoIndex int
+
+	refCount int // 由 MulticastManager 的锁保护
+
+	conn *net.UDPConn
+
+	mutex   sync.Mutex
+	dsts    map[int]*net.UDPAddr // key为track在sdp中的序号，只有SETUP过的track才发送
+	players []*SubSession
+}
+
+func newMulticastOutput(streamName, addr string, port, ttl int, sdpCtx sdp.LogicContext) (*multicastOutput, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err = setMulticastTtl(conn, ttl); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	o := &multicastOutput{
+		streamName: streamName,
+		addr:       addr,
+		port:       port,
+		ttl:        ttl,
+		sdpCtx:     sdpCtx,
+		audioIndex: -1,
+		videoIndex: -1,
+		conn:       conn,
+		dsts:       make(map[int]*net.UDPAddr),
+	}
+	for _, track := range sdpCtx.Tracks {
+		if track.Media == sdp.MediaTypeAudio && o.audioIndex == -1 {
+			o.audioIndex = track.Index
+		} else if track.Media == sdp.MediaTypeVideo && o.videoIndex == -1 {
+			o.videoIndex = track.Index
+		}
+	}
+	return o, nil
+}
+
+// setup 开启uri对应的track的发送
+//
+// @return 该track使用的rtp、rtcp端口
+func (o *multicastOutput) setup(uri string) (rtpPort, rtcpPort int, err error) {
+	index := -1
+	if o.sdpCtx.IsAudioUri(uri) {
+		index = o.audioIndex
+	} else if o.sdpCtx.IsVideoUri(uri) {
+		index = o.videoIndex
+	} else if track, ok := o.sdpCtx.GetExtraTrackByUri(uri); ok {
+		index = track.Index
+	}
+	if index == -1 {
+		return 0, 0, nazaerrors.Wrap(base.ErrRtsp)
+	}
+
+	rtpPort, rtcpPort = o.trackPort(index)
+	o.mutex.Lock()
+	o.dsts[index] = &net.UDPAddr{IP: net.ParseIP(o.addr), Port: rtpPort}
+	o.mutex.Unlock()
+	return
+}
+
+func (o *multicastOutput) addPlayer(session *SubSession) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.players = append(o.players, session)
+}
+
+func (o *multicastOutput) delPlayer(session *SubSession) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for i, s := range o.players {
+		if s == session {
+			o.players = append(o.players[:i], o.players[i+1:]...)
+			break
+		}
+	}
+}
+
+// writeRtpPacket 发送主音频、主视频
+func (o *multicastOutput) writeRtpPacket(session *SubSession, packet rtprtcp.RtpPacket) {
+	t := int(packet.Header.PacketType)
+	if o.sdpCtx.IsAudioPayloadTypeOrigin(t) {
+		o.writeTrackRtpPacket(session, o.audioIndex, packet)
+	} else if o.sdpCtx.IsVideoPayloadTypeOrigin(t) {
+		o.writeTrackRtpPacket(session, o.videoIndex, packet)
+	}
+}
+
+// writeTrackRtpPacket 发送`index`对应的track，主音频、主视频之外的其他track通过 SubSession.WriteTrackRtpPacket 直接调用
+func (o *multicastOutput) writeTrackRtpPacket(session *SubSession, index int, packet rtprtcp.RtpPacket) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// 第一个开始播放的拉流者负责发送
+	if len(o.players) == 0 || o.players[0] != session {
+		return
+	}
+	dst, ok := o.dsts[index]
+	if !ok {
+		return
+	}
+	if _, err := o.conn.WriteToUDP(packet.Raw, dst); err != nil {
+		Log.Warnf("write multicast rtp failed. stream=%s, dst=%s, err=%+v", o.streamName, dst.String(), err)
+	}
+}
+
+func (o *multicastOutput) trackPort(index int) (rtpPort, rtcpPort int) {
+	rtpPort = o.port + 2*index
+	return rtpPort, rtpPort + 1
+}
+
+// rewriteSdp 将sdp中的连接地址和端口修改为组播地址和端口
+func (o *multicastOutput) rewriteSdp(rawSdp []byte) []byte {
+	lines := strings.Split(strings.TrimRight(string(rawSdp), "\r\n"), "\n")
+	out := make([]string, 0, len(lines)+len(o.sdpCtx.Tracks))
+	index := 0
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "c=") {
+			continue
+		}
+		if strings.HasPrefix(line, "m=") {
+			// e.g. m=video 0 RTP/AVP 96
+			items := strings.Split(line, " ")
+			if len(items) > 1 {
+				rtpPort, _ := o.trackPort(index)
+				items[1] = strconv.Itoa(rtpPort)
+			}
+			out = append(out, strings.Join(items, " "))
+			out = append(out, fmt.Sprintf("c=IN IP4 %s/%d", o.addr, o.ttl))
+			index++
+			continue
+		}
+		out = append(out, line)
+	}
+	return []byte(strings.Join(out, "\r\n") + "\r\n")
+}
+
+func (o *multicastOutput) dispose() {
+	_ = o.conn.Close()
+}
+
+// isMulticastSdpRequested DESCRIBE的url参数中是否携带了`multicast`，携带时sdp中使用组播地址和端口
+func isMulticastSdpRequested(rawQuery string) bool {
+	values, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return false
+	}
+	v, ok := values["multicast"]
+	return ok && (len(v) == 0 || (v[0] != "0" && v[0] != "false"))
+}
+
+func uint32ToIp(v uint32) string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip.String()
+}
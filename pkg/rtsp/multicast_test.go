@@ -0,0 +1,180 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+	"github.com/ysjhlnu/lal/pkg/sdp"
+)
+
+var multicastTestSdp = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=No Name\r\n" +
+	"c=IN IP4 127.0.0.1\r\n" +
+	"t=0 0\r\n" +
+	"a=tool:libavformat 57.83.100\r\n" +
+	"m=video 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 H264/90000\r\n" +
+	"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z2QAIKzZQMApsBEAAAMAAQAAAwAyDxgxlg==,aOvssiw=; profile-level-id=640020\r\n" +
+	"a=control:streamid=0\r\n" +
+	"m=audio 0 RTP/AVP 97\r\n" +
+	"b=AS:128\r\n" +
+	"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+	"a=fmtp:97 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=1210\r\n" +
+	"a=control:streamid=1\r\n"
+
+func TestMulticast(t *testing.T) {
+	_, err := NewMulticastManager(MulticastConfig{AddrBegin: "192.168.0.1", AddrEnd: "192.168.0.2", Port: 40000, Ttl: 16})
+	assert.IsNotNil(t, err)
+	_, err = NewMulticastManager(MulticastConfig{AddrBegin: "239.0.0.1", AddrEnd: "239.0.0.2", Port: 40001, Ttl: 16})
+	assert.IsNotNil(t, err)
+
+	m, err := NewMulticastManager(MulticastConfig{AddrBegin: "239.0.0.1", AddrEnd: "239.0.0.2", Port: 40000, Ttl: 16})
+	assert.Equal(t, nil, err)
+
+	sdpCtx, err := sdp.ParseSdp2LogicContext([]byte(multicastTestSdp))
+	assert.Equal(t, nil, err)
+
+	// 同一路流共享，不同流分配不同的地址，地址用完后分配失败
+	o1, err := m.acquire("test1", sdpCtx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "239.0.0.1", o1.addr)
+	o2, err := m.acquire("test1", sdpCtx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, o1, o2)
+	o3, err := m.acquire("test2", sdpCtx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "239.0.0.2", o3.addr)
+	_, err = m.acquire("test3", sdpCtx)
+	assert.IsNotNil(t, err)
+	m.release(o3)
+	o3, err = m.acquire("test3", sdpCtx)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "239.0.0.2", o3.addr)
+
+	expectedSdp := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=No Name\r\n" +
+		"t=0 0\r\n" +
+		"a=tool:libavformat 57.83.100\r\n" +
+		"m=video 40000 RTP/AVP 96\r\n" +
+		"c=IN IP4 239.0.0.1/16\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=Z2QAIKzZQMApsBEAAAMAAQAAAwAyDxgxlg==,aOvssiw=; profile-level-id=640020\r\n" +
+		"a=control:streamid=0\r\n" +
+		"m=audio 40002 RTP/AVP 97\r\n" +
+		"c=IN IP4 239.0.0.1/16\r\n" +
+		"b=AS:128\r\n" +
+		"a=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+		"a=fmtp:97 profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3; config=1210\r\n" +
+		"a=control:streamid=1\r\n"
+	assert.Equal(t, expectedSdp, string(o1.rewriteSdp([]byte(multicastTestSdp))))
+
+	rtpPort, rtcpPort, err := o1.setup("rtsp://127.0.0.1/live/test1/streamid=1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 40002, rtpPort)
+	assert.Equal(t, 40003, rtcpPort)
+	_, _, err = o1.setup("rtsp://127.0.0.1/live/test1/streamid=9")
+	assert.IsNotNil(t, err)
+
+	// 只有第一个开始播放的拉流者发送数据，为了测试，将目的地址改为本地的单播地址
+	lconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, nil, err)
+	defer lconn.Close()
+	o1.dsts[sdpCtx.Tracks[1].Index] = lconn.LocalAddr().(*net.UDPAddr)
+
+	s1 := &SubSession{}
+	s2 := &SubSession{}
+	o1.addPlayer(s1)
+	o1.addPlayer(s2)
+	pkt := makeMulticastTestRtpPacket(97, 1)
+	o1.writeRtpPacket(s2, pkt)
+	o1.writeRtpPacket(s1, pkt)
+	o1.delPlayer(s1)
+	o1.writeRtpPacket(s2, makeMulticastTestRtpPacket(97, 2))
+	// 视频没有SETUP，不发送
+	o1.writeRtpPacket(s2, makeMulticastTestRtpPacket(96, 3))
+
+	buf := make([]byte, 1500)
+	for _, seq := range []uint16{1, 2} {
+		_ = lconn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := lconn.ReadFromUDP(buf)
+		assert.Equal(t, nil, err)
+		h, err := rtprtcp.ParseRtpHeader(buf[:n])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, seq, h.Seq)
+	}
+	_ = lconn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = lconn.ReadFromUDP(buf)
+	assert.IsNotNil(t, err)
+
+	m.release(o1)
+	m.release(o2)
+	m.release(o3)
+	assert.Equal(t, 0, len(m.stream2Output))
+	assert.Equal(t, 0, len(m.usedAddrs))
+}
+
+func TestMulticast_ExtraTrack(t *testing.T) {
+	m, err := NewMulticastManager(MulticastConfig{AddrBegin: "239.0.0.1", AddrEnd: "239.0.0.1", Port: 40000, Ttl: 16})
+	assert.Equal(t, nil, err)
+
+	rawSdp := multicastTestSdp +
+		"m=application 0 RTP/AVP 107\r\n" +
+		"a=rtpmap:107 vnd.onvif.metadata/90000\r\n" +
+		"a=control:streamid=2\r\n"
+	sdpCtx, err := sdp.ParseSdp2LogicContext([]byte(rawSdp))
+	assert.Equal(t, nil, err)
+	o, err := m.acquire("test", sdpCtx)
+	assert.Equal(t, nil, err)
+	defer m.release(o)
+
+	// 主音频、主视频之外的track也可以SETUP，通过writeTrackRtpPacket发送
+	rtpPort, _, err := o.setup("rtsp://127.0.0.1/live/test/streamid=2")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 40004, rtpPort)
+
+	lconn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, nil, err)
+	defer lconn.Close()
+	o.dsts[2] = lconn.LocalAddr().(*net.UDPAddr)
+
+	s := &SubSession{}
+	o.addPlayer(s)
+	o.writeTrackRtpPacket(s, 2, makeMulticastTestRtpPacket(107, 1))
+
+	buf := make([]byte, 1500)
+	_ = lconn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := lconn.ReadFromUDP(buf)
+	assert.Equal(t, nil, err)
+	h, err := rtprtcp.ParseRtpHeader(buf[:n])
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint8(107), h.PacketType)
+}
+
+func TestIsMulticastSdpRequested(t *testing.T) {
+	assert.Equal(t, false, isMulticastSdpRequested(""))
+	assert.Equal(t, false, isMulticastSdpRequested("token=abc"))
+	assert.Equal(t, false, isMulticastSdpRequested("multicast=0"))
+	assert.Equal(t, true, isMulticastSdpRequested("multicast"))
+	assert.Equal(t, true, isMulticastSdpRequested("token=abc&multicast=1"))
+}
+
+func makeMulticastTestRtpPacket(pt uint8, seq uint16) rtprtcp.RtpPacket {
+	h := rtprtcp.MakeDefaultRtpHeader()
+	h.PacketType = pt
+	h.Seq = seq
+	return rtprtcp.MakeRtpPacket(h, []byte{0x01, 0x02})
+}
@@ -10,6 +10,7 @@ package rtsp
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/ysjhlnu/lal/pkg/base"
@@ -21,7 +22,7 @@ import (
 var ResponseOptionsTmpl = "RTSP/1.0 200 OK\r\n" +
 	"Server: " + base.LalRtspOptionsResponseServer + "\r\n" +
 	"CSeq: %s\r\n" +
-	"Public: DESCRIBE, ANNOUNCE, SETUP, PLAY, PAUSE, RECORD, TEARDOWN\r\n" +
+	"Public: OPTIONS, DESCRIBE, ANNOUNCE, SETUP, PLAY, PAUSE, RECORD, TEARDOWN, GET_PARAMETER, SET_PARAMETER\r\n" +
 	"\r\n"
 
 // rfc2326 10.3 ANNOUNCE
@@ -69,6 +70,20 @@ var ResponsePlayTmpl = "RTSP/1.0 200 OK\r\n" +
 	"Date: %s\r\n" +
 	"\r\n"
 
+// ResponsePlayVodTmpl CSeq, Date, Session, Range, Scale
+var ResponsePlayVodTmpl = "RTSP/1.0 200 OK\r\n" +
+	"CSeq: %s\r\n" +
+	"Date: %s\r\n" +
+	"Session: %s\r\n" +
+	"Range: %s\r\n" +
+	"Scale: %s\r\n" +
+	"\r\n"
+
+// ResponseInvalidRangeTmpl CSeq
+var ResponseInvalidRangeTmpl = "RTSP/1.0 457 Invalid Range\r\n" +
+	"CSeq: %s\r\n" +
+	"\r\n"
+
 // rfc2326 10.7 TEARDOWN
 //var RequestTeardownTmpl = "not impl"
 
@@ -77,6 +92,34 @@ var ResponseTeardownTmpl = "RTSP/1.0 200 OK\r\n" +
 	"CSeq: %s\r\n" +
 	"\r\n"
 
+// rfc2326 10.6 PAUSE
+
+// ResponsePauseTmpl CSeq, Session
+var ResponsePauseTmpl = "RTSP/1.0 200 OK\r\n" +
+	"CSeq: %s\r\n" +
+	"Session: %s\r\n" +
+	"\r\n"
+
+// rfc2326 10.8 GET_PARAMETER, 10.9 SET_PARAMETER
+// 目前只用于保活，不支持具体的参数
+
+// ResponseParameterTmpl CSeq, Session
+var ResponseParameterTmpl = "RTSP/1.0 200 OK\r\n" +
+	"CSeq: %s\r\n" +
+	"Session: %s\r\n" +
+	"Content-Length: 0\r\n" +
+	"\r\n"
+
+// ResponseParameterNotUnderstoodTmpl CSeq
+var ResponseParameterNotUnderstoodTmpl = "RTSP/1.0 451 Parameter Not Understood\r\n" +
+	"CSeq: %s\r\n" +
+	"\r\n"
+
+// ResponseMethodNotValidTmpl CSeq
+var ResponseMethodNotValidTmpl = "RTSP/1.0 455 Method Not Valid in This State\r\n" +
+	"CSeq: %s\r\n" +
+	"\r\n"
+
 var ResponseAuthorizedTmpl = "RTSP/1.0 401 Unauthorized\r\n" +
 	"CSeq: %s\r\n" +
 	"Date: %s\r\n" +
@@ -102,6 +145,13 @@ func PackResponseSetup(cseq string, htv string) string {
 	return fmt.Sprintf(ResponseSetupTmpl, cseq, date, sessionId, htv)
 }
 
+// PackResponseSetupWithTimeout 在Session头中携带超时时间，客户端需要在超时时间内发送信令或者rtcp保活
+func PackResponseSetupWithTimeout(cseq string, htv string, timeoutSec int) string {
+	date := time.Now().Format(time.RFC1123)
+
+	return fmt.Sprintf(ResponseSetupTmpl, cseq, date, fmt.Sprintf("%s;timeout=%d", sessionId, timeoutSec), htv)
+}
+
 func PackResponseRecord(cseq string) string {
 	return fmt.Sprintf(ResponseRecordTmpl, cseq, sessionId)
 }
@@ -111,10 +161,39 @@ func PackResponsePlay(cseq string) string {
 	return fmt.Sprintf(ResponsePlayTmpl, cseq, date)
 }
 
+// PackResponsePlayVod 点播的PLAY响应，携带实际的播放范围和倍速
+//
+// @param startMs, durationMs: 单位毫秒
+func PackResponsePlayVod(cseq string, startMs, durationMs int64, scale float64) string {
+	date := time.Now().Format(time.RFC1123)
+	r := fmt.Sprintf("npt=%.3f-%.3f", float64(startMs)/1000, float64(durationMs)/1000)
+	return fmt.Sprintf(ResponsePlayVodTmpl, cseq, date, sessionId, r, strconv.FormatFloat(scale, 'f', -1, 64))
+}
+
+func PackResponseInvalidRange(cseq string) string {
+	return fmt.Sprintf(ResponseInvalidRangeTmpl, cseq)
+}
+
 func PackResponseTeardown(cseq string) string {
 	return fmt.Sprintf(ResponseTeardownTmpl, cseq)
 }
 
+func PackResponsePause(cseq string) string {
+	return fmt.Sprintf(ResponsePauseTmpl, cseq, sessionId)
+}
+
+func PackResponseParameter(cseq string) string {
+	return fmt.Sprintf(ResponseParameterTmpl, cseq, sessionId)
+}
+
+func PackResponseParameterNotUnderstood(cseq string) string {
+	return fmt.Sprintf(ResponseParameterNotUnderstoodTmpl, cseq)
+}
+
+func PackResponseMethodNotValid(cseq string) string {
+	return fmt.Sprintf(ResponseMethodNotValidTmpl, cseq)
+}
+
 func PackResponseAuthorized(cseq, authenticate string) string {
 	date := time.Now().Format(time.RFC1123)
 	return fmt.Sprintf(ResponseAuthorizedTmpl, cseq, date, authenticate)
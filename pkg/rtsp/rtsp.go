@@ -13,6 +13,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/q191201771/naza/pkg/nazaerrors"
 
@@ -36,7 +37,9 @@ const (
 	MethodRecord       = "RECORD"
 	MethodPlay         = "PLAY"
 	MethodTeardown     = "TEARDOWN"
+	MethodPause        = "PAUSE"
 	MethodGetParameter = "GET_PARAMETER"
+	MethodSetParameter = "SET_PARAMETER"
 )
 
 const (
@@ -48,9 +51,11 @@ const (
 	HeaderTransport       = "Transport"
 	HeaderSession         = "Session"
 	HeaderRange           = "Range"
+	HeaderScale           = "Scale"
 	HeaderWwwAuthenticate = "WWW-Authenticate"
 	HeaderAuthorization   = "Authorization"
 	HeaderPublic          = "Public"
+	HeaderLocation        = "Location"
 
 	// HeaderAcceptApplicationSdp header value
 	HeaderAcceptApplicationSdp         = "application/sdp"
@@ -65,6 +70,8 @@ const (
 
 	HeaderTransportServerRecordTmpl = "RTP/AVP/UDP;unicast;client_port=%d-%d;server_port=%d-%d;mode=record"
 
+	HeaderTransportServerPlayMulticastTmpl = "RTP/AVP;multicast;destination=%s;port=%d-%d;ttl=%d" // addr, rtpPort, rtcpPort, ttl
+
 	//HeaderTransportServerRecordTCPTmpl = "RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record"
 )
 
@@ -72,6 +79,7 @@ const (
 	TransportFieldClientPort  = "client_port"
 	TransportFieldServerPort  = "server_port"
 	TransportFieldInterleaved = "interleaved"
+	TransportFieldMulticast   = "multicast"
 )
 
 const (
@@ -82,11 +90,18 @@ var (
 	// TODO chef: 参考协议标准，不要使用固定值
 	sessionId = "191201771"
 
+	defaultServerSessionTimeoutSec = 60 // 服务端session超时时间，在SETUP响应的Session头中告知客户端
+
 	minServerPort = uint16(30000)
 	maxServerPort = uint16(60000)
 
 	unpackerItemMaxSize = 1024
 
+	maxOnvifMetadataSize = 1024 * 1024 // 单个ONVIF元数据xml文档的最大长度
+
+	rtpPacketCacheSize      = 512                    // udp模式下，每个track缓存的用于重传的rtp包数量
+	keyFrameRequestInterval = 500 * time.Millisecond // 向输入端请求关键帧的最小间隔
+
 	serverCommandSessionReadBufSize   = 256
 	serverCommandSessionWriteChanSize = 1024
 
@@ -181,6 +196,21 @@ func parseTransport(setupTransport string, key string) (first, second uint16, er
 	return uint16(iFirst), uint16(iSecond), err
 }
 
+// parseSession 解析SETUP回复中的Session，比如`12345678;timeout=60`
+//
+// @return timeoutSec 没有timeout字段时为0
+func parseSession(v string) (sessionId string, timeoutSec int) {
+	items := strings.Split(v, ";")
+	sessionId = strings.TrimSpace(items[0])
+	for _, item := range items[1:] {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) == 2 && kv[0] == "timeout" {
+			timeoutSec, _ = strconv.Atoi(kv[1])
+		}
+	}
+	return
+}
+
 func makeSetupUri(urlCtx base.UrlContext, aControl string) string {
 	if strings.HasPrefix(aControl, "rtsp://") {
 		return aControl
@@ -11,6 +11,7 @@ package rtsp
 import (
 	"crypto/tls"
 	"net"
+	"sync"
 )
 
 type IServerObserver interface {
@@ -50,27 +51,67 @@ type IServerObserver interface {
 	OnDelRtspSubSession(session *SubSession)
 }
 
+// ServerAuthConfig 默认的 IServerAuthenticator
 type ServerAuthConfig struct {
-	AuthEnable bool   `json:"auth_enable"`
-	AuthMethod int    `json:"auth_method"`
+	AuthEnable bool   `json:"auth_enable"` // 拉流鉴权
+	AuthMethod int    `json:"auth_method"` // 0 Basic，1 Digest，推流和拉流相同
 	UserName   string `json:"username"`
 	PassWord   string `json:"password"`
+
+	PubAuthEnable bool   `json:"pub_auth_enable"` // 推流鉴权
+	PubUserName   string `json:"pub_username"`
+	PubPassWord   string `json:"pub_password"`
+
+	// 同一IP鉴权连续失败AuthMaxFailCount次后，AuthBlockSec秒内拒绝该IP的请求，为0时不限制
+	AuthMaxFailCount int `json:"auth_max_fail_count"`
+	AuthBlockSec     int `json:"auth_block_sec"`
 }
 
 type Server struct {
 	addr     string
 	observer IServerObserver
 
-	ln   net.Listener
-	auth ServerAuthConfig
+	ln            net.Listener
+	authenticator IServerAuthenticator
+	authLimiter   *authFailLimiter
+
+	tunnelMutex   sync.Mutex
+	cookie2Tunnel map[string]*httpTunnelConn // RTSP over HTTP，见 ServeHttpTunnel
+
+	multicastManager *MulticastManager
+	timeoutSec       int
 }
 
 func NewServer(addr string, observer IServerObserver, auth ServerAuthConfig) *Server {
-	return &Server{
-		addr:     addr,
-		observer: observer,
-		auth:     auth,
+	s := &Server{
+		addr:          addr,
+		observer:      observer,
+		authenticator: auth,
+		cookie2Tunnel: make(map[string]*httpTunnelConn),
+		timeoutSec:    defaultServerSessionTimeoutSec,
+	}
+	if auth.AuthMaxFailCount > 0 {
+		s.authLimiter = newAuthFailLimiter(auth.AuthMaxFailCount, auth.AuthBlockSec)
 	}
+	return s
+}
+
+// WithAuthenticator 替换默认的账号来源，见 IServerAuthenticator
+func (s *Server) WithAuthenticator(authenticator IServerAuthenticator) *Server {
+	s.authenticator = authenticator
+	return s
+}
+
+// WithMulticastManager 开启组播输出，见 MulticastManager
+func (s *Server) WithMulticastManager(m *MulticastManager) *Server {
+	s.multicastManager = m
+	return s
+}
+
+// WithSessionTimeoutSec 设置session超时时间，超时时间内没有收到任何信令或数据（包括udp的rtp、rtcp）时，关闭session
+func (s *Server) WithSessionTimeoutSec(sec int) *Server {
+	s.timeoutSec = sec
+	return s
 }
 
 func (s *Server) Listen() (err error) {
@@ -140,7 +181,10 @@ func (s *Server) OnDelRtspSubSession(session *SubSession) {
 // ---------------------------------------------------------------------------------------------------------------------
 
 func (s *Server) handleTcpConnect(conn net.Conn) {
-	session := NewServerCommandSession(s, conn, s.auth)
+	session := NewServerCommandSession(s, conn, s.authenticator)
+	session.authLimiter = s.authLimiter
+	session.multicastManager = s.multicastManager
+	session.timeoutSec = s.timeoutSec
 	s.observer.OnNewRtspSessionConnect(session)
 
 	err := session.RunLoop()
@@ -0,0 +1,129 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"sync"
+	"time"
+)
+
+// IServerAuthenticator RTSP推流（ANNOUNCE）和拉流（DESCRIBE）时，获取Basic/Digest鉴权使用的账号
+//
+// 默认使用 ServerAuthConfig ，业务方可通过 Server.WithAuthenticator 替换，比如按流从数据库或webhook获取账号
+type IServerAuthenticator interface {
+	// GetCredential
+	//
+	// 注意，每个需要鉴权的信令都会调用，包括客户端第一次没有携带Authorization的请求
+	//
+	// @return err: 如果返回非nil，则关闭该连接
+	//
+	GetCredential(req ServerAuthRequest) (ServerAuthCredential, error)
+}
+
+type ServerAuthRequest struct {
+	IsPub      bool   `json:"is_pub"` // true为推流，false为拉流
+	AppName    string `json:"app_name"`
+	StreamName string `json:"stream_name"`
+	UrlParam   string `json:"url_param"`
+	RemoteAddr string `json:"remote_addr"`
+	Username   string `json:"username"` // 客户端Authorization中的用户名，第一次请求没有携带Authorization时为空
+}
+
+type ServerAuthCredential struct {
+	Enable   bool   `json:"enable"` // false表示不需要鉴权
+	Method   int    `json:"method"` // 0 Basic，1 Digest
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// GetCredential 推流和拉流使用不同的账号，鉴权方式相同
+func (c ServerAuthConfig) GetCredential(req ServerAuthRequest) (ServerAuthCredential, error) {
+	if req.IsPub {
+		return ServerAuthCredential{
+			Enable:   c.PubAuthEnable,
+			Method:   c.AuthMethod,
+			Username: c.PubUserName,
+			Password: c.PubPassWord,
+		}, nil
+	}
+	return ServerAuthCredential{
+		Enable:   c.AuthEnable,
+		Method:   c.AuthMethod,
+		Username: c.UserName,
+		Password: c.PassWord,
+	}, nil
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// authFailLimiter 同一IP鉴权连续失败达到一定次数后，在一段时间内拒绝该IP的请求，防止暴力破解
+type authFailLimiter struct {
+	maxFailCount int
+	blockDur     time.Duration
+
+	mutex   sync.Mutex
+	ip2Item map[string]*authFailItem
+}
+
+type authFailItem struct {
+	failCount    int
+	lastFailTime time.Time
+	blockUntil   time.Time
+}
+
+// 记录的IP数量超过该值时，清理过期的记录
+var authFailLimiterMaxItemNum = 4096
+
+func newAuthFailLimiter(maxFailCount, blockSec int) *authFailLimiter {
+	return &authFailLimiter{
+		maxFailCount: maxFailCount,
+		blockDur:     time.Duration(blockSec) * time.Second,
+		ip2Item:      make(map[string]*authFailItem),
+	}
+}
+
+func (l *authFailLimiter) IsBlocked(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	item, ok := l.ip2Item[ip]
+	return ok && time.Now().Before(item.blockUntil)
+}
+
+func (l *authFailLimiter) OnFail(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if len(l.ip2Item) >= authFailLimiterMaxItemNum {
+		for k, v := range l.ip2Item {
+			if now.After(v.blockUntil) && now.Sub(v.lastFailTime) > l.blockDur {
+				delete(l.ip2Item, k)
+			}
+		}
+	}
+
+	item, ok := l.ip2Item[ip]
+	if !ok {
+		item = &authFailItem{}
+		l.ip2Item[ip] = item
+	}
+	item.failCount++
+	item.lastFailTime = now
+	if item.failCount >= l.maxFailCount {
+		Log.Warnf("too many rtsp auth failures, block ip. ip=%s, count=%d, duration=%v", ip, item.failCount, l.blockDur)
+		item.failCount = 0
+		item.blockUntil = now.Add(l.blockDur)
+	}
+}
+
+func (l *authFailLimiter) OnSuccess(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.ip2Item, ip)
+}
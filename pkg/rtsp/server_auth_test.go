@@ -0,0 +1,135 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazahttp"
+)
+
+// serverAuthTestAuthenticator 推流使用Digest，拉流使用Basic，并且只有test110这路流需要鉴权
+type serverAuthTestAuthenticator struct {
+	reqs []ServerAuthRequest
+}
+
+func (a *serverAuthTestAuthenticator) GetCredential(req ServerAuthRequest) (ServerAuthCredential, error) {
+	a.reqs = append(a.reqs, req)
+	if req.StreamName != "test110" {
+		return ServerAuthCredential{}, nil
+	}
+	if req.IsPub {
+		return ServerAuthCredential{Enable: true, Method: 1, Username: "pub", Password: "pub:pass"}, nil
+	}
+	return ServerAuthCredential{Enable: true, Method: 0, Username: "sub", Password: "sub:pass"}, nil
+}
+
+func TestServerCommandSessionAuth(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	defer cconn.Close()
+
+	authenticator := &serverAuthTestAuthenticator{}
+	session := NewServerCommandSession(&commandSessionTestObserver{}, sconn, authenticator)
+	go func() {
+		_ = session.RunLoop()
+	}()
+
+	r := bufio.NewReader(cconn)
+	request := func(method string, uri string, headers string, body string) nazahttp.HttpRespMsgCtx {
+		if body != "" {
+			headers += fmt.Sprintf("Content-Length: %d\r\n", len(body))
+		}
+		_, err := cconn.Write([]byte(method + " " + uri + " RTSP/1.0\r\nCSeq: 1\r\n" + headers + "\r\n" + body))
+		assert.Equal(t, nil, err)
+		ctx, err := nazahttp.ReadHttpResponseMessage(r)
+		assert.Equal(t, nil, err)
+		return ctx
+	}
+	authorization := func(ctx nazahttp.HttpRespMsgCtx, method, uri, username, password string) string {
+		var auth Auth
+		auth.FeedWwwAuthenticate([]string{ctx.Headers.Get(HeaderWwwAuthenticate)}, username, password)
+		return HeaderAuthorization + ": " + auth.MakeAuthorization(method, uri) + "\r\n"
+	}
+
+	// 推流，Digest
+	uri := "rtsp://127.0.0.1/live/test110?k=v"
+	ctx := request(MethodAnnounce, uri, "", multicastTestSdp)
+	assert.Equal(t, "401", ctx.StatusCode)
+	assert.Equal(t, ServerAuthRequest{IsPub: true, AppName: "live", StreamName: "test110", UrlParam: "k=v", RemoteAddr: "pipe"}, authenticator.reqs[0])
+	firstCtx := ctx
+
+	// 密码错误
+	ctx = request(MethodAnnounce, uri, authorization(ctx, MethodAnnounce, uri, "pub", "wrong"), multicastTestSdp)
+	assert.Equal(t, "401", ctx.StatusCode)
+	assert.Equal(t, "pub", authenticator.reqs[1].Username)
+	// 使用已经失效的nonce
+	ctx = request(MethodAnnounce, uri, authorization(firstCtx, MethodAnnounce, uri, "pub", "pub:pass"), multicastTestSdp)
+	assert.Equal(t, "401", ctx.StatusCode)
+	// 拉流的账号不能用于推流
+	ctx = request(MethodAnnounce, uri, authorization(ctx, MethodAnnounce, uri, "sub", "sub:pass"), multicastTestSdp)
+	assert.Equal(t, "401", ctx.StatusCode)
+
+	ctx = request(MethodAnnounce, uri, authorization(ctx, MethodAnnounce, uri, "pub", "pub:pass"), multicastTestSdp)
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.IsNotNil(t, session.pubSession)
+
+	// 拉流，Basic
+	ctx = request(MethodDescribe, uri, "", "")
+	assert.Equal(t, "401", ctx.StatusCode)
+	assert.Equal(t, "Basic realm=\"lal\"", ctx.Headers.Get(HeaderWwwAuthenticate))
+	ctx = request(MethodDescribe, uri, authorization(ctx, MethodDescribe, uri, "sub", "sub:pass"), "")
+	assert.Equal(t, "200", ctx.StatusCode)
+
+	// 不需要鉴权的流
+	ctx = request(MethodDescribe, "rtsp://127.0.0.1/live/test111", "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+}
+
+func TestServerAuthConfig(t *testing.T) {
+	config := ServerAuthConfig{
+		AuthEnable:    true,
+		AuthMethod:    1,
+		UserName:      "sub",
+		PassWord:      "sub_pass",
+		PubAuthEnable: false,
+		PubUserName:   "pub",
+	}
+	cred, err := config.GetCredential(ServerAuthRequest{IsPub: false})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, ServerAuthCredential{Enable: true, Method: 1, Username: "sub", Password: "sub_pass"}, cred)
+	cred, err = config.GetCredential(ServerAuthRequest{IsPub: true})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, cred.Enable)
+	assert.Equal(t, "pub", cred.Username)
+}
+
+func TestAuthFailLimiter(t *testing.T) {
+	l := newAuthFailLimiter(3, 60)
+	for i := 0; i < 2; i++ {
+		l.OnFail("1.1.1.1")
+		assert.Equal(t, false, l.IsBlocked("1.1.1.1"))
+	}
+	// 成功后重新计数
+	l.OnSuccess("1.1.1.1")
+	for i := 0; i < 2; i++ {
+		l.OnFail("1.1.1.1")
+	}
+	assert.Equal(t, false, l.IsBlocked("1.1.1.1"))
+	l.OnFail("1.1.1.1")
+	assert.Equal(t, true, l.IsBlocked("1.1.1.1"))
+	assert.Equal(t, false, l.IsBlocked("2.2.2.2"))
+
+	l = newAuthFailLimiter(1, 0)
+	l.OnFail("1.1.1.1")
+	assert.Equal(t, false, l.IsBlocked("1.1.1.1"))
+}
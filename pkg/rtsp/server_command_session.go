@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/q191201771/naza/pkg/nazaerrors"
 
@@ -54,27 +56,36 @@ type IServerCommandSessionObserver interface {
 }
 
 type ServerCommandSession struct {
-	uniqueKey    string                        // const after ctor
-	observer     IServerCommandSessionObserver // const after ctor
-	conn         connection.Connection
-	prevConnStat connection.Stat
-	staleStat    *connection.Stat
-	stat         base.StatSession
-	authConf     ServerAuthConfig
-	auth         Auth
-
+	uniqueKey     string                        // const after ctor
+	observer      IServerCommandSessionObserver // const after ctor
+	conn          connection.Connection
+	prevConnStat  connection.Stat
+	staleStat     *connection.Stat
+	stat          base.StatSession
+	authenticator IServerAuthenticator
+	authLimiter   *authFailLimiter // nil表示不限制
+	authNonce     string           // Digest鉴权时，最近一次下发给客户端的nonce
+
+	mutex      sync.Mutex // 只保护超时检查协程对pubSession和subSession的读取
 	pubSession *PubSession
 	subSession *SubSession
 
 	describeSeq string // only for sub session
+
+	multicastManager *MulticastManager
+	timeoutSec       int
 }
 
-func NewServerCommandSession(observer IServerCommandSessionObserver, conn net.Conn, authConf ServerAuthConfig) *ServerCommandSession {
+// NewServerCommandSession
+//
+// @param authenticator: 推流和拉流鉴权使用的账号，为nil时不鉴权
+func NewServerCommandSession(observer IServerCommandSessionObserver, conn net.Conn, authenticator IServerAuthenticator) *ServerCommandSession {
 	uk := base.GenUkRtspServerCommandSession()
 	s := &ServerCommandSession{
-		uniqueKey: uk,
-		observer:  observer,
-		authConf:  authConf,
+		uniqueKey:     uk,
+		observer:      observer,
+		authenticator: authenticator,
+		timeoutSec:    defaultServerSessionTimeoutSec,
 		conn: connection.New(conn, func(option *connection.Option) {
 			option.ReadBufSize = serverCommandSessionReadBufSize
 			option.WriteChanSize = serverCommandSessionWriteChanSize
@@ -155,6 +166,10 @@ func (session *ServerCommandSession) UniqueKey() string {
 func (session *ServerCommandSession) runCmdLoop() error {
 	var r = bufio.NewReader(session.conn)
 
+	timeoutDone := make(chan struct{})
+	defer close(timeoutDone)
+	go session.runTimeoutCheck(timeoutDone)
+
 Loop:
 	for {
 		isInterleaved, packet, channel, err := readInterleaved(r)
@@ -204,6 +219,12 @@ Loop:
 		case MethodPlay:
 			// sub
 			handleMsgErr = session.handlePlay(requestCtx)
+		case MethodPause:
+			// sub
+			handleMsgErr = session.handlePause(requestCtx)
+		case MethodGetParameter, MethodSetParameter:
+			// pub, sub
+			handleMsgErr = session.handleParameter(requestCtx)
 		case MethodTeardown:
 			// pub
 			handleMsgErr = session.handleTeardown(requestCtx)
@@ -239,13 +260,19 @@ func (session *ServerCommandSession) handleAnnounce(requestCtx nazahttp.HttpReqM
 		return err
 	}
 
+	if pass, err := session.checkAuth(requestCtx, urlCtx, true); !pass {
+		return err
+	}
+
 	sdpCtx, err := sdp.ParseSdp2LogicContext(requestCtx.Body)
 	if err != nil {
 		Log.Errorf("[%s] parse sdp failed. err=%v", session.uniqueKey, err)
 		return err
 	}
 
+	session.mutex.Lock()
 	session.pubSession = NewPubSession(urlCtx, session)
+	session.mutex.Unlock()
 	Log.Infof("[%s] link new PubSession. [%s]", session.uniqueKey, session.pubSession.UniqueKey())
 	session.pubSession.InitWithSdp(sdpCtx)
 
@@ -261,28 +288,21 @@ func (session *ServerCommandSession) handleAnnounce(requestCtx nazahttp.HttpReqM
 func (session *ServerCommandSession) handleDescribe(requestCtx nazahttp.HttpReqMsgCtx) error {
 	Log.Infof("[%s] < R DESCRIBE", session.uniqueKey)
 
-	if session.authConf.AuthEnable {
-		// 鉴权处理
-		authresp, err := session.handleAuthorized(requestCtx)
-		if err != nil {
-			return err
-		}
-
-		if authresp != "" {
-			_, err := session.conn.Write([]byte(authresp))
-			return err
-		}
-	}
-
 	urlCtx, err := base.ParseRtspUrl(requestCtx.Uri)
 	if err != nil {
 		Log.Errorf("[%s] parse presentation failed. uri=%s", session.uniqueKey, requestCtx.Uri)
 		return err
 	}
 
+	if pass, err := session.checkAuth(requestCtx, urlCtx, false); !pass {
+		return err
+	}
+
 	session.describeSeq = requestCtx.Headers.Get(HeaderCSeq)
 
+	session.mutex.Lock()
 	session.subSession = NewSubSession(urlCtx, session)
+	session.mutex.Unlock()
 	Log.Infof("[%s] link new SubSession. [%s]", session.uniqueKey, session.subSession.UniqueKey())
 	ok, rawSdp := session.observer.OnNewRtspSubSessionDescribe(session.subSession)
 	if !ok {
@@ -300,44 +320,97 @@ func (session *ServerCommandSession) feedSdp(rawSdp []byte) error {
 	sdpCtx, _ := sdp.ParseSdp2LogicContext(rawSdp)
 	session.subSession.InitWithSdp(sdpCtx)
 
+	// 点播的每个拉流播放位置不同，不使用组播
+	if session.multicastManager != nil && !session.subSession.IsVod() {
+		if output, err := session.multicastManager.acquire(session.subSession.StreamName(), sdpCtx); err != nil {
+			Log.Warnf("[%s] acquire multicast output failed, only unicast available. err=%+v", session.uniqueKey, err)
+		} else {
+			session.subSession.initMulticast(session.multicastManager, output)
+			// 注意，单播的客户端依然需要原始的sdp，只有明确要求时，才在sdp中使用组播地址和端口
+			if isMulticastSdpRequested(session.subSession.RawQuery()) {
+				rawSdp = output.rewriteSdp(rawSdp)
+			}
+		}
+	}
+
 	resp := PackResponseDescribe(session.describeSeq, string(rawSdp))
 	_, err := session.conn.Write([]byte(resp))
 	return err
 }
 
-func (session *ServerCommandSession) handleAuthorized(requestCtx nazahttp.HttpReqMsgCtx) (string, error) {
-	if requestCtx.Headers.Get(HeaderAuthorization) != "" {
-		authorization := requestCtx.Headers.Get(HeaderAuthorization)
-		session.auth.ParseAuthorization(authorization)
+// checkAuth 推流和拉流鉴权，账号见 IServerAuthenticator
+//
+// @return pass: 为false并且err为nil时，表示已回复401，等待客户端携带Authorization重新请求
+func (session *ServerCommandSession) checkAuth(requestCtx nazahttp.HttpReqMsgCtx, urlCtx base.UrlContext, isPub bool) (pass bool, err error) {
+	if session.authenticator == nil {
+		return true, nil
+	}
+
+	ip, _, _ := net.SplitHostPort(session.conn.RemoteAddr().String())
+	if session.authLimiter != nil && session.authLimiter.IsBlocked(ip) {
+		return false, fmt.Errorf("%w. too many failures, ip blocked. ip=%s", base.ErrRtspAuthFailed, ip)
+	}
+
+	var auth Auth
+	authorization := requestCtx.Headers.Get(HeaderAuthorization)
+	if authorization != "" {
+		if err = auth.ParseAuthorization(authorization); err != nil {
+			return false, fmt.Errorf("%w. %s", base.ErrRtspAuthFailed, err.Error())
+		}
+	}
+
+	cred, err := session.authenticator.GetCredential(ServerAuthRequest{
+		IsPub:      isPub,
+		AppName:    urlCtx.PathWithoutLastItem,
+		StreamName: urlCtx.LastItemOfPath,
+		UrlParam:   urlCtx.RawQuery,
+		RemoteAddr: session.conn.RemoteAddr().String(),
+		Username:   auth.Username,
+	})
+	if err != nil {
+		return false, fmt.Errorf("%w. %s", base.ErrRtspAuthFailed, err.Error())
+	}
+	if !cred.Enable {
+		return true, nil
+	}
+
+	var typ string
+	switch cred.Method {
+	case 0:
+		typ = AuthTypeBasic
+	case 1:
+		typ = AuthTypeDigest
+	default:
+		return false, fmt.Errorf("%w. unsupported auth method. method=%d", base.ErrRtspAuthFailed, cred.Method)
+	}
 
-		// 解析出的鉴权方式需要与配置的鉴权方式一致,防止鉴权降级
-		if session.auth.Typ == AuthTypeBasic && session.authConf.AuthMethod == 0 ||
-			session.auth.Typ == AuthTypeDigest && session.authConf.AuthMethod == 1 {
-			if session.auth.CheckAuthorization(requestCtx.Method, session.authConf.UserName, session.authConf.PassWord) {
-				return "", nil
+	if authorization != "" {
+		// 解析出的鉴权方式需要与配置的鉴权方式一致，防止鉴权降级
+		// Digest方式下，nonce必须是本端下发的，防止重放
+		if auth.Typ == typ && auth.Username == cred.Username &&
+			(typ == AuthTypeBasic || (auth.Nonce != "" && auth.Nonce == session.authNonce)) &&
+			auth.CheckAuthorization(requestCtx.Method, cred.Username, cred.Password) {
+			if session.authLimiter != nil {
+				session.authLimiter.OnSuccess(ip)
 			}
+			return true, nil
 		}
 
-		// TODO(chef): [refactor] 错误放入base/error.go中 202205
-		err := fmt.Errorf("rtsp auth failed, auth:%s", authorization)
-		return "", err
-	} else {
-		if session.authConf.AuthMethod == 0 {
-			// Basic鉴权
-			authenticate := session.auth.MakeAuthenticate(AuthTypeBasic)
-			resp := PackResponseAuthorized(requestCtx.Headers.Get(HeaderCSeq), authenticate)
-			return resp, nil
-		} else if session.authConf.AuthMethod == 1 {
-			// Digest鉴权
-			authenticate := session.auth.MakeAuthenticate(AuthTypeDigest)
-			resp := PackResponseAuthorized(requestCtx.Headers.Get(HeaderCSeq), authenticate)
-			return resp, nil
-		} else {
-			// TODO(chef): [refactor] 错误放入base/error.go中 202205
-			err := fmt.Errorf("unsupport, auth method:%d", session.authConf.AuthMethod)
-			return "", err
+		// 注意，不打印authorization，Basic方式下包含明文密码
+		Log.Warnf("[%s] rtsp auth failed. ip=%s, type=%s, username=%s", session.uniqueKey, ip, auth.Typ, auth.Username)
+		if session.authLimiter != nil {
+			session.authLimiter.OnFail(ip)
 		}
 	}
+
+	// 第一次请求，或者鉴权失败，回复401让客户端（重新）携带Authorization请求
+	authenticate := auth.MakeAuthenticate(typ)
+	if typ == AuthTypeDigest {
+		session.authNonce = auth.getV(authenticate, `nonce="`)
+	}
+	resp := PackResponseAuthorized(requestCtx.Headers.Get(HeaderCSeq), authenticate)
+	_, err = session.conn.Write([]byte(resp))
+	return false, err
 }
 
 // 一次SETUP对应一路流（音频或视频）
@@ -370,7 +443,24 @@ func (session *ServerCommandSession) handleSetup(requestCtx nazahttp.HttpReqMsgC
 			return nazaerrors.Wrap(base.ErrRtsp)
 		}
 
-		resp := PackResponseSetup(requestCtx.Headers.Get(HeaderCSeq), htv)
+		resp := PackResponseSetupWithTimeout(requestCtx.Headers.Get(HeaderCSeq), htv, session.timeoutSec)
+		_, err = session.conn.Write([]byte(resp))
+		return err
+	}
+
+	// 是否为组播模式
+	if strings.Contains(htv, TransportFieldMulticast) {
+		if session.subSession == nil {
+			Log.Errorf("[%s] setup multicast but subSession not exist.", session.uniqueKey)
+			return nazaerrors.Wrap(base.ErrRtspUnsupportedTransport)
+		}
+		addr, rtpPort, rtcpPort, ttl, err := session.subSession.SetupWithMulticast(requestCtx.Uri)
+		if err != nil {
+			Log.Errorf("[%s] setup multicast error. err=%+v", session.uniqueKey, err)
+			return err
+		}
+		htv = fmt.Sprintf(HeaderTransportServerPlayMulticastTmpl, addr, rtpPort, rtcpPort, ttl)
+		resp := PackResponseSetupWithTimeout(requestCtx.Headers.Get(HeaderCSeq), htv, session.timeoutSec)
 		_, err = session.conn.Write([]byte(resp))
 		return err
 	}
@@ -405,7 +495,7 @@ func (session *ServerCommandSession) handleSetup(requestCtx nazahttp.HttpReqMsgC
 		return nazaerrors.Wrap(base.ErrRtsp)
 	}
 
-	resp := PackResponseSetup(requestCtx.Headers.Get(HeaderCSeq), htv)
+	resp := PackResponseSetupWithTimeout(requestCtx.Headers.Get(HeaderCSeq), htv, session.timeoutSec)
 	_, err = session.conn.Write([]byte(resp))
 	return err
 }
@@ -426,18 +516,149 @@ func (session *ServerCommandSession) handlePlay(requestCtx nazahttp.HttpReqMsgCt
 		return base.ErrRtsp
 	}
 
+	if session.subSession.IsVod() {
+		return session.handleVodPlay(requestCtx)
+	}
+
+	// 暂停后恢复播放
+	if session.subSession.resume() {
+		Log.Infof("[%s] resume subSession. [%s]", session.uniqueKey, session.subSession.UniqueKey())
+		resp := PackResponsePlay(requestCtx.Headers.Get(HeaderCSeq))
+		_, err := session.conn.Write([]byte(resp))
+		return err
+	}
+
 	// TODO(chef): [opt] 上层关闭，可以考虑回复非200状态码再关闭
 	if err := session.observer.OnNewRtspSubSessionPlay(session.subSession); err != nil {
 		return err
 	}
+	session.subSession.startMulticast()
 	resp := PackResponsePlay(requestCtx.Headers.Get(HeaderCSeq))
 	_, err := session.conn.Write([]byte(resp))
 	return err
 }
 
+// handleVodPlay 点播的PLAY，每次都交给上层处理
+func (session *ServerCommandSession) handleVodPlay(requestCtx nazahttp.HttpReqMsgCtx) error {
+	cseq := requestCtx.Headers.Get(HeaderCSeq)
+
+	var playRange *PlayRange
+	if v := requestCtx.Headers.Get(HeaderRange); v != "" {
+		r, err := ParseRange(v)
+		if err != nil {
+			Log.Warnf("[%s] parse range failed. range=%s, err=%+v", session.uniqueKey, v, err)
+			_, err = session.conn.Write([]byte(PackResponseInvalidRange(cseq)))
+			return err
+		}
+		playRange = &r
+	}
+
+	// 目前不支持倒放，非法值按正常速度播放，并在响应中告知客户端实际的倍速
+	scale := 1.0
+	if v := requestCtx.Headers.Get(HeaderScale); v != "" {
+		if s, err := ParseScale(v); err == nil && s > 0 {
+			scale = s
+		} else {
+			Log.Warnf("[%s] unsupported scale, use 1. scale=%s", session.uniqueKey, v)
+		}
+	}
+
+	startMs, durationMs, err := session.subSession.vodObserver.OnVodPlay(playRange, scale)
+	if err != nil {
+		Log.Warnf("[%s] vod play failed. range=%+v, err=%+v", session.uniqueKey, playRange, err)
+		_, err = session.conn.Write([]byte(PackResponseInvalidRange(cseq)))
+		return err
+	}
+	Log.Infof("[%s] vod play. start=%d, duration=%d, scale=%v", session.uniqueKey, startMs, durationMs, scale)
+
+	resp := PackResponsePlayVod(cseq, startMs, durationMs, scale)
+	_, err = session.conn.Write([]byte(resp))
+	return err
+}
+
+func (session *ServerCommandSession) handlePause(requestCtx nazahttp.HttpReqMsgCtx) error {
+	Log.Infof("[%s] < R PAUSE", session.uniqueKey)
+
+	// 注意，目前只支持拉流的暂停
+	if session.subSession == nil {
+		Log.Warnf("[%s] handlePause but subSession not exist.", session.uniqueKey)
+		resp := PackResponseMethodNotValid(requestCtx.Headers.Get(HeaderCSeq))
+		_, err := session.conn.Write([]byte(resp))
+		return err
+	}
+
+	if session.subSession.IsVod() {
+		session.subSession.vodObserver.OnVodPause()
+	} else {
+		session.subSession.pause()
+	}
+	resp := PackResponsePause(requestCtx.Headers.Get(HeaderCSeq))
+	_, err := session.conn.Write([]byte(resp))
+	return err
+}
+
+// handleParameter 处理GET_PARAMETER和SET_PARAMETER，目前只用于保活
+func (session *ServerCommandSession) handleParameter(requestCtx nazahttp.HttpReqMsgCtx) error {
+	Log.Debugf("[%s] < R %s", session.uniqueKey, requestCtx.Method)
+
+	var resp string
+	if requestCtx.Method == MethodSetParameter && len(requestCtx.Body) != 0 {
+		resp = PackResponseParameterNotUnderstood(requestCtx.Headers.Get(HeaderCSeq))
+	} else {
+		resp = PackResponseParameter(requestCtx.Headers.Get(HeaderCSeq))
+	}
+	_, err := session.conn.Write([]byte(resp))
+	return err
+}
+
 func (session *ServerCommandSession) handleTeardown(requestCtx nazahttp.HttpReqMsgCtx) error {
 	Log.Infof("[%s] < R TEARDOWN", session.uniqueKey)
 	resp := PackResponseTeardown(requestCtx.Headers.Get(HeaderCSeq))
 	_, err := session.conn.Write([]byte(resp))
 	return err
 }
+
+// runTimeoutCheck 超时时间内没有收到任何数据时，关闭session
+//
+// 注意，除了rtsp信令连接上的数据，udp的rtp（pub）、rtcp（sub）也计算在内
+func (session *ServerCommandSession) runTimeoutCheck(done chan struct{}) {
+	if session.timeoutSec <= 0 {
+		return
+	}
+	timeout := time.Duration(session.timeoutSec) * time.Second
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+
+	lastReadBytes := session.readBytesSum()
+	lastActiveTime := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if curr := session.readBytesSum(); curr != lastReadBytes {
+				lastReadBytes = curr
+				lastActiveTime = now
+				continue
+			}
+			if now.Sub(lastActiveTime) >= timeout {
+				Log.Warnf("[%s] session timeout. timeout=%ds", session.uniqueKey, session.timeoutSec)
+				_ = session.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (session *ServerCommandSession) readBytesSum() uint64 {
+	n := session.conn.GetStat().ReadBytesSum
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if session.pubSession != nil {
+		n += session.pubSession.baseInSession.sessionStat.ReadBytesSum()
+	} else if session.subSession != nil {
+		n += session.subSession.baseOutSession.sessionStat.ReadBytesSum()
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazahttp"
+
+	"github.com/ysjhlnu/lal/pkg/rtprtcp"
+)
+
+type commandSessionTestObserver struct {
+	subSession *SubSession
+}
+
+func (o *commandSessionTestObserver) OnNewRtspPubSession(session *PubSession) error {
+	return nil
+}
+
+func (o *commandSessionTestObserver) OnNewRtspSubSessionDescribe(session *SubSession) (ok bool, sdp []byte) {
+	return true, []byte(multicastTestSdp)
+}
+
+func (o *commandSessionTestObserver) OnNewRtspSubSessionPlay(session *SubSession) error {
+	o.subSession = session
+	return nil
+}
+
+func TestServerCommandSession(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	defer cconn.Close()
+
+	observer := &commandSessionTestObserver{}
+	session := NewServerCommandSession(observer, sconn, nil)
+	session.timeoutSec = 1
+	doneChan := make(chan struct{})
+	go func() {
+		_ = session.RunLoop()
+		close(doneChan)
+	}()
+
+	r := bufio.NewReader(cconn)
+	request := func(method string, uri string, headers string, body string) nazahttp.HttpRespMsgCtx {
+		_, err := cconn.Write([]byte(method + " " + uri + " RTSP/1.0\r\nCSeq: 1\r\n" + headers + "\r\n" + body))
+		assert.Equal(t, nil, err)
+		ctx, err := nazahttp.ReadHttpResponseMessage(r)
+		assert.Equal(t, nil, err)
+		return ctx
+	}
+	readRtpSeq := func() uint16 {
+		isInterleaved, packet, _, err := readInterleaved(r)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, isInterleaved)
+		h, err := rtprtcp.ParseRtpHeader(packet)
+		assert.Equal(t, nil, err)
+		return h.Seq
+	}
+	makePacket := func(pt uint8, seq uint16, payload []byte) rtprtcp.RtpPacket {
+		h := rtprtcp.MakeDefaultRtpHeader()
+		h.PacketType = pt
+		h.Seq = seq
+		return rtprtcp.MakeRtpPacket(h, payload)
+	}
+	uri := "rtsp://127.0.0.1/live/test"
+
+	ctx := request(MethodOptions, uri, "", "")
+	assert.Equal(t, true, strings.Contains(ctx.Headers.Get(HeaderPublic), MethodGetParameter))
+	ctx = request(MethodGetParameter, uri, "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	ctx = request(MethodSetParameter, uri, "Content-Length: 3\r\n", "a=b")
+	assert.Equal(t, "451", ctx.StatusCode)
+	// 没有拉流时不支持暂停
+	ctx = request(MethodPause, uri, "", "")
+	assert.Equal(t, "455", ctx.StatusCode)
+
+	ctx = request(MethodDescribe, uri, "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	ctx = request(MethodSetup, uri+"/streamid=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1\r\n", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, sessionId+";timeout=1", ctx.Headers.Get(HeaderSession))
+	ctx = request(MethodSetup, uri+"/streamid=1", "Transport: RTP/AVP/TCP;unicast;interleaved=2-3\r\n", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	ctx = request(MethodPlay, uri, "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	sub := observer.subSession
+	assert.IsNotNil(t, sub)
+
+	sub.WriteRtpPacket(makePacket(97, 1, []byte{0x01}))
+	assert.Equal(t, uint16(1), readRtpSeq())
+
+	// 暂停期间不发送
+	ctx = request(MethodPause, uri, "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, true, sub.IsPaused())
+	sub.WriteRtpPacket(makePacket(97, 2, []byte{0x01}))
+
+	// 恢复后从视频关键帧开始发送
+	ctx = request(MethodPlay, uri, "", "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	sub.WriteRtpPacket(makePacket(97, 3, []byte{0x01}))
+	sub.WriteRtpPacket(makePacket(96, 4, []byte{0x41, 0x01}))
+	sub.WriteRtpPacket(makePacket(96, 5, []byte{0x65, 0x01}))
+	sub.WriteRtpPacket(makePacket(97, 6, []byte{0x01}))
+	assert.Equal(t, uint16(5), readRtpSeq())
+	assert.Equal(t, uint16(6), readRtpSeq())
+	assert.Equal(t, false, sub.IsPaused())
+
+	// 不再发送任何数据，等待超时
+	select {
+	case <-doneChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not timeout")
+	}
+}
@@ -66,6 +66,11 @@ func (session *PubSession) GetSdp() sdp.LogicContext {
 	return session.baseInSession.GetSdp()
 }
 
+// RequestKeyFrame 文档请参考： BaseInSession.RequestKeyFrame
+func (session *PubSession) RequestKeyFrame() {
+	session.baseInSession.RequestKeyFrame()
+}
+
 func (session *PubSession) HandleInterleavedPacket(b []byte, channel int) {
 	session.baseInSession.HandleInterleavedPacket(b, channel)
 }
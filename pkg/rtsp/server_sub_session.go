@@ -9,6 +9,8 @@
 package rtsp
 
 import (
+	"sync"
+
 	"github.com/ysjhlnu/lal/pkg/base"
 	"github.com/ysjhlnu/lal/pkg/rtprtcp"
 	"github.com/ysjhlnu/lal/pkg/sdp"
@@ -22,6 +24,18 @@ type SubSession struct {
 	baseOutSession *BaseOutSession
 
 	ShouldWaitVideoKeyFrame bool
+
+	multicastManager  *MulticastManager
+	multicast         *multicastOutput // 不为nil时，表示该路流可以使用组播
+	isMulticastSetup  bool
+	multicastDoneOnce sync.Once
+
+	pauseMutex             sync.Mutex
+	isPaused               bool
+	isWaitKeyFrameOnResume bool // 恢复播放后，从视频关键帧开始发送
+
+	vodObserver IVodObserver // 不为nil时，表示为点播，见 IVodObserver
+	vodStopOnce sync.Once
 }
 
 func NewSubSession(urlCtx base.UrlContext, cmdSession *ServerCommandSession) *SubSession {
@@ -47,6 +61,21 @@ func (session *SubSession) InitWithSdp(sdpCtx sdp.LogicContext) {
 	session.baseOutSession.InitWithSdp(sdpCtx)
 }
 
+// SetVodObserver 设置后该拉流进入点播模式，需要在 IServerObserver.OnNewRtspSubSessionDescribe 回调中调用
+func (session *SubSession) SetVodObserver(observer IVodObserver) {
+	session.vodObserver = observer
+}
+
+func (session *SubSession) IsVod() bool {
+	return session.vodObserver != nil
+}
+
+// WithOnKeyFrameRequest 拉流端通过rtcp PLI或FIR请求视频关键帧时回调，需要在 IServerObserver.OnNewRtspSubSessionDescribe 回调中调用
+func (session *SubSession) WithOnKeyFrameRequest(onKeyFrameRequest func()) *SubSession {
+	session.baseOutSession.WithOnKeyFrameRequest(onKeyFrameRequest)
+	return session
+}
+
 func (session *SubSession) SetupWithConn(uri string, rtpConn, rtcpConn *nazanet.UdpConnection) error {
 	return session.baseOutSession.SetupWithConn(uri, rtpConn, rtcpConn)
 }
@@ -55,12 +84,54 @@ func (session *SubSession) SetupWithChannel(uri string, rtpChannel, rtcpChannel
 	return session.baseOutSession.SetupWithChannel(uri, rtpChannel, rtcpChannel)
 }
 
+// SetupWithMulticast 组播模式的SETUP
+//
+// @return 组播地址，以及该track使用的rtp、rtcp端口，ttl
+func (session *SubSession) SetupWithMulticast(uri string) (addr string, rtpPort, rtcpPort, ttl int, err error) {
+	if session.multicast == nil {
+		return "", 0, 0, 0, nazaerrors.Wrap(base.ErrRtspUnsupportedTransport)
+	}
+	if rtpPort, rtcpPort, err = session.multicast.setup(uri); err != nil {
+		return "", 0, 0, 0, err
+	}
+	session.isMulticastSetup = true
+	return session.multicast.addr, rtpPort, rtcpPort, session.multicast.ttl, nil
+}
+
 func (session *SubSession) WriteRtpPacket(packet rtprtcp.RtpPacket) {
+	if !session.checkPause(packet) {
+		return
+	}
+	if session.isMulticastSetup {
+		session.multicast.writeRtpPacket(session, packet)
+	}
 	session.baseOutSession.WriteRtpPacket(packet)
 }
 
+// WriteTrackRtpPacket 见 BaseOutSession.WriteTrackRtpPacket
+func (session *SubSession) WriteTrackRtpPacket(trackIndex int, packet rtprtcp.RtpPacket) {
+	if session.IsPaused() {
+		return
+	}
+	if session.isMulticastSetup {
+		session.multicast.writeTrackRtpPacket(session, trackIndex, packet)
+	}
+	_ = session.baseOutSession.WriteTrackRtpPacket(trackIndex, packet)
+}
+
 func (session *SubSession) Dispose() error {
 	Log.Infof("[%s] lifecycle dispose rtsp SubSession. session=%p", session.UniqueKey(), session)
+	session.multicastDoneOnce.Do(func() {
+		if session.multicast != nil {
+			session.multicast.delPlayer(session)
+			session.multicastManager.release(session.multicast)
+		}
+	})
+	session.vodStopOnce.Do(func() {
+		if session.vodObserver != nil {
+			session.vodObserver.OnVodStop()
+		}
+	})
 	e1 := session.baseOutSession.Dispose()
 	e2 := session.cmdSession.Dispose()
 	return nazaerrors.CombineErrors(e1, e2)
@@ -104,6 +175,93 @@ func (session *SubSession) IsAlive() (readAlive, writeAlive bool) {
 	return session.baseOutSession.IsAlive()
 }
 
+// initMulticast 供 ServerCommandSession 调用
+func (session *SubSession) initMulticast(m *MulticastManager, output *multicastOutput) {
+	session.multicastManager = m
+	session.multicast = output
+}
+
+// startMulticast 供 ServerCommandSession 在PLAY时调用
+func (session *SubSession) startMulticast() {
+	if session.isMulticastSetup {
+		session.multicast.addPlayer(session)
+	}
+}
+
+// IsPaused 是否处于暂停状态，包括恢复播放后还没有等到视频关键帧
+func (session *SubSession) IsPaused() bool {
+	session.pauseMutex.Lock()
+	defer session.pauseMutex.Unlock()
+	return session.isPaused || session.isWaitKeyFrameOnResume
+}
+
+// pause 供 ServerCommandSession 在PAUSE时调用
+func (session *SubSession) pause() {
+	session.pauseMutex.Lock()
+	session.isPaused = true
+	session.pauseMutex.Unlock()
+
+	// 组播时，交给其他拉流者发送
+	if session.isMulticastSetup {
+		session.multicast.delPlayer(session)
+	}
+}
+
+// resume 供 ServerCommandSession 在PLAY时调用
+//
+// @return 如果之前没有暂停，返回false
+func (session *SubSession) resume() bool {
+	session.pauseMutex.Lock()
+	if !session.isPaused {
+		session.pauseMutex.Unlock()
+		return false
+	}
+	session.isPaused = false
+	switch session.baseOutSession.sdpCtx.GetVideoPayloadTypeBase() {
+	case base.AvPacketPtAvc, base.AvPacketPtHevc, base.AvPacketPtAv1, base.AvPacketPtVp9:
+		session.isWaitKeyFrameOnResume = true
+	}
+	session.pauseMutex.Unlock()
+
+	if session.isMulticastSetup {
+		session.multicast.addPlayer(session)
+	}
+	return true
+}
+
+// checkPause 返回false表示暂停中，不发送
+func (session *SubSession) checkPause(packet rtprtcp.RtpPacket) bool {
+	session.pauseMutex.Lock()
+	defer session.pauseMutex.Unlock()
+
+	if session.isPaused {
+		return false
+	}
+	if !session.isWaitKeyFrameOnResume {
+		return true
+	}
+
+	sdpCtx := &session.baseOutSession.sdpCtx
+	if !sdpCtx.IsVideoPayloadTypeOrigin(int(packet.Header.PacketType)) {
+		return false
+	}
+	var boundary bool
+	switch sdpCtx.GetVideoPayloadTypeBase() {
+	case base.AvPacketPtAvc:
+		boundary = rtprtcp.IsAvcBoundary(packet)
+	case base.AvPacketPtHevc:
+		boundary = rtprtcp.IsHevcBoundary(packet)
+	case base.AvPacketPtAv1:
+		boundary = rtprtcp.IsAv1Boundary(packet)
+	case base.AvPacketPtVp9:
+		boundary = rtprtcp.IsVp9Boundary(packet)
+	}
+	if boundary {
+		session.isWaitKeyFrameOnResume = false
+	}
+	return boundary
+}
+
 // WriteInterleavedPacket IInterleavedPacketWriter, callback by BaseOutSession
 func (session *SubSession) WriteInterleavedPacket(packet []byte, channel int) error {
 	return session.cmdSession.WriteInterleavedPacket(packet, channel)
@@ -0,0 +1,107 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RTSP点播
+//
+// 上层在 IServerObserver.OnNewRtspSubSessionDescribe 回调中调用 SubSession.SetVodObserver ，该拉流即进入点播模式，
+// 之后的PLAY（包括seek、倍速、暂停后恢复）和PAUSE信令都交给 IVodObserver 处理，不再回调 IServerObserver.OnNewRtspSubSessionPlay 。
+
+type IVodObserver interface {
+	// OnVodPlay
+	//
+	// @param playRange 请求的播放范围，nil表示请求中没有Range，此时从当前位置继续播放
+	// @param scale     播放倍速，大于0
+	//
+	// @return startMs    实际的起始位置，单位毫秒，相对于文件开头
+	// @return durationMs 文件总时长，单位毫秒
+	// @return err        如果返回非nil，则回复457 Invalid Range
+	//
+	OnVodPlay(playRange *PlayRange, scale float64) (startMs, durationMs int64, err error)
+
+	OnVodPause()
+
+	// OnVodStop 拉流结束时回调，只回调一次
+	OnVodStop()
+}
+
+// PlayRange PLAY信令中Range的起始位置，结束位置目前忽略，总是播放到文件结尾
+type PlayRange struct {
+	IsClock bool // true表示`clock=`格式，使用 StartClock ，否则为`npt=`格式，使用 StartMs
+
+	IsNow      bool  // `npt=now-`
+	StartMs    int64 // 单位毫秒
+	StartClock time.Time
+}
+
+// ParseRange
+//
+// 支持以下格式（rfc2326 3.6, 3.7）：
+//
+// npt=10-
+// npt=10.5-20
+// npt=0:01:10.5-
+// npt=now-
+// clock=20221018T100000Z-
+// clock=20221018T100000.25Z-20221018T110000Z
+func ParseRange(value string) (r PlayRange, err error) {
+	// e.g. `npt=10-;time=19970123T143720Z`
+	value = strings.TrimSpace(strings.Split(value, ";")[0])
+
+	items := strings.SplitN(value, "=", 2)
+	if len(items) != 2 {
+		return r, fmt.Errorf("%w. invalid range. value=%s", base.ErrRtsp, value)
+	}
+	start := strings.TrimSpace(strings.SplitN(items[1], "-", 2)[0])
+
+	switch strings.TrimSpace(items[0]) {
+	case "npt":
+		if start == "now" {
+			r.IsNow = true
+			return
+		}
+		if start == "" {
+			return
+		}
+		r.StartMs, err = parseNpt(start)
+	case "clock":
+		r.IsClock = true
+		r.StartClock, err = time.Parse("20060102T150405Z", start)
+	default:
+		err = fmt.Errorf("%w. unsupported range unit. value=%s", base.ErrRtsp, value)
+	}
+	return
+}
+
+// ParseScale 解析Scale头，比如`2`，`0.5`，`-1`
+func ParseScale(value string) (float64, error) {
+	return strconv.ParseFloat(strings.TrimSpace(value), 64)
+}
+
+// parseNpt 解析`10.5`或`0:01:10.5`格式的npt时间，返回毫秒
+func parseNpt(s string) (int64, error) {
+	var sec float64
+	for _, item := range strings.Split(s, ":") {
+		v, err := strconv.ParseFloat(item, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("%w. invalid npt. value=%s", base.ErrRtsp, s)
+		}
+		sec = sec*60 + v
+	}
+	return int64(sec*1000 + 0.5), nil
+}
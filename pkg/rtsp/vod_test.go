@@ -0,0 +1,150 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazahttp"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+func TestParseRange(t *testing.T) {
+	golden := map[string]int64{
+		"npt=0.000-":              0,
+		"npt=10-":                 10000,
+		"npt=10.5-20":             10500,
+		"npt=0:01:10.5-":          70500,
+		"npt=-20":                 0,
+		"npt=10-;time=19970123T1": 10000,
+	}
+	for in, out := range golden {
+		r, err := ParseRange(in)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, r.IsClock)
+		assert.Equal(t, out, r.StartMs)
+	}
+
+	r, err := ParseRange("npt=now-")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, r.IsNow)
+
+	r, err = ParseRange("clock=20221018T100000.25Z-20221018T110000Z")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, r.IsClock)
+	assert.Equal(t, time.Date(2022, 10, 18, 10, 0, 0, 250*1e6, time.UTC), r.StartClock)
+
+	for _, in := range []string{"npt", "npt=abc-", "npt=1:x-", "smpte=10:07:00-", "clock=2022-"} {
+		_, err = ParseRange(in)
+		assert.IsNotNil(t, err)
+	}
+}
+
+type vodTestObserver struct {
+	commandSessionTestObserver
+
+	playRange *PlayRange
+	scale     float64
+	paused    bool
+	stopped   bool
+}
+
+func (o *vodTestObserver) OnNewRtspSubSessionDescribe(session *SubSession) (ok bool, sdp []byte) {
+	session.SetVodObserver(o)
+	return true, []byte(multicastTestSdp)
+}
+
+func (o *vodTestObserver) OnNewRtspSubSessionPlay(session *SubSession) error {
+	return base.ErrRtsp
+}
+
+func (o *vodTestObserver) OnVodPlay(playRange *PlayRange, scale float64) (startMs, durationMs int64, err error) {
+	o.playRange = playRange
+	o.scale = scale
+	o.paused = false
+	if playRange != nil {
+		if playRange.StartMs > 60000 {
+			return 0, 0, base.ErrRtsp
+		}
+		startMs = playRange.StartMs
+	}
+	return startMs, 60000, nil
+}
+
+func (o *vodTestObserver) OnVodPause() {
+	o.paused = true
+}
+
+func (o *vodTestObserver) OnVodStop() {
+	o.stopped = true
+}
+
+func TestVod(t *testing.T) {
+	sconn, cconn := net.Pipe()
+	defer cconn.Close()
+
+	observer := &vodTestObserver{}
+	session := NewServerCommandSession(observer, sconn, nil)
+	go func() {
+		_ = session.RunLoop()
+	}()
+
+	r := bufio.NewReader(cconn)
+	request := func(method string, headers string) nazahttp.HttpRespMsgCtx {
+		_, err := cconn.Write([]byte(method + " rtsp://127.0.0.1/vod/test.flv RTSP/1.0\r\nCSeq: 1\r\n" + headers + "\r\n"))
+		assert.Equal(t, nil, err)
+		ctx, err := nazahttp.ReadHttpResponseMessage(r)
+		assert.Equal(t, nil, err)
+		return ctx
+	}
+
+	ctx := request(MethodDescribe, "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, true, session.subSession.IsVod())
+
+	// 首次播放，没有Range和Scale
+	ctx = request(MethodPlay, "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, "npt=0.000-60.000", ctx.Headers.Get(HeaderRange))
+	assert.Equal(t, "1", ctx.Headers.Get(HeaderScale))
+	assert.Equal(t, (*PlayRange)(nil), observer.playRange)
+
+	ctx = request(MethodPause, "")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, true, observer.paused)
+
+	// seek并倍速
+	ctx = request(MethodPlay, "Range: npt=10.5-\r\nScale: 2.0\r\n")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, "npt=10.500-60.000", ctx.Headers.Get(HeaderRange))
+	assert.Equal(t, "2", ctx.Headers.Get(HeaderScale))
+	assert.Equal(t, int64(10500), observer.playRange.StartMs)
+	assert.Equal(t, 2.0, observer.scale)
+	assert.Equal(t, false, observer.paused)
+
+	// 不支持倒放
+	ctx = request(MethodPlay, "Scale: -1\r\n")
+	assert.Equal(t, "200", ctx.StatusCode)
+	assert.Equal(t, "1", ctx.Headers.Get(HeaderScale))
+
+	// 非法的Range，以及超出文件范围
+	ctx = request(MethodPlay, "Range: npt=abc-\r\n")
+	assert.Equal(t, "457", ctx.StatusCode)
+	ctx = request(MethodPlay, "Range: npt=100-\r\n")
+	assert.Equal(t, "457", ctx.StatusCode)
+
+	_ = session.subSession.Dispose()
+	_ = session.subSession.Dispose()
+	assert.Equal(t, true, observer.stopped)
+}
@@ -0,0 +1,209 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// RTSP over WebSocket，供浏览器端的rtsp播放器使用
+//
+// WebSocket连接上传输的内容，和RTSP TCP连接上的内容完全一致，即rtsp信令以及interleaved模式的rtp、rtcp数据，
+// 服务端发送时，每个rtsp信令响应或者每个interleaved包为一个binary帧，
+// 客户端发送时，不要求帧边界和rtsp信令对齐，text帧和binary帧都支持。
+
+// maxWebSocketPayloadSize 客户端单个WebSocket帧的最大长度
+const maxWebSocketPayloadSize = 1024 * 1024
+
+// IsWebSocketRequest 是否为WebSocket的请求
+func IsWebSocketRequest(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade")
+}
+
+// ServeWebSocket 供http服务回调，函数签名和 base.Handler 一致
+func (s *Server) ServeWebSocket(writer http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !IsWebSocketRequest(req) || key == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	conn, bio, err := writer.(http.Hijacker).Hijack()
+	if err != nil {
+		Log.Errorf("hijack failed. err=%+v", err)
+		return
+	}
+
+	if _, err = conn.Write(packWebSocketResponse(key, req.Header.Get("Sec-WebSocket-Protocol"))); err != nil {
+		_ = conn.Close()
+		return
+	}
+	Log.Infof("new rtsp over websocket. raddr=%s, path=%s", conn.RemoteAddr().String(), req.URL.Path)
+
+	s.handleTcpConnect(newWebSocketConn(conn, bio.Reader))
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+func packWebSocketResponse(key string, protocols string) []byte {
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Server: " + base.LalRtspOptionsResponseServer + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base.MakeWsAcceptKey(key) + "\r\n"
+
+	// 浏览器要求，如果请求中携带了子协议，响应中必须从中选择一个，这里直接选择第一个
+	if protocols != "" {
+		resp += "Sec-WebSocket-Protocol: " + strings.TrimSpace(strings.Split(protocols, ",")[0]) + "\r\n"
+	}
+	return []byte(resp + "\r\n")
+}
+
+// webSocketConn 将WebSocket连接封装成 net.Conn ，从而复用 ServerCommandSession 的逻辑
+type webSocketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	pending []byte // 已解帧但还没有被读走的数据
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+}
+
+func newWebSocketConn(conn net.Conn, r *bufio.Reader) *webSocketConn {
+	return &webSocketConn{
+		conn: conn,
+		r:    r,
+	}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write 每次调用发送一个binary帧
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(base.Wso_Binary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) readFrame() error {
+	var h [8]byte
+	if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+		return err
+	}
+	opcode := h[0] & 0x0F
+	masked := h[1]&0x80 != 0
+	length := uint64(h[1] & 0x7F)
+	switch length {
+	case 126:
+		if _, err := io.ReadFull(c.r, h[:2]); err != nil {
+			return err
+		}
+		length = uint64(bele.BeUint16(h[:2]))
+	case 127:
+		if _, err := io.ReadFull(c.r, h[:8]); err != nil {
+			return err
+		}
+		length = bele.BeUint64(h[:8])
+	}
+	if length > maxWebSocketPayloadSize {
+		return nazaerrors.Wrap(base.ErrRtsp)
+	}
+
+	var maskKey [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.r, maskKey[:]); err != nil {
+			return err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= maskKey[i%4]
+		}
+	}
+
+	switch opcode {
+	case base.Wso_Continuous, base.Wso_Text, base.Wso_Binary:
+		c.pending = payload
+	case base.Wso_Ping:
+		return c.writeFrame(base.Wso_Pong, payload)
+	case base.Wso_Close:
+		_ = c.writeFrame(base.Wso_Close, nil)
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *webSocketConn) writeFrame(opcode base.WsOpcode, payload []byte) error {
+	header := base.MakeWsFrameHeader(base.WsHeader{
+		Fin:           true,
+		Opcode:        opcode,
+		PayloadLength: uint64(len(payload)),
+	})
+
+	// 注意，pong可能和rtp数据并发发送
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
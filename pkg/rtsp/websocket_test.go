@@ -0,0 +1,100 @@
+// Copyright 2022, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package rtsp_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/rtsp"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/bele"
+)
+
+func TestWebSocket(t *testing.T) {
+	s := rtsp.NewServer("", &tunnelServerObserver{}, rtsp.ServerAuthConfig{})
+	hs := httptest.NewServer(http.HandlerFunc(s.ServeWebSocket))
+	defer hs.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(hs.URL, "http://"))
+	assert.Equal(t, nil, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /live/test HTTP/1.1\r\n" +
+		"Host: 127.0.0.1\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" +
+		"Sec-WebSocket-Protocol: rtsp, binary\r\n\r\n"))
+	assert.Equal(t, nil, err)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "rtsp", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	writeFrame := func(opcode base.WsOpcode, payload []byte) {
+		maskKey := uint32(0x12345678)
+		header := base.MakeWsFrameHeader(base.WsHeader{
+			Fin:           true,
+			Opcode:        opcode,
+			PayloadLength: uint64(len(payload)),
+			Masked:        true,
+			MaskKey:       maskKey,
+		})
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ byte(maskKey>>(8*(i%4)))
+		}
+		_, err := conn.Write(append(header, masked...))
+		assert.Equal(t, nil, err)
+	}
+	readFrame := func() (base.WsOpcode, []byte) {
+		var h [2]byte
+		_, err := io.ReadFull(r, h[:])
+		assert.Equal(t, nil, err)
+		assert.Equal(t, uint8(0), h[1]&0x80)
+		opcode := h[0] & 0x0F
+		length := int(h[1] & 0x7F)
+		if length == 126 {
+			_, err = io.ReadFull(r, h[:])
+			assert.Equal(t, nil, err)
+			length = int(bele.BeUint16(h[:]))
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(r, payload)
+		assert.Equal(t, nil, err)
+		return opcode, payload
+	}
+
+	writeFrame(base.Wso_Ping, []byte("hi"))
+	opcode, payload := readFrame()
+	assert.Equal(t, base.Wso_Pong, opcode)
+	assert.Equal(t, "hi", string(payload))
+
+	// 一个rtsp信令拆分在两个帧中发送
+	req := "OPTIONS rtsp://127.0.0.1/live/test RTSP/1.0\r\nCSeq: 1\r\n\r\n"
+	writeFrame(base.Wso_Text, []byte(req[:10]))
+	writeFrame(base.Wso_Binary, []byte(req[10:]))
+	opcode, payload = readFrame()
+	assert.Equal(t, base.Wso_Binary, opcode)
+	assert.Equal(t, rtsp.PackResponseOptions("1"), string(payload))
+
+	writeFrame(base.Wso_Close, nil)
+	opcode, _ = readFrame()
+	assert.Equal(t, base.Wso_Close, opcode)
+}
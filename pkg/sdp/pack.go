@@ -29,6 +29,16 @@ type AudioInfo struct {
 }
 
 func Pack(videoInfo VideoInfo, audioInfo AudioInfo) (ctx LogicContext, err error) {
+	return PackWithExtraTracks(videoInfo, audioInfo, nil, nil)
+}
+
+// PackWithExtraTracks
+//
+// 除主视频、主音频外，追加其他track，比如Enhanced RTMP multitrack中的非默认track。
+// 追加的track在sdp中排在主视频、主音频之后，顺序为 extraVideos、extraAudios，
+// 可通过 LogicContext.ExtraTracks 获取对应的 TrackContext.Index。
+// 无法生成sdp信息的track会被忽略。
+func PackWithExtraTracks(videoInfo VideoInfo, audioInfo AudioInfo, extraVideos []VideoInfo, extraAudios []AudioInfo) (ctx LogicContext, err error) {
 	// 组装SDP头部
 	sdpStr := fmt.Sprintf(`v=0
 o=- 0 0 IN IP4 127.0.0.1
@@ -50,6 +60,21 @@ a=tool:%s
 	audioSdpStr := buildAudioSdpInfo(audioInfo, streamid)
 	if audioSdpStr != "" {
 		sdpStr += audioSdpStr
+		streamid++
+	}
+
+	// 组装其他track的SDP信息
+	for _, vi := range extraVideos {
+		if str := buildVideoSdpInfo(vi, streamid); str != "" {
+			sdpStr += str
+			streamid++
+		}
+	}
+	for _, ai := range extraAudios {
+		if str := buildAudioSdpInfo(ai, streamid); str != "" {
+			sdpStr += str
+			streamid++
+		}
 	}
 
 	if videoSdpStr == "" && audioSdpStr == "" {
@@ -84,6 +109,18 @@ a=fmtp:98 profile-id=1;sprop-sps=%s;sprop-pps=%s;sprop-vps=%s
 a=control:streamid=%d
 `
 		return fmt.Sprintf(tmpl, base.AvPacketPtHevc, base64.StdEncoding.EncodeToString(videoInfo.Sps), base64.StdEncoding.EncodeToString(videoInfo.Pps), base64.StdEncoding.EncodeToString(videoInfo.Vps), streamid)
+	} else if videoInfo.VideoPt == base.AvPacketPtAv1 || videoInfo.VideoPt == base.AvPacketPtVp9 {
+		// AV1和VP9的编码参数在rtp数据包中带内传输，sdp中不需要携带
+		name := ARtpMapEncodingNameAv1
+		if videoInfo.VideoPt == base.AvPacketPtVp9 {
+			name = ARtpMapEncodingNameVp9
+		}
+
+		tmpl := `m=video 0 RTP/AVP %d
+a=rtpmap:%d %s/90000
+a=control:streamid=%d
+`
+		return fmt.Sprintf(tmpl, videoInfo.VideoPt, videoInfo.VideoPt, name, streamid)
 	}
 
 	return ""
@@ -114,6 +151,13 @@ a=rtpmap:%d PCMU/%d
 a=control:streamid=%d
 `
 		return fmt.Sprintf(tmpl, base.AvPacketPtG711U, base.AvPacketPtG711U, audioInfo.SamplingFrequency, streamid)
+	} else if audioInfo.AudioPt == base.AvPacketPtOpus {
+		// rfc7587，无论实际采样率和声道数，固定为48000/2
+		tmpl := `m=audio 0 RTP/AVP %d
+a=rtpmap:%d opus/48000/2
+a=control:streamid=%d
+`
+		return fmt.Sprintf(tmpl, base.AvPacketPtOpus, base.AvPacketPtOpus, streamid)
 	}
 
 	return ""
@@ -159,4 +159,59 @@ func TestSdpPack(t *testing.T) {
 		assert.Equal(t, hevcvps, sdpctx.Vps)
 		assert.Equal(t, asc, sdpctx.Asc)
 	}
+	{
+		// av1和vp9
+		for _, pt := range []base.AvPacketPt{base.AvPacketPtAv1, base.AvPacketPtVp9} {
+			video := VideoInfo{
+				VideoPt: pt,
+			}
+			audio := AudioInfo{
+				AudioPt: base.AvPacketPtUnknown,
+			}
+			sdpctx, err := Pack(video, audio)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, pt, sdpctx.GetVideoPayloadTypeBase())
+			assert.Equal(t, true, sdpctx.IsVideoUnpackable())
+			assert.Equal(t, 90000, sdpctx.VideoClockRate)
+		}
+	}
+	{
+		// opus
+		video := VideoInfo{
+			VideoPt: base.AvPacketPtUnknown,
+		}
+		audio := AudioInfo{
+			AudioPt: base.AvPacketPtOpus,
+		}
+		sdpctx, err := Pack(video, audio)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, base.AvPacketPtOpus, sdpctx.GetAudioPayloadTypeBase())
+		assert.Equal(t, true, sdpctx.IsAudioUnpackable())
+		assert.Equal(t, 48000, sdpctx.AudioClockRate)
+	}
+	{
+		// 多track
+		video := VideoInfo{
+			VideoPt: base.AvPacketPtAvc,
+			Sps:     avcsps,
+			Pps:     avcpps,
+		}
+		audio := AudioInfo{
+			AudioPt:           base.AvPacketPtAac,
+			SamplingFrequency: 44100,
+			Asc:               asc,
+		}
+		extraVideos := []VideoInfo{{VideoPt: base.AvPacketPtAv1}}
+		extraAudios := []AudioInfo{{AudioPt: base.AvPacketPtOpus}, {AudioPt: base.AvPacketPtUnknown}}
+		sdpctx, err := PackWithExtraTracks(video, audio, extraVideos, extraAudios)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, avcsps, sdpctx.Sps)
+		assert.Equal(t, asc, sdpctx.Asc)
+		extra := sdpctx.ExtraTracks()
+		assert.Equal(t, 2, len(extra))
+		assert.Equal(t, 2, extra[0].Index)
+		assert.Equal(t, base.AvPacketPtAv1, extra[0].PayloadTypeBase)
+		assert.Equal(t, 3, extra[1].Index)
+		assert.Equal(t, base.AvPacketPtOpus, extra[1].PayloadTypeBase)
+	}
 }
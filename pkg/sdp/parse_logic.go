@@ -37,6 +37,52 @@ type LogicContext struct {
 	// 没有用上的
 	hasAudio bool
 	hasVideo bool
+
+	// Tracks sdp中所有的媒体描述，按sdp中的顺序排列，包含主音频、主视频
+	Tracks              []TrackContext
+	primaryTrackIndexes []int
+}
+
+// TrackContext sdp中一个媒体描述（m=）对应的信息
+type TrackContext struct {
+	Index int // 在sdp中的序号，从0开始
+
+	Media             string // audio、video、application
+	EncodingName      string
+	ClockRate         int
+	PayloadTypeOrigin int
+	PayloadTypeBase   base.AvPacketPt // 不支持的类型为 base.AvPacketPtUnknown
+	AControl          string
+
+	Asc []byte
+	Vps []byte
+	Sps []byte
+	Pps []byte
+}
+
+// IsOnvifMetadata ONVIF元数据，rtp负载为xml
+func (t *TrackContext) IsOnvifMetadata() bool {
+	return t.Media == MediaTypeApplication && strings.EqualFold(t.EncodingName, ARtpMapEncodingNameOnvifMetadata)
+}
+
+// IsUnpackable 是否支持将rtp合帧为 base.AvPacket
+func (t *TrackContext) IsUnpackable() bool {
+	switch t.PayloadTypeBase {
+	case base.AvPacketPtAac:
+		return t.Asc != nil
+	case base.AvPacketPtG711A, base.AvPacketPtG711U, base.AvPacketPtAvc, base.AvPacketPtHevc,
+		base.AvPacketPtAv1, base.AvPacketPtVp9, base.AvPacketPtOpus:
+		return true
+	}
+	return false
+}
+
+func (t *TrackContext) IsUri(uri string) bool {
+	return t.AControl != "" && strings.HasSuffix(uri, t.AControl)
+}
+
+func (t *TrackContext) MakeSetupUri(uri string) string {
+	return makeSetupUri(uri, t.AControl)
 }
 
 func (lc *LogicContext) IsAudioPayloadTypeOrigin(t int) bool {
@@ -52,12 +98,15 @@ func (lc *LogicContext) IsPayloadTypeOrigin(t int) bool {
 }
 
 func (lc *LogicContext) IsAudioUnpackable() bool {
-	return (lc.audioPayloadTypeBase == base.AvPacketPtAac && lc.Asc != nil) || (lc.audioPayloadTypeBase == base.AvPacketPtG711A) || (lc.audioPayloadTypeBase == base.AvPacketPtG711U)
+	return (lc.audioPayloadTypeBase == base.AvPacketPtAac && lc.Asc != nil) || (lc.audioPayloadTypeBase == base.AvPacketPtG711A) || (lc.audioPayloadTypeBase == base.AvPacketPtG711U) ||
+		(lc.audioPayloadTypeBase == base.AvPacketPtOpus)
 }
 
 func (lc *LogicContext) IsVideoUnpackable() bool {
 	return lc.videoPayloadTypeBase == base.AvPacketPtAvc ||
-		lc.videoPayloadTypeBase == base.AvPacketPtHevc
+		lc.videoPayloadTypeBase == base.AvPacketPtHevc ||
+		lc.videoPayloadTypeBase == base.AvPacketPtAv1 ||
+		lc.videoPayloadTypeBase == base.AvPacketPtVp9
 }
 
 func (lc *LogicContext) IsAudioUri(uri string) bool {
@@ -77,11 +126,33 @@ func (lc *LogicContext) HasVideoAControl() bool {
 }
 
 func (lc *LogicContext) MakeAudioSetupUri(uri string) string {
-	return lc.makeSetupUri(uri, lc.audioAControl)
+	return makeSetupUri(uri, lc.audioAControl)
 }
 
 func (lc *LogicContext) MakeVideoSetupUri(uri string) string {
-	return lc.makeSetupUri(uri, lc.videoAControl)
+	return makeSetupUri(uri, lc.videoAControl)
+}
+
+// ExtraTracks 主音频、主视频之外的其他track，比如第二路音频、ONVIF元数据
+func (lc *LogicContext) ExtraTracks() []TrackContext {
+	var ret []TrackContext
+	for _, track := range lc.Tracks {
+		if lc.isPrimaryTrack(track.Index) {
+			continue
+		}
+		ret = append(ret, track)
+	}
+	return ret
+}
+
+// GetExtraTrackByUri 注意，主音频、主视频请使用 IsAudioUri 和 IsVideoUri 判断
+func (lc *LogicContext) GetExtraTrackByUri(uri string) (TrackContext, bool) {
+	for _, track := range lc.ExtraTracks() {
+		if track.IsUri(uri) {
+			return track, true
+		}
+	}
+	return TrackContext{}, false
 }
 
 func (lc *LogicContext) GetAudioPayloadTypeBase() base.AvPacketPt {
@@ -92,7 +163,16 @@ func (lc *LogicContext) GetVideoPayloadTypeBase() base.AvPacketPt {
 	return lc.videoPayloadTypeBase
 }
 
-func (lc *LogicContext) makeSetupUri(uri string, aControl string) string {
+func (lc *LogicContext) isPrimaryTrack(index int) bool {
+	for _, i := range lc.primaryTrackIndexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+func makeSetupUri(uri string, aControl string) string {
 	if strings.HasPrefix(aControl, "rtsp://") {
 		return aControl
 	}
@@ -107,87 +187,126 @@ func ParseSdp2LogicContext(b []byte) (LogicContext, error) {
 		return ret, err
 	}
 
-	for _, md := range c.MediaDescList {
-		switch md.M.Media {
-		case "audio":
+	for i, md := range c.MediaDescList {
+		track := parseTrack(md)
+		track.Index = i
+		ret.Tracks = append(ret.Tracks, track)
+
+		// 注意，存在多路音频或视频时，第一路作为主音频、主视频，其余的见 ExtraTracks
+		switch track.Media {
+		case MediaTypeAudio:
+			if ret.hasAudio {
+				continue
+			}
 			ret.hasAudio = true
-			ret.AudioClockRate = md.ARtpMap.ClockRate
-			ret.audioAControl = md.AControl.Value
-
-			ret.audioPayloadTypeOrigin = md.ARtpMap.PayloadType
-			if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameAac) {
-				ret.audioPayloadTypeBase = base.AvPacketPtAac
-				if md.AFmtPBase != nil {
-					ret.Asc, err = ParseAsc(md.AFmtPBase)
-					if err != nil {
-						Log.Warnf("parse asc from afmtp failed. err=%+v", err)
-					}
-				} else {
-					Log.Warnf("aac afmtp not exist.")
+			ret.AudioClockRate = track.ClockRate
+			ret.audioAControl = track.AControl
+			ret.audioPayloadTypeOrigin = track.PayloadTypeOrigin
+			ret.audioPayloadTypeBase = track.PayloadTypeBase
+			ret.Asc = track.Asc
+			ret.primaryTrackIndexes = append(ret.primaryTrackIndexes, i)
+		case MediaTypeVideo:
+			if ret.hasVideo {
+				continue
+			}
+			ret.hasVideo = true
+			ret.VideoClockRate = track.ClockRate
+			ret.videoAControl = track.AControl
+			ret.videoPayloadTypeOrigin = track.PayloadTypeOrigin
+			ret.videoPayloadTypeBase = track.PayloadTypeBase
+			ret.Vps = track.Vps
+			ret.Sps = track.Sps
+			ret.Pps = track.Pps
+			ret.primaryTrackIndexes = append(ret.primaryTrackIndexes, i)
+		}
+	}
+
+	ret.RawSdp = b
+	return ret, nil
+}
+
+func parseTrack(md MediaDesc) TrackContext {
+	var err error
+	ret := TrackContext{
+		Media:             md.M.Media,
+		EncodingName:      md.ARtpMap.EncodingName,
+		ClockRate:         md.ARtpMap.ClockRate,
+		PayloadTypeOrigin: md.ARtpMap.PayloadType,
+		PayloadTypeBase:   base.AvPacketPtUnknown,
+		AControl:          md.AControl.Value,
+	}
+
+	switch md.M.Media {
+	case MediaTypeAudio:
+		if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameAac) {
+			ret.PayloadTypeBase = base.AvPacketPtAac
+			if md.AFmtPBase != nil {
+				ret.Asc, err = ParseAsc(md.AFmtPBase)
+				if err != nil {
+					Log.Warnf("parse asc from afmtp failed. err=%+v", err)
 				}
-			} else if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameG711A) {
-				// 例子:a=rtpmap:8 PCMA/8000/1
-				// rtmpmap中有PCMA字段表示G711A
-				ret.audioPayloadTypeBase = base.AvPacketPtG711A
-			} else if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameG711U) {
-				ret.audioPayloadTypeBase = base.AvPacketPtG711U
 			} else {
-				if md.M.PT == 8 {
-					// ffmpeg推流情况下不会填充rtpmap字段,m中pt值为8也可以表示是PCMA,采样率默认为8000Hz
-					// RFC3551中表明G711A固定pt值为8
-					ret.audioPayloadTypeBase = base.AvPacketPtG711A
-					ret.audioPayloadTypeOrigin = 8
-					if ret.AudioClockRate == 0 {
-						ret.AudioClockRate = 8000
-					}
-				} else if md.M.PT == 0 {
-					// ffmpeg推流情况下不会填充rtpmap字段,m中pt值为8也可以表示是PCMU,采样率默认为8000Hz
-					// RFC3551中表明G711U固定pt值为0
-					ret.audioPayloadTypeBase = base.AvPacketPtG711U
-					ret.audioPayloadTypeOrigin = 0
-					if ret.AudioClockRate == 0 {
-						ret.AudioClockRate = 8000
-					}
-				} else {
-					ret.audioPayloadTypeBase = base.AvPacketPtUnknown
+				Log.Warnf("aac afmtp not exist.")
+			}
+		} else if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameG711A) {
+			// 例子:a=rtpmap:8 PCMA/8000/1
+			// rtmpmap中有PCMA字段表示G711A
+			ret.PayloadTypeBase = base.AvPacketPtG711A
+		} else if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameG711U) {
+			ret.PayloadTypeBase = base.AvPacketPtG711U
+		} else if strings.EqualFold(md.ARtpMap.EncodingName, ARtpMapEncodingNameOpus) {
+			// rfc7587，时钟频率固定为48000
+			ret.PayloadTypeBase = base.AvPacketPtOpus
+		} else {
+			if md.M.PT == 8 {
+				// ffmpeg推流情况下不会填充rtpmap字段,m中pt值为8也可以表示是PCMA,采样率默认为8000Hz
+				// RFC3551中表明G711A固定pt值为8
+				ret.PayloadTypeBase = base.AvPacketPtG711A
+				ret.PayloadTypeOrigin = 8
+				if ret.ClockRate == 0 {
+					ret.ClockRate = 8000
+				}
+			} else if md.M.PT == 0 {
+				// ffmpeg推流情况下不会填充rtpmap字段,m中pt值为8也可以表示是PCMU,采样率默认为8000Hz
+				// RFC3551中表明G711U固定pt值为0
+				ret.PayloadTypeBase = base.AvPacketPtG711U
+				ret.PayloadTypeOrigin = 0
+				if ret.ClockRate == 0 {
+					ret.ClockRate = 8000
 				}
 			}
-		case "video":
-			ret.hasVideo = true
-			ret.VideoClockRate = md.ARtpMap.ClockRate
-			ret.videoAControl = md.AControl.Value
-
-			ret.videoPayloadTypeOrigin = md.ARtpMap.PayloadType
-			switch md.ARtpMap.EncodingName {
-			case ARtpMapEncodingNameH264:
-				ret.videoPayloadTypeBase = base.AvPacketPtAvc
-				if md.AFmtPBase != nil {
-					ret.Sps, ret.Pps, err = ParseSpsPps(md.AFmtPBase)
-					if err != nil {
-						Log.Warnf("parse sps pps from afmtp failed. err=%+v", err)
-					}
-				} else {
-					// afmtp不存在，也即没法从sdp中解析出sps、pps。
-					// 这种情况是存在的，sps、pps可以在后续的rtp数据包中传输。
-					// 所以这里只打印警告。
-					Log.Warnf("avc afmtp not exist.")
+		}
+	case MediaTypeVideo:
+		switch md.ARtpMap.EncodingName {
+		case ARtpMapEncodingNameH264:
+			ret.PayloadTypeBase = base.AvPacketPtAvc
+			if md.AFmtPBase != nil {
+				ret.Sps, ret.Pps, err = ParseSpsPps(md.AFmtPBase)
+				if err != nil {
+					Log.Warnf("parse sps pps from afmtp failed. err=%+v", err)
 				}
-			case ARtpMapEncodingNameH265:
-				ret.videoPayloadTypeBase = base.AvPacketPtHevc
-				if md.AFmtPBase != nil {
-					ret.Vps, ret.Sps, ret.Pps, err = ParseVpsSpsPps(md.AFmtPBase)
-					if err != nil {
-						Log.Warnf("parse vps sps pps from afmtp failed. err=%+v", err)
-					}
-				} else {
-					Log.Warnf("hevc afmtp not exist.")
+			} else {
+				// afmtp不存在，也即没法从sdp中解析出sps、pps。
+				// 这种情况是存在的，sps、pps可以在后续的rtp数据包中传输。
+				// 所以这里只打印警告。
+				Log.Warnf("avc afmtp not exist.")
+			}
+		case ARtpMapEncodingNameH265:
+			ret.PayloadTypeBase = base.AvPacketPtHevc
+			if md.AFmtPBase != nil {
+				ret.Vps, ret.Sps, ret.Pps, err = ParseVpsSpsPps(md.AFmtPBase)
+				if err != nil {
+					Log.Warnf("parse vps sps pps from afmtp failed. err=%+v", err)
 				}
-			default:
-				ret.videoPayloadTypeBase = base.AvPacketPtUnknown
+			} else {
+				Log.Warnf("hevc afmtp not exist.")
 			}
+		case ARtpMapEncodingNameAv1:
+			// AV1和VP9的编码参数都在rtp数据包中带内传输
+			ret.PayloadTypeBase = base.AvPacketPtAv1
+		case ARtpMapEncodingNameVp9:
+			ret.PayloadTypeBase = base.AvPacketPtVp9
 		}
 	}
-
-	ret.RawSdp = b
-	return ret, nil
+	return ret
 }
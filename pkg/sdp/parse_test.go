@@ -600,32 +600,61 @@ a=control:streamid=1
 }
 
 func TestCase15(t *testing.T) {
-	// TODO(chef): [fix] 有多路音频的情况 202209
-	//v=0
-	//o=- 2266397444 2266397444 IN IP4 0.0.0.0
-	//s=Media Server
-	//c=IN IP4 0.0.0.0
-	//t=0 0
-	//a=control:*
-	//	a=packetization-supported:DH
-	//a=rtppayload-supported:DH
-	//a=range:npt=now-
-	//	a=x-packetization-supported:IV
-	//a=x-rtppayload-supported:IV
-	//m=video 0 RTP/AVP 96
-	//a=control:trackID=0
-	//a=framerate:25.000000
-	//a=rtpmap:96 H264/90000
-	//a=fmtp:96 packetization-mode=1;profile-level-id=64103C;sprop-parameter-sets=Z2QQPKwbGqAIAA4/lmyAAAADAIAAABlHhEI1AA==,aO4xshsA
-	//a=recvonly
-	//m=audio 0 RTP/AVP 8
-	//a=control:trackID=1
-	//a=rtpmap:8 PCMA/8000
-	//a=recvonly
-	//m=audio 0 RTP/AVP 8
-	//a=control:trackID=2
-	//a=rtpmap:8 PCMA/8000
-	//a=recvonly
+	// 有多路音频的情况
+	golden := `v=0
+o=- 2266397444 2266397444 IN IP4 0.0.0.0
+s=Media Server
+c=IN IP4 0.0.0.0
+t=0 0
+a=control:*
+a=packetization-supported:DH
+a=rtppayload-supported:DH
+a=range:npt=now-
+a=x-packetization-supported:IV
+a=x-rtppayload-supported:IV
+m=video 0 RTP/AVP 96
+a=control:trackID=0
+a=framerate:25.000000
+a=rtpmap:96 H264/90000
+a=fmtp:96 packetization-mode=1;profile-level-id=64103C;sprop-parameter-sets=Z2QQPKwbGqAIAA4/lmyAAAADAIAAABlHhEI1AA==,aO4xshsA
+a=recvonly
+m=audio 0 RTP/AVP 8
+a=control:trackID=1
+a=rtpmap:8 PCMA/8000
+a=recvonly
+m=audio 0 RTP/AVP 8
+a=control:trackID=2
+a=rtpmap:8 PCMA/8000
+a=recvonly
+m=application 0 RTP/AVP 107
+a=control:trackID=3
+a=rtpmap:107 vnd.onvif.metadata/90000
+a=recvonly
+`
+	golden = strings.ReplaceAll(golden, "\n", "\r\n")
+	ctx, err := ParseSdp2LogicContext([]byte(golden))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 4, len(ctx.Tracks))
+	assert.Equal(t, true, ctx.IsAudioUri("rtsp://127.0.0.1/live/trackID=1"))
+	assert.Equal(t, false, ctx.IsAudioUri("rtsp://127.0.0.1/live/trackID=2"))
+	assert.Equal(t, base.AvPacketPtG711A, ctx.GetAudioPayloadTypeBase())
+	assert.Equal(t, base.AvPacketPtAvc, ctx.GetVideoPayloadTypeBase())
+
+	extra := ctx.ExtraTracks()
+	assert.Equal(t, 2, len(extra))
+	assert.Equal(t, 2, extra[0].Index)
+	assert.Equal(t, base.AvPacketPtG711A, extra[0].PayloadTypeBase)
+	assert.Equal(t, true, extra[0].IsUnpackable())
+	assert.Equal(t, 3, extra[1].Index)
+	assert.Equal(t, true, extra[1].IsOnvifMetadata())
+	assert.Equal(t, false, extra[1].IsUnpackable())
+	assert.Equal(t, "rtsp://127.0.0.1/live/trackID=3", extra[1].MakeSetupUri("rtsp://127.0.0.1/live"))
+
+	track, ok := ctx.GetExtraTrackByUri("rtsp://127.0.0.1/live/trackID=3")
+	assert.Equal(t, true, ok)
+	assert.Equal(t, 3, track.Index)
+	_, ok = ctx.GetExtraTrackByUri("rtsp://127.0.0.1/live/trackID=0")
+	assert.Equal(t, false, ok)
 }
 
 func TestCase16(t *testing.T) {
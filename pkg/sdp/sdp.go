@@ -16,4 +16,15 @@ const (
 	ARtpMapEncodingNameAac   = "MPEG4-GENERIC"
 	ARtpMapEncodingNameG711A = "PCMA"
 	ARtpMapEncodingNameG711U = "PCMU"
+	ARtpMapEncodingNameAv1   = "AV1"
+	ARtpMapEncodingNameVp9   = "VP9"
+	ARtpMapEncodingNameOpus  = "opus"
+
+	ARtpMapEncodingNameOnvifMetadata = "vnd.onvif.metadata"
+)
+
+const (
+	MediaTypeAudio       = "audio"
+	MediaTypeVideo       = "video"
+	MediaTypeApplication = "application"
 )
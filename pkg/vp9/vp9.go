@@ -0,0 +1,302 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package vp9
+
+import (
+	"github.com/q191201771/naza/pkg/bele"
+	"github.com/q191201771/naza/pkg/nazabits"
+	"github.com/q191201771/naza/pkg/nazaerrors"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+)
+
+// VP9 bitstream:
+//   vp9-bitstream-specification-v0.6.pdf
+//   一个rtmp message或rtp合帧后的数据，是一个frame或者superframe（多个frame加上尾部的索引）。
+//   注意，superframe中的第一个frame放在数据的开头，所以只解析开头的uncompressed header就可以判断是否是关键帧。
+//
+// vpcC:
+//   VP-Codec-ISOBMFF.pdf, 2.3. VP Codec Configuration Box
+//   enhanced-rtmp vp09的SequenceStart中的数据。
+
+const (
+	FrameTypeKey    uint8 = 0
+	FrameTypeNonKey uint8 = 1
+
+	ColorSpaceRgb uint8 = 7
+
+	// ChromaSubsampling420Vertical ChromaSubsamplingXxx...
+	//
+	// vpcC中chromaSubsampling字段的取值
+	ChromaSubsampling420Vertical       uint8 = 0
+	ChromaSubsampling420CollocatedLuma uint8 = 1
+	ChromaSubsampling422               uint8 = 2
+	ChromaSubsampling444               uint8 = 3
+)
+
+const (
+	vpccLength    = 12
+	frameSyncCode = 0x498342
+
+	// vpcC中颜色相关的字段，2表示unspecified
+	colourUnspecified = 2
+)
+
+// FrameHeader
+//
+// vp9-bitstream-specification-v0.6.pdf, 6.2 Uncompressed header syntax
+//
+// 注意，只解析到frame_size()，并且只有关键帧才有BitDepth之后的字段
+type FrameHeader struct {
+	Profile           uint8
+	ShowExistingFrame uint8
+	FrameType         uint8
+	ShowFrame         uint8
+	BitDepth          uint8
+	ColorSpace        uint8
+	ColorRange        uint8
+	SubsamplingX      uint8
+	SubsamplingY      uint8
+	Width             uint32
+	Height            uint32
+}
+
+// DecoderConfigurationRecord vpcC
+//
+//	aligned (8) class VPCodecConfigurationRecord {
+//	  unsigned int (8) profile;
+//	  unsigned int (8) level;
+//	  unsigned int (4) bitDepth;
+//	  unsigned int (3) chromaSubsampling;
+//	  unsigned int (1) videoFullRangeFlag;
+//	  unsigned int (8) colourPrimaries;
+//	  unsigned int (8) transferCharacteristics;
+//	  unsigned int (8) matrixCoefficients;
+//	  unsigned int (16) codecInitializationDataSize;
+//	  unsigned int (8)[] codecInitializationData;
+//	}
+//
+// 注意，和ffmpeg保持一致，序列化时前面带有FullBox的4字节version和flags
+type DecoderConfigurationRecord struct {
+	Profile                 uint8
+	Level                   uint8
+	BitDepth                uint8
+	ChromaSubsampling       uint8
+	VideoFullRangeFlag      uint8
+	ColourPrimaries         uint8
+	TransferCharacteristics uint8
+	MatrixCoefficients      uint8
+}
+
+// ParseFrameHeader
+//
+// @param frame: frame或superframe
+func ParseFrameHeader(frame []byte, h *FrameHeader) error {
+	br := nazabits.NewBitReader(frame)
+
+	frameMarker, _ := br.ReadBits8(2)
+	if frameMarker != 2 {
+		return nazaerrors.Wrap(base.ErrVp9)
+	}
+	profileLowBit, _ := br.ReadBit()
+	profileHighBit, _ := br.ReadBit()
+	h.Profile = profileHighBit<<1 | profileLowBit
+	if h.Profile == 3 {
+		_ = br.SkipBits(1) // reserved_zero
+	}
+
+	h.ShowExistingFrame, _ = br.ReadBit()
+	if h.ShowExistingFrame == 1 {
+		_ = br.SkipBits(3) // frame_to_show_map_idx
+		return wrapBitReaderErr(&br)
+	}
+
+	h.FrameType, _ = br.ReadBit()
+	h.ShowFrame, _ = br.ReadBit()
+	_ = br.SkipBits(1) // error_resilient_mode
+	if h.FrameType != FrameTypeKey {
+		return wrapBitReaderErr(&br)
+	}
+
+	syncCode, _ := br.ReadBits32(24)
+	if br.Err() == nil && syncCode != frameSyncCode {
+		return nazaerrors.Wrap(base.ErrVp9)
+	}
+
+	// color_config()
+	h.BitDepth = 8
+	if h.Profile >= 2 {
+		tenOrTwelveBit, _ := br.ReadBit()
+		if tenOrTwelveBit == 1 {
+			h.BitDepth = 12
+		} else {
+			h.BitDepth = 10
+		}
+	}
+	h.ColorSpace, _ = br.ReadBits8(3)
+	if h.ColorSpace != ColorSpaceRgb {
+		h.ColorRange, _ = br.ReadBit()
+		if h.Profile == 1 || h.Profile == 3 {
+			h.SubsamplingX, _ = br.ReadBit()
+			h.SubsamplingY, _ = br.ReadBit()
+			_ = br.SkipBits(1) // reserved_zero
+		} else {
+			h.SubsamplingX, h.SubsamplingY = 1, 1
+		}
+	} else {
+		h.ColorRange = 1
+		if h.Profile == 1 || h.Profile == 3 {
+			h.SubsamplingX, h.SubsamplingY = 0, 0
+			_ = br.SkipBits(1) // reserved_zero
+		}
+	}
+
+	// frame_size()
+	frameWidthMinus1, _ := br.ReadBits16(16)
+	frameHeightMinus1, _ := br.ReadBits16(16)
+	h.Width = uint32(frameWidthMinus1) + 1
+	h.Height = uint32(frameHeightMinus1) + 1
+
+	return wrapBitReaderErr(&br)
+}
+
+func IsKeyFrame(frame []byte) bool {
+	var h FrameHeader
+	if err := ParseFrameHeader(frame, &h); err != nil {
+		return false
+	}
+	return h.ShowExistingFrame == 0 && h.FrameType == FrameTypeKey
+}
+
+// NewDecoderConfigurationRecord 使用关键帧的header生成vpcC
+func NewDecoderConfigurationRecord(h *FrameHeader) DecoderConfigurationRecord {
+	record := DecoderConfigurationRecord{
+		Profile:                 h.Profile,
+		Level:                   calcLevel(h.Width, h.Height),
+		BitDepth:                h.BitDepth,
+		VideoFullRangeFlag:      h.ColorRange,
+		ColourPrimaries:         colourUnspecified,
+		TransferCharacteristics: colourUnspecified,
+		MatrixCoefficients:      colourUnspecified,
+	}
+	if h.ColorSpace == ColorSpaceRgb {
+		record.MatrixCoefficients = 0
+	}
+	switch {
+	case h.SubsamplingX == 1 && h.SubsamplingY == 1:
+		record.ChromaSubsampling = ChromaSubsampling420CollocatedLuma
+	case h.SubsamplingX == 1 && h.SubsamplingY == 0:
+		record.ChromaSubsampling = ChromaSubsampling422
+	default:
+		record.ChromaSubsampling = ChromaSubsampling444
+	}
+	return record
+}
+
+// Pack
+//
+// @return 内存块为内部独立新申请
+func (r *DecoderConfigurationRecord) Pack() []byte {
+	out := make([]byte, vpccLength)
+	out[0] = 1 // version
+	// flags 3字节为0
+	out[4] = r.Profile
+	out[5] = r.Level
+	out[6] = r.BitDepth<<4 | (r.ChromaSubsampling&0x07)<<1 | r.VideoFullRangeFlag&0x01
+	out[7] = r.ColourPrimaries
+	out[8] = r.TransferCharacteristics
+	out[9] = r.MatrixCoefficients
+	bele.BePutUint16(out[10:], 0) // codecInitializationDataSize
+	return out
+}
+
+func ParseDecoderConfigurationRecord(b []byte) (r DecoderConfigurationRecord, err error) {
+	if len(b) < vpccLength {
+		return r, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	if b[0] != 1 {
+		return r, nazaerrors.Wrap(base.ErrVp9)
+	}
+	r.Profile = b[4]
+	r.Level = b[5]
+	r.BitDepth = b[6] >> 4
+	r.ChromaSubsampling = (b[6] >> 1) & 0x07
+	r.VideoFullRangeFlag = b[6] & 0x01
+	r.ColourPrimaries = b[7]
+	r.TransferCharacteristics = b[8]
+	r.MatrixCoefficients = b[9]
+	return r, nil
+}
+
+// BuildSeqHeaderFromKeyFrame 生成enhanced-rtmp vp09的SequenceStart
+//
+// @return 内存块为内部独立新申请
+func BuildSeqHeaderFromKeyFrame(frame []byte) ([]byte, error) {
+	var h FrameHeader
+	if err := ParseFrameHeader(frame, &h); err != nil {
+		return nil, err
+	}
+	if h.ShowExistingFrame == 1 || h.FrameType != FrameTypeKey {
+		return nil, nazaerrors.Wrap(base.ErrVp9)
+	}
+	record := NewDecoderConfigurationRecord(&h)
+	vpcc := record.Pack()
+
+	out := make([]byte, 5+len(vpcc))
+	out[0] = 0x80 | base.RtmpExFrameTypeKeyFrame<<4 | base.RtmpExPacketTypeSequenceStart
+	copy(out[1:], base.RtmpExFourCcVp9)
+	copy(out[5:], vpcc)
+	return out, nil
+}
+
+// ParseDecoderConfigurationRecordFromSeqHeader
+//
+// @param payload: enhanced-rtmp vp09的SequenceStart，rtmp message的payload部分或者flv tag的payload部分
+func ParseDecoderConfigurationRecordFromSeqHeader(payload []byte) (DecoderConfigurationRecord, error) {
+	if len(payload) < 5 {
+		return DecoderConfigurationRecord{}, nazaerrors.Wrap(base.ErrShortBuffer)
+	}
+	return ParseDecoderConfigurationRecord(payload[5:])
+}
+
+// ---------------------------------------------------------------------------------------------------------------------
+
+// calcLevel 只根据画面大小估算level
+//
+// https://www.webmproject.org/vp9/levels/
+func calcLevel(width, height uint32) uint8 {
+	levels := []struct {
+		level      uint8
+		maxPicSize uint32
+	}{
+		{10, 36864},
+		{11, 73728},
+		{20, 122880},
+		{21, 245760},
+		{30, 552960},
+		{31, 983040},
+		{40, 2228224},
+		{50, 8912896},
+		{60, 35651584},
+	}
+	picSize := width * height
+	for _, l := range levels {
+		if picSize <= l.maxPicSize {
+			return l.level
+		}
+	}
+	return 62
+}
+
+func wrapBitReaderErr(br *nazabits.BitReader) error {
+	if br.Err() != nil {
+		return nazaerrors.Wrap(base.ErrVp9)
+	}
+	return nil
+}
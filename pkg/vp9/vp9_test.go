@@ -0,0 +1,98 @@
+// Copyright 2023, Chef.  All rights reserved.
+// https://github.com/ysjhlnu/lal
+//
+// Use of this source code is governed by a MIT-style license
+// that can be found in the License file.
+//
+// Author: Chef (191201771@qq.com)
+
+package vp9_test
+
+import (
+	"testing"
+
+	"github.com/q191201771/naza/pkg/assert"
+	"github.com/q191201771/naza/pkg/nazabits"
+
+	"github.com/ysjhlnu/lal/pkg/base"
+	"github.com/ysjhlnu/lal/pkg/vp9"
+)
+
+// goldenKeyFrame profile 0，1280x720
+var goldenKeyFrame = []byte{0x82, 0x49, 0x83, 0x42, 0x00, 0x4f, 0xf0, 0x2c, 0xf0, 0x00, 0x00}
+
+// goldenInterFrame profile 0
+var goldenInterFrame = []byte{0x86, 0x00, 0x40, 0x92}
+
+func TestParseFrameHeader(t *testing.T) {
+	var h vp9.FrameHeader
+	err := vp9.ParseFrameHeader(goldenKeyFrame, &h)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint8(0), h.Profile)
+	assert.Equal(t, vp9.FrameTypeKey, h.FrameType)
+	assert.Equal(t, uint8(1), h.ShowFrame)
+	assert.Equal(t, uint8(8), h.BitDepth)
+	assert.Equal(t, uint32(1280), h.Width)
+	assert.Equal(t, uint32(720), h.Height)
+	assert.Equal(t, true, vp9.IsKeyFrame(goldenKeyFrame))
+
+	err = vp9.ParseFrameHeader(goldenInterFrame, &h)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, vp9.FrameTypeNonKey, h.FrameType)
+	assert.Equal(t, false, vp9.IsKeyFrame(goldenInterFrame))
+
+	// profile 2，10bit
+	b := make([]byte, 16)
+	bw := nazabits.NewBitWriter(b)
+	bw.WriteBits8(2, 2)        // frame_marker
+	bw.WriteBits8(2, 1)        // profile_low_bit=0, profile_high_bit=1
+	bw.WriteBits8(4, 0x2)      // show_existing_frame=0, frame_type=0, show_frame=1, error_resilient_mode=0
+	bw.WriteBits16(16, 0x4983) // frame_sync_code
+	bw.WriteBits8(8, 0x42)
+	bw.WriteBits8(1, 0)        // ten_or_twelve_bit
+	bw.WriteBits8(3, 2)        // color_space
+	bw.WriteBits8(1, 1)        // color_range
+	bw.WriteBits16(16, 3840-1) // frame_width_minus_1
+	bw.WriteBits16(16, 2160-1) // frame_height_minus_1
+	err = vp9.ParseFrameHeader(b, &h)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint8(2), h.Profile)
+	assert.Equal(t, uint8(10), h.BitDepth)
+	assert.Equal(t, uint8(1), h.ColorRange)
+	assert.Equal(t, uint32(3840), h.Width)
+	assert.Equal(t, uint32(2160), h.Height)
+
+	// 错误的frame_marker
+	err = vp9.ParseFrameHeader([]byte{0x02}, &h)
+	assert.IsNotNil(t, err)
+	// 错误的sync code
+	err = vp9.ParseFrameHeader([]byte{0x82, 0x49, 0x83, 0x43, 0x00, 0x4f, 0xf0, 0x2c, 0xf0, 0x00, 0x00}, &h)
+	assert.IsNotNil(t, err)
+	// 长度不够
+	err = vp9.ParseFrameHeader(goldenKeyFrame[:5], &h)
+	assert.IsNotNil(t, err)
+}
+
+func TestSeqHeader(t *testing.T) {
+	sh, err := vp9.BuildSeqHeaderFromKeyFrame(goldenKeyFrame)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []byte{0x90, 'v', 'p', '0', '9', 1, 0, 0, 0, 0, 31, 0x82, 2, 2, 2, 0, 0}, sh)
+
+	msg := base.RtmpMsg{
+		Header:  base.RtmpHeader{MsgTypeId: base.RtmpTypeIdVideo},
+		Payload: sh,
+	}
+	assert.Equal(t, true, msg.IsVp9KeySeqHeader())
+	assert.Equal(t, true, msg.IsVideoKeySeqHeader())
+	assert.Equal(t, false, msg.IsVideoKeyNalu())
+	assert.Equal(t, base.RtmpCodecIdVp9, msg.VideoCodecId())
+
+	record, err := vp9.ParseDecoderConfigurationRecordFromSeqHeader(sh)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, uint8(31), record.Level)
+	assert.Equal(t, uint8(8), record.BitDepth)
+	assert.Equal(t, vp9.ChromaSubsampling420CollocatedLuma, record.ChromaSubsampling)
+
+	_, err = vp9.BuildSeqHeaderFromKeyFrame(goldenInterFrame)
+	assert.IsNotNil(t, err)
+}